@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// adminOnly restricts the handler to the users listed in --admin-user.
+// Without authentication configured the admin API is disabled.
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return auth.Middleware(func(res http.ResponseWriter, r *http.Request) {
+		if !auth.Enabled() {
+			writeError(res, http.StatusForbidden, errCodeDisabled, "Admin API requires authentication to be configured")
+			return
+		}
+
+		if !isAdmin(r) {
+			writeError(res, http.StatusForbidden, errCodeForbidden, "Admin access required")
+			return
+		}
+		next(res, r)
+	})
+}
+
+// isAdmin tells whether the user of the request is listed in
+// --admin-user, all users are admins if the list is empty
+func isAdmin(r *http.Request) bool {
+	if !auth.Enabled() {
+		return false
+	}
+
+	admins := nonEmpty(cfg.AdminUser)
+	if len(admins) == 0 {
+		return true
+	}
+
+	user := requestUser(r)
+	for _, a := range admins {
+		if a == user {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(res http.ResponseWriter, status int, v interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(v)
+}
+
+type saneStatus struct {
+	ConfigDir string           `json:"config_dir"`
+	Devices   []scanner.Device `json:"devices"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// handleAdminSANEReinit switches the SANE configuration directory (which
+// contains dll.conf selecting the backends to load) and reinitializes the
+// SANE layer. The switch waits for a running scan to finish and is
+// reverted when no devices can be listed afterwards.
+func handleAdminSANEReinit(res http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ConfigDir *string `json:"config_dir"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, "Invalid JSON body")
+		return
+	}
+
+	if req.ConfigDir != nil && *req.ConfigDir != "" {
+		if fi, err := os.Stat(*req.ConfigDir); err != nil || !fi.IsDir() {
+			writeError(res, http.StatusBadRequest, errCodeInvalidParameter, "Config dir does not exist")
+			return
+		}
+	}
+
+	var (
+		devs     []scanner.Device
+		previous string
+	)
+	reinit := func() error {
+		return saneScanner.Exclusive(func(list func() ([]scanner.Device, error)) (err error) {
+			previous = os.Getenv("SANE_CONFIG_DIR")
+			if req.ConfigDir != nil {
+				os.Setenv("SANE_CONFIG_DIR", *req.ConfigDir)
+			}
+
+			if devs, err = list(); err != nil {
+				os.Setenv("SANE_CONFIG_DIR", previous)
+			}
+			return err
+		})
+	}
+
+	var err error
+	if scanPool != nil {
+		// The devices of the pool keep SANE initialized otherwise
+		err = scanPool.Exclusive(reinit)
+	} else {
+		err = reinit()
+	}
+	if err != nil {
+		log.WithError(err).Error("SANE reinitialization failed, reverted config dir")
+		writeJSON(res, http.StatusInternalServerError, saneStatus{ConfigDir: previous, Error: err.Error()})
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"config_dir": os.Getenv("SANE_CONFIG_DIR"),
+		"devices":    len(devs),
+		"user":       requestUser(r),
+	}).Info("SANE reinitialized")
+	writeJSON(res, http.StatusOK, saneStatus{ConfigDir: os.Getenv("SANE_CONFIG_DIR"), Devices: devs})
+}
+
+// defaultResetTimeout is the time POST /admin/reset waits for cancelled
+// scans to release the scanner
+const defaultResetTimeout = 30 * time.Second
+
+// handleAdminReset recovers from a wedged SANE backend without
+// restarting the daemon: scans reading pages are cancelled (partial
+// scans are kept for resuming), the kept device is closed and SANE is
+// torn down and initialized again. Jobs waiting for the scanner, the
+// history and all other state are kept.
+func handleAdminReset(res http.ResponseWriter, r *http.Request) {
+	timeout := defaultResetTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(res, http.StatusBadRequest, errCodeInvalidParameter, "timeout must be a positive duration like '30s'")
+			return
+		}
+		timeout = d
+	}
+
+	cancelled := runningJobs.CancelScanning(errBackendReset)
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	var devs []scanner.Device
+	reset := func() (err error) {
+		devs, err = saneScanner.Reset(ctx)
+		return err
+	}
+
+	var err error
+	if scanPool != nil {
+		// The devices of the pool keep SANE initialized otherwise
+		err = scanPool.ExclusiveContext(ctx, reset)
+	} else {
+		err = reset()
+	}
+
+	logger := log.WithFields(log.Fields{
+		"cancelled_jobs": cancelled,
+		"user":           requestUser(r),
+	})
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		logger.Error("SANE reset failed, scanner is still in use")
+		writeError(res, http.StatusConflict, errCodeScannerBusy, "Scanner is still in use after "+timeout.String()+", the backend might need a restart of the daemon")
+		return
+
+	case err != nil:
+		logger.WithError(err).Error("SANE reset failed")
+		writeError(res, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+
+	if devs == nil {
+		devs = []scanner.Device{}
+	}
+	logger.WithField("devices", len(devs)).Info("SANE backend reset")
+	writeJSON(res, http.StatusOK, struct {
+		Devices       []scanner.Device `json:"devices"`
+		CancelledJobs []string         `json:"cancelled_jobs"`
+	}{devs, cancelled})
+}
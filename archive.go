@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+)
+
+// archivePages returns the originals of the pages as scanned, keeping
+// the sections and the rotation chosen for the processed pages
+func archivePages(pages []*scanner.Page) []*scanner.Page {
+	out := []*scanner.Page{}
+	for _, p := range pages {
+		if p.Original == nil {
+			continue
+		}
+		o := *p.Original
+		o.Section, o.Rotate = p.Section, p.Rotate
+		out = append(out, &o)
+	}
+	return out
+}
+
+// deliverArchive renders the originals of the pages into a single PDF
+// and delivers it to the archive targets alongside the optimized
+// document described by doc
+func deliverArchive(res http.ResponseWriter, params *scanParams, pages []*scanner.Page, targets []string, doc *deliveryDocument) {
+	logger := params.logger()
+	if len(targets) == 0 {
+		logger.Warn("Archival copy requested but the matching route has no archive targets")
+		res.Header().Add("X-Scan-Warning", "The matching route has no archive targets, no archival copy was delivered")
+		return
+	}
+
+	originals := archivePages(pages)
+	if len(originals) == 0 {
+		// Pages captured before resuming a scan without archive
+		logger.Warn("No originals available for the archival copy")
+		res.Header().Add("X-Scan-Warning", "The scanned originals are not available, no archival copy was delivered")
+		return
+	}
+
+	// The archive contains the scanned pages only, always as one document
+	archiveParams := *params
+	archiveParams.Cover, archiveParams.PageNumbers, archiveParams.Existing = false, false, nil
+
+	file, err := renderTempFile(func(w io.Writer) error { return writePDF(w, &archiveParams, originals) })
+	if err != nil {
+		logger.WithError(err).Error("Unable to generate archival copy")
+		res.Header().Add("X-Scan-Warning", "Unable to generate the archival copy")
+		return
+	}
+
+	archived := *doc
+	archived.File = file
+	archived.Filename = strings.TrimSuffix(doc.Filename, filepath.Ext(doc.Filename)) + "_original.pdf"
+	archived.ContentType = "application/pdf"
+	archived.Pages = len(originals)
+
+	res.Header().Set("X-Archive-Targets", strings.Join(targets, ", "))
+	deliverScan(targets, &archived, true)
+}
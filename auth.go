@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type contextKey int
+
+const (
+	ctxKeyUser contextKey = iota
+	// ctxKeyJobID presets the ID of the job started by the request
+	ctxKeyJobID
+	// ctxKeyRequestID is the ID assigned by logRequests
+	ctxKeyRequestID
+)
+
+// authenticator checks the credentials of a request. If the request
+// does not carry credentials handled by the authenticator ok is false
+// and the next authenticator in the chain is asked.
+type authenticator interface {
+	Authenticate(r *http.Request) (user string, ok bool)
+}
+
+// authChain tries all configured authenticators in order and accepts
+// the request as soon as one of them accepts it. An empty chain
+// disables authentication.
+type authChain []authenticator
+
+// authConfig holds the chain used for all requests, it is replaced when
+// the configuration is reloaded
+type authConfig struct {
+	chain authChain
+	lock  sync.RWMutex
+}
+
+var auth = &authConfig{}
+
+func buildAuthChain() (authChain, error) {
+	chain := authChain{}
+
+	if entries := nonEmpty(cfg.AuthBasic); len(entries) > 0 {
+		a, err := newBasicAuthenticator(entries)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, a)
+	}
+
+	tokens := nonEmpty(cfg.AuthToken)
+	if cfg.AuthTokenFile != "" {
+		fileTokens, err := readTokenFile(cfg.AuthTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, fileTokens...)
+	}
+
+	if len(tokens) > 0 {
+		a, err := newTokenAuthenticator(tokens)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, a)
+	}
+
+	if cfg.OIDCIssuer != "" {
+		// Tokens of the provider issued for any other application (e.g.
+		// a public client) would be accepted otherwise
+		if cfg.OIDCAudience == "" {
+			return nil, fmt.Errorf("--oidc-issuer requires the client ID of the daemon in --oidc-audience")
+		}
+		chain = append(chain, newOIDCAuthenticator(cfg.OIDCIssuer, cfg.OIDCAudience, cfg.OIDCUserClaim))
+	}
+
+	if cfg.TLSClientCA != "" {
+		chain = append(chain, clientCertAuthenticator{})
+	}
+
+	if cfg.AuthProxyHeader != "" {
+		trusted, err := parseNetworks("auth-proxy-trusted", cfg.AuthProxyTrusted)
+		if err != nil {
+			return nil, err
+		}
+		if len(trusted) == 0 {
+			return nil, fmt.Errorf("--auth-proxy-header requires the networks of the proxy in --auth-proxy-trusted")
+		}
+		chain = append(chain, proxyHeaderAuthenticator{header: cfg.AuthProxyHeader, trusted: trusted})
+	}
+
+	return chain, nil
+}
+
+// readTokenFile reads the 'name:token' entries of --auth-token-file, one
+// per line, empty lines and lines starting with # are ignored
+func readTokenFile(file string) ([]string, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read token file: %s", err)
+	}
+
+	var entries []string
+	for _, line := range strings.Split(string(raw), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			entries = append(entries, line)
+		}
+	}
+	return entries, nil
+}
+
+func (a *authConfig) Set(chain authChain) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.chain = chain
+}
+
+func (a *authConfig) current() authChain {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.chain
+}
+
+// Enabled tells whether any authenticator is configured
+func (a *authConfig) Enabled() bool {
+	return len(a.current()) > 0
+}
+
+// Middleware rejects requests not accepted by any authenticator of the
+// current chain
+func (a *authConfig) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, r *http.Request) {
+		a.current().Middleware(next)(res, r)
+	}
+}
+
+func (a *authConfig) authenticate(r *http.Request) (*http.Request, bool) {
+	return a.current().authenticate(r)
+}
+
+// Middleware rejects requests not accepted by any authenticator and
+// stores the authenticated user in the request context
+func (a authChain) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, r *http.Request) {
+		if !requestNetworkAllowed(r) {
+			log.WithField("remote", r.RemoteAddr).Warn("Rejected request from network not allowed by --allow-cidr")
+			writeError(res, http.StatusForbidden, errCodeForbidden, "Requests from your network are not allowed")
+			return
+		}
+
+		if r, ok := a.authenticate(r); ok {
+			next(res, r)
+			return
+		}
+
+		log.WithField("remote", r.RemoteAddr).Warn("Rejected unauthenticated request")
+		for _, au := range a {
+			if _, ok := au.(basicAuthenticator); ok {
+				res.Header().Set("WWW-Authenticate", `Basic realm="scansnap-go"`)
+			}
+		}
+		writeError(res, http.StatusUnauthorized, errCodeUnauthorized, "Authentication required")
+	}
+}
+
+// authenticate returns the request carrying the authenticated user,
+// ok is false if no authenticator accepts the request
+func (a authChain) authenticate(r *http.Request) (*http.Request, bool) {
+	if len(a) == 0 {
+		return r, true
+	}
+
+	for _, au := range a {
+		if user, ok := au.Authenticate(r); ok {
+			return r.WithContext(context.WithValue(r.Context(), ctxKeyUser, user)), true
+		}
+	}
+	return r, false
+}
+
+// requestUser returns the authenticated user of the request (empty if
+// authentication is disabled)
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(ctxKeyUser).(string)
+	return user
+}
+
+// secretMatches compares the given secret with the configured one which
+// is either stored in plain text or as "sha256:<hex digest>"
+func secretMatches(configured, given string) bool {
+	if strings.HasPrefix(configured, "sha256:") {
+		sum := sha256.Sum256([]byte(given))
+		given = hex.EncodeToString(sum[:])
+		configured = strings.TrimPrefix(configured, "sha256:")
+	}
+	return subtle.ConstantTimeCompare([]byte(configured), []byte(given)) == 1
+}
+
+// splitCredential splits a "name:secret" configuration entry
+func splitCredential(entry string) (string, string, error) {
+	parts := strings.SplitN(entry, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid credential %q, expected format 'name:secret'", strings.SplitN(entry, ":", 2)[0])
+	}
+	return parts[0], parts[1], nil
+}
+
+// basicAuthenticator accepts HTTP basic auth credentials
+type basicAuthenticator map[string]string
+
+func newBasicAuthenticator(entries []string) (basicAuthenticator, error) {
+	b := basicAuthenticator{}
+	for _, e := range entries {
+		user, pass, err := splitCredential(e)
+		if err != nil {
+			return nil, err
+		}
+		b[user] = pass
+	}
+	return b, nil
+}
+
+func (b basicAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+
+	expected, exists := b[user]
+	if !exists || !secretMatches(expected, pass) {
+		return "", false
+	}
+
+	return user, true
+}
+
+// tokenAuthenticator accepts bearer tokens for machine-to-machine use
+type tokenAuthenticator map[string]string
+
+func newTokenAuthenticator(entries []string) (tokenAuthenticator, error) {
+	t := tokenAuthenticator{}
+	for _, e := range entries {
+		name, token, err := splitCredential(e)
+		if err != nil {
+			return nil, err
+		}
+		t[name] = token
+	}
+	return t, nil
+}
+
+func (t tokenAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+	given := strings.TrimPrefix(header, "Bearer ")
+
+	for name, token := range t {
+		if secretMatches(token, given) {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// proxyHeaderAuthenticator accepts the user set in a header by an
+// authenticating reverse proxy, the header is ignored on requests not
+// coming from the trusted proxies
+type proxyHeaderAuthenticator struct {
+	header  string
+	trusted []*net.IPNet
+}
+
+func (p proxyHeaderAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	user := strings.TrimSpace(r.Header.Get(p.header))
+	if user == "" || !requestFromNetworks(r, p.trusted) {
+		return "", false
+	}
+	return user, true
+}
+
+// clientCertAuthenticator accepts requests presenting a TLS client
+// certificate verified against the configured CA (mutual TLS)
+type clientCertAuthenticator struct{}
+
+func (clientCertAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+}
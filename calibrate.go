@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxCalibrationReference limits the size of the posted reference file
+const maxCalibrationReference = 1 << 20
+
+// loadColorProfile reads the --icc-profile
+func loadColorProfile(file string) (*scanner.ColorProfile, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read color profile: %s", err)
+	}
+
+	profile, err := scanner.ParseColorProfile(data)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse color profile: %s", err)
+	}
+	return profile, nil
+}
+
+// handleAdminCalibrate scans an IT8.7/2 target and responds with the
+// color profile derived from it using the reference values posted as
+// CGATS file (supplied with the target). The scan parameters of
+// /scan.pdf apply, the pipeline is empty unless given to not alter the
+// colors and the profile of --icc-profile is not applied.
+func handleAdminCalibrate(res http.ResponseWriter, r *http.Request) {
+	raw, err := ioutil.ReadAll(http.MaxBytesReader(res, r.Body, maxCalibrationReference))
+	if err != nil {
+		writeError(res, http.StatusRequestEntityTooLarge, errCodeInvalidParameter, "Reference file is too large")
+		return
+	}
+	reference, err := scanner.ParseIT8Reference(raw)
+	if err != nil {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("Invalid reference file: %s", err))
+		return
+	}
+
+	params, err := parseScanParams(r)
+	if err != nil {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	params.JobID = newID()
+	params.User = requestUser(r)
+	params.RequestID = requestID(r)
+	params.Calibration = true
+	params.Color = scanner.ColorModeColor
+	params.Duplex = false
+	params.MaxPages = 1
+	if r.URL.Query().Get("pipeline") == "" {
+		params.Pipeline = scanner.Pipeline{}
+	}
+	res.Header().Set("X-Job-ID", params.JobID)
+
+	pages, skipped, err := scanAndProcessPages(params, 0)
+	if err != nil {
+		params.logger().WithError(err).Error("Unable to scan calibration target")
+		writeScanError(res, params.JobID, err)
+		return
+	}
+	if len(pages) == 0 {
+		msg := "Unable to process calibration target"
+		if len(skipped) > 0 {
+			msg = skipped.Error()
+		}
+		writeError(res, http.StatusInternalServerError, errCodeInternal, msg)
+		return
+	}
+
+	img, err := pages[0].DecodedImage()
+	if err != nil || img == nil {
+		params.logger().WithError(err).Error("Unable to read calibration target")
+		writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to read calibration target")
+		return
+	}
+
+	profile, deltaE, err := scanner.CalibrateIT8(img, reference)
+	if err != nil {
+		writeError(res, http.StatusUnprocessableEntity, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	params.logger().WithField("delta_e", deltaE).Info("Created color profile from calibration target")
+	res.Header().Set("Content-Type", "application/vnd.iccprofile")
+	res.Header().Set("Content-Disposition", contentDisposition("scanner.icc"))
+	res.Header().Set("X-Calibration-Delta-E", strconv.FormatFloat(deltaE, 'f', 2, 64))
+	if _, err := res.Write(profile.Data()); err != nil {
+		log.WithError(err).Debug("Unable to send color profile")
+	}
+}
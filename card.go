@@ -0,0 +1,224 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+)
+
+// cardDefaults are the parameters of business card scans not given by
+// the request or its profile: the card is cropped and recognized
+var cardDefaults = map[string]string{
+	"blank-pages": blankPagesBacks,
+	"color":       scanner.ColorModeColor,
+	"duplex":      "false",
+	"pdf-dpi":     "300",
+	"pipeline":    "crop margin=1, ocr",
+	"scan-dpi":    "300",
+}
+
+// cardScanArea is the width and height of the scan area for cards in
+// mm, an ID-1 card (85.6 x 54 mm) fed in either direction fits
+const cardScanArea = 90.0
+
+var (
+	cardEmailPattern  = regexp.MustCompile(`(?i)[a-z0-9._%+-]+@[a-z0-9.-]+\.[a-z]{2,}`)
+	cardURLPattern    = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[a-z0-9.-]+\.[a-z]{2,}(?:/\S*)?`)
+	cardPhonePattern  = regexp.MustCompile(`\+?\(?\d[\d ()/.-]{5,}\d`)
+	cardPostalPattern = regexp.MustCompile(`^(?:[A-Z]{1,2}-)?\d{4,5} \p{Lu}`)
+	cardOrgPattern    = regexp.MustCompile(`(?i)\b(?:GmbH|AG|KG|e\.V\.|Inc\.?|Ltd\.?|LLC|Corp\.?|S\.A\.|S\.r\.l\.|B\.V\.)(?:\s|$)`)
+	cardNamePattern   = regexp.MustCompile(`^(?:(?:Dr|Prof)\.\s)?\p{Lu}[\p{L}'-]+(?:\s\p{Lu}[\p{L}'.-]*){1,3}$`)
+)
+
+// card is a business card with its back side if scanned in duplex
+type card struct {
+	front, back *scanner.Page
+}
+
+// scannedCards pairs the pages to cards, back sides without content
+// removed by blank-pages leave the card without back
+func scannedCards(params *scanParams, pages []*scanner.Page) []card {
+	cards := []card{}
+	for _, sheet := range splitSheets(pages, params.Duplex) {
+		c := card{front: sheet[0]}
+		if len(sheet) > 1 {
+			c.back = sheet[1]
+		}
+		cards = append(cards, c)
+	}
+	return cards
+}
+
+// writeCardZIP writes every card as image files and the contact
+// recognized on it as vCard into a ZIP archive
+func writeCardZIP(w io.Writer, params *scanParams, pages []*scanner.Page, base string) error {
+	var (
+		zw   = zip.NewWriter(w)
+		meta = imageMetadata(params)
+	)
+
+	for i, c := range scannedCards(params, pages) {
+		name := fmt.Sprintf("%s_%03d", base, i+1)
+		if err := addZIPImage(zw, name, c.front, meta); err != nil {
+			return fmt.Errorf("Unable to add card %d to archive: %s", i+1, err)
+		}
+		if c.back != nil {
+			if err := addZIPImage(zw, name+"_back", c.back, meta); err != nil {
+				return fmt.Errorf("Unable to add back side of card %d to archive: %s", i+1, err)
+			}
+		}
+
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     name + ".vcf",
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to add contact %d to archive: %s", i+1, err)
+		}
+		if _, err = fw.Write(c.vCard(i + 1)); err != nil {
+			return fmt.Errorf("Unable to write contact %d: %s", i+1, err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("Unable to finalize archive: %s", err)
+	}
+
+	return nil
+}
+
+// lines returns the recognized lines of the card, the back side
+// following the front
+func (c card) lines() []string {
+	lines := []string{}
+	for _, p := range []*scanner.Page{c.front, c.back} {
+		if p != nil {
+			lines = append(lines, pageLines(p)...)
+		}
+	}
+	return lines
+}
+
+// pageLines returns the text of the recognized lines of the page
+func pageLines(p *scanner.Page) []string {
+	lines := []string{}
+	for _, l := range (jobTextPage{Words: p.Words}).lines() {
+		words := []string{}
+		for _, w := range l.Words {
+			words = append(words, w.Text)
+		}
+		lines = append(lines, strings.Join(words, " "))
+	}
+	return lines
+}
+
+// vCard guesses the fields of the contact from the recognized lines
+// and returns them as vCard 3.0, the full text is kept as note to
+// correct the guesses. Cards without a recognized name are named by
+// their number.
+func (c card) vCard(number int) []byte {
+	var (
+		lines                    = c.lines()
+		nameLine                 = -1
+		name, title, org         string
+		street, postal, locality string
+		emails, urls             []string
+		phones                   [][2]string
+	)
+
+	for i, l := range lines {
+		switch {
+		case cardEmailPattern.MatchString(l):
+			emails = append(emails, cardEmailPattern.FindAllString(l, -1)...)
+		case cardURLPattern.MatchString(l):
+			urls = append(urls, cardURLPattern.FindString(l))
+		case cardPostalPattern.MatchString(l) && postal == "":
+			fields := strings.SplitN(l, " ", 2)
+			postal, locality = fields[0], fields[1]
+			if i > 0 && strings.ContainsAny(lines[i-1], "0123456789") && !cardPhonePattern.MatchString(lines[i-1]) {
+				street = lines[i-1]
+			}
+		case cardPhonePattern.MatchString(l):
+			phones = append(phones, [2]string{phoneType(l), strings.TrimSpace(cardPhonePattern.FindString(l))})
+		case cardOrgPattern.MatchString(l) && org == "":
+			org = l
+		case cardNamePattern.MatchString(l) && name == "":
+			name, nameLine = l, i
+		}
+	}
+
+	if nameLine >= 0 && nameLine+1 < len(lines) {
+		// The position is usually printed below the name
+		if next := lines[nameLine+1]; next != org && next != street && !strings.ContainsAny(next, "0123456789@") {
+			title = next
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	line := func(format string, args ...interface{}) { fmt.Fprintf(buf, format+"\r\n", args...) }
+
+	line("BEGIN:VCARD")
+	line("VERSION:3.0")
+	if name != "" {
+		var (
+			parts  = strings.Fields(name)
+			prefix string
+		)
+		if strings.HasSuffix(parts[0], ".") {
+			prefix, parts = parts[0], parts[1:]
+		}
+		line("FN:%s", vCardEscape(name))
+		line("N:%s;%s;;%s;", vCardEscape(parts[len(parts)-1]), vCardEscape(strings.Join(parts[:len(parts)-1], " ")), vCardEscape(prefix))
+	} else {
+		line("FN:Business card %d", number)
+		line("N:;;;;")
+	}
+	if title != "" {
+		line("TITLE:%s", vCardEscape(title))
+	}
+	if org != "" {
+		line("ORG:%s", vCardEscape(org))
+	}
+	for _, e := range emails {
+		line("EMAIL;TYPE=INTERNET,WORK:%s", vCardEscape(e))
+	}
+	for _, p := range phones {
+		line("TEL;TYPE=%s:%s", p[0], vCardEscape(p[1]))
+	}
+	if postal != "" {
+		line("ADR;TYPE=WORK:;;%s;%s;;%s;", vCardEscape(street), vCardEscape(locality), vCardEscape(postal))
+	}
+	for _, u := range urls {
+		line("URL:%s", vCardEscape(u))
+	}
+	if len(lines) > 0 {
+		line("NOTE:%s", vCardEscape(strings.Join(lines, "\n")))
+	}
+	line("END:VCARD")
+
+	return buf.Bytes()
+}
+
+// phoneType returns the vCard type of the number by its label
+func phoneType(line string) string {
+	l := strings.ToLower(line)
+	switch {
+	case strings.Contains(l, "fax"):
+		return "WORK,FAX"
+	case strings.Contains(l, "mobil"), strings.Contains(l, "cell"), strings.Contains(l, "handy"):
+		return "CELL"
+	default:
+		return "WORK,VOICE"
+	}
+}
+
+func vCardEscape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\n", `\n`).Replace(v)
+}
@@ -0,0 +1,51 @@
+#!/bin/bash
+# Builds the release assets of the tag given as argument into dist/:
+# an archive per platform named scansnap-go_<tag>_<os>_<arch> (.tar.gz,
+# .zip for Windows), their SHA256SUMS and its Ed25519 signature
+# SHA256SUMS.sig made using the private key in $RELEASE_SIGNING_KEY_FILE
+# (PEM, e.g. "openssl genpkey -algorithm ed25519"). The public key is
+# pinned into the binaries, selfupdate only installs releases signed by
+# it.
+set -euo pipefail
+
+tag=${1:?usage: $0 <tag>}
+key=${RELEASE_SIGNING_KEY_FILE:?RELEASE_SIGNING_KEY_FILE is required}
+pubkey=$(openssl pkey -in "${key}" -pubout -outform DER | tail -c 32 | base64)
+
+# <GOOS>/<GOARCH>/<C compiler>: Linux builds use SANE through cgo and
+# need libsane-dev of the architecture, Windows builds use WIA
+targets=(
+  linux/amd64/x86_64-linux-gnu-gcc
+  linux/arm64/aarch64-linux-gnu-gcc
+  linux/arm/arm-linux-gnueabihf-gcc
+  windows/amd64/
+)
+
+rm -rf dist
+mkdir -p dist
+
+for target in "${targets[@]}"; do
+  IFS=/ read -r goos goarch cc <<<"${target}"
+  name="scansnap-go_${tag}_${goos}_${goarch}"
+  bin=scansnap-go
+  [[ ${goos} == windows ]] && bin=scansnap-go.exe
+
+  cgo=0
+  [[ -n ${cc} ]] && cgo=1
+
+  build=$(mktemp -d)
+  echo "Building ${name}"
+  GOOS=${goos} GOARCH=${goarch} GOARM=7 CGO_ENABLED=${cgo} CC=${cc} \
+    go build -trimpath -ldflags "-s -w -X main.version=${tag} -X main.updatePublicKey=${pubkey}" -o "${build}/${bin}" .
+  cp LICENSE README.md "${build}/"
+
+  if [[ ${goos} == windows ]]; then
+    (cd "${build}" && zip -q "${OLDPWD}/dist/${name}.zip" ./*)
+  else
+    tar -czf "dist/${name}.tar.gz" -C "${build}" .
+  fi
+  rm -rf "${build}"
+done
+
+(cd dist && sha256sum ./*.tar.gz ./*.zip | sed 's# \./# #' >SHA256SUMS)
+openssl pkeyutl -sign -inkey "${key}" -rawin -in dist/SHA256SUMS -out dist/SHA256SUMS.sig
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// claimDefaultTTL is the time a claim lasts without ttl parameter,
+	// every scan of the holder extends it by its TTL again
+	claimDefaultTTL = 15 * time.Minute
+	// claimMaxTTL limits claims forgotten to be released
+	claimMaxTTL = 8 * time.Hour
+)
+
+var errNotClaimed = errors.New("Scanner is not claimed")
+
+// claimedError rejects the scans of others while the scanner is
+// reserved for a person
+type claimedError struct {
+	Name    string
+	Expires time.Time
+}
+
+func (c claimedError) Error() string {
+	return c.localize(defaultLanguage)
+}
+
+// localize returns the message of the error in the language
+func (c claimedError) localize(lang string) string {
+	return localize(lang, "Scanner is in use by %s until %s", c.Name, c.Expires.Format("15:04"))
+}
+
+// scannerClaim reserves the scanner for one person, e.g. in a shared
+// office for a session of several batches not to be interleaved with
+// the pages of others
+type scannerClaim struct {
+	Name    string        `json:"name"`
+	User    string        `json:"user,omitempty"`
+	Created time.Time     `json:"created"`
+	Expires time.Time     `json:"expires"`
+	TTL     time.Duration `json:"-"`
+
+	token string
+}
+
+type claimStore struct {
+	claim *scannerClaim
+	lock  sync.Mutex
+}
+
+var scannerClaims = &claimStore{}
+
+// current returns the active claim, nil if there is none, the caller
+// must hold the lock
+func (c *claimStore) current() *scannerClaim {
+	if c.claim != nil && time.Now().After(c.claim.Expires) {
+		log.WithField("name", c.claim.Name).Info("Claim of the scanner expired")
+		c.claim = nil
+	}
+	return c.claim
+}
+
+// heldBy tells whether the request having the token and user is made
+// by the holder of the claim: it has the token of the claim or is made
+// by the authenticated user having claimed the scanner
+func (c *scannerClaim) heldBy(token, user string) bool {
+	if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) == 1 {
+		return true
+	}
+	return c.User != "" && c.User == user
+}
+
+// Claim reserves the scanner for the name, the holder of the active
+// claim renews it. The token is returned with the claim.
+func (c *claimStore) Claim(name, user, token string, ttl time.Duration) (scannerClaim, string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	claim := c.current()
+	switch {
+	case claim == nil:
+		claim = &scannerClaim{Name: name, User: user, Created: time.Now(), token: newID() + newID()}
+		c.claim = claim
+	case !claim.heldBy(token, user):
+		return scannerClaim{}, "", claimedError{claim.Name, claim.Expires}
+	}
+
+	claim.TTL = ttl
+	claim.Expires = time.Now().Add(ttl)
+	return *claim, claim.token, nil
+}
+
+// Release ends the claim of the holder, force ends any claim
+func (c *claimStore) Release(token, user string, force bool) (scannerClaim, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	claim := c.current()
+	switch {
+	case claim == nil:
+		return scannerClaim{}, errNotClaimed
+	case !force && !claim.heldBy(token, user):
+		return scannerClaim{}, claimedError{claim.Name, claim.Expires}
+	}
+
+	c.claim = nil
+	return *claim, nil
+}
+
+// Status returns the active claim, false if the scanner is not claimed
+func (c *claimStore) Status() (scannerClaim, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	claim := c.current()
+	if claim == nil {
+		return scannerClaim{}, false
+	}
+	return *claim, true
+}
+
+// Check returns a claimedError for scans of others than the holder of
+// the claim, scans of the holder extend the claim by its TTL
+func (c *claimStore) Check(params *scanParams) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	claim := c.current()
+	if claim == nil {
+		return nil
+	}
+	if !claim.heldBy(params.ClaimToken, params.User) {
+		return claimedError{claim.Name, claim.Expires}
+	}
+
+	if e := time.Now().Add(claim.TTL); e.After(claim.Expires) {
+		claim.Expires = e
+	}
+	return nil
+}
+
+// writeClaimedError responds with 423 and the time the claim expires
+func writeClaimedError(res http.ResponseWriter, err claimedError) {
+	res.Header().Set("Retry-After", strconv.Itoa(int(time.Until(err.Expires).Seconds())+1))
+	writeError(res, http.StatusLocked, errCodeScannerClaimed, err.localize(responseLanguage(res)))
+}
+
+// handleClaim claims the scanner or renews the claim of the holder of
+// the X-Claim-Token
+func handleClaim(res http.ResponseWriter, r *http.Request) {
+	var (
+		name = strings.TrimSpace(r.URL.Query().Get("name"))
+		user = requestUser(r)
+		ttl  = claimDefaultTTL
+	)
+
+	if name == "" {
+		name = user
+	}
+	if name == "" {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, "name is required to tell others who is using the scanner")
+		return
+	}
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > claimMaxTTL {
+			writeError(res, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("Invalid value for ttl (up to %s)", claimMaxTTL))
+			return
+		}
+		ttl = d
+	}
+
+	claim, token, err := scannerClaims.Claim(name, user, claimToken(r), ttl)
+	var claimed claimedError
+	if errors.As(err, &claimed) {
+		writeClaimedError(res, claimed)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"name":    claim.Name,
+		"user":    user,
+		"expires": claim.Expires.Format(time.RFC3339),
+	}).Info("Scanner claimed")
+
+	writeJSON(res, http.StatusOK, struct {
+		scannerClaim
+		Token string `json:"token"`
+	}{claim, token})
+}
+
+func handleGetClaim(res http.ResponseWriter, r *http.Request) {
+	claim, ok := scannerClaims.Status()
+	if !ok {
+		writeError(res, http.StatusNotFound, errCodeNotFound, errNotClaimed.Error())
+		return
+	}
+	writeJSON(res, http.StatusOK, claim)
+}
+
+// handleReleaseClaim ends the claim of the holder of the X-Claim-Token,
+// admins release any claim using DELETE /admin/claim
+func handleReleaseClaim(force bool) http.HandlerFunc {
+	return func(res http.ResponseWriter, r *http.Request) {
+		claim, err := scannerClaims.Release(claimToken(r), requestUser(r), force)
+		var claimed claimedError
+		switch {
+		case errors.As(err, &claimed):
+			writeClaimedError(res, claimed)
+			return
+		case err != nil:
+			writeError(res, http.StatusNotFound, errCodeNotFound, err.Error())
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"name":   claim.Name,
+			"user":   requestUser(r),
+			"forced": force,
+		}).Info("Claim of the scanner released")
+		res.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// claimToken returns the token of the claim the request is made for
+func claimToken(r *http.Request) string {
+	return r.Header.Get("X-Claim-Token")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// classificationRule tags the scans whose recognized text matches the
+// expression, e.g. "(?i)rechnung" to tag invoices. Routes select the
+// targets by the tags and webhook targets pass them on to paperless.
+type classificationRule struct {
+	Text string   `yaml:"text"`
+	Tags []string `yaml:"tags"`
+	// Title is used for scans without title, the first matching rule
+	// having one sets it
+	Title string `yaml:"title"`
+
+	text *regexp.Regexp
+}
+
+// classificationRules are guarded by targetsLock as they are loaded
+// from the targets file
+var classificationRules []classificationRule
+
+func compileClassificationRules(rules []classificationRule) error {
+	for i := range rules {
+		rule := &rules[i]
+		if len(rule.Tags) == 0 && rule.Title == "" {
+			return fmt.Errorf("Classification rule %d has neither tags nor title", i+1)
+		}
+
+		var err error
+		if rule.text, err = regexp.Compile(rule.Text); err != nil {
+			return fmt.Errorf("Classification rule %d has invalid text expression: %s", i+1, err)
+		}
+	}
+	return nil
+}
+
+// classifyScan applies all rules matching the recognized text to the
+// tags already given (by a routing sheet), scans without text (no ocr
+// step) are not classified
+func classifyScan(text *jobText, given []string) (tags []string, title string) {
+	tags = []string{}
+	seen := map[string]bool{}
+	add := func(tag string) {
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	for _, tag := range given {
+		add(tag)
+	}
+
+	if text == nil {
+		return tags, ""
+	}
+
+	targetsLock.RLock()
+	defer targetsLock.RUnlock()
+
+	if len(classificationRules) == 0 {
+		return tags, ""
+	}
+
+	plain := text.plainText()
+	for _, rule := range classificationRules {
+		if !rule.text.Match(plain) {
+			continue
+		}
+		for _, tag := range rule.Tags {
+			add(tag)
+		}
+		if title == "" {
+			title = rule.Title
+		}
+	}
+	return tags, title
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runScan performs a single scan without starting the HTTP server. The
+// arguments are an optional target file ("-" for stdout) and scan
+// parameters in the form of the query parameters of /scan.pdf
+// ("duplex=false", "profile=invoice", ...).
+func runScan(args []string) {
+	start := time.Now()
+
+	var (
+		q      = url.Values{}
+		target string
+	)
+	for _, arg := range args {
+		if k, v, ok := strings.Cut(arg, "="); ok {
+			q.Add(k, v)
+			continue
+		}
+		if target != "" {
+			log.Fatalf("Unexpected argument %q, parameters must be given as 'name=value'", arg)
+		}
+		target = arg
+	}
+
+	r, err := http.NewRequest(http.MethodGet, "/scan.pdf?"+q.Encode(), nil)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to parse scan parameters")
+	}
+
+	params, err := parseScanParams(r)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid scan parameters")
+	}
+	params.JobID = newID()
+
+	pages, skipped, err := scanAndProcessPages(params, 0)
+	if err != nil {
+		log.WithError(err).WithField("pages", len(pages)).Fatal("Unable to fetch pages")
+	}
+
+	if pages, skipped = skipUnembeddablePages(params, selectPages(pages, params.Pages), skipped); len(pages) == 0 {
+		log.Fatal("Page selection does not contain any of the processed pages")
+	}
+	if len(skipped) > 0 {
+		log.WithField("pages", skippedPages(skipped)).Warn("Some pages were unable to be processed and are missing in the document")
+	}
+
+	if misfed := misfedPages(pages); len(misfed) > 0 {
+		log.WithField("pages", misfed).Warn("Possible misfeed (stapled or overlapping sheets) detected, please rescan")
+	}
+
+	var (
+		docs = scanDocuments(params, pages)
+		ext  = ".pdf"
+	)
+	if len(docs) > 1 {
+		ext = ".zip"
+	}
+
+	filename, err := scanFilename(params, "", len(pages), start, ext)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to generate filename")
+	}
+	if target == "" {
+		target = filename
+	}
+
+	var w io.Writer = os.Stdout
+	if target != "-" {
+		f, err := os.Create(target)
+		if err != nil {
+			log.WithError(err).Fatal("Unable to create output file")
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if len(docs) > 1 {
+		err = writeZIPFromDocuments(w, params, docs, strings.TrimSuffix(filename, ext))
+	} else {
+		err = writePDF(w, params, docs[0])
+	}
+	if err != nil {
+		if target != "-" {
+			os.Remove(target)
+		}
+		log.WithError(err).Fatal("Unable to generate document")
+	}
+
+	log.WithFields(log.Fields{
+		"file":      target,
+		"pages":     len(pages),
+		"documents": len(docs),
+		"duration":  time.Since(start).Seconds(),
+	}).Info("Scan finished")
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Upload targets for consumer cloud storages authorized using OAuth 2,
+// the refresh token is obtained once by the user and exchanged for
+// short-lived access tokens when needed
+
+var (
+	dropboxTokenURL  = "https://api.dropboxapi.com/oauth2/token"
+	dropboxUploadURL = "https://content.dropboxapi.com/2/files/upload"
+
+	gdriveTokenURL  = "https://oauth2.googleapis.com/token"
+	gdriveFilesURL  = "https://www.googleapis.com/drive/v3/files"
+	gdriveUploadURL = "https://www.googleapis.com/upload/drive/v3/files"
+)
+
+// Dropbox rejects simple uploads larger than this
+const dropboxMaxUploadSize = 150 << 20
+
+// oauthToken keeps the access token issued for the refresh token until
+// it expires or is rejected
+type oauthToken struct {
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RefreshToken string `yaml:"refresh_token"`
+
+	tokenURL string
+	lock     sync.Mutex
+	access   string
+	expiry   time.Time
+}
+
+func (o *oauthToken) validate() error {
+	if o.ClientID == "" || o.RefreshToken == "" {
+		return fmt.Errorf("client_id and refresh_token are required")
+	}
+	return nil
+}
+
+// Token returns a valid access token, refreshing it if required
+func (o *oauthToken) Token(ctx context.Context) (string, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	// Refresh early to not have the token expire during a long upload
+	if o.access != "" && time.Until(o.expiry) > 5*time.Minute {
+		return o.access, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {o.RefreshToken},
+		"client_id":     {o.ClientID},
+	}
+	if o.ClientSecret != "" {
+		form.Set("client_secret", o.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("Unable to create token request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err = doJSONRequest(req, &token); err != nil {
+		return "", fmt.Errorf("Unable to refresh access token: %s", err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("Token response contains no access token")
+	}
+
+	o.access, o.expiry = token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn)*time.Second)
+	return o.access, nil
+}
+
+// Invalidate drops the access token after it was rejected
+func (o *oauthToken) Invalidate() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.access = ""
+}
+
+// authorize adds the access token to the request
+func (o *oauthToken) authorize(req *http.Request) error {
+	token, err := o.Token(req.Context())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// do executes the authorized request decoding the JSON response into
+// out (if not nil), rejected tokens are refreshed on the next attempt
+func (o *oauthToken) do(req *http.Request, out interface{}) (*http.Response, error) {
+	if err := o.authorize(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to execute request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		o.Invalidate()
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("Unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return nil, fmt.Errorf("Unable to decode response: %s", err)
+		}
+	}
+	return resp, nil
+}
+
+// doJSONRequest executes an unauthorized request decoding the JSON
+// response into out
+func doJSONRequest(req *http.Request, out interface{}) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to execute request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// cloudFolder is the folder template shared by the cloud targets
+type cloudFolder struct {
+	Folder string `yaml:"folder"`
+
+	folder *template.Template
+}
+
+func (c *cloudFolder) parse() error {
+	var err error
+	if c.folder, err = template.New("folder").Parse(c.Folder); err != nil {
+		return fmt.Errorf("invalid folder template: %s", err)
+	}
+	return nil
+}
+
+// segments returns the folder names of the rendered folder path
+func (c *cloudFolder) segments(doc *deliveryDocument) ([]string, error) {
+	buf := new(bytes.Buffer)
+	if err := c.folder.Execute(buf, doc); err != nil {
+		return nil, fmt.Errorf("Unable to render folder: %s", err)
+	}
+
+	var segments []string
+	for _, s := range strings.Split(path.Clean("/"+buf.String()), "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+	return segments, nil
+}
+
+type dropboxTarget struct {
+	oauthToken  `yaml:",inline"`
+	cloudFolder `yaml:",inline"`
+}
+
+func newDropboxTarget(decode func(interface{}) error) (uploadTarget, error) {
+	t := &dropboxTarget{}
+	if err := decode(t); err != nil {
+		return nil, err
+	}
+	t.tokenURL = dropboxTokenURL
+
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	return t, t.parse()
+}
+
+// Address implements addressedTarget
+func (d *dropboxTarget) Address() string { return urlAddress(dropboxUploadURL) }
+
+// Upload implements uploadTarget, missing folders are created by
+// Dropbox and existing files are kept by renaming the new one
+func (d *dropboxTarget) Upload(ctx context.Context, doc *deliveryDocument) error {
+	segments, err := d.segments(doc)
+	if err != nil {
+		return err
+	}
+
+	f, size, err := doc.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if size > dropboxMaxUploadSize {
+		return fmt.Errorf("Document exceeds the Dropbox upload limit of %d MiB", dropboxMaxUploadSize>>20)
+	}
+
+	arg, err := json.Marshal(map[string]interface{}{
+		"path":       "/" + path.Join(append(segments, doc.Filename)...),
+		"mode":       "add",
+		"autorename": true,
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to encode upload arguments: %s", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dropboxUploadURL, f)
+	if err != nil {
+		return fmt.Errorf("Unable to create request: %s", err)
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Dropbox-API-Arg", asciiJSON(arg))
+
+	_, err = d.do(req, nil)
+	return err
+}
+
+// asciiJSON escapes the non-ASCII characters of the JSON for use in
+// HTTP headers
+func asciiJSON(in []byte) string {
+	var b strings.Builder
+	for _, r := range string(in) {
+		switch {
+		case r < 0x80:
+			b.WriteRune(r)
+		case r > 0xffff:
+			// Encoded as UTF-16 surrogate pair
+			r -= 0x10000
+			fmt.Fprintf(&b, `\u%04x\u%04x`, 0xd800+(r>>10), 0xdc00+(r&0x3ff))
+		default:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		}
+	}
+	return b.String()
+}
+
+type gdriveTarget struct {
+	oauthToken  `yaml:",inline"`
+	cloudFolder `yaml:",inline"`
+	// FolderID is the parent of the folder path (default: the root of
+	// "My Drive")
+	FolderID string `yaml:"folder_id"`
+
+	// Resolved folder IDs by path to not look them up for every upload
+	folderLock sync.Mutex
+	folders    map[string]string
+}
+
+func newGDriveTarget(decode func(interface{}) error) (uploadTarget, error) {
+	t := &gdriveTarget{FolderID: "root", folders: map[string]string{}}
+	if err := decode(t); err != nil {
+		return nil, err
+	}
+	t.tokenURL = gdriveTokenURL
+
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	return t, t.parse()
+}
+
+// Address implements addressedTarget
+func (g *gdriveTarget) Address() string { return urlAddress(gdriveUploadURL) }
+
+// Upload implements uploadTarget using a resumable upload, which is
+// required for files larger than 5 MiB
+func (g *gdriveTarget) Upload(ctx context.Context, doc *deliveryDocument) error {
+	segments, err := g.segments(doc)
+	if err != nil {
+		return err
+	}
+
+	parent, err := g.folderID(ctx, segments)
+	if err != nil {
+		return err
+	}
+
+	f, size, err := doc.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	meta, err := json.Marshal(map[string]interface{}{
+		"name":     doc.Filename,
+		"parents":  []string{parent},
+		"mimeType": doc.ContentType,
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to encode file metadata: %s", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, gdriveUploadURL+"?uploadType=resumable", bytes.NewReader(meta))
+	if err != nil {
+		return fmt.Errorf("Unable to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", doc.ContentType)
+	req.Header.Set("X-Upload-Content-Length", fmt.Sprint(size))
+
+	resp, err := g.do(req, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to start upload: %s", err)
+	}
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return fmt.Errorf("Upload session has no location")
+	}
+
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPut, session, f); err != nil {
+		return fmt.Errorf("Unable to create request: %s", err)
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", doc.ContentType)
+
+	_, err = g.do(req, nil)
+	return err
+}
+
+// folderID returns the ID of the folder path below the configured
+// parent, missing folders are created
+func (g *gdriveTarget) folderID(ctx context.Context, segments []string) (string, error) {
+	g.folderLock.Lock()
+	defer g.folderLock.Unlock()
+
+	parent := g.FolderID
+	for i, name := range segments {
+		key := strings.Join(segments[:i+1], "/")
+		if id, ok := g.folders[key]; ok {
+			parent = id
+			continue
+		}
+
+		q := url.Values{
+			"q": {fmt.Sprintf("name = '%s' and '%s' in parents and mimeType = 'application/vnd.google-apps.folder' and trashed = false",
+				strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(name), parent)},
+			"fields": {"files(id)"},
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, gdriveFilesURL+"?"+q.Encode(), nil)
+		if err != nil {
+			return "", fmt.Errorf("Unable to create request: %s", err)
+		}
+
+		var list struct {
+			Files []struct {
+				ID string `json:"id"`
+			} `json:"files"`
+		}
+		if _, err = g.do(req, &list); err != nil {
+			return "", fmt.Errorf("Unable to look up folder %q: %s", key, err)
+		}
+
+		if len(list.Files) > 0 {
+			parent = list.Files[0].ID
+		} else {
+			meta, _ := json.Marshal(map[string]interface{}{
+				"name":     name,
+				"parents":  []string{parent},
+				"mimeType": "application/vnd.google-apps.folder",
+			})
+			if req, err = http.NewRequestWithContext(ctx, http.MethodPost, gdriveFilesURL+"?fields=id", bytes.NewReader(meta)); err != nil {
+				return "", fmt.Errorf("Unable to create request: %s", err)
+			}
+			req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+
+			var created struct {
+				ID string `json:"id"`
+			}
+			if _, err = g.do(req, &created); err != nil {
+				return "", fmt.Errorf("Unable to create folder %q: %s", key, err)
+			}
+			parent = created.ID
+		}
+
+		g.folders[key] = parent
+	}
+
+	return parent, nil
+}
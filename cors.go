@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsExposedHeaders are the response headers scripts of other origins
+// may read, browsers hide all others
+var corsExposedHeaders = []string{
+	"Content-Disposition",
+	"ETag",
+	"Location",
+	"Retry-After",
+	"X-Content-SHA256",
+	"X-Delivery-Targets",
+	"X-Document-Count",
+	"X-Error-Code",
+	"X-Generation-Time",
+	"X-Job-ID",
+	"X-Key-ID",
+	"X-Misfeed-Pages",
+	"X-OCR-Confidence",
+	"X-OCR-Overlay-ID",
+	"X-Request-ID",
+	"X-Rescan-ID",
+	"X-Scan-ID",
+	"X-Scan-Warning",
+	"X-Skipped-Pages",
+}
+
+// corsAllowedHeaders are the request headers accepted from other
+// origins
+var corsAllowedHeaders = []string{"Authorization", "Content-Type", "If-None-Match", "X-Request-ID"}
+
+// allowCORS adds the CORS headers for the origins listed in
+// --cors-origin and answers preflight requests before they reach the
+// authentication
+func allowCORS(next http.Handler) http.Handler {
+	origins := nonEmpty(cfg.CORSOrigin)
+	if len(origins) == 0 {
+		return next
+	}
+
+	allowed := func(origin string) bool {
+		for _, o := range origins {
+			if o == "*" || strings.EqualFold(o, origin) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(res, r)
+			return
+		}
+
+		res.Header().Add("Vary", "Origin")
+		if !allowed(origin) {
+			next.ServeHTTP(res, r)
+			return
+		}
+
+		if cfg.CORSCredentials {
+			// Credentialed requests must not be answered with a wildcard
+			res.Header().Set("Access-Control-Allow-Origin", origin)
+			res.Header().Set("Access-Control-Allow-Credentials", "true")
+		} else if len(origins) == 1 && origins[0] == "*" {
+			res.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			res.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			res.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			next.ServeHTTP(res, r)
+			return
+		}
+
+		res.Header().Set("Access-Control-Allow-Methods", strings.Join(nonEmpty(cfg.CORSMethods), ", "))
+		res.Header().Set("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+		res.Header().Set("Access-Control-Max-Age", "600")
+		res.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/pdfgen"
+)
+
+const (
+	coverMargin   = 56.0 // ~2cm
+	coverQRSize   = 128.0
+	coverWrapAt   = 90 // characters per line of custom text
+	coverFontSize = 12.0
+)
+
+// coverSheet contains the information printed onto the cover page
+// prepended to the documents
+type coverSheet struct {
+	Title   string
+	Created time.Time
+	Profile string
+	JobID   string
+	Pages   int
+	User    string
+	Text    string
+	// QR is encoded as QR code, usually the URL of the stored scan.
+	// Codes with a QRSize (in points) are centered below the text
+	// instead of the top right corner.
+	QR     string
+	QRSize float64
+}
+
+// Render creates the content stream of the cover page
+func (c coverSheet) Render() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	title := c.Title
+	if title == "" {
+		title = "Scan"
+	}
+
+	y := pdfgen.A4HeightPt - coverMargin - 24
+	fmt.Fprintf(buf, "BT /F2 24 Tf %.2f %.2f Td %s Tj ET\n", coverMargin, y, pdfgen.WinAnsiString(title))
+	y -= 40
+
+	pages := ""
+	if c.Pages > 0 {
+		pages = fmt.Sprintf("%d", c.Pages)
+	}
+
+	for _, f := range []struct{ label, value string }{
+		{"Date", c.Created.Format("2006-01-02 15:04:05")},
+		{"Profile", c.Profile},
+		{"Job", c.JobID},
+		{"Pages", pages},
+		{"User", c.User},
+	} {
+		if f.value == "" {
+			continue
+		}
+		fmt.Fprintf(buf, "BT /F2 %.0f Tf %.2f %.2f Td %s Tj /F1 %.0f Tf 70 0 Td %s Tj ET\n",
+			coverFontSize, coverMargin, y, pdfgen.WinAnsiString(f.label+":"), coverFontSize, pdfgen.WinAnsiString(f.value))
+		y -= coverFontSize * 1.5
+	}
+
+	if c.Text != "" {
+		y -= coverFontSize
+		for _, line := range wrapText(c.Text, coverWrapAt) {
+			fmt.Fprintf(buf, "BT /F1 %.0f Tf %.2f %.2f Td %s Tj ET\n", coverFontSize, coverMargin, y, pdfgen.WinAnsiString(line))
+			y -= coverFontSize * 1.4
+		}
+	}
+
+	if c.QR != "" {
+		modules, err := encodeQR([]byte(c.QR))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to encode QR code: %s", err)
+		}
+
+		var (
+			size = coverQRSize
+			x0   = pdfgen.A4WidthPt - coverMargin - size
+			y0   = pdfgen.A4HeightPt - coverMargin - size
+		)
+		if c.QRSize > 0 {
+			size = c.QRSize
+			x0, y0 = (pdfgen.A4WidthPt-size)/2, 2*coverMargin
+		}
+		// Leave a quiet zone of 4 modules around the code
+		m := size / float64(len(modules)+8)
+
+		buf.WriteString("0 g\n")
+		for row, line := range modules {
+			for col, dark := range line {
+				if dark {
+					fmt.Fprintf(buf, "%.3f %.3f %.3f %.3f re\n",
+						x0+float64(col+4)*m, y0+size-float64(row+5)*m, m, m)
+				}
+			}
+		}
+		buf.WriteString("f\n")
+
+		fmt.Fprintf(buf, "BT /F1 7 Tf %.2f %.2f Td %s Tj ET\n", x0, y0-8, pdfgen.WinAnsiString(c.QR))
+	}
+
+	return buf.Bytes(), nil
+}
+
+// wrapText splits the text into lines of at most width characters,
+// keeping explicit line breaks
+func wrapText(text string, width int) []string {
+	lines := []string{}
+	for _, para := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(para) {
+			if line != "" && len([]rune(line))+1+len([]rune(word)) > width {
+				lines = append(lines, line)
+				line = ""
+			}
+			if line != "" {
+				line += " "
+			}
+			line += word
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
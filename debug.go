@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// debugStatus describes the state of the process to diagnose memory
+// growth and stuck scans
+type debugStatus struct {
+	Version    string            `json:"version"`
+	Goroutines int               `json:"goroutines"`
+	Memory     debugMemoryStatus `json:"memory"`
+	Jobs       []runningJob      `json:"jobs"`
+	Stats      dutyCycleSnapshot `json:"stats"`
+	// Retained lists the pages kept in memory for resuming failed scans
+	// and for assembly sessions
+	Retained debugRetainedPages `json:"retained"`
+	// SpoolBytes is the size of the pages spooled to --spool-dir
+	SpoolBytes int64 `json:"spool_bytes,omitempty"`
+}
+
+type debugMemoryStatus struct {
+	// Alloc is the size of the live heap objects, Sys the memory
+	// obtained from the OS
+	Alloc       uint64  `json:"alloc_bytes"`
+	TotalAlloc  uint64  `json:"total_alloc_bytes"`
+	Sys         uint64  `json:"sys_bytes"`
+	HeapInuse   uint64  `json:"heap_inuse_bytes"`
+	HeapObjects uint64  `json:"heap_objects"`
+	NumGC       uint32  `json:"num_gc"`
+	LastGC      float64 `json:"last_gc_seconds_ago,omitempty"`
+}
+
+type debugRetainedPages struct {
+	PartialScans     int `json:"partial_scans"`
+	PartialScanPages int `json:"partial_scan_pages"`
+	Sessions         int `json:"sessions"`
+	SessionPages     int `json:"session_pages"`
+}
+
+// listenAndServeDebug serves net/http/pprof and /debug/status on the
+// separate --pprof-listen address, they are not exposed on the API port
+func listenAndServeDebug() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("GET /debug/status", handleDebugStatus)
+
+	log.WithField("listen", cfg.PprofListen).Info("Serving pprof and runtime diagnostics")
+	return http.ListenAndServe(cfg.PprofListen, mux)
+}
+
+// hidePprof keeps the profiles net/http/pprof registers on the default
+// mux when imported from being served on the API port
+func hidePprof(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/debug/pprof/") {
+			http.NotFound(res, r)
+			return
+		}
+		next.ServeHTTP(res, r)
+	})
+}
+
+func handleDebugStatus(res http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	status := debugStatus{
+		Version:    version,
+		Goroutines: runtime.NumGoroutine(),
+		Memory: debugMemoryStatus{
+			Alloc:       mem.Alloc,
+			TotalAlloc:  mem.TotalAlloc,
+			Sys:         mem.Sys,
+			HeapInuse:   mem.HeapInuse,
+			HeapObjects: mem.HeapObjects,
+			NumGC:       mem.NumGC,
+		},
+		Jobs:     runningJobs.List(),
+		Stats:    dutyCycle.Snapshot(),
+		Retained: retainedPages(),
+	}
+	if pageSpool != nil {
+		status.SpoolBytes = pageSpool.Size()
+	}
+	if mem.LastGC > 0 {
+		status.Memory.LastGC = time.Since(time.Unix(0, int64(mem.LastGC))).Seconds()
+	}
+
+	writeJSON(res, http.StatusOK, status)
+}
+
+// retainedPages counts the pages held by the partial scan and session
+// stores, expired entries are not removed before the next access
+func retainedPages() debugRetainedPages {
+	var r debugRetainedPages
+
+	partialScans.lock.Lock()
+	for _, ps := range partialScans.scans {
+		r.PartialScans++
+		r.PartialScanPages += len(ps.Pages)
+	}
+	partialScans.lock.Unlock()
+
+	assemblySessions.lock.Lock()
+	for _, s := range assemblySessions.sessions {
+		r.Sessions++
+		r.SessionPages += len(s.Pages)
+	}
+	assemblySessions.lock.Unlock()
+
+	return r
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// deliveryAttempts is the number of uploads tried per target before
+	// the delivery is given up, the wait between them grows linearly
+	deliveryAttempts = 3
+	deliveryBackoff  = 10 * time.Second
+	deliveryTimeout  = 10 * time.Minute
+)
+
+// uploadTarget delivers finished documents to a destination outside
+// the daemon (paperless, Nextcloud, a mailbox, ...)
+type uploadTarget interface {
+	Upload(ctx context.Context, doc *deliveryDocument) error
+}
+
+// addressedTarget is implemented by the targets delivering over the
+// network for the self-test to check they are reachable
+type addressedTarget interface {
+	// Address returns the host:port connected to for deliveries
+	Address() string
+}
+
+// resumableTarget is implemented by targets keeping the parts of a
+// failed upload to continue it on the next attempt
+type resumableTarget interface {
+	// Discard drops the parts kept for the document once its delivery
+	// is given up
+	Discard(doc *deliveryDocument)
+}
+
+// urlAddress returns the host:port of the URL with the default port of
+// its scheme if it has none
+func urlAddress(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// deliveryDocument is a rendered document waiting to be delivered
+type deliveryDocument struct {
+	// File contains the document, it must not be modified by targets
+	File        string
+	Filename    string
+	ContentType string
+	Created     time.Time
+	JobID       string
+	Pages       int
+	Profile     string
+	Title       string
+	User        string
+	// Tags were set by the classification rules
+	Tags []string
+	// PaperWidthMM and PaperHeightMM are the size of the scan area, zero
+	// if the scanner options do not set it
+	PaperWidthMM, PaperHeightMM float64
+
+	// progress is set for the target being delivered to
+	progress func(sent, size int64)
+}
+
+// reportProgress is called by the targets with the bytes uploaded
+func (d *deliveryDocument) reportProgress(sent, size int64) {
+	if d.progress != nil {
+		d.progress(sent, size)
+	}
+}
+
+// Open returns the content of the document and its size
+func (d *deliveryDocument) Open() (*os.File, int64, error) {
+	f, err := os.Open(d.File)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Unable to open document: %s", err)
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("Unable to stat document: %s", err)
+	}
+
+	return f, stat.Size(), nil
+}
+
+// targetTypes creates the targets from the options given in the
+// targets file, the options are decoded using decode
+var targetTypes = map[string]func(decode func(interface{}) error) (uploadTarget, error){
+	"directory": newDirectoryTarget,
+	"dropbox":   newDropboxTarget,
+	"email":     newEmailTarget,
+	"fax":       newFaxTarget,
+	"ftp":       newFTPTarget,
+	"gdrive":    newGDriveTarget,
+	"ipp":       newIPPTarget,
+	"ntfy":      newNtfyTarget,
+	"s3":        newS3Target,
+	"sftp":      newSFTPTarget,
+	"slack":     newSlackTarget,
+	"telegram":  newTelegramTarget,
+	"webdav":    newWebDAVTarget,
+	"webhook":   newWebhookTarget,
+}
+
+// deliveryRoute selects the targets of the scans matching all of its
+// conditions, a route without conditions matches every scan
+type deliveryRoute struct {
+	Profile string            `yaml:"profile"`
+	User    string            `yaml:"user"`
+	Query   map[string]string `yaml:"query"`
+	Barcode string            `yaml:"barcode"`
+	// Tag matches scans tagged by a classification rule
+	Tag     string   `yaml:"tag"`
+	Targets []string `yaml:"targets"`
+	// ArchiveTargets receive the archival copy of scans requesting one
+	// using the archive parameter
+	ArchiveTargets []string `yaml:"archive_targets"`
+	// BackTargets receive the back sides of scans split using
+	// duplex-split, the front sides go to Targets
+	BackTargets []string `yaml:"back_targets"`
+
+	barcode *regexp.Regexp
+}
+
+func (d deliveryRoute) matches(params *scanParams, barcodes func() []string) bool {
+	if d.Profile != "" && d.Profile != params.Profile {
+		return false
+	}
+
+	if d.User != "" && d.User != params.User {
+		return false
+	}
+
+	for k, v := range d.Query {
+		if params.Query.Get(k) != v {
+			return false
+		}
+	}
+
+	if d.Tag != "" {
+		tagged := false
+		for _, tag := range params.Meta.Tags {
+			tagged = tagged || tag == d.Tag
+		}
+		if !tagged {
+			return false
+		}
+	}
+
+	if d.barcode != nil {
+		for _, code := range barcodes() {
+			if d.barcode.MatchString(code) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+var (
+	uploadTargets  = map[string]uploadTarget{}
+	deliveryRoutes []deliveryRoute
+	// targetsLock guards targets and routes as they are replaced when
+	// the configuration is reloaded
+	targetsLock sync.RWMutex
+)
+
+// haveUploadTargets tells whether any upload target is configured
+func haveUploadTargets() bool {
+	targetsLock.RLock()
+	defer targetsLock.RUnlock()
+
+	return len(uploadTargets) > 0
+}
+
+// haveArchiveTargets tells whether any route delivers archival copies
+func haveArchiveTargets() bool {
+	targetsLock.RLock()
+	defer targetsLock.RUnlock()
+
+	for _, route := range deliveryRoutes {
+		if len(route.ArchiveTargets) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// loadTargets reads the upload targets and the routes distributing the
+// scans to them from a YAML file:
+//
+//	targets:
+//	  paperless:
+//	    type: webhook
+//	    url: https://paperless.example.com/api/documents/post_document/
+//	routes:
+//	  - profile: invoice
+//	    targets: [paperless]
+//	classify:
+//	  - text: (?i)rechnung
+//	    tags: [invoice]
+func loadTargets(file string) error {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("Unable to read targets: %s", err)
+	}
+
+	var config struct {
+		Targets  map[string]map[string]interface{} `yaml:"targets"`
+		Routes   []deliveryRoute                   `yaml:"routes"`
+		Classify []classificationRule              `yaml:"classify"`
+	}
+	if err := yaml.UnmarshalStrict(raw, &config); err != nil {
+		return fmt.Errorf("Unable to parse targets: %s", err)
+	}
+
+	targets := map[string]uploadTarget{}
+	for name, opts := range config.Targets {
+		typ, _ := opts["type"].(string)
+		create, ok := targetTypes[typ]
+		if !ok {
+			return fmt.Errorf("Target %q has unknown type %q (available: %s)", name, typ, strings.Join(targetTypeNames(), ", "))
+		}
+		delete(opts, "type")
+
+		decode := func(out interface{}) error {
+			// Options are decoded strictly to catch typos
+			buf, err := yaml.Marshal(opts)
+			if err != nil {
+				return err
+			}
+			return yaml.UnmarshalStrict(buf, out)
+		}
+
+		if targets[name], err = create(decode); err != nil {
+			return fmt.Errorf("Invalid target %q: %s", name, err)
+		}
+	}
+
+	for i := range config.Routes {
+		route := &config.Routes[i]
+		if len(route.Targets) == 0 && len(route.ArchiveTargets) == 0 && len(route.BackTargets) == 0 {
+			return fmt.Errorf("Route %d has no targets", i+1)
+		}
+		for _, t := range append(append(append([]string{}, route.Targets...), route.ArchiveTargets...), route.BackTargets...) {
+			if _, ok := targets[t]; !ok {
+				return fmt.Errorf("Route %d references unknown target %q", i+1, t)
+			}
+		}
+		if route.Barcode != "" && !featureBarcode {
+			return fmt.Errorf("Route %d matches a barcode which is not available in this build (built with -tags nobarcode)", i+1)
+		}
+		if route.Barcode != "" {
+			if route.barcode, err = regexp.Compile(route.Barcode); err != nil {
+				return fmt.Errorf("Route %d has invalid barcode expression: %s", i+1, err)
+			}
+		}
+		if route.Profile != "" && !profileExists(route.Profile) {
+			return fmt.Errorf("Route %d references unknown profile %q", i+1, route.Profile)
+		}
+	}
+
+	if err := compileClassificationRules(config.Classify); err != nil {
+		return err
+	}
+
+	targetsLock.Lock()
+	defer targetsLock.Unlock()
+
+	uploadTargets, deliveryRoutes, classificationRules = targets, config.Routes, config.Classify
+	return nil
+}
+
+func targetTypeNames() []string {
+	names := []string{}
+	for n := range targetTypes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// routeScan returns the route selecting the targets to deliver the scan
+// to, the first matching route wins. Without routes all targets receive
+// every scan.
+func routeScan(params *scanParams, pages []*scanner.Page) deliveryRoute {
+	targetsLock.RLock()
+	defer targetsLock.RUnlock()
+
+	if len(deliveryRoutes) == 0 {
+		names := []string{}
+		for n := range uploadTargets {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return deliveryRoute{Targets: names}
+	}
+
+	var codes []string
+	barcodes := func() []string {
+		// Only read once and only if a route asks for them
+		if codes == nil {
+			codes = readBarcodes(pages)
+		}
+		return codes
+	}
+
+	for _, route := range deliveryRoutes {
+		if route.matches(params, barcodes) {
+			return route
+		}
+	}
+	return deliveryRoute{}
+}
+
+// readBarcodes returns the content of the barcodes found on the first
+// page of the scan using zbarimg
+func readBarcodes(pages []*scanner.Page) []string {
+	codes := []string{}
+	if !featureBarcode || len(pages) == 0 {
+		return codes
+	}
+
+	data, err := pages[0].ImageData()
+	if err != nil {
+		log.WithError(err).Error("Unable to read page for barcode detection")
+		return codes
+	}
+	if pages[0].ImageType == "ccitt" {
+		img, err := pages[0].DecodedImage()
+		if err != nil || img == nil {
+			log.WithError(err).Warn("First page image is not available for barcode detection")
+			return codes
+		}
+		buf := new(bytes.Buffer)
+		if err := png.Encode(buf, img); err != nil {
+			log.WithError(err).Error("Unable to encode page for barcode detection")
+			return codes
+		}
+		data = buf.Bytes()
+	}
+
+	f, err := ioutil.TempFile(cfg.SpoolDir, "scansnap-barcode-")
+	if err != nil {
+		log.WithError(err).Error("Unable to create temporary file for barcode detection")
+		return codes
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.WithError(err).Error("Unable to write page for barcode detection")
+		return codes
+	}
+
+	stderr := new(bytes.Buffer)
+	cmd := exec.Command(cfg.Zbarimg, "--quiet", "--raw", f.Name())
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == 4 {
+			// No barcode found
+			return codes
+		}
+		log.WithError(err).WithField("stderr", strings.TrimSpace(stderr.String())).Error("Unable to execute zbarimg")
+		return codes
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			codes = append(codes, line)
+		}
+	}
+	log.WithField("barcodes", codes).Debug("Read barcodes from first page")
+	return codes
+}
+
+// needsBarcodes tells whether the first page image has to be kept for
+// detecting barcodes
+func needsBarcodes() bool {
+	if cfg.RoutingSheets {
+		return true
+	}
+
+	targetsLock.RLock()
+	defer targetsLock.RUnlock()
+
+	for _, route := range deliveryRoutes {
+		if route.barcode != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverScan uploads the document to the targets in the background,
+// a temporary document file is removed afterwards
+func deliverScan(names []string, doc *deliveryDocument, temporary bool) {
+	// Resolved now as reloading the configuration replaces the targets
+	targetsLock.RLock()
+	targets := map[string]uploadTarget{}
+	for _, name := range names {
+		if t, ok := uploadTargets[name]; ok {
+			targets[name] = t
+		}
+	}
+	targetsLock.RUnlock()
+
+	go func() {
+		if temporary {
+			defer os.Remove(doc.File)
+		}
+
+		for _, name := range names {
+			logger := log.WithFields(log.Fields{"job_id": doc.JobID, "target": name})
+
+			target, ok := targets[name]
+			if !ok {
+				logger.Error("Unable to deliver scan, the target was removed by reloading the configuration")
+				publishEvent(scanEvent{Event: "delivery_failed", JobID: doc.JobID, Filename: doc.Filename, Profile: doc.Profile, User: doc.User, Target: name, Error: "Target removed"})
+				continue
+			}
+
+			doc.progress = func(sent, size int64) {
+				logger.WithFields(log.Fields{"sent": sent, "size": size}).Debug("Delivering scan")
+				publishEvent(scanEvent{Event: "delivery_progress", JobID: doc.JobID, Filename: doc.Filename, Profile: doc.Profile, User: doc.User, Target: name, Bytes: sent, Size: size})
+			}
+
+			var err error
+			for attempt := 1; attempt <= deliveryAttempts; attempt++ {
+				ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+				if failInject.uploadTimesOut(name) {
+					err = fmt.Errorf("Injected failure: %w", context.DeadlineExceeded)
+				} else {
+					err = target.Upload(ctx, doc)
+				}
+				cancel()
+				if err == nil {
+					break
+				}
+
+				if attempt < deliveryAttempts {
+					logger.WithError(err).Warn("Unable to deliver scan, retrying")
+					time.Sleep(time.Duration(attempt) * deliveryBackoff)
+				}
+			}
+
+			if err != nil {
+				if r, ok := target.(resumableTarget); ok {
+					r.Discard(doc)
+				}
+				logger.WithError(err).Error("Unable to deliver scan")
+				publishEvent(scanEvent{Event: "delivery_failed", JobID: doc.JobID, Filename: doc.Filename, Profile: doc.Profile, User: doc.User, Target: name, Error: err.Error()})
+				continue
+			}
+
+			logger.Info("Scan delivered")
+			publishEvent(scanEvent{Event: "delivered", JobID: doc.JobID, Filename: doc.Filename, Profile: doc.Profile, User: doc.User, Target: name})
+		}
+	}()
+}
+
+// renderTempFile renders the document into a temporary file for the
+// targets to read it after the response was sent
+func renderTempFile(render func(io.Writer) error) (string, error) {
+	f, err := ioutil.TempFile(cfg.SpoolDir, "scansnap-delivery-")
+	if err != nil {
+		return "", fmt.Errorf("Unable to create temporary file: %s", err)
+	}
+
+	err = render(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
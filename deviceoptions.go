@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	saneTypeNames = map[scanner.Type]string{
+		scanner.TypeBool:   "bool",
+		scanner.TypeInt:    "int",
+		scanner.TypeFloat:  "float",
+		scanner.TypeString: "string",
+		scanner.TypeButton: "button",
+	}
+	saneUnitNames = map[scanner.Unit]string{
+		scanner.UnitPixel:   "pixel",
+		scanner.UnitBit:     "bit",
+		scanner.UnitMm:      "mm",
+		scanner.UnitDpi:     "dpi",
+		scanner.UnitPercent: "percent",
+		scanner.UnitUsec:    "microsecond",
+	}
+)
+
+// optionDescriptor describes a device option to build settings forms
+// and validate option overrides
+type optionDescriptor struct {
+	Name        string        `json:"name"`
+	Group       string        `json:"group,omitempty"`
+	Title       string        `json:"title,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Type        string        `json:"type"`
+	Unit        string        `json:"unit,omitempty"`
+	Length      int           `json:"length,omitempty"`
+	Range       *optionRange  `json:"range,omitempty"`
+	Values      []interface{} `json:"values,omitempty"`
+	Active      bool          `json:"active"`
+	Settable    bool          `json:"settable"`
+	Advanced    bool          `json:"advanced,omitempty"`
+	Automatic   bool          `json:"automatic,omitempty"`
+	Value       interface{}   `json:"value,omitempty"`
+}
+
+type optionRange struct {
+	Min   interface{} `json:"min"`
+	Max   interface{} `json:"max"`
+	Quant interface{} `json:"quant,omitempty"`
+}
+
+func describeOption(o scanner.DeviceOption) optionDescriptor {
+	d := optionDescriptor{
+		Name:        o.Name,
+		Group:       o.Group,
+		Title:       o.Title,
+		Description: o.Desc,
+		Type:        saneTypeNames[o.Type],
+		Unit:        saneUnitNames[o.Unit],
+		Values:      o.ConstrSet,
+		Active:      o.IsActive,
+		Settable:    o.IsSettable,
+		Advanced:    o.IsAdvanced,
+		Automatic:   o.IsAutomatic,
+		Value:       o.Value,
+	}
+
+	if o.Length > 1 {
+		d.Length = o.Length
+	}
+	if r := o.ConstrRange; r != nil {
+		d.Range = &optionRange{Min: r.Min, Max: r.Max, Quant: r.Quant}
+	}
+
+	return d
+}
+
+func handleDeviceOptions(res http.ResponseWriter, r *http.Request) {
+	describer, ok := scanBackend.(scanner.DeviceDescriber)
+	if !ok {
+		writeError(res, http.StatusNotFound, errCodeDisabled, "The scanner is not able to describe its options")
+		return
+	}
+
+	caps, err := describer.DeviceOptions()
+	if err != nil {
+		log.WithError(err).Error("Unable to read device options")
+		writeScanError(res, "", err)
+		return
+	}
+
+	out := struct {
+		Device  scanner.Device     `json:"device"`
+		Options []optionDescriptor `json:"options"`
+	}{caps.Device, []optionDescriptor{}}
+
+	for _, o := range caps.Options {
+		out.Options = append(out.Options, describeOption(o))
+	}
+
+	writeJSON(res, http.StatusOK, out)
+}
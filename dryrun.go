@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// handleScanValidate applies the options of a scan request (JSON body
+// like POST /scan or the query parameters of /scan.pdf) with its profile
+// to the device without feeding paper and reports the values the
+// device uses, e.g. to build profiles
+func handleScanValidate(res http.ResponseWriter, r *http.Request) {
+	validator, ok := scanBackend.(scanner.OptionValidator)
+	if !ok {
+		writeError(res, http.StatusNotFound, errCodeDisabled, "The scanner is not able to validate options")
+		return
+	}
+
+	var (
+		params *scanParams
+		err    error
+	)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		params, _, err = parseScanJSONRequest(r)
+	} else {
+		params, err = parseScanParams(r)
+	}
+	if err != nil {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	report, err := validator.ValidateOptions(scanner.Job{
+		Options:    params.scannerOptions(),
+		Resolution: params.ScanDPI,
+		Depth:      params.Depth,
+		Context:    r.Context(),
+		Device:     params.Device,
+	})
+	if e, ok := err.(scanner.UnsupportedError); ok {
+		err = invalidParamError{e.Error()}
+	}
+	if err != nil {
+		log.WithError(err).Error("Unable to validate scan options")
+		writeScanError(res, "", err)
+		return
+	}
+
+	writeJSON(res, http.StatusOK, report)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+)
+
+// Error codes clients can react on, see apiError
+const (
+	errCodeADFEmpty          = "adf_empty"
+	errCodeCooldown          = "cooldown"
+	errCodeCoverOpen         = "cover_open"
+	errCodeDisabled          = "disabled"
+	errCodeForbidden         = "forbidden"
+	errCodeInternal          = "internal_error"
+	errCodeInvalidParameter  = "invalid_parameter"
+	errCodeNoPagesSelected   = "no_pages_selected"
+	errCodeNotAcceptable     = "not_acceptable"
+	errCodeNotFound          = "not_found"
+	errCodePageCountMismatch = "page_count_mismatch"
+	errCodePageLimitExceeded = "page_limit_exceeded"
+	errCodePaperJam          = "paper_jam"
+	errCodePostProcessFailed = "post_process_failed"
+	errCodeQueueFull         = "queue_full"
+	errCodeRateLimited       = "rate_limited"
+	errCodeScanFailed        = "scan_failed"
+	errCodeScanCancelled     = "scan_cancelled"
+	errCodeScanInterrupted   = "scan_interrupted"
+	errCodeScanTimeout       = "scan_timeout"
+	errCodeScannerBusy       = "scanner_busy"
+	errCodeScannerClaimed    = "scanner_claimed"
+	errCodeSpoolFull         = "spool_full"
+	errCodeUnauthorized      = "unauthorized"
+	errCodeUnavailable       = "scanner_unavailable"
+)
+
+// apiError is sent as body of all error responses wrapped into an
+// {"error": ...} object. The code is repeated in the X-Error-Code
+// header.
+type apiError struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	SANEStatus string `json:"sane_status,omitempty"`
+	JobID      string `json:"job_id,omitempty"`
+	// Set if the scan failed after some pages were captured, they are
+	// kept for resuming the scan using the rescan ID
+	PagesCaptured int    `json:"pages_captured,omitempty"`
+	RescanID      string `json:"rescan_id,omitempty"`
+}
+
+// saneStatusNames maps the errors of the SANE library to the names of
+// the SANE status codes
+var saneStatusNames = map[error]string{
+	scanner.ErrUnsupported: "SANE_STATUS_UNSUPPORTED",
+	scanner.ErrCancelled:   "SANE_STATUS_CANCELLED",
+	scanner.ErrBusy:        "SANE_STATUS_DEVICE_BUSY",
+	scanner.ErrInvalid:     "SANE_STATUS_INVAL",
+	scanner.ErrJammed:      "SANE_STATUS_JAMMED",
+	scanner.ErrEmpty:       "SANE_STATUS_NO_DOCS",
+	scanner.ErrCoverOpen:   "SANE_STATUS_COVER_OPEN",
+	scanner.ErrIo:          "SANE_STATUS_IO_ERROR",
+	scanner.ErrNoMem:       "SANE_STATUS_NO_MEM",
+	scanner.ErrDenied:      "SANE_STATUS_ACCESS_DENIED",
+}
+
+// saneStatusName returns the name of the SANE status causing the error,
+// empty if it did not originate from SANE
+func saneStatusName(err error) string {
+	for e, name := range saneStatusNames {
+		if errors.Is(err, e) {
+			return name
+		}
+	}
+	return ""
+}
+
+func writeError(res http.ResponseWriter, status int, code, msg string) {
+	writeAPIError(res, status, apiError{Code: code, Message: msg})
+}
+
+// writeAPIError sends the error with its message in the language
+// negotiated for the response
+func writeAPIError(res http.ResponseWriter, status int, e apiError) {
+	lang := responseLanguage(res)
+	e.Message = localize(lang, e.Message)
+
+	res.Header().Set("X-Error-Code", e.Code)
+	res.Header().Set("Content-Language", lang)
+	res.Header().Add("Vary", "Accept-Language")
+	writeJSON(res, status, struct {
+		Error apiError `json:"error"`
+	}{e})
+}
+
+// scanErrorStatus maps the cause of a failed scan to the response
+// status and error code
+func scanErrorStatus(err error) (int, string) {
+	var (
+		claimed     claimedError
+		cooldown    cooldownError
+		invalid     invalidParamError
+		pageCount   pageCountError
+		pageLimit   scanner.PageLimitError
+		queueFull   queueFullError
+		unavailable scanner.UnavailableError
+	)
+
+	switch {
+	case errors.As(err, &invalid):
+		return http.StatusBadRequest, errCodeInvalidParameter
+	case errors.As(err, &cooldown):
+		return http.StatusServiceUnavailable, errCodeCooldown
+	case errors.As(err, &claimed):
+		return http.StatusLocked, errCodeScannerClaimed
+	case errors.As(err, &queueFull):
+		return http.StatusTooManyRequests, errCodeQueueFull
+	case errors.As(err, &unavailable):
+		return http.StatusServiceUnavailable, errCodeUnavailable
+	case errors.Is(err, errJobCancelled), errors.Is(err, errBackendReset):
+		return http.StatusConflict, errCodeScanCancelled
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, errCodeScanTimeout
+	case errors.Is(err, scanner.ErrSpoolFull):
+		return http.StatusInsufficientStorage, errCodeSpoolFull
+	case errors.As(err, &pageCount):
+		return http.StatusUnprocessableEntity, errCodePageCountMismatch
+	case errors.As(err, &pageLimit):
+		return http.StatusUnprocessableEntity, errCodePageLimitExceeded
+	case errors.Is(err, scanner.ErrEmpty):
+		return http.StatusUnprocessableEntity, errCodeADFEmpty
+	case errors.Is(err, scanner.ErrBusy):
+		return http.StatusConflict, errCodeScannerBusy
+	case errors.Is(err, scanner.ErrJammed):
+		// Fujitsu devices report double feeds as jam too
+		return http.StatusConflict, errCodePaperJam
+	case errors.Is(err, scanner.ErrCoverOpen):
+		return http.StatusConflict, errCodeCoverOpen
+	}
+	return http.StatusInternalServerError, errCodeScanFailed
+}
+
+// writeScanError responds with the status matching the cause of a
+// failed scan
+func writeScanError(res http.ResponseWriter, jobID string, err error) {
+	status, code := scanErrorStatus(err)
+	e := apiError{Code: code, Message: err.Error(), SANEStatus: saneStatusName(err), JobID: jobID}
+
+	// Errors of the scanner are only available in English, other
+	// languages get the description of the error code
+	lang := responseLanguage(res)
+	if d, ok := errCodeDescriptions[code]; ok && !localized(lang, e.Message) {
+		e.Message = d
+	}
+
+	var cooldown cooldownError
+	if errors.As(err, &cooldown) {
+		res.Header().Set("Retry-After", strconv.Itoa(int(cooldown.Remaining.Seconds())+1))
+	}
+	var claimed claimedError
+	if errors.As(err, &claimed) {
+		res.Header().Set("Retry-After", strconv.Itoa(int(time.Until(claimed.Expires).Seconds())+1))
+		e.Message = claimed.localize(lang)
+	}
+	if code == errCodeQueueFull {
+		res.Header().Set("Retry-After", strconv.Itoa(int(queueFullRetryAfter.Seconds())))
+	}
+	if code == errCodeADFEmpty {
+		e.Message = "The document feeder is empty, load the documents and try again"
+	}
+
+	writeAPIError(res, status, e)
+}
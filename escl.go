@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// Server side of the eSCL (AirScan) protocol used by macOS, Windows,
+// iOS, Mopria and sane-airscan clients to scan from network scanners.
+// Scans use the configured defaults, the clients select color mode,
+// resolution, duplex and the document format (PDF or JPEG pages).
+
+const esclVersion = "2.63"
+
+var esclJobs = newNetworkJobStore()
+
+var esclColorModes = map[string]string{
+	"BlackAndWhite1": scanner.ColorModeBW,
+	"Grayscale8":     scanner.ColorModeGray,
+	"RGB24":          scanner.ColorModeColor,
+}
+
+var esclTemplates = template.Must(template.New("escl").Funcs(template.FuncMap{"xml": xmlText}).Parse(`
+{{- define "capabilities" -}}
+<?xml version="1.0" encoding="UTF-8"?>
+<scan:ScannerCapabilities xmlns:scan="http://schemas.hp.com/imaging/escl/2011/05/03" xmlns:pwg="http://www.pwg.org/schemas/2010/12/sm">
+  <pwg:Version>{{ .Version }}</pwg:Version>
+  <pwg:MakeAndModel>{{ xml .MakeAndModel }}</pwg:MakeAndModel>
+  <scan:UUID>{{ .UUID }}</scan:UUID>
+  <scan:Adf>
+    <scan:AdfSimplexInputCaps>{{ template "inputcaps" . }}</scan:AdfSimplexInputCaps>
+    <scan:AdfDuplexInputCaps>{{ template "inputcaps" . }}</scan:AdfDuplexInputCaps>
+    <scan:FeederCapacity>50</scan:FeederCapacity>
+    <scan:AdfOptions>
+      <scan:AdfOption>Duplex</scan:AdfOption>
+    </scan:AdfOptions>
+  </scan:Adf>
+</scan:ScannerCapabilities>
+{{ end -}}
+
+{{- define "inputcaps" }}
+      <scan:MinWidth>{{ .MinWidth }}</scan:MinWidth>
+      <scan:MaxWidth>{{ .MaxWidth }}</scan:MaxWidth>
+      <scan:MinHeight>{{ .MinHeight }}</scan:MinHeight>
+      <scan:MaxHeight>{{ .MaxHeight }}</scan:MaxHeight>
+      <scan:MaxScanRegions>1</scan:MaxScanRegions>
+      <scan:SettingProfiles>
+        <scan:SettingProfile>
+          <scan:ColorModes>
+            <scan:ColorMode>BlackAndWhite1</scan:ColorMode>
+            <scan:ColorMode>Grayscale8</scan:ColorMode>
+            <scan:ColorMode>RGB24</scan:ColorMode>
+          </scan:ColorModes>
+          <scan:DocumentFormats>
+            <pwg:DocumentFormat>application/pdf</pwg:DocumentFormat>
+            <pwg:DocumentFormat>image/jpeg</pwg:DocumentFormat>
+            <scan:DocumentFormatExt>application/pdf</scan:DocumentFormatExt>
+            <scan:DocumentFormatExt>image/jpeg</scan:DocumentFormatExt>
+          </scan:DocumentFormats>
+          <scan:SupportedResolutions>
+            <scan:DiscreteResolutions>
+              {{- range .Resolutions }}
+              <scan:DiscreteResolution><scan:XResolution>{{ . }}</scan:XResolution><scan:YResolution>{{ . }}</scan:YResolution></scan:DiscreteResolution>
+              {{- end }}
+            </scan:DiscreteResolutions>
+          </scan:SupportedResolutions>
+        </scan:SettingProfile>
+      </scan:SettingProfiles>
+      <scan:SupportedIntents>
+        <scan:Intent>Document</scan:Intent>
+        <scan:Intent>TextAndGraphic</scan:Intent>
+        <scan:Intent>Photo</scan:Intent>
+      </scan:SupportedIntents>
+      <scan:MaxOpticalXResolution>{{ .MaxResolution }}</scan:MaxOpticalXResolution>
+      <scan:MaxOpticalYResolution>{{ .MaxResolution }}</scan:MaxOpticalYResolution>
+    {{ end -}}
+
+{{- define "status" -}}
+<?xml version="1.0" encoding="UTF-8"?>
+<scan:ScannerStatus xmlns:scan="http://schemas.hp.com/imaging/escl/2011/05/03" xmlns:pwg="http://www.pwg.org/schemas/2010/12/sm">
+  <pwg:Version>{{ .Version }}</pwg:Version>
+  <pwg:State>{{ .State }}</pwg:State>
+  <scan:Jobs>
+    {{- range .Jobs }}
+    <scan:JobInfo>
+      <pwg:JobUri>/eSCL/ScanJobs/{{ .ID }}</pwg:JobUri>
+      <pwg:JobUuid>{{ .ID }}</pwg:JobUuid>
+      <scan:Age>{{ .Age }}</scan:Age>
+      <pwg:ImagesCompleted>{{ .ImagesCompleted }}</pwg:ImagesCompleted>
+      <pwg:ImagesToTransfer>{{ .ImagesToTransfer }}</pwg:ImagesToTransfer>
+      <pwg:JobState>{{ .State }}</pwg:JobState>
+      <pwg:JobStateReasons><pwg:JobStateReason>{{ .Reason }}</pwg:JobStateReason></pwg:JobStateReasons>
+    </scan:JobInfo>
+    {{- end }}
+  </scan:Jobs>
+</scan:ScannerStatus>
+{{ end -}}
+`))
+
+// esclScanSettings is the body of POST /eSCL/ScanJobs, the namespace
+// prefixes are ignored
+type esclScanSettings struct {
+	XMLName           xml.Name `xml:"ScanSettings"`
+	InputSource       string   `xml:"InputSource"`
+	ColorMode         string   `xml:"ColorMode"`
+	XResolution       int      `xml:"XResolution"`
+	DocumentFormat    string   `xml:"DocumentFormat"`
+	DocumentFormatExt string   `xml:"DocumentFormatExt"`
+	Duplex            bool     `xml:"Duplex"`
+}
+
+func (e esclScanSettings) format() string {
+	if e.DocumentFormatExt != "" {
+		return e.DocumentFormatExt
+	}
+	if e.DocumentFormat != "" {
+		return e.DocumentFormat
+	}
+	return "application/pdf"
+}
+
+// esclJobState returns the job state and reason in eSCL terms, the
+// caller must hold the job lock
+func esclJobState(j *networkJob) (state, reason string) {
+	switch {
+	case j.finished.IsZero():
+		return "Processing", "JobScanning"
+	case j.errCode == errCodeScanCancelled:
+		return "Canceled", "JobCanceledByUser"
+	case j.status >= http.StatusBadRequest:
+		return "Aborted", "AbortedBySystem"
+	}
+	return "Completed", "JobCompletedSuccessfully"
+}
+
+// esclMDNSService returns the DNS-SD service eSCL clients discover the
+// scanner with
+func esclMDNSService(instance string, port int) mdnsService {
+	info := currentDeviceInfo()
+
+	service := "_uscan._tcp"
+	if cfg.TLSCert != "" {
+		service = "_uscans._tcp"
+	}
+
+	return mdnsService{
+		Instance: instance,
+		Type:     service,
+		Port:     port,
+		TXT: []string{
+			"txtvers=1",
+			"ty=" + info.MakeAndModel,
+			"rs=eSCL",
+			"vers=" + esclVersion,
+			"pdl=application/pdf,image/jpeg",
+			"cs=color,grayscale,binary",
+			"is=adf",
+			"duplex=T",
+			"UUID=" + info.UUID,
+		},
+	}
+}
+
+func writeESCL(res http.ResponseWriter, name string, data interface{}) {
+	res.Header().Set("Content-Type", "text/xml")
+	if err := esclTemplates.ExecuteTemplate(res, name, data); err != nil {
+		log.WithError(err).Error("Unable to render eSCL response")
+	}
+}
+
+func handleESCLCapabilities(res http.ResponseWriter, r *http.Request) {
+	writeESCL(res, "capabilities", struct {
+		networkDeviceInfo
+		Version string
+	}{currentDeviceInfo(), esclVersion})
+}
+
+func handleESCLStatus(res http.ResponseWriter, r *http.Request) {
+	type jobInfo struct {
+		ID, State, Reason                      string
+		Age, ImagesCompleted, ImagesToTransfer int
+	}
+
+	status := struct {
+		Version, State string
+		Jobs           []jobInfo
+	}{Version: esclVersion, State: "Idle"}
+
+	if len(runningJobs.List()) > 0 {
+		status.State = "Processing"
+	}
+
+	for _, job := range esclJobs.List() {
+		job.lock.Lock()
+		state, reason := esclJobState(job)
+		status.Jobs = append(status.Jobs, jobInfo{
+			ID:               job.ID,
+			State:            state,
+			Reason:           reason,
+			Age:              int(time.Since(job.Created).Seconds()),
+			ImagesCompleted:  len(job.docs),
+			ImagesToTransfer: len(job.docs) - job.next,
+		})
+		job.lock.Unlock()
+	}
+
+	writeESCL(res, "status", status)
+}
+
+func handleESCLCreateJob(res http.ResponseWriter, r *http.Request) {
+	var settings esclScanSettings
+	if err := xml.NewDecoder(r.Body).Decode(&settings); err != nil {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("Invalid scan settings: %s", err))
+		return
+	}
+
+	if settings.InputSource != "" && settings.InputSource != "Feeder" {
+		writeError(res, http.StatusConflict, errCodeInvalidParameter, "Only the document feeder is available")
+		return
+	}
+
+	format := settings.format()
+	if format != "application/pdf" && format != "image/jpeg" {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("Unsupported document format %q", format))
+		return
+	}
+
+	q := url.Values{}
+	q.Set("duplex", strconv.FormatBool(settings.Duplex))
+	if color, ok := esclColorModes[settings.ColorMode]; ok {
+		q.Set("color", color)
+	}
+	if settings.XResolution > 0 {
+		// Clients expect the requested resolution in the document
+		q.Set("scan-dpi", strconv.Itoa(settings.XResolution))
+		q.Set("pdf-dpi", strconv.Itoa(settings.XResolution))
+	}
+
+	job, err := startNetworkJob(r, esclJobs, format, q)
+	if err != nil {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"job_id": job.ID,
+		"format": format,
+		"user":   requestUser(r),
+	}).Info("Starting scan requested using eSCL")
+
+	res.Header().Set("Location", "/eSCL/ScanJobs/"+job.ID)
+	res.WriteHeader(http.StatusCreated)
+}
+
+// handleESCLNextDocument waits for the scan to finish and returns the
+// next document, 404 signals the client there are no more documents
+func handleESCLNextDocument(res http.ResponseWriter, r *http.Request) {
+	job := esclJobs.Get(r.PathValue("id"))
+	if job == nil {
+		writeError(res, http.StatusNotFound, errCodeNotFound, "No scan job with this ID")
+		return
+	}
+
+	select {
+	case <-job.done:
+	case <-r.Context().Done():
+		return
+	}
+
+	job.lock.Lock()
+	defer job.lock.Unlock()
+
+	if job.next >= len(job.docs) {
+		if job.next == 0 && job.status >= http.StatusBadRequest && job.errCode != errCodeADFEmpty {
+			writeError(res, job.status, job.errCode, "Scan failed")
+			return
+		}
+		writeError(res, http.StatusNotFound, errCodeNotFound, "No more documents")
+		return
+	}
+
+	doc := job.docs[job.next]
+	job.docs[job.next] = nil
+	job.next++
+
+	res.Header().Set("Content-Type", job.Format)
+	res.Header().Set("Content-Length", strconv.Itoa(len(doc)))
+	res.Write(doc)
+}
+
+func handleESCLCancelJob(res http.ResponseWriter, r *http.Request) {
+	job := esclJobs.Get(r.PathValue("id"))
+	if job == nil {
+		writeError(res, http.StatusNotFound, errCodeNotFound, "No scan job with this ID")
+		return
+	}
+
+	// Finished jobs are simply not fetched any further
+	runningJobs.Cancel(job.ID)
+	res.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const scannerProbeInterval = time.Minute
+
+// scanEvent describes a step in the lifecycle of a scan job
+type scanEvent struct {
+	Event     string    `json:"event"` // started, page, completed, failed, delivered, delivery_progress, delivery_failed, maintenance_due
+	JobID     string    `json:"job_id"`
+	Time      time.Time `json:"time"`
+	Page      int       `json:"page,omitempty"`
+	Pages     int       `json:"pages,omitempty"`
+	Documents int       `json:"documents,omitempty"`
+	Filename  string    `json:"filename,omitempty"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Profile   string    `json:"profile,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Target    string    `json:"target,omitempty"`
+	// Bytes of the Size of the document uploaded by delivery_progress
+	Bytes     int64  `json:"bytes,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"`
+	// Task is the maintenance task of maintenance_due events
+	Task string `json:"task,omitempty"`
+}
+
+// mqtt is nil when no broker is configured
+var mqtt *mqttClient
+
+func mqttTopic(name string) string {
+	return cfg.MQTTTopic + "/" + name
+}
+
+func initMQTT() error {
+	clientID := cfg.MQTTClientID
+	if clientID == "" {
+		host, _ := os.Hostname()
+		clientID = "scansnap-go-" + host
+	}
+
+	c, err := newMQTTClient(cfg.MQTTBroker, clientID, cfg.MQTTUser, cfg.MQTTPassword)
+	if err != nil {
+		return err
+	}
+
+	c.will = &mqttMessage{Topic: mqttTopic("status"), Payload: []byte("offline"), Retain: true}
+	c.onConnect = func() {
+		if cfg.MQTTHADiscovery {
+			publishHADiscovery()
+		}
+		publishMQTT(mqttMessage{Topic: mqttTopic("status"), Payload: []byte("online"), Retain: true})
+		publishScannerAvailability()
+	}
+
+	if cfg.MQTTHADiscovery {
+		if storage == nil && !haveUploadTargets() {
+			log.Warn("Home Assistant scan button disabled: Scans started from Home Assistant require --storage-dir or --targets")
+		} else {
+			c.Subscribe(mqttTopic("command/scan"), handleScanCommand)
+		}
+	}
+
+	mqtt = c
+	go c.Run()
+	go func() {
+		for range time.Tick(scannerProbeInterval) {
+			publishScannerAvailability()
+		}
+	}()
+
+	return nil
+}
+
+func publishMQTT(msg mqttMessage) {
+	if mqtt == nil {
+		return
+	}
+
+	if err := mqtt.Publish(msg); err != nil {
+		log.WithError(err).WithField("topic", msg.Topic).Debug("Unable to publish MQTT message")
+	}
+}
+
+// publishEvent announces the event on the configured channels
+func publishEvent(e scanEvent) {
+	grpcJobs.Observe(e)
+
+	if e.Event == "failed" {
+		notifyFailure(e)
+	}
+
+	if mqtt == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.WithError(err).Error("Unable to marshal event")
+		return
+	}
+
+	publishMQTT(mqttMessage{Topic: mqttTopic("events"), Payload: payload})
+
+	// The outcome of the latest job is kept as retained state for
+	// subscribers (e.g. Home Assistant sensors) joining later
+	switch e.Event {
+	case "completed":
+		publishMQTT(mqttMessage{Topic: mqttTopic("last_scan"), Payload: payload, Retain: true})
+	case "failed":
+		publishMQTT(mqttMessage{Topic: mqttTopic("last_error"), Payload: payload, Retain: true})
+	}
+}
+
+// publishScannerAvailability checks whether a scanner is connected and
+// publishes the result as retained message
+func publishScannerAvailability() {
+	state := "available"
+
+	// A running scan proves the scanner is there and must not be
+	// disturbed by listing the devices
+	if usesSANE() {
+		if devs, busy, err := saneScanner.TryDevices(); !busy && (err != nil || len(devs) == 0) {
+			state = "unavailable"
+		}
+	}
+
+	publishMQTT(mqttMessage{Topic: mqttTopic("scanner"), Payload: []byte(state), Retain: true})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// exportKey signs the manifests of compliance exports, nil disables
+// the export
+var exportKey ed25519.PrivateKey
+
+// exportManifest describes the documents contained in a compliance
+// export. Its exact bytes are signed, the signature is stored next to
+// it in the archive.
+type exportManifest struct {
+	Created    time.Time        `json:"created"`
+	ExportedBy string           `json:"exported_by,omitempty"`
+	Generator  string           `json:"generator"`
+	KeyID      string           `json:"key_id"`
+	Documents  []exportDocument `json:"documents"`
+}
+
+type exportDocument struct {
+	File         string          `json:"file"`
+	ID           string          `json:"id"`
+	SHA256       string          `json:"sha256"`
+	Size         int64           `json:"size"`
+	Scanned      time.Time       `json:"scanned"`
+	Pages        int             `json:"pages"`
+	Title        string          `json:"title,omitempty"`
+	Operator     string          `json:"operator,omitempty"`
+	Device       *scanner.Device `json:"device,omitempty"`
+	DeviceSerial string          `json:"device_serial,omitempty"`
+}
+
+func loadExportKey(file string) (ed25519.PrivateKey, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read key: %s", err)
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse key: %s", err)
+	}
+
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Key is no Ed25519 key")
+	}
+	return edKey, nil
+}
+
+// exportKeyID identifies the signing key by the beginning of the
+// SHA-256 of its public key
+func exportKeyID() string {
+	sum := sha256.Sum256(exportKey.Public().(ed25519.PublicKey))
+	return hex.EncodeToString(sum[:8])
+}
+
+func exportPublicKeyPEM() ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(exportKey.Public())
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// deviceSerial extracts the serial number from the device name: the
+// fujitsu backend names USB devices "fujitsu:<model>:<serial>"
+func deviceSerial(dev scanner.Device) string {
+	parts := strings.Split(dev.Name, ":")
+	if len(parts) == 3 && parts[0] == "fujitsu" && parts[1] != "libusb" {
+		return parts[2]
+	}
+	return ""
+}
+
+// writeComplianceExport writes the scans together with the signed
+// manifest into a ZIP archive
+func writeComplianceExport(w io.Writer, recs []*scanRecord, user string) error {
+	zw := zip.NewWriter(w)
+
+	manifest := exportManifest{
+		Created:    time.Now(),
+		ExportedBy: user,
+		Generator:  "scansnap-go " + version,
+		KeyID:      exportKeyID(),
+		Documents:  []exportDocument{},
+	}
+
+	for _, rec := range recs {
+		doc, err := addExportDocument(zw, rec)
+		if err != nil {
+			return err
+		}
+		manifest.Documents = append(manifest.Documents, doc)
+	}
+
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to marshal manifest: %s", err)
+	}
+
+	pub, err := exportPublicKeyPEM()
+	if err != nil {
+		return fmt.Errorf("Unable to encode public key: %s", err)
+	}
+
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"manifest.json", raw},
+		{"manifest.sig", ed25519.Sign(exportKey, raw)},
+		{"public-key.pem", pub},
+	} {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: manifest.Created})
+		if err != nil {
+			return fmt.Errorf("Unable to add %s to archive: %s", f.name, err)
+		}
+		if _, err := fw.Write(f.data); err != nil {
+			return fmt.Errorf("Unable to write %s: %s", f.name, err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("Unable to finalize archive: %s", err)
+	}
+	return nil
+}
+
+// addExportDocument copies the scan into the archive while hashing it
+func addExportDocument(zw *zip.Writer, rec *scanRecord) (exportDocument, error) {
+	doc := exportDocument{
+		File:     "documents/" + rec.Filename,
+		ID:       rec.ID,
+		Scanned:  rec.Created,
+		Pages:    rec.Pages,
+		Title:    rec.Title,
+		Operator: rec.User,
+	}
+
+	if s, err := optionSnapshots.Get(rec.ID); err == nil {
+		doc.Device = &s.Device
+		doc.DeviceSerial = deviceSerial(s.Device)
+	}
+
+	f, err := os.Open(storage.File(rec))
+	if err != nil {
+		return doc, fmt.Errorf("Unable to open scan %s: %s", rec.ID, err)
+	}
+	defer f.Close()
+
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: doc.File, Method: zip.Deflate, Modified: rec.Created})
+	if err != nil {
+		return doc, fmt.Errorf("Unable to add scan %s to archive: %s", rec.ID, err)
+	}
+
+	h := sha256.New()
+	if doc.Size, err = io.Copy(io.MultiWriter(fw, h), f); err != nil {
+		return doc, fmt.Errorf("Unable to write scan %s: %s", rec.ID, err)
+	}
+	doc.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	return doc, nil
+}
+
+// selectExportScans returns the scans given by ?id= (repeatable) or
+// created within ?from= / ?to= (dates or RFC3339 times)
+func selectExportScans(r *http.Request) ([]*scanRecord, error) {
+	q := r.URL.Query()
+
+	if ids := q["id"]; len(ids) > 0 {
+		recs := []*scanRecord{}
+		for _, id := range ids {
+			rec, err := storage.Get(id)
+			if err != nil {
+				return nil, invalidParamError{fmt.Sprintf("Scan %q not found", id)}
+			}
+			recs = append(recs, rec)
+		}
+		return recs, nil
+	}
+
+	var from, to time.Time
+	for param, target := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := q.Get(param); v != "" {
+			t, err := parseDate(v)
+			if err != nil {
+				return nil, invalidParamError{fmt.Sprintf("Invalid value for %s: %q", param, v)}
+			}
+			*target = t
+		}
+	}
+	if from.IsZero() && to.IsZero() {
+		return nil, invalidParamError{"Select the scans to export using id or from / to"}
+	}
+	if !to.IsZero() && len(q.Get("to")) == len("2006-01-02") {
+		// Include the whole day
+		to = to.AddDate(0, 0, 1)
+	}
+
+	all, err := storage.List()
+	if err != nil {
+		return nil, err
+	}
+
+	recs := []*scanRecord{}
+	for i := len(all) - 1; i >= 0; i-- {
+		rec := all[i]
+		if (from.IsZero() || !rec.Created.Before(from)) && (to.IsZero() || rec.Created.Before(to)) {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, nil
+}
+
+func handleComplianceExport(res http.ResponseWriter, r *http.Request) {
+	if storage == nil || exportKey == nil {
+		writeError(res, http.StatusNotFound, errCodeDisabled, "Compliance export is not enabled")
+		return
+	}
+
+	recs, err := selectExportScans(r)
+	if err != nil {
+		if _, ok := err.(invalidParamError); ok {
+			writeError(res, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+			return
+		}
+		log.WithError(err).Error("Unable to list scans")
+		writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to list scans")
+		return
+	}
+
+	if len(recs) == 0 {
+		writeError(res, http.StatusNotFound, errCodeNotFound, "No scans selected")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"scans": len(recs),
+		"user":  requestUser(r),
+	}).Info("Creating compliance export")
+
+	res.Header().Set("Content-Type", "application/zip")
+	res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+		fmt.Sprintf("scansnap-go-export-%s.zip", time.Now().Format("20060102-150405"))))
+
+	out := &lazyResponseWriter{ResponseWriter: res}
+	if err := writeComplianceExport(out, recs, requestUser(r)); err != nil {
+		log.WithError(err).Error("Unable to create compliance export")
+		if !out.written {
+			writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to create compliance export")
+			return
+		}
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func handleExportPublicKey(res http.ResponseWriter, r *http.Request) {
+	if exportKey == nil {
+		writeError(res, http.StatusNotFound, errCodeDisabled, "Compliance export is not enabled")
+		return
+	}
+
+	pub, err := exportPublicKeyPEM()
+	if err != nil {
+		writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to encode public key")
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/x-pem-file")
+	res.Header().Set("X-Key-ID", exportKeyID())
+	res.Write(pub)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// failureInjection holds the developer-controlled failures parsed from
+// the --fail-inject flag. They are used to exercise the error paths of
+// the scan pipeline without needing a misbehaving scanner at hand.
+type failureInjection struct {
+	// JamAfterPage simulates a paper jam after the given number of
+	// pages were read from the scanner (0 = disabled)
+	JamAfterPage int
+	// UploadTimeout lists the upload targets whose deliveries time out,
+	// "*" matches all of them
+	UploadTimeout []string
+	// OCRCrashPage simulates tesseract crashing while recognizing the
+	// given page (1-based, 0 = disabled)
+	OCRCrashPage int
+}
+
+var failInject = failureInjection{}
+
+// parseFailureInjection reads a comma separated list of failure points
+// in the format "name=value" (e.g. "jam-after=3,upload-timeout=nas,
+// ocr-crash=2"), upload-timeout may be given multiple times
+func parseFailureInjection(spec string) (failureInjection, error) {
+	fi := failureInjection{}
+
+	if spec == "" {
+		return fi, nil
+	}
+
+	for _, part := range strings.Split(spec, ",") {
+		var (
+			kv    = strings.SplitN(strings.TrimSpace(part), "=", 2)
+			name  = kv[0]
+			value string
+		)
+
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+
+		switch name {
+		case "jam-after":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return fi, fmt.Errorf("Invalid page count for jam-after: %q", value)
+			}
+			fi.JamAfterPage = n
+
+		case "upload-timeout":
+			if value == "" {
+				return fi, fmt.Errorf("Missing target name for upload-timeout")
+			}
+			fi.UploadTimeout = append(fi.UploadTimeout, value)
+
+		case "ocr-crash":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return fi, fmt.Errorf("Invalid page number for ocr-crash: %q", value)
+			}
+			fi.OCRCrashPage = n
+
+		default:
+			return fi, fmt.Errorf("Unknown failure injection point %q", name)
+		}
+	}
+
+	return fi, nil
+}
+
+// uploadTimesOut tells whether deliveries to the target should fail as
+// if they timed out
+func (f failureInjection) uploadTimesOut(target string) bool {
+	for _, t := range f.UploadTimeout {
+		if t == target || t == "*" {
+			return true
+		}
+	}
+	return false
+}
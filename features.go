@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os/exec"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+)
+
+// capability tells whether an optional integration is compiled into
+// the binary and whether it can be used with the running configuration
+type capability struct {
+	Built     bool   `json:"built"`
+	Available bool   `json:"available"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// capabilities is returned by GET /capabilities for clients to detect
+// the features instead of guessing from failing requests
+type capabilities struct {
+	Features      map[string]capability `json:"features"`
+	Modes         map[string]bool       `json:"modes"`
+	Steps         []string              `json:"steps"`
+	ImageBackends []string              `json:"image_backends"`
+}
+
+// toolCapability checks an integration calling an external binary
+func toolCapability(built bool, tags, binary string) capability {
+	c := capability{Built: built}
+	switch {
+	case !built:
+		c.Reason = fmt.Sprintf("Built %s", tags)
+	case binary == "":
+		c.Reason = "Binary not configured"
+	default:
+		if _, err := exec.LookPath(binary); err != nil {
+			c.Reason = fmt.Sprintf("%s not found", binary)
+		} else {
+			c.Available = true
+		}
+	}
+	return c
+}
+
+// flagCapability checks an integration enabled by a flag
+func flagCapability(built bool, tags string, enabled bool, flag string) capability {
+	c := capability{Built: built, Available: built && enabled}
+	switch {
+	case !built:
+		c.Reason = fmt.Sprintf("Built %s", tags)
+	case !enabled:
+		c.Reason = fmt.Sprintf("Not enabled by %s", flag)
+	}
+	return c
+}
+
+func currentCapabilities() capabilities {
+	vips := false
+	for _, name := range scanner.ImageOpsNames() {
+		vips = vips || name == "vips"
+	}
+
+	c := capabilities{
+		Features: map[string]capability{
+			"ocr":     toolCapability(featureOCR, "with -tags noocr", cfg.Tesseract),
+			"barcode": toolCapability(featureBarcode, "with -tags nobarcode", cfg.Zbarimg),
+			"escl":    flagCapability(featureESCL, "with -tags noescl", cfg.ESCL, "--escl"),
+			"vips":    flagCapability(vips, "without -tags vips", cfg.ImageBackend == "vips", "--image-backend"),
+		},
+		Steps:         []string{},
+		ImageBackends: scanner.ImageOpsNames(),
+	}
+	for _, name := range scanner.StepNames() {
+		if name != "ocr" || featureOCR {
+			c.Steps = append(c.Steps, name)
+		}
+	}
+
+	ocr := c.Features["ocr"].Available
+	c.Modes = map[string]bool{
+		"photo":   true,
+		"card":    ocr,
+		"receipt": ocr,
+	}
+
+	return c
+}
+
+func handleCapabilities(res http.ResponseWriter, r *http.Request) {
+	writeJSON(res, http.StatusOK, currentCapabilities())
+}
+
+// unavailableStep replaces the factory of a step left out of the build
+// to explain why pipelines using it are rejected
+func unavailableStep(name, tag string) scanner.StepFactory {
+	return func(scanner.StepOptions) (scanner.Step, error) {
+		return nil, fmt.Errorf("The %s step is not available in this build (built with -tags %s)", name, tag)
+	}
+}
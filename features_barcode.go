@@ -0,0 +1,9 @@
+//go:build !nobarcode
+// +build !nobarcode
+
+package main
+
+// featureBarcode enables reading barcodes using zbarimg for barcode
+// routes and routing sheets, minimal builds leave it out using
+// -tags nobarcode
+const featureBarcode = true
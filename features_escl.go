@@ -0,0 +1,8 @@
+//go:build !noescl
+// +build !noescl
+
+package main
+
+// featureESCL enables the eSCL (AirScan) server, minimal builds leave
+// it out using -tags noescl
+const featureESCL = true
@@ -0,0 +1,6 @@
+//go:build nobarcode
+// +build nobarcode
+
+package main
+
+const featureBarcode = false
@@ -0,0 +1,6 @@
+//go:build noescl
+// +build noescl
+
+package main
+
+const featureESCL = false
@@ -0,0 +1,6 @@
+//go:build noocr
+// +build noocr
+
+package main
+
+const featureOCR = false
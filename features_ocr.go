@@ -0,0 +1,8 @@
+//go:build !noocr
+// +build !noocr
+
+package main
+
+// featureOCR enables the OCR using tesseract (the ocr step, ocr-osd and
+// ocr-overlay), minimal builds leave it out using -tags noocr
+const featureOCR = true
@@ -0,0 +1,8 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// featureSANE tells whether the scans use SANE by default, Windows
+// builds have no SANE and scan using WIA
+const featureSANE = true
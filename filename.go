@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// filenameData is available in the --filename-template
+type filenameData struct {
+	Date    string // 2006-01-02
+	Time    string // 150405
+	Counter int    // Number of the scan since the start (continued from the storage)
+	Profile string
+	Title   string
+	User    string
+	Pages   int
+}
+
+var (
+	filenameTemplate *template.Template
+
+	scanCounter     int
+	scanCounterLock sync.Mutex
+)
+
+func parseFilenameTemplate(tpl string) error {
+	t, err := template.New("filename").Option("missingkey=error").Parse(tpl)
+	if err != nil {
+		return fmt.Errorf("Unable to parse filename template: %s", err)
+	}
+
+	// Render once with example data to catch references to unknown fields
+	if err := t.Execute(new(bytes.Buffer), filenameData{}); err != nil {
+		return fmt.Errorf("Invalid filename template: %s", err)
+	}
+
+	filenameTemplate = t
+	return nil
+}
+
+// contentDisposition returns the Content-Disposition header of a scan
+// document using the --content-disposition type, names containing
+// non-ASCII characters are encoded according to RFC 2231
+func contentDisposition(filename string) string {
+	return mime.FormatMediaType(cfg.ContentDisposition, map[string]string{"filename": filename})
+}
+
+func nextScanCounter() int {
+	scanCounterLock.Lock()
+	defer scanCounterLock.Unlock()
+
+	scanCounter++
+	return scanCounter
+}
+
+// scanFilename renders the filename template for a scan. The extension
+// given in the template is replaced by ext to match the content.
+func scanFilename(params *scanParams, user string, pages int, created time.Time, ext string) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := filenameTemplate.Execute(buf, filenameData{
+		Date:    created.Format("2006-01-02"),
+		Time:    created.Format("150405"),
+		Counter: nextScanCounter(),
+		Profile: params.Profile,
+		Title:   params.Info.Title,
+		User:    user,
+		Pages:   pages,
+	}); err != nil {
+		return "", fmt.Errorf("Unable to render filename: %s", err)
+	}
+
+	name := sanitizeFilename(buf.String())
+	name = strings.TrimSuffix(name, path.Ext(name))
+	if name == "" {
+		name = "scan"
+	}
+
+	return name + ext, nil
+}
+
+// sanitizeFilename removes characters not safe to use in filenames on
+// common file systems and in HTTP headers
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r < 32, strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		}
+		return r
+	}, name)
+
+	return strings.TrimLeft(strings.TrimSpace(name), ".")
+}
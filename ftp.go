@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Upload targets for FTP drop folders (with optional explicit FTPS) and
+// SFTP servers, the latter using the OpenSSH sftp client
+
+// remotePath is the directory template shared by the FTP and SFTP
+// targets, the document is uploaded with a temporary name and renamed
+// afterwards for consumers not to pick up incomplete files
+type remotePath struct {
+	Path string `yaml:"path"`
+
+	path *template.Template
+}
+
+func (r *remotePath) parse() error {
+	var err error
+	if r.path, err = template.New("path").Parse(r.Path); err != nil {
+		return fmt.Errorf("invalid path template: %s", err)
+	}
+	return nil
+}
+
+// files returns the directories to create, the temporary and the final
+// name of the document
+func (r *remotePath) files(doc *deliveryDocument) (dirs []string, tmp, final string, err error) {
+	buf := new(bytes.Buffer)
+	if err = r.path.Execute(buf, doc); err != nil {
+		return nil, "", "", fmt.Errorf("Unable to render path: %s", err)
+	}
+
+	dir := path.Clean(buf.String())
+	if strings.ContainsAny(dir, "\"\r\n") {
+		return nil, "", "", fmt.Errorf("Invalid characters in path %q", dir)
+	}
+
+	if dir != "." && dir != "/" {
+		for d := dir; d != "." && d != "/"; d = path.Dir(d) {
+			dirs = append([]string{d}, dirs...)
+		}
+	}
+
+	return dirs, path.Join(dir, "."+doc.Filename+".part"), path.Join(dir, doc.Filename), nil
+}
+
+type ftpTarget struct {
+	Host     string `yaml:"host"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	// TLS enables explicit FTPS (AUTH TLS) for control and data
+	// connections
+	TLS        bool `yaml:"tls"`
+	remotePath `yaml:",inline"`
+}
+
+func newFTPTarget(decode func(interface{}) error) (uploadTarget, error) {
+	t := &ftpTarget{User: "anonymous", Password: "scansnap-go@"}
+	if err := decode(t); err != nil {
+		return nil, err
+	}
+
+	if t.Host == "" {
+		return nil, fmt.Errorf("host is required")
+	}
+	if _, _, err := net.SplitHostPort(t.Host); err != nil {
+		t.Host = net.JoinHostPort(t.Host, "21")
+	}
+
+	return t, t.parse()
+}
+
+// Address implements addressedTarget
+func (f *ftpTarget) Address() string { return f.Host }
+
+// Upload implements uploadTarget
+func (f *ftpTarget) Upload(ctx context.Context, doc *deliveryDocument) error {
+	dirs, tmp, final, err := f.files(doc)
+	if err != nil {
+		return err
+	}
+
+	in, _, err := doc.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	c, err := f.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	for _, d := range dirs {
+		// Fails for existing directories, errors show up on upload
+		c.cmd(0, "MKD %s", d)
+	}
+
+	data, err := c.passive(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err = c.cmd(1, "STOR %s", tmp); err != nil {
+		data.Close()
+		return fmt.Errorf("Unable to start upload: %s", err)
+	}
+
+	_, err = io.Copy(data, in)
+	if cerr := data.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to upload document: %s", err)
+	}
+	if _, _, err = c.ReadResponse(2); err != nil {
+		return fmt.Errorf("Upload failed: %s", err)
+	}
+
+	if _, err = c.cmd(3, "RNFR %s", tmp); err == nil {
+		_, err = c.cmd(2, "RNTO %s", final)
+	}
+	if err != nil {
+		c.cmd(0, "DELE %s", tmp)
+		return fmt.Errorf("Unable to rename uploaded document: %s", err)
+	}
+
+	c.cmd(0, "QUIT")
+	return nil
+}
+
+type ftpConn struct {
+	*textproto.Conn
+	conn      net.Conn
+	tlsConfig *tls.Config
+}
+
+// connect logs in and switches to binary transfers
+func (f *ftpTarget) connect(ctx context.Context) (*ftpConn, error) {
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", f.Host)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to FTP server: %s", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c := &ftpConn{Conn: textproto.NewConn(conn), conn: conn}
+	if _, _, err = c.ReadResponse(2); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("FTP server refused connection: %s", err)
+	}
+
+	if f.TLS {
+		host, _, _ := net.SplitHostPort(f.Host)
+		// Servers commonly require the data connections to resume the
+		// session of the control connection
+		c.tlsConfig = &tls.Config{ServerName: host, ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+
+		if _, err = c.cmd(2, "AUTH TLS"); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("Unable to start TLS: %s", err)
+		}
+		tlsConn := tls.Client(conn, c.tlsConfig)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("TLS handshake failed: %s", err)
+		}
+		c.Conn, c.conn = textproto.NewConn(tlsConn), tlsConn
+
+		if _, err = c.cmd(2, "PBSZ 0"); err == nil {
+			_, err = c.cmd(2, "PROT P")
+		}
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("Unable to protect data connections: %s", err)
+		}
+	}
+
+	code, err := c.cmd(0, "USER %s", f.User)
+	if err == nil && code == 331 {
+		code, err = c.cmd(0, "PASS %s", f.Password)
+	}
+	if err == nil && code/100 != 2 {
+		err = fmt.Errorf("status %d", code)
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("Login failed: %s", err)
+	}
+
+	if _, err = c.cmd(2, "TYPE I"); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("Unable to switch to binary mode: %s", err)
+	}
+
+	return c, nil
+}
+
+// cmd sends the command and reads the response, expectCode is the
+// expected first digit of the status (0 = any)
+func (c *ftpConn) cmd(expectCode int, format string, args ...interface{}) (int, error) {
+	if _, err := c.Cmd(format, args...); err != nil {
+		return 0, err
+	}
+	code, _, err := c.ReadResponse(expectCode)
+	return code, err
+}
+
+// passive opens a data connection, the address announced by the
+// server is ignored as it is often wrong behind NAT
+func (c *ftpConn) passive(ctx context.Context) (net.Conn, error) {
+	var port int
+
+	if _, err := c.Cmd("EPSV"); err != nil {
+		return nil, err
+	}
+	code, msg, err := c.ReadResponse(2)
+	if code == 229 && err == nil {
+		// Entering Extended Passive Mode (|||port|)
+		if start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)"); start >= 0 && end > start+4 {
+			port, err = strconv.Atoi(msg[start+4 : end])
+		}
+	} else {
+		if _, err = c.Cmd("PASV"); err != nil {
+			return nil, err
+		}
+		if _, msg, err = c.ReadResponse(2); err != nil {
+			return nil, fmt.Errorf("Unable to enter passive mode: %s", err)
+		}
+		// Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+		fields := strings.Split(strings.Trim(msg[strings.Index(msg, "(")+1:], ").\r\n "), ",")
+		if len(fields) == 6 {
+			p1, _ := strconv.Atoi(fields[4])
+			p2, _ := strconv.Atoi(fields[5])
+			port = p1<<8 | p2
+		}
+	}
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("Invalid passive mode response %q", msg)
+	}
+
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	data, err := new(net.Dialer).DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open data connection: %s", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		data.SetDeadline(deadline)
+	}
+
+	if c.tlsConfig != nil {
+		return tls.Client(data, c.tlsConfig), nil
+	}
+	return data, nil
+}
+
+type sftpTarget struct {
+	Host string `yaml:"host"`
+	User string `yaml:"user"`
+	// Identity is the private key to authenticate with, the default
+	// keys of the user running the daemon are used otherwise
+	Identity string `yaml:"identity"`
+	// KnownHosts replaces the known_hosts file of the user running the
+	// daemon, the host key must be known
+	KnownHosts string `yaml:"known_hosts"`
+	remotePath `yaml:",inline"`
+}
+
+func newSFTPTarget(decode func(interface{}) error) (uploadTarget, error) {
+	t := &sftpTarget{}
+	if err := decode(t); err != nil {
+		return nil, err
+	}
+
+	if t.Host == "" || t.User == "" {
+		return nil, fmt.Errorf("host and user are required")
+	}
+	if _, _, err := net.SplitHostPort(t.Host); err != nil {
+		t.Host = net.JoinHostPort(t.Host, "22")
+	}
+
+	return t, t.parse()
+}
+
+// Address implements addressedTarget
+func (s *sftpTarget) Address() string { return s.Host }
+
+// Upload implements uploadTarget
+func (s *sftpTarget) Upload(ctx context.Context, doc *deliveryDocument) error {
+	dirs, tmp, final, err := s.files(doc)
+	if err != nil {
+		return err
+	}
+
+	host, port, _ := net.SplitHostPort(s.Host)
+	args := []string{"-b", "-", "-P", port, "-o", "BatchMode=yes"}
+	if s.Identity != "" {
+		args = append(args, "-i", s.Identity)
+	}
+	if s.KnownHosts != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+s.KnownHosts)
+	}
+	args = append(args, s.User+"@"+host)
+
+	// Commands prefixed with "-" may fail without aborting the batch
+	batch := new(bytes.Buffer)
+	for _, d := range dirs {
+		fmt.Fprintf(batch, "-mkdir %s\n", sftpQuote(d))
+	}
+	fmt.Fprintf(batch, "put %s %s\n", sftpQuote(doc.File), sftpQuote(tmp))
+	fmt.Fprintf(batch, "rename %s %s\n", sftpQuote(tmp), sftpQuote(final))
+
+	output := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, cfg.SFTP, args...)
+	cmd.Stdin = batch
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Unable to execute sftp: %s (%s)", err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// sftpQuote quotes an argument of an sftp batch command
+func sftpQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
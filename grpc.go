@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Minimal gRPC server on top of the HTTP/2 support of net/http
+// supporting unary and server streaming calls with uncompressed
+// protobuf messages
+
+// gRPC status codes used by the services
+const (
+	grpcOK                 = 0
+	grpcCancelled          = 1
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcAborted            = 10
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+
+	// grpcMaxMessageSize limits the size of received messages
+	grpcMaxMessageSize = 4 << 20
+)
+
+// grpcError ends a call with the given status code, ErrorCode is sent
+// as x-error-code trailer
+type grpcError struct {
+	Code      int
+	Message   string
+	ErrorCode string
+}
+
+func (g grpcError) Error() string { return g.Message }
+
+// grpcMethod handles a call with the received request message, send
+// writes a response message (once for unary calls)
+type grpcMethod func(r *http.Request, req []byte, send func(msg []byte) error) error
+
+// grpcService serves the methods of a service by their name
+type grpcService struct {
+	Name    string
+	Methods map[string]grpcMethod
+}
+
+func (g grpcService) ServeHTTP(res http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(res, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/grpc")
+	res.Header().Set("Trailer", "Grpc-Status, Grpc-Message, X-Error-Code")
+
+	err := g.call(res, r)
+	if err == nil {
+		res.Header().Set("Grpc-Status", strconv.Itoa(grpcOK))
+		return
+	}
+
+	gerr, ok := err.(grpcError)
+	if !ok {
+		log.WithError(err).WithField("method", r.URL.Path).Error("gRPC call failed")
+		gerr = grpcError{Code: grpcInternal, Message: err.Error()}
+	}
+	res.Header().Set("Grpc-Status", strconv.Itoa(gerr.Code))
+	res.Header().Set("Grpc-Message", grpcEncodeMessage(gerr.Message))
+	if gerr.ErrorCode != "" {
+		res.Header().Set("X-Error-Code", gerr.ErrorCode)
+	}
+}
+
+func (g grpcService) call(res http.ResponseWriter, r *http.Request) error {
+	name, ok := strings.CutPrefix(r.URL.Path, "/"+g.Name+"/")
+	method := g.Methods[name]
+	if !ok || method == nil {
+		return grpcError{Code: grpcUnimplemented, Message: fmt.Sprintf("Unknown method %s", r.URL.Path)}
+	}
+
+	if !requestNetworkAllowed(r) {
+		return grpcError{Code: grpcPermissionDenied, Message: "Requests from your network are not allowed", ErrorCode: errCodeForbidden}
+	}
+
+	r, ok = auth.authenticate(r)
+	if !ok {
+		return grpcError{Code: grpcUnauthenticated, Message: "Authentication required", ErrorCode: errCodeUnauthorized}
+	}
+
+	req, err := grpcReadMessage(r.Body)
+	if err != nil {
+		return err
+	}
+
+	flusher, _ := res.(http.Flusher)
+	return method(r, req, func(msg []byte) error {
+		frame := make([]byte, 5, 5+len(msg))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+		if _, err := res.Write(append(frame, msg...)); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+}
+
+// grpcReadMessage reads the single request message of a call
+func grpcReadMessage(body io.Reader) ([]byte, error) {
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(body, head); err != nil {
+		return nil, grpcError{Code: grpcInvalidArgument, Message: "Missing request message"}
+	}
+
+	if head[0] != 0 {
+		return nil, grpcError{Code: grpcUnimplemented, Message: "Compressed messages are not supported"}
+	}
+
+	size := binary.BigEndian.Uint32(head[1:])
+	if size > grpcMaxMessageSize {
+		return nil, grpcError{Code: grpcInvalidArgument, Message: "Request message too large"}
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, grpcError{Code: grpcInvalidArgument, Message: "Incomplete request message"}
+	}
+	return msg, nil
+}
+
+// grpcEncodeMessage percent-encodes the status message as required by
+// the gRPC protocol
+func grpcEncodeMessage(msg string) string {
+	return url.PathEscape(msg)
+}
+
+// grpcStatusFromHTTP maps the status of an HTTP error response to the
+// equivalent gRPC status code
+func grpcStatusFromHTTP(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInvalidArgument
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcNotFound
+	case http.StatusConflict:
+		return grpcAborted
+	case http.StatusUnprocessableEntity:
+		return grpcFailedPrecondition
+	case http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusServiceUnavailable:
+		return grpcUnavailable
+	case http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	}
+	return grpcInternal
+}
+
+// protoMessage builds a protobuf encoded message, fields having their
+// default value are omitted like proto3 does
+type protoMessage []byte
+
+func (p protoMessage) tag(field, wireType int) protoMessage {
+	return binary.AppendUvarint(p, uint64(field<<3|wireType))
+}
+
+func (p protoMessage) Varint(field int, v uint64) protoMessage {
+	if v == 0 {
+		return p
+	}
+	return binary.AppendUvarint(p.tag(field, 0), v)
+}
+
+func (p protoMessage) Int(field int, v int) protoMessage {
+	return p.Varint(field, uint64(int64(v)))
+}
+
+func (p protoMessage) Bytes(field int, b []byte) protoMessage {
+	if len(b) == 0 {
+		return p
+	}
+	return append(binary.AppendUvarint(p.tag(field, 2), uint64(len(b))), b...)
+}
+
+func (p protoMessage) String(field int, s string) protoMessage {
+	return p.Bytes(field, []byte(s))
+}
+
+// Message embeds a message, unlike other fields it is also written
+// when empty to be present in repeated fields
+func (p protoMessage) Message(field int, m protoMessage) protoMessage {
+	return append(binary.AppendUvarint(p.tag(field, 2), uint64(len(m))), m...)
+}
+
+// protoField is a decoded field of a protobuf message, Varint is set
+// for wire type 0, Data for length delimited fields
+type protoField struct {
+	Number int
+	Varint uint64
+	Data   []byte
+}
+
+// String returns the field as string, Int as signed integer (int32 /
+// int64) and Bool as bool
+func (p protoField) String() string { return string(p.Data) }
+func (p protoField) Int() int       { return int(int64(p.Varint)) }
+func (p protoField) Bool() bool     { return p.Varint != 0 }
+
+// decodeProtoMessage returns the fields of a protobuf message, fields
+// of unsupported wire types (fixed32 / fixed64) are skipped
+func decodeProtoMessage(b []byte) ([]protoField, error) {
+	var fields []protoField
+
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("Invalid field tag")
+		}
+		b = b[n:]
+
+		f := protoField{Number: int(tag >> 3)}
+		switch tag & 7 {
+		case 0:
+			if f.Varint, n = binary.Uvarint(b); n <= 0 {
+				return nil, fmt.Errorf("Invalid varint in field %d", f.Number)
+			}
+			b = b[n:]
+
+		case 1, 5:
+			size := 8
+			if tag&7 == 5 {
+				size = 4
+			}
+			if len(b) < size {
+				return nil, fmt.Errorf("Truncated field %d", f.Number)
+			}
+			b = b[size:]
+			continue
+
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return nil, fmt.Errorf("Truncated field %d", f.Number)
+			}
+			f.Data = b[n : n+int(size)]
+			b = b[n+int(size):]
+
+		default:
+			return nil, fmt.Errorf("Unsupported wire type %d in field %d", tag&7, f.Number)
+		}
+
+		fields = append(fields, f)
+	}
+
+	return fields, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// grpcFrame prefixes the message with the uncompressed message header
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+func TestProtoMessage(t *testing.T) {
+	for name, tc := range map[string]struct {
+		msg protoMessage
+		exp []byte
+	}{
+		"varint":          {protoMessage{}.Varint(1, 150), []byte{0x08, 0x96, 0x01}},
+		"default varint":  {protoMessage{}.Varint(1, 0), nil},
+		"negative int":    {protoMessage{}.Int(2, -1), []byte{0x10, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		"string":          {protoMessage{}.String(2, "testing"), append([]byte{0x12, 0x07}, "testing"...)},
+		"empty string":    {protoMessage{}.String(2, ""), nil},
+		"large field":     {protoMessage{}.Varint(16, 1), []byte{0x80, 0x01, 0x01}},
+		"empty message":   {protoMessage{}.Message(3, nil), []byte{0x1a, 0x00}},
+		"nested message":  {protoMessage{}.Message(3, protoMessage{}.Varint(1, 150)), []byte{0x1a, 0x03, 0x08, 0x96, 0x01}},
+		"multiple fields": {protoMessage{}.Int(1, 1).String(2, "a"), []byte{0x08, 0x01, 0x12, 0x01, 'a'}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if !bytes.Equal(tc.msg, tc.exp) {
+				t.Errorf("expected %x, got %x", tc.exp, []byte(tc.msg))
+			}
+		})
+	}
+}
+
+func TestDecodeProtoMessage(t *testing.T) {
+	for name, tc := range map[string]struct {
+		msg    []byte
+		fields []protoField
+		valid  bool
+	}{
+		"round trip": {
+			protoMessage{}.Int(1, -5).String(2, "report").Message(3, nil),
+			[]protoField{{Number: 1, Varint: ^uint64(4)}, {Number: 2, Data: []byte("report")}, {Number: 3, Data: []byte{}}},
+			true,
+		},
+		"fixed fields skipped": {
+			[]byte{0x09, 1, 2, 3, 4, 5, 6, 7, 8, 0x15, 1, 2, 3, 4, 0x18, 0x01},
+			[]protoField{{Number: 3, Varint: 1}},
+			true,
+		},
+		"empty":             {nil, nil, true},
+		"truncated tag":     {[]byte{0x80}, nil, false},
+		"truncated varint":  {[]byte{0x08, 0x96}, nil, false},
+		"truncated fixed64": {[]byte{0x09, 1, 2, 3}, nil, false},
+		"truncated bytes":   {[]byte{0x12, 0x07, 't', 'e'}, nil, false},
+		"group wire type":   {[]byte{0x0b}, nil, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fields, err := decodeProtoMessage(tc.msg)
+			if (err == nil) != tc.valid {
+				t.Fatalf("expected valid=%v, got %v", tc.valid, err)
+			}
+			if !reflect.DeepEqual(fields, tc.fields) {
+				t.Errorf("expected fields %+v, got %+v", tc.fields, fields)
+			}
+		})
+	}
+
+	fields, _ := decodeProtoMessage(protoMessage{}.Int(1, -5).String(2, "report").Varint(3, 1))
+	if fields[0].Int() != -5 || fields[1].String() != "report" || !fields[2].Bool() {
+		t.Errorf("unexpected field values %+v", fields)
+	}
+}
+
+func TestGRPCReadMessage(t *testing.T) {
+	large := make([]byte, 5)
+	binary.BigEndian.PutUint32(large[1:], grpcMaxMessageSize+1)
+
+	for name, tc := range map[string]struct {
+		body []byte
+		exp  []byte
+		code int
+	}{
+		"message":       {grpcFrame([]byte("request")), []byte("request"), grpcOK},
+		"empty message": {grpcFrame(nil), []byte{}, grpcOK},
+		"missing":       {nil, nil, grpcInvalidArgument},
+		"short header":  {[]byte{0, 0, 0}, nil, grpcInvalidArgument},
+		"compressed":    {append([]byte{1}, grpcFrame([]byte("request"))[1:]...), nil, grpcUnimplemented},
+		"too large":     {large, nil, grpcInvalidArgument},
+		"incomplete":    {grpcFrame([]byte("request"))[:8], nil, grpcInvalidArgument},
+	} {
+		t.Run(name, func(t *testing.T) {
+			msg, err := grpcReadMessage(bytes.NewReader(tc.body))
+
+			code := grpcOK
+			if err != nil {
+				gerr, ok := err.(grpcError)
+				if !ok {
+					t.Fatalf("expected a grpcError, got %T", err)
+				}
+				code = gerr.Code
+			}
+			if code != tc.code || !bytes.Equal(msg, tc.exp) {
+				t.Errorf("expected %q (status %d), got %q (%d)", tc.exp, tc.code, msg, code)
+			}
+		})
+	}
+}
+
+func TestGRPCService(t *testing.T) {
+	svc := grpcService{
+		Name: "scansnap.v1.Scanner",
+		Methods: map[string]grpcMethod{
+			"Echo": func(r *http.Request, req []byte, send func([]byte) error) error {
+				for i := 0; i < 2; i++ {
+					if err := send(req); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			"Busy": func(r *http.Request, req []byte, send func([]byte) error) error {
+				return grpcError{Code: grpcUnavailable, Message: "Scanner is busy right now", ErrorCode: errCodeScannerBusy}
+			},
+			"Broken": func(r *http.Request, req []byte, send func([]byte) error) error {
+				return errors.New("broken")
+			},
+		},
+	}
+
+	for name, tc := range map[string]struct {
+		method, path, contentType string
+		body                      []byte
+
+		httpStatus int
+		status     string
+		message    string
+		errorCode  string
+		response   []byte
+	}{
+		"streamed response": {
+			http.MethodPost, "/scansnap.v1.Scanner/Echo", "application/grpc+proto", grpcFrame([]byte("ping")),
+			http.StatusOK, "0", "", "", append(grpcFrame([]byte("ping")), grpcFrame([]byte("ping"))...),
+		},
+		"status error": {
+			http.MethodPost, "/scansnap.v1.Scanner/Busy", "application/grpc", grpcFrame(nil),
+			http.StatusOK, "14", "Scanner%20is%20busy%20right%20now", errCodeScannerBusy, nil,
+		},
+		"internal error": {
+			http.MethodPost, "/scansnap.v1.Scanner/Broken", "application/grpc", grpcFrame(nil),
+			http.StatusOK, "13", "broken", "", nil,
+		},
+		"unknown method": {
+			http.MethodPost, "/scansnap.v1.Scanner/Missing", "application/grpc", grpcFrame(nil),
+			http.StatusOK, "12", "Unknown%20method%20%2Fscansnap.v1.Scanner%2FMissing", "", nil,
+		},
+		"other service": {
+			http.MethodPost, "/other.Service/Echo", "application/grpc", grpcFrame(nil),
+			http.StatusOK, "12", "Unknown%20method%20%2Fother.Service%2FEcho", "", nil,
+		},
+		"missing message": {
+			http.MethodPost, "/scansnap.v1.Scanner/Echo", "application/grpc", nil,
+			http.StatusOK, "3", "Missing%20request%20message", "", nil,
+		},
+		"not grpc": {
+			http.MethodPost, "/scansnap.v1.Scanner/Echo", "application/json", nil,
+			http.StatusUnsupportedMediaType, "", "", "", nil,
+		},
+		"get request": {
+			http.MethodGet, "/scansnap.v1.Scanner/Echo", "application/grpc", nil,
+			http.StatusUnsupportedMediaType, "", "", "", nil,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, bytes.NewReader(tc.body))
+			r.Header.Set("Content-Type", tc.contentType)
+			res := httptest.NewRecorder()
+
+			svc.ServeHTTP(res, r)
+
+			if res.Code != tc.httpStatus {
+				t.Fatalf("expected HTTP status %d, got %d", tc.httpStatus, res.Code)
+			}
+			if tc.httpStatus != http.StatusOK {
+				return
+			}
+
+			h := res.Header()
+			if h.Get("Grpc-Status") != tc.status || h.Get("Grpc-Message") != tc.message || h.Get("X-Error-Code") != tc.errorCode {
+				t.Errorf("expected status %s %q (%s), got %s %q (%s)", tc.status, tc.message, tc.errorCode,
+					h.Get("Grpc-Status"), h.Get("Grpc-Message"), h.Get("X-Error-Code"))
+			}
+			if !bytes.Equal(res.Body.Bytes(), tc.response) {
+				t.Errorf("expected response %x, got %x", tc.response, res.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestGRPCStatusFromHTTP(t *testing.T) {
+	for status, exp := range map[int]int{
+		http.StatusBadRequest:          grpcInvalidArgument,
+		http.StatusUnauthorized:        grpcUnauthenticated,
+		http.StatusConflict:            grpcAborted,
+		http.StatusServiceUnavailable:  grpcUnavailable,
+		http.StatusInternalServerError: grpcInternal,
+		http.StatusTeapot:              grpcInternal,
+	} {
+		if got := grpcStatusFromHTTP(status); got != exp {
+			t.Errorf("HTTP status %d: expected %d, got %d", status, exp, got)
+		}
+	}
+}
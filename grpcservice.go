@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// scannerGRPCService implements the scansnap.v1.Scanner service
+// defined in scansnap.proto
+var scannerGRPCService = grpcService{
+	Name: "scansnap.v1.Scanner",
+	Methods: map[string]grpcMethod{
+		"StartScan":      grpcStartScan,
+		"StreamProgress": grpcStreamProgress,
+		"GetResult":      grpcGetResult,
+		"ListDevices":    grpcListDevices,
+	},
+}
+
+// Finished jobs started using gRPC are kept this long for their result
+// to be fetched
+const grpcJobTTL = time.Hour
+
+// States of a job, values of the Progress.State enum
+const (
+	grpcJobQueued    = 1
+	grpcJobScanning  = 2
+	grpcJobCompleted = 3
+	grpcJobFailed    = 4
+)
+
+func listenAndServeGRPC() error {
+	server := &http.Server{Addr: cfg.GRPCListen, Handler: scannerGRPCService, Protocols: new(http.Protocols)}
+
+	if cfg.TLSCert == "" {
+		// gRPC clients use HTTP/2 without TLS upgrade (h2c)
+		server.Protocols.SetUnencryptedHTTP2(true)
+		return server.ListenAndServe()
+	}
+
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	server.TLSConfig = tlsConfig
+	server.Protocols.SetHTTP2(true)
+	return server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+}
+
+// grpcJob is a scan started using StartScan, it is executed like a
+// POST /scan request and its response is kept to be fetched later
+type grpcJob struct {
+	ID      string
+	Created time.Time
+	User    string
+	// Request is the JSON scan request
+	Request []byte
+
+	lock sync.Mutex
+	// changed is closed and replaced on every update
+	changed   chan struct{}
+	state     int
+	pages     int
+	documents int
+	finished  time.Time
+	result    *bufferResponseWriter
+	err       grpcError
+}
+
+func (j *grpcJob) update(fn func()) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	fn()
+	close(j.changed)
+	j.changed = make(chan struct{})
+	j.persist()
+}
+
+// grpcJobRecord is the state of a job persisted in --state-dir, the
+// document of completed jobs is stored next to it
+type grpcJobRecord struct {
+	ID        string          `json:"id"`
+	Created   time.Time       `json:"created"`
+	User      string          `json:"user,omitempty"`
+	Request   json.RawMessage `json:"request"`
+	State     int             `json:"state"`
+	Pages     int             `json:"pages"`
+	Documents int             `json:"documents"`
+	Finished  time.Time       `json:"finished"`
+	Status    int             `json:"status,omitempty"`
+	Header    http.Header     `json:"header,omitempty"`
+	Error     grpcError       `json:"error"`
+	// Redacted is set if secrets were removed from the request
+	Redacted bool `json:"redacted,omitempty"`
+}
+
+// persist writes the job to the state directory, the caller must hold
+// the lock
+func (j *grpcJob) persist() {
+	if jobState == nil {
+		return
+	}
+
+	request, redacted := persistedScanRequest(j.Request)
+	rec := grpcJobRecord{
+		ID:        j.ID,
+		Created:   j.Created,
+		User:      j.User,
+		Request:   request,
+		Redacted:  redacted,
+		State:     j.state,
+		Pages:     j.pages,
+		Documents: j.documents,
+		Finished:  j.finished,
+		Error:     j.err,
+	}
+	if j.result != nil {
+		rec.Status, rec.Header = j.result.status, j.result.header
+	}
+
+	if err := jobState.Save("grpc", j.ID, rec); err != nil {
+		log.WithError(err).WithField("job_id", j.ID).Error("Unable to persist job")
+	}
+}
+
+// persistedScanRequest removes the document password from the scan
+// request to not write it to disk, it is only kept in memory
+func persistedScanRequest(raw json.RawMessage) (json.RawMessage, bool) {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &req); err != nil {
+		// The scan fails anyway, whatever it contains is not persisted
+		return nil, true
+	}
+
+	var output map[string]json.RawMessage
+	if err := json.Unmarshal(req["output"], &output); err != nil {
+		return raw, false
+	}
+	if pw, ok := output["password"]; !ok || string(pw) == "null" {
+		return raw, false
+	}
+
+	delete(output, "password")
+	req["output"], _ = json.Marshal(output)
+	redacted, _ := json.Marshal(req)
+	return redacted, true
+}
+
+// scanRequest creates the request executing the scan of the job, the
+// scan outlives the call starting it so only the user is taken from it
+func (j *grpcJob) scanRequest() (*http.Request, error) {
+	ctx := context.WithValue(context.Background(), ctxKeyUser, j.User)
+	ctx = context.WithValue(ctx, ctxKeyJobID, j.ID)
+	sr, err := http.NewRequestWithContext(ctx, http.MethodPost, "/scan", bytes.NewReader(j.Request))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create scan request: %s", err)
+	}
+	return sr, nil
+}
+
+// progress returns the encoded Progress message and the channel closed
+// on the next update
+func (j *grpcJob) progress() (msg protoMessage, done bool, changed <-chan struct{}) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	msg = protoMessage(nil).
+		String(1, j.ID).
+		Int(2, j.state).
+		Int(3, j.pages).
+		String(4, j.err.ErrorCode).
+		String(5, j.err.Message)
+
+	return msg, !j.finished.IsZero(), j.changed
+}
+
+// finish stores the response of the scan
+func (j *grpcJob) finish(res *bufferResponseWriter) {
+	j.update(func() {
+		j.finished = time.Now()
+		j.result = res
+
+		if jobState != nil {
+			// The record referring to the document is written after it
+			if err := ioutil.WriteFile(jobState.DataFile("grpc", j.ID), res.body.Bytes(), 0600); err != nil {
+				log.WithError(err).WithField("job_id", j.ID).Error("Unable to persist job result")
+			}
+		}
+
+		if res.status < http.StatusBadRequest {
+			j.state = grpcJobCompleted
+			return
+		}
+
+		var body struct {
+			Error apiError `json:"error"`
+		}
+		if err := json.Unmarshal(res.body.Bytes(), &body); err != nil {
+			body.Error = apiError{Code: errCodeInternal, Message: "Scan failed"}
+		}
+
+		j.state = grpcJobFailed
+		j.err = grpcError{Code: grpcStatusFromHTTP(res.status), Message: body.Error.Message, ErrorCode: body.Error.Code}
+	})
+}
+
+type grpcJobStore struct {
+	jobs map[string]*grpcJob
+	lock sync.Mutex
+}
+
+var grpcJobs = &grpcJobStore{jobs: map[string]*grpcJob{}}
+
+func (g *grpcJobStore) Add(user string, request []byte) *grpcJob {
+	job := &grpcJob{ID: newID(), Created: time.Now(), User: user, Request: request, changed: make(chan struct{}), state: grpcJobQueued}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.expire()
+	g.jobs[job.ID] = job
+	job.persist()
+	return job
+}
+
+// Restore loads the jobs of the previous run from the state directory:
+// finished jobs keep their result, queued jobs are started again one
+// after another in their order and jobs interrupted while scanning fail
+func (g *grpcJobStore) Restore() {
+	queued := []*grpcJob{}
+
+	jobState.Load("grpc", func(raw []byte) error {
+		rec := grpcJobRecord{}
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return err
+		}
+
+		job := &grpcJob{
+			ID:        rec.ID,
+			Created:   rec.Created,
+			User:      rec.User,
+			Request:   rec.Request,
+			changed:   make(chan struct{}),
+			state:     rec.State,
+			pages:     rec.Pages,
+			documents: rec.Documents,
+			finished:  rec.Finished,
+			err:       rec.Error,
+		}
+
+		switch rec.State {
+		case grpcJobCompleted, grpcJobFailed:
+			data, err := ioutil.ReadFile(jobState.DataFile("grpc", rec.ID))
+			if err != nil {
+				return fmt.Errorf("Unable to read result: %s", err)
+			}
+			job.result = &bufferResponseWriter{header: rec.Header, status: rec.Status}
+			job.result.body.Write(data)
+
+		case grpcJobScanning:
+			job.state, job.finished = grpcJobFailed, time.Now()
+			job.err = grpcError{Code: grpcAborted, Message: "Scan was interrupted by a restart of the daemon", ErrorCode: errCodeScanInterrupted}
+			job.persist()
+
+		default:
+			if rec.Redacted {
+				// The requested document can not be produced without the
+				// password
+				job.state, job.finished = grpcJobFailed, time.Now()
+				job.err = grpcError{Code: grpcAborted, Message: "Scan with a document password was interrupted by a restart of the daemon, passwords are not persisted", ErrorCode: errCodeScanInterrupted}
+				job.persist()
+				break
+			}
+			queued = append(queued, job)
+		}
+
+		g.lock.Lock()
+		g.jobs[job.ID] = job
+		g.lock.Unlock()
+		return nil
+	})
+
+	if len(queued) == 0 {
+		return
+	}
+
+	sort.Slice(queued, func(a, b int) bool { return queued[a].Created.Before(queued[b].Created) })
+	log.WithField("jobs", len(queued)).Info("Starting scans queued before the restart")
+	go func() {
+		for _, job := range queued {
+			sr, err := job.scanRequest()
+			if err != nil {
+				log.WithError(err).WithField("job_id", job.ID).Error("Unable to restart queued scan")
+				continue
+			}
+			g.run(job, sr)
+		}
+	}()
+}
+
+func (g *grpcJobStore) Get(id string) *grpcJob {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.expire()
+	return g.jobs[id]
+}
+
+// Observe updates the progress of the job the event belongs to
+func (g *grpcJobStore) Observe(e scanEvent) {
+	job := g.Get(e.JobID)
+	if job == nil {
+		return
+	}
+
+	switch e.Event {
+	case "started":
+		job.update(func() { job.state = grpcJobScanning })
+	case "page":
+		job.update(func() { job.pages = e.Page })
+	case "completed":
+		job.update(func() { job.pages, job.documents = e.Pages, e.Documents })
+	}
+}
+
+// expire removes finished jobs whose result was not fetched in time,
+// the caller must hold the lock
+func (g *grpcJobStore) expire() {
+	for id, job := range g.jobs {
+		job.lock.Lock()
+		finished := job.finished
+		job.lock.Unlock()
+
+		if !finished.IsZero() && time.Since(finished) > grpcJobTTL {
+			delete(g.jobs, id)
+			if jobState != nil {
+				jobState.Remove("grpc", id)
+			}
+		}
+	}
+}
+
+// run executes the scan and stores its response in the job
+func (g *grpcJobStore) run(job *grpcJob, r *http.Request) {
+	res := &bufferResponseWriter{header: http.Header{}}
+
+	defer func() {
+		if p := recover(); p != nil {
+			// The document failed to render after it was started
+			log.WithField("job_id", job.ID).Errorf("Scan started using gRPC aborted: %v", p)
+			res = &bufferResponseWriter{header: http.Header{}}
+			writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to generate document")
+		}
+		job.finish(res)
+	}()
+
+	handleScanJSONRequest(res, r)
+}
+
+// bufferResponseWriter keeps a complete response in memory
+type bufferResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferResponseWriter) Header() http.Header { return b.header }
+
+func (b *bufferResponseWriter) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func (b *bufferResponseWriter) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+// decodeScanRequest converts the ScanRequest message into the JSON
+// scan request it mirrors
+func decodeScanRequest(msg []byte) (scanRequest, error) {
+	var req scanRequest
+
+	fields, err := decodeProtoMessage(msg)
+	if err != nil {
+		return req, fmt.Errorf("Invalid scan request: %s", err)
+	}
+
+	var (
+		stringFields = map[int]**string{
+			4:  &req.Scan.Color,
+			8:  &req.Processing.Pages,
+			11: &req.Processing.CoverText,
+			17: &req.Output.Password,
+			18: &req.Output.Title,
+			19: &req.Output.Author,
+			20: &req.Output.Subject,
+			21: &req.Output.Keywords,
+			22: &req.Output.CreationDate,
+			23: &req.Processing.Pipeline,
+			27: &req.Processing.OCRLang,
+			33: &req.Processing.BlankPages,
+			34: &req.Processing.Steps,
+			37: &req.Processing.PageCountMismatch,
+			39: &req.Processing.DuplicatePages,
+			43: &req.Output.MaxSize,
+			45: &req.Output.PDFPlacement,
+			46: &req.Scan.Priority,
+			47: &req.Scan.Source,
+		}
+		boolFields = map[int]**bool{
+			5:  &req.Scan.Duplex,
+			10: &req.Processing.Cover,
+			12: &req.Processing.OCROverlay,
+			13: &req.Processing.Partial,
+			16: &req.Output.PDFA,
+			26: &req.Output.PageNumbers,
+			28: &req.Processing.OCROSD,
+			29: &req.Output.Lossless,
+			30: &req.Output.Archive,
+			31: &req.Processing.RawFrames,
+			32: &req.Processing.DuplexSplit,
+			40: &req.Output.Photo,
+			41: &req.Output.Card,
+			42: &req.Output.Receipt,
+			48: &req.Output.Optimize,
+		}
+		intFields = map[int]**int{
+			6:  &req.Scan.ScanDPI,
+			7:  &req.Scan.RotateBack,
+			9:  &req.Processing.SplitEvery,
+			14: &req.Output.PDFDPI,
+			15: &req.Output.Quality,
+			24: &req.Processing.Sharpen,
+			25: &req.Processing.Contrast,
+			35: &req.Processing.ExpectPages,
+			36: &req.Processing.ExpectSheets,
+			38: &req.Scan.MaxPages,
+			44: &req.Scan.Depth,
+		}
+	)
+
+	for _, f := range fields {
+		switch f.Number {
+		case 1:
+			req.Profile = f.String()
+		case 2:
+			req.Device = f.String()
+		case 3:
+			req.Resume = f.String()
+		}
+
+		if target, ok := stringFields[f.Number]; ok {
+			v := f.String()
+			*target = &v
+		}
+		if target, ok := boolFields[f.Number]; ok {
+			v := f.Bool()
+			*target = &v
+		}
+		if target, ok := intFields[f.Number]; ok {
+			v := f.Int()
+			*target = &v
+		}
+	}
+
+	return req, nil
+}
+
+// grpcRequestedJob returns the job named in a JobRequest message
+func grpcRequestedJob(msg []byte) (*grpcJob, error) {
+	fields, err := decodeProtoMessage(msg)
+	if err != nil {
+		return nil, grpcError{Code: grpcInvalidArgument, Message: err.Error(), ErrorCode: errCodeInvalidParameter}
+	}
+
+	var id string
+	for _, f := range fields {
+		if f.Number == 1 {
+			id = f.String()
+		}
+	}
+
+	job := grpcJobs.Get(id)
+	if job == nil {
+		return nil, grpcError{Code: grpcNotFound, Message: "No scan with this job ID", ErrorCode: errCodeNotFound}
+	}
+	return job, nil
+}
+
+// grpcStartScan queues the scan and returns its job ID immediately,
+// failures are reported by StreamProgress and GetResult
+func grpcStartScan(r *http.Request, msg []byte, send func([]byte) error) error {
+	req, err := decodeScanRequest(msg)
+	if err != nil {
+		return grpcError{Code: grpcInvalidArgument, Message: err.Error(), ErrorCode: errCodeInvalidParameter}
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal scan request: %s", err)
+	}
+
+	job := grpcJobs.Add(requestUser(r), body)
+	sr, err := job.scanRequest()
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"job_id": job.ID,
+		"user":   requestUser(r),
+	}).Info("Starting scan requested using gRPC")
+	go grpcJobs.run(job, sr)
+
+	return send(protoMessage(nil).String(1, job.ID))
+}
+
+// grpcStreamProgress sends the progress of the job on every change
+// until it is finished
+func grpcStreamProgress(r *http.Request, msg []byte, send func([]byte) error) error {
+	job, err := grpcRequestedJob(msg)
+	if err != nil {
+		return err
+	}
+
+	var last protoMessage
+	for {
+		progress, done, changed := job.progress()
+		if !bytes.Equal(progress, last) {
+			if err := send(progress); err != nil {
+				return err
+			}
+			last = progress
+		}
+
+		if done {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return grpcError{Code: grpcCancelled, Message: "Call cancelled"}
+		}
+	}
+}
+
+// grpcGetResult returns the document of a completed job or the error
+// the job failed with
+func grpcGetResult(r *http.Request, msg []byte, send func([]byte) error) error {
+	job, err := grpcRequestedJob(msg)
+	if err != nil {
+		return err
+	}
+
+	job.lock.Lock()
+	defer job.lock.Unlock()
+
+	switch job.state {
+	case grpcJobFailed:
+		return job.err
+	case grpcJobQueued, grpcJobScanning:
+		return grpcError{Code: grpcFailedPrecondition, Message: "Scan is still running"}
+	}
+
+	res := job.result
+	_, dispParams, _ := mime.ParseMediaType(res.header.Get("Content-Disposition"))
+
+	result := protoMessage(nil).
+		String(1, job.ID).
+		String(2, res.header.Get("Content-Type")).
+		String(3, dispParams["filename"]).
+		Bytes(4, res.body.Bytes()).
+		Int(5, job.pages).
+		Int(6, job.documents)
+	for _, w := range res.header.Values("X-Scan-Warning") {
+		result = result.String(7, w)
+	}
+	result = result.String(8, res.header.Get("X-Error-Code"))
+
+	return send(result)
+}
+
+func grpcListDevices(r *http.Request, msg []byte, send func([]byte) error) error {
+	var (
+		devs []scanner.Device
+		err  error
+	)
+
+	if fake, ok := scanBackend.(*scanner.Fake); ok {
+		var caps scanner.DeviceCapabilities
+		caps, err = fake.DeviceOptions()
+		devs = []scanner.Device{caps.Device}
+	} else {
+		devs, err = saneScanner.Devices()
+	}
+	if err != nil {
+		_, code := scanErrorStatus(err)
+		return grpcError{Code: grpcUnavailable, Message: err.Error(), ErrorCode: code}
+	}
+
+	list := protoMessage(nil)
+	for _, d := range devs {
+		list = list.Message(1, protoMessage(nil).
+			String(1, d.Name).
+			String(2, d.Vendor).
+			String(3, d.Model).
+			String(4, d.Type))
+	}
+
+	return send(list)
+}
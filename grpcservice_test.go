@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestPersistedScanRequest(t *testing.T) {
+	for name, tc := range map[string]struct {
+		request, persisted string
+		redacted           bool
+	}{
+		"no output":     {`{"profile":"invoice"}`, `{"profile":"invoice"}`, false},
+		"no password":   {`{"output":{"title":"Report"}}`, `{"output":{"title":"Report"}}`, false},
+		"null password": {`{"output":{"password":null}}`, `{"output":{"password":null}}`, false},
+		"password":      {`{"profile":"invoice","output":{"password":"secret","title":"Report"}}`, `{"output":{"title":"Report"},"profile":"invoice"}`, true},
+		"invalid":       {`{"output":{"password":"secret"`, ``, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			persisted, redacted := persistedScanRequest([]byte(tc.request))
+			if string(persisted) != tc.persisted || redacted != tc.redacted {
+				t.Errorf("expected %s (redacted %v), got %s (%v)", tc.persisted, tc.redacted, persisted, redacted)
+			}
+		})
+	}
+}
+
+func TestGRPCJobRestorePassword(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newJobStateStore(dir)
+	if err != nil {
+		t.Fatalf("creating store: %s", err)
+	}
+	prev := jobState
+	jobState = store
+	t.Cleanup(func() { jobState = prev })
+
+	job := &grpcJob{
+		ID:      "a1b2c3",
+		Created: time.Now(),
+		Request: []byte(`{"output":{"password":"secret","title":"Report"}}`),
+		changed: make(chan struct{}),
+		state:   grpcJobQueued,
+	}
+	job.persist()
+
+	raw, err := ioutil.ReadFile(path.Join(dir, "grpc", job.ID+".json"))
+	if err != nil {
+		t.Fatalf("reading record: %s", err)
+	}
+	if bytes.Contains(raw, []byte("secret")) || !bytes.Contains(raw, []byte("Report")) {
+		t.Errorf("expected the record to contain the request without password, got %s", raw)
+	}
+
+	// Waiting jobs without password would be started again
+	jobs := &grpcJobStore{jobs: map[string]*grpcJob{}}
+	jobs.Restore()
+
+	restored := jobs.jobs[job.ID]
+	if restored == nil {
+		t.Fatalf("job was not restored")
+	}
+	if restored.state != grpcJobFailed || restored.err.ErrorCode != errCodeScanInterrupted {
+		t.Errorf("expected the job to fail with %s, got state %d (%+v)", errCodeScanInterrupted, restored.state, restored.err)
+	}
+}
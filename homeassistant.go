@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// haUser is recorded as the user of scans started from Home Assistant
+const haUser = "homeassistant"
+
+var haScanRunning atomic.Bool
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+}
+
+// haEntity is the payload of a Home Assistant MQTT discovery message,
+// only the fields used by the entities below are present
+type haEntity struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	Device            haDevice `json:"device"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	CommandTopic      string   `json:"command_topic,omitempty"`
+	StateTopic        string   `json:"state_topic,omitempty"`
+	ValueTemplate     string   `json:"value_template,omitempty"`
+	AttributesTopic   string   `json:"json_attributes_topic,omitempty"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+	Icon              string   `json:"icon,omitempty"`
+	PayloadOn         string   `json:"payload_on,omitempty"`
+	PayloadOff        string   `json:"payload_off,omitempty"`
+}
+
+type haComponent struct {
+	component, objectID string
+	entity              haEntity
+}
+
+// publishHADiscovery announces the scanner as a device with its
+// entities to Home Assistant
+func publishHADiscovery() {
+	var (
+		nodeID = haNodeID(mqtt.clientID)
+		device = haDevice{
+			Identifiers:  []string{mqtt.clientID},
+			Name:         "ScanSnap",
+			Manufacturer: "Fujitsu",
+			Model:        "scansnap-go",
+			SWVersion:    version,
+		}
+	)
+
+	entities := []haComponent{
+		{"binary_sensor", "scanner", haEntity{
+			Name:        "Scanner",
+			StateTopic:  mqttTopic("scanner"),
+			DeviceClass: "connectivity",
+			PayloadOn:   "available",
+			PayloadOff:  "unavailable",
+		}},
+		{"sensor", "last_scan", haEntity{
+			Name:            "Last scan",
+			StateTopic:      mqttTopic("last_scan"),
+			ValueTemplate:   "{{ value_json.time }}",
+			AttributesTopic: mqttTopic("last_scan"),
+			DeviceClass:     "timestamp",
+		}},
+		{"sensor", "last_scan_pages", haEntity{
+			Name:              "Last scan pages",
+			StateTopic:        mqttTopic("last_scan"),
+			ValueTemplate:     "{{ value_json.pages }}",
+			UnitOfMeasurement: "pages",
+			Icon:              "mdi:file-document-multiple",
+		}},
+		{"sensor", "last_error", haEntity{
+			Name:       "Last error",
+			StateTopic: mqttTopic("last_error"),
+			// States are limited to 255 characters
+			ValueTemplate:   "{{ value_json.error[:255] }}",
+			AttributesTopic: mqttTopic("last_error"),
+			Icon:            "mdi:alert-circle",
+		}},
+	}
+
+	if storage != nil || haveUploadTargets() {
+		entities = append(entities, haComponent{"button", "scan", haEntity{
+			Name:         "Start scan",
+			CommandTopic: mqttTopic("command/scan"),
+			Icon:         "mdi:scanner",
+		}})
+	}
+
+	for _, e := range entities {
+		e.entity.UniqueID = nodeID + "_" + e.objectID
+		e.entity.Device = device
+		e.entity.AvailabilityTopic = mqttTopic("status")
+
+		payload, err := json.Marshal(e.entity)
+		if err != nil {
+			log.WithError(err).Error("Unable to marshal Home Assistant discovery message")
+			continue
+		}
+
+		publishMQTT(mqttMessage{
+			Topic:   strings.Join([]string{cfg.MQTTHAPrefix, e.component, nodeID, e.objectID, "config"}, "/"),
+			Payload: payload,
+			Retain:  true,
+		})
+	}
+}
+
+// haNodeID replaces the characters not allowed in discovery topics
+func haNodeID(clientID string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+			return r
+		}
+		return '_'
+	}, clientID)
+}
+
+// handleScanCommand starts a scan when the button is pressed in Home
+// Assistant. The scan is processed like a request to /scan.pdf and
+// only ends up in the storage and the upload targets.
+func handleScanCommand(msg mqttMessage) {
+	if !haScanRunning.CompareAndSwap(false, true) {
+		log.Warn("Ignoring scan command from MQTT, a scan started from MQTT is still running")
+		return
+	}
+	defer haScanRunning.Store(false)
+
+	log.Info("Starting scan requested using MQTT")
+	if status := runHeadlessScan(haUser, cfg.MQTTHAScanProfile); status >= http.StatusBadRequest {
+		log.WithField("status", status).Error("Scan requested using MQTT failed")
+	}
+}
+
+// runHeadlessScan processes a scan like a request to /scan.pdf without
+// a client receiving the document and returns the response status
+func runHeadlessScan(user, profile string) int {
+	q := url.Values{}
+	if profile != "" {
+		q.Set("profile", profile)
+	}
+
+	r, err := http.NewRequest(http.MethodGet, "/scan.pdf?"+q.Encode(), nil)
+	if err != nil {
+		log.WithError(err).Error("Unable to create scan request")
+		return http.StatusInternalServerError
+	}
+	r = r.WithContext(context.WithValue(r.Context(), ctxKeyUser, user))
+
+	res := &discardResponseWriter{header: http.Header{}}
+	handleScanRequest(res, r)
+	return res.status
+}
+
+// discardResponseWriter keeps the status of a response and drops its
+// body
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (d *discardResponseWriter) Header() http.Header { return d.header }
+
+func (d *discardResponseWriter) Write(p []byte) (int, error) {
+	if d.status == 0 {
+		d.status = http.StatusOK
+	}
+	return len(p), nil
+}
+
+func (d *discardResponseWriter) WriteHeader(status int) {
+	if d.status == 0 {
+		d.status = status
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultLanguage is used for clients not asking for a supported
+// language, the messages in the code are written in it
+const defaultLanguage = "en"
+
+// messageBundles translate the messages of the API and the UI by their
+// English text, messages without translation are sent in English
+var messageBundles = map[string]map[string]string{
+	"de": {
+		// API errors
+		"Admin access required":                                      "Administratorrechte erforderlich",
+		"Admin API requires authentication to be configured":         "Die Admin-API erfordert eine konfigurierte Anmeldung",
+		"Authentication required":                                    "Anmeldung erforderlich",
+		"Compliance export is not enabled":                           "Der Compliance-Export ist nicht aktiviert",
+		"Invalid JSON body":                                          "Ungültiger JSON-Inhalt",
+		"name is required to tell others who is using the scanner":   "Ein Name ist erforderlich, damit andere sehen, wer den Scanner nutzt",
+		"No metadata found for the job":                              "Für diesen Auftrag wurden keine Metadaten gefunden",
+		"No more documents":                                          "Keine weiteren Dokumente",
+		"No running scan with this job ID":                           "Kein laufender Scan mit dieser Auftrags-ID",
+		"No running scan with this job ID or page not processed yet": "Kein laufender Scan mit dieser Auftrags-ID oder die Seite ist noch nicht verarbeitet",
+		"No scan job with this ID":                                   "Kein Scan-Auftrag mit dieser ID",
+		"No scans selected":                                          "Keine Scans ausgewählt",
+		"Only the document feeder is available":                      "Nur der Dokumenteneinzug ist verfügbar",
+		"Page not found":                                             "Seite nicht gefunden",
+		"Page selection does not contain any of the scanned pages":   "Die Seitenauswahl enthält keine der gescannten Seiten",
+		"No scan with this job ID is waiting for the scanner":        "Kein Scan mit dieser Auftrags-ID wartet auf den Scanner",
+		"Partial scan not found or expired":                          "Unterbrochener Scan nicht gefunden oder abgelaufen",
+		"Partial scan to resume not found or expired":                "Der fortzusetzende Scan wurde nicht gefunden oder ist abgelaufen",
+		"Priority urgent requires admin access":                      "Die Priorität urgent erfordert Administratorrechte",
+		"Requests from your network are not allowed":                 "Anfragen aus deinem Netzwerk sind nicht erlaubt",
+		"Scan failed":                      "Der Scan ist fehlgeschlagen",
+		"Scan history is not enabled":      "Der Scan-Verlauf ist nicht aktiviert",
+		"Scan not found":                   "Scan nicht gefunden",
+		"Scanner is in use by %s until %s": "Der Scanner wird bis %[2]s von %[1]s verwendet",
+		"Scanner is not claimed":           "Der Scanner ist nicht reserviert",
+		"The document feeder is empty, load the documents and try again":                                                                                             "Der Dokumenteneinzug ist leer, lege die Dokumente ein und versuche es erneut",
+		"The flatbed scans one side of one page, source flatbed can not be combined with duplex, expect-pages or expect-sheets, use a session to scan several pages": "Das Flachbett scannt eine Seite einseitig, source flatbed kann nicht mit duplex, expect-pages oder expect-sheets kombiniert werden, nutze eine Sitzung, um mehrere Seiten zu scannen",
+		"The scanner is not able to validate options":                                                                                                                "Der Scanner kann keine Optionen prüfen",
+		"The device has no sleep timer":                                                                                                                              "Das Gerät hat keinen Ruhezustands-Timer",
+		"The scanner backend does not support power control":                                                                                                         "Das Scanner-Backend unterstützt keine Energiesteuerung",
+		"The scanner is not able to describe its options":                                                                                                            "Der Scanner kann seine Optionen nicht beschreiben",
+		"Too many requests, slow down":                                                                                                                               "Zu viele Anfragen, bitte etwas langsamer",
+		"Unable to generate document":                                                                                                                                "Das Dokument konnte nicht erstellt werden",
+		"Unable to list scans":                                                                                                                                       "Die Scans konnten nicht aufgelistet werden",
+		"Unable to render the pages":                                                                                                                                 "Die Seiten konnten nicht dargestellt werden",
+		"Scans into a session can not be resumed, scan the remaining sheets into the session instead":                                                                "Scans in eine Sitzung können nicht fortgesetzt werden, scanne die restlichen Blätter stattdessen in die Sitzung",
+
+		// Descriptions of the error codes of failed scans
+		"A previous scan is still being finished, try again in a moment":  "Ein vorheriger Scan wird noch abgeschlossen, versuche es gleich noch einmal",
+		"Paper jam or double feed, clear the feeder and try again":        "Papierstau oder Doppeleinzug, leere den Einzug und versuche es erneut",
+		"The cover of the scanner is open, close it and try again":        "Die Abdeckung des Scanners ist offen, schließe sie und versuche es erneut",
+		"The number of pages does not match the expected count":           "Die Seitenzahl entspricht nicht der erwarteten Anzahl",
+		"The scan has more pages than allowed":                            "Der Scan hat mehr Seiten als erlaubt",
+		"The scan was cancelled":                                          "Der Scan wurde abgebrochen",
+		"The scan was interrupted by a restart":                           "Der Scan wurde durch einen Neustart unterbrochen",
+		"The scan took too long and was stopped":                          "Der Scan hat zu lange gedauert und wurde beendet",
+		"The scanner is busy, try again in a moment":                      "Der Scanner ist beschäftigt, versuche es gleich noch einmal",
+		"The scanner is not available, check that it is connected and on": "Der Scanner ist nicht verfügbar, prüfe ob er angeschlossen und eingeschaltet ist",
+		"The scanner is unable to scan, see the log for details":          "Der Scanner konnte nicht scannen, Details stehen im Log",
+		"The storage for scanned pages is full":                           "Der Speicher für gescannte Seiten ist voll",
+		"Too many scans are waiting, try again later":                     "Zu viele Scans warten, versuche es später erneut",
+
+		// Rescan assistant
+		"Continue scan":                   "Scan fortsetzen",
+		"Scan interrupted":                "Scan unterbrochen",
+		"The scan stopped with an error:": "Der Scan wurde mit einem Fehler beendet:",
+		"%d sheet(s) were captured successfully. The last good page looks like this:": "%d Blatt/Blätter wurden erfolgreich erfasst. Die letzte gute Seite sieht so aus:",
+		"Last captured page":             "Zuletzt erfasste Seite",
+		"Place the sheets starting with": "Lege die Blätter ab",
+		"sheet %d":                       "Blatt %d",
+		"back into the feeder and continue the scan. The new pages are appended to the %d page(s) already captured.": "wieder in den Einzug und setze den Scan fort. Die neuen Seiten werden an die %d bereits erfassten Seite(n) angehängt.",
+
+		// Session assistant
+		"Scan session":          "Scan-Sitzung",
+		"The last scan failed:": "Der letzte Scan ist fehlgeschlagen:",
+		"%d page(s) were scanned into the document so far.": "%d Seite(n) wurden bisher in das Dokument gescannt.",
+		"Last scanned page": "Zuletzt gescannte Seite",
+		"Place the next page on the glass and scan it, or finish the document if all pages are scanned.":        "Lege die nächste Seite auf das Glas und scanne sie, oder schließe das Dokument ab, wenn alle Seiten gescannt sind.",
+		"Place the next sheets into the feeder and scan them, or finish the document if all pages are scanned.": "Lege die nächsten Blätter in den Einzug und scanne sie, oder schließe das Dokument ab, wenn alle Seiten gescannt sind.",
+		"Scan next page":   "Nächste Seite scannen",
+		"Scan next sheets": "Nächste Blätter scannen",
+		"Finish document":  "Dokument abschließen",
+		"Paper size: %s":   "Papierformat: %s",
+
+		// Notifications
+		"Scan completed":            "Scan abgeschlossen",
+		"Scan completed: %s":        "Scan abgeschlossen: %s",
+		"%d pages":                  "%d Seiten",
+		"profile %s":                "Profil %s",
+		"Scan failed: %s":           "Scan fehlgeschlagen: %s",
+		"(profile %s)":              "(Profil %s)",
+		"Scanned %d page(s) on %s.": "%d Seite(n) gescannt am %s.",
+		"Scanner cleaning due":      "Reinigung des Scanners fällig",
+		"Scanner calibration due":   "Kalibrierung des Scanners fällig",
+		"Scanner cleaning is due: %d pages were scanned since (reminder at %d pages)":    "Die Reinigung des Scanners ist fällig: seitdem wurden %d Seiten gescannt (Erinnerung bei %d Seiten)",
+		"Scanner calibration is due: %d pages were scanned since (reminder at %d pages)": "Die Kalibrierung des Scanners ist fällig: seitdem wurden %d Seiten gescannt (Erinnerung bei %d Seiten)",
+	},
+}
+
+// errCodeDescriptions describe the causes of failed scans, they replace
+// the error of the scanner for clients asking for another language
+var errCodeDescriptions = map[string]string{
+	errCodeADFEmpty:          "The document feeder is empty, load the documents and try again",
+	errCodeCooldown:          "A previous scan is still being finished, try again in a moment",
+	errCodeCoverOpen:         "The cover of the scanner is open, close it and try again",
+	errCodePageCountMismatch: "The number of pages does not match the expected count",
+	errCodePageLimitExceeded: "The scan has more pages than allowed",
+	errCodePaperJam:          "Paper jam or double feed, clear the feeder and try again",
+	errCodeQueueFull:         "Too many scans are waiting, try again later",
+	errCodeScanCancelled:     "The scan was cancelled",
+	errCodeScanFailed:        "The scanner is unable to scan, see the log for details",
+	errCodeScanInterrupted:   "The scan was interrupted by a restart",
+	errCodeScanTimeout:       "The scan took too long and was stopped",
+	errCodeScannerBusy:       "The scanner is busy, try again in a moment",
+	errCodeSpoolFull:         "The storage for scanned pages is full",
+	errCodeUnavailable:       "The scanner is not available, check that it is connected and on",
+}
+
+// localize returns the message in the language, formatted with args
+// like fmt.Sprintf if they are given
+func localize(lang, msg string, args ...interface{}) string {
+	if t, ok := messageBundles[lang][msg]; ok {
+		msg = t
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// localized tells whether the message has a translation into the
+// language, the default language needs none
+func localized(lang, msg string) bool {
+	if lang == defaultLanguage {
+		return true
+	}
+	_, ok := messageBundles[lang][msg]
+	return ok
+}
+
+// negotiateLanguage picks the supported language preferred in the
+// Accept-Language header, regional variants (de-AT) match their
+// language
+func negotiateLanguage(header string) string {
+	type preference struct {
+		lang string
+		q    float64
+	}
+
+	prefs := []preference{}
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		lang, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if lang != defaultLanguage && messageBundles[lang] == nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, preference{lang, q})
+		}
+	}
+
+	if len(prefs) == 0 {
+		return defaultLanguage
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	return prefs[0].lang
+}
+
+// languageWriter carries the language and units negotiated for the
+// request to the helpers writing the response
+type languageWriter struct {
+	http.ResponseWriter
+	lang  string
+	units string
+}
+
+// Flush keeps streamed responses working through the writer
+func (l *languageWriter) Flush() {
+	if f, ok := l.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the connection
+func (l *languageWriter) Unwrap() http.ResponseWriter { return l.ResponseWriter }
+
+// localizeResponses negotiates the language of the messages and the
+// units of the paper sizes sent to the client
+func localizeResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&languageWriter{res, requestLanguage(r), requestUnits(r)}, r)
+	})
+}
+
+// requestLanguage returns the language the client asked for
+func requestLanguage(r *http.Request) string {
+	return negotiateLanguage(r.Header.Get("Accept-Language"))
+}
+
+// responseLanguage returns the language negotiated for the response,
+// the writers wrapping it are unwrapped to find it
+func responseLanguage(res http.ResponseWriter) string {
+	for res != nil {
+		if l, ok := res.(*languageWriter); ok {
+			return l.lang
+		}
+		u, ok := res.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		res = u.Unwrap()
+	}
+	return defaultLanguage
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxIdempotencyKeyLength limits the Idempotency-Key header
+const maxIdempotencyKeyLength = 255
+
+// idempotentScan is the response of a scan request made with an
+// Idempotency-Key, replayed to retries of the request instead of
+// scanning again
+type idempotentScan struct {
+	Key     string
+	Request string
+	Created time.Time
+
+	// done is closed once the response is recorded or dropped
+	done   chan struct{}
+	status int
+	header http.Header
+	file   string
+}
+
+type idempotentScanStore struct {
+	scans map[string]*idempotentScan
+	lock  sync.Mutex
+}
+
+var idempotentScans = &idempotentScanStore{scans: map[string]*idempotentScan{}}
+
+// Begin returns the scan recorded for the key, if there is none a new
+// one is registered and started is true
+func (s *idempotentScanStore) Begin(key, request string) (scan *idempotentScan, started bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for k, e := range s.scans {
+		if e.file != "" && time.Since(e.Created) > cfg.IdempotencyTTL {
+			os.Remove(e.file)
+			delete(s.scans, k)
+		}
+	}
+
+	if e, ok := s.scans[key]; ok {
+		return e, false
+	}
+
+	e := &idempotentScan{Key: key, Request: request, Created: time.Now(), done: make(chan struct{})}
+	s.scans[key] = e
+	return e, true
+}
+
+// Finish keeps the recorded response, Drop forgets the key so a retry
+// scans again
+func (s *idempotentScanStore) Finish(e *idempotentScan, status int, header http.Header, file string) {
+	s.lock.Lock()
+	e.status, e.header, e.file = status, header, file
+	s.lock.Unlock()
+	close(e.done)
+}
+
+func (s *idempotentScanStore) Drop(e *idempotentScan) {
+	s.lock.Lock()
+	delete(s.scans, e.Key)
+	s.lock.Unlock()
+	close(e.done)
+}
+
+// idempotencyRecorder passes the response to the client while writing
+// its body into a file for replaying it
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   *os.File
+	err    error
+}
+
+func (i *idempotencyRecorder) WriteHeader(status int) {
+	if i.status == 0 {
+		i.status = status
+	}
+	i.ResponseWriter.WriteHeader(status)
+}
+
+func (i *idempotencyRecorder) Write(p []byte) (int, error) {
+	if i.status == 0 {
+		i.status = http.StatusOK
+	}
+	if i.err == nil {
+		_, i.err = i.body.Write(p)
+	}
+	return i.ResponseWriter.Write(p)
+}
+
+// Flush keeps streamed responses working through the recorder
+func (i *idempotencyRecorder) Flush() {
+	if f, ok := i.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the connection
+func (i *idempotencyRecorder) Unwrap() http.ResponseWriter { return i.ResponseWriter }
+
+// idempotent replays the response of a successful scan to requests
+// repeating its Idempotency-Key within --idempotency-ttl, so clients
+// retrying after a dropped connection do not feed the next sheets.
+// Retries while the scan is running wait for it, failed scans are not
+// kept and scan again.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(res, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(res, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("Idempotency-Key must not be longer than %d characters", maxIdempotencyKeyLength))
+			return
+		}
+
+		request, err := idempotencyFingerprint(r)
+		if err != nil {
+			writeError(res, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("Unable to read request body: %s", err))
+			return
+		}
+
+		// Keys are scoped to the user so others can not fetch the scan
+		scan, started := idempotentScans.Begin(requestUser(r)+"\x00"+key, request)
+
+		if !started {
+			if scan.Request != request {
+				writeError(res, http.StatusUnprocessableEntity, errCodeInvalidParameter, "Idempotency-Key was already used for another request")
+				return
+			}
+			<-scan.done
+			if scan.file == "" {
+				// The scan failed and was dropped, the retry scans again
+				idempotent(next)(res, r)
+				return
+			}
+			replayIdempotentScan(res, scan)
+			return
+		}
+
+		body, err := ioutil.TempFile(cfg.SpoolDir, "scansnap-idempotent-")
+		if err != nil {
+			idempotentScans.Drop(scan)
+			log.WithError(err).Error("Unable to create temporary file")
+			writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to record response")
+			return
+		}
+
+		var (
+			rec      = &idempotencyRecorder{ResponseWriter: res, body: body}
+			complete bool
+		)
+		defer func() {
+			body.Close()
+			if !complete || rec.err != nil || rec.status < 200 || rec.status > 299 {
+				// Aborted responses (incomplete documents) are not kept either
+				os.Remove(body.Name())
+				idempotentScans.Drop(scan)
+				return
+			}
+			// Trailers were set after the body and are replayed as headers
+			header := res.Header().Clone()
+			header.Del("Trailer")
+			idempotentScans.Finish(scan, rec.status, header, body.Name())
+		}()
+
+		next(rec, r)
+		complete = true
+	}
+}
+
+// idempotencyFingerprint identifies the request a key was used for by
+// its target, the representation accepted and a digest of the body
+// (JSON scan requests, posted PDFs). The body is read into memory and
+// restored for the handler.
+func idempotencyFingerprint(r *http.Request) (string, error) {
+	digest := sha256.New()
+	if r.Body != nil {
+		// Larger bodies are rejected by the handler
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxExistingDocumentSize+1))
+		if err != nil {
+			return "", err
+		}
+		digest.Write(body)
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	}
+
+	return fmt.Sprintf("%s %s\nAccept: %s\nContent-Type: %s\nBody: %x",
+		r.Method, r.URL.RequestURI(), r.Header.Get("Accept"), r.Header.Get("Content-Type"), digest.Sum(nil)), nil
+}
+
+func replayIdempotentScan(res http.ResponseWriter, scan *idempotentScan) {
+	f, err := os.Open(scan.file)
+	if err != nil {
+		log.WithError(err).Error("Unable to open recorded response")
+		writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to replay response")
+		return
+	}
+	defer f.Close()
+
+	for k, v := range scan.header {
+		if k != "X-Request-Id" {
+			res.Header()[k] = v
+		}
+	}
+	if fi, err := f.Stat(); err == nil {
+		res.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	}
+	res.Header().Set("Idempotent-Replayed", "true")
+	res.WriteHeader(scan.status)
+	io.Copy(res, f)
+}
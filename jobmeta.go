@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+)
+
+// maxJobMetas is the number of scan metadata records kept in memory
+const maxJobMetas = 100
+
+// jobMeta describes how a scan was produced for automation deciding on
+// the result, e.g. rescanning if pages are missing
+type jobMeta struct {
+	JobID     string    `json:"job_id"`
+	Created   time.Time `json:"created"`
+	Profile   string    `json:"profile,omitempty"`
+	Device    string    `json:"device,omitempty"`
+	Color     string    `json:"color"`
+	Duplex    bool      `json:"duplex"`
+	ScanDPI   int       `json:"scan_dpi"`
+	PDFDPI    int       `json:"pdf_dpi"`
+	Pages     int       `json:"pages"`
+	Documents int       `json:"documents"`
+	// BlankPages and SkippedPages are the numbers of the pages in the
+	// batch removed as blank or unable to be processed
+	BlankPages   []int `json:"blank_pages"`
+	SkippedPages []int `json:"skipped_pages"`
+	// DuplicatePages are the numbers of the pages looking like the
+	// previous sheet scanned again
+	DuplicatePages []int `json:"duplicate_pages"`
+	// MisfeedPages are the numbers of the pages suspected to be fed
+	// badly, the reasons are given in PageDetails
+	MisfeedPages []int `json:"misfeed_pages"`
+	// Suspect tells why the result is likely wrong, e.g. not having the
+	// expected number of pages
+	Suspect string `json:"suspect,omitempty"`
+	// Tags were set by the classification rules matching the text
+	Tags []string `json:"tags"`
+	// ScanSeconds is the time feeding and processing the pages took
+	ScanSeconds float64       `json:"scan_seconds"`
+	PageDetails []jobMetaPage `json:"page_details"`
+	Pipeline    string        `json:"pipeline"`
+	// Options are the effective values of the options set on the device,
+	// AdjustedOptions the ones the backend did not take as requested
+	Options         map[string]interface{}  `json:"options,omitempty"`
+	AdjustedOptions []scanner.AppliedOption `json:"adjusted_options"`
+}
+
+// jobMetaPage describes a page of the document
+type jobMetaPage struct {
+	Page int `json:"page"`
+	// Width and Height are given in pixels at DPI
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	DPI    int    `json:"dpi"`
+	Color  string `json:"color"`
+	// Bytes is the size of the embedded image
+	Bytes             int     `json:"bytes"`
+	ProcessingSeconds float64 `json:"processing_seconds"`
+	// Misfeed tells why the page is suspected to be fed badly, e.g. a
+	// folded corner
+	Misfeed string `json:"misfeed,omitempty"`
+}
+
+func newJobMeta(params *scanParams) *jobMeta {
+	return &jobMeta{
+		JobID:        params.JobID,
+		Created:      time.Now(),
+		Profile:      params.Profile,
+		Color:        params.Color,
+		Duplex:       params.Duplex,
+		ScanDPI:      params.ScanDPI,
+		PDFDPI:       params.PDFDPI,
+		BlankPages:   []int{},
+		SkippedPages: []int{},
+		PageDetails:  []jobMetaPage{},
+		Tags:         []string{},
+
+		DuplicatePages: []int{},
+		MisfeedPages:   []int{},
+
+		AdjustedOptions: []scanner.AppliedOption{},
+	}
+}
+
+// setOptions records the options applied to the device, resumed scans
+// keep the ones of the scan started last
+func (m *jobMeta) setOptions(opts []scanner.AppliedOption) {
+	m.Options = map[string]interface{}{}
+	m.AdjustedOptions = []scanner.AppliedOption{}
+	for _, o := range opts {
+		m.Options[o.Name] = o.Effective
+		if o.Adjusted {
+			m.AdjustedOptions = append(m.AdjustedOptions, o)
+		}
+	}
+}
+
+// complete adds the document produced from the pages
+func (m *jobMeta) complete(params *scanParams, pages []*scanner.Page, skipped scanner.PageErrors, documents int) {
+	m.Pages, m.Documents = len(pages), documents
+	m.Pipeline = params.pipeline().String()
+
+	for _, idx := range skipped.Indices() {
+		m.SkippedPages = append(m.SkippedPages, idx+1)
+	}
+	for _, p := range pages {
+		if p.Misfeed != "" {
+			m.MisfeedPages = append(m.MisfeedPages, p.Index+1)
+		}
+		m.PageDetails = append(m.PageDetails, jobMetaPage{
+			Page:              p.Index + 1,
+			Width:             p.Width,
+			Height:            p.Height,
+			DPI:               p.DPI,
+			Color:             p.Color,
+			Bytes:             p.Size(),
+			ProcessingSeconds: p.ProcessingTime.Seconds(),
+			Misfeed:           p.Misfeed,
+		})
+	}
+}
+
+// setHeaders sets the X-Scan-* headers summarizing the metadata
+func (m jobMeta) setHeaders(h http.Header) {
+	h.Set("X-Scan-Pages", strconv.Itoa(m.Pages))
+	h.Set("X-Scan-DPI", strconv.Itoa(m.ScanDPI))
+	h.Set("X-Scan-Duration", strconv.FormatFloat(m.ScanSeconds, 'f', 2, 64))
+	if m.Device != "" {
+		h.Set("X-Scan-Device", m.Device)
+	}
+	if m.Suspect != "" {
+		h.Set("X-Scan-Suspect", m.Suspect)
+	}
+	if len(m.Tags) > 0 {
+		h.Set("X-Scan-Tags", strings.Join(m.Tags, ","))
+	}
+	for header, numbers := range map[string][]int{
+		"X-Scan-Blank-Pages":     m.BlankPages,
+		"X-Scan-Duplicate-Pages": m.DuplicatePages,
+	} {
+		if len(numbers) == 0 {
+			continue
+		}
+		pages := []string{}
+		for _, n := range numbers {
+			pages = append(pages, strconv.Itoa(n))
+		}
+		h.Set(header, strings.Join(pages, ","))
+	}
+}
+
+type jobMetaStore struct {
+	metas map[string]*jobMeta
+	order []string
+	lock  sync.Mutex
+}
+
+var jobMetas = &jobMetaStore{metas: map[string]*jobMeta{}}
+
+func (j *jobMetaStore) Add(m *jobMeta) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if _, exists := j.metas[m.JobID]; !exists {
+		j.order = append(j.order, m.JobID)
+	}
+	j.metas[m.JobID] = m
+	for len(j.order) > maxJobMetas {
+		delete(j.metas, j.order[0])
+		j.order = j.order[1:]
+	}
+}
+
+func (j *jobMetaStore) Get(jobID string) *jobMeta {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.metas[jobID]
+}
+
+func handleJobMeta(res http.ResponseWriter, r *http.Request) {
+	m := jobMetas.Get(r.PathValue("id"))
+	if m == nil {
+		writeError(res, http.StatusNotFound, errCodeNotFound, "No metadata found for the job")
+		return
+	}
+	writeJSON(res, http.StatusOK, m)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// errJobCancelled is the cause of scans aborted using DELETE /jobs/{id}
+	errJobCancelled = errors.New("Scan was cancelled")
+	// errBackendReset is the cause of scans aborted by POST /admin/reset
+	errBackendReset = errors.New("Scan was cancelled to reset the SANE backend")
+)
+
+// runningJob is a scan currently reading or processing pages
+type runningJob struct {
+	JobID   string    `json:"job_id"`
+	Started time.Time `json:"started"`
+	Profile string    `json:"profile,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Device  string    `json:"device,omitempty"`
+	// Priority and QueuePosition (1 = next) of jobs waiting for the
+	// scanner
+	Priority      string `json:"priority"`
+	QueuePosition int    `json:"queue_position,omitempty"`
+	// Pages is the number of pages processed so far
+	Pages int `json:"pages"`
+
+	cancel     context.CancelCauseFunc
+	thumbnails map[int][]byte
+	options    []scanner.AppliedOption
+}
+
+type runningJobStore struct {
+	jobs map[string]*runningJob
+	lock sync.Mutex
+}
+
+var runningJobs = &runningJobStore{jobs: map[string]*runningJob{}}
+
+// Add registers the job until the returned remove function is called
+func (j *runningJobStore) Add(params *scanParams, cancel context.CancelCauseFunc) (remove func()) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.jobs[params.JobID] = &runningJob{
+		JobID:    params.JobID,
+		Started:  time.Now(),
+		Profile:  params.Profile,
+		User:     params.User,
+		Priority: params.Priority,
+
+		cancel:     cancel,
+		thumbnails: map[int][]byte{},
+	}
+
+	return func() {
+		j.lock.Lock()
+		defer j.lock.Unlock()
+
+		delete(j.jobs, params.JobID)
+	}
+}
+
+// Cancel aborts the job, false if no such job is running
+func (j *runningJobStore) Cancel(id string) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	job, ok := j.jobs[id]
+	if !ok {
+		return false
+	}
+
+	job.cancel(errJobCancelled)
+	return true
+}
+
+// CancelScanning aborts the jobs scanning with a device and returns
+// their IDs, jobs still waiting for the scanner are kept
+func (j *runningJobStore) CancelScanning(cause error) []string {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	ids := []string{}
+	for id, job := range j.jobs {
+		if job.Device != "" {
+			job.cancel(cause)
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// SetDevice records the name of the device the job is scanning with
+func (j *runningJobStore) SetDevice(id, device string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if job, ok := j.jobs[id]; ok {
+		job.Device = device
+	}
+}
+
+// SetPriority records the changed priority of a waiting job
+func (j *runningJobStore) SetPriority(id, priority string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if job, ok := j.jobs[id]; ok {
+		job.Priority = priority
+	}
+}
+
+// SetOptions records how the device took the options of the job
+func (j *runningJobStore) SetOptions(id string, opts []scanner.AppliedOption) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if job, ok := j.jobs[id]; ok {
+		job.options = opts
+	}
+}
+
+// Options returns the options applied to the device of the job, nil
+// before the scan started
+func (j *runningJobStore) Options(id string) []scanner.AppliedOption {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if job, ok := j.jobs[id]; ok {
+		return job.options
+	}
+	return nil
+}
+
+// Device returns the name of the device the job is scanning with, empty
+// before the scan started
+func (j *runningJobStore) Device(id string) string {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if job, ok := j.jobs[id]; ok {
+		return job.Device
+	}
+	return ""
+}
+
+// AddThumbnail stores the thumbnail of the processed page with the
+// index for previews while the job is running
+func (j *runningJobStore) AddThumbnail(id string, idx int, thumb []byte) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if job, ok := j.jobs[id]; ok {
+		job.thumbnails[idx] = thumb
+		job.Pages = len(job.thumbnails)
+	}
+}
+
+// Thumbnail returns the thumbnail of the page with the index, false if
+// the job is not running or the page is not processed yet
+func (j *runningJobStore) Thumbnail(id string, idx int) ([]byte, bool) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	job, ok := j.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	thumb, ok := job.thumbnails[idx]
+	return thumb, ok
+}
+
+// List returns the running jobs, oldest first, with the positions of
+// the jobs waiting for the scanner
+func (j *runningJobStore) List() []runningJob {
+	positions := pendingScans.Positions()
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	jobs := []runningJob{}
+	for _, job := range j.jobs {
+		entry := *job
+		entry.QueuePosition = positions[job.JobID]
+		jobs = append(jobs, entry)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].Started.Before(jobs[b].Started) })
+	return jobs
+}
+
+func handleListJobs(res http.ResponseWriter, r *http.Request) {
+	writeJSON(res, http.StatusOK, runningJobs.List())
+}
+
+func handleCancelJob(res http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	if !runningJobs.Cancel(id) {
+		writeError(res, http.StatusNotFound, errCodeNotFound, "No running scan with this job ID")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"job_id": id,
+		"user":   requestUser(r),
+	}).Warn("Scan cancelled on request")
+
+	writeJSON(res, http.StatusAccepted, map[string]string{"job_id": id, "status": "cancelled"})
+}
+
+// handleJobPageThumbnail serves the thumbnail of a page of a running
+// scan, the page number counts the scanned pages starting with 1
+func handleJobPageThumbnail(res http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil || n < 1 {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("Invalid page number: %q", r.PathValue("n")))
+		return
+	}
+
+	thumb, ok := runningJobs.Thumbnail(r.PathValue("id"), n-1)
+	if !ok {
+		writeError(res, http.StatusNotFound, errCodeNotFound, "No running scan with this job ID or page not processed yet")
+		return
+	}
+
+	res.Header().Set("Content-Type", "image/jpeg")
+	res.Header().Set("Cache-Control", "private, max-age=3600")
+	res.Write(thumb)
+}
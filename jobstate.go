@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Persistence of the jobs started using gRPC and of the results kept
+// for --result-ttl in --state-dir: queued jobs are started again and
+// finished ones stay available after a restart, crash or upgrade
+
+// jobStateStore keeps every record as JSON file next to its data,
+// records are replaced atomically to never leave partial files
+type jobStateStore struct {
+	dir string
+}
+
+// jobState is nil when no state directory is configured
+var jobState *jobStateStore
+
+func newJobStateStore(dir string) (*jobStateStore, error) {
+	for _, kind := range []string{"grpc", "results"} {
+		if err := os.MkdirAll(path.Join(dir, kind), 0700); err != nil {
+			return nil, fmt.Errorf("Unable to create state directory: %s", err)
+		}
+	}
+	return &jobStateStore{dir: dir}, nil
+}
+
+// DataFile is the file containing the document of the record
+func (s *jobStateStore) DataFile(kind, id string) string {
+	return path.Join(s.dir, kind, id+".data")
+}
+
+// Save replaces the record with the ID
+func (s *jobStateStore) Save(kind, id string, rec interface{}) error {
+	raw, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to marshal state: %s", err)
+	}
+
+	tmp := path.Join(s.dir, kind, "."+id+".tmp")
+	if err = ioutil.WriteFile(tmp, raw, 0600); err == nil {
+		err = os.Rename(tmp, path.Join(s.dir, kind, id+".json"))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Unable to write state: %s", err)
+	}
+	return nil
+}
+
+// Load passes every record of the kind to fn, records unable to be
+// read are removed
+func (s *jobStateStore) Load(kind string, fn func(raw []byte) error) {
+	files, err := filepath.Glob(path.Join(s.dir, kind, "*.json"))
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		raw, err := ioutil.ReadFile(f)
+		if err == nil {
+			err = fn(raw)
+		}
+		if err != nil {
+			log.WithError(err).WithField("file", f).Warn("Unable to restore job state, removing it")
+			s.Remove(kind, strings.TrimSuffix(path.Base(f), ".json"))
+		}
+	}
+}
+
+// Remove deletes the record and its data
+func (s *jobStateStore) Remove(kind, id string) {
+	os.Remove(path.Join(s.dir, kind, id+".json"))
+	os.Remove(s.DataFile(kind, id))
+}
+
+// linkOrCopy makes the file available at dst, a copy is made if the
+// directories are on different file systems
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxJobTexts is the number of recognized texts kept in memory, with
+// scan storage enabled they are persisted next to the scans
+const maxJobTexts = 100
+
+// jobText is the text recognized by the ocr step on the pages of a
+// scan job
+type jobText struct {
+	JobID   string        `json:"job_id"`
+	Created time.Time     `json:"created"`
+	Pages   []jobTextPage `json:"pages"`
+}
+
+// jobTextPage contains the words of a page of the document, their boxes
+// are given in pixels of the page image
+type jobTextPage struct {
+	Page   int            `json:"page"`
+	Width  int            `json:"width"`
+	Height int            `json:"height"`
+	DPI    int            `json:"dpi"`
+	Words  []scanner.Word `json:"words"`
+}
+
+// jobTextLine is a line of words to render the text
+type jobTextLine struct {
+	Box   image.Rectangle
+	Words []scanner.Word
+}
+
+type jobTextStore struct {
+	texts map[string]*jobText
+	order []string
+	lock  sync.Mutex
+}
+
+var jobTexts = &jobTextStore{texts: map[string]*jobText{}}
+
+// newJobText collects the recognized words of the pages, nil if none of
+// the pages was recognized
+func newJobText(jobID string, pages []*scanner.Page) *jobText {
+	t := &jobText{JobID: jobID, Created: time.Now()}
+
+	recognized := false
+	for i, p := range pages {
+		t.Pages = append(t.Pages, jobTextPage{
+			Page:   i + 1,
+			Width:  p.Width,
+			Height: p.Height,
+			DPI:    p.DPI,
+			Words:  p.Words,
+		})
+		recognized = recognized || p.Words != nil
+	}
+
+	if !recognized {
+		return nil
+	}
+	return t
+}
+
+func (j *jobTextStore) Add(t *jobText) {
+	j.lock.Lock()
+	if _, exists := j.texts[t.JobID]; !exists {
+		j.order = append(j.order, t.JobID)
+	}
+	j.texts[t.JobID] = t
+	for len(j.order) > maxJobTexts {
+		delete(j.texts, j.order[0])
+		j.order = j.order[1:]
+	}
+	j.lock.Unlock()
+
+	if storage == nil {
+		return
+	}
+	scanIndex.Add(t)
+
+	raw, err := json.Marshal(t)
+	if err == nil {
+		err = ioutil.WriteFile(jobTextFile(t.JobID), raw, 0600)
+	}
+	if err != nil {
+		log.WithError(err).WithField("job_id", t.JobID).Error("Unable to persist recognized text")
+	}
+}
+
+func (j *jobTextStore) Get(jobID string) (*jobText, error) {
+	j.lock.Lock()
+	t := j.texts[jobID]
+	j.lock.Unlock()
+
+	if t != nil {
+		return t, nil
+	}
+
+	if storage == nil || !scanIDPattern.MatchString(jobID) {
+		return nil, os.ErrNotExist
+	}
+
+	raw, err := ioutil.ReadFile(jobTextFile(jobID))
+	if err != nil {
+		return nil, err
+	}
+
+	t = &jobText{}
+	if err := json.Unmarshal(raw, t); err != nil {
+		return nil, fmt.Errorf("Unable to read recognized text of job %s: %s", jobID, err)
+	}
+	return t, nil
+}
+
+func jobTextFile(jobID string) string {
+	// The name does not match the scan ID pattern so it is not listed
+	// as scan metadata
+	return path.Join(storage.dir, jobID+".text.json")
+}
+
+// lines groups the words of the page by their line
+func (p jobTextPage) lines() []jobTextLine {
+	lines := []jobTextLine{}
+	for i, w := range p.Words {
+		if i == 0 || w.Line != p.Words[i-1].Line {
+			lines = append(lines, jobTextLine{Box: w.Box})
+		}
+		l := &lines[len(lines)-1]
+		l.Box = l.Box.Union(w.Box)
+		l.Words = append(l.Words, w)
+	}
+	return lines
+}
+
+// plainText renders the lines of all pages, pages are separated by a
+// form feed like tesseract does
+func (t jobText) plainText() []byte {
+	buf := new(bytes.Buffer)
+	for i, p := range t.Pages {
+		if i > 0 {
+			buf.WriteString("\f")
+		}
+		for _, l := range p.lines() {
+			words := []string{}
+			for _, w := range l.Words {
+				words = append(words, w.Text)
+			}
+			fmt.Fprintln(buf, strings.Join(words, " "))
+		}
+	}
+	return buf.Bytes()
+}
+
+// hOCR renders the positioned words as hOCR document
+// (http://kba.github.io/hocr-spec/1.2/)
+func (t jobText) hOCR() []byte {
+	bbox := func(r image.Rectangle) string {
+		return fmt.Sprintf("bbox %d %d %d %d", r.Min.X, r.Min.Y, r.Max.X, r.Max.Y)
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN" "http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head>
+<title></title>
+<meta http-equiv="Content-Type" content="text/html;charset=utf-8"/>
+<meta name="ocr-system" content="scansnap-go (tesseract)"/>
+<meta name="ocr-capabilities" content="ocr_page ocr_line ocrx_word"/>
+</head>
+<body>
+`)
+	for _, p := range t.Pages {
+		fmt.Fprintf(buf, "<div class=\"ocr_page\" id=\"page_%d\" title=\"%s; ppageno %d; scan_res %d %d\">\n",
+			p.Page, bbox(image.Rect(0, 0, p.Width, p.Height)), p.Page-1, p.DPI, p.DPI)
+		for i, l := range p.lines() {
+			fmt.Fprintf(buf, "<span class=\"ocr_line\" id=\"line_%d_%d\" title=\"%s\">", p.Page, i+1, bbox(l.Box))
+			for j, w := range l.Words {
+				if j > 0 {
+					buf.WriteString(" ")
+				}
+				fmt.Fprintf(buf, "<span class=\"ocrx_word\" id=\"word_%d_%d_%d\" title=\"%s; x_wconf %.0f\">%s</span>",
+					p.Page, i+1, j+1, bbox(w.Box), w.Confidence, html.EscapeString(w.Text))
+			}
+			buf.WriteString("</span>\n")
+		}
+		buf.WriteString("</div>\n")
+	}
+	buf.WriteString("</body>\n</html>\n")
+	return buf.Bytes()
+}
+
+// alto renders the positioned words as ALTO v4 document with pixel
+// coordinates
+func (t jobText) alto() []byte {
+	attrs := func(r image.Rectangle) string {
+		return fmt.Sprintf(`HPOS="%d" VPOS="%d" WIDTH="%d" HEIGHT="%d"`, r.Min.X, r.Min.Y, r.Dx(), r.Dy())
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<alto xmlns="http://www.loc.gov/standards/alto/ns-v4#">
+<Description><MeasurementUnit>pixel</MeasurementUnit></Description>
+<Layout>
+`)
+	for _, p := range t.Pages {
+		fmt.Fprintf(buf, "<Page ID=\"page_%d\" PHYSICAL_IMG_NR=\"%d\" WIDTH=\"%d\" HEIGHT=\"%d\">\n<PrintSpace>\n", p.Page, p.Page, p.Width, p.Height)
+		for i, l := range p.lines() {
+			fmt.Fprintf(buf, "<TextLine ID=\"line_%d_%d\" %s>", p.Page, i+1, attrs(l.Box))
+			for j, w := range l.Words {
+				if j > 0 {
+					buf.WriteString("<SP/>")
+				}
+				fmt.Fprintf(buf, "<String %s WC=\"%.2f\" CONTENT=\"%s\"/>", attrs(w.Box), w.Confidence/100, html.EscapeString(w.Text))
+			}
+			buf.WriteString("</TextLine>\n")
+		}
+		buf.WriteString("</PrintSpace>\n</Page>\n")
+	}
+	buf.WriteString("</Layout>\n</alto>\n")
+	return buf.Bytes()
+}
+
+// handleJobText serves the recognized text of the job {id} in the
+// format given by the path
+func handleJobText(format string) http.HandlerFunc {
+	return func(res http.ResponseWriter, r *http.Request) {
+		t, err := jobTexts.Get(r.PathValue("id"))
+		if err != nil {
+			writeError(res, http.StatusNotFound, errCodeNotFound, "No recognized text for this job, is the ocr step part of the pipeline?")
+			return
+		}
+
+		var (
+			body        []byte
+			contentType string
+		)
+		switch format {
+		case "hocr":
+			body, contentType = t.hOCR(), "application/xhtml+xml; charset=utf-8"
+		case "alto":
+			body, contentType = t.alto(), "application/xml; charset=utf-8"
+		default:
+			body, contentType = t.plainText(), "text/plain; charset=utf-8"
+		}
+
+		res.Header().Set("Content-Type", contentType)
+		res.Header().Set("Cache-Control", "no-cache")
+		res.Write(body)
+	}
+}
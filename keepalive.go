@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// startKeepAlive pings the idle scanner in the background to keep it
+// from falling asleep
+func startKeepAlive() error {
+	pinger, ok := scanBackend.(scanner.Pinger)
+	if !ok {
+		return fmt.Errorf("The scanner backend does not support keep-alive")
+	}
+
+	log.WithField("interval", cfg.KeepAlive).Info("Keeping the scanner awake")
+	go keepAlive(pinger)
+	return nil
+}
+
+func keepAlive(pinger scanner.Pinger) {
+	var failing bool
+
+	for range time.Tick(cfg.KeepAlive) {
+		if scannerPower.Asleep() {
+			// Sent to sleep using POST /power/sleep
+			continue
+		}
+
+		err := pinger.Ping()
+		switch {
+		case errors.Is(err, scanner.ErrBusy):
+			// A running scan keeps the device awake
+			continue
+
+		case err != nil:
+			if !failing {
+				log.WithError(err).Warn("Scanner did not answer the keep-alive, reopening it on the next one")
+			}
+			failing = true
+			continue
+		}
+
+		if failing {
+			log.Info("Scanner answers the keep-alive again")
+		}
+		failing = false
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// listenUnixPrefix marks --listen addresses naming a socket path
+	listenUnixPrefix = "unix:"
+	// systemdListenFDsStart is the first file descriptor passed by
+	// systemd socket activation (SD_LISTEN_FDS_START)
+	systemdListenFDsStart = 3
+)
+
+// httpListener returns the socket passed by systemd socket activation
+// or creates the one given by --listen (TCP address or unix:<path>)
+func httpListener() (net.Listener, error) {
+	l, err := systemdListener()
+	if err != nil || l != nil {
+		return l, err
+	}
+
+	if !strings.HasPrefix(cfg.Listen, listenUnixPrefix) {
+		return net.Listen("tcp", cfg.Listen)
+	}
+
+	socket := strings.TrimPrefix(cfg.Listen, listenUnixPrefix)
+	// A socket left over by an unclean shutdown prevents binding
+	if fi, err := os.Stat(socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(socket); err != nil {
+			return nil, fmt.Errorf("Unable to remove stale socket: %s", err)
+		}
+	}
+
+	if l, err = net.Listen("unix", socket); err != nil {
+		return nil, err
+	}
+	// Give a reverse proxy running in the same group access
+	if err = os.Chmod(socket, 0660); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("Unable to set permissions of socket: %s", err)
+	}
+	return l, nil
+}
+
+// systemdListener returns the socket passed by systemd socket
+// activation (LISTEN_PID / LISTEN_FDS), nil if the daemon was started
+// without it
+func systemdListener() (net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	if n > 1 {
+		return nil, fmt.Errorf("Socket activation passed %d sockets, only one is supported", n)
+	}
+
+	// Keep child processes (post-processing, OCR) from inheriting them
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(systemdListenFDsStart, "systemd-socket")
+	defer f.Close()
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to use socket passed by systemd: %s", err)
+	}
+
+	log.WithField("listen", l.Addr().String()).Info("Using socket passed by systemd")
+	return l, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Unit systems used for the paper sizes shown to users
+const (
+	unitsMetric   = "metric"
+	unitsImperial = "imperial"
+)
+
+// imperialRegions measure paper in inches, all other regions use
+// millimeters
+var imperialRegions = map[string]bool{"us": true, "lr": true, "mm": true}
+
+// paperSizes are named in the labels of scan areas matching them in
+// either orientation
+var paperSizes = []struct {
+	Name          string
+	Width, Height float64 // mm
+}{
+	{"A4", 210, 297},
+	{"A5", 148, 210},
+	{"A6", 105, 148},
+	{"B5", 176, 250},
+	{"Letter", 215.9, 279.4},
+	{"Legal", 215.9, 355.6},
+}
+
+// dateTimeLayouts format times in messages of the language, the
+// default language uses ISO dates
+var dateTimeLayouts = map[string]string{
+	defaultLanguage: "2006-01-02 15:04",
+	"de":            "02.01.2006 15:04",
+}
+
+// parseLocale splits a language tag like en-US into the supported
+// language and the units customary in its region (metric without region)
+func parseLocale(tag string) (string, string, bool) {
+	lang, region, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+	if lang != defaultLanguage && messageBundles[lang] == nil {
+		return "", "", false
+	}
+
+	if imperialRegions[region] {
+		return lang, unitsImperial, true
+	}
+	return lang, unitsMetric, true
+}
+
+// negotiateUnits returns the units of the region of the language most
+// preferred in the Accept-Language header, tags without region and
+// unsupported languages do not select units
+func negotiateUnits(header string) string {
+	var (
+		units = unitsMetric
+		best  = 0.0
+	)
+
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.Contains(tag, "-") {
+			continue
+		}
+		_, u, ok := parseLocale(tag)
+		if !ok {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > best {
+			units, best = u, q
+		}
+	}
+
+	return units
+}
+
+// requestUnits returns the units the client is used to
+func requestUnits(r *http.Request) string {
+	return negotiateUnits(r.Header.Get("Accept-Language"))
+}
+
+// responseUnits returns the units negotiated for the response like
+// responseLanguage does for the language
+func responseUnits(res http.ResponseWriter) string {
+	for res != nil {
+		if l, ok := res.(*languageWriter); ok && l.units != "" {
+			return l.units
+		}
+		u, ok := res.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		res = u.Unwrap()
+	}
+	return unitsMetric
+}
+
+// paperSizeLabel describes the paper size in the units, naming the
+// standard size it matches: "A4 (210 × 297 mm)", "Letter (8.5 × 11 in)"
+func paperSizeLabel(lang, units string, widthMM, heightMM float64) string {
+	var dims string
+	if units == unitsImperial {
+		dims = fmt.Sprintf("%s × %s in", formatDecimal(lang, widthMM/25.4, 2), formatDecimal(lang, heightMM/25.4, 2))
+	} else {
+		dims = fmt.Sprintf("%s × %s mm", formatDecimal(lang, widthMM, 0), formatDecimal(lang, heightMM, 0))
+	}
+
+	for _, p := range paperSizes {
+		portrait := math.Abs(widthMM-p.Width) < 1 && math.Abs(heightMM-p.Height) < 1
+		landscape := math.Abs(widthMM-p.Height) < 1 && math.Abs(heightMM-p.Width) < 1
+		if portrait || landscape {
+			return p.Name + " (" + dims + ")"
+		}
+	}
+	return dims
+}
+
+// formatDecimal rounds the number to the digits after the decimal
+// separator of the language, trailing zeros are removed
+func formatDecimal(lang string, v float64, digits int) string {
+	s := strconv.FormatFloat(v, 'f', digits, 64)
+	if digits > 0 {
+		s = strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+	}
+	if lang == "de" {
+		s = strings.Replace(s, ".", ",", 1)
+	}
+	return s
+}
+
+// formatDateTime formats the time for messages in the language
+func formatDateTime(lang string, t time.Time) string {
+	layout, ok := dateTimeLayouts[lang]
+	if !ok {
+		layout = dateTimeLayouts[defaultLanguage]
+	}
+	return t.Format(layout)
+}
+
+// scanAreaSize returns the size of the area scanned using the options
+// in mm, ok is false if the scanner options do not set it
+func scanAreaSize(opts map[string]interface{}) (float64, float64, bool) {
+	width, wok := optionFloat(opts["page-width"])
+	height, hok := optionFloat(opts["page-height"])
+	return width, height, wok && hok && width > 0 && height > 0
+}
+
+// responsePaperSize returns the label of the paper size scanned using
+// the parameters in the language and units of the response, empty if
+// the scanner options do not set it
+func responsePaperSize(res http.ResponseWriter, params *scanParams) string {
+	w, h, ok := scanAreaSize(params.scannerOptions())
+	if !ok {
+		return ""
+	}
+	return paperSizeLabel(responseLanguage(res), responseUnits(res), w, h)
+}
+
+// localeOptions select the language and units of the messages sent by
+// a target
+type localeOptions struct {
+	// Language of the messages (en, de), a region selects its units
+	// (en-US: imperial)
+	Language string `yaml:"language"`
+	// Units of the paper sizes (metric, imperial), overriding the ones
+	// of the region
+	Units string `yaml:"units"`
+}
+
+func (l localeOptions) validate() error {
+	if l.Language != "" {
+		if _, _, ok := parseLocale(l.Language); !ok {
+			return fmt.Errorf("unsupported language %q", l.Language)
+		}
+	}
+	if l.Units != "" && l.Units != unitsMetric && l.Units != unitsImperial {
+		return fmt.Errorf("units must be metric or imperial")
+	}
+	return nil
+}
+
+// lang returns the language of the messages
+func (l localeOptions) lang() string {
+	if lang, _, ok := parseLocale(l.Language); ok {
+		return lang
+	}
+	return defaultLanguage
+}
+
+// units returns the units of the paper sizes
+func (l localeOptions) units() string {
+	if l.Units != "" {
+		return l.Units
+	}
+	if _, units, ok := parseLocale(l.Language); ok {
+		return units
+	}
+	return unitsMetric
+}
+
+// localize returns the message in the language of the target
+func (l localeOptions) localize(msg string, args ...interface{}) string {
+	return localize(l.lang(), msg, args...)
+}
+
+// paperSize returns the label of the paper size of the document, empty
+// if it is unknown
+func (l localeOptions) paperSize(doc *deliveryDocument) string {
+	if doc.PaperWidthMM <= 0 || doc.PaperHeightMM <= 0 {
+		return ""
+	}
+	return paperSizeLabel(l.lang(), l.units(), doc.PaperWidthMM, doc.PaperHeightMM)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNegotiateUnits(t *testing.T) {
+	for header, exp := range map[string]string{
+		"":                        unitsMetric,
+		"en":                      unitsMetric,
+		"en-US":                   unitsImperial,
+		"de-DE,en-US;q=0.8":       unitsMetric,
+		"de,en-US;q=0.8":          unitsImperial,
+		"fr-FR,en-US;q=0.5":       unitsImperial,
+		"en-GB;q=0.5,en-US;q=0.9": unitsImperial,
+		"en-US;q=x,de-AT;q=0.1":   unitsMetric,
+	} {
+		if got := negotiateUnits(header); got != exp {
+			t.Errorf("%q: expected %s, got %s", header, exp, got)
+		}
+	}
+}
+
+func TestPaperSizeLabel(t *testing.T) {
+	for name, tc := range map[string]struct {
+		lang, units   string
+		width, height float64
+		exp           string
+	}{
+		"A4 metric":           {"en", unitsMetric, 210, 297, "A4 (210 × 297 mm)"},
+		"A4 landscape":        {"en", unitsMetric, 297, 210, "A4 (297 × 210 mm)"},
+		"A4 imperial":         {"en", unitsImperial, 210, 297, "A4 (8.27 × 11.69 in)"},
+		"Letter imperial":     {"en", unitsImperial, 215.9, 279.4, "Letter (8.5 × 11 in)"},
+		"Letter german":       {"de", unitsImperial, 215.9, 279.4, "Letter (8,5 × 11 in)"},
+		"Letter metric":       {"de", unitsMetric, 215.9, 279.4, "Letter (216 × 279 mm)"},
+		"unknown size":        {"en", unitsMetric, 100, 100, "100 × 100 mm"},
+		"unknown size german": {"de", unitsImperial, 100, 100, "3,94 × 3,94 in"},
+	} {
+		if got := paperSizeLabel(tc.lang, tc.units, tc.width, tc.height); got != tc.exp {
+			t.Errorf("%s: expected %q, got %q", name, tc.exp, got)
+		}
+	}
+}
+
+func TestLocaleOptions(t *testing.T) {
+	for name, tc := range map[string]struct {
+		opts        localeOptions
+		lang, units string
+		valid       bool
+	}{
+		"default":        {localeOptions{}, "en", unitsMetric, true},
+		"german":         {localeOptions{Language: "de"}, "de", unitsMetric, true},
+		"region":         {localeOptions{Language: "en-US"}, "en", unitsImperial, true},
+		"units override": {localeOptions{Language: "en-US", Units: unitsMetric}, "en", unitsMetric, true},
+		"unsupported":    {localeOptions{Language: "fr"}, "en", unitsMetric, false},
+		"invalid units":  {localeOptions{Units: "inch"}, "en", "inch", false},
+	} {
+		if err := tc.opts.validate(); (err == nil) != tc.valid {
+			t.Errorf("%s: expected valid=%v, got %v", name, tc.valid, err)
+		}
+		if l, u := tc.opts.lang(), tc.opts.units(); l != tc.lang || u != tc.units {
+			t.Errorf("%s: expected %s/%s, got %s/%s", name, tc.lang, tc.units, l, u)
+		}
+	}
+}
+
+func TestNotifyMessage(t *testing.T) {
+	doc := &deliveryDocument{Filename: "scan.pdf", Pages: 3, Profile: "letters", PaperWidthMM: 210, PaperHeightMM: 297}
+
+	for lang, exp := range map[string]string{
+		"en":    "Scan completed: scan.pdf\n3 pages, A4 (210 × 297 mm), profile letters",
+		"de":    "Scan abgeschlossen: scan.pdf\n3 Seiten, A4 (210 × 297 mm), Profil letters",
+		"en-US": "Scan completed: scan.pdf\n3 pages, A4 (8.27 × 11.69 in), profile letters",
+	} {
+		n := notifyOptions{localeOptions: localeOptions{Language: lang}}
+		if got := n.message(doc); got != exp {
+			t.Errorf("%s: expected %q, got %q", lang, exp, got)
+		}
+	}
+
+	failed := scanEvent{Error: "sane: jammed", ErrorCode: errCodePaperJam, Profile: "letters"}
+	for lang, exp := range map[string]string{
+		"en": "Scan failed: sane: jammed (profile letters)",
+		"de": "Scan fehlgeschlagen: Papierstau oder Doppeleinzug, leere den Einzug und versuche es erneut (Profil letters)",
+	} {
+		n := notifyOptions{localeOptions: localeOptions{Language: lang}}
+		if got := n.failureMessage(failed); got != exp {
+			t.Errorf("%s: expected %q, got %q", lang, exp, got)
+		}
+	}
+}
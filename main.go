@@ -1,48 +1,176 @@
 package main
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"image"
-	"image/jpeg"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Luzifer/rconfig"
-	"github.com/Luzifer/sane"
-	"github.com/disintegration/imaging"
-	"github.com/jung-kurt/gofpdf"
+	"github.com/Luzifer/scansnap-go/pkg/pdfgen"
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	scanDPI = 300
-	pdfDPI  = 150
-)
-
 var (
 	cfg = struct {
-		Listen         string `flag:"listen" default:":3000" description:"Port/IP to listen on"`
-		LogLevel       string `flag:"log-level" default:"info" description:"Log level (debug, info, warn, error, fatal)"`
-		VersionAndExit bool   `flag:"version" default:"false" description:"Prints current version and exits"`
+		AdminUser            []string      `flag:"admin-user" default:"" description:"Users allowed to use the admin API (default: all authenticated users)"`
+		AllowCIDR            []string      `flag:"allow-cidr" default:"" description:"Networks (CIDR) allowed to use the API and the SANE network protocol, e.g. '192.168.1.0/24' (default: all)"`
+		AuthBasic            []string      `flag:"auth-basic" default:"" description:"Require HTTP basic auth with these 'user:password' pairs (password may be 'sha256:<hex>')"`
+		AuthProxyHeader      string        `flag:"auth-proxy-header" default:"" description:"Accept the user name an authenticating reverse proxy sets in this header (e.g. X-Forwarded-User)"`
+		AuthProxyTrusted     []string      `flag:"auth-proxy-trusted" default:"127.0.0.1/32,::1/128" description:"Networks (CIDR) of the proxies allowed to set --auth-proxy-header"`
+		AuthToken            []string      `flag:"auth-token" default:"" description:"Accept these 'name:token' bearer tokens (token may be 'sha256:<hex>')"`
+		AuthTokenFile        string        `flag:"auth-token-file" default:"" description:"File with additional 'name:token' bearer tokens, one per line, reloaded on SIGHUP"`
+		BlankPages           string        `flag:"blank-pages" default:"scanner" description:"Default removal of blank pages: scanner (by the 'swskip' option), backs (only blank back sides of duplex scans, detected in software) or keep"`
+		BlankThreshold       float64       `flag:"blank-threshold" default:"0.5" description:"Default percentage of a back side covered by ink below which it is blank (blank-pages=backs)"`
+		CalibrationReminder  int           `flag:"calibration-reminder" default:"0" description:"Remind to calibrate the scanner after this many pages, reset using POST /maintenance/calibration (0 = no reminder)"`
+		CleaningReminder     int           `flag:"cleaning-reminder" default:"0" description:"Remind to clean the scanner (rollers, glass) after this many pages, reset using POST /maintenance/cleaning (0 = no reminder)"`
+		Color                string        `flag:"color" default:"color" description:"Default color mode (color, gray, bw, auto, auto-bw)"`
+		ContentDisposition   string        `flag:"content-disposition" default:"inline" description:"Disposition of downloaded scans: inline (shown by browsers) or attachment (saved under the templated filename)"`
+		CooldownDuration     time.Duration `flag:"cooldown-duration" default:"5m" description:"Time the scanner rests after a large batch (see --cooldown-pages)"`
+		CooldownPages        int           `flag:"cooldown-pages" default:"0" description:"Reject new scans for --cooldown-duration after a batch of at least this many pages (0 = disable)"`
+		CORSCredentials      bool          `flag:"cors-credentials" default:"false" description:"Allow browsers to send credentials (basic auth, client certificates) with cross-origin requests"`
+		CORSMethods          []string      `flag:"cors-methods" default:"GET,POST,PUT,DELETE" description:"Methods allowed for cross-origin requests"`
+		CORSOrigin           []string      `flag:"cors-origin" default:"" description:"Origins (e.g. 'https://scan.example.com', '*' for all) allowed to call the API from the browser (default: none)"`
+		Device               string        `flag:"device" default:"" description:"SANE device to scan with (default: first device found, 'test:0' for the SANE test backend)"`
+		DeviceMatch          string        `flag:"device-match" default:"" description:"Scan with the first device whose name, vendor or model matches this regular expression if --device is not set, e.g. 'ScanSnap iX500'"`
+		Duplex               bool          `flag:"duplex" default:"true" description:"Scan both sides of the pages by default (override per request with ?duplex=false)"`
+		DuplicatePages       string        `flag:"duplicate-pages" default:"ignore" description:"Default handling of sheets scanned twice (re-fed pages) found by comparing every page to the previous sheet: ignore (do not compare), flag (report in the metadata) or drop"`
+		EnablePprof          bool          `flag:"enable-pprof" default:"false" description:"Serve net/http/pprof profiles and runtime diagnostics on --pprof-listen"`
+		ESCL                 bool          `flag:"escl" default:"false" description:"Serve the eSCL (AirScan) protocol for stock scan clients and announce the scanner using mDNS"`
+		ExportKey            string        `flag:"export-key" default:"" description:"Ed25519 private key (PKCS#8 PEM) to sign compliance exports with, enables GET /export"`
+		FailInject           string        `flag:"fail-inject" default:"" description:"Developer option: Inject failures for testing (e.g. 'jam-after=3', 'upload-timeout=<target>', 'ocr-crash=2')"`
+		FakeScanner          int           `flag:"fake-scanner" default:"0" description:"Developer option: Scan this many generated pages per request instead of using SANE (0 = disable)"`
+		FilenameTemplate     string        `flag:"filename-template" default:"scan_{{.Date}}_{{.Time}}" description:"Template for the names of downloaded and stored scans (fields: Date, Time, Counter, Profile, Title, User, Pages)"`
+		GRPCListen           string        `flag:"grpc-listen" default:"" description:"Port/IP to serve the gRPC API on, e.g. ':3001' (empty = disabled)"`
+		ICCConvert           bool          `flag:"icc-convert" default:"false" description:"Convert the color pages from --icc-profile to sRGB instead of embedding the profile"`
+		ICCProfile           string        `flag:"icc-profile" default:"" description:"ICC profile (RGB matrix/TRC) of the scanner to embed into the documents for its color pages, e.g. created by POST /admin/calibrate"`
+		IdempotencyTTL       time.Duration `flag:"idempotency-ttl" default:"1h" description:"Time the response of a scan requested with an Idempotency-Key header is replayed to retries"`
+		ImageBackend         string        `flag:"image-backend" default:"imaging" description:"Library to process the page images with (imaging, vips if built with -tags vips)"`
+		JPEGQuality          int           `flag:"jpeg-quality" default:"95" description:"JPEG quality (1-100) for the pages embedded into the PDF"`
+		KeepAlive            time.Duration `flag:"keep-alive" default:"0" description:"Wake the idle scanner in this interval by reading an option to keep it from dropping off USB, reopening it if it does not answer (0 = disable)"`
+		Listen               string        `flag:"listen" default:":3000" description:"Port/IP or 'unix:<path>' of a socket to listen on (ignored if started by systemd socket activation)"`
+		LogFormat            string        `flag:"log-format" default:"text" description:"Log output format (text, json)"`
+		LogLevel             string        `flag:"log-level" default:"info" description:"Log level (debug, info, warn, error, fatal)"`
+		Lossless             bool          `flag:"lossless" default:"false" description:"Embed gray and color pages as PNG instead of JPEG into the PDF, no compression artifacts at several times the file size"`
+		MaintenanceCounter   []string      `flag:"maintenance-counter" default:"" description:"Read-only device options counting the wear of consumables to report, 'option' or 'option:threshold' to warn when it is reached"`
+		MaintenanceNotify    []string      `flag:"maintenance-notify" default:"" description:"Notification targets (slack, telegram, ntfy) of --targets to send the maintenance reminders to"`
+		MaxPages             int           `flag:"max-pages" default:"0" description:"Default limit of pages per scan, scans exceeding it are stopped and deliver the pages up to the limit (0 = no limit)"`
+		MaxQueuedScans       int           `flag:"max-queued-scans" default:"0" description:"Reject scans with 429 while this many scans are waiting for the scanner (0 = no limit)"`
+		MaxSpoolSize         int           `flag:"max-spool-size" default:"0" description:"Fail scans once the pages spooled to --spool-dir take more than this many MiB (0 = no limit)"`
+		MDNS                 bool          `flag:"mdns" default:"false" description:"Announce the HTTP scan service using mDNS / Bonjour for clients to discover it"`
+		MDNSName             string        `flag:"mdns-name" default:"" description:"Name to announce the service with using mDNS (default: 'scansnap-go (<hostname>)')"`
+		MQTTBroker           string        `flag:"mqtt-broker" default:"" description:"Publish scan events to this MQTT broker (e.g. tcp://localhost:1883, mqtts://broker:8883)"`
+		MQTTClientID         string        `flag:"mqtt-client-id" default:"" description:"Client ID to use for MQTT (default: scansnap-go-<hostname>)"`
+		MQTTHADiscovery      bool          `flag:"mqtt-ha-discovery" default:"false" description:"Announce the scanner to Home Assistant using MQTT discovery"`
+		MQTTHAPrefix         string        `flag:"mqtt-ha-prefix" default:"homeassistant" description:"Discovery prefix configured in Home Assistant"`
+		MQTTHAScanProfile    string        `flag:"mqtt-ha-scan-profile" default:"" description:"Profile to use for scans started from Home Assistant"`
+		MQTTPassword         string        `flag:"mqtt-password" default:"" description:"Password for the MQTT broker"`
+		MQTTTopic            string        `flag:"mqtt-topic" default:"scansnap" description:"Prefix of the MQTT topics to publish to"`
+		MQTTUser             string        `flag:"mqtt-user" default:"" description:"Username for the MQTT broker"`
+		MisfeedCorners       bool          `flag:"misfeed-corners" default:"false" description:"Warn about pages with a folded corner or the shadow of a removed staple (dark triangle in a corner), sheets which may have fed badly or stuck together"`
+		MisfeedSkewThreshold float64       `flag:"misfeed-skew-threshold" default:"0" description:"Warn about possibly stapled / overlapping sheets when content is skewed by at least this many degrees, e.g. 2 (0 = disable)"`
+		OffTimer             int           `flag:"off-timer" default:"0" description:"Minutes of inactivity after which the scanner turns itself off (0 = never, devices may round it)"`
+		OIDCAudience         string        `flag:"oidc-audience" default:"" description:"Audience (client ID) the OIDC tokens must be issued for, required with --oidc-issuer"`
+		OIDCIssuer           string        `flag:"oidc-issuer" default:"" description:"Accept bearer tokens (JWT) signed by this OpenID Connect provider, e.g. 'https://auth.example.com/realms/home'"`
+		OIDCUserClaim        string        `flag:"oidc-user-claim" default:"preferred_username" description:"Claim of the OIDC tokens containing the user name (falls back to 'sub')"`
+		PDFA                 bool          `flag:"pdfa" default:"false" description:"Produce PDF/A-2b archival output by default"`
+		PDFDPI               int           `flag:"pdf-dpi" default:"150" description:"Resolution of the pages embedded into the PDF"`
+		PDFMargin            float64       `flag:"pdf-margin" default:"0" description:"Margin (mm) kept free on all sides of the A4 pages of the PDF"`
+		PDFPlacement         string        `flag:"pdf-placement" default:"width" description:"Placement of the pages on the A4 pages of the PDF: width (scaled to the width, top aligned), fit (scaled to fit, centered), fill (scaled to cover, clipped) or center (actual size, centered)"`
+		PageCountMismatch    string        `flag:"page-count-mismatch" default:"warn" description:"Default handling of scans not matching expect-pages / expect-sheets: warn (deliver marked as suspect) or fail"`
+		PageNumberTemplate   string        `flag:"page-number-template" default:"Page {{.Page}} of {{.Pages}}" description:"Template of the page number footers added with ?page-numbers=true (fields: Page, Pages)"`
+		Pipeline             string        `flag:"pipeline" default:"resize" description:"Processing steps applied to every page (e.g. 'deskew, resize, ocr lang=deu'), can be overridden per profile or request"`
+		PostProcess          string        `flag:"post-process" default:"" description:"Command to run on every finished document before it is delivered, it is called with the path of the document to modify in place"`
+		PostProcessOptional  bool          `flag:"post-process-optional" default:"false" description:"Deliver the unprocessed document if the post-processing command fails instead of failing the scan"`
+		PostProcessTimeout   time.Duration `flag:"post-process-timeout" default:"5m" description:"Abort the post-processing command after this time"`
+		PprofListen          string        `flag:"pprof-listen" default:"127.0.0.1:6060" description:"Port/IP to serve pprof and /debug/status on with --enable-pprof"`
+		PreviewDPI           int           `flag:"preview-dpi" default:"75" description:"Resolution of preview scans (/preview.jpg)"`
+		Profiles             string        `flag:"profiles" default:"" description:"YAML file containing named sets of scan parameters selectable using ?profile="`
+		PublicURL            string        `flag:"public-url" default:"" description:"URL the daemon is reachable at, used to link stored scans from cover sheets"`
+		RateLimit            float64       `flag:"rate-limit" default:"0" description:"Requests per second allowed per client IP, exceeding clients get 429 (0 = disable)"`
+		RateLimitBurst       int           `flag:"rate-limit-burst" default:"10" description:"Requests a client IP may send at once before --rate-limit applies"`
+		ReplayDir            string        `flag:"replay-dir" default:"" description:"Developer option: Feed the image files of this directory instead of scanning, one subdirectory per scan in turn if it has any"`
+		ReplayDPI            int           `flag:"replay-dpi" default:"300" description:"Resolution the images of --replay-dir were scanned at, they are scaled to the resolution of the scan"`
+		ResampleFilter       string        `flag:"resample-filter" default:"auto" description:"Filter to scale the pages with (lanczos, catmullrom, linear, box, nearest, auto: lanczos on x86, catmullrom on other architectures)"`
+		RoutingSheets        bool          `flag:"routing-sheets" default:"false" description:"Read routing sheets (GET /routing-sheet.pdf) on top of the scanned stacks using zbarimg, apply their settings and remove them"`
+		ResultTTL            time.Duration `flag:"result-ttl" default:"15m" description:"Keep documents for downloading them again using X-Scan-ID if --storage-dir is not set (0 = disable)"`
+		RetentionMaxAge      time.Duration `flag:"retention-max-age" default:"0" description:"Remove stored scans older than this, e.g. 2160h for 90 days (0 = keep)"`
+		RetentionMaxCount    int           `flag:"retention-max-count" default:"0" description:"Keep at most this many stored scans, the oldest are removed (0 = no limit)"`
+		RetentionMaxSize     int           `flag:"retention-max-size" default:"0" description:"Remove the oldest stored scans once all take more than this many MiB (0 = no limit)"`
+		SANEConfigDir        string        `flag:"sane-config-dir" default:"" description:"Directory containing the SANE configuration (dll.conf, backend configs) to use instead of the system default"`
+		SANEDAllow           []string      `flag:"saned-allow" default:"" description:"Networks (CIDR) allowed to use the SANE network protocol (default: all, required with authentication)"`
+		SANEDListen          string        `flag:"saned-listen" default:"" description:"Port/IP to serve the scanner on using the SANE network protocol (saned), e.g. ':6566' (empty = disabled)"`
+		SANEIdleTimeout      time.Duration `flag:"sane-idle-timeout" default:"5m" description:"Keep the scanner open for this time after a scan to speed up the next one (0 = close after every scan)"`
+		SANERetryBackoff     time.Duration `flag:"sane-retry-backoff" default:"500ms" description:"First wait before retrying SANE operations failing with transient errors (device busy, I/O), doubled for every attempt"`
+		SANERetryTimeout     time.Duration `flag:"sane-retry-timeout" default:"30s" description:"Total time to retry a failing SANE operation for (0 = disable retries)"`
+		SFTP                 string        `flag:"sftp" default:"sftp" description:"Path to the OpenSSH sftp binary used by SFTP upload targets"`
+		Schedules            string        `flag:"schedules" default:"" description:"YAML file with scans to start at the times given as cron expressions (requires --storage-dir or --targets)"`
+		ScanCommand          string        `flag:"scan-command" default:"" description:"Acquire the pages by running this program instead of using SANE, e.g. a bridge to TWAIN (default on Windows: WIA using PowerShell)"`
+		ScanDPI              int           `flag:"scan-dpi" default:"300" description:"Resolution to scan the pages with"`
+		ScanTimeout          time.Duration `flag:"scan-timeout" default:"10m" description:"Abort scans not finished within this time, the pages captured so far are kept for resuming the scan (0 = no limit)"`
+		ScannerOptions       string        `flag:"scanner-options" default:"" description:"YAML file with default scanner options replacing the built-in ones, changes using the admin API are persisted to it"`
+		Scanners             string        `flag:"scanners" default:"" description:"YAML file with several devices to dispatch the scans to (first idle one or the one named in the request) with their options"`
+		SelfTestFrame        bool          `flag:"self-test-frame" default:"false" description:"Scan a frame from the SANE test backend (test:0) in the self-test to check the acquisition works"`
+		SignCert             string        `flag:"sign-cert" default:"" description:"Certificate (PEM, followed by its chain) to sign the generated PDFs with (PAdES), requires --sign-key"`
+		SignKey              string        `flag:"sign-key" default:"" description:"RSA or ECDSA private key (PEM) of the --sign-cert certificate"`
+		SignLocation         string        `flag:"sign-location" default:"" description:"Location shown with the signature of the PDFs, e.g. the office of the scanner"`
+		SignReason           string        `flag:"sign-reason" default:"" description:"Reason shown with the signature of the PDFs"`
+		SleepTimer           int           `flag:"sleep-timer" default:"-1" description:"Minutes of inactivity after which the scanner goes to sleep (-1 = keep the device setting)"`
+		Source               string        `flag:"source" default:"adf" description:"Default paper source: adf (document feeder) or flatbed (one page per scan, collect several using a session)"`
+		SpoolDir             string        `flag:"spool-dir" default:"" description:"Keep the processed pages and the documents being built in files in this directory instead of memory (default: pages in memory, documents in the system temp directory)"`
+		StateDir             string        `flag:"state-dir" default:"" description:"Persist the jobs started using gRPC and the results kept for --result-ttl in this directory so they survive restarts"`
+		StatsFile            string        `flag:"stats-file" default:"" description:"Persist the cumulative scan statistics in this file (default: 'stats.json' in --storage-dir if set)"`
+		StorageDir           string        `flag:"storage-dir" default:"" description:"Persist every scan into this directory to list and download it again later"`
+		Targets              string        `flag:"targets" default:"" description:"YAML file with upload targets (directory, WebDAV, S3, FTP, SFTP, Dropbox, Google Drive, email, webhook, IPP printer, fax) and the routes delivering scans to them"`
+		Tesseract            string        `flag:"tesseract" default:"tesseract" description:"Path to the tesseract binary used for OCR"`
+		TLSCert              string        `flag:"tls-cert" default:"" description:"Serve HTTPS using this certificate file"`
+		TLSClientCA          string        `flag:"tls-client-ca" default:"" description:"Accept TLS client certificates signed by this CA as authentication (mutual TLS)"`
+		TLSKey               string        `flag:"tls-key" default:"" description:"Key file for the --tls-cert certificate"`
+		UpdateCheck          time.Duration `flag:"update-check" default:"0" description:"Check GitHub for a newer release in this interval, e.g. 24h, reported in the log and GET /status (0 = disable)"`
+		UserProfile          []string      `flag:"user-profile" default:"" description:"Profile used for the scans of an authenticated user not selecting one, as 'user:profile' (repeatable)"`
+		VersionAndExit       bool          `flag:"version" default:"false" description:"Prints current version and exits"`
+		WatchADF             bool          `flag:"watch-adf" default:"false" description:"Start a scan when paper is inserted into the document feeder (requires --storage-dir or --targets)"`
+		WatchDelay           time.Duration `flag:"watch-delay" default:"3s" description:"Time paper has to be loaded before --watch-adf starts the scan"`
+		WatchInterval        time.Duration `flag:"watch-interval" default:"1s" description:"Interval to poll the paper sensor in for --watch-adf"`
+		WatchProfile         string        `flag:"watch-profile" default:"" description:"Profile to use for scans started by --watch-adf"`
+		WatchSensor          string        `flag:"watch-sensor" default:"page-loaded" description:"Boolean scanner option telling whether paper is loaded, polled for --watch-adf"`
+		WSD                  bool          `flag:"wsd" default:"false" description:"Serve the WSD scan protocol and announce the scanner using WS-Discovery for Windows clients"`
+		Zbarimg              string        `flag:"zbarimg" default:"zbarimg" description:"Path to the zbarimg binary used to read barcodes for routing scans to upload targets"`
 	}{}
 
 	version = "dev"
 
+	imageOps scanner.ImageOps
+
+	// pageSpool keeps the processed pages on disk if --spool-dir is set
+	pageSpool *scanner.Spool
+	// colorProfile describes the colors of the scanner if --icc-profile
+	// is set
+	colorProfile *scanner.ColorProfile
+
 	scannerOpts = map[string]interface{}{
 		"ald":         true,         // Detect page end for short pages
 		"brightness":  25,           // Brighten the image to whiten background
 		"br-x":        210.0,        // A4: 210mm
 		"br-y":        297.0,        // A4: 297mm
 		"buffermode":  "On",         // Read pages fast into scanner buffer
-		"mode":        "Color",      // Use color image scans
-		"offtimer":    0,            // Don't turn off scanner
+		"mode":        "Color",      // Use color image scans (see scanParams)
+		"offtimer":    0,            // Don't turn off scanner (see --off-timer)
 		"page-height": 297.0,        // A4: 297mm
 		"page-width":  210.0,        // A4: 210mm
-		"resolution":  scanDPI,      // Scan with 300dpi for better results
-		"source":      "ADF Duplex", // Duplex scan: Both pages at once
+		"resolution":  300,          // Scan with 300dpi for better results (see scanParams)
+		"source":      "ADF Duplex", // Duplex scan: Both pages at once (see scanParams)
 		"swdespeck":   2,            // Remove black spots
 		"swskip":      10.0,         // If a page is >=10% empty discard it
 		"tl-x":        0.0,          // Start the page at 0mm
@@ -60,105 +188,983 @@ func init() {
 		os.Exit(0)
 	}
 
+	if cfg.OffTimer < 0 {
+		log.Fatal("--off-timer must not be negative")
+	}
+	scannerOpts["offtimer"] = cfg.OffTimer
+	if cfg.SleepTimer >= 0 {
+		scannerOpts["sleeptimer"] = cfg.SleepTimer
+	}
+
+	if err := defaultScanParams().validate(); err != nil {
+		log.WithError(err).Fatal("Invalid scan defaults")
+	}
+
 	if l, err := log.ParseLevel(cfg.LogLevel); err != nil {
 		log.WithError(err).Fatal("Unable to parse log level")
 	} else {
 		log.SetLevel(l)
 	}
+
+	switch cfg.LogFormat {
+	case "text":
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		log.WithField("log_format", cfg.LogFormat).Fatal("Invalid log format (supported: text, json)")
+	}
+
+	if cfg.SANEConfigDir != "" {
+		os.Setenv("SANE_CONFIG_DIR", cfg.SANEConfigDir)
+	}
+
+	var err error
+	chain, err := buildAuthChain()
+	if err != nil {
+		log.WithError(err).Fatal("Unable to configure authentication")
+	}
+	auth.Set(chain)
+
+	if allowedNetworks, err = parseNetworks("allow-cidr", cfg.AllowCIDR); err != nil {
+		log.WithError(err).Fatal("Unable to configure allowed networks")
+	}
+
+	fi, err := parseFailureInjection(cfg.FailInject)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to parse failure injection")
+	}
+	failInject = fi
+
+	if cfg.FailInject != "" {
+		log.WithField("fail_inject", cfg.FailInject).Warn("Failure injection is enabled, do not use this in production")
+	}
+
+	saneScanner.Device = cfg.Device
+	if cfg.DeviceMatch != "" {
+		if saneScanner.DeviceMatch, err = regexp.Compile(cfg.DeviceMatch); err != nil {
+			log.WithError(err).Fatal("Invalid device match expression")
+		}
+	}
+	saneScanner.IdleTimeout = cfg.SANEIdleTimeout
+	if cfg.SANERetryTimeout > 0 {
+		saneScanner.Retry = scanner.RetryPolicy{
+			Initial:  cfg.SANERetryBackoff,
+			Deadline: cfg.SANERetryTimeout,
+			Notify: func(op string, err error, wait time.Duration) {
+				log.WithError(err).WithFields(log.Fields{"operation": op, "retry_in": wait}).Warn("Transient SANE error, retrying")
+			},
+		}
+	}
+	switch {
+	case cfg.ScanCommand != "":
+		scanBackend = &scanner.Command{Path: cfg.ScanCommand, Device: cfg.Device}
+	case !featureSANE:
+		scanBackend = scanner.WIA(cfg.Device)
+	}
+	if cfg.Scanners != "" {
+		if !featureSANE {
+			log.Fatal("Several scanners (--scanners) require SANE which is not available on Windows")
+		}
+		if scanPool, err = loadScannerPool(cfg.Scanners); err != nil {
+			log.WithError(err).Fatal("Unable to load scanners")
+		}
+		scanBackend = scanPool
+	}
+	if cfg.ReplayDir != "" {
+		if cfg.FakeScanner > 0 {
+			log.Fatal("--fake-scanner and --replay-dir can not be combined")
+		}
+		if fi, err := os.Stat(cfg.ReplayDir); err != nil || !fi.IsDir() {
+			log.WithField("dir", cfg.ReplayDir).Fatal("Fixture directory for --replay-dir not found")
+		}
+		scanBackend = &scanner.Replay{Dir: cfg.ReplayDir, DPI: cfg.ReplayDPI}
+		log.WithField("dir", cfg.ReplayDir).Warn("Replaying fixtures, scans do not use the real scanner")
+	}
+	if cfg.FakeScanner > 0 {
+		scanBackend = &scanner.Fake{Pages: cfg.FakeScanner}
+		log.WithField("pages", cfg.FakeScanner).Warn("Fake scanner is enabled, scans do not use the real scanner")
+	}
+
+	if imageOps, err = scanner.GetImageOps(cfg.ImageBackend); err != nil {
+		log.WithError(err).Fatal("Invalid image backend")
+	}
+	filter := cfg.ResampleFilter
+	if filter == "auto" {
+		filter = scanner.DefaultResampleFilter()
+	}
+	if imageOps, err = scanner.WithResampleFilter(imageOps, filter); err != nil {
+		log.WithError(err).Fatal("Invalid resampling filter")
+	}
+	log.WithField("filter", filter).Debug("Scaling pages with resampling filter")
+
+	if err = parseFilenameTemplate(cfg.FilenameTemplate); err != nil {
+		log.WithError(err).Fatal("Invalid filename template")
+	}
+
+	if cfg.ContentDisposition != "inline" && cfg.ContentDisposition != "attachment" {
+		log.WithField("content_disposition", cfg.ContentDisposition).Fatal("Invalid content disposition (supported: inline, attachment)")
+	}
+
+	if err = parsePageNumberTemplate(cfg.PageNumberTemplate); err != nil {
+		log.WithError(err).Fatal("Invalid page number template")
+	}
+
+	// Provided by the daemon as it uses the configured tesseract binary
+	if featureOCR {
+		scanner.RegisterStep("ocr", newOCRStep)
+	} else {
+		scanner.RegisterStep("ocr", unavailableStep("ocr", "noocr"))
+	}
+	if cfg.RoutingSheets && !featureBarcode {
+		log.Fatal("Routing sheets are not available in this build (built with -tags nobarcode)")
+	}
+	if pagePipeline, err = scanner.ParsePipeline(cfg.Pipeline); err != nil {
+		log.WithError(err).Fatal("Invalid processing pipeline")
+	}
+
+	if cfg.Profiles != "" {
+		if err = loadProfiles(cfg.Profiles); err != nil {
+			log.WithError(err).Fatal("Unable to load profiles")
+		}
+	}
+
+	if err = loadUserProfiles(cfg.UserProfile); err != nil {
+		log.WithError(err).Fatal("Unable to load user profiles")
+	}
+
+	if err = parseMaintenanceCounters(cfg.MaintenanceCounter); err != nil {
+		log.WithError(err).Fatal("Unable to parse maintenance counters")
+	}
+
+	if cfg.ScannerOptions != "" {
+		if err = loadScannerOptions(cfg.ScannerOptions); err != nil {
+			log.WithError(err).Fatal("Unable to load scanner options")
+		}
+	}
+
+	if cfg.Targets != "" {
+		if err = loadTargets(cfg.Targets); err != nil {
+			log.WithError(err).Fatal("Unable to load upload targets")
+		}
+	}
+
+	if cfg.SpoolDir != "" {
+		if pageSpool, err = scanner.NewSpool(cfg.SpoolDir, int64(cfg.MaxSpoolSize)<<20); err != nil {
+			log.WithError(err).Fatal("Unable to initialize spool")
+		}
+	} else if cfg.MaxSpoolSize > 0 {
+		log.Warn("Spool size limit requires --spool-dir, pages are kept in memory without a limit")
+	}
+
+	if cfg.ICCProfile != "" {
+		if colorProfile, err = loadColorProfile(cfg.ICCProfile); err != nil {
+			log.WithError(err).Fatal("Unable to load color profile")
+		}
+	} else if cfg.ICCConvert {
+		log.Warn("Color conversion requires --icc-profile, the colors are kept")
+	}
+
+	if cfg.StorageDir != "" {
+		if storage, err = newScanStorage(cfg.StorageDir); err != nil {
+			log.WithError(err).Fatal("Unable to initialize scan storage")
+		}
+
+		// Continue counting where the previous run stopped
+		if recs, err := storage.List(); err == nil {
+			scanCounter = len(recs)
+		}
+		scanIndex.Load()
+	}
+
+	if cfg.StateDir != "" {
+		if jobState, err = newJobStateStore(cfg.StateDir); err != nil {
+			log.WithError(err).Fatal("Unable to initialize job state")
+		}
+	}
+
+	if file := statsFile(); file != "" {
+		if err = dutyCycle.loadTotals(file); err != nil {
+			log.WithError(err).Fatal("Unable to load scan statistics")
+		}
+		// Scans removed by the retention policy still count
+		scanCounter += dutyCycle.Snapshot().RemovedScans
+	}
+
+	if storage == nil && (cfg.RetentionMaxAge > 0 || cfg.RetentionMaxCount > 0 || cfg.RetentionMaxSize > 0) {
+		log.Warn("Retention policy requires --storage-dir, it is ignored")
+	}
+
+	if cfg.SignCert != "" || cfg.SignKey != "" {
+		if pdfSigner, err = loadPDFSigner(cfg.SignCert, cfg.SignKey); err != nil {
+			log.WithError(err).Fatal("Unable to load PDF signing certificate")
+		}
+	}
+
+	if cfg.ExportKey != "" {
+		if exportKey, err = loadExportKey(cfg.ExportKey); err != nil {
+			log.WithError(err).Fatal("Unable to load export signing key")
+		}
+		if storage == nil {
+			log.Warn("Compliance export requires --storage-dir, export is disabled")
+		}
+	}
+
+	log.AddHook(recentLogs)
 }
 
 func main() {
-	http.HandleFunc("/scan.pdf", handleScanRequest)
-	http.ListenAndServe(cfg.Listen, nil)
+	if args := rconfig.Args(); len(args) > 1 {
+		switch args[1] {
+		case "scan":
+			runScan(args[2:])
+		case "selfupdate":
+			runSelfUpdate(args[2:])
+		case "support-bundle":
+			runSupportBundle(args[2:])
+		default:
+			log.Fatalf("Unknown command %q", args[1])
+		}
+		return
+	}
+
+	if !runSelfChecks().OK {
+		log.Fatal("Self-check reported fatal problems, refusing to serve")
+	}
+
+	if cfg.MQTTBroker != "" {
+		if err := initMQTT(); err != nil {
+			log.WithError(err).Fatal("Unable to configure MQTT")
+		}
+	}
+
+	http.HandleFunc("/scan", auth.Middleware(idempotent(handleScan)))
+	http.HandleFunc("/scan.pdf", auth.Middleware(idempotent(handleScanRequest)))
+	http.HandleFunc("POST /scan/validate", auth.Middleware(handleScanValidate))
+	http.HandleFunc("GET /scan/schema.json", handleScanRequestSchema)
+	http.HandleFunc("GET /openapi.json", handleOpenAPI)
+	http.HandleFunc("/preview.jpg", auth.Middleware(handlePreviewRequest))
+	http.HandleFunc("GET /rescan/{id}", auth.Middleware(handleRescanAssistant))
+	http.HandleFunc("GET /rescan/{id}/last-page.jpg", auth.Middleware(handleRescanLastPage))
+	http.HandleFunc("GET /ocr-overlay/{id}", auth.Middleware(handleOCROverlaySummary))
+	http.HandleFunc("GET /ocr-overlay/{id}/{file}", auth.Middleware(handleOCROverlayPage))
+	http.HandleFunc("GET /raw-frames/{id}", auth.Middleware(handleRawFramesSummary))
+	http.HandleFunc("GET /raw-frames/{id}/{file}", auth.Middleware(handleRawFrame))
+	http.HandleFunc("POST /sessions", auth.Middleware(handleCreateSession))
+	http.HandleFunc("GET /sessions/{id}", auth.Middleware(handleGetSession))
+	http.HandleFunc("DELETE /sessions/{id}", auth.Middleware(handleDeleteSession))
+	http.HandleFunc("POST /sessions/{id}/finish", auth.Middleware(handleFinishSession))
+	http.HandleFunc("GET /sessions/{id}/assistant", auth.Middleware(handleSessionAssistant))
+	http.HandleFunc("POST /sessions/{id}/assistant", auth.Middleware(handleSessionAssistantScan))
+	http.HandleFunc("GET /sessions/{id}/pages", auth.Middleware(handleListSessionPages))
+	http.HandleFunc("PUT /sessions/{id}/pages", auth.Middleware(handleReorderSessionPages))
+	http.HandleFunc("DELETE /sessions/{id}/pages/{n}", auth.Middleware(handleDeleteSessionPage))
+	http.HandleFunc("POST /sessions/{id}/pages/{n}/rotate", auth.Middleware(handleRotateSessionPage))
+	http.HandleFunc("GET /sessions/{id}/pages/{n}/thumb.jpg", auth.Middleware(handleSessionPageThumbnail))
+	http.HandleFunc("GET /routing-sheet.pdf", auth.Middleware(handleRoutingSheet))
+	http.HandleFunc("GET /scans", auth.Middleware(handleListScans))
+	http.HandleFunc("GET /scans/{file}", auth.Middleware(handleGetScan))
+	http.HandleFunc("GET /search", auth.Middleware(handleSearch))
+	http.HandleFunc("GET /export", auth.Middleware(handleComplianceExport))
+	http.HandleFunc("GET /export/public-key", auth.Middleware(handleExportPublicKey))
+	http.HandleFunc("GET /options", auth.Middleware(handleDeviceOptions))
+	http.HandleFunc("GET /options/{id}", auth.Middleware(handleGetOptionSnapshot))
+	http.HandleFunc("GET /options/{id}/diff/{other}", auth.Middleware(handleDiffOptionSnapshots))
+	http.HandleFunc("GET /jobs", auth.Middleware(handleListJobs))
+	http.HandleFunc("DELETE /jobs/{id}", auth.Middleware(handleCancelJob))
+	http.HandleFunc("GET /jobs/{id}/meta", auth.Middleware(handleJobMeta))
+	http.HandleFunc("GET /jobs/{id}/pages/{n}/thumb", auth.Middleware(handleJobPageThumbnail))
+	http.HandleFunc("GET /jobs/{id}/text", auth.Middleware(handleJobText("text")))
+	http.HandleFunc("GET /jobs/{id}/hocr", auth.Middleware(handleJobText("hocr")))
+	http.HandleFunc("GET /jobs/{id}/alto", auth.Middleware(handleJobText("alto")))
+	http.HandleFunc("POST /claim", auth.Middleware(handleClaim))
+	http.HandleFunc("GET /claim", auth.Middleware(handleGetClaim))
+	http.HandleFunc("DELETE /claim", auth.Middleware(handleReleaseClaim(false)))
+	http.HandleFunc("GET /status", auth.Middleware(handleScannerStatus))
+	http.HandleFunc("GET /selftest", adminOnly(handleSelfTest))
+	http.HandleFunc("POST /selftest", adminOnly(handleSelfTest))
+	http.HandleFunc("POST /maintenance/{task}", auth.Middleware(handleMaintenanceDone))
+	http.HandleFunc("POST /power/{state}", auth.Middleware(handlePowerState))
+	http.HandleFunc("GET /capabilities", auth.Middleware(handleCapabilities))
+	http.HandleFunc("GET /stats", auth.Middleware(handleStats))
+	http.HandleFunc("GET /metrics", auth.Middleware(handleMetrics))
+	http.HandleFunc("GET /admin/options", adminOnly(handleAdminGetOptions))
+	http.HandleFunc("PUT /admin/options", adminOnly(handleAdminPutOptions))
+	http.HandleFunc("POST /admin/sane/reinit", adminOnly(handleAdminSANEReinit))
+	http.HandleFunc("POST /admin/reset", adminOnly(handleAdminReset))
+	http.HandleFunc("POST /admin/calibrate", adminOnly(handleAdminCalibrate))
+	http.HandleFunc("GET /admin/support-bundle", adminOnly(handleAdminSupportBundle))
+	http.HandleFunc("POST /admin/reload", adminOnly(handleAdminReload))
+	http.HandleFunc("DELETE /admin/claim", adminOnly(handleReleaseClaim(true)))
+	http.HandleFunc("PUT /admin/jobs/{id}/priority", adminOnly(handleAdminSetPriority))
+
+	if cfg.ESCL && !featureESCL {
+		log.Fatal("eSCL is not available in this build (built with -tags noescl)")
+	}
+	if featureESCL && cfg.ESCL {
+		http.HandleFunc("GET /eSCL/ScannerCapabilities", auth.Middleware(handleESCLCapabilities))
+		http.HandleFunc("GET /eSCL/ScannerStatus", auth.Middleware(handleESCLStatus))
+		http.HandleFunc("POST /eSCL/ScanJobs", auth.Middleware(handleESCLCreateJob))
+		http.HandleFunc("GET /eSCL/ScanJobs/{id}/NextDocument", auth.Middleware(handleESCLNextDocument))
+		http.HandleFunc("DELETE /eSCL/ScanJobs/{id}", auth.Middleware(handleESCLCancelJob))
+	}
+
+	if cfg.WSD {
+		http.HandleFunc("POST /wsd", auth.Middleware(handleWSD))
+		http.HandleFunc("POST /wsd/scan", auth.Middleware(handleWSD))
+
+		if err := startWSDiscovery(); err != nil {
+			log.WithError(err).Error("Unable to start WS-Discovery")
+		}
+	}
+
+	if cfg.MDNS || cfg.ESCL {
+		if err := startMDNSResponder(); err != nil {
+			log.WithError(err).Error("Unable to announce the scanner using mDNS")
+		}
+	}
+
+	go retention.Run()
+
+	if jobState != nil {
+		scanResults.Restore()
+		if cfg.GRPCListen != "" {
+			// Queued jobs of the previous run start scanning right away
+			grpcJobs.Restore()
+		}
+	}
+
+	if cfg.GRPCListen != "" {
+		go func() {
+			if err := listenAndServeGRPC(); err != nil {
+				log.WithError(err).Fatal("gRPC server exited")
+			}
+		}()
+	}
+
+	if cfg.EnablePprof {
+		go func() {
+			if err := listenAndServeDebug(); err != nil {
+				log.WithError(err).Fatal("Diagnostics server exited")
+			}
+		}()
+	}
+
+	if cfg.SANEDListen != "" {
+		if !usesSANE() {
+			log.Fatal("The SANE network protocol is not available with the fake scanner, replayed fixtures or an acquisition command")
+		}
+		if scanPool != nil {
+			// saned clients open devices beside the pool
+			log.Fatal("The SANE network protocol can not be combined with several scanners (--scanners)")
+		}
+		go func() {
+			if err := listenAndServeSANED(); err != nil {
+				log.WithError(err).Fatal("SANE network server exited")
+			}
+		}()
+	}
+
+	if cfg.WatchADF {
+		if err := startADFWatch(); err != nil {
+			log.WithError(err).Fatal("Unable to watch the document feeder")
+		}
+	}
+
+	if cfg.Schedules != "" {
+		if err := loadSchedules(cfg.Schedules); err != nil {
+			log.WithError(err).Fatal("Unable to load schedules")
+		}
+		if err := startScheduler(); err != nil {
+			log.WithError(err).Fatal("Unable to schedule scans")
+		}
+	}
+
+	if cfg.UpdateCheck > 0 {
+		go updates.Run()
+	}
+
+	if cfg.KeepAlive > 0 {
+		if err := startKeepAlive(); err != nil {
+			log.WithError(err).Fatal("Unable to keep the scanner awake")
+		}
+	}
+
+	reloadOnSIGHUP()
+
+	if err := listenAndServe(); err != nil {
+		log.WithError(err).Fatal("HTTP server exited")
+	}
 }
 
+func listenAndServe() error {
+	server := &http.Server{Handler: logRequests(localizeResponses(allowCORS(limitRequests(hidePprof(http.DefaultServeMux)))))}
+
+	if cfg.TLSCert == "" && cfg.TLSClientCA != "" {
+		return fmt.Errorf("Client certificate authentication requires --tls-cert and --tls-key")
+	}
+
+	l, err := httpListener()
+	if err != nil {
+		return fmt.Errorf("Unable to listen for HTTP requests: %s", err)
+	}
+
+	if cfg.TLSCert == "" {
+		return server.Serve(l)
+	}
+
+	if server.TLSConfig, err = serverTLSConfig(); err != nil {
+		return err
+	}
+	return server.ServeTLS(l, cfg.TLSCert, cfg.TLSKey)
+}
+
+// serverTLSConfig returns the TLS configuration for the servers started
+// with --tls-cert
+func serverTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if cfg.TLSClientCA != "" {
+		caPEM, err := ioutil.ReadFile(cfg.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read client CA: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("No certificates found in client CA file")
+		}
+
+		tlsConfig.ClientCAs = pool
+		// Clients without certificate may still use other authenticators
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// handleScanRequest serves /scan.pdf
 func handleScanRequest(res http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
-	pages, err := fetchPages()
+	params, err := parseScanParams(r)
 	if err != nil {
-		log.WithError(err).Error("Unable to fetch pages")
-		http.Error(res, "Unable to fetch pages", http.StatusInternalServerError)
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
 		return
 	}
 
-	pdf, err := generatePDFFromPages(pages)
-	if err != nil {
-		log.WithError(err).Error("Unable to generate PDF")
-		http.Error(res, "Unable to generate PDF", http.StatusInternalServerError)
+	// The alias always sends PDF documents, only the pages as separate
+	// parts can be requested like before /scan negotiated the format
+	res.Header().Add("Vary", "Accept")
+	format := formatPDF
+	if wantsMultipart(r) {
+		format = formatMultipart
+	}
+	serveScanFormat(res, r, params, format, start)
+}
+
+// serveScan executes the scan described by the parameters and responds
+// with the document
+func serveScan(res http.ResponseWriter, r *http.Request, params *scanParams, start time.Time) {
+	params.JobID = newID()
+	params.User = requestUser(r)
+	params.RequestID = requestID(r)
+
+	var previous *partialScan
+	if id := r.URL.Query().Get("resume"); id != "" {
+		if previous = partialScans.Get(id); previous == nil {
+			writeError(res, http.StatusNotFound, errCodeNotFound, "Partial scan to resume not found or expired")
+			return
+		}
+		// Continue with the settings of the interrupted scan
+		params = previous.Params
+		params.RequestID = requestID(r)
+	}
+	if id := r.URL.Query().Get("session"); id != "" {
+		if previous != nil {
+			writeError(res, http.StatusBadRequest, errCodeInvalidParameter, "Scans into a session can not be resumed, scan the remaining sheets into the session instead")
+			return
+		}
+		serveSessionScan(res, r, id)
 		return
 	}
+	if id, ok := r.Context().Value(ctxKeyJobID).(string); ok {
+		// Started asynchronously, the caller already knows the ID
+		params.JobID = id
+	}
+	res.Header().Set("X-Job-ID", params.JobID)
 
-	res.Header().Set("X-Generation-Time", time.Since(start).String())
-	res.Header().Set("Content-Type", "application/pdf")
-	res.Header().Set("Cache-Control", "no-cache")
-	io.Copy(res, pdf)
-}
+	var (
+		captured   []*scanner.Page
+		firstIndex int
+	)
+	if previous != nil {
+		captured, firstIndex = previous.Pages, previous.Fed
+	}
+
+	pages, skipped, err := scanAndProcessPages(params, firstIndex)
+	pages = append(captured, pages...)
 
-func fetchPages() ([]*sane.Image, error) {
-	err := sane.Init()
+	var limit scanner.PageLimitError
+	if errors.As(err, &limit) && len(pages) > 0 {
+		// Stopped cleanly, the pages up to the limit are delivered
+		params.logger().WithError(err).Warn("Page limit exceeded, scan was stopped")
+		params.Meta.Suspect = err.Error()
+		res.Header().Add("X-Scan-Warning", err.Error())
+		err = nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("Unable to initialize SANE: %s", err)
+		_, code := scanErrorStatus(err)
+		switch code {
+		case errCodeInvalidParameter, errCodeCooldown, errCodeQueueFull:
+			// Rejected before scanning anything
+			writeScanError(res, params.JobID, err)
+			return
+
+		case errCodeADFEmpty:
+			// Nothing to scan, a partial scan being resumed is kept
+			params.logger().Warn("Document feeder is empty")
+			publishEvent(scanEvent{Event: "failed", JobID: params.JobID, Profile: params.Profile, User: params.User, Error: err.Error(), ErrorCode: code})
+			writeScanError(res, params.JobID, err)
+			return
+		}
+
+		params.logger().WithError(err).WithField("pages", len(pages)).Error("Unable to fetch pages")
+		recordFailedJob(r, params, len(pages), err)
+		publishEvent(scanEvent{Event: "failed", JobID: params.JobID, Pages: len(pages), Profile: params.Profile, User: params.User, Error: err.Error(), ErrorCode: code})
+
+		switch {
+		case len(pages) == 0:
+			writeScanError(res, params.JobID, err)
+			return
+
+		case !params.Partial:
+			if previous != nil {
+				partialScans.Remove(previous.ID)
+			}
+			respondPartialScan(res, partialScans.Add(params, pages, err))
+			return
+		}
+
+		// Deliver the pages captured so far instead of keeping them for
+		// resuming the scan
+		_, code = partialScanError(err)
+		res.Header().Set("X-Error-Code", code)
+		res.Header().Add("X-Scan-Warning", fmt.Sprintf("Scan failed after %d page(s), the document is incomplete: %s", len(pages), err))
 	}
 
-	devs, err := sane.Devices()
-	if err != nil {
-		return nil, fmt.Errorf("Unable to list devices: %s", err)
+	if previous != nil {
+		partialScans.Remove(previous.ID)
 	}
 
-	if len(devs) < 1 {
-		return nil, fmt.Errorf("No scanners found")
+	pages = applyRoutingSheet(params, pages)
+
+	if err == nil {
+		if err = checkPageCount(params, pages, skipped); err != nil && params.PageCountMismatch == pageCountFail {
+			params.logger().WithError(err).Error("Unexpected number of pages scanned")
+			_, code := scanErrorStatus(err)
+			publishEvent(scanEvent{Event: "failed", JobID: params.JobID, Pages: len(pages), Profile: params.Profile, User: params.User, Error: err.Error(), ErrorCode: code})
+			writeScanError(res, params.JobID, err)
+			return
+		}
+		if err != nil {
+			params.logger().WithError(err).Warn("Unexpected number of pages scanned")
+			params.Meta.Suspect = err.Error()
+			res.Header().Add("X-Scan-Warning", err.Error())
+		}
+	}
+
+	serveDocument(res, r, params, pages, skipped, start)
+}
+
+// serveDocument renders the selected pages into the document, stores
+// and delivers it and responds with it
+func serveDocument(res http.ResponseWriter, r *http.Request, params *scanParams, pages []*scanner.Page, skipped scanner.PageErrors, start time.Time) {
+	pages, skipped = skipUnembeddablePages(params, selectPages(pages, params.Pages), skipped)
+
+	if len(pages) == 0 {
+		if len(skipped) > 0 {
+			writeError(res, http.StatusInternalServerError, errCodeInternal, skipped.Error())
+			return
+		}
+		writeError(res, http.StatusUnprocessableEntity, errCodeNoPagesSelected, "Page selection does not contain any of the scanned pages")
+		return
+	}
+
+	if len(skipped) > 0 {
+		res.Header().Set("X-Skipped-Pages", skippedPages(skipped))
+		res.Header().Add("X-Scan-Warning", "Some pages were unable to be processed and are missing in the document")
+	}
+
+	if params.Meta != nil && len(params.Meta.DuplicatePages) > 0 {
+		if params.DuplicatePages == duplicatePagesDrop {
+			res.Header().Add("X-Scan-Warning", "Pages looking like sheets scanned twice were removed")
+		} else {
+			res.Header().Add("X-Scan-Warning", "Some pages look like sheets scanned twice, please check the document")
+		}
+	}
+
+	if misfed := misfedPages(pages); len(misfed) > 0 {
+		params.logger().WithField("pages", misfed).Warn("Possible misfeed (stapled or overlapping sheets) detected, please rescan")
+		res.Header().Set("X-Misfeed-Pages", misfed)
+		res.Header().Add("X-Scan-Warning", "Possible misfeed (stapled or overlapping sheets) detected, please rescan")
 	}
 
-	c, err := sane.Open(devs[0].Name)
+	if featureOCR && params.OCROverlay {
+		if ov, err := createOCROverlay(pages, params.OCRLang); err != nil {
+			// The overlay is a debug aid, the scan itself is still fine
+			params.logger().WithError(err).Error("Unable to create OCR overlay")
+		} else {
+			res.Header().Set("X-OCR-Overlay-ID", ov.ID)
+			res.Header().Set("X-OCR-Confidence", strconv.FormatFloat(ov.MeanConfidence(), 'f', 1, 64))
+		}
+	}
+
+	// The effective steps to reproduce the scan with ?pipeline=
+	res.Header().Set("X-Pipeline", params.pipeline().String())
+
+	if params.RawFrames {
+		res.Header().Set("X-Raw-Frames-ID", rawFrameScans.Add(params.JobID, pages).ID)
+	}
+
+	text := newJobText(params.JobID, pages)
+	if text != nil {
+		jobTexts.Add(text)
+	}
+
+	if params.MaxSize > 0 {
+		reduced, step, fits, err := fitSizeBudget(params, pages)
+		switch {
+		case err != nil:
+			params.logger().WithError(err).Error("Unable to reduce document to max-size")
+			res.Header().Add("X-Scan-Warning", "Unable to reduce the document to max-size")
+		case !fits:
+			pages = reduced
+			res.Header().Set("X-Size-Reduction", step)
+			res.Header().Add("X-Scan-Warning", "The document exceeds max-size even at the lowest quality")
+		case step != "":
+			pages = reduced
+			res.Header().Set("X-Size-Reduction", step)
+		}
+	}
+
+	var (
+		docs        = scanDocuments(params, pages)
+		contentType = "application/pdf"
+		ext         = ".pdf"
+	)
+
+	switch {
+	case len(docs) > 1 || params.Photo || params.Card || params.Receipt || params.Format == formatZIP:
+		contentType, ext = "application/zip", ".zip"
+	case params.Format == formatTIFF:
+		contentType, ext = "image/tiff", ".tif"
+	}
+
+	if params.Meta == nil {
+		// Documents of sessions assembled from several scans
+		params.Meta = newJobMeta(params)
+	}
+	params.Meta.complete(params, pages, skipped, len(docs))
+
+	var title string
+	var extraTags []string
+	if params.RoutingSheet != nil {
+		extraTags = params.RoutingSheet.Tags
+	}
+	params.Meta.Tags, title = classifyScan(text, extraTags)
+	if params.Info.Title == "" {
+		params.Info.Title = title
+	}
+
+	params.Meta.setHeaders(res.Header())
+	jobMetas.Add(params.Meta)
+
+	filename, err := scanFilename(params, requestUser(r), len(pages), start, ext)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to open scanner: %s", err)
+		params.logger().WithError(err).Error("Unable to generate filename")
+		writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to generate filename")
+		return
+	}
+
+	// Documents are written page by page while being rendered instead of
+	// buffering them to keep the memory usage low for large batches
+	render := func(w io.Writer) error {
+		if params.Photo {
+			return writePhotoZIP(w, params, pages, strings.TrimSuffix(filename, ext))
+		}
+		if params.Card {
+			return writeCardZIP(w, params, pages, strings.TrimSuffix(filename, ext))
+		}
+		if params.Receipt {
+			return writeReceiptZIP(w, params, pages, strings.TrimSuffix(filename, ext))
+		}
+		if contentType == "application/zip" {
+			return writeZIPFromDocuments(w, params, docs, strings.TrimSuffix(filename, ext))
+		}
+		if contentType == "image/tiff" {
+			return scanner.WriteTIFF(w, docs[0], imageMetadata(params))
+		}
+		return writePDF(w, params, docs[0])
 	}
 
-	defer func() {
-		c.Cancel()
-		c.Close()
-		sane.Exit()
-	}()
+	completed := scanEvent{
+		Event:     "completed",
+		JobID:     params.JobID,
+		Pages:     len(pages),
+		Documents: len(docs),
+		Filename:  filename,
+		Profile:   params.Profile,
+		User:      params.User,
+	}
 
-	for name, value := range scannerOpts {
-		_, err := c.SetOption(name, value)
-		if err != nil {
-			return nil, fmt.Errorf("Unable to set option: %s", err)
+	route := routeScan(params, pages)
+	if params.RoutingSheet != nil && len(params.RoutingSheet.Targets) > 0 {
+		route.Targets = params.RoutingSheet.Targets
+	}
+	targets := route.Targets
+	if len(targets) > 0 {
+		res.Header().Set("X-Delivery-Targets", strings.Join(targets, ", "))
+	}
+	delivery := &deliveryDocument{
+		Filename:    filename,
+		ContentType: contentType,
+		Created:     start,
+		JobID:       params.JobID,
+		Pages:       len(pages),
+		Profile:     params.Profile,
+		Title:       params.Info.Title,
+		User:        params.User,
+		Tags:        params.Meta.Tags,
+	}
+	if w, h, ok := scanAreaSize(params.scannerOptions()); ok {
+		delivery.PaperWidthMM, delivery.PaperHeightMM = w, h
+	}
+
+	if params.Archive {
+		deliverArchive(res, params, pages, route.ArchiveTargets, delivery)
+	}
+
+	if params.DuplexSplit && len(route.BackTargets) > 0 {
+		// The sides are delivered as separate documents instead of the
+		// ZIP archive the client gets
+		deliverDuplexSplit(res, params, docs, route, delivery)
+		targets = nil
+	}
+
+	if cfg.PostProcess != "" {
+		file, processed, err := postProcessedRender(render, delivery)
+		if file != "" {
+			defer os.Remove(file)
+		}
+		switch {
+		case err == nil:
+			render = processed
+
+		case file != "" && cfg.PostProcessOptional:
+			render = processed
+			res.Header().Add("X-Scan-Warning", "Post-processing failed, the document is delivered unprocessed")
+
+		case file == "":
+			params.logger().WithError(err).Error("Unable to generate document")
+			publishEvent(scanEvent{Event: "failed", JobID: params.JobID, Pages: len(pages), Profile: params.Profile, User: params.User, Error: err.Error(), ErrorCode: errCodeInternal})
+			writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to generate document")
+			return
+
+		default:
+			recordFailedJob(r, params, len(pages), err)
+			publishEvent(scanEvent{Event: "failed", JobID: params.JobID, Pages: len(pages), Profile: params.Profile, User: params.User, Error: err.Error(), ErrorCode: errCodePostProcessFailed})
+			writeError(res, http.StatusInternalServerError, errCodePostProcessFailed, err.Error())
+			return
+		}
+	}
+
+	// The checksum of the document is computed while rendering it
+	var checksum string
+	unhashed := render
+	render = func(w io.Writer) error {
+		h := sha256.New()
+		if err := unhashed(io.MultiWriter(w, h)); err != nil {
+			return err
+		}
+		checksum = hex.EncodeToString(h.Sum(nil))
+		return nil
+	}
+
+	if len(docs) > 1 {
+		res.Header().Set("X-Document-Count", strconv.Itoa(len(docs)))
+	}
+	res.Header().Set("Content-Type", contentType)
+	res.Header().Set("Content-Disposition", contentDisposition(filename))
+	res.Header().Set("Cache-Control", "no-cache")
+
+	if storage != nil {
+		rec := &scanRecord{
+			ID:          params.JobID,
+			Created:     start,
+			Pages:       len(pages),
+			Documents:   len(docs),
+			ContentType: contentType,
+			Filename:    filename,
+			Title:       params.Info.Title,
+			User:        requestUser(r),
+			Pipeline:    params.pipeline().String(),
+		}
+
+		// The document is rendered into the storage first so it is not
+		// lost if the client disconnects during the transfer
+		if err = storage.Write(rec, render); err == nil {
+			completed.SHA256 = checksum
+			publishEvent(completed)
+			retention.Trigger()
+			if len(targets) > 0 {
+				delivery.File = storage.File(rec)
+				deliverScan(targets, delivery, false)
+			}
+			res.Header().Set("X-Scan-ID", rec.ID)
+			res.Header().Set("X-Content-SHA256", checksum)
+			res.Header().Set("ETag", `"`+checksum+`"`)
+			res.Header().Set("X-Generation-Time", time.Since(start).String())
+			http.ServeFile(res, r, storage.File(rec))
+			return
 		}
+		// The client still gets the scan, only the history is missing it
+		params.logger().WithError(err).Error("Unable to store scan")
 	}
 
-	return c.ReadAvailableImages()
+	if len(targets) > 0 || cfg.ResultTTL > 0 {
+		// The targets read the document after the response was sent
+		if delivery.File, err = renderTempFile(render); err != nil {
+			params.logger().WithError(err).Error("Unable to generate document")
+			publishEvent(scanEvent{Event: "failed", JobID: params.JobID, Pages: len(pages), Profile: params.Profile, User: params.User, Error: err.Error(), ErrorCode: errCodeInternal})
+			writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to generate document")
+			return
+		}
+
+		completed.SHA256 = checksum
+		publishEvent(completed)
+		if cfg.ResultTTL > 0 {
+			// Kept to download it again if the transfer fails
+			if result, err := scanResults.Add(delivery, checksum); err == nil {
+				res.Header().Set("X-Scan-ID", result.ID)
+				res.Header().Set("ETag", `"`+checksum+`"`)
+			} else {
+				params.logger().WithError(err).Error("Unable to keep scan result")
+			}
+		}
+		res.Header().Set("X-Content-SHA256", checksum)
+		res.Header().Set("X-Generation-Time", time.Since(start).String())
+		http.ServeFile(res, r, delivery.File)
+		if len(targets) > 0 {
+			deliverScan(targets, delivery, true)
+		} else {
+			os.Remove(delivery.File)
+		}
+		return
+	}
+
+	res.Header().Set("Trailer", "X-Generation-Time, X-Content-SHA256")
+	out := &lazyResponseWriter{ResponseWriter: res}
+	if err := render(out); err != nil {
+		params.logger().WithError(err).Error("Unable to generate document")
+		publishEvent(scanEvent{Event: "failed", JobID: params.JobID, Pages: len(pages), Profile: params.Profile, User: params.User, Error: err.Error(), ErrorCode: errCodeInternal})
+		if !out.written {
+			writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to generate document")
+			return
+		}
+		// Status and parts of the document were already sent, abort the
+		// connection to signal the document is incomplete
+		panic(http.ErrAbortHandler)
+	}
+	res.Header().Set("X-Generation-Time", time.Since(start).String())
+	res.Header().Set("X-Content-SHA256", checksum)
+	completed.SHA256 = checksum
+	publishEvent(completed)
+}
+
+// lazyResponseWriter tracks whether anything was written to the
+// response to decide whether an error can still be reported as status
+type lazyResponseWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (l *lazyResponseWriter) Write(p []byte) (int, error) {
+	l.written = true
+	return l.ResponseWriter.Write(p)
 }
 
-func generatePDFFromPages(pages []*sane.Image) (io.Reader, error) {
-	pdf := gofpdf.New("P", "mm", "A4", "")
-	defer pdf.Close()
+// Unwrap gives http.ResponseController access to the connection
+func (l *lazyResponseWriter) Unwrap() http.ResponseWriter { return l.ResponseWriter }
+
+// writePDF renders the pages into a PDF written to w page by page,
+// documents to be optimized or signed are written once they are complete
+func writePDF(w io.Writer, params *scanParams, pages []*scanner.Page) error {
+	if params.Optimize {
+		return writeOptimizedPDF(w, params, pages)
+	}
+	if pdfSigner != nil {
+		return writeSignedPDF(w, params, pages)
+	}
+	return assemblePDF(w, params, pages)
+}
+
+// assemblePDF writes the pages into a PDF page by page
+func assemblePDF(w io.Writer, params *scanParams, pages []*scanner.Page) error {
+	var pdf pdfgen.Assembler
+	if params.Existing != nil {
+		// The posted document keeps its metadata
+		pdf = pdfgen.NewAppendWriter(w, params.Existing, params.Prepend)
+	} else {
+		pdf = pdfgen.NewWriter(w, params.pdfOptions())
+	}
+
+	if params.Cover {
+		content, err := params.coverSheet(len(pages)).Render()
+		if err != nil {
+			return fmt.Errorf("Unable to render cover sheet: %s", err)
+		}
+		if err := pdf.AddContentPage(content); err != nil {
+			return fmt.Errorf("Unable to write cover sheet: %s", err)
+		}
+	}
 
 	for i, p := range pages {
-		pdf.AddPage()
-		img := new(bytes.Buffer)
-		if err := jpeg.Encode(img, reducePageDPI(p), &jpeg.Options{Quality: 95}); err != nil {
-			return nil, fmt.Errorf("Unable to encode page %d: %s", i, err)
+		img, err := p.PDFImage()
+		if err != nil {
+			return fmt.Errorf("Unable to embed page %d: %s", i, err)
 		}
-		imgOpts := gofpdf.ImageOptions{
-			ImageType: "jpeg",
-			ReadDpi:   true,
+		img.Layout = params.layout()
+
+		if params.PageNumbers {
+			// The cover sheet is not counted
+			if err := addPageNumber(img, i+1, len(pages)); err != nil {
+				return err
+			}
+		}
+
+		if p.Section != "" {
+			pdf.AddBookmark(p.Section)
+		}
+
+		if err := pdf.AddImagePage(img); err != nil {
+			return fmt.Errorf("Unable to write page %d: %s", i, err)
 		}
-		pdf.RegisterImageOptionsReader(fmt.Sprintf("page%d", i), imgOpts, img)
-		pdf.ImageOptions(fmt.Sprintf("page%d", i), 0, 0, 210, 0, false, imgOpts, 0, "")
 	}
 
-	pdfBuf := new(bytes.Buffer)
-	if err := pdf.Output(pdfBuf); err != nil {
-		return nil, fmt.Errorf("Unable to render PDF: %s", err)
+	if err := pdf.Close(); err != nil {
+		return fmt.Errorf("Unable to render PDF: %s", err)
 	}
 
-	return pdfBuf, nil
+	return nil
 }
 
-func reducePageDPI(in image.Image) image.Image {
-	origW, origH := in.Bounds().Max.X, in.Bounds().Max.Y
-
-	return imaging.Fit(in, origW/(scanDPI/pdfDPI), origH/(scanDPI/pdfDPI), imaging.Lanczos)
+// nonEmpty filters empty entries out of slice flags as rconfig yields a
+// single empty string for unset flags
+func nonEmpty(in []string) []string {
+	out := []string{}
+	for _, v := range in {
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// maintenanceCounter is a read-only device option counting pages or
+// the wear of a consumable (pad, pick roller) together with the value
+// it should be replaced at
+type maintenanceCounter struct {
+	Option    string  `json:"option"`
+	Title     string  `json:"title,omitempty"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold,omitempty"`
+	// ReplacementDue is set once the value reached the threshold
+	ReplacementDue bool `json:"replacement_due"`
+}
+
+// scannerStatus contains the sensors and maintenance counters of the
+// device
+type scannerStatus struct {
+	Device   scanner.Device         `json:"device"`
+	Sensors  map[string]interface{} `json:"sensors"`
+	Counters []maintenanceCounter   `json:"counters"`
+	// Reminders are the maintenance tasks done by the user
+	Reminders []maintenanceReminder `json:"reminders"`
+	// Power tells whether the scanner was sent to sleep
+	Power powerStatus `json:"power"`
+	// Update is the result of the last --update-check
+	Update *updateStatus `json:"update,omitempty"`
+}
+
+// maintenanceState keeps the configured counters, their last values for
+// the metrics and whether a warning was logged already
+type maintenanceState struct {
+	thresholds map[string]float64
+	order      []string
+
+	lock   sync.Mutex
+	last   []maintenanceCounter
+	warned map[string]bool
+}
+
+var maintenance = &maintenanceState{thresholds: map[string]float64{}, warned: map[string]bool{}}
+
+// parseMaintenanceCounters reads the "option" or "option:threshold"
+// entries of --maintenance-counter
+func parseMaintenanceCounters(entries []string) error {
+	for _, e := range nonEmpty(entries) {
+		name, v, hasThreshold := strings.Cut(e, ":")
+		if name == "" {
+			return fmt.Errorf("Invalid maintenance counter %q, expected format 'option' or 'option:threshold'", e)
+		}
+
+		var threshold float64
+		if hasThreshold {
+			var err error
+			if threshold, err = strconv.ParseFloat(v, 64); err != nil || threshold <= 0 {
+				return fmt.Errorf("Invalid threshold for maintenance counter %q: %q", name, v)
+			}
+		}
+
+		if _, exists := maintenance.thresholds[name]; !exists {
+			maintenance.order = append(maintenance.order, name)
+		}
+		maintenance.thresholds[name] = threshold
+	}
+	return nil
+}
+
+// readScannerStatus reads the read-only options of the device and
+// updates the maintenance counters
+func readScannerStatus(describer scanner.DeviceDescriber) (scannerStatus, error) {
+	caps, err := describer.DeviceOptions()
+	if err != nil {
+		return scannerStatus{}, err
+	}
+
+	status := scannerStatus{Device: caps.Device, Sensors: map[string]interface{}{}, Counters: []maintenanceCounter{}}
+	options := map[string]scanner.DeviceOption{}
+	for _, o := range caps.Options {
+		options[o.Name] = o
+		if o.IsActive && !o.IsSettable && o.Type != scanner.TypeButton {
+			status.Sensors[o.Name] = o.Value
+		}
+	}
+
+	for _, name := range maintenance.order {
+		o, ok := options[name]
+		if !ok {
+			log.WithField("option", name).Warn("Maintenance counter is not provided by the device")
+			continue
+		}
+
+		value, ok := optionFloat(o.Value)
+		if !ok {
+			log.WithField("option", name).Warn("Maintenance counter is no numeric option")
+			continue
+		}
+
+		c := maintenanceCounter{
+			Option:    name,
+			Title:     o.Title,
+			Value:     value,
+			Threshold: maintenance.thresholds[name],
+		}
+		c.ReplacementDue = c.Threshold > 0 && c.Value >= c.Threshold
+		status.Counters = append(status.Counters, c)
+	}
+
+	maintenance.update(status.Counters)
+	status.Reminders = dutyCycle.Reminders()
+	status.Power = scannerPower.Status()
+	status.Update = updates.Status()
+	return status, nil
+}
+
+// update keeps the counters for the metrics and logs a warning when a
+// counter reaches its threshold, once until it is reset
+func (m *maintenanceState) update(counters []maintenanceCounter) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.last = counters
+	for _, c := range counters {
+		if c.ReplacementDue && !m.warned[c.Option] {
+			log.WithFields(log.Fields{
+				"option":    c.Option,
+				"value":     c.Value,
+				"threshold": c.Threshold,
+			}).Warn("Maintenance counter reached its threshold, replace the consumable and reset the counter")
+		}
+		m.warned[c.Option] = c.ReplacementDue
+	}
+}
+
+// checkMaintenance reads the counters after a scan changed them, it
+// waits for the scan to release the device
+func checkMaintenance() {
+	describer, ok := scanBackend.(scanner.DeviceDescriber)
+	if !ok || len(maintenance.order) == 0 {
+		return
+	}
+
+	go func() {
+		if _, err := readScannerStatus(describer); err != nil {
+			log.WithError(err).Debug("Unable to read maintenance counters")
+		}
+	}()
+}
+
+// writeMaintenanceMetrics appends the last read counters to the metrics
+func writeMaintenanceMetrics(w io.Writer) {
+	maintenance.lock.Lock()
+	counters := append([]maintenanceCounter{}, maintenance.last...)
+	maintenance.lock.Unlock()
+
+	if len(counters) == 0 {
+		return
+	}
+	sort.Slice(counters, func(i, j int) bool { return counters[i].Option < counters[j].Option })
+
+	fmt.Fprint(w, "# HELP scansnap_maintenance_counter Value of the maintenance counters read from the scanner\n# TYPE scansnap_maintenance_counter gauge\n")
+	for _, c := range counters {
+		fmt.Fprintf(w, "scansnap_maintenance_counter{option=%q} %v\n", c.Option, c.Value)
+	}
+
+	fmt.Fprint(w, "# HELP scansnap_maintenance_threshold Value the consumable should be replaced at\n# TYPE scansnap_maintenance_threshold gauge\n")
+	for _, c := range counters {
+		if c.Threshold > 0 {
+			fmt.Fprintf(w, "scansnap_maintenance_threshold{option=%q} %v\n", c.Option, c.Threshold)
+		}
+	}
+}
+
+func handleScannerStatus(res http.ResponseWriter, r *http.Request) {
+	describer, ok := scanBackend.(scanner.DeviceDescriber)
+	if !ok {
+		writeError(res, http.StatusNotFound, errCodeDisabled, "The scanner is not able to describe its options")
+		return
+	}
+
+	status, err := readScannerStatus(describer)
+	if err != nil {
+		log.WithError(err).Error("Unable to read scanner status")
+		writeScanError(res, "", err)
+		return
+	}
+
+	writeJSON(res, http.StatusOK, status)
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Minimal mDNS responder (RFC 6762 / 6763) advertising DNS-SD services
+// of this host, answering queries for the service types, instances and
+// the host name
+
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+
+	dnsClassIN = 1
+	// Set on unique records in responses, on questions it requests a
+	// unicast response
+	dnsClassFlag = 0x8000
+
+	mdnsHostTTL    = 120
+	mdnsServiceTTL = 4500
+
+	mdnsServicesName = "_services._dns-sd._udp.local."
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsService is a service instance announced using DNS-SD
+type mdnsService struct {
+	// Instance is the user visible name, e.g. "scansnap-go (host)"
+	Instance string
+	// Type is the service type, e.g. "_http._tcp"
+	Type string
+	Port int
+	TXT  []string
+}
+
+func (m mdnsService) typeName() string     { return m.Type + ".local." }
+func (m mdnsService) instanceName() string { return m.Instance + "." + m.typeName() }
+
+// startMDNSResponder announces the enabled services in the background
+func startMDNSResponder() error {
+	port, err := listenPort(cfg.Listen)
+	if err != nil {
+		return err
+	}
+
+	instance := serviceInstanceName()
+
+	var services []mdnsService
+	if cfg.MDNS {
+		services = append(services, httpMDNSService(instance, port))
+	}
+	if cfg.ESCL {
+		services = append(services, esclMDNSService(instance, port))
+	}
+
+	m, err := newMDNSResponder(services)
+	if err != nil {
+		return err
+	}
+
+	log.WithField("instance", instance).Info("Announcing services using mDNS")
+	go m.Run()
+	return nil
+}
+
+// serviceInstanceName returns the name the scanner is announced with
+// by the discovery protocols
+func serviceInstanceName() string {
+	instance := cfg.MDNSName
+	if instance == "" {
+		host, _ := os.Hostname()
+		instance = fmt.Sprintf("scansnap-go (%s)", strings.SplitN(host, ".", 2)[0])
+	}
+	// Instance names are a single DNS label
+	instance = strings.ReplaceAll(instance, ".", " ")
+	if len(instance) > 63 {
+		instance = instance[:63]
+	}
+	return instance
+}
+
+// httpMDNSService announces the HTTP API, the TXT record points to the
+// scan endpoint and the API description
+func httpMDNSService(instance string, port int) mdnsService {
+	service := "_http._tcp"
+	if cfg.TLSCert != "" {
+		service = "_https._tcp"
+	}
+
+	return mdnsService{
+		Instance: instance,
+		Type:     service,
+		Port:     port,
+		TXT: []string{
+			"path=/scan.pdf",
+			"api=/openapi.json",
+			"version=" + version,
+		},
+	}
+}
+
+type mdnsResponder struct {
+	host     string
+	services []mdnsService
+	conn     *net.UDPConn
+}
+
+func newMDNSResponder(services []mdnsService) (*mdnsResponder, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get hostname: %s", err)
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen for mDNS queries: %s", err)
+	}
+
+	return &mdnsResponder{
+		host:     strings.SplitN(host, ".", 2)[0] + ".local.",
+		services: services,
+		conn:     conn,
+	}, nil
+}
+
+// Run announces the services and answers queries until the connection
+// fails
+func (m *mdnsResponder) Run() {
+	go func() {
+		// Announce twice as required by RFC 6762 section 8.3
+		for i := 0; i < 2; i++ {
+			m.send(mdnsGroup, 0, nil, m.allRecords())
+			time.Sleep(time.Second)
+		}
+	}()
+
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.WithError(err).Error("mDNS responder stopped")
+			return
+		}
+		if !networkAllowed(allowedNetworks, src.IP) {
+			continue
+		}
+
+		id, questions, err := parseDNSQuery(buf[:n])
+		if err != nil {
+			log.WithError(err).WithField("remote", src).Debug("Ignoring invalid mDNS packet")
+			continue
+		}
+
+		var answers [][]byte
+		for _, q := range questions {
+			answers = append(answers, m.answer(q)...)
+		}
+		if len(answers) == 0 {
+			continue
+		}
+
+		if src.Port != mdnsGroup.Port {
+			// Legacy unicast query (RFC 6762 section 6.7) expecting a
+			// regular DNS response
+			m.send(src, id, questions, answers)
+			continue
+		}
+		m.send(mdnsGroup, 0, nil, answers)
+	}
+}
+
+// answer returns the records answering the question
+func (m *mdnsResponder) answer(q dnsQuestion) [][]byte {
+	var records [][]byte
+	matches := func(name string, qtype uint16) bool {
+		return strings.EqualFold(q.Name, name) && (q.Type == qtype || q.Type == dnsTypeANY)
+	}
+
+	for _, s := range m.services {
+		if matches(mdnsServicesName, dnsTypePTR) {
+			records = append(records, dnsPTR(mdnsServicesName, s.typeName()))
+		}
+		if matches(s.typeName(), dnsTypePTR) {
+			records = append(records, dnsPTR(s.typeName(), s.instanceName()))
+			records = append(records, m.serviceRecords(s)...)
+		}
+		if matches(s.instanceName(), dnsTypeSRV) || matches(s.instanceName(), dnsTypeTXT) {
+			records = append(records, m.serviceRecords(s)...)
+		}
+	}
+
+	if matches(m.host, dnsTypeA) {
+		records = append(records, m.hostRecords()...)
+	}
+
+	return records
+}
+
+func (m *mdnsResponder) serviceRecords(s mdnsService) [][]byte {
+	return append([][]byte{
+		dnsSRV(s.instanceName(), m.host, s.Port),
+		dnsTXT(s.instanceName(), s.TXT),
+	}, m.hostRecords()...)
+}
+
+// hostRecords returns A records for the IPv4 addresses of all
+// interfaces
+func (m *mdnsResponder) hostRecords() [][]byte {
+	var records [][]byte
+	for _, ip := range localIPv4Addrs() {
+		records = append(records, dnsA(m.host, ip))
+	}
+	return records
+}
+
+func (m *mdnsResponder) allRecords() [][]byte {
+	var records [][]byte
+	for _, s := range m.services {
+		records = append(records, dnsPTR(s.typeName(), s.instanceName()))
+		records = append(records, m.serviceRecords(s)...)
+	}
+	return records
+}
+
+func (m *mdnsResponder) send(to *net.UDPAddr, id uint16, questions []dnsQuestion, records [][]byte) {
+	// Responses are authoritative answers
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = binary.BigEndian.AppendUint16(msg, 0x8400)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(questions)))
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(records)))
+	msg = binary.BigEndian.AppendUint32(msg, 0)
+
+	for _, q := range questions {
+		msg = append(msg, dnsName(q.Name)...)
+		msg = binary.BigEndian.AppendUint16(msg, q.Type)
+		msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	}
+	for _, r := range records {
+		msg = append(msg, r...)
+	}
+
+	if _, err := m.conn.WriteToUDP(msg, to); err != nil {
+		log.WithError(err).WithField("remote", to).Debug("Unable to send mDNS response")
+	}
+}
+
+type dnsQuestion struct {
+	Name string
+	Type uint16
+}
+
+// parseDNSQuery returns the questions of a query, responses sent by
+// other hosts are ignored
+func parseDNSQuery(msg []byte) (id uint16, questions []dnsQuestion, err error) {
+	if len(msg) < 12 {
+		return 0, nil, fmt.Errorf("Packet too short")
+	}
+
+	id = binary.BigEndian.Uint16(msg)
+	if binary.BigEndian.Uint16(msg[2:])&0x8000 != 0 {
+		return id, nil, nil
+	}
+
+	off := 12
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:])); i++ {
+		var name string
+		if name, off, err = parseDNSName(msg, off); err != nil {
+			return id, nil, err
+		}
+		if off+4 > len(msg) {
+			return id, nil, fmt.Errorf("Truncated question")
+		}
+
+		questions = append(questions, dnsQuestion{Name: name, Type: binary.BigEndian.Uint16(msg[off:])})
+		off += 4
+	}
+
+	return id, questions, nil
+}
+
+// parseDNSName reads the possibly compressed name at off and returns
+// the offset behind it
+func parseDNSName(msg []byte, off int) (string, int, error) {
+	var (
+		labels []string
+		end    = -1
+	)
+
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, fmt.Errorf("Truncated name")
+		}
+
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, fmt.Errorf("Invalid name compression")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, fmt.Errorf("Truncated label")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// dnsName encodes the name without compression
+func dnsName(name string) []byte {
+	var b []byte
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+func dnsRecord(name string, rtype uint16, unique bool, ttl uint32, data []byte) []byte {
+	class := uint16(dnsClassIN)
+	if unique {
+		class |= dnsClassFlag
+	}
+
+	r := dnsName(name)
+	r = binary.BigEndian.AppendUint16(r, rtype)
+	r = binary.BigEndian.AppendUint16(r, class)
+	r = binary.BigEndian.AppendUint32(r, ttl)
+	r = binary.BigEndian.AppendUint16(r, uint16(len(data)))
+	return append(r, data...)
+}
+
+func dnsA(name string, ip net.IP) []byte {
+	return dnsRecord(name, dnsTypeA, true, mdnsHostTTL, ip)
+}
+
+func dnsPTR(name, target string) []byte {
+	return dnsRecord(name, dnsTypePTR, false, mdnsServiceTTL, dnsName(target))
+}
+
+func dnsSRV(name, target string, port int) []byte {
+	// Priority and weight are not used by DNS-SD
+	data := binary.BigEndian.AppendUint32(nil, 0)
+	data = binary.BigEndian.AppendUint16(data, uint16(port))
+	return dnsRecord(name, dnsTypeSRV, true, mdnsHostTTL, append(data, dnsName(target)...))
+}
+
+func dnsTXT(name string, entries []string) []byte {
+	var data []byte
+	for _, e := range entries {
+		data = append(data, byte(len(e)))
+		data = append(data, e...)
+	}
+	if len(data) == 0 {
+		// TXT records must contain at least one string
+		data = []byte{0}
+	}
+	return dnsRecord(name, dnsTypeTXT, true, mdnsServiceTTL, data)
+}
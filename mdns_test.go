@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// dnsTestRecord is a decoded resource record
+type dnsTestRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+func parseDNSTestRecord(t *testing.T, r []byte) dnsTestRecord {
+	t.Helper()
+
+	name, off, err := parseDNSName(r, 0)
+	if err != nil {
+		t.Fatalf("parsing record name: %s", err)
+	}
+	if len(r) < off+10 {
+		t.Fatalf("record too short: %x", r)
+	}
+
+	rec := dnsTestRecord{
+		Name:  name,
+		Type:  binary.BigEndian.Uint16(r[off:]),
+		Class: binary.BigEndian.Uint16(r[off+2:]),
+		TTL:   binary.BigEndian.Uint32(r[off+4:]),
+		Data:  r[off+10:],
+	}
+	if n := int(binary.BigEndian.Uint16(r[off+8:])); n != len(rec.Data) {
+		t.Fatalf("record %s announces %d bytes of data, has %d", name, n, len(rec.Data))
+	}
+	return rec
+}
+
+func TestParseDNSQuery(t *testing.T) {
+	header := func(flags, questions uint16) []byte {
+		return []byte{0x12, 0x34, byte(flags >> 8), byte(flags), byte(questions >> 8), byte(questions), 0, 0, 0, 0, 0, 0}
+	}
+	question := func(name []byte, qtype uint16) []byte {
+		return append(name, byte(qtype>>8), byte(qtype), 0x80, dnsClassIN)
+	}
+
+	for name, tc := range map[string]struct {
+		msg       []byte
+		questions []dnsQuestion
+		valid     bool
+	}{
+		"single question": {
+			append(header(0, 1), question(dnsName("_uscan._tcp.local."), dnsTypePTR)...),
+			[]dnsQuestion{{"_uscan._tcp.local.", dnsTypePTR}},
+			true,
+		},
+		"compressed names": {
+			// The second name points to "local." of the first one
+			append(append(header(0, 2), question(dnsName("scanner.local."), dnsTypeA)...), question([]byte{4, '_', 'h', 't', 't', 0xc0, 20}, dnsTypeANY)...),
+			[]dnsQuestion{{"scanner.local.", dnsTypeA}, {"_htt.local.", dnsTypeANY}},
+			true,
+		},
+		"response": {
+			append(header(0x8400, 1), question(dnsName("scanner.local."), dnsTypeA)...),
+			nil,
+			true,
+		},
+		"short packet":       {[]byte{0x12, 0x34, 0}, nil, false},
+		"truncated question": {append(header(0, 1), dnsName("scanner.local.")...), nil, false},
+		"truncated label":    {append(header(0, 1), 7, 's', 'c'), nil, false},
+		"compression loop":   {append(header(0, 1), 0xc0, 12), nil, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			id, questions, err := parseDNSQuery(tc.msg)
+			if (err == nil) != tc.valid {
+				t.Fatalf("expected valid=%v, got %v", tc.valid, err)
+			}
+			if tc.valid && id != 0x1234 {
+				t.Errorf("expected ID 0x1234, got %#x", id)
+			}
+			if !reflect.DeepEqual(questions, tc.questions) {
+				t.Errorf("expected questions %v, got %v", tc.questions, questions)
+			}
+		})
+	}
+}
+
+func TestDNSRecords(t *testing.T) {
+	if exp := []byte{7, 's', 'c', 'a', 'n', 'n', 'e', 'r', 5, 'l', 'o', 'c', 'a', 'l', 0}; !bytes.Equal(dnsName("scanner.local."), exp) {
+		t.Errorf("expected name %x, got %x", exp, dnsName("scanner.local."))
+	}
+
+	srv := parseDNSTestRecord(t, dnsSRV("Scanner._uscan._tcp.local.", "host.local.", 3000))
+	if srv.Type != dnsTypeSRV || srv.Class != dnsClassIN|dnsClassFlag || srv.TTL != mdnsHostTTL {
+		t.Errorf("unexpected SRV record %+v", srv)
+	}
+	if port := binary.BigEndian.Uint16(srv.Data[4:]); port != 3000 {
+		t.Errorf("expected port 3000, got %d", port)
+	}
+	if target, _, err := parseDNSName(srv.Data, 6); err != nil || target != "host.local." {
+		t.Errorf("expected target host.local., got %q (%v)", target, err)
+	}
+
+	ptr := parseDNSTestRecord(t, dnsPTR("_uscan._tcp.local.", "Scanner._uscan._tcp.local."))
+	if ptr.Type != dnsTypePTR || ptr.Class != dnsClassIN || ptr.TTL != mdnsServiceTTL {
+		t.Errorf("unexpected PTR record %+v", ptr)
+	}
+
+	txt := parseDNSTestRecord(t, dnsTXT("Scanner._uscan._tcp.local.", []string{"rs=eSCL", "txtvers=1"}))
+	if exp := append([]byte{7}, "rs=eSCL\x09txtvers=1"...); txt.Type != dnsTypeTXT || !bytes.Equal(txt.Data, exp) {
+		t.Errorf("expected TXT data %q, got %q", exp, txt.Data)
+	}
+	if empty := parseDNSTestRecord(t, dnsTXT("Scanner._uscan._tcp.local.", nil)); !bytes.Equal(empty.Data, []byte{0}) {
+		t.Errorf("expected an empty string in the empty TXT record, got %x", empty.Data)
+	}
+
+	a := parseDNSTestRecord(t, dnsA("host.local.", []byte{192, 168, 1, 10}))
+	if a.Type != dnsTypeA || !bytes.Equal(a.Data, []byte{192, 168, 1, 10}) {
+		t.Errorf("unexpected A record %+v", a)
+	}
+}
+
+func TestMDNSAnswer(t *testing.T) {
+	m := &mdnsResponder{
+		host:     "host.local.",
+		services: []mdnsService{{Instance: "Scanner", Type: "_uscan._tcp", Port: 3000, TXT: []string{"rs=eSCL"}}},
+	}
+	hosts := len(localIPv4Addrs())
+
+	type answer struct {
+		Name string
+		Type uint16
+	}
+	service := []answer{{"Scanner._uscan._tcp.local.", dnsTypeSRV}, {"Scanner._uscan._tcp.local.", dnsTypeTXT}}
+
+	for name, tc := range map[string]struct {
+		question dnsQuestion
+		exp      []answer
+		hosts    int
+	}{
+		"service types":    {dnsQuestion{mdnsServicesName, dnsTypePTR}, []answer{{mdnsServicesName, dnsTypePTR}}, 0},
+		"service type":     {dnsQuestion{"_uscan._tcp.local.", dnsTypePTR}, append([]answer{{"_uscan._tcp.local.", dnsTypePTR}}, service...), hosts},
+		"instance":         {dnsQuestion{"scanner._USCAN._tcp.local.", dnsTypeSRV}, service, hosts},
+		"instance any":     {dnsQuestion{"Scanner._uscan._tcp.local.", dnsTypeANY}, service, hosts},
+		"host":             {dnsQuestion{"host.local.", dnsTypeA}, nil, hosts},
+		"other service":    {dnsQuestion{"_ipp._tcp.local.", dnsTypePTR}, nil, 0},
+		"unsupported type": {dnsQuestion{"host.local.", dnsTypeTXT}, nil, 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var got []answer
+			for _, r := range m.answer(tc.question) {
+				rec := parseDNSTestRecord(t, r)
+				got = append(got, answer{rec.Name, rec.Type})
+			}
+
+			exp := tc.exp
+			for i := 0; i < tc.hosts; i++ {
+				exp = append(exp, answer{"host.local.", dnsTypeA})
+			}
+			if !reflect.DeepEqual(got, exp) {
+				t.Errorf("expected %v, got %v", exp, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Minimal MQTT 3.1.1 client publishing and subscribing with QoS 0,
+// reconnecting in the background whenever the connection to the broker
+// is lost
+
+const (
+	mqttPacketConnect   = 0x10
+	mqttPacketConnack   = 0x20
+	mqttPacketPublish   = 0x30
+	mqttPacketSubscribe = 0x82 // includes the mandatory reserved flags
+	mqttPacketPingreq   = 0xc0
+
+	mqttKeepAlive = 30 * time.Second
+)
+
+type mqttMessage struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+type mqttClient struct {
+	broker   *url.URL
+	clientID string
+	user     string
+	password string
+	// will is published by the broker when the connection is lost
+	will *mqttMessage
+	// onConnect is called after every (re)connect
+	onConnect func()
+
+	lock     sync.Mutex
+	conn     net.Conn
+	handlers map[string]func(mqttMessage)
+	packetID uint16
+}
+
+func newMQTTClient(broker, clientID, user, password string) (*mqttClient, error) {
+	u, err := url.Parse(broker)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("Invalid MQTT broker %q, expected e.g. tcp://localhost:1883", broker)
+	}
+
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "mqtts", "tls":
+	default:
+		return nil, fmt.Errorf("Unsupported MQTT broker scheme %q (supported: tcp, mqtts)", u.Scheme)
+	}
+
+	if password != "" && user == "" {
+		// MQTT 3.1.1 section 3.1.2.9 does not allow a password without
+		// user name, brokers close the connection
+		return nil, fmt.Errorf("A MQTT password requires a user name (--mqtt-user)")
+	}
+
+	return &mqttClient{broker: u, clientID: clientID, user: user, password: password}, nil
+}
+
+// Run keeps the connection to the broker alive, it does not return
+func (m *mqttClient) Run() {
+	backoff := time.Second
+	for {
+		conn, err := m.connect()
+		if err != nil {
+			log.WithError(err).WithField("retry_in", backoff).Warn("Unable to connect to MQTT broker")
+			time.Sleep(backoff)
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+
+		log.WithField("broker", m.broker.Host).Info("Connected to MQTT broker")
+		m.lock.Lock()
+		m.conn = conn
+		topics := make([]string, 0, len(m.handlers))
+		for topic := range m.handlers {
+			topics = append(topics, topic)
+		}
+		m.lock.Unlock()
+
+		// Subscriptions do not survive the clean session
+		for _, topic := range topics {
+			if err := m.subscribe(conn, topic); err != nil {
+				log.WithError(err).WithField("topic", topic).Error("Unable to subscribe MQTT topic")
+			}
+		}
+
+		if m.onConnect != nil {
+			m.onConnect()
+		}
+
+		err = m.serve(conn)
+
+		m.lock.Lock()
+		m.conn = nil
+		m.lock.Unlock()
+		conn.Close()
+
+		log.WithError(err).Warn("Lost connection to MQTT broker")
+	}
+}
+
+func (m *mqttClient) connect() (net.Conn, error) {
+	host := m.broker.Host
+	if m.broker.Port() == "" {
+		host = net.JoinHostPort(host, "1883")
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	switch m.broker.Scheme {
+	case "ssl", "mqtts", "tls":
+		if m.broker.Port() == "" {
+			host = net.JoinHostPort(m.broker.Hostname(), "8883")
+		}
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", host, &tls.Config{ServerName: m.broker.Hostname()})
+	default:
+		conn, err = net.DialTimeout("tcp", host, 10*time.Second)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(m.connectPacket()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to send CONNECT: %s", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	typ, body, err := readMQTTPacket(bufio.NewReader(conn))
+	conn.SetReadDeadline(time.Time{})
+	switch {
+	case err != nil:
+		conn.Close()
+		return nil, fmt.Errorf("Unable to read CONNACK: %s", err)
+	case typ != mqttPacketConnack || len(body) != 2:
+		conn.Close()
+		return nil, fmt.Errorf("Unexpected packet 0x%02x instead of CONNACK", typ)
+	case body[1] != 0:
+		conn.Close()
+		return nil, fmt.Errorf("Broker refused connection (return code %d)", body[1])
+	}
+
+	return conn, nil
+}
+
+func (m *mqttClient) connectPacket() []byte {
+	var (
+		flags   byte = 0x02 // clean session
+		payload      = new(bytes.Buffer)
+	)
+
+	writeMQTTString(payload, m.clientID)
+	if m.will != nil {
+		flags |= 0x04
+		if m.will.Retain {
+			flags |= 0x20
+		}
+		writeMQTTString(payload, m.will.Topic)
+		writeMQTTBytes(payload, m.will.Payload)
+	}
+	if m.user != "" {
+		flags |= 0x80
+		writeMQTTString(payload, m.user)
+
+		if m.password != "" {
+			flags |= 0x40
+			writeMQTTString(payload, m.password)
+		}
+	}
+
+	body := new(bytes.Buffer)
+	writeMQTTString(body, "MQTT")
+	body.WriteByte(4) // protocol level 3.1.1
+	body.WriteByte(flags)
+	binary.Write(body, binary.BigEndian, uint16(mqttKeepAlive/time.Second))
+	body.Write(payload.Bytes())
+
+	return mqttPacket(mqttPacketConnect, body.Bytes())
+}
+
+// serve reads packets from the broker and sends keep-alive pings until
+// the connection fails
+func (m *mqttClient) serve(conn net.Conn) error {
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		t := time.NewTicker(mqttKeepAlive / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if err := m.write(conn, mqttPacket(mqttPacketPingreq, nil)); err != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * mqttKeepAlive))
+		typ, body, err := readMQTTPacket(r)
+		if err != nil {
+			return err
+		}
+
+		if typ&0xf0 == mqttPacketPublish {
+			m.dispatch(typ, body)
+		}
+	}
+}
+
+// dispatch passes a received message to the handler of its topic
+func (m *mqttClient) dispatch(typ byte, body []byte) {
+	if len(body) < 2 {
+		return
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return
+	}
+	msg := mqttMessage{Topic: string(body[2 : 2+n]), Payload: body[2+n:], Retain: typ&0x01 != 0}
+	if typ&0x06 != 0 {
+		// QoS > 0 carries a packet identifier. We only subscribe with
+		// QoS 0 so the broker should never send these.
+		if len(msg.Payload) < 2 {
+			return
+		}
+		msg.Payload = msg.Payload[2:]
+	}
+
+	m.lock.Lock()
+	handler := m.handlers[msg.Topic]
+	m.lock.Unlock()
+
+	if handler != nil {
+		// Handlers may take a while and must not block the keep-alive
+		go handler(msg)
+	}
+}
+
+// Subscribe registers a handler for messages to the topic (no
+// wildcards). The subscription is renewed on every reconnect.
+func (m *mqttClient) Subscribe(topic string, handler func(mqttMessage)) error {
+	m.lock.Lock()
+	if m.handlers == nil {
+		m.handlers = map[string]func(mqttMessage){}
+	}
+	m.handlers[topic] = handler
+	conn := m.conn
+	m.lock.Unlock()
+
+	if conn == nil {
+		// Subscribed as soon as the connection is established
+		return nil
+	}
+
+	return m.subscribe(conn, topic)
+}
+
+func (m *mqttClient) subscribe(conn net.Conn, topic string) error {
+	m.lock.Lock()
+	m.packetID++
+	if m.packetID == 0 {
+		m.packetID = 1
+	}
+	id := m.packetID
+	m.lock.Unlock()
+
+	body := new(bytes.Buffer)
+	binary.Write(body, binary.BigEndian, id)
+	writeMQTTString(body, topic)
+	body.WriteByte(0) // QoS 0
+
+	// The SUBACK is ignored by the read loop: QoS 0 is always granted
+	if err := m.write(conn, mqttPacket(mqttPacketSubscribe, body.Bytes())); err != nil {
+		conn.Close()
+		return fmt.Errorf("Unable to subscribe: %s", err)
+	}
+	return nil
+}
+
+func (m *mqttClient) write(conn net.Conn, packet []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := conn.Write(packet)
+	return err
+}
+
+// Publish sends the message with QoS 0. Messages are dropped while the
+// connection to the broker is down.
+func (m *mqttClient) Publish(msg mqttMessage) error {
+	m.lock.Lock()
+	conn := m.conn
+	m.lock.Unlock()
+
+	if conn == nil {
+		return fmt.Errorf("Not connected to MQTT broker")
+	}
+
+	body := new(bytes.Buffer)
+	writeMQTTString(body, msg.Topic)
+	body.Write(msg.Payload)
+
+	var flags byte
+	if msg.Retain {
+		flags = 0x01
+	}
+
+	if err := m.write(conn, mqttPacket(mqttPacketPublish|flags, body.Bytes())); err != nil {
+		conn.Close()
+		return fmt.Errorf("Unable to publish: %s", err)
+	}
+	return nil
+}
+
+func mqttPacket(typ byte, body []byte) []byte {
+	buf := []byte{typ}
+
+	// Remaining length as variable byte integer
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if n == 0 {
+			break
+		}
+	}
+
+	return append(buf, body...)
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var length, shift uint
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= uint(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+
+	return typ, body, nil
+}
+
+func writeMQTTString(buf *bytes.Buffer, s string) {
+	writeMQTTBytes(buf, []byte(s))
+}
+
+func writeMQTTBytes(buf *bytes.Buffer, b []byte) {
+	binary.Write(buf, binary.BigEndian, uint16(len(b)))
+	buf.Write(b)
+}
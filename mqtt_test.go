@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewMQTTClient(t *testing.T) {
+	for name, tc := range map[string]struct {
+		broker, user, password string
+		valid                  bool
+	}{
+		"anonymous":             {"tcp://localhost:1883", "", "", true},
+		"credentials":           {"mqtts://broker:8883", "scanner", "secret", true},
+		"user only":             {"tcp://localhost", "scanner", "", true},
+		"password without user": {"tcp://localhost:1883", "", "secret", false},
+		"missing host":          {"localhost:1883", "", "", false},
+		"unsupported scheme":    {"ws://localhost:9001", "", "", false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := newMQTTClient(tc.broker, "scansnap-go-test", tc.user, tc.password)
+			if (err == nil) != tc.valid {
+				t.Errorf("expected valid=%v, got %v", tc.valid, err)
+			}
+		})
+	}
+}
+
+func TestMQTTConnectPacket(t *testing.T) {
+	header := []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04}
+	keepAlive := []byte{0x00, 0x1e}
+
+	for name, tc := range map[string]struct {
+		client  *mqttClient
+		flags   byte
+		payload []byte
+	}{
+		"anonymous": {
+			&mqttClient{clientID: "cid"},
+			0x02,
+			[]byte{0x00, 0x03, 'c', 'i', 'd'},
+		},
+		"user and password": {
+			&mqttClient{clientID: "cid", user: "u", password: "p"},
+			0xc2,
+			[]byte{0x00, 0x03, 'c', 'i', 'd', 0x00, 0x01, 'u', 0x00, 0x01, 'p'},
+		},
+		"password without user": {
+			&mqttClient{clientID: "cid", password: "p"},
+			0x02,
+			[]byte{0x00, 0x03, 'c', 'i', 'd'},
+		},
+		"retained will": {
+			&mqttClient{clientID: "cid", will: &mqttMessage{Topic: "s/status", Payload: []byte("offline"), Retain: true}},
+			0x26,
+			[]byte{0x00, 0x03, 'c', 'i', 'd', 0x00, 0x08, 's', '/', 's', 't', 'a', 't', 'u', 's', 0x00, 0x07, 'o', 'f', 'f', 'l', 'i', 'n', 'e'},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			body := append(append(append(append([]byte{}, header...), tc.flags), keepAlive...), tc.payload...)
+			exp := append([]byte{mqttPacketConnect, byte(len(body))}, body...)
+
+			if got := tc.client.connectPacket(); !bytes.Equal(got, exp) {
+				t.Errorf("expected\n%x\ngot\n%x", exp, got)
+			}
+		})
+	}
+}
+
+func TestMQTTPacketLength(t *testing.T) {
+	// Remaining length uses one byte per 7 bits
+	for n, lengthBytes := range map[int]int{0: 1, 127: 1, 128: 2, 16383: 2, 16384: 3, 2097151: 3, 2097152: 4} {
+		body := bytes.Repeat([]byte{0xa5}, n)
+
+		packet := mqttPacket(mqttPacketPublish, body)
+		if got := len(packet) - 1 - n; got != lengthBytes {
+			t.Errorf("length %d: expected %d length bytes, got %d", n, lengthBytes, got)
+		}
+
+		typ, got, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(packet)))
+		if err != nil {
+			t.Fatalf("length %d: reading packet: %s", n, err)
+		}
+		if typ != mqttPacketPublish || !bytes.Equal(got, body) {
+			t.Errorf("length %d: expected the packet to round trip, got type 0x%02x and %d bytes", n, typ, len(got))
+		}
+	}
+
+	if _, _, err := readMQTTPacket(bufio.NewReader(bytes.NewReader([]byte{mqttPacketPublish, 0x05, 0x00}))); err == nil {
+		t.Errorf("expected an error for a truncated packet")
+	}
+}
+
+func TestMQTTDispatch(t *testing.T) {
+	received := make(chan mqttMessage, 1)
+	m := &mqttClient{handlers: map[string]func(mqttMessage){"s/scan": func(msg mqttMessage) { received <- msg }}}
+
+	for name, tc := range map[string]struct {
+		typ  byte
+		body []byte
+		exp  *mqttMessage
+	}{
+		"qos 0":           {mqttPacketPublish, []byte{0x00, 0x06, 's', '/', 's', 'c', 'a', 'n', 'g', 'o'}, &mqttMessage{Topic: "s/scan", Payload: []byte("go")}},
+		"retained":        {mqttPacketPublish | 0x01, []byte{0x00, 0x06, 's', '/', 's', 'c', 'a', 'n'}, &mqttMessage{Topic: "s/scan", Payload: []byte{}, Retain: true}},
+		"qos 1":           {mqttPacketPublish | 0x02, []byte{0x00, 0x06, 's', '/', 's', 'c', 'a', 'n', 0x00, 0x01, 'g', 'o'}, &mqttMessage{Topic: "s/scan", Payload: []byte("go")}},
+		"other topic":     {mqttPacketPublish, []byte{0x00, 0x06, 's', '/', 'i', 'n', 'f', 'o', 'g', 'o'}, nil},
+		"truncated topic": {mqttPacketPublish, []byte{0x00, 0x06, 's', '/'}, nil},
+		"empty":           {mqttPacketPublish, nil, nil},
+	} {
+		t.Run(name, func(t *testing.T) {
+			m.dispatch(tc.typ, tc.body)
+
+			select {
+			case msg := <-received:
+				if tc.exp == nil || !reflect.DeepEqual(msg, *tc.exp) {
+					t.Errorf("expected %+v, got %+v", tc.exp, msg)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tc.exp != nil {
+					t.Errorf("expected %+v to be dispatched", *tc.exp)
+				}
+			}
+		})
+	}
+}
+
+func TestMQTTConnect(t *testing.T) {
+	for name, tc := range map[string]struct {
+		connack []byte
+		valid   bool
+	}{
+		"accepted":        {[]byte{mqttPacketConnack, 0x02, 0x00, 0x00}, true},
+		"not authorized":  {[]byte{mqttPacketConnack, 0x02, 0x00, 0x05}, false},
+		"wrong packet":    {[]byte{mqttPacketPublish, 0x02, 0x00, 0x00}, false},
+		"closed early":    {nil, false},
+		"invalid connack": {[]byte{mqttPacketConnack, 0x01, 0x00}, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listening: %s", err)
+			}
+			defer l.Close()
+
+			connect := make(chan []byte, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				_, body, _ := readMQTTPacket(bufio.NewReader(conn))
+				connect <- body
+				conn.Write(tc.connack)
+			}()
+
+			m, err := newMQTTClient("tcp://"+l.Addr().String(), "cid", "u", "p")
+			if err != nil {
+				t.Fatalf("creating client: %s", err)
+			}
+
+			conn, err := m.connect()
+			if conn != nil {
+				conn.Close()
+			}
+			if (err == nil) != tc.valid {
+				t.Errorf("expected valid=%v, got %v", tc.valid, err)
+			}
+			if body := <-connect; !bytes.Equal(mqttPacket(mqttPacketConnect, body), m.connectPacket()) {
+				t.Errorf("broker received unexpected CONNECT %x", body)
+			}
+		})
+	}
+}
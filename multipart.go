@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+)
+
+// wantsMultipart tells whether the client asked for the pages as
+// separate parts of a multipart/mixed response
+func wantsMultipart(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && mt == "multipart/mixed" {
+			return true
+		}
+	}
+	return false
+}
+
+// pageStream writes every processed page as single page PDF into a
+// part of the multipart response while the scan continues
+type pageStream struct {
+	res    http.ResponseWriter
+	params *scanParams
+
+	lock   sync.Mutex
+	parts  *multipart.Writer
+	pages  int
+	failed []string
+}
+
+// Write renders the page and sends it, the response is started with
+// the first page so errors before can still be reported as status
+func (p *pageStream) Write(page *scanner.Page) {
+	buf := new(bytes.Buffer)
+	if err := writePDF(buf, p.params, []*scanner.Page{page}); err != nil {
+		p.params.logger().WithError(err).WithField("page", page.Index+1).Error("Unable to render page, skipping it")
+		p.lock.Lock()
+		p.failed = append(p.failed, strconv.Itoa(page.Index+1))
+		p.lock.Unlock()
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.parts == nil {
+		p.parts = multipart.NewWriter(p.res)
+		p.res.Header().Set("Content-Type", "multipart/mixed; boundary="+p.parts.Boundary())
+		p.res.Header().Set("Cache-Control", "no-cache")
+		p.res.Header().Set("Trailer", "X-Error-Code, X-Scan-Warning, X-Skipped-Pages, X-Generation-Time")
+		p.res.WriteHeader(http.StatusOK)
+	}
+
+	part, err := p.parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"application/pdf"},
+		"Content-Disposition": {contentDisposition(fmt.Sprintf("page-%03d.pdf", page.Index+1))},
+		"X-Page-Number":       {strconv.Itoa(page.Index + 1)},
+	})
+	if err == nil {
+		_, err = part.Write(buf.Bytes())
+	}
+	if err != nil {
+		// The client went away, the scan continues until the feeder is
+		// empty as stopping it would leave sheets half fed
+		p.params.logger().WithError(err).Debug("Unable to stream page")
+		return
+	}
+
+	p.pages++
+	if f, ok := p.res.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// serveMultipartScan streams the pages as separate PDFs while they are
+// scanned. Only the parts are sent: the scan is not stored or delivered
+// to the upload targets.
+func serveMultipartScan(res http.ResponseWriter, r *http.Request, params *scanParams, start time.Time) {
+	q := r.URL.Query()
+	if params.Cover || params.Stream || params.MaxSize > 0 || params.Photo || params.Card || params.Receipt || params.PageNumbers || params.SplitEvery > 0 || params.DuplexSplit || params.Existing != nil || len(params.Pages) > 0 || params.Archive || params.RawFrames || params.ExpectPages > 0 || params.ExpectSheets > 0 || q.Get("resume") != "" || q.Get("session") != "" {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, "Multipart responses can not be combined with cover, stream, max-size, photo, card, receipt, page-numbers, split-every, duplex-split, pages, archive, raw-frames, expect-pages, expect-sheets, merge, resume or session")
+		return
+	}
+
+	if params.DuplicatePages == duplicatePagesDrop {
+		// The pages are sent before the next sheet can be compared
+		params.DuplicatePages = duplicatePagesFlag
+	}
+
+	params.JobID = newID()
+	params.User = requestUser(r)
+	params.RequestID = requestID(r)
+	if id, ok := r.Context().Value(ctxKeyJobID).(string); ok {
+		params.JobID = id
+	}
+	res.Header().Set("X-Job-ID", params.JobID)
+	res.Header().Set("X-Pipeline", params.pipeline().String())
+
+	stream := &pageStream{res: res, params: params}
+	params.OnPage = stream.Write
+
+	pages, skipped, err := scanAndProcessPages(params, 0)
+	if err != nil {
+		_, code := scanErrorStatus(err)
+		params.logger().WithError(err).WithField("pages", len(pages)).Error("Unable to fetch pages")
+		if len(pages) > 0 {
+			recordFailedJob(r, params, len(pages), err)
+		}
+		publishEvent(scanEvent{Event: "failed", JobID: params.JobID, Pages: len(pages), Profile: params.Profile, User: params.User, Error: err.Error(), ErrorCode: code})
+	}
+
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	if stream.parts == nil {
+		// Nothing was sent yet
+		switch {
+		case err != nil:
+			writeScanError(res, params.JobID, err)
+		case len(skipped) > 0:
+			writeError(res, http.StatusInternalServerError, errCodeInternal, skipped.Error())
+		default:
+			writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to render the pages")
+		}
+		return
+	}
+
+	for _, idx := range skipped.Indices() {
+		stream.failed = append(stream.failed, strconv.Itoa(idx+1))
+	}
+	if len(stream.failed) > 0 {
+		res.Header().Set("X-Skipped-Pages", strings.Join(stream.failed, ","))
+		res.Header().Add("X-Scan-Warning", "Some pages were unable to be processed and are missing")
+	}
+	if params.Meta != nil && len(params.Meta.DuplicatePages) > 0 {
+		res.Header().Add("X-Scan-Warning", "Some pages look like sheets scanned twice, please check the pages")
+	}
+	if err != nil {
+		_, code := partialScanError(err)
+		res.Header().Set("X-Error-Code", code)
+		res.Header().Add("X-Scan-Warning", fmt.Sprintf("Scan failed after %d page(s): %s", len(pages), err))
+	}
+	res.Header().Set("X-Generation-Time", time.Since(start).String())
+
+	if cerr := stream.parts.Close(); cerr != nil {
+		params.logger().WithError(cerr).Debug("Unable to finish multipart response")
+	}
+
+	if err == nil {
+		publishEvent(scanEvent{
+			Event:     "completed",
+			JobID:     params.JobID,
+			Pages:     stream.pages,
+			Documents: stream.pages,
+			Profile:   params.Profile,
+			User:      params.User,
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Representations of the scanned documents, chosen by the Accept header
+const (
+	formatPDF       = "pdf"
+	formatTIFF      = "tiff"
+	formatZIP       = "zip"
+	formatMultipart = "multipart"
+)
+
+// scanFormats are the media types of the representations offered, in
+// the order preferred if the client accepts several equally
+var scanFormats = []struct{ mediaType, format string }{
+	{"application/pdf", formatPDF},
+	{"image/tiff", formatTIFF},
+	{"application/zip", formatZIP},
+	{"multipart/mixed", formatMultipart},
+}
+
+// handleScan serves /scan: JSON scan requests posted are decoded like
+// the query parameters, the representation of the documents is
+// negotiated using the Accept header
+func handleScan(res http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		handleScanJSONRequest(res, r)
+		return
+	}
+
+	start := time.Now()
+
+	params, err := parseScanParams(r)
+	if err != nil {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	serveNegotiatedScan(res, r, params, start)
+}
+
+// serveNegotiatedScan responds with the representation of the scan
+// accepted by the client
+func serveNegotiatedScan(res http.ResponseWriter, r *http.Request, params *scanParams, start time.Time) {
+	res.Header().Add("Vary", "Accept")
+
+	format, ok := negotiateScanFormat(r.Header.Get("Accept"))
+	if !ok {
+		writeError(res, http.StatusNotAcceptable, errCodeNotAcceptable, "None of the accepted media types can be produced (supported: application/pdf, image/tiff, application/zip, multipart/mixed)")
+		return
+	}
+
+	serveScanFormat(res, r, params, format, start)
+}
+
+// serveScanFormat responds with the scan in the representation
+func serveScanFormat(res http.ResponseWriter, r *http.Request, params *scanParams, format string, start time.Time) {
+	params.Format = format
+
+	if err := params.validateFormat(); err != nil {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	switch {
+	case format == formatMultipart:
+		serveMultipartScan(res, r, params, start)
+	case params.Stream:
+		serveStreamedScan(res, r, params, start)
+	default:
+		serveScan(res, r, params, start)
+	}
+}
+
+// negotiateScanFormat picks the representation with the highest quality
+// in the Accept header, false if none is acceptable. Media types listed
+// explicitly win over wildcards, ties are resolved by their position in
+// the header. PDF is sent to clients not sending the header.
+func negotiateScanFormat(accept string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return formatPDF, true
+	}
+
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []mediaRange
+	for _, item := range strings.Split(accept, ",") {
+		mt, mtParams, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := mtParams["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{mt, q})
+	}
+
+	var (
+		best     string
+		bestQ    float64
+		bestRank int
+	)
+	for i, f := range scanFormats {
+		typ := strings.SplitN(f.mediaType, "/", 2)[0]
+
+		// The most specific range matching the media type applies
+		q, rank, specificity := 0.0, 0, 0
+		for j, mr := range ranges {
+			var s int
+			switch mr.mediaType {
+			case f.mediaType:
+				s = 3
+			case typ + "/*":
+				s = 2
+			case "*/*":
+				s = 1
+			default:
+				continue
+			}
+			if s > specificity {
+				q, specificity, rank = mr.q, s, j
+				if s < 3 {
+					// Formats only accepted by wildcards follow the
+					// ones listed in the order preferred
+					rank = len(ranges) + i
+				}
+			}
+		}
+
+		if q > 0 && (best == "" || q > bestQ || (q == bestQ && rank < bestRank)) {
+			best, bestQ, bestRank = f.format, q, rank
+		}
+	}
+
+	return best, best != ""
+}
+
+// validateFormat checks the parameters can be combined with the
+// negotiated representation
+func (s *scanParams) validateFormat() error {
+	if s.Format == formatTIFF && (s.Cover || s.PageNumbers || s.Password != "" || s.PDFA || s.Optimize || s.Existing != nil || s.Stream || s.SplitEvery > 0 || s.DuplexSplit || s.MaxSize > 0 || s.Photo || s.Card || s.Receipt) {
+		return fmt.Errorf("TIFF documents contain the page images only, image/tiff can not be combined with cover, page-numbers, password, pdfa, optimize, merge, stream, split-every, duplex-split, max-size, photo, card or receipt")
+	}
+
+	if s.Stream && s.Format != formatPDF {
+		return fmt.Errorf("Streamed documents are sent as PDF, stream requires accepting application/pdf")
+	}
+
+	return nil
+}
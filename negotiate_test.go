@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Luzifer/scansnap-go/pkg/pdfgen"
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+)
+
+// withFakeScanner executes the scans of the test using a fake scanner
+// feeding the number of pages
+func withFakeScanner(t *testing.T, pages int) {
+	t.Helper()
+
+	backend, fake := scanBackend, cfg.FakeScanner
+	scanBackend, cfg.FakeScanner = &scanner.Fake{Pages: pages}, pages
+	t.Cleanup(func() { scanBackend, cfg.FakeScanner = backend, fake })
+}
+
+// requestScan sends the request to the /scan handler
+func requestScan(method, target, accept string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	res := httptest.NewRecorder()
+	handleScan(res, r)
+	return res
+}
+
+func TestHandleScan(t *testing.T) {
+	withFakeScanner(t, 2)
+
+	res := requestScan(http.MethodGet, "/scan?scan-dpi=75&pdf-dpi=75&color=gray", "")
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	if ct := res.Header().Get("Content-Type"); ct != "application/pdf" {
+		t.Errorf("expected a PDF, got %q", ct)
+	}
+	if res.Header().Get("X-Job-ID") == "" {
+		t.Errorf("job ID is not reported")
+	}
+
+	doc, err := pdfgen.ReadDocument(res.Body.Bytes())
+	if err != nil {
+		t.Fatalf("reading document: %s", err)
+	}
+	if doc.Pages != 2 {
+		t.Errorf("expected 2 pages, got %d", doc.Pages)
+	}
+}
+
+func TestHandleScanNegotiation(t *testing.T) {
+	withFakeScanner(t, 1)
+
+	res := requestScan(http.MethodGet, "/scan?scan-dpi=75&pdf-dpi=75&color=bw", "image/tiff, application/pdf;q=0.5")
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	if ct := res.Header().Get("Content-Type"); ct != "image/tiff" {
+		t.Errorf("expected a TIFF, got %q", ct)
+	}
+	if !bytes.HasPrefix(res.Body.Bytes(), []byte("MM\x00\x2A")) {
+		t.Errorf("response is no TIFF")
+	}
+
+	for name, tc := range map[string]struct {
+		target, accept string
+		status         int
+	}{
+		"unacceptable":       {"/scan", "text/html", http.StatusNotAcceptable},
+		"invalid parameter":  {"/scan?color=sepia", "", http.StatusBadRequest},
+		"invalid resolution": {"/scan?scan-dpi=abc", "", http.StatusBadRequest},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if res := requestScan(http.MethodGet, tc.target, tc.accept); res.Code != tc.status {
+				t.Errorf("expected status %d, got %d: %s", tc.status, res.Code, res.Body)
+			}
+		})
+	}
+}
+
+func TestHandleScanFailure(t *testing.T) {
+	withFakeScanner(t, 1)
+	scanBackend = &scanner.Replay{Dir: t.TempDir()}
+
+	res := requestScan(http.MethodGet, "/scan", "")
+	if res.Code == http.StatusOK {
+		t.Fatalf("expected an error for an empty feeder")
+	}
+	if ct := res.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected a JSON error, got %q", ct)
+	}
+}
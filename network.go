@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// allowedNetworks restricts the API, saned and discovery to clients from
+// these networks (--allow-cidr), all networks are allowed if empty
+var allowedNetworks []*net.IPNet
+
+// parseNetworks parses the CIDR networks given to the flag
+func parseNetworks(flag string, cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range nonEmpty(cidrs) {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network %q in --%s: %s", cidr, flag, err)
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// networkAllowed reports whether the IP is part of the allowed networks
+func networkAllowed(allowed []*net.IPNet, ip net.IP) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, n := range allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestFromNetworks reports whether the client of the request is part
+// of the networks. Requests received on a Unix socket carry no address
+// and are guarded by the permissions of the socket.
+func requestFromNetworks(r *http.Request, networks []*net.IPNet) bool {
+	if r.RemoteAddr == "@" || r.RemoteAddr == "" {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return len(networks) == 0
+	}
+	return networkAllowed(networks, ip)
+}
+
+// requestNetworkAllowed checks the client of the request against
+// --allow-cidr
+func requestNetworkAllowed(r *http.Request) bool {
+	return requestFromNetworks(r, allowedNetworks)
+}
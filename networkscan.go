@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// Scan jobs and device description shared by the network scan
+// protocols (eSCL and WSD)
+
+// Finished network scan jobs are kept this long for clients to fetch
+// the remaining documents
+const networkJobTTL = 10 * time.Minute
+
+// commonResolutions are offered if the scanner does not list the
+// supported resolutions
+var commonResolutions = []int{75, 100, 150, 200, 300, 400, 600}
+
+// networkJob is a scan started by a network scan client, its documents
+// are fetched one after another
+type networkJob struct {
+	ID string
+	// Number is a sequential ID for protocols using numeric job IDs
+	Number  int
+	Created time.Time
+	Format  string
+
+	lock     sync.Mutex
+	done     chan struct{}
+	docs     [][]byte
+	next     int
+	status   int
+	errCode  string
+	finished time.Time
+}
+
+type networkJobStore struct {
+	jobs    map[string]*networkJob
+	lock    sync.Mutex
+	counter int
+}
+
+func newNetworkJobStore() *networkJobStore {
+	return &networkJobStore{jobs: map[string]*networkJob{}}
+}
+
+func (n *networkJobStore) Add(format string) *networkJob {
+	job := &networkJob{ID: newID(), Created: time.Now(), Format: format, done: make(chan struct{})}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.expire()
+	n.counter++
+	job.Number = n.counter
+	n.jobs[job.ID] = job
+	return job
+}
+
+func (n *networkJobStore) Get(id string) *networkJob {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.expire()
+	return n.jobs[id]
+}
+
+// GetNumber returns the job having the sequential number
+func (n *networkJobStore) GetNumber(number int) *networkJob {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.expire()
+	for _, job := range n.jobs {
+		if job.Number == number {
+			return job
+		}
+	}
+	return nil
+}
+
+// List returns the known jobs, oldest first
+func (n *networkJobStore) List() []*networkJob {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.expire()
+	jobs := []*networkJob{}
+	for _, job := range n.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].Created.Before(jobs[b].Created) })
+	return jobs
+}
+
+// expire removes finished jobs, the caller must hold the lock
+func (n *networkJobStore) expire() {
+	for id, job := range n.jobs {
+		job.lock.Lock()
+		finished := job.finished
+		job.lock.Unlock()
+
+		if !finished.IsZero() && time.Since(finished) > networkJobTTL {
+			delete(n.jobs, id)
+		}
+	}
+}
+
+// run scans the documents of the job, PDFs are produced like by
+// /scan.pdf while JPEG clients get the processed pages
+func (j *networkJob) run(r *http.Request, params *scanParams) {
+	var (
+		docs   [][]byte
+		status = http.StatusOK
+		code   string
+	)
+
+	defer func() {
+		if p := recover(); p != nil {
+			// The document failed to render after it was started
+			log.WithField("job_id", j.ID).Errorf("Network scan aborted: %v", p)
+			docs, status, code = nil, http.StatusInternalServerError, errCodeInternal
+		}
+
+		j.lock.Lock()
+		defer j.lock.Unlock()
+
+		j.docs, j.status, j.errCode = docs, status, code
+		j.finished = time.Now()
+		close(j.done)
+	}()
+
+	if j.Format == "image/jpeg" {
+		pages, _, err := scanAndProcessPages(params, 0)
+		if err != nil && len(pages) == 0 {
+			status, code = scanErrorStatus(err)
+		}
+		meta := imageMetadata(params)
+		for _, p := range pages {
+			data, err := pageImageData(p, meta)
+			if err != nil {
+				log.WithError(err).WithField("job_id", j.ID).Error("Unable to read scanned page")
+				docs, status, code = nil, http.StatusInternalServerError, errCodeInternal
+				break
+			}
+			docs = append(docs, data)
+		}
+	} else {
+		res := &bufferResponseWriter{header: http.Header{}}
+		serveScan(res, r, params, time.Now())
+		if res.status >= http.StatusBadRequest {
+			status, code = res.status, res.header.Get("X-Error-Code")
+		} else {
+			docs = append(docs, res.body.Bytes())
+		}
+	}
+}
+
+// startNetworkJob queues a scan configured by the /scan.pdf query
+// parameters, the scan outlives the request creating the job
+func startNetworkJob(r *http.Request, jobs *networkJobStore, format string, q url.Values) (*networkJob, error) {
+	ctx := context.WithValue(context.Background(), ctxKeyUser, requestUser(r))
+	sr := r.Clone(ctx)
+	sr.Method = http.MethodGet
+	sr.URL.RawQuery = q.Encode()
+
+	params, err := parseScanParams(sr)
+	if err != nil {
+		return nil, err
+	}
+	if format == "image/jpeg" {
+		// Bilevel pages are encoded using CCITT which is no JPEG
+		switch params.Color {
+		case scanner.ColorModeBW:
+			params.Color = scanner.ColorModeGray
+		case scanner.ColorModeAutoBW:
+			params.Color = scanner.ColorModeAuto
+		}
+		params.Lossless, params.Archive, params.Depth = false, false, 8
+	}
+
+	job := jobs.Add(format)
+	params.JobID, params.User = job.ID, requestUser(r)
+
+	go job.run(sr.WithContext(context.WithValue(ctx, ctxKeyJobID, job.ID)), params)
+	return job, nil
+}
+
+// networkDeviceInfo describes the scanner to network scan clients and
+// in the discovery announcements
+type networkDeviceInfo struct {
+	Vendor, Model string
+	MakeAndModel  string
+	UUID          string
+	Resolutions   []int
+	MaxResolution int
+	// Sizes in 1/300 inch
+	MinWidth, MaxWidth, MinHeight, MaxHeight int
+}
+
+func currentDeviceInfo() networkDeviceInfo {
+	info := networkDeviceInfo{
+		Vendor:       "scansnap-go",
+		MakeAndModel: "scansnap-go",
+		UUID:         deviceUUID(),
+		Resolutions:  commonResolutions,
+		MinWidth:     mmTo300thInch(10),
+		MinHeight:    mmTo300thInch(10),
+	}
+
+	defaults := defaultScannerOptions()
+	width, _ := optionFloat(defaults["page-width"])
+	height, _ := optionFloat(defaults["page-height"])
+
+	if describer, ok := scanBackend.(scanner.DeviceDescriber); ok {
+		if caps, err := describer.DeviceOptions(); err != nil {
+			log.WithError(err).Warn("Unable to read device options, announcing default capabilities")
+		} else {
+			info.Vendor, info.Model = caps.Device.Vendor, caps.Device.Model
+			info.MakeAndModel = strings.TrimSpace(caps.Device.Vendor + " " + caps.Device.Model)
+			for _, o := range caps.Options {
+				switch o.Name {
+				case "resolution":
+					info.Resolutions = supportedResolutions(o)
+				case "page-width":
+					width = optionRangeMax(o, width)
+				case "page-height":
+					height = optionRangeMax(o, height)
+				}
+			}
+		}
+	}
+
+	info.MaxWidth, info.MaxHeight = mmTo300thInch(width), mmTo300thInch(height)
+	for _, r := range info.Resolutions {
+		if r > info.MaxResolution {
+			info.MaxResolution = r
+		}
+	}
+	return info
+}
+
+// supportedResolutions lists the resolutions allowed by the option,
+// ranges are reduced to the common resolutions within them
+func supportedResolutions(o scanner.DeviceOption) []int {
+	var res []int
+
+	for _, v := range o.ConstrSet {
+		if f, ok := optionFloat(v); ok {
+			res = append(res, int(f))
+		}
+	}
+
+	if r := o.ConstrRange; r != nil {
+		min, _ := optionFloat(r.Min)
+		max, _ := optionFloat(r.Max)
+		for _, dpi := range commonResolutions {
+			if float64(dpi) >= min && float64(dpi) <= max {
+				res = append(res, dpi)
+			}
+		}
+	}
+
+	if len(res) == 0 {
+		return commonResolutions
+	}
+	return res
+}
+
+func optionRangeMax(o scanner.DeviceOption, fallback float64) float64 {
+	if o.ConstrRange == nil {
+		return fallback
+	}
+	if max, ok := optionFloat(o.ConstrRange.Max); ok && max > 0 {
+		return max
+	}
+	return fallback
+}
+
+func optionFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func mmTo300thInch(mm float64) int {
+	return int(mm / 25.4 * 300)
+}
+
+// deviceUUID derives a stable UUID from the hostname so clients
+// recognize the scanner after restarts
+func deviceUUID() string {
+	host, _ := os.Hostname()
+	s := sha1.Sum([]byte("scansnap-go:" + host))
+	return fmt.Sprintf("%x-%x-%x-%x-%x", s[0:4], s[4:6], s[6:8], s[8:10], s[10:16])
+}
+
+// localIPv4Addrs returns the IPv4 addresses of all interfaces except
+// the loopback interface
+func localIPv4Addrs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.WithError(err).Error("Unable to list interface addresses")
+		return nil
+	}
+
+	var ips []net.IP
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.To4() == nil {
+			continue
+		}
+		ips = append(ips, ipNet.IP.To4())
+	}
+	return ips
+}
+
+// xmlText escapes s for use in XML templates
+func xmlText(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// listenPort returns the port of a listen address like ":3000"
+func listenPort(addr string) (int, error) {
+	if strings.HasPrefix(addr, listenUnixPrefix) {
+		return 0, fmt.Errorf("Announcing the service requires a TCP listen address")
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid listen address %q: %s", addr, err)
+	}
+	return strconv.Atoi(port)
+}
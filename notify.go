@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// notifyTimeout limits sending the notification about a failed scan
+const notifyTimeout = 30 * time.Second
+
+// failureNotifier is implemented by targets also informing about scans
+// which failed and therefore have no document to deliver
+type failureNotifier interface {
+	NotifyFailure(ctx context.Context, e scanEvent) error
+}
+
+// messageNotifier is implemented by targets able to send a message not
+// related to a scan, e.g. maintenance reminders. Title and message are
+// translated into the language of the target, args format the message.
+type messageNotifier interface {
+	NotifyMessage(ctx context.Context, title, msg string, args ...interface{}) error
+}
+
+// notifyOptions are shared by the notification targets
+type notifyOptions struct {
+	// Attach sends the document with the message
+	Attach bool `yaml:"attach"`
+	// Link is the external URL of the daemon to link the stored scan
+	// (requires --storage-dir)
+	Link string `yaml:"link"`
+	// Failures also notifies about failed scans of the routes the
+	// target is part of (default: true)
+	Failures *bool `yaml:"failures"`
+
+	localeOptions `yaml:",inline"`
+}
+
+func (n notifyOptions) validate() error {
+	if n.Link != "" {
+		if _, err := url.ParseRequestURI(n.Link); err != nil {
+			return fmt.Errorf("invalid link: %s", err)
+		}
+	}
+	return n.localeOptions.validate()
+}
+
+func (n notifyOptions) notifiesFailures() bool {
+	return n.Failures == nil || *n.Failures
+}
+
+// message describes the delivered document, with a link to the stored
+// scan if configured
+func (n notifyOptions) message(doc *deliveryDocument) string {
+	name := doc.Title
+	if name == "" {
+		name = doc.Filename
+	}
+
+	details := []string{n.localize("%d pages", doc.Pages)}
+	if paper := n.paperSize(doc); paper != "" {
+		details = append(details, paper)
+	}
+	if doc.Profile != "" {
+		details = append(details, n.localize("profile %s", doc.Profile))
+	}
+	msg := n.localize("Scan completed: %s", name) + "\n" + strings.Join(details, ", ")
+
+	if link := n.scanLink(doc); link != "" {
+		msg += "\n" + link
+	}
+	return msg
+}
+
+func (n notifyOptions) scanLink(doc *deliveryDocument) string {
+	if n.Link == "" || storage == nil {
+		return ""
+	}
+	return strings.TrimSuffix(n.Link, "/") + "/scans/" + doc.JobID + filepath.Ext(doc.Filename)
+}
+
+// failureMessage describes the failed scan, errors of the scanner are
+// replaced by the description of their code in other languages
+func (n notifyOptions) failureMessage(e scanEvent) string {
+	cause := e.Error
+	if d, ok := errCodeDescriptions[e.ErrorCode]; ok && !localized(n.lang(), cause) {
+		cause = d
+	}
+
+	msg := n.localize("Scan failed: %s", n.localize(cause))
+	if e.Profile != "" {
+		msg += " " + n.localize("(profile %s)", e.Profile)
+	}
+	return msg
+}
+
+// notifyFailure informs the notification targets of the routes matching
+// the failed scan
+func notifyFailure(e scanEvent) {
+	names := routeScan(&scanParams{Profile: e.Profile, User: e.User, Query: url.Values{}}, nil).Targets
+
+	targetsLock.RLock()
+	notifiers := map[string]failureNotifier{}
+	for _, name := range names {
+		if n, ok := uploadTargets[name].(failureNotifier); ok {
+			notifiers[name] = n
+		}
+	}
+	targetsLock.RUnlock()
+
+	if len(notifiers) == 0 {
+		return
+	}
+
+	go func() {
+		for name, n := range notifiers {
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			if err := n.NotifyFailure(ctx, e); err != nil {
+				log.WithError(err).WithFields(log.Fields{"job_id": e.JobID, "target": name}).Error("Unable to send failure notification")
+			}
+			cancel()
+		}
+	}()
+}
+
+// postJSON sends the payload to the URL
+func postJSON(ctx context.Context, u string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal message: %s", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Unable to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return doTargetRequest(req)
+}
+
+// slackTarget posts a message to a Slack incoming webhook, webhooks are
+// not able to upload files
+type slackTarget struct {
+	WebhookURL    string `yaml:"webhook_url"`
+	notifyOptions `yaml:",inline"`
+}
+
+func newSlackTarget(decode func(interface{}) error) (uploadTarget, error) {
+	t := &slackTarget{}
+	if err := decode(t); err != nil {
+		return nil, err
+	}
+
+	if _, err := url.ParseRequestURI(t.WebhookURL); err != nil {
+		return nil, fmt.Errorf("invalid webhook_url: %s", err)
+	}
+	if t.Attach {
+		return nil, fmt.Errorf("attach is not supported by Slack webhooks, use link")
+	}
+	return t, t.validate()
+}
+
+// Address implements addressedTarget
+func (s slackTarget) Address() string { return urlAddress(s.WebhookURL) }
+
+// Upload implements uploadTarget
+func (s slackTarget) Upload(ctx context.Context, doc *deliveryDocument) error {
+	return postJSON(ctx, s.WebhookURL, map[string]string{"text": s.message(doc)})
+}
+
+// NotifyFailure implements failureNotifier
+func (s slackTarget) NotifyFailure(ctx context.Context, e scanEvent) error {
+	if !s.notifiesFailures() {
+		return nil
+	}
+	return postJSON(ctx, s.WebhookURL, map[string]string{"text": s.failureMessage(e)})
+}
+
+// NotifyMessage implements messageNotifier
+func (s slackTarget) NotifyMessage(ctx context.Context, title, msg string, args ...interface{}) error {
+	return postJSON(ctx, s.WebhookURL, map[string]string{"text": s.localize(msg, args...)})
+}
+
+// telegramTarget sends a message or the document using a Telegram bot
+type telegramTarget struct {
+	Token         string `yaml:"token"`
+	ChatID        string `yaml:"chat_id"`
+	APIURL        string `yaml:"api_url"`
+	notifyOptions `yaml:",inline"`
+}
+
+func newTelegramTarget(decode func(interface{}) error) (uploadTarget, error) {
+	t := &telegramTarget{APIURL: "https://api.telegram.org"}
+	if err := decode(t); err != nil {
+		return nil, err
+	}
+
+	if t.Token == "" || t.ChatID == "" {
+		return nil, fmt.Errorf("token and chat_id are required")
+	}
+	if _, err := url.ParseRequestURI(t.APIURL); err != nil {
+		return nil, fmt.Errorf("invalid api_url: %s", err)
+	}
+	return t, t.validate()
+}
+
+func (t telegramTarget) method(name string) string {
+	return strings.TrimSuffix(t.APIURL, "/") + "/bot" + t.Token + "/" + name
+}
+
+// Address implements addressedTarget
+func (t telegramTarget) Address() string { return urlAddress(t.APIURL) }
+
+// Upload implements uploadTarget
+func (t telegramTarget) Upload(ctx context.Context, doc *deliveryDocument) error {
+	if !t.Attach {
+		return postJSON(ctx, t.method("sendMessage"), map[string]string{"chat_id": t.ChatID, "text": t.message(doc)})
+	}
+
+	f, _, err := doc.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The form is streamed to not keep large documents in memory
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+
+	go func() {
+		err := form.WriteField("chat_id", t.ChatID)
+		if err == nil {
+			err = form.WriteField("caption", t.message(doc))
+		}
+		if err == nil {
+			var part io.Writer
+			if part, err = form.CreateFormFile("document", doc.Filename); err == nil {
+				_, err = io.Copy(part, f)
+			}
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.method("sendDocument"), pr)
+	if err != nil {
+		pr.Close()
+		return fmt.Errorf("Unable to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	return doTargetRequest(req)
+}
+
+// NotifyFailure implements failureNotifier
+func (t telegramTarget) NotifyFailure(ctx context.Context, e scanEvent) error {
+	if !t.notifiesFailures() {
+		return nil
+	}
+	return postJSON(ctx, t.method("sendMessage"), map[string]string{"chat_id": t.ChatID, "text": t.failureMessage(e)})
+}
+
+// NotifyMessage implements messageNotifier
+func (t telegramTarget) NotifyMessage(ctx context.Context, title, msg string, args ...interface{}) error {
+	return postJSON(ctx, t.method("sendMessage"), map[string]string{"chat_id": t.ChatID, "text": t.localize(msg, args...)})
+}
+
+// ntfyTarget publishes a message or the document to a topic of an ntfy
+// server, e.g. https://ntfy.sh/my-scans
+type ntfyTarget struct {
+	URL           string `yaml:"url"`
+	Token         string `yaml:"token"`
+	notifyOptions `yaml:",inline"`
+}
+
+func newNtfyTarget(decode func(interface{}) error) (uploadTarget, error) {
+	t := &ntfyTarget{}
+	if err := decode(t); err != nil {
+		return nil, err
+	}
+
+	if _, err := url.ParseRequestURI(t.URL); err != nil {
+		return nil, fmt.Errorf("invalid url: %s", err)
+	}
+	return t, t.validate()
+}
+
+func (n ntfyTarget) publish(ctx context.Context, method string, body io.Reader, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, method, n.URL, body)
+	if err != nil {
+		return fmt.Errorf("Unable to create request: %s", err)
+	}
+	if n.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+	for k, v := range headers {
+		if v != "" {
+			req.Header.Set(k, v)
+		}
+	}
+
+	return doTargetRequest(req)
+}
+
+// Address implements addressedTarget
+func (n ntfyTarget) Address() string { return urlAddress(n.URL) }
+
+// Upload implements uploadTarget
+func (n ntfyTarget) Upload(ctx context.Context, doc *deliveryDocument) error {
+	headers := map[string]string{"Title": n.localize("Scan completed"), "Tags": "page_facing_up", "Click": n.scanLink(doc)}
+
+	if !n.Attach {
+		return n.publish(ctx, http.MethodPost, strings.NewReader(n.message(doc)), headers)
+	}
+
+	f, _, err := doc.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Attachments are sent as body, the message moves into a header
+	headers["Filename"] = doc.Filename
+	headers["Message"] = strings.ReplaceAll(n.message(doc), "\n", " ")
+	return n.publish(ctx, http.MethodPut, f, headers)
+}
+
+// NotifyFailure implements failureNotifier
+func (n ntfyTarget) NotifyFailure(ctx context.Context, e scanEvent) error {
+	if !n.notifiesFailures() {
+		return nil
+	}
+	return n.publish(ctx, http.MethodPost, strings.NewReader(n.failureMessage(e)), map[string]string{"Title": n.localize("Scan failed"), "Tags": "warning", "Priority": "high"})
+}
+
+// NotifyMessage implements messageNotifier
+func (n ntfyTarget) NotifyMessage(ctx context.Context, title, msg string, args ...interface{}) error {
+	return n.publish(ctx, http.MethodPost, strings.NewReader(n.localize(msg, args...)), map[string]string{"Title": n.localize(title), "Tags": "wrench"})
+}
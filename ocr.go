@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Luzifer/scansnap-go/pkg/pdfgen"
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+)
+
+// ocrWord is a word recognized by tesseract together with its bounding
+// box in page pixels, the confidence (0-100) and the number of its line
+type ocrWord struct {
+	Text       string
+	Confidence float64
+	Box        image.Rectangle
+	Line       int
+}
+
+// ocrLangAuto recognizes the text using the tesseract model of the
+// script detected on the page
+const ocrLangAuto = "auto"
+
+// Orientations detected with a lower confidence are ignored, e.g. on
+// pages having only a few words
+const minOrientationConfidence = 2
+
+var ocrLangPattern = regexp.MustCompile(`^[A-Za-z0-9_/]+(\+[A-Za-z0-9_/]+)*$`)
+
+// pageOrientation is the result of the orientation and script detection
+// (OSD) of tesseract
+type pageOrientation struct {
+	// Rotate is the clockwise rotation turning the page upright
+	Rotate                int
+	OrientationConfidence float64
+	Script                string
+	ScriptConfidence      float64
+}
+
+// runTesseract passes the image to tesseract and returns its output
+func runTesseract(img image.Image, dpi int, args ...string) ([]byte, error) {
+	in := new(bytes.Buffer)
+	if err := png.Encode(in, img); err != nil {
+		return nil, fmt.Errorf("Unable to encode page for OCR: %s", err)
+	}
+
+	stderr := new(bytes.Buffer)
+	cmd := exec.Command(cfg.Tesseract, append([]string{"stdin", "stdout", "--dpi", strconv.Itoa(dpi)}, args...)...)
+	cmd.Stdin = in
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to execute tesseract: %s (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// recognizeWords runs tesseract on the image and returns the words
+// found on it, lang selects the tesseract languages (e.g. deu+eng,
+// empty = tesseract default, auto = detected script)
+func recognizeWords(img image.Image, dpi int, lang string) ([]ocrWord, error) {
+	if lang == ocrLangAuto {
+		o, err := detectOrientation(img, dpi)
+		if err != nil {
+			return nil, err
+		}
+		lang = o.lang()
+	}
+
+	args := []string{}
+	if lang != "" {
+		args = append(args, "-l", lang)
+	}
+
+	out, err := runTesseract(img, dpi, append(args, "tsv")...)
+	if err != nil {
+		return nil, err
+	}
+	return parseTesseractTSV(out)
+}
+
+// detectOrientation runs the orientation and script detection of
+// tesseract on the image (requires the osd model)
+func detectOrientation(img image.Image, dpi int) (pageOrientation, error) {
+	out, err := runTesseract(img, dpi, "--psm", "0")
+	if err != nil {
+		return pageOrientation{}, err
+	}
+	return parseTesseractOSD(out)
+}
+
+// parseTesseractOSD reads the "Key: Value" lines printed by the
+// orientation and script detection
+func parseTesseractOSD(raw []byte) (pageOrientation, error) {
+	var (
+		o   pageOrientation
+		err error
+	)
+
+	s := bufio.NewScanner(bytes.NewReader(raw))
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		v := strings.TrimSpace(kv[1])
+		switch kv[0] {
+		case "Rotate":
+			o.Rotate, err = strconv.Atoi(v)
+		case "Orientation confidence":
+			o.OrientationConfidence, err = strconv.ParseFloat(v, 64)
+		case "Script":
+			o.Script = v
+		case "Script confidence":
+			o.ScriptConfidence, err = strconv.ParseFloat(v, 64)
+		}
+		if err != nil {
+			return o, fmt.Errorf("Invalid orientation in tesseract output: %q", s.Text())
+		}
+	}
+
+	return o, s.Err()
+}
+
+// lang returns the tesseract script model for the detected script,
+// empty (tesseract default) if no script was detected
+func (o pageOrientation) lang() string {
+	if o.Script == "" || o.ScriptConfidence <= 0 {
+		return ""
+	}
+	return "script/" + o.Script
+}
+
+// ocrStep adds the recognized words as invisible text layer to the
+// pages to make the PDF searchable. With osd the orientation of the
+// pages is detected first and sideways or upside down pages are turned
+// upright.
+type ocrStep struct {
+	lang string
+	osd  bool
+}
+
+func newOCRStep(o scanner.StepOptions) (scanner.Step, error) {
+	step := ocrStep{lang: o.String("lang", "")}
+	if step.lang != "" && step.lang != ocrLangAuto && !ocrLangPattern.MatchString(step.lang) {
+		return nil, fmt.Errorf("invalid languages %q for option \"lang\"", step.lang)
+	}
+
+	var err error
+	if step.osd, err = strconv.ParseBool(o.String("osd", "false")); err != nil {
+		return nil, fmt.Errorf("invalid boolean %q for option \"osd\"", o.String("osd", ""))
+	}
+	return step, nil
+}
+
+func (o ocrStep) Apply(p *scanner.StepPage) error {
+	if failInject.OCRCrashPage > 0 && p.Index+1 == failInject.OCRCrashPage {
+		return fmt.Errorf("Unable to execute tesseract: signal: segmentation fault (injected failure)")
+	}
+
+	lang := o.lang
+	if o.osd {
+		orientation, err := detectOrientation(p.Image, p.DPI)
+		if err != nil {
+			return err
+		}
+
+		if orientation.OrientationConfidence >= minOrientationConfidence {
+			p.Image = scanner.RotatePage(p.Ops, p.Image, orientation.Rotate)
+		}
+		if lang == ocrLangAuto {
+			lang = orientation.lang()
+		}
+	}
+
+	words, err := recognizeWords(p.Image, p.DPI, lang)
+	if err != nil {
+		return err
+	}
+
+	w, h := float64(p.Image.Bounds().Dx()), float64(p.Image.Bounds().Dy())
+	for _, word := range words {
+		p.Text = append(p.Text, pdfgen.Text{
+			Text:      word.Text,
+			X:         float64(word.Box.Min.X) / w,
+			Y:         float64(word.Box.Max.Y) / h,
+			Size:      float64(word.Box.Dy()) / h,
+			Width:     float64(word.Box.Dx()) / w,
+			Invisible: true,
+		})
+		p.Words = append(p.Words, scanner.Word{
+			Text:       word.Text,
+			Confidence: word.Confidence,
+			Box:        word.Box,
+			Line:       word.Line,
+		})
+	}
+	return nil
+}
+
+// KeepsDepth implements scanner.DepthKeeper, the words are recognized
+// without changing the page
+func (ocrStep) KeepsDepth() bool { return true }
+
+// parseTesseractTSV extracts the words (level 5 entries) from the TSV
+// output of tesseract
+func parseTesseractTSV(raw []byte) ([]ocrWord, error) {
+	var (
+		words    = []ocrWord{}
+		line     int
+		lastLine string
+	)
+
+	s := bufio.NewScanner(bytes.NewReader(raw))
+	for s.Scan() {
+		// level page_num block_num par_num line_num word_num left top width height conf text
+		fields := strings.Split(s.Text(), "\t")
+		if len(fields) < 12 || fields[0] != "5" {
+			continue
+		}
+
+		var n [4]int
+		for i := range n {
+			v, err := strconv.Atoi(fields[6+i])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid bounding box in tesseract output: %q", s.Text())
+			}
+			n[i] = v
+		}
+
+		conf, err := strconv.ParseFloat(fields[10], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid confidence in tesseract output: %q", s.Text())
+		}
+
+		text := strings.TrimSpace(fields[11])
+		if conf < 0 || text == "" {
+			continue
+		}
+
+		// Lines are numbered within their paragraph and block
+		if key := strings.Join(fields[1:5], "/"); key != lastLine {
+			line++
+			lastLine = key
+		}
+
+		words = append(words, ocrWord{
+			Text:       text,
+			Confidence: conf,
+			Box:        image.Rect(n[0], n[1], n[0]+n[2], n[1]+n[3]),
+			Line:       line,
+		})
+	}
+
+	return words, s.Err()
+}
+
+// meanConfidence returns the average word confidence, 0 without words
+func meanConfidence(words []ocrWord) float64 {
+	if len(words) == 0 {
+		return 0
+	}
+
+	var sum float64
+	for _, w := range words {
+		sum += w.Confidence
+	}
+	return sum / float64(len(words))
+}
+
+// confidenceColor maps the confidence onto red (bad), yellow and green
+// (good) highlighting
+func confidenceColor(conf float64) color.NRGBA {
+	switch {
+	case conf >= 85:
+		return color.NRGBA{0, 200, 0, 80}
+	case conf >= 60:
+		return color.NRGBA{255, 200, 0, 100}
+	default:
+		return color.NRGBA{255, 0, 0, 110}
+	}
+}
+
+// renderConfidenceOverlay highlights the recognized words on a copy of
+// the page colored by their confidence
+func renderConfidenceOverlay(img image.Image, words []ocrWord) *image.RGBA {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(out, out.Bounds(), img, b.Min, draw.Src)
+
+	for _, w := range words {
+		c := confidenceColor(w.Confidence)
+		draw.Draw(out, w.Box, &image.Uniform{c}, image.Point{}, draw.Over)
+
+		// Opaque frame to tell adjacent words apart
+		c.A = 255
+		frame := &image.Uniform{c}
+		r := w.Box
+		for _, edge := range []image.Rectangle{
+			image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+1),
+			image.Rect(r.Min.X, r.Max.Y-1, r.Max.X, r.Max.Y),
+			image.Rect(r.Min.X, r.Min.Y, r.Min.X+1, r.Max.Y),
+			image.Rect(r.Max.X-1, r.Min.Y, r.Max.X, r.Max.Y),
+		} {
+			draw.Draw(out, edge, frame, image.Point{}, draw.Src)
+		}
+	}
+
+	return out
+}
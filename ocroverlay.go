@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// OCR overlays are debug renderings and kept only for a limited time
+const ocrOverlayTTL = time.Hour
+
+type ocrOverlayPage struct {
+	Page  *scanner.Page
+	Words []ocrWord
+}
+
+type ocrOverlay struct {
+	ID      string
+	Pages   []ocrOverlayPage
+	Created time.Time
+}
+
+type ocrOverlayStore struct {
+	overlays map[string]*ocrOverlay
+	lock     sync.Mutex
+}
+
+var ocrOverlays = &ocrOverlayStore{overlays: map[string]*ocrOverlay{}}
+
+func (o *ocrOverlayStore) Add(ov *ocrOverlay) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for id, e := range o.overlays {
+		if time.Since(e.Created) > ocrOverlayTTL {
+			delete(o.overlays, id)
+		}
+	}
+
+	o.overlays[ov.ID] = ov
+}
+
+func (o *ocrOverlayStore) Get(id string) *ocrOverlay {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	ov := o.overlays[id]
+	if ov == nil || time.Since(ov.Created) > ocrOverlayTTL {
+		return nil
+	}
+	return ov
+}
+
+// createOCROverlay recognizes the text of all pages and stores the
+// results to be rendered on download, lang selects the tesseract
+// languages like for the ocr step
+func createOCROverlay(pages []*scanner.Page, lang string) (*ocrOverlay, error) {
+	ov := &ocrOverlay{ID: newID(), Created: time.Now()}
+
+	for _, pg := range pages {
+		img, err := pg.DecodedImage()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read page %d: %s", pg.Index+1, err)
+		}
+		words, err := recognizeWords(img, pg.DPI, lang)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to recognize page %d: %s", pg.Index+1, err)
+		}
+		ov.Pages = append(ov.Pages, ocrOverlayPage{Page: pg, Words: words})
+	}
+
+	ocrOverlays.Add(ov)
+	return ov, nil
+}
+
+func (o ocrOverlay) MeanConfidence() float64 {
+	all := []ocrWord{}
+	for _, p := range o.Pages {
+		all = append(all, p.Words...)
+	}
+	return meanConfidence(all)
+}
+
+func handleOCROverlaySummary(res http.ResponseWriter, r *http.Request) {
+	ov := ocrOverlays.Get(r.PathValue("id"))
+	if ov == nil {
+		writeError(res, http.StatusNotFound, errCodeNotFound, "OCR overlay not found or expired")
+		return
+	}
+
+	type pageSummary struct {
+		Page           int     `json:"page"`
+		Words          int     `json:"words"`
+		LowConfidence  int     `json:"low_confidence_words"`
+		MeanConfidence float64 `json:"mean_confidence"`
+		Overlay        string  `json:"overlay"`
+	}
+
+	summary := []pageSummary{}
+	for i, p := range ov.Pages {
+		s := pageSummary{
+			Page:           i + 1,
+			Words:          len(p.Words),
+			MeanConfidence: meanConfidence(p.Words),
+			Overlay:        fmt.Sprintf("/ocr-overlay/%s/%d.png", ov.ID, i+1),
+		}
+		for _, w := range p.Words {
+			if w.Confidence < 60 {
+				s.LowConfidence++
+			}
+		}
+		summary = append(summary, s)
+	}
+
+	writeJSON(res, http.StatusOK, map[string]interface{}{
+		"id":              ov.ID,
+		"mean_confidence": ov.MeanConfidence(),
+		"pages":           summary,
+	})
+}
+
+// handleOCROverlayPage serves /ocr-overlay/{id}/{page}.png
+func handleOCROverlayPage(res http.ResponseWriter, r *http.Request) {
+	ov := ocrOverlays.Get(r.PathValue("id"))
+	if ov == nil {
+		writeError(res, http.StatusNotFound, errCodeNotFound, "OCR overlay not found or expired")
+		return
+	}
+
+	file := r.PathValue("file")
+	n, err := strconv.Atoi(strings.TrimSuffix(file, ".png"))
+	if err != nil || !strings.HasSuffix(file, ".png") || n < 1 || n > len(ov.Pages) {
+		writeError(res, http.StatusNotFound, errCodeNotFound, "Page not found")
+		return
+	}
+
+	p := ov.Pages[n-1]
+	img, err := p.Page.DecodedImage()
+	if err != nil {
+		log.WithError(err).Error("Unable to read page for OCR overlay")
+		writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to read page for OCR overlay")
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, renderConfidenceOverlay(img, p.Words)); err != nil {
+		log.WithError(err).Error("Unable to encode OCR overlay")
+		writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to encode OCR overlay")
+		return
+	}
+
+	res.Header().Set("Content-Type", "image/png")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Write(buf.Bytes())
+}
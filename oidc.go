@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// oidcClockSkew is accepted between the provider and the daemon when
+	// checking the validity of tokens
+	oidcClockSkew = time.Minute
+	// oidcKeyRefreshInterval limits fetching the keys of the provider for
+	// tokens signed by an unknown key
+	oidcKeyRefreshInterval = time.Minute
+)
+
+// oidcAuthenticator accepts JWT bearer tokens (ID or access tokens)
+// signed by the keys of an OpenID Connect provider
+type oidcAuthenticator struct {
+	issuer    string
+	audience  string
+	userClaim string
+	client    *http.Client
+
+	lock    sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func newOIDCAuthenticator(issuer, audience, userClaim string) *oidcAuthenticator {
+	return &oidcAuthenticator{
+		issuer:    strings.TrimSuffix(issuer, "/"),
+		audience:  audience,
+		userClaim: userClaim,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (o *oidcAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+
+	claims, err := o.verify(strings.TrimPrefix(header, "Bearer "))
+	if err != nil {
+		log.WithError(err).WithField("remote", r.RemoteAddr).Debug("Rejected OIDC token")
+		return "", false
+	}
+
+	for _, claim := range []string{o.userClaim, "sub"} {
+		if user, ok := claims[claim].(string); ok && user != "" {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+// verify checks signature, issuer, audience and validity of the token
+// and returns its claims
+func (o *oidcAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Token is no JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode signature: %s", err)
+	}
+
+	key, err := o.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("Unsupported algorithm %q for RSA key", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, fmt.Errorf("Invalid signature: %s", err)
+		}
+
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return nil, fmt.Errorf("Unsupported algorithm %q for EC key", header.Alg)
+		}
+		if !ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, fmt.Errorf("Invalid signature")
+		}
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != o.issuer {
+		return nil, fmt.Errorf("Token issued by %q", iss)
+	}
+
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); !ok || now.After(time.Unix(int64(exp), 0).Add(oidcClockSkew)) {
+		return nil, fmt.Errorf("Token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("Token not yet valid")
+	}
+
+	if !claimContains(claims["aud"], o.audience) {
+		return nil, fmt.Errorf("Token not issued for audience %q", o.audience)
+	}
+
+	return claims, nil
+}
+
+// key returns the signing key with the ID, the keys of the provider are
+// fetched again if the key is unknown (key rotation)
+func (o *oidcAuthenticator) key(kid string) (crypto.PublicKey, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if k, ok := o.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(o.fetched) < oidcKeyRefreshInterval {
+		return nil, fmt.Errorf("Unknown signing key %q", kid)
+	}
+
+	o.fetched = time.Now()
+	keys, err := o.fetchKeys()
+	if err != nil {
+		return nil, err
+	}
+	o.keys = keys
+
+	if k, ok := o.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("Unknown signing key %q", kid)
+}
+
+// fetchKeys loads the signing keys using the discovery document of the
+// provider
+func (o *oidcAuthenticator) fetchKeys() (map[string]crypto.PublicKey, error) {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := o.getJSON(o.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("Unable to fetch OIDC discovery document: %s", err)
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := o.getJSON(discovery.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("Unable to fetch OIDC signing keys: %s", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		k, err := jwk.publicKey()
+		if err != nil {
+			log.WithError(err).WithField("kid", jwk.Kid).Warn("Ignoring OIDC signing key")
+			continue
+		}
+		keys[jwk.Kid] = k
+	}
+
+	log.WithField("keys", len(keys)).Debug("OIDC signing keys fetched")
+	return keys, nil
+}
+
+func (o *oidcAuthenticator) getJSON(url string, v interface{}) error {
+	resp, err := o.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (j jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(v string) (*big.Int, error) {
+		raw, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(raw), nil
+	}
+
+	switch j.Kty {
+	case "RSA":
+		n, err := decode(j.N)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid modulus: %s", err)
+		}
+		e, err := decode(j.E)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid exponent: %s", err)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if j.Crv != "P-256" {
+			return nil, fmt.Errorf("Unsupported curve %q", j.Crv)
+		}
+		x, err := decode(j.X)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid x coordinate: %s", err)
+		}
+		y, err := decode(j.Y)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid y coordinate: %s", err)
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported key type %q", j.Kty)
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("Unable to decode token: %s", err)
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("Unable to parse token: %s", err)
+	}
+	return nil
+}
+
+// claimContains checks a claim being either a string or a list of
+// strings (like aud) for the value
+func claimContains(claim interface{}, value string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == value
+	case []interface{}:
+		for _, v := range c {
+			if v == value {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testJWT signs the claims using the key (RS256 or ES256)
+func testJWT(t *testing.T, kid, alg string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatalf("signing token: %s", err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatalf("signing token: %s", err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// testOIDCProvider serves the discovery document and the public keys
+func testOIDCProvider(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) *httptest.Server {
+	t.Helper()
+
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	jwks := map[string]interface{}{"keys": []jsonWebKey{
+		{Kid: "rsa", Kty: "RSA", Use: "sig", N: b64(rsaKey.N.Bytes()), E: b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{Kid: "ec", Kty: "EC", Crv: "P-256", X: b64(ecKey.X.Bytes()), Y: b64(ecKey.Y.Bytes())},
+		{Kid: "enc", Kty: "RSA", Use: "enc", N: b64(rsaKey.N.Bytes()), E: b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{Kid: "p384", Kty: "EC", Crv: "P-384", X: b64(ecKey.X.Bytes()), Y: b64(ecKey.Y.Bytes())},
+	}}
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(res).Encode(map[string]string{"issuer": srv.URL, "jwks_uri": srv.URL + "/keys"})
+		case "/keys":
+			json.NewEncoder(res).Encode(jwks)
+		default:
+			http.NotFound(res, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOIDCVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating RSA key: %s", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating EC key: %s", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating EC key: %s", err)
+	}
+
+	srv := testOIDCProvider(t, rsaKey, ecKey)
+	o := newOIDCAuthenticator(srv.URL+"/", "scansnap", "preferred_username")
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"iss": srv.URL, "aud": "scansnap", "sub": "1234", "preferred_username": "jdoe", "exp": now + 300}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	valid := testJWT(t, "rsa", "RS256", rsaKey, claims(nil))
+	tampered := strings.Split(valid, ".")
+	tampered[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"` + srv.URL + `","aud":"scansnap","sub":"admin","exp":9999999999}`))
+
+	for name, tc := range map[string]struct {
+		token string
+		ok    bool
+	}{
+		"RS256":             {valid, true},
+		"ES256":             {testJWT(t, "ec", "ES256", ecKey, claims(nil)), true},
+		"audience list":     {testJWT(t, "ec", "ES256", ecKey, claims(map[string]interface{}{"aud": []string{"other", "scansnap"}})), true},
+		"clock skew":        {testJWT(t, "ec", "ES256", ecKey, claims(map[string]interface{}{"exp": now - 30})), true},
+		"expired":           {testJWT(t, "ec", "ES256", ecKey, claims(map[string]interface{}{"exp": now - 3600})), false},
+		"no expiry":         {testJWT(t, "ec", "ES256", ecKey, claims(map[string]interface{}{"exp": nil})), false},
+		"not yet valid":     {testJWT(t, "ec", "ES256", ecKey, claims(map[string]interface{}{"nbf": now + 3600})), false},
+		"wrong audience":    {testJWT(t, "ec", "ES256", ecKey, claims(map[string]interface{}{"aud": "other"})), false},
+		"no audience":       {testJWT(t, "ec", "ES256", ecKey, claims(map[string]interface{}{"aud": nil})), false},
+		"wrong issuer":      {testJWT(t, "ec", "ES256", ecKey, claims(map[string]interface{}{"iss": "https://evil.example.com"})), false},
+		"wrong key":         {testJWT(t, "ec", "ES256", otherKey, claims(nil)), false},
+		"unknown key":       {testJWT(t, "other", "ES256", otherKey, claims(nil)), false},
+		"encryption key":    {testJWT(t, "enc", "RS256", rsaKey, claims(nil)), false},
+		"unsupported curve": {testJWT(t, "p384", "ES256", ecKey, claims(nil)), false},
+		"algorithm":         {testJWT(t, "rsa", "ES256", ecKey, claims(nil)), false},
+		"tampered claims":   {strings.Join(tampered, "."), false},
+		"unsigned":          {strings.Join(tampered[:2], ".") + ".", false},
+		"no JWT":            {"abc.def", false},
+		"invalid encoding":  {"!!!.???.***", false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := o.verify(tc.token)
+			if tc.ok && err != nil {
+				t.Errorf("expected the token to be accepted: %s", err)
+			}
+			if !tc.ok && err == nil {
+				t.Errorf("expected the token to be rejected")
+			}
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/scan", nil)
+	r.Header.Set("Authorization", "Bearer "+valid)
+	if user, ok := o.Authenticate(r); !ok || user != "jdoe" {
+		t.Errorf("expected user jdoe to be authenticated, got %q (%v)", user, ok)
+	}
+}
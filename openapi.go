@@ -0,0 +1,54 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	//go:embed openapi.json
+	openAPISpec []byte
+
+	openAPIDocument     []byte
+	openAPIDocumentErr  error
+	openAPIDocumentOnce sync.Once
+)
+
+// buildOpenAPIDocument completes the embedded specification with the
+// version of the daemon and the schema of the JSON scan request so
+// both are not maintained twice
+func buildOpenAPIDocument() ([]byte, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		return nil, fmt.Errorf("Unable to parse OpenAPI specification: %s", err)
+	}
+
+	var reqSchema map[string]interface{}
+	if err := json.Unmarshal(scanRequestSchema, &reqSchema); err != nil {
+		return nil, fmt.Errorf("Unable to parse scan request schema: %s", err)
+	}
+	delete(reqSchema, "$schema")
+	delete(reqSchema, "$id")
+
+	doc["info"].(map[string]interface{})["version"] = version
+	doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})["ScanRequest"] = reqSchema
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+func handleOpenAPI(res http.ResponseWriter, r *http.Request) {
+	openAPIDocumentOnce.Do(func() { openAPIDocument, openAPIDocumentErr = buildOpenAPIDocument() })
+	if openAPIDocumentErr != nil {
+		log.WithError(openAPIDocumentErr).Error("Unable to build OpenAPI document")
+		writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to build OpenAPI document")
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(openAPIDocument)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/Luzifer/scansnap-go/pkg/pdfgen"
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+)
+
+// writeOptimizedPDF renders the document into memory to rewrite it as a
+// whole, the signature is added afterwards to cover the final document
+func writeOptimizedPDF(w io.Writer, params *scanParams, pages []*scanner.Page) error {
+	buf := new(bytes.Buffer)
+	if err := assemblePDF(buf, params, pages); err != nil {
+		return err
+	}
+
+	data, err := pdfgen.Optimize(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("Unable to optimize PDF: %s", err)
+	}
+
+	if pdfSigner != nil {
+		return signPDF(w, data)
+	}
+	_, err = w.Write(data)
+	return err
+}
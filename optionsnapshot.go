@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxOptionSnapshots is the number of snapshots kept in memory, with
+// scan storage enabled they are persisted next to the scans
+const maxOptionSnapshots = 100
+
+// optionSnapshot records the device and all its option values at the
+// start of a scan job
+type optionSnapshot struct {
+	JobID   string                 `json:"job_id"`
+	Created time.Time              `json:"created"`
+	Device  scanner.Device         `json:"device"`
+	Values  map[string]interface{} `json:"values"`
+}
+
+type optionChange struct {
+	Option string      `json:"option"`
+	From   interface{} `json:"from"`
+	To     interface{} `json:"to"`
+}
+
+type optionSnapshotStore struct {
+	snapshots map[string]*optionSnapshot
+	order     []string
+	lock      sync.Mutex
+}
+
+var optionSnapshots = &optionSnapshotStore{snapshots: map[string]*optionSnapshot{}}
+
+func (o *optionSnapshotStore) Add(s *optionSnapshot) {
+	o.lock.Lock()
+	if _, exists := o.snapshots[s.JobID]; !exists {
+		// Resumed jobs replace their previous snapshot
+		o.order = append(o.order, s.JobID)
+	}
+	o.snapshots[s.JobID] = s
+	for len(o.order) > maxOptionSnapshots {
+		delete(o.snapshots, o.order[0])
+		o.order = o.order[1:]
+	}
+	o.lock.Unlock()
+
+	if storage == nil {
+		return
+	}
+
+	raw, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(optionSnapshotFile(s.JobID), raw, 0600)
+	}
+	if err != nil {
+		log.WithError(err).WithField("job_id", s.JobID).Error("Unable to persist option snapshot")
+	}
+}
+
+func (o *optionSnapshotStore) Get(jobID string) (*optionSnapshot, error) {
+	o.lock.Lock()
+	s := o.snapshots[jobID]
+	o.lock.Unlock()
+
+	if s != nil {
+		return s, nil
+	}
+
+	if storage == nil || !scanIDPattern.MatchString(jobID) {
+		return nil, os.ErrNotExist
+	}
+
+	raw, err := ioutil.ReadFile(optionSnapshotFile(jobID))
+	if err != nil {
+		return nil, err
+	}
+
+	s = &optionSnapshot{}
+	if err := json.Unmarshal(raw, s); err != nil {
+		return nil, fmt.Errorf("Unable to read option snapshot of job %s: %s", jobID, err)
+	}
+	return s, nil
+}
+
+func optionSnapshotFile(jobID string) string {
+	// The name does not match the scan ID pattern so it is not listed
+	// as scan metadata
+	return path.Join(storage.dir, jobID+".options.json")
+}
+
+// diffOptionSnapshots lists all options having different values,
+// options missing in one of the snapshots have a nil value
+func diffOptionSnapshots(from, to *optionSnapshot) []optionChange {
+	names := map[string]bool{}
+	for name := range from.Values {
+		names[name] = true
+	}
+	for name := range to.Values {
+		names[name] = true
+	}
+
+	changes := []optionChange{}
+	for name := range names {
+		// Compare the JSON representation as values read from disk
+		// have lost their original (numeric) types
+		a, _ := json.Marshal(from.Values[name])
+		b, _ := json.Marshal(to.Values[name])
+		if string(a) != string(b) {
+			changes = append(changes, optionChange{Option: name, From: from.Values[name], To: to.Values[name]})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Option < changes[j].Option })
+	return changes
+}
+
+func handleGetOptionSnapshot(res http.ResponseWriter, r *http.Request) {
+	s, err := optionSnapshots.Get(r.PathValue("id"))
+	if err != nil {
+		writeError(res, http.StatusNotFound, errCodeNotFound, "Option snapshot not found")
+		return
+	}
+
+	writeJSON(res, http.StatusOK, s)
+}
+
+// handleDiffOptionSnapshots compares the options of job {id} with those
+// of job {other}
+func handleDiffOptionSnapshots(res http.ResponseWriter, r *http.Request) {
+	from, err := optionSnapshots.Get(r.PathValue("id"))
+	if err != nil {
+		writeError(res, http.StatusNotFound, errCodeNotFound, "Option snapshot not found")
+		return
+	}
+
+	to, err := optionSnapshots.Get(r.PathValue("other"))
+	if err != nil {
+		writeError(res, http.StatusNotFound, errCodeNotFound, "Option snapshot to compare with not found")
+		return
+	}
+
+	writeJSON(res, http.StatusOK, struct {
+		From          string         `json:"from"`
+		To            string         `json:"to"`
+		DeviceChanged bool           `json:"device_changed"`
+		Changes       []optionChange `json:"changes"`
+	}{
+		From:          from.JobID,
+		To:            to.JobID,
+		DeviceChanged: from.Device != to.Device,
+		Changes:       diffOptionSnapshots(from, to),
+	})
+}
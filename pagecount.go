@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+)
+
+// pageCountError is returned for scans having another number of pages
+// than expected, usually caused by a double feed the hardware missed
+type pageCountError struct {
+	unit               string
+	expected, received int
+}
+
+func (p pageCountError) Error() string {
+	return fmt.Sprintf("Expected %d %s but %d were scanned", p.expected, p.unit, p.received)
+}
+
+// checkPageCount compares the scanned pages against expect-pages or
+// expect-sheets. Pages removed as blank or unable to be processed were
+// still fed, dropped duplicates were not expected.
+func checkPageCount(params *scanParams, pages []*scanner.Page, skipped scanner.PageErrors) error {
+	if params.ExpectPages == 0 && params.ExpectSheets == 0 {
+		return nil
+	}
+
+	images := scannedPageCount(pages)
+	for _, idx := range skipped.Indices() {
+		if idx+1 > images {
+			images = idx + 1
+		}
+	}
+	if params.Meta != nil {
+		for _, n := range params.Meta.BlankPages {
+			if n > images {
+				images = n
+			}
+		}
+	}
+
+	if params.Meta != nil && params.DuplicatePages == duplicatePagesDrop {
+		// Sheets fed twice by accident are expected to be fed once
+		images -= len(params.Meta.DuplicatePages)
+	}
+
+	if params.ExpectPages > 0 && images != params.ExpectPages {
+		return pageCountError{"pages", params.ExpectPages, images}
+	}
+
+	sheets := images
+	if params.Duplex {
+		sheets = (images + 1) / 2
+	}
+	if params.ExpectSheets > 0 && sheets != params.ExpectSheets {
+		return pageCountError{"sheets", params.ExpectSheets, sheets}
+	}
+
+	return nil
+}
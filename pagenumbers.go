@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+
+	"github.com/Luzifer/scansnap-go/pkg/pdfgen"
+)
+
+// pageNumberData is available in the --page-number-template
+type pageNumberData struct {
+	Page  int // Number of the page in the document (1-based)
+	Pages int
+}
+
+const (
+	pageNumberSize   = 9  // points
+	pageNumberMargin = 18 // points from the bottom of the page
+)
+
+var pageNumberTemplate *template.Template
+
+func parsePageNumberTemplate(tpl string) error {
+	t, err := template.New("page-number").Option("missingkey=error").Parse(tpl)
+	if err != nil {
+		return fmt.Errorf("Unable to parse page number template: %s", err)
+	}
+
+	if err := t.Execute(new(bytes.Buffer), pageNumberData{}); err != nil {
+		return fmt.Errorf("Invalid page number template: %s", err)
+	}
+
+	pageNumberTemplate = t
+	return nil
+}
+
+// addPageNumber prints the page number centered at the bottom of the
+// page image
+func addPageNumber(img *pdfgen.Image, page, pages int) error {
+	buf := new(bytes.Buffer)
+	if err := pageNumberTemplate.Execute(buf, pageNumberData{Page: page, Pages: pages}); err != nil {
+		return fmt.Errorf("Unable to render page number: %s", err)
+	}
+
+	_, h := img.SizePt()
+	// The text of the page is shared with the processed page
+	img.Text = append(append([]pdfgen.Text{}, img.Text...), pdfgen.Text{
+		Text:  buf.String(),
+		X:     0.5,
+		Y:     1 - pageNumberMargin/h,
+		Align: pdfgen.AlignCenter,
+		Size:  pageNumberSize / h,
+	})
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Luzifer/scansnap-go/pkg/pdfgen"
+	log "github.com/sirupsen/logrus"
+)
+
+// pageRange is an inclusive range of 1-based page numbers
+type pageRange struct {
+	From, To int
+}
+
+// pageSelection describes a subset of pages in the format "1-3,5,7-"
+// with an empty selection meaning all pages
+type pageSelection []pageRange
+
+func parsePageSelection(spec string) (pageSelection, error) {
+	var sel pageSelection
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var (
+			r   pageRange
+			err error
+		)
+
+		bounds := strings.SplitN(part, "-", 2)
+		if r.From, err = strconv.Atoi(bounds[0]); err != nil || r.From < 1 {
+			return nil, fmt.Errorf("Invalid page number in %q", part)
+		}
+		r.To = r.From
+
+		if len(bounds) == 2 {
+			if bounds[1] == "" {
+				// Open range: "7-" selects page 7 up to the last page
+				r.To = -1
+			} else if r.To, err = strconv.Atoi(bounds[1]); err != nil || r.To < r.From {
+				return nil, fmt.Errorf("Invalid page range %q", part)
+			}
+		}
+
+		sel = append(sel, r)
+	}
+
+	return sel, nil
+}
+
+// indices returns the 0-based indices of the selected pages out of a
+// document with the given page count, in the order of the selection
+func (p pageSelection) indices(count int) []int {
+	idx := []int{}
+
+	if len(p) == 0 {
+		for i := 0; i < count; i++ {
+			idx = append(idx, i)
+		}
+		return idx
+	}
+
+	for _, r := range p {
+		to := r.To
+		if to < 0 || to > count {
+			to = count
+		}
+		for n := r.From; n <= to; n++ {
+			idx = append(idx, n-1)
+		}
+	}
+
+	return idx
+}
+
+// serveSelectedPages answers downloads of a kept document requesting a
+// subset of its pages using the pages parameter with a new PDF of the
+// selected pages, signed again with --sign-cert. False is returned if
+// no pages are requested and the file is to be served as is.
+func serveSelectedPages(res http.ResponseWriter, r *http.Request, file, contentType, filename string) bool {
+	spec := r.URL.Query().Get("pages")
+	if spec == "" {
+		return false
+	}
+
+	sel, err := parsePageSelection(spec)
+	if err != nil {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return true
+	}
+	if contentType != "application/pdf" {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, "Pages can only be selected from PDF documents")
+		return true
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		log.WithError(err).Error("Unable to read document to select pages")
+		writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to read document")
+		return true
+	}
+	doc, err := pdfgen.ReadDocument(data)
+	if err != nil {
+		writeError(res, http.StatusUnprocessableEntity, errCodeInvalidParameter, fmt.Sprintf("Unable to select pages of the document: %s", err))
+		return true
+	}
+
+	// Pages after the end of the document are ignored like for scans
+	idx := []int{}
+	for _, i := range sel.indices(doc.Pages) {
+		if i < doc.Pages {
+			idx = append(idx, i)
+		}
+	}
+	if len(idx) == 0 {
+		writeError(res, http.StatusUnprocessableEntity, errCodeNoPagesSelected, "Page selection does not contain any of the pages of the document")
+		return true
+	}
+
+	if data, err = pdfgen.ExtractPages(doc, idx); err != nil {
+		writeError(res, http.StatusUnprocessableEntity, errCodeInvalidParameter, fmt.Sprintf("Unable to select pages of the document: %s", err))
+		return true
+	}
+	if pdfSigner != nil {
+		buf := new(bytes.Buffer)
+		if err = signPDF(buf, data); err != nil {
+			log.WithError(err).Error("Unable to sign selected pages")
+			writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to sign document")
+			return true
+		}
+		data = buf.Bytes()
+	}
+
+	sum := sha256.Sum256(data)
+	res.Header().Set("X-Content-SHA256", hex.EncodeToString(sum[:]))
+	res.Header().Set("Content-Type", contentType)
+	res.Header().Set("Content-Disposition", contentDisposition(filename))
+	res.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	res.Write(data)
+	return true
+}
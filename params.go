@@ -0,0 +1,894 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/pdfgen"
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// scanParams contains the per-request settings for a scan, initialized
+// from the configured defaults and overridden by query parameters
+type scanParams struct {
+	Archive        bool
+	BlankPages     string
+	BlankThreshold float64
+	// ClaimToken is the X-Claim-Token of the request, required to scan
+	// while the scanner is claimed
+	ClaimToken string
+	Color      string
+	Contrast   int
+	Cover      bool
+	CoverText  string
+	// Depth is the bits per sample scanned, 16 bit pages are kept at
+	// their depth and embedded as PNG
+	Depth          int
+	Duplex         bool
+	DuplexSplit    bool
+	DuplicatePages string
+	// RoutingSheet was found on the first page and removed from it
+	RoutingSheet *routingSheet
+	// Calibration scans keep the decoded image in the colors of the
+	// scanner
+	Calibration  bool
+	Existing     *pdfgen.Document
+	ExpectPages  int
+	ExpectSheets int
+	Info         pdfgen.Info
+	JPEGQuality  int
+	Lossless     bool
+	// MaxSize is the budget of the documents in bytes (0 = unlimited)
+	MaxSize     int64
+	OCRLang     string
+	OCROSD      bool
+	OCROverlay  bool
+	Optimize    bool
+	PageLimit   int
+	PageNumbers bool
+	Password    string
+	PDFDPI      int
+	// PDFMargin (mm) and PDFPlacement place the pages on A4 pages
+	PDFMargin    float64
+	PDFPlacement string
+	Pages        pageSelection
+	Partial      bool
+	PDFA         bool
+	Photo        bool
+	Card         bool
+	Receipt      bool
+	Pipeline     scanner.Pipeline
+	Prepend      bool
+	// Priority orders the scans waiting for the scanner
+	Priority   string
+	Profile    string
+	RawFrames  bool
+	RotateBack int
+	ScanDPI    int
+	Sharpen    int
+	// Source is the side of the scanner fed with paper (source*)
+	Source     string
+	SplitEvery int
+	// Stream sends the PDF while scanning (HTTP requests only)
+	Stream bool
+	// Format is the representation negotiated using the Accept header
+	// (format*), set by the handler
+	Format string
+
+	// PageCountMismatch handles scans not having the ExpectPages or
+	// ExpectSheets (pageCount*)
+	PageCountMismatch string
+
+	// Set by the request handler to identify the job in cover sheets
+	// and the storage
+	JobID string
+	User  string
+	// RequestID is the HTTP request scanning, added to the log
+	RequestID string
+	// MaxPages limits the pages fed (previews), set by the handler
+	MaxPages int
+	// Fed is the index following the last page fed, including the pages
+	// removed as blank or unable to be processed, set by the scan
+	Fed int `json:"-"`
+	// Device and Options override the scanner and its default options
+	// (JSON requests only)
+	Device  string
+	Options map[string]interface{}
+	// Query contains the request parameters including the profile
+	// defaults to route the scan to upload targets
+	Query url.Values
+	// OnPage is called concurrently with every page once it is
+	// processed, in the order they finish
+	OnPage func(*scanner.Page) `json:"-"`
+	// OnProcessed is called like OnPage for every page index, the page
+	// is nil for blank pages and pages unable to be processed
+	OnProcessed func(int, *scanner.Page) `json:"-"`
+	// Meta collects the metadata of the scan while scanning
+	Meta *jobMeta `json:"-"`
+}
+
+// Handling of scans with unexpected page counts by page-count-mismatch
+const (
+	// pageCountWarn delivers the scan marked as suspect
+	pageCountWarn = "warn"
+	// pageCountFail fails the scan
+	pageCountFail = "fail"
+)
+
+// Blank page removal policies of the blank-pages parameter
+const (
+	// blankPagesScanner leaves it to the swskip option of the scanner
+	blankPagesScanner = "scanner"
+	// blankPagesBacks disables swskip and removes blank back sides only
+	blankPagesBacks = "backs"
+	// blankPagesKeep disables swskip and keeps every page
+	blankPagesKeep = "keep"
+)
+
+// Paper sources of the source parameter
+const (
+	// sourceADF scans the stack in the document feeder
+	sourceADF = "adf"
+	// sourceFlatbed scans one page from the flatbed per scan, several
+	// pages are collected using an assembly session
+	sourceFlatbed = "flatbed"
+)
+
+// Handling of sheets scanned twice by the duplicate-pages parameter
+const (
+	// duplicatePagesIgnore does not compare the pages
+	duplicatePagesIgnore = "ignore"
+	// duplicatePagesFlag keeps the pages and reports them in the metadata
+	duplicatePagesFlag = "flag"
+	// duplicatePagesDrop removes the later scan of the sheet
+	duplicatePagesDrop = "drop"
+)
+
+// pagePipeline is the --pipeline used unless overridden by the request
+var pagePipeline scanner.Pipeline
+
+func defaultScanParams() *scanParams {
+	return &scanParams{
+		BlankPages:        cfg.BlankPages,
+		BlankThreshold:    cfg.BlankThreshold,
+		Color:             cfg.Color,
+		Depth:             8,
+		Duplex:            cfg.Duplex,
+		DuplicatePages:    cfg.DuplicatePages,
+		JPEGQuality:       cfg.JPEGQuality,
+		Lossless:          cfg.Lossless,
+		PageLimit:         cfg.MaxPages,
+		PageCountMismatch: cfg.PageCountMismatch,
+		PDFDPI:            cfg.PDFDPI,
+		PDFMargin:         cfg.PDFMargin,
+		PDFPlacement:      cfg.PDFPlacement,
+		PDFA:              cfg.PDFA,
+		Priority:          priorityNormal,
+		Pipeline:          pagePipeline,
+		ScanDPI:           cfg.ScanDPI,
+		Source:            cfg.Source,
+	}
+}
+
+func parseScanParams(r *http.Request) (*scanParams, error) {
+	var (
+		p   = defaultScanParams()
+		q   = r.URL.Query()
+		err error
+	)
+
+	p.ClaimToken = claimToken(r)
+
+	v := q.Get("profile")
+	if v == "" {
+		// Scans of authenticated users default to their profile
+		v = userProfile(requestUser(r))
+	}
+	if v != "" {
+		if err = applyProfile(q, v); err != nil {
+			return nil, err
+		}
+		p.Profile = v
+	}
+
+	if v := q.Get("photo"); v != "" {
+		if p.Photo, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid value for photo: %q", v)
+		}
+		if p.Photo {
+			applyModeDefaults(q, photoDefaults)
+		}
+	}
+
+	if v := q.Get("card"); v != "" {
+		if p.Card, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid value for card: %q", v)
+		}
+		if p.Card {
+			applyModeDefaults(q, cardDefaults)
+		}
+	}
+
+	if v := q.Get("receipt"); v != "" {
+		if p.Receipt, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid value for receipt: %q", v)
+		}
+		if p.Receipt {
+			applyModeDefaults(q, receiptDefaults)
+		}
+	}
+
+	if v := q.Get("duplex"); v != "" {
+		if p.Duplex, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid value for duplex: %q", v)
+		}
+	}
+
+	if v := q.Get("source"); v != "" {
+		p.Source = v
+	}
+	if p.Source == sourceFlatbed {
+		// The flatbed holds one page, a scan ends after it
+		p.MaxPages = 1
+		if q.Get("duplex") == "" {
+			p.Duplex = false
+		}
+	}
+
+	if v := q.Get("blank-pages"); v != "" {
+		p.BlankPages = v
+	}
+
+	if v := q.Get("duplicate-pages"); v != "" {
+		p.DuplicatePages = v
+	}
+
+	if v := q.Get("priority"); v != "" {
+		if err = validatePriority(r, v); err != nil {
+			return nil, err
+		}
+		p.Priority = v
+	}
+
+	if v := q.Get("pdf-placement"); v != "" {
+		p.PDFPlacement = v
+	}
+
+	if v := q.Get("pdf-margin"); v != "" {
+		if p.PDFMargin, err = strconv.ParseFloat(v, 64); err != nil {
+			return nil, fmt.Errorf("Invalid value for pdf-margin: %q", v)
+		}
+	}
+
+	if v := q.Get("blank-threshold"); v != "" {
+		if p.BlankThreshold, err = strconv.ParseFloat(v, 64); err != nil {
+			return nil, fmt.Errorf("Invalid value for blank-threshold: %q", v)
+		}
+	}
+
+	if v := q.Get("color"); v != "" {
+		p.Color = v
+	}
+
+	if v := q.Get("archive"); v != "" {
+		if p.Archive, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid value for archive: %q", v)
+		}
+	}
+
+	if v := q.Get("cover"); v != "" {
+		if p.Cover, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid value for cover: %q", v)
+		}
+	}
+	p.CoverText = q.Get("cover-text")
+
+	if v := q.Get("duplex-split"); v != "" {
+		if p.DuplexSplit, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid value for duplex-split: %q", v)
+		}
+	}
+
+	if v := q.Get("lossless"); v != "" {
+		if p.Lossless, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid value for lossless: %q", v)
+		}
+	}
+
+	if v := q.Get("pdfa"); v != "" {
+		if p.PDFA, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid value for pdfa: %q", v)
+		}
+	}
+
+	if v := q.Get("max-size"); v != "" {
+		if p.MaxSize, err = parseByteSize(v); err != nil {
+			return nil, fmt.Errorf("Invalid value for max-size: %s", err)
+		}
+	}
+
+	if v := q.Get("stream"); v != "" {
+		if p.Stream, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid value for stream: %q", v)
+		}
+	}
+
+	if v := q.Get("raw-frames"); v != "" {
+		if p.RawFrames, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid value for raw-frames: %q", v)
+		}
+	}
+
+	if v := q.Get("pipeline"); v != "" {
+		if p.Pipeline, err = scanner.ParsePipeline(v); err != nil {
+			return nil, err
+		}
+	}
+
+	if v := q.Get("steps"); v != "" {
+		// Single steps of the pipeline of the profile or --pipeline
+		if p.Pipeline, err = p.Pipeline.Override(v); err != nil {
+			return nil, err
+		}
+	}
+
+	if v := q.Get("ocr-overlay"); v != "" {
+		if p.OCROverlay, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid value for ocr-overlay: %q", v)
+		}
+	}
+
+	p.OCRLang = q.Get("ocr-lang")
+	if v := q.Get("ocr-osd"); v != "" {
+		if p.OCROSD, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid value for ocr-osd: %q", v)
+		}
+	}
+
+	if v := q.Get("page-numbers"); v != "" {
+		if p.PageNumbers, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid value for page-numbers: %q", v)
+		}
+	}
+
+	if v := q.Get("optimize"); v != "" {
+		if p.Optimize, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid value for optimize: %q", v)
+		}
+	}
+
+	for param, target := range map[string]*int{"expect-pages": &p.ExpectPages, "expect-sheets": &p.ExpectSheets} {
+		if v := q.Get(param); v != "" {
+			if *target, err = strconv.Atoi(v); err != nil || *target < 1 {
+				return nil, fmt.Errorf("Invalid value for %s: %q", param, v)
+			}
+		}
+	}
+
+	if v := q.Get("page-count-mismatch"); v != "" {
+		p.PageCountMismatch = v
+	}
+
+	if v := q.Get("partial"); v != "" {
+		if p.Partial, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("Invalid value for partial: %q", v)
+		}
+	}
+
+	if v := q.Get("max-pages"); v != "" {
+		if p.PageLimit, err = strconv.Atoi(v); err != nil || p.PageLimit < 0 {
+			return nil, fmt.Errorf("Invalid value for max-pages: %q", v)
+		}
+	}
+
+	if v := q.Get("rotate-back"); v != "" {
+		if p.RotateBack, err = strconv.Atoi(v); err != nil || (p.RotateBack != 0 && p.RotateBack != 180) {
+			return nil, fmt.Errorf("Invalid value for rotate-back: %q (supported: 0, 180)", v)
+		}
+	}
+
+	if err = p.parseDocumentOptions(r, q); err != nil {
+		return nil, err
+	}
+
+	if err = p.parseExistingDocument(r, q); err != nil {
+		return nil, err
+	}
+
+	if v := q.Get("pages"); v != "" {
+		if p.Pages, err = parsePageSelection(v); err != nil {
+			return nil, err
+		}
+	}
+
+	p.Query = q
+
+	for param, target := range map[string]*int{
+		"contrast":    &p.Contrast,
+		"depth":       &p.Depth,
+		"pdf-dpi":     &p.PDFDPI,
+		"quality":     &p.JPEGQuality,
+		"scan-dpi":    &p.ScanDPI,
+		"sharpen":     &p.Sharpen,
+		"split-every": &p.SplitEvery,
+	} {
+		if v := q.Get(param); v != "" {
+			if *target, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("Invalid value for %s: %q", param, v)
+			}
+		}
+	}
+
+	return p, p.validate()
+}
+
+// parseDocumentOptions reads the PDF document metadata and password
+// from the query parameters (including profile defaults) and from a
+// JSON request body (query parameters win)
+func (s *scanParams) parseDocumentOptions(r *http.Request, q url.Values) error {
+	var body struct {
+		Password     string `json:"password"`
+		Title        string `json:"title"`
+		Author       string `json:"author"`
+		Subject      string `json:"subject"`
+		Keywords     string `json:"keywords"`
+		CreationDate string `json:"creation_date"`
+	}
+
+	if r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return fmt.Errorf("Invalid JSON body: %s", err)
+		}
+	}
+
+	for param, target := range map[string]*string{
+		"title":         &body.Title,
+		"author":        &body.Author,
+		"subject":       &body.Subject,
+		"keywords":      &body.Keywords,
+		"creation-date": &body.CreationDate,
+		"password":      &body.Password,
+	} {
+		// Values from the profile do not override the body
+		if v := q.Get(param); v != "" && (*target == "" || r.URL.Query().Get(param) != "") {
+			*target = v
+		}
+	}
+
+	s.Password = body.Password
+	s.Info.Title = body.Title
+	s.Info.Author = body.Author
+	s.Info.Subject = body.Subject
+	s.Info.Keywords = body.Keywords
+
+	if body.CreationDate != "" {
+		var err error
+		if s.Info.CreationDate, err = parseDate(body.CreationDate); err != nil {
+			return fmt.Errorf("Invalid value for creation-date: %q (expected RFC3339 or YYYY-MM-DD)", body.CreationDate)
+		}
+	}
+
+	return nil
+}
+
+// maxExistingDocumentSize limits the size of PDFs posted to add the
+// scanned pages to
+const maxExistingDocumentSize = 100 << 20
+
+// parseExistingDocument reads a PDF posted as request body the scanned
+// pages are added to, after its pages unless merge=prepend is given
+func (s *scanParams) parseExistingDocument(r *http.Request, q url.Values) error {
+	switch v := q.Get("merge"); v {
+	case "", "append":
+	case "prepend":
+		s.Prepend = true
+	default:
+		return fmt.Errorf("Invalid value for merge: %q (supported: append, prepend)", v)
+	}
+
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/pdf") {
+		return nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxExistingDocumentSize+1))
+	if err != nil {
+		return fmt.Errorf("Unable to read PDF body: %s", err)
+	}
+	if len(data) > maxExistingDocumentSize {
+		return fmt.Errorf("PDF body exceeds %d MiB", maxExistingDocumentSize>>20)
+	}
+
+	if s.Existing, err = pdfgen.ReadDocument(data); err != nil {
+		return fmt.Errorf("Unable to add pages to the posted PDF: %s", err)
+	}
+	return nil
+}
+
+// parseDate accepts full RFC3339 timestamps and plain dates (which are
+// interpreted in the local time zone)
+func parseDate(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", v, time.Local)
+}
+
+func (s scanParams) validate() error {
+	if s.ScanDPI < 1 {
+		return fmt.Errorf("Scan DPI must be positive")
+	}
+
+	if s.PDFDPI < 1 || s.PDFDPI > s.ScanDPI {
+		return fmt.Errorf("PDF DPI must be between 1 and the scan DPI (%d)", s.ScanDPI)
+	}
+
+	if err := s.layout().Validate(); err != nil {
+		return fmt.Errorf("Invalid PDF layout: %s", err)
+	}
+
+	switch s.Color {
+	case scanner.ColorModeColor, scanner.ColorModeGray, scanner.ColorModeBW, scanner.ColorModeAuto, scanner.ColorModeAutoBW:
+	default:
+		return fmt.Errorf("Invalid color mode %q (supported: color, gray, bw, auto, auto-bw)", s.Color)
+	}
+
+	if s.Depth != 8 && s.Depth != 16 {
+		return fmt.Errorf("Invalid depth %d (supported: 8, 16)", s.Depth)
+	}
+
+	if s.Depth == 16 && (s.Color == scanner.ColorModeBW || s.Color == scanner.ColorModeAutoBW) {
+		return fmt.Errorf("16 bit depth keeps the tones of gray and color pages, it can not be combined with bw colors")
+	}
+
+	if steps := s.pipeline().ReducingDepth(); s.Depth == 16 && len(steps) > 0 {
+		return fmt.Errorf("16 bit pages can only be processed by the resize, rotate, crop and ocr steps, the pipeline contains %s", strings.Join(steps, ", "))
+	}
+
+	switch s.BlankPages {
+	case blankPagesScanner, blankPagesBacks, blankPagesKeep:
+	default:
+		return fmt.Errorf("Invalid blank-pages %q (supported: scanner, backs, keep)", s.BlankPages)
+	}
+
+	switch s.DuplicatePages {
+	case duplicatePagesIgnore, duplicatePagesFlag, duplicatePagesDrop:
+	default:
+		return fmt.Errorf("Invalid duplicate-pages %q (supported: ignore, flag, drop)", s.DuplicatePages)
+	}
+
+	if s.BlankThreshold <= 0 || s.BlankThreshold > 100 {
+		return fmt.Errorf("blank-threshold must be a percentage above 0 and up to 100")
+	}
+
+	if s.SplitEvery < 0 {
+		return fmt.Errorf("Split size must not be negative")
+	}
+
+	if s.ExpectPages > 0 && s.ExpectSheets > 0 {
+		return fmt.Errorf("expect-pages and expect-sheets can not be combined")
+	}
+
+	switch s.Source {
+	case sourceADF, sourceFlatbed:
+	default:
+		return fmt.Errorf("Invalid source %q (supported: adf, flatbed)", s.Source)
+	}
+
+	if s.Source == sourceFlatbed && (s.Duplex || s.ExpectSheets > 1 || s.ExpectPages > 1) {
+		return fmt.Errorf("The flatbed scans one side of one page, source flatbed can not be combined with duplex, expect-pages or expect-sheets, use a session to scan several pages")
+	}
+
+	switch s.PageCountMismatch {
+	case pageCountWarn, pageCountFail:
+	default:
+		return fmt.Errorf("Invalid page-count-mismatch %q (supported: warn, fail)", s.PageCountMismatch)
+	}
+
+	if s.PDFA && s.Cover {
+		return fmt.Errorf("Cover sheets use fonts not embedded into the PDF which PDF/A does not allow, pdfa and cover can not be combined")
+	}
+
+	if s.PDFA && s.PageNumbers {
+		return fmt.Errorf("Page numbers use fonts not embedded into the PDF which PDF/A does not allow, pdfa and page-numbers can not be combined")
+	}
+
+	if s.PDFA && s.Pipeline.Contains("stamp") {
+		return fmt.Errorf("Stamps use fonts not embedded into the PDF which PDF/A does not allow, pdfa and the stamp step can not be combined")
+	}
+
+	for _, step := range s.Pipeline {
+		if s.PDFA && step.Name == "watermark" && step.Options["text"] != "" {
+			return fmt.Errorf("Text watermarks use fonts not embedded into the PDF which PDF/A does not allow, pdfa and a watermark text can not be combined")
+		}
+	}
+
+	if s.Optimize && s.Password != "" {
+		return fmt.Errorf("Encrypted documents can not be rewritten, optimize and password can not be combined")
+	}
+
+	if s.DuplexSplit && (!s.Duplex || s.SplitEvery > 0) {
+		return fmt.Errorf("duplex-split requires duplex and can not be combined with split-every")
+	}
+
+	if s.Existing != nil && (s.Cover || s.PDFA || s.PageNumbers || s.Password != "" || s.Optimize || s.SplitEvery > 0 || s.DuplexSplit) {
+		return fmt.Errorf("Pages added to a posted PDF can not be combined with cover, pdfa, page-numbers, password, optimize, split-every or duplex-split")
+	}
+
+	if (s.Photo || s.Card) && (s.Color == scanner.ColorModeBW || s.Color == scanner.ColorModeAutoBW || s.Cover || s.PDFA || s.PageNumbers || s.Password != "" || s.SplitEvery > 0 || s.DuplexSplit || s.Existing != nil) {
+		return fmt.Errorf("Photos and cards are delivered as image files, photo and card can not be combined with bw colors, cover, pdfa, page-numbers, password, split-every, duplex-split or merge")
+	}
+
+	if (s.Photo && s.Card) || (s.Receipt && (s.Photo || s.Card)) {
+		return fmt.Errorf("Only one of photo, card and receipt can be used")
+	}
+
+	if s.MaxSize > 0 && (s.Photo || s.Card || s.Stream) {
+		return fmt.Errorf("max-size applies to the documents generated after the scan, it can not be combined with photo, card or stream")
+	}
+
+	if s.Card && !s.Pipeline.Contains("ocr") {
+		return fmt.Errorf("card requires the ocr step in the pipeline to recognize the contacts")
+	}
+
+	if s.Receipt && (s.SplitEvery > 0 || s.DuplexSplit || s.Existing != nil) {
+		return fmt.Errorf("Every receipt gets a PDF of its own, receipt can not be combined with split-every, duplex-split or merge")
+	}
+
+	if s.Receipt && !s.Pipeline.Contains("ocr") {
+		return fmt.Errorf("receipt requires the ocr step in the pipeline to recognize the expenses")
+	}
+
+	if s.PDFA && s.Password != "" {
+		return fmt.Errorf("PDF/A does not allow encryption, pdfa and password can not be combined")
+	}
+
+	if pdfSigner != nil && (s.Password != "" || s.Stream) {
+		return fmt.Errorf("Documents are signed (--sign-cert) once they are complete and unencrypted, password and stream can not be used")
+	}
+
+	if s.Archive && !haveArchiveTargets() {
+		return fmt.Errorf("archive requires a route with archive_targets in --targets")
+	}
+
+	if s.OCRLang != "" && s.OCRLang != ocrLangAuto && !ocrLangPattern.MatchString(s.OCRLang) {
+		return fmt.Errorf("Invalid OCR languages %q (e.g. deu+eng or auto)", s.OCRLang)
+	}
+
+	if s.OCRLang != "" && !s.OCROverlay && !s.Pipeline.Contains("ocr") {
+		return fmt.Errorf("ocr-lang requires the ocr step in the pipeline or ocr-overlay")
+	}
+
+	if s.OCROSD && !s.Pipeline.Contains("ocr") {
+		return fmt.Errorf("ocr-osd requires the ocr step in the pipeline")
+	}
+
+	if s.OCROverlay && !featureOCR {
+		return fmt.Errorf("ocr-overlay is not available in this build (built with -tags noocr)")
+	}
+
+	if s.JPEGQuality < 1 || s.JPEGQuality > 100 {
+		return fmt.Errorf("JPEG quality must be between 1 and 100")
+	}
+
+	if s.Sharpen < 0 || s.Sharpen > 500 {
+		return fmt.Errorf("Sharpen must be between 0 and 500")
+	}
+
+	if s.Contrast < -100 || s.Contrast > 100 {
+		return fmt.Errorf("Contrast must be between -100 and 100")
+	}
+
+	return nil
+}
+
+// coverSheet returns the cover sheet for a document of the given
+// number of pages belonging to this job
+func (s scanParams) coverSheet(pages int) coverSheet {
+	c := coverSheet{
+		Title:   s.Info.Title,
+		Created: s.Info.CreationDate,
+		Profile: s.Profile,
+		JobID:   s.JobID,
+		Pages:   pages,
+		User:    s.User,
+		Text:    s.CoverText,
+		QR:      s.JobID,
+	}
+
+	if c.Created.IsZero() {
+		c.Created = time.Now()
+	}
+
+	if cfg.PublicURL != "" && storage != nil {
+		c.QR = strings.TrimRight(cfg.PublicURL, "/") + "/scans/" + s.JobID
+	}
+
+	return c
+}
+
+// scannerOptions returns the SANE options to apply for this request
+func (s scanParams) scannerOptions() map[string]interface{} {
+	opts := map[string]interface{}{}
+	for k, v := range defaultScannerOptions() {
+		opts[k] = v
+	}
+	for k, v := range s.Options {
+		opts[k] = v
+	}
+
+	opts["resolution"] = s.ScanDPI
+	if s.Depth == 16 {
+		opts["depth"] = s.Depth
+	}
+
+	switch {
+	case s.Color == scanner.ColorModeColor, s.Color == scanner.ColorModeAuto, s.Color == scanner.ColorModeAutoBW:
+		// The auto modes decide per page after scanning in color
+		opts["mode"] = "Color"
+	case s.Pipeline.Contains("dropout"):
+		// The colors to drop are needed, the page is converted to gray or
+		// bw after the pipeline
+		opts["mode"] = "Color"
+	default:
+		// Binarization is done in software to be able to use an adaptive
+		// threshold instead of the fixed hardware one of "Lineart"
+		opts["mode"] = "Gray"
+	}
+
+	if _, ok := opts["swskip"]; ok && s.BlankPages != blankPagesScanner {
+		// Pages skipped by the scanner would shift the back sides
+		opts["swskip"] = 0.0
+	}
+
+	if s.Photo {
+		// Photos keep their tones and fine details
+		for _, k := range []string{"brightness", "swdespeck"} {
+			if _, ok := opts[k]; ok {
+				opts[k] = 0
+			}
+		}
+	}
+
+	if s.Card {
+		// Cards are centered in the feeder, the area is cropped to the
+		// card by the pipeline
+		for _, k := range []string{"page-width", "page-height", "br-x", "br-y"} {
+			if _, ok := opts[k]; ok {
+				opts[k] = cardScanArea
+			}
+		}
+	}
+
+	switch {
+	case s.Source == sourceFlatbed:
+		opts["source"] = scanner.SourceFlatbed
+	case s.Duplex:
+		opts["source"] = "ADF Duplex"
+	default:
+		opts["source"] = "ADF Front"
+	}
+
+	return opts
+}
+
+// pipeline returns the processing pipeline followed by the sharpen and
+// contrast adjustments of the request, which apply to the scaled page
+func (s scanParams) pipeline() scanner.Pipeline {
+	pipeline := s.Pipeline
+	if s.OCRLang != "" || s.OCROSD {
+		// The request overrides the options of the ocr steps
+		pipeline = append(scanner.Pipeline{}, pipeline...)
+		for i, step := range pipeline {
+			if o, ok := step.Step.(ocrStep); ok {
+				opts := map[string]string{}
+				for k, v := range step.Options {
+					opts[k] = v
+				}
+				if s.OCRLang != "" {
+					o.lang, opts["lang"] = s.OCRLang, s.OCRLang
+				}
+				if s.OCROSD {
+					o.osd, opts["osd"] = true, "true"
+				}
+				pipeline[i].Step, pipeline[i].Options = o, opts
+			}
+		}
+	}
+
+	steps := []string{}
+	if s.Contrast != 0 {
+		steps = append(steps, fmt.Sprintf("contrast percent=%d", s.Contrast))
+	}
+	if s.Sharpen != 0 {
+		steps = append(steps, fmt.Sprintf("sharpen amount=%g", float64(s.Sharpen)/100))
+	}
+	if len(steps) == 0 {
+		return pipeline
+	}
+
+	// The values are checked by validate
+	adjust, _ := scanner.ParsePipeline(strings.Join(steps, ", "))
+	return append(append(scanner.Pipeline{}, pipeline...), adjust...)
+}
+
+// logger returns the log entry carrying the IDs of the job and the
+// request scanning it
+func (s scanParams) logger() *log.Entry {
+	fields := log.Fields{"job_id": s.JobID}
+	if s.RequestID != "" {
+		fields["request_id"] = s.RequestID
+	}
+	return log.WithFields(fields)
+}
+
+// processor returns the image processing to apply for this request
+func (s scanParams) processor() scanner.Processor {
+	pageHeight, _ := defaultScannerOptions()["page-height"].(float64)
+
+	return scanner.ImageProcessor{
+		Color:                s.Color,
+		Duplex:               s.Duplex,
+		RotateBack:           s.RotateBack,
+		ScanDPI:              s.ScanDPI,
+		OutputDPI:            s.PDFDPI,
+		Pipeline:             s.pipeline(),
+		JPEGQuality:          s.JPEGQuality,
+		Lossless:             s.Lossless,
+		KeepOriginal:         s.Archive || s.RawFrames,
+		RemoveBlankBacks:     s.BlankPages == blankPagesBacks,
+		BlankThreshold:       s.BlankThreshold,
+		KeepImage:            s.OCROverlay || s.Calibration,
+		KeepFirstImage:       needsBarcodes(),
+		Ops:                  imageOps,
+		Layout:               s.layout(),
+		MisfeedSkewThreshold: cfg.MisfeedSkewThreshold,
+		PageHeightMM:         pageHeight,
+		MisfeedCorners:       cfg.MisfeedCorners,
+		Spool:                pageSpool,
+		ColorProfile:         s.conversionProfile(),
+	}
+}
+
+// conversionProfile returns the profile to convert the pages to sRGB
+// with, nil to keep the colors of the scanner
+func (s scanParams) conversionProfile() *scanner.ColorProfile {
+	if !cfg.ICCConvert || s.Calibration || s.Depth == 16 {
+		// The conversion creates 8 bit pages, 16 bit pages get the profile
+		// embedded instead
+		return nil
+	}
+	return colorProfile
+}
+
+// iccProfile returns the profile to embed for the color pages, nil if
+// there is none or the pages were converted to sRGB
+func (s scanParams) iccProfile() []byte {
+	if colorProfile == nil || (cfg.ICCConvert && s.Depth != 16) {
+		return nil
+	}
+	return colorProfile.Data()
+}
+
+// layout returns the placement of the pages on A4 pages
+func (s scanParams) layout() pdfgen.Layout {
+	return pdfgen.Layout{Placement: s.PDFPlacement, Margin: pdfgen.MMToPt(s.PDFMargin)}
+}
+
+// pdfOptions returns the options of new documents of the scan
+func (s scanParams) pdfOptions() pdfgen.Options {
+	info := s.Info
+	info.Creator = "scansnap-go " + version
+	info.Producer = "scansnap-go " + version
+	if info.CreationDate.IsZero() {
+		info.CreationDate = time.Now()
+	}
+
+	return pdfgen.Options{PDFA: s.PDFA, Info: info, Password: s.Password, ICCProfile: s.iccProfile()}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+)
+
+// photoDefaults are the parameters of photo scans not given by the
+// request or its profile: full resolution, keeping every page and
+// cropping the photo to its edges
+var photoDefaults = map[string]string{
+	"blank-pages": blankPagesKeep,
+	"color":       scanner.ColorModeColor,
+	"duplex":      "false",
+	"lossless":    "true",
+	"pdf-dpi":     "600",
+	"pipeline":    "crop margin=0",
+	"quality":     "100",
+	"scan-dpi":    "600",
+}
+
+// applyModeDefaults sets the parameters of a scan mode not given by
+// the request or its profile
+func applyModeDefaults(q url.Values, defaults map[string]string) {
+	for k, v := range defaults {
+		if q.Get(k) == "" {
+			q.Set(k, v)
+		}
+	}
+}
+
+// writePhotoZIP writes the pages as image files into a ZIP archive, the
+// images are stored as encoded without converting them again
+func writePhotoZIP(w io.Writer, params *scanParams, pages []*scanner.Page, base string) error {
+	var (
+		zw   = zip.NewWriter(w)
+		meta = imageMetadata(params)
+	)
+
+	for i, p := range pages {
+		if err := addZIPImage(zw, fmt.Sprintf("%s_%03d", base, i+1), p, meta); err != nil {
+			return fmt.Errorf("Unable to add photo %d to archive: %s", i+1, err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("Unable to finalize archive: %s", err)
+	}
+
+	return nil
+}
+
+// addZIPImage stores the encoded image of the page as name with the
+// extension of its type and the capture metadata embedded
+func addZIPImage(zw *zip.Writer, name string, p *scanner.Page, meta scanner.ImageMetadata) error {
+	ext := ".png"
+	if p.ImageType == "jpeg" {
+		ext = ".jpg"
+	}
+
+	data, err := pageImageData(p, meta)
+	if err != nil {
+		return err
+	}
+
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name: name + ext,
+		// The images are compressed already
+		Method:   zip.Store,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = fw.Write(data)
+	return err
+}
+
+// imageMetadata describes the capture of the scan for the image files
+// produced from its pages, the resolution is set per page
+func imageMetadata(params *scanParams) scanner.ImageMetadata {
+	meta := scanner.ImageMetadata{Time: time.Now(), Software: "scansnap-go " + version}
+	if params.Meta != nil {
+		meta.Time = params.Meta.Created
+	}
+	if s, err := optionSnapshots.Get(params.JobID); err == nil {
+		meta.Make, meta.Model = s.Device.Vendor, s.Device.Model
+	}
+	return meta
+}
+
+// pageImageData returns the encoded image of the page with the capture
+// metadata embedded
+func pageImageData(p *scanner.Page, meta scanner.ImageMetadata) ([]byte, error) {
+	data, err := p.ImageData()
+	if err != nil {
+		return nil, err
+	}
+
+	meta.DPI = p.DPI
+	if data, err = scanner.EmbedMetadata(p.ImageType, data, meta); err != nil {
+		return nil, fmt.Errorf("Unable to embed image metadata: %s", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,238 @@
+package pdfgen
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Document is an existing PDF to add pages to using NewAppendWriter
+type Document struct {
+	data     []byte
+	xref     int // offset of the newest cross-reference section
+	size     int
+	catalog  pdfDict
+	pagesID  int
+	pages    pdfDict
+	infoRaw  []byte
+	fileID   []byte
+	trailer  pdfDict
+	outlines bool
+
+	// firstPageID and firstPage locate the first page of the document
+	// for annotations, 0 if the page tree has no pages
+	firstPageID int
+	firstPage   pdfDict
+	reader      *pdfReader
+
+	// Pages is the number of pages of the document
+	Pages int
+}
+
+// ReadDocument parses the existing document, it must not be encrypted
+func ReadDocument(data []byte) (*Document, error) {
+	start := bytes.LastIndex(data, []byte("startxref"))
+	if !bytes.HasPrefix(data, []byte("%PDF-")) || start < 0 {
+		return nil, fmt.Errorf("not a PDF document")
+	}
+
+	l := &pdfLexer{data: data, pos: start + len("startxref")}
+	xref, err := l.int()
+	if err != nil {
+		return nil, fmt.Errorf("invalid startxref: %s", err)
+	}
+
+	r := &pdfReader{data: data, xref: map[int]xrefEntry{}, streams: map[int]*objectStream{}}
+	trailer, err := r.readXRef(xref)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read cross-reference table: %s", err)
+	}
+
+	if trailer.get("Encrypt") != nil {
+		return nil, fmt.Errorf("encrypted documents are not supported")
+	}
+
+	d := &Document{data: data, xref: xref, infoRaw: trailer.raw["Info"], trailer: trailer}
+	if d.size, _ = asInt(trailer.get("Size")); d.size < 1 || d.size > maxObjects+1 {
+		return nil, fmt.Errorf("invalid size in trailer")
+	}
+	if ids, ok := trailer.get("ID").(pdfArray); ok && len(ids) == 2 {
+		if id, ok := ids[0].(pdfRaw); ok {
+			d.fileID = id
+		}
+	}
+
+	v, err := r.resolve(trailer.get("Root"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read catalog: %s", err)
+	}
+	var ok bool
+	if d.catalog, ok = v.(pdfDict); !ok {
+		return nil, fmt.Errorf("document has no catalog")
+	}
+	d.outlines = d.catalog.get("Outlines") != nil
+
+	pagesRef, ok := d.catalog.ref("Pages")
+	if !ok || pagesRef.Gen != 0 || pagesRef.ID < 1 || pagesRef.ID >= d.size {
+		return nil, fmt.Errorf("unsupported page tree reference")
+	}
+	d.pagesID = pagesRef.ID
+	if v, err = r.object(pagesRef.ID); err != nil {
+		return nil, fmt.Errorf("unable to read page tree: %s", err)
+	}
+	if d.pages, ok = v.(pdfDict); !ok || d.pages.name("Type") != "Pages" {
+		return nil, fmt.Errorf("document has no page tree")
+	}
+	if d.Pages, ok = asInt(d.pages.get("Count")); !ok {
+		return nil, fmt.Errorf("page tree has no page count")
+	}
+
+	d.reader = r
+	d.firstPageID, d.firstPage = r.firstPage(d.pages)
+	if d.firstPageID >= d.size {
+		// The page is rewritten by updates, it must be in the table
+		d.firstPageID, d.firstPage = 0, pdfDict{}
+	}
+
+	return d, nil
+}
+
+// firstPage follows the first kids of the page tree to its first page,
+// 0 is returned if there is none
+func (r *pdfReader) firstPage(node pdfDict) (int, pdfDict) {
+	// The depth is limited to not loop on malformed trees
+	for depth := 0; depth < 32; depth++ {
+		kids, ok := node.get("Kids").(pdfArray)
+		if !ok || len(kids) == 0 {
+			return 0, pdfDict{}
+		}
+		ref, ok := kids[0].(pdfRef)
+		if !ok {
+			return 0, pdfDict{}
+		}
+		v, err := r.object(ref.ID)
+		if err != nil {
+			return 0, pdfDict{}
+		}
+		if node, ok = v.(pdfDict); !ok {
+			return 0, pdfDict{}
+		}
+		if node.name("Type") == "Page" {
+			return ref.ID, node
+		}
+	}
+	return 0, pdfDict{}
+}
+
+// NewAppendWriter copies the document to w and adds the pages as an
+// incremental update which leaves the existing objects untouched. With
+// prepend the new pages are placed before the existing ones. Options
+// are not supported, the document keeps its metadata.
+func NewAppendWriter(w io.Writer, doc *Document, prepend bool) *Writer {
+	p := newUpdateWriter(w, doc)
+	p.prepend = prepend
+	p.pagesID = p.allocObject()
+	return p
+}
+
+// newUpdateWriter copies the document to w to write an incremental
+// update of it
+func newUpdateWriter(w io.Writer, doc *Document) *Writer {
+	p := &Writer{
+		w:        bufio.NewWriter(w),
+		fileID:   make([]byte, 16),
+		existing: doc,
+	}
+	rand.Read(p.fileID)
+
+	p.write(doc.data)
+	if !bytes.HasSuffix(doc.data, []byte("\n")) {
+		p.printf("\n")
+	}
+
+	// Object numbers of the document are kept, only rewritten ones get
+	// an offset in the update
+	p.offsets = make([]int64, doc.size-1)
+	for i := range p.offsets {
+		p.offsets[i] = -1
+	}
+
+	return p
+}
+
+// closeAppend writes the new root of the page tree containing the
+// page tree of the document and the added pages
+func (p *Writer) closeAppend() error {
+	var (
+		doc  = p.existing
+		kids = []string{}
+	)
+	for _, id := range p.pageIDs {
+		kids = append(kids, fmt.Sprintf("%d 0 R", id))
+	}
+	existing := fmt.Sprintf("%d 0 R", doc.pagesID)
+	if p.prepend {
+		kids = append(kids, existing)
+	} else {
+		kids = append([]string{existing}, kids...)
+	}
+
+	p.writeObject(p.pagesID, fmt.Sprintf("/Type /Pages /Kids [%s] /Count %d", strings.Join(kids, " "), doc.Pages+len(p.pageIDs)), nil)
+	p.writeObject(doc.pagesID, doc.pages.String("Parent")+fmt.Sprintf(" /Parent %d 0 R", p.pagesID), nil)
+
+	catalog := doc.catalog.String("Pages") + fmt.Sprintf(" /Pages %d 0 R", p.pagesID)
+	if !doc.outlines {
+		if outlines := p.writeOutlines(); outlines != 0 {
+			catalog += fmt.Sprintf(" /Outlines %d 0 R", outlines)
+			if doc.catalog.get("PageMode") == nil {
+				catalog += " /PageMode /UseOutlines"
+			}
+		}
+	}
+	catalogID := p.allocObject()
+	p.writeObject(catalogID, catalog, nil)
+
+	return p.closeUpdate(catalogID)
+}
+
+// closeUpdate writes the cross-reference section of the objects written
+// by the update with the new catalog and flushes the document
+func (p *Writer) closeUpdate(catalogID int) error {
+	doc := p.existing
+	trailer := fmt.Sprintf("/Size %d /Root %d 0 R", len(p.offsets)+1, catalogID)
+	if doc.infoRaw != nil {
+		trailer += " /Info " + string(doc.infoRaw)
+	}
+	firstID := doc.fileID
+	if firstID == nil {
+		firstID = []byte(fmt.Sprintf("<%x>", p.fileID))
+	}
+	trailer += fmt.Sprintf(" /ID [%s <%x>] /Prev %d", firstID, p.fileID, doc.xref)
+
+	// Subsections of consecutive objects written by the update
+	xref := p.written
+	p.printf("xref\n")
+	for id := 1; id <= len(p.offsets); {
+		if p.offsets[id-1] < 0 {
+			id++
+			continue
+		}
+		end := id
+		for end <= len(p.offsets) && p.offsets[end-1] >= 0 {
+			end++
+		}
+		p.printf("%d %d\n", id, end-id)
+		for ; id < end; id++ {
+			p.printf("%010d 00000 n \n", p.offsets[id-1])
+		}
+	}
+	p.printf("trailer\n<<%s>>\nstartxref\n%d\n%%%%EOF\n", trailer, xref)
+
+	if p.err != nil {
+		return p.err
+	}
+	return p.w.Flush()
+}
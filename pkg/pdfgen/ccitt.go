@@ -0,0 +1,210 @@
+package pdfgen
+
+import (
+	"image"
+	"strings"
+)
+
+// Encoder for CCITT Group 4 (ITU-T T.6) compressed bilevel images as
+// understood by the CCITTFaxDecode filter with /K -1. Text pages end
+// up at a fraction of the size of a JPEG or Flate encoded page.
+
+type faxCode struct {
+	bits uint32
+	len  uint
+}
+
+func mkFaxCode(s string) faxCode {
+	c := faxCode{len: uint(len(s))}
+	for _, b := range s {
+		c.bits <<= 1
+		if b == '1' {
+			c.bits |= 1
+		}
+	}
+	return c
+}
+
+func mkFaxCodes(s string) []faxCode {
+	codes := []faxCode{}
+	for _, f := range strings.Fields(s) {
+		codes = append(codes, mkFaxCode(f))
+	}
+	return codes
+}
+
+var (
+	faxPass  = mkFaxCode("0001")
+	faxHoriz = mkFaxCode("001")
+	// Vertical mode codes indexed by b1 - a1 + 3 (VR3 ... V0 ... VL3)
+	faxVertical = mkFaxCodes("0000011 000011 011 1 010 000010 0000010")
+	faxEOFB     = []faxCode{mkFaxCode("000000000001"), mkFaxCode("000000000001")}
+
+	// Terminating codes for run lengths 0-63
+	faxWhiteTerm = mkFaxCodes(`
+		00110101 000111 0111 1000 1011 1100 1110 1111
+		10011 10100 00111 01000 001000 000011 110100 110101
+		101010 101011 0100111 0001100 0001000 0010111 0000011 0000100
+		0101000 0101011 0010011 0100100 0011000 00000010 00000011 00011010
+		00011011 00010010 00010011 00010100 00010101 00010110 00010111 00101000
+		00101001 00101010 00101011 00101100 00101101 00000100 00000101 00001010
+		00001011 01010010 01010011 01010100 01010101 00100100 00100101 01011000
+		01011001 01011010 01011011 01001010 01001011 00110010 00110011 00110100`)
+	faxBlackTerm = mkFaxCodes(`
+		0000110111 010 11 10 011 0011 0010 00011
+		000101 000100 0000100 0000101 0000111 00000100 00000111 000011000
+		0000010111 0000011000 0000001000 00001100111 00001101000 00001101100 00000110111 00000101000
+		00000010111 00000011000 000011001010 000011001011 000011001100 000011001101 000001101000 000001101001
+		000001101010 000001101011 000011010010 000011010011 000011010100 000011010101 000011010110 000011010111
+		000001101100 000001101101 000011011010 000011011011 000001010100 000001010101 000001010110 000001010111
+		000001100100 000001100101 000001010010 000001010011 000000100100 000000110111 000000111000 000000100111
+		000000101000 000001011000 000001011001 000000101011 000000101100 000001011010 000001100110 000001100111`)
+
+	// Make-up codes for run lengths 64-1728 (multiples of 64)
+	faxWhiteMakeup = mkFaxCodes(`
+		11011 10010 010111 0110111 00110110 00110111 01100100 01100101
+		01101000 01100111 011001100 011001101 011010010 011010011 011010100 011010101
+		011010110 011010111 011011000 011011001 011011010 011011011 010011000 010011001
+		010011010 011000 010011011`)
+	faxBlackMakeup = mkFaxCodes(`
+		0000001111 000011001000 000011001001 000001011011 000000110011 000000110100 000000110101 0000001101100
+		0000001101101 0000001001010 0000001001011 0000001001100 0000001001101 0000001110010 0000001110011 0000001110100
+		0000001110101 0000001110110 0000001110111 0000001010010 0000001010011 0000001010100 0000001010101 0000001011010
+		0000001011011 0000001100100 0000001100101`)
+	// Extended make-up codes for run lengths 1792-2560 shared by both colors
+	faxExtMakeup = mkFaxCodes(`
+		00000001000 00000001100 00000001101 000000010010 000000010011 000000010100 000000010101
+		000000010110 000000010111 000000011100 000000011101 000000011110 000000011111`)
+)
+
+type faxBitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (w *faxBitWriter) put(c faxCode) {
+	w.acc = w.acc<<c.len | uint64(c.bits)
+	w.nbits += c.len
+	for w.nbits >= 8 {
+		w.nbits -= 8
+		w.buf = append(w.buf, byte(w.acc>>w.nbits))
+	}
+}
+
+func (w *faxBitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		w.buf = append(w.buf, byte(w.acc<<(8-w.nbits)))
+		w.nbits = 0
+	}
+	return w.buf
+}
+
+// putRun writes a run length using the make-up and terminating codes
+// of the given color
+func (w *faxBitWriter) putRun(run int, black bool) {
+	term, makeup := faxWhiteTerm, faxWhiteMakeup
+	if black {
+		term, makeup = faxBlackTerm, faxBlackMakeup
+	}
+
+	for run >= 2560+64 {
+		w.put(faxExtMakeup[len(faxExtMakeup)-1])
+		run -= 2560
+	}
+
+	if run >= 64 {
+		k := run / 64
+		if k <= len(makeup) {
+			w.put(makeup[k-1])
+		} else {
+			w.put(faxExtMakeup[k-len(makeup)-1])
+		}
+		run -= k * 64
+	}
+
+	w.put(term[run])
+}
+
+// findDiff returns the position of the first pixel at or after start
+// not having the given color, or the line length if there is none
+func findDiff(line []bool, start int, black bool) int {
+	for i := start; i < len(line); i++ {
+		if line[i] != black {
+			return i
+		}
+	}
+	return len(line)
+}
+
+func findDiff2(line []bool, start int, black bool) int {
+	if start >= len(line) {
+		return len(line)
+	}
+	return findDiff(line, start, black)
+}
+
+// EncodeCCITTG4 encodes the image treating palette index 0 as black
+// and everything else as white
+func EncodeCCITTG4(img *image.Paletted) []byte {
+	var (
+		b       = img.Bounds()
+		width   = b.Dx()
+		w       = &faxBitWriter{}
+		ref     = make([]bool, width) // imaginary all-white line above the image
+		cur     = make([]bool, width)
+		isBlack = func(line []bool, x int) bool { return x < len(line) && line[x] }
+	)
+
+	for y := 0; y < b.Dy(); y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+width]
+		for x, v := range row {
+			cur[x] = v == 0
+		}
+
+		a0 := 0
+		a1 := findDiff(cur, 0, false)
+		b1 := findDiff(ref, 0, false)
+
+		for {
+			b2 := findDiff2(ref, b1, isBlack(ref, b1))
+			if b2 >= a1 {
+				d := b1 - a1
+				if d < -3 || d > 3 {
+					// Horizontal mode
+					a2 := findDiff2(cur, a1, isBlack(cur, a1))
+					w.put(faxHoriz)
+					firstBlack := a0+a1 != 0 && isBlack(cur, a0)
+					w.putRun(a1-a0, firstBlack)
+					w.putRun(a2-a1, !firstBlack)
+					a0 = a2
+				} else {
+					// Vertical mode
+					w.put(faxVertical[d+3])
+					a0 = a1
+				}
+			} else {
+				// Pass mode
+				w.put(faxPass)
+				a0 = b2
+			}
+
+			if a0 >= width {
+				break
+			}
+
+			color := isBlack(cur, a0)
+			a1 = findDiff(cur, a0, color)
+			b1 = findDiff(ref, a0, !color)
+			b1 = findDiff(ref, b1, color)
+		}
+
+		ref, cur = cur, ref
+	}
+
+	for _, c := range faxEOFB {
+		w.put(c)
+	}
+
+	return w.bytes()
+}
@@ -0,0 +1,234 @@
+package pdfgen
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// faxDecoder decodes CCITT G4 data using the code tables of the
+// encoder, it is only meant to check the encoder against
+type faxDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *faxDecoder) bit() (byte, error) {
+	if d.pos >= len(d.data)*8 {
+		return 0, fmt.Errorf("unexpected end of data")
+	}
+	b := d.data[d.pos/8] >> (7 - uint(d.pos%8)) & 1
+	d.pos++
+	return b, nil
+}
+
+// code reads bits until they form one of the codes and returns its
+// index in the list of tables
+func (d *faxDecoder) code(tables ...[]faxCode) (int, int, error) {
+	var c faxCode
+	for c.len < 14 {
+		b, err := d.bit()
+		if err != nil {
+			return 0, 0, err
+		}
+		c.bits, c.len = c.bits<<1|uint32(b), c.len+1
+
+		for t, table := range tables {
+			for i, code := range table {
+				if code == c {
+					return t, i, nil
+				}
+			}
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid code at bit %d", d.pos)
+}
+
+func (d *faxDecoder) run(black bool) (int, error) {
+	term, makeup := faxWhiteTerm, faxWhiteMakeup
+	if black {
+		term, makeup = faxBlackTerm, faxBlackMakeup
+	}
+
+	run := 0
+	for {
+		t, i, err := d.code(term, makeup, faxExtMakeup)
+		if err != nil {
+			return 0, err
+		}
+		switch t {
+		case 0:
+			return run + i, nil
+		case 1:
+			run += (i + 1) * 64
+		default:
+			run += (i + 28) * 64
+		}
+	}
+}
+
+// changingElement returns the position of the first pixel after start
+// having the given color while the one before does not
+func changingElement(line []bool, start int, black bool) int {
+	for i := start + 1; i < len(line); i++ {
+		prev := i > 0 && line[i-1]
+		if line[i] == black && prev != black {
+			return i
+		}
+	}
+	return len(line)
+}
+
+// decodeCCITTG4 decodes the lines up to the end of block, black pixels
+// are true
+func decodeCCITTG4(data []byte, width int) ([][]bool, error) {
+	var (
+		d     = &faxDecoder{data: data}
+		ref   = make([]bool, width)
+		lines [][]bool
+		modes = []faxCode{faxPass, faxHoriz, faxEOFB[0]}
+	)
+
+	for {
+		var (
+			cur   = make([]bool, width)
+			a0    = -1
+			black = false
+		)
+		fill := func(to int, black bool) error {
+			if to > width || to < a0 {
+				return fmt.Errorf("line %d: run to %d out of range", len(lines), to)
+			}
+			for x := a0; x < to; x++ {
+				if x >= 0 {
+					cur[x] = black
+				}
+			}
+			return nil
+		}
+
+		for a0 < width {
+			b1 := changingElement(ref, a0, !black)
+			b2 := changingElement(ref, b1, black)
+
+			t, i, err := d.code(modes, faxVertical)
+			if err != nil {
+				return nil, err
+			}
+
+			switch {
+			case t == 0 && i == 0: // Pass
+				if err = fill(b2, black); err != nil {
+					return nil, err
+				}
+				a0 = b2
+
+			case t == 0 && i == 1: // Horizontal
+				if a0 < 0 {
+					a0 = 0
+				}
+				r1, err := d.run(black)
+				if err != nil {
+					return nil, err
+				}
+				r2, err := d.run(!black)
+				if err != nil {
+					return nil, err
+				}
+				if err = fill(a0+r1, black); err != nil {
+					return nil, err
+				}
+				a0 += r1
+				if err = fill(a0+r2, !black); err != nil {
+					return nil, err
+				}
+				a0 += r2
+
+			case t == 0: // End of block
+				if a0 != -1 {
+					return nil, fmt.Errorf("end of block within line %d", len(lines))
+				}
+				if _, _, err = d.code(modes); err != nil {
+					return nil, err
+				}
+				return lines, nil
+
+			default: // Vertical
+				a1 := b1 - (i - 3)
+				if err = fill(a1, black); err != nil {
+					return nil, err
+				}
+				a0, black = a1, !black
+			}
+		}
+
+		lines = append(lines, cur)
+		ref = cur
+	}
+}
+
+// faxImage returns a bilevel image with black pixels where black
+// returns true
+func faxImage(width, height int, black func(x, y int) bool) *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{color.Black, color.White})
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if !black(x, y) {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	return img
+}
+
+func TestEncodeCCITTG4(t *testing.T) {
+	// Every line is coded as V0 followed by the end of block
+	out := EncodeCCITTG4(faxImage(8, 3, func(x, y int) bool { return false }))
+	if exp := []byte{0xE0, 0x02, 0x00, 0x20}; !bytes.Equal(out, exp) {
+		t.Errorf("expected %x for a white image, got %x", exp, out)
+	}
+}
+
+func TestEncodeCCITTG4RoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	for name, tc := range map[string]struct {
+		width, height int
+		black         func(x, y int) bool
+	}{
+		"single pixel":  {1, 1, func(x, y int) bool { return true }},
+		"white":         {64, 4, func(x, y int) bool { return false }},
+		"black":         {64, 4, func(x, y int) bool { return true }},
+		"noise":         {7, 50, func(x, y int) bool { return rnd.Intn(2) == 0 }},
+		"wide noise":    {1800, 20, func(x, y int) bool { return rnd.Intn(8) == 0 }},
+		"checkerboard":  {33, 33, func(x, y int) bool { return (x+y)%2 == 0 }},
+		"stripes":       {100, 30, func(x, y int) bool { return (x/3+y/5)%2 == 0 }},
+		"diagonal":      {200, 200, func(x, y int) bool { return x >= y-2 && x <= y+2 }},
+		"first pixel":   {20, 3, func(x, y int) bool { return x == 0 }},
+		"last pixel":    {20, 3, func(x, y int) bool { return x == 19 }},
+		"makeup runs":   {1800, 3, func(x, y int) bool { return x >= 70+y*500 && x < 1790-y*10 }},
+		"extended runs": {6000, 3, func(x, y int) bool { return x >= 2+y && x < 5990-y*700 }},
+	} {
+		t.Run(name, func(t *testing.T) {
+			img := faxImage(tc.width, tc.height, tc.black)
+
+			lines, err := decodeCCITTG4(EncodeCCITTG4(img), tc.width)
+			if err != nil {
+				t.Fatalf("decoding image: %s", err)
+			}
+			if len(lines) != tc.height {
+				t.Fatalf("expected %d lines, got %d", tc.height, len(lines))
+			}
+			for y, line := range lines {
+				for x, black := range line {
+					if exp := img.ColorIndexAt(x, y) == 0; black != exp {
+						t.Fatalf("pixel %d,%d: expected black=%v", x, y, exp)
+					}
+				}
+			}
+		})
+	}
+}
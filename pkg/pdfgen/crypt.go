@@ -0,0 +1,136 @@
+package pdfgen
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math/big"
+)
+
+// pdfPermissions allows everything once the document is opened
+const pdfPermissions int32 = -4
+
+// pdfMaxPasswordLength is the number of UTF-8 bytes of the password used
+// by revision 6
+const pdfMaxPasswordLength = 127
+
+// pdfEncryption implements the standard security handler revision 6
+// with 256 bit AES (AESV3) encryption of all strings and streams
+type pdfEncryption struct {
+	key    []byte
+	o, u   []byte
+	oe, ue []byte
+	perms  []byte
+}
+
+func newPDFEncryption(password string) *pdfEncryption {
+	e := &pdfEncryption{key: randomBytes(32)}
+
+	pw := []byte(password)
+	if len(pw) > pdfMaxPasswordLength {
+		pw = pw[:pdfMaxPasswordLength]
+	}
+
+	// There is no separate owner password: everybody knowing the
+	// password is allowed to do everything with the document
+	e.u, e.ue = e.passwordEntries(pw, nil)
+	e.o, e.oe = e.passwordEntries(pw, e.u)
+	e.perms = e.computePerms()
+	return e
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// passwordEntries computes the U and UE entries (O and OE using the U
+// entry as udata): the hash validating the password followed by its
+// salts and the file key encrypted using the hash of the key salt
+func (e *pdfEncryption) passwordEntries(pw, udata []byte) ([]byte, []byte) {
+	validationSalt, keySalt := randomBytes(8), randomBytes(8)
+
+	entry := append(append(hashR6(pw, validationSalt, udata), validationSalt...), keySalt...)
+
+	block, _ := aes.NewCipher(hashR6(pw, keySalt, udata))
+	encKey := make([]byte, len(e.key))
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(encKey, e.key)
+
+	return entry, encKey
+}
+
+// computePerms encrypts the permissions to detect them being altered
+func (e *pdfEncryption) computePerms() []byte {
+	plain, perms := make([]byte, 16), pdfPermissions
+	binary.LittleEndian.PutUint32(plain, uint32(perms))
+	binary.LittleEndian.PutUint32(plain[4:], 0xffffffff)
+	// Metadata is encrypted as well
+	copy(plain[8:], "Tadb")
+	copy(plain[12:], randomBytes(4))
+
+	block, _ := aes.NewCipher(e.key)
+	out := make([]byte, 16)
+	block.Encrypt(out, plain)
+	return out
+}
+
+// hashR6 is the hash of revision 6 (ISO 32000-2, algorithm 2.B): rounds
+// of AES-128 encryption and SHA-2 hashes chosen by the data encrypted
+func hashR6(pw, salt, udata []byte) []byte {
+	sum := sha256.Sum256(append(append(append([]byte{}, pw...), salt...), udata...))
+	k := sum[:]
+
+	var e []byte
+	for round := 0; round < 64 || int(e[len(e)-1]) > round-32; round++ {
+		seq := append(append(append([]byte{}, pw...), k...), udata...)
+		k1 := bytes.Repeat(seq, 64)
+
+		block, _ := aes.NewCipher(k[:16])
+		e = make([]byte, len(k1))
+		cipher.NewCBCEncrypter(block, k[16:32]).CryptBlocks(e, k1)
+
+		var h hash.Hash
+		switch new(big.Int).Mod(new(big.Int).SetBytes(e[:16]), big.NewInt(3)).Int64() {
+		case 0:
+			h = sha256.New()
+		case 1:
+			h = sha512.New384()
+		default:
+			h = sha512.New()
+		}
+		h.Write(e)
+		k = h.Sum(nil)
+	}
+
+	return k[:32]
+}
+
+// Dict returns the entries of the encryption dictionary
+func (e *pdfEncryption) Dict() string {
+	return fmt.Sprintf(
+		"/Filter /Standard /V 5 /R 6 /Length 256 /CF <</StdCF <</AuthEvent /DocOpen /CFM /AESV3 /Length 32>>>> /StmF /StdCF /StrF /StdCF /O <%x> /U <%x> /OE <%x> /UE <%x> /P %d /Perms <%x>",
+		e.o, e.u, e.oe, e.ue, pdfPermissions, e.perms,
+	)
+}
+
+// Encrypt encrypts a string or stream using AES-CBC with the file key
+// and a random IV prepended to the data
+func (e *pdfEncryption) Encrypt(data []byte) []byte {
+	block, _ := aes.NewCipher(e.key)
+
+	pad := aes.BlockSize - len(data)%aes.BlockSize
+	plain := append(append([]byte{}, data...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+
+	out := make([]byte, aes.BlockSize+len(plain))
+	rand.Read(out[:aes.BlockSize])
+	cipher.NewCBCEncrypter(block, out[:aes.BlockSize]).CryptBlocks(out[aes.BlockSize:], plain)
+
+	return out
+}
@@ -0,0 +1,136 @@
+package pdfgen
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// decryptKey decrypts the file key of the UE or OE entry like a reader
+// knowing the password
+func decryptKey(t *testing.T, pw, entry, encKey, udata []byte) []byte {
+	t.Helper()
+
+	block, err := aes.NewCipher(hashR6(pw, entry[40:48], udata))
+	if err != nil {
+		t.Fatalf("creating cipher: %s", err)
+	}
+	key := make([]byte, len(encKey))
+	cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(key, encKey)
+	return key
+}
+
+// decrypt reverses Encrypt using the file key
+func decrypt(t *testing.T, key, data []byte) []byte {
+	t.Helper()
+
+	if len(data) < 2*aes.BlockSize || len(data)%aes.BlockSize != 0 {
+		t.Fatalf("invalid length %d of encrypted data", len(data))
+	}
+	block, _ := aes.NewCipher(key)
+	plain := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, data[:aes.BlockSize]).CryptBlocks(plain, data[aes.BlockSize:])
+
+	pad := int(plain[len(plain)-1])
+	if pad < 1 || pad > aes.BlockSize || !bytes.Equal(plain[len(plain)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		t.Fatalf("invalid padding %x", plain[len(plain)-aes.BlockSize:])
+	}
+	return plain[:len(plain)-pad]
+}
+
+func TestPDFEncryptionPassword(t *testing.T) {
+	long := strings.Repeat("ü", 100)
+
+	for name, tc := range map[string]struct {
+		password, entered string
+	}{
+		"ascii":     {"secret", "secret"},
+		"unicode":   {"pässwörd €", "pässwörd €"},
+		"truncated": {long, long[:pdfMaxPasswordLength]},
+	} {
+		t.Run(name, func(t *testing.T) {
+			e := newPDFEncryption(tc.password)
+			pw := []byte(tc.entered)
+
+			for _, entries := range []struct {
+				name          string
+				entry, encKey []byte
+				udata         []byte
+			}{
+				{"user", e.u, e.ue, nil},
+				{"owner", e.o, e.oe, e.u},
+			} {
+				if len(entries.entry) != 48 || len(entries.encKey) != 32 {
+					t.Fatalf("invalid %s entry lengths %d / %d", entries.name, len(entries.entry), len(entries.encKey))
+				}
+				if !bytes.Equal(hashR6(pw, entries.entry[32:40], entries.udata), entries.entry[:32]) {
+					t.Errorf("%s password is not accepted", entries.name)
+				}
+				if bytes.Equal(hashR6([]byte("wrong"), entries.entry[32:40], entries.udata), entries.entry[:32]) {
+					t.Errorf("wrong %s password is accepted", entries.name)
+				}
+				if key := decryptKey(t, pw, entries.entry, entries.encKey, entries.udata); !bytes.Equal(key, e.key) {
+					t.Errorf("%s entry does not contain the file key", entries.name)
+				}
+			}
+		})
+	}
+}
+
+func TestPDFEncryptionPerms(t *testing.T) {
+	e := newPDFEncryption("secret")
+
+	block, _ := aes.NewCipher(e.key)
+	plain := make([]byte, 16)
+	block.Decrypt(plain, e.perms)
+
+	if p := int32(binary.LittleEndian.Uint32(plain)); p != pdfPermissions {
+		t.Errorf("expected permissions %d, got %d", pdfPermissions, p)
+	}
+	if string(plain[8:12]) != "Tadb" {
+		t.Errorf("expected encrypted metadata and the Perms marker, got %q", plain[8:12])
+	}
+}
+
+func TestPDFEncryptionRoundTrip(t *testing.T) {
+	e := newPDFEncryption("secret")
+
+	for _, size := range []int{0, 1, 15, 16, 17, 1000} {
+		data := bytes.Repeat([]byte{0xA5}, size)
+
+		enc := e.Encrypt(data)
+		if got := decrypt(t, e.key, enc); !bytes.Equal(got, data) {
+			t.Errorf("size %d: decrypted data differs", size)
+		}
+		if bytes.Equal(enc, e.Encrypt(data)) {
+			t.Errorf("size %d: encrypted twice using the same IV", size)
+		}
+	}
+}
+
+func TestWriterEncryption(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, Options{Info: Info{Title: "Quarterly report"}, Password: "secret"})
+	if err := w.AddImagePage(testImage(t, 0)); err != nil {
+		t.Fatalf("adding page: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing document: %s", err)
+	}
+
+	out := buf.Bytes()
+	if !bytes.HasPrefix(out, []byte("%PDF-2.0\n")) {
+		t.Errorf("expected a PDF 2.0 header, got %q", out[:9])
+	}
+	for _, s := range []string{"/Encrypt ", "/V 5 /R 6", "/CFM /AESV3"} {
+		if !bytes.Contains(out, []byte(s)) {
+			t.Errorf("document does not contain %q", s)
+		}
+	}
+	if bytes.Contains(out, []byte("Quarterly report")) {
+		t.Errorf("title is not encrypted")
+	}
+}
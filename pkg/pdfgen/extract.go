@@ -0,0 +1,134 @@
+package pdfgen
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+)
+
+// ExtractPages writes a new document containing the pages at the
+// 0-based indices in the given order with the objects they use, pages
+// selected twice are included once. Outlines and forms (including
+// signatures) are dropped as they refer to the pages left out.
+func ExtractPages(doc *Document, indices []int) ([]byte, error) {
+	o := &optimizer{doc: doc, r: doc.reader, objects: map[int]interface{}{}}
+
+	root, ok := doc.trailer.ref("Root")
+	if !ok {
+		return nil, fmt.Errorf("trailer has no catalog reference")
+	}
+	o.rootID = root.ID
+
+	if err := o.flattenPages(doc.pagesID, map[string]interface{}{}, map[int]bool{}); err != nil {
+		return nil, err
+	}
+
+	var (
+		selected []int
+		seen     = map[int]bool{}
+	)
+	for _, i := range indices {
+		if i < 0 || i >= len(o.pages) {
+			return nil, fmt.Errorf("document has no page %d", i+1)
+		}
+		if id := o.pages[i]; !seen[id] {
+			seen[id] = true
+			selected = append(selected, id)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no pages selected")
+	}
+
+	// Pages left out are known but not copied, references to them (e.g.
+	// in annotations) are written as null
+	for _, id := range o.pages {
+		if !seen[id] {
+			o.objects[id] = nil
+		}
+	}
+	o.pages = selected
+
+	v, err := o.r.object(o.rootID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read catalog: %s", err)
+	}
+	catalog, ok := v.(pdfDict)
+	if !ok {
+		return nil, fmt.Errorf("document has no catalog")
+	}
+	catalog = catalog.with("Outlines", nil).with("AcroForm", nil)
+	o.add(o.rootID, catalog)
+
+	kids := pdfArray{}
+	for _, id := range o.pages {
+		kids = append(kids, pdfRef{ID: id})
+	}
+	pages := pdfDict{vals: map[string]interface{}{}}
+	pages = pages.with("Type", pdfName("Pages"))
+	pages = pages.with("Kids", kids)
+	pages = pages.with("Count", float64(len(o.pages)))
+	o.add(doc.pagesID, pages)
+
+	for _, id := range o.pages {
+		if err := o.collect(o.objects[id]); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.collect(catalog); err != nil {
+		return nil, err
+	}
+	if err := o.collect(doc.trailer.get("Info")); err != nil {
+		return nil, err
+	}
+
+	return o.writeExtract(), nil
+}
+
+// writeExtract writes the loaded objects renumbered in the order they
+// were found with a cross-reference table, streams are copied as is
+func (o *optimizer) writeExtract() []byte {
+	o.renum = map[int]int{}
+	ids := []int{}
+	for _, id := range o.order {
+		if _, done := o.renum[id]; done || o.objects[id] == nil {
+			continue
+		}
+		ids = append(ids, id)
+		o.renum[id] = len(ids)
+	}
+
+	buf := bytes.NewBufferString(fmt.Sprintf("%%PDF-%s\n%%\xe2\xe3\xcf\xd3\n", o.version()))
+	offsets := make([]int, len(ids))
+	for i, id := range ids {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(buf, "%d 0 obj\n", i+1)
+
+		stream, ok := o.objects[id].(pdfStream)
+		if !ok {
+			o.value(buf, o.objects[id])
+			buf.WriteString("\nendobj\n")
+			continue
+		}
+		o.value(buf, stream.Dict.with("Length", float64(len(stream.Data))))
+		buf.WriteString("\nstream\n")
+		buf.Write(stream.Data)
+		buf.WriteString("\nendstream\nendobj\n")
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(buf, "xref\n0 %d\n0000000000 65535 f \n", len(ids)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(buf, "%010d 00000 n \n", off)
+	}
+
+	newID := make([]byte, 16)
+	rand.Read(newID)
+	fmt.Fprintf(buf, "trailer\n<</Size %d /Root %d 0 R", len(ids)+1, o.renum[o.rootID])
+	if info := o.doc.trailer.get("Info"); info != nil {
+		buf.WriteString(" /Info ")
+		o.value(buf, info)
+	}
+	fmt.Fprintf(buf, " /ID [<%x> <%x>]>>\nstartxref\n%d\n%%%%EOF\n", newID, newID, xref)
+	return buf.Bytes()
+}
@@ -0,0 +1,68 @@
+package pdfgen
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExtractPages(t *testing.T) {
+	doc, err := ReadDocument(testDocument(t, 3))
+	if err != nil {
+		t.Fatalf("reading document: %s", err)
+	}
+
+	out, err := ExtractPages(doc, []int{2, 0, 2})
+	if err != nil {
+		t.Fatalf("extracting pages: %s", err)
+	}
+
+	extract, err := ReadDocument(out)
+	if err != nil {
+		t.Fatalf("reading extracted document: %s", err)
+	}
+	if extract.Pages != 2 {
+		t.Errorf("expected 2 pages, got %d", extract.Pages)
+	}
+	if n := bytes.Count(out, []byte("/Subtype /Image")); n != 2 {
+		t.Errorf("expected the images of 2 pages, got %d", n)
+	}
+	if extract.outlines {
+		t.Errorf("outlines referring to other pages were kept")
+	}
+
+	// The first page of the extract shows the image of the third page
+	kids, _ := doc.pages.get("Kids").(pdfArray)
+	third, err := doc.reader.resolve(kids[2])
+	if err != nil {
+		t.Fatalf("reading third page: %s", err)
+	}
+	if !bytes.Equal(pageImage(t, extract.reader, extract.firstPage), pageImage(t, doc.reader, third)) {
+		t.Errorf("first page of the extract does not show the third page")
+	}
+
+	for _, idx := range [][]int{{3}, {-1}, {}} {
+		if _, err := ExtractPages(doc, idx); err == nil {
+			t.Errorf("expected an error for pages %v", idx)
+		}
+	}
+}
+
+// pageImage returns the data of the image Im0 shown on the page
+func pageImage(t *testing.T, r *pdfReader, page interface{}) []byte {
+	t.Helper()
+
+	p, _ := page.(pdfDict)
+	res, _ := r.resolve(p.get("Resources"))
+	resources, _ := res.(pdfDict)
+	xobjects, _ := r.resolve(resources.get("XObject"))
+	dict, _ := xobjects.(pdfDict)
+	img, err := r.resolve(dict.get("Im0"))
+	if err != nil {
+		t.Fatalf("reading image: %s", err)
+	}
+	stream, ok := img.(pdfStream)
+	if !ok {
+		t.Fatalf("page has no image")
+	}
+	return stream.Data
+}
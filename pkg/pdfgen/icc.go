@@ -0,0 +1,89 @@
+package pdfgen
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// srgbICCProfile builds a compact ICC v2 display profile describing the
+// sRGB color space (primaries adapted to D50, gamma 2.2). It is embedded
+// as output intent for PDF/A which requires device colors to be
+// characterized by a profile.
+func srgbICCProfile() []byte {
+	type tag struct {
+		sig  string
+		data []byte
+	}
+
+	xyz := func(x, y, z float64) []byte {
+		b := new(bytes.Buffer)
+		b.WriteString("XYZ \x00\x00\x00\x00")
+		for _, v := range []float64{x, y, z} {
+			binary.Write(b, binary.BigEndian, int32(math.Round(v*65536)))
+		}
+		return b.Bytes()
+	}
+
+	desc := func(text string) []byte {
+		b := new(bytes.Buffer)
+		b.WriteString("desc\x00\x00\x00\x00")
+		binary.Write(b, binary.BigEndian, uint32(len(text)+1))
+		b.WriteString(text + "\x00")
+		// Empty unicode (language code + count) and scriptcode (code,
+		// count and 67 byte buffer) descriptions
+		b.Write(make([]byte, 4+4+2+1+67))
+		return b.Bytes()
+	}
+
+	// curveType with a single entry: gamma as u8Fixed8Number (2.2)
+	trc := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x01\x02\x33")
+
+	tags := []tag{
+		{"desc", desc("sRGB (scansnap-go)")},
+		{"cprt", []byte("text\x00\x00\x00\x00No copyright, use freely\x00")},
+		{"wtpt", xyz(0.9642, 1.0, 0.8249)},
+		{"rXYZ", xyz(0.4361, 0.2225, 0.0139)},
+		{"gXYZ", xyz(0.3851, 0.7169, 0.0971)},
+		{"bXYZ", xyz(0.1431, 0.0606, 0.7141)},
+		{"rTRC", trc},
+		{"gTRC", trc},
+		{"bTRC", trc},
+	}
+
+	pad4 := func(n int) int { return (n + 3) &^ 3 }
+
+	var (
+		offset  = 128 + 4 + 12*len(tags)
+		table   = new(bytes.Buffer)
+		data    = new(bytes.Buffer)
+		written = map[string]int{} // identical tag data is shared
+	)
+
+	binary.Write(table, binary.BigEndian, uint32(len(tags)))
+	for _, t := range tags {
+		off, ok := written[string(t.data)]
+		if !ok {
+			off = offset + data.Len()
+			written[string(t.data)] = off
+			data.Write(t.data)
+			data.Write(make([]byte, pad4(len(t.data))-len(t.data)))
+		}
+		table.WriteString(t.sig)
+		binary.Write(table, binary.BigEndian, uint32(off))
+		binary.Write(table, binary.BigEndian, uint32(len(t.data)))
+	}
+
+	header := new(bytes.Buffer)
+	binary.Write(header, binary.BigEndian, uint32(offset+data.Len()))
+	header.Write(make([]byte, 4))                                  // preferred CMM
+	header.Write([]byte{2, 0x10, 0, 0})                            // version 2.1
+	header.WriteString("mntrRGB XYZ ")                             // class, color space, PCS
+	header.Write([]byte{0x07, 0xe2, 0, 1, 0, 1, 0, 0, 0, 0, 0, 0}) // 2018-01-01
+	header.WriteString("acsp")
+	header.Write(make([]byte, 4+4+4+4+8+4))    // platform, flags, manufacturer, model, attributes, intent
+	header.Write(xyz(0.9642, 1.0, 0.8249)[8:]) // PCS illuminant (D50)
+	header.Write(make([]byte, 4+44))           // creator, reserved
+
+	return append(append(header.Bytes(), table.Bytes()...), data.Bytes()...)
+}
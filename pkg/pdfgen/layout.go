@@ -0,0 +1,83 @@
+package pdfgen
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Placements of images on A4 pages, see Layout
+const (
+	// PlaceWidth scales the image to the width between the margins and
+	// aligns it to the top margin, long images run off the page
+	PlaceWidth = "width"
+	// PlaceFit scales the image to fit between the margins and centers it
+	PlaceFit = "fit"
+	// PlaceFill scales the image to cover the area between the margins
+	// and centers it, the overflow is clipped
+	PlaceFill = "fill"
+	// PlaceCenter shows the image at its actual size (Resolution) in the
+	// center of the page, larger images are scaled down to fit
+	PlaceCenter = "center"
+)
+
+// Placements lists the supported placements
+var Placements = []string{PlaceWidth, PlaceFit, PlaceFill, PlaceCenter}
+
+// MMToPt converts millimeters to PDF points
+func MMToPt(mm float64) float64 { return mm * 72 / 25.4 }
+
+// Layout places images on A4 pages, the zero value scales them to the
+// width of the page like PlaceWidth without margins
+type Layout struct {
+	Placement string
+	// Margin is kept free on all sides of the page, in points
+	Margin float64
+}
+
+// Validate checks the placement is known and the margins leave space
+// for the image
+func (l Layout) Validate() error {
+	switch l.Placement {
+	case "", PlaceWidth, PlaceFit, PlaceFill, PlaceCenter:
+	default:
+		return fmt.Errorf("unknown placement %q (supported: %s)", l.Placement, strings.Join(Placements, ", "))
+	}
+	if l.Margin < 0 || 2*l.Margin >= math.Min(A4WidthPt, A4HeightPt) {
+		return fmt.Errorf("the margin does not leave space on the page")
+	}
+	return nil
+}
+
+// Place returns the lower left corner and the size of an image of
+// width x height pixels on the page in points, the resolution is used
+// by PlaceCenter and ignored if unknown (0). The aspect ratio of the
+// image is kept by all placements.
+func (l Layout) Place(width, height, resolution int) (x, y, w, h float64) {
+	var (
+		areaW = A4WidthPt - 2*l.Margin
+		areaH = A4HeightPt - 2*l.Margin
+		scale = areaW / float64(width)
+	)
+
+	switch l.Placement {
+	case PlaceFit:
+		scale = math.Min(areaW/float64(width), areaH/float64(height))
+
+	case PlaceFill:
+		scale = math.Max(areaW/float64(width), areaH/float64(height))
+
+	case PlaceCenter:
+		scale = math.Min(areaW/float64(width), areaH/float64(height))
+		if resolution > 0 {
+			scale = math.Min(scale, 72/float64(resolution))
+		}
+
+	default:
+		w, h = areaW, areaW*float64(height)/float64(width)
+		return l.Margin, A4HeightPt - l.Margin - h, w, h
+	}
+
+	w, h = scale*float64(width), scale*float64(height)
+	return (A4WidthPt - w) / 2, (A4HeightPt - h) / 2, w, h
+}
@@ -0,0 +1,801 @@
+package pdfgen
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Optimize rewrites the document to reduce its size and to let viewers
+// display the first page before the whole file is downloaded:
+//
+//   - FlateDecode streams (content, text layers, lossless images) are
+//     compressed again at the best level, uncompressed streams except
+//     metadata get compressed. JPEG and CCITT images are kept as is:
+//     encoding JPEGs again loses quality, CCITT G4 is the best encoding
+//     for bilevel images available.
+//   - objects not referenced by the document (e.g. replaced by
+//     incremental updates) are dropped and the page tree is flattened
+//   - document level dictionaries are packed into an object stream and
+//     the cross-reference sections are written as compressed streams
+//   - the file is linearized for fast web view (ISO 32000-1, Annex F)
+//
+// The document must not be encrypted.
+func Optimize(data []byte) ([]byte, error) {
+	doc, err := ReadDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &optimizer{doc: doc, r: doc.reader, objects: map[int]interface{}{}}
+	if err = o.load(); err != nil {
+		return nil, err
+	}
+	if len(o.pages) == 0 {
+		return nil, fmt.Errorf("document has no pages")
+	}
+
+	o.classify()
+	return o.write()
+}
+
+// optimizer holds the objects of the document while it is rewritten,
+// objects are identified by their number in the document read
+type optimizer struct {
+	doc *Document
+	r   *pdfReader
+
+	objects map[int]interface{}
+	order   []int // objects in the order they were found
+	rootID  int
+	pages   []int
+
+	// Parts of the linearized file, see classify
+	firstPage []int
+	pageParts [][]int
+	shared    []int
+	other     []int
+	packed    []int // non-stream objects of other, in the object stream
+
+	// sharedBy lists the pages referencing an object
+	sharedBy map[int][]int
+	renum    map[int]int
+}
+
+// inheritedPageKeys are the attributes a page inherits from the nodes of
+// the page tree, they are set on the pages when flattening the tree
+var inheritedPageKeys = []string{"Resources", "MediaBox", "CropBox", "Rotate"}
+
+// load reads the objects reachable from the trailer with the page tree
+// flattened into a single node listing all pages
+func (o *optimizer) load() error {
+	root, ok := o.doc.trailer.ref("Root")
+	if !ok {
+		return fmt.Errorf("trailer has no catalog reference")
+	}
+	o.rootID = root.ID
+
+	if err := o.flattenPages(o.doc.pagesID, map[string]interface{}{}, map[int]bool{}); err != nil {
+		return err
+	}
+
+	kids := pdfArray{}
+	for _, id := range o.pages {
+		kids = append(kids, pdfRef{ID: id})
+	}
+	pages := pdfDict{vals: map[string]interface{}{}}
+	pages = pages.with("Type", pdfName("Pages"))
+	pages = pages.with("Kids", kids)
+	pages = pages.with("Count", float64(len(o.pages)))
+	o.add(o.doc.pagesID, pages)
+
+	// The pages are loaded already, the objects they use are not
+	for _, id := range o.pages {
+		if err := o.collect(o.objects[id]); err != nil {
+			return err
+		}
+	}
+	if err := o.collect(root); err != nil {
+		return err
+	}
+	return o.collect(o.doc.trailer.get("Info"))
+}
+
+// flattenPages adds the pages below the node of the page tree to pages
+// and objects, with the inherited attributes set on the pages
+func (o *optimizer) flattenPages(id int, inherited map[string]interface{}, seen map[int]bool) error {
+	if seen[id] {
+		return fmt.Errorf("loop in page tree at object %d", id)
+	}
+	seen[id] = true
+
+	v, err := o.r.object(id)
+	if err != nil {
+		return fmt.Errorf("unable to read page tree: %s", err)
+	}
+	node, ok := v.(pdfDict)
+	if !ok {
+		return fmt.Errorf("invalid page tree node %d", id)
+	}
+
+	if node.name("Type") == "Page" {
+		for _, k := range inheritedPageKeys {
+			if node.get(k) == nil && inherited[k] != nil {
+				node = node.with(k, inherited[k])
+			}
+		}
+		o.add(id, node.with("Parent", pdfRef{ID: o.doc.pagesID}))
+		o.pages = append(o.pages, id)
+		return nil
+	}
+
+	attrs := map[string]interface{}{}
+	for _, k := range inheritedPageKeys {
+		if attrs[k] = inherited[k]; node.get(k) != nil {
+			attrs[k] = node.get(k)
+		}
+	}
+
+	kids, _ := node.get("Kids").(pdfArray)
+	for _, kid := range kids {
+		ref, ok := kid.(pdfRef)
+		if !ok {
+			return fmt.Errorf("invalid page tree node %d", id)
+		}
+		if err := o.flattenPages(ref.ID, attrs, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *optimizer) add(id int, v interface{}) {
+	o.objects[id] = v
+	o.order = append(o.order, id)
+}
+
+// collect loads the objects referenced by the value
+func (o *optimizer) collect(v interface{}) error {
+	switch v := v.(type) {
+	case pdfRef:
+		if _, ok := o.objects[v.ID]; ok {
+			return nil
+		}
+		obj, err := o.r.object(v.ID)
+		if err != nil {
+			return fmt.Errorf("unable to read object %d: %s", v.ID, err)
+		}
+		o.add(v.ID, obj)
+		return o.collect(obj)
+
+	case pdfDict:
+		for _, k := range v.keys {
+			if err := o.collect(v.vals[k]); err != nil {
+				return err
+			}
+		}
+
+	case pdfArray:
+		for _, e := range v {
+			if err := o.collect(e); err != nil {
+				return err
+			}
+		}
+
+	case pdfStream:
+		// The length is written directly, an indirect one is dropped
+		return o.collect(v.Dict.with("Length", nil))
+	}
+	return nil
+}
+
+// classify assigns the objects to the parts of the linearized file: the
+// first page with all objects it uses, every other page with the objects
+// used by it only, the objects shared by several pages and the other
+// objects (page tree, outlines, metadata, info)
+func (o *optimizer) classify() {
+	var (
+		isPage   = map[int]bool{}
+		used     = make([][]int, len(o.pages))
+		assigned = map[int]bool{o.rootID: true, o.doc.pagesID: true}
+	)
+	for _, id := range o.pages {
+		isPage[id] = true
+	}
+
+	o.sharedBy = map[int][]int{}
+	for i, id := range o.pages {
+		seen := map[int]bool{}
+		var walk func(v interface{})
+		walk = func(v interface{}) {
+			switch v := v.(type) {
+			case pdfRef:
+				// Other pages, the page tree and the catalog are reached
+				// through annotations and destinations, they belong to
+				// their own parts
+				if seen[v.ID] || isPage[v.ID] || assigned[v.ID] || o.objects[v.ID] == nil {
+					return
+				}
+				seen[v.ID] = true
+				used[i] = append(used[i], v.ID)
+				o.sharedBy[v.ID] = append(o.sharedBy[v.ID], i)
+				walk(o.objects[v.ID])
+			case pdfDict:
+				for _, k := range v.keys {
+					if k != "Parent" {
+						walk(v.vals[k])
+					}
+				}
+			case pdfArray:
+				for _, e := range v {
+					walk(e)
+				}
+			case pdfStream:
+				walk(v.Dict)
+			}
+		}
+		walk(o.objects[id])
+	}
+
+	o.firstPage = append([]int{o.pages[0]}, used[0]...)
+	for _, id := range o.firstPage {
+		assigned[id] = true
+	}
+
+	o.pageParts = make([][]int, len(o.pages))
+	for i := 1; i < len(o.pages); i++ {
+		o.pageParts[i] = []int{o.pages[i]}
+		assigned[o.pages[i]] = true
+		for _, id := range used[i] {
+			if len(o.sharedBy[id]) == 1 {
+				o.pageParts[i] = append(o.pageParts[i], id)
+				assigned[id] = true
+			}
+		}
+	}
+	for i := 1; i < len(o.pages); i++ {
+		for _, id := range used[i] {
+			if !assigned[id] {
+				o.shared = append(o.shared, id)
+				assigned[id] = true
+			}
+		}
+	}
+
+	for _, id := range o.order {
+		if assigned[id] && id != o.doc.pagesID || o.objects[id] == nil {
+			continue
+		}
+		assigned[id] = true
+		if _, ok := o.objects[id].(pdfStream); ok {
+			o.other = append(o.other, id)
+		} else {
+			o.packed = append(o.packed, id)
+		}
+	}
+}
+
+// linearizedObject is an object of the linearized file with its new
+// number and its serialized form
+type linearizedObject struct {
+	num    int
+	data   []byte
+	offset int
+}
+
+func (o *optimizer) write() ([]byte, error) {
+	// Objects of the first page section are numbered after the others:
+	// the linearization dictionary, the first cross-reference stream,
+	// the catalog, the hint stream and the first page
+	o.renum = map[int]int{}
+	num := 0
+	for i := 1; i < len(o.pageParts); i++ {
+		for _, id := range o.pageParts[i] {
+			num++
+			o.renum[id] = num
+		}
+	}
+	for _, ids := range [][]int{o.shared, o.other, o.packed} {
+		for _, id := range ids {
+			num++
+			o.renum[id] = num
+		}
+	}
+	var objStmNum int
+	if len(o.packed) > 0 {
+		num++
+		objStmNum = num
+	}
+	num++
+	mainXRefNum := num
+
+	var (
+		mainSize = num + 1
+		linNum   = num + 1
+		xrefNum  = num + 2
+		hintNum  = num + 4
+	)
+	o.renum[o.rootID] = num + 3
+	num += 4
+	for _, id := range o.firstPage {
+		num++
+		o.renum[id] = num
+	}
+	size := num + 1
+
+	serialize := func(ids []int) []*linearizedObject {
+		out := []*linearizedObject{}
+		for _, id := range ids {
+			out = append(out, &linearizedObject{num: o.renum[id], data: o.object(o.renum[id], o.objects[id])})
+		}
+		return out
+	}
+
+	var (
+		catalog   = serialize([]int{o.rootID})
+		firstPage = serialize(o.firstPage)
+		pageParts = make([][]*linearizedObject, len(o.pageParts))
+		shared    = serialize(o.shared)
+		other     = serialize(o.other)
+	)
+	for i := 1; i < len(o.pageParts); i++ {
+		pageParts[i] = serialize(o.pageParts[i])
+	}
+	if objStmNum > 0 {
+		other = append(other, &linearizedObject{num: objStmNum, data: o.objectStream(objStmNum)})
+	}
+
+	var (
+		header  = []byte(fmt.Sprintf("%%PDF-%s\n%%\xe2\xe3\xcf\xd3\n", o.version()))
+		lin     = &linearizedObject{num: linNum}
+		xref    = &linearizedObject{num: xrefNum}
+		hint    = &linearizedObject{num: hintNum}
+		mainRef = &linearizedObject{num: mainXRefNum}
+	)
+
+	fileID := o.doc.fileID
+	newID := make([]byte, 16)
+	rand.Read(newID)
+	if fileID == nil {
+		fileID = []byte(fmt.Sprintf("<%x>", newID))
+	}
+	trailer := new(bytes.Buffer)
+	fmt.Fprintf(trailer, " /Root %d 0 R", o.renum[o.rootID])
+	if info := o.doc.trailer.get("Info"); info != nil {
+		trailer.WriteString(" /Info ")
+		o.value(trailer, info)
+	}
+	fmt.Fprintf(trailer, " /ID [%s <%x>]", fileID, newID)
+
+	first := append(append([]*linearizedObject{lin, xref}, catalog...), hint)
+	first = append(first, firstPage...)
+	rest := []*linearizedObject{}
+	for i := 1; i < len(pageParts); i++ {
+		rest = append(rest, pageParts[i]...)
+	}
+	rest = append(append(rest, shared...), other...)
+
+	// The layout is computed with placeholders first: the sizes of the
+	// linearization dictionary, the first cross-reference stream and the
+	// hint stream do not depend on the offsets written into them
+	var mainXRefOffset, fileLen int
+	for pass := 0; pass < 2; pass++ {
+		lin.data = o.linearizationDict(linNum, fileLen, hint, firstPage, mainXRefOffset)
+		xref.data = xrefStream(xrefNum, linNum, first, size, fmt.Sprintf("%s /Prev %10d", trailer, mainXRefOffset))
+		hint.data = o.hintStream(hintNum, len(hint.data), firstPage, pageParts, shared)
+
+		offset := len(header)
+		for _, obj := range append(append([]*linearizedObject{}, first...), rest...) {
+			obj.offset = offset
+			offset += len(obj.data)
+		}
+		mainXRefOffset = offset
+
+		entries := append([]*linearizedObject{}, rest...)
+		mainRef.offset = offset
+		mainRef.data = o.mainXRefStream(mainXRefNum, mainSize, append(entries, mainRef), objStmNum)
+		fileLen = offset + len(mainRef.data) + len(fmt.Sprintf("startxref\n%d\n%%%%EOF\n", xref.offset))
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, fileLen))
+	buf.Write(header)
+	for _, obj := range append(append(first, rest...), mainRef) {
+		buf.Write(obj.data)
+	}
+	fmt.Fprintf(buf, "startxref\n%d\n%%%%EOF\n", xref.offset)
+
+	if buf.Len() != fileLen {
+		return nil, fmt.Errorf("unstable layout of linearized document")
+	}
+	return buf.Bytes(), nil
+}
+
+// version returns the version of the document, at least 1.5 which
+// introduced object and cross-reference streams
+func (o *optimizer) version() string {
+	data := o.doc.data
+	end := bytes.IndexAny(data, "\r\n")
+	if end < 0 || end > 16 {
+		return "1.5"
+	}
+	v := string(bytes.TrimSpace(data[len("%PDF-"):end]))
+	if f, err := strconv.ParseFloat(v, 64); err != nil || f < 1.5 {
+		return "1.5"
+	}
+	return v
+}
+
+// linearizationDict writes the numbers padded to a fixed width to keep
+// the size of the dictionary independent of them
+func (o *optimizer) linearizationDict(num, fileLen int, hint *linearizedObject, firstPage []*linearizedObject, mainXRef int) []byte {
+	last := firstPage[len(firstPage)-1]
+	return []byte(fmt.Sprintf(
+		"%d 0 obj\n<</Linearized 1 /L %10d /H [%10d %10d] /O %10d /E %10d /N %10d /T %10d>>\nendobj\n",
+		num, fileLen, hint.offset, len(hint.data), firstPage[0].num, last.offset+len(last.data), len(o.pages), mainXRef,
+	))
+}
+
+// xrefRow encodes an entry of the cross-reference streams using the
+// field widths [1 4 2]
+func xrefRow(buf *bytes.Buffer, typ byte, a, b int) {
+	buf.WriteByte(typ)
+	binary.Write(buf, binary.BigEndian, uint32(a))
+	binary.Write(buf, binary.BigEndian, uint16(b))
+}
+
+// xrefStream writes the uncompressed cross-reference stream of the first
+// page section, its size only depends on the number of objects
+func xrefStream(num, firstNum int, objs []*linearizedObject, size int, trailer string) []byte {
+	rows := new(bytes.Buffer)
+	for _, obj := range objs {
+		xrefRow(rows, 1, obj.offset, 0)
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%d 0 obj\n<</Type /XRef /Index [%d %d] /W [1 4 2] /Size %d%s /Length %d>>\nstream\n",
+		num, firstNum, len(objs), size, trailer, rows.Len())
+	buf.Write(rows.Bytes())
+	buf.WriteString("\nendstream\nendobj\n")
+	return buf.Bytes()
+}
+
+// mainXRefStream writes the compressed cross-reference stream of the
+// objects after the first page, including the ones in the object stream
+func (o *optimizer) mainXRefStream(num, size int, objs []*linearizedObject, objStmNum int) []byte {
+	entries := make([][3]int, size)
+	entries[0] = [3]int{0, 0, 0xFFFF}
+	for _, obj := range objs {
+		entries[obj.num] = [3]int{1, obj.offset, 0}
+	}
+	for i, id := range o.packed {
+		entries[o.renum[id]] = [3]int{2, objStmNum, i}
+	}
+
+	rows := new(bytes.Buffer)
+	for _, e := range entries {
+		xrefRow(rows, byte(e[0]), e[1], e[2])
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%d 0 obj\n<</Type /XRef /Index [0 %d] /W [1 4 2] /Size %d /Filter /FlateDecode", num, size, size)
+	writeStreamData(buf, deflate(rows.Bytes()))
+	return buf.Bytes()
+}
+
+// objectStream packs the non-stream objects of the other objects part
+func (o *optimizer) objectStream(num int) []byte {
+	var (
+		index   = new(bytes.Buffer)
+		objects = new(bytes.Buffer)
+	)
+	for _, id := range o.packed {
+		fmt.Fprintf(index, "%d %d ", o.renum[id], objects.Len())
+		o.value(objects, o.objects[id])
+		objects.WriteByte('\n')
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%d 0 obj\n<</Type /ObjStm /N %d /First %d /Filter /FlateDecode", num, len(o.packed), index.Len())
+	writeStreamData(buf, deflate(append(index.Bytes(), objects.Bytes()...)))
+	return buf.Bytes()
+}
+
+// writeStreamData finishes the stream dictionary started in buf with the
+// length of the data and writes the data
+func writeStreamData(buf *bytes.Buffer, data []byte) {
+	fmt.Fprintf(buf, " /Length %d>>\nstream\n", len(data))
+	buf.Write(data)
+	buf.WriteString("\nendstream\nendobj\n")
+}
+
+// object serializes the indirect object with its new number
+func (o *optimizer) object(num int, v interface{}) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%d 0 obj\n", num)
+
+	stream, ok := v.(pdfStream)
+	if !ok {
+		o.value(buf, v)
+		buf.WriteString("\nendobj\n")
+		return buf.Bytes()
+	}
+
+	stream = recompressStream(stream)
+	o.value(buf, stream.Dict.with("Length", float64(len(stream.Data))))
+	buf.WriteString("\nstream\n")
+	buf.Write(stream.Data)
+	buf.WriteString("\nendstream\nendobj\n")
+	return buf.Bytes()
+}
+
+// value serializes the value with references using the new numbers,
+// references to objects not existing are written as null
+func (o *optimizer) value(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case pdfName:
+		buf.WriteString("/" + string(v))
+	case pdfRaw:
+		buf.Write(v)
+	case float64:
+		buf.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	case pdfRef:
+		if num, ok := o.renum[v.ID]; ok {
+			fmt.Fprintf(buf, "%d 0 R", num)
+		} else {
+			buf.WriteString("null")
+		}
+	case pdfArray:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			o.value(buf, e)
+		}
+		buf.WriteByte(']')
+	case pdfDict:
+		buf.WriteString("<<")
+		for _, k := range v.keys {
+			if v.vals[k] == nil {
+				// Null entries are equal to missing ones
+				continue
+			}
+			buf.WriteString("/" + k + " ")
+			o.value(buf, v.vals[k])
+		}
+		buf.WriteString(">>")
+	}
+}
+
+// recompressStream compresses FlateDecode streams again at the best
+// level and compresses unfiltered ones, the smaller data is kept.
+// Metadata must stay readable without decoding, streams failing to
+// decode are kept unchanged.
+func recompressStream(s pdfStream) pdfStream {
+	filter := s.Dict.get("Filter")
+	if arr, ok := filter.(pdfArray); ok && len(arr) == 1 {
+		filter = arr[0]
+	}
+
+	switch {
+	case filter == pdfName("FlateDecode"):
+		zr, err := zlib.NewReader(bytes.NewReader(s.Data))
+		if err != nil {
+			return s
+		}
+		raw, err := io.ReadAll(zr)
+		if err != nil {
+			return s
+		}
+		if data := deflate(raw); len(data) < len(s.Data) {
+			s.Data = data
+		}
+
+	case filter == nil && s.Dict.get("DecodeParms") == nil && s.Dict.name("Type") != "Metadata":
+		if data := deflate(s.Data); len(data) < len(s.Data) {
+			s.Dict = s.Dict.with("Filter", pdfName("FlateDecode"))
+			s.Data = data
+		}
+	}
+	return s
+}
+
+func deflate(data []byte) []byte {
+	buf := new(bytes.Buffer)
+	zw, _ := zlib.NewWriterLevel(buf, zlib.BestCompression)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// with returns a copy of the dictionary with the value set, nil removes
+// the entry. The raw values are not kept.
+func (d pdfDict) with(key string, v interface{}) pdfDict {
+	out := pdfDict{vals: map[string]interface{}{}}
+	for _, k := range d.keys {
+		if k != key {
+			out.keys = append(out.keys, k)
+			out.vals[k] = d.vals[k]
+		}
+	}
+	if v != nil {
+		out.keys = append(out.keys, key)
+		out.vals[key] = v
+	}
+	return out
+}
+
+// hintStream writes the page offset and shared object hint tables
+// describing the location of the pages and the objects they share.
+// Locations are given as if the hint stream of hintLen bytes, which
+// precedes the first page, was not present (ISO 32000-1, F.4).
+func (o *optimizer) hintStream(num, hintLen int, firstPage []*linearizedObject, pageParts [][]*linearizedObject, shared []*linearizedObject) []byte {
+	// Shared object identifiers index the objects of the first page
+	// followed by the ones of the shared objects part
+	sharedIndex := map[int]int{}
+	for i, id := range o.firstPage {
+		sharedIndex[id] = i
+	}
+	for i, id := range o.shared {
+		sharedIndex[id] = len(o.firstPage) + i
+	}
+
+	var (
+		objects = make([]int, len(o.pages))
+		lengths = make([]int, len(o.pages))
+		refs    = make([][]int, len(o.pages))
+	)
+	for i := range o.pages {
+		part := firstPage
+		if i > 0 {
+			part = pageParts[i]
+		}
+		objects[i] = len(part)
+		for _, obj := range part {
+			lengths[i] += len(obj.data)
+		}
+	}
+	for id, pages := range o.sharedBy {
+		if len(pages) < 2 {
+			continue
+		}
+		for _, p := range pages {
+			refs[p] = append(refs[p], sharedIndex[id])
+		}
+	}
+
+	minObjects, maxObjects := minMax(objects)
+	minLength, maxLength := minMax(lengths)
+	maxRefs, maxID := 0, len(o.firstPage)+len(o.shared)-1
+	for _, r := range refs {
+		if len(r) > maxRefs {
+			maxRefs = len(r)
+		}
+	}
+
+	// Page offset hint table, the content streams are described as the
+	// whole page
+	w := &bitWriter{}
+	w.write(minObjects, 32)
+	w.write(firstPage[0].offset-hintLen, 32)
+	w.write(bitsFor(maxObjects-minObjects), 16)
+	w.write(minLength, 32)
+	w.write(bitsFor(maxLength-minLength), 16)
+	w.write(0, 32)
+	w.write(0, 16)
+	w.write(minLength, 32)
+	w.write(bitsFor(maxLength-minLength), 16)
+	w.write(bitsFor(maxRefs), 16)
+	w.write(bitsFor(maxID), 16)
+	w.write(0, 16)
+	w.write(1, 16)
+
+	for _, n := range objects {
+		w.write(n-minObjects, bitsFor(maxObjects-minObjects))
+	}
+	w.align()
+	for _, l := range lengths {
+		w.write(l-minLength, bitsFor(maxLength-minLength))
+	}
+	w.align()
+	for _, r := range refs {
+		w.write(len(r), bitsFor(maxRefs))
+	}
+	w.align()
+	for _, r := range refs {
+		for _, id := range r {
+			w.write(id, bitsFor(maxID))
+		}
+	}
+	w.align()
+	w.align() // no content stream offsets
+	for _, l := range lengths {
+		w.write(l-minLength, bitsFor(maxLength-minLength))
+	}
+	w.align()
+
+	// Shared object hint table with a group per object
+	sharedOffset := len(w.buf)
+	groups := append(append([]*linearizedObject{}, firstPage...), shared...)
+	groupLengths := make([]int, len(groups))
+	for i, g := range groups {
+		groupLengths[i] = len(g.data)
+	}
+	minGroup, maxGroup := minMax(groupLengths)
+
+	firstShared, firstSharedOffset := 0, 0
+	if len(shared) > 0 {
+		firstShared, firstSharedOffset = shared[0].num, shared[0].offset-hintLen
+	}
+	w.write(firstShared, 32)
+	w.write(firstSharedOffset, 32)
+	w.write(len(firstPage), 32)
+	w.write(len(groups), 32)
+	w.write(0, 16)
+	w.write(minGroup, 32)
+	w.write(bitsFor(maxGroup-minGroup), 16)
+
+	for _, l := range groupLengths {
+		w.write(l-minGroup, bitsFor(maxGroup-minGroup))
+	}
+	w.align()
+	for range groups {
+		w.write(0, 1) // no MD5 signatures
+	}
+	w.align()
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%d 0 obj\n<</S %d", num, sharedOffset)
+	writeStreamData(buf, w.buf)
+	return buf.Bytes()
+}
+
+func minMax(values []int) (int, int) {
+	lo, hi := values[0], values[0]
+	for _, v := range values {
+		if v < lo {
+			lo = v
+		}
+		if v > hi {
+			hi = v
+		}
+	}
+	return lo, hi
+}
+
+// bitsFor returns the number of bits needed to represent the value
+func bitsFor(v int) int {
+	n := 0
+	for ; v > 0; v >>= 1 {
+		n++
+	}
+	return n
+}
+
+// bitWriter packs the values of the hint tables most significant bit
+// first
+type bitWriter struct {
+	buf  []byte
+	bits int // bits used in the last byte, 0 if it is full
+}
+
+func (w *bitWriter) write(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.bits == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			w.buf[len(w.buf)-1] |= 0x80 >> uint(w.bits)
+		}
+		w.bits = (w.bits + 1) % 8
+	}
+}
+
+// align starts the next value on a byte boundary
+func (w *bitWriter) align() { w.bits = 0 }
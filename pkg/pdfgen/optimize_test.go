@@ -0,0 +1,84 @@
+package pdfgen
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	data := testDocument(t, 3)
+	out, err := Optimize(data)
+	if err != nil {
+		t.Fatalf("optimizing document: %s", err)
+	}
+
+	doc, err := ReadDocument(out)
+	if err != nil {
+		t.Fatalf("reading optimized document: %s", err)
+	}
+	if doc.Pages != 3 {
+		t.Errorf("expected 3 pages, got %d", doc.Pages)
+	}
+
+	// The linearization dictionary is the first object
+	l := &pdfLexer{data: out, pos: bytes.Index(out, []byte("obj")) + len("obj")}
+	v, err := l.value()
+	if err != nil {
+		t.Fatalf("reading linearization dictionary: %s", err)
+	}
+	lin, ok := v.(pdfDict)
+	if !ok || lin.get("Linearized") == nil {
+		t.Fatalf("document is not linearized")
+	}
+	if n, _ := asInt(lin.get("L")); n != len(out) {
+		t.Errorf("expected file length %d, got %d", len(out), n)
+	}
+	if n, _ := asInt(lin.get("N")); n != 3 {
+		t.Errorf("expected 3 pages in linearization dictionary, got %d", n)
+	}
+
+	// The hint tables locate the first page as if the hint stream was
+	// not present
+	h, _ := lin.get("H").(pdfArray)
+	if len(h) != 2 {
+		t.Fatalf("invalid hint stream location %v", h)
+	}
+	hintOffset, _ := asInt(h[0])
+	hintLen, _ := asInt(h[1])
+	_, hv, err := doc.reader.objectAt(hintOffset)
+	if err != nil {
+		t.Fatalf("reading hint stream: %s", err)
+	}
+	hint, ok := hv.(pdfStream)
+	if !ok || len(hint.Data) < 8 {
+		t.Fatalf("invalid hint stream")
+	}
+
+	pageID, _ := asInt(lin.get("O"))
+	pageOffset := doc.reader.xref[pageID].offset
+	if pageOffset <= hintOffset {
+		t.Fatalf("first page at %d does not follow the hint stream at %d", pageOffset, hintOffset)
+	}
+	if got := int(binary.BigEndian.Uint32(hint.Data[4:8])); got != pageOffset-hintLen {
+		t.Errorf("expected first page at %d in hint table, got %d", pageOffset-hintLen, got)
+	}
+
+	if _, err := Optimize(out); err != nil {
+		t.Errorf("optimizing the optimized document: %s", err)
+	}
+}
+
+func TestOptimizeMalformed(t *testing.T) {
+	for name, doc := range map[string][]byte{
+		"no pages":   rawDocument("<</Type /Catalog /Pages 2 0 R>>", "<</Type /Pages /Kids [] /Count 0>>"),
+		"page loop":  rawDocument("<</Type /Catalog /Pages 2 0 R>>", "<</Type /Pages /Kids [2 0 R] /Count 1>>"),
+		"not a page": rawDocument("<</Type /Catalog /Pages 2 0 R>>", "<</Type /Pages /Kids [3 0 R] /Count 1>>", "42"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Optimize(doc); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
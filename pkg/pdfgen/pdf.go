@@ -0,0 +1,625 @@
+// Package pdfgen assembles PDF documents from already encoded page
+// images without re-encoding them
+package pdfgen
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	// A4 page size in PDF points (1/72 inch)
+	A4WidthPt  = 595.28
+	A4HeightPt = 841.89
+)
+
+// Image is an image XObject carrying already encoded image data which
+// is embedded into the PDF without further processing
+type Image struct {
+	Width, Height    int
+	ColorSpace       string
+	BitsPerComponent int
+	Filter           string
+	DecodeParms      string
+	Data             []byte
+	// DPI sizes the page to the image printed at this resolution, by
+	// default the image is placed on an A4 page by the Layout
+	DPI int
+	// Layout places the image on the A4 page, Resolution is the one the
+	// image was rendered at for showing it at its actual size
+	Layout     Layout
+	Resolution int
+	// Text is drawn over the image
+	Text []Text
+	// Rotate turns the page clockwise by this multiple of 90 degrees
+	// when it is displayed
+	Rotate int
+}
+
+// Info contains the document information dictionary entries
+type Info struct {
+	Title        string
+	Author       string
+	Subject      string
+	Keywords     string
+	Creator      string
+	Producer     string
+	CreationDate time.Time
+}
+
+type Options struct {
+	// PDFA produces PDF/A-2b conforming output: identification and
+	// metadata as XMP and device colors characterized by an embedded
+	// sRGB output intent
+	PDFA bool
+	Info Info
+	// Password enables AES encryption of the document, it must be
+	// entered to open the document
+	Password string
+	// ICCProfile characterizes the colors of the DeviceRGB images, e.g.
+	// the profile of the scanner (RGB only)
+	ICCProfile []byte
+}
+
+// Assembler builds a document page by page. Close must be called
+// after the last page to complete the document.
+type Assembler interface {
+	AddImagePage(img *Image) error
+	AddContentPage(content []byte) error
+	// AddBookmark adds an entry to the outline of the document pointing
+	// to the next page added
+	AddBookmark(title string)
+	Close() error
+}
+
+// Writer writes a PDF document object by object to the underlying
+// writer. Only the offsets of the objects are kept in memory, so pages
+// can be written as soon as they are available.
+type Writer struct {
+	w       *bufio.Writer
+	written int64
+	err     error
+
+	opts    Options
+	offsets []int64 // offset of object n is stored at n-1
+	pageIDs []int
+	pagesID int
+	fileID  []byte
+	enc     *pdfEncryption
+	fontsID int // font resource dictionary, written on first use
+	iccID   int // ICCProfile stream, written on first use
+
+	bookmarks []bookmark
+
+	// existing is the document updated by an appending writer
+	existing *Document
+	prepend  bool
+}
+
+// bookmark is an outline entry pointing to the page with the index
+type bookmark struct {
+	title string
+	page  int
+}
+
+func NewWriter(w io.Writer, opts Options) *Writer {
+	p := &Writer{w: bufio.NewWriter(w), opts: opts, fileID: make([]byte, 16)}
+	rand.Read(p.fileID)
+
+	version := "1.4"
+	switch {
+	case opts.PDFA:
+		// PDF/A-2 is based on PDF 1.7
+		version = "1.7"
+	case opts.Password != "":
+		// AES-256 encryption was introduced with PDF 2.0
+		version = "2.0"
+		p.enc = newPDFEncryption(opts.Password)
+	}
+
+	// The binary comment marks the file as containing binary data
+	p.printf("%%PDF-%s\n%%\xe2\xe3\xcf\xd3\n", version)
+	p.pagesID = p.allocObject()
+
+	return p
+}
+
+// allocObject reserves an object number to be written later
+func (p *Writer) allocObject() int {
+	p.offsets = append(p.offsets, -1)
+	return len(p.offsets)
+}
+
+func (p *Writer) printf(format string, args ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(p.w, format, args...)
+	p.written += int64(n)
+	p.err = err
+}
+
+func (p *Writer) write(data []byte) {
+	if p.err != nil {
+		return
+	}
+	n, err := p.w.Write(data)
+	p.written += int64(n)
+	p.err = err
+}
+
+// writeObject writes a dictionary object with the given entries and an
+// optional stream (which gets its /Length added to the dictionary)
+func (p *Writer) writeObject(id int, dict string, stream []byte) {
+	p.offsets[id-1] = p.written
+	p.printf("%d 0 obj\n", id)
+
+	if stream == nil {
+		p.printf("<<%s>>\nendobj\n", dict)
+		return
+	}
+
+	if p.enc != nil {
+		stream = p.enc.Encrypt(stream)
+	}
+
+	p.printf("<<%s /Length %d>>\nstream\n", dict, len(stream))
+	p.write(stream)
+	p.printf("\nendstream\nendobj\n")
+}
+
+// AddImagePage adds an A4 page showing the image placed by its Layout,
+// or a page of the size of the image if its DPI is set
+func (p *Writer) AddImagePage(img *Image) error {
+	colorSpace := "/" + img.ColorSpace
+	if img.ColorSpace == "DeviceRGB" && len(p.opts.ICCProfile) > 0 {
+		colorSpace = fmt.Sprintf("[/ICCBased %d 0 R]", p.iccProfile())
+	}
+
+	imgID := p.allocObject()
+	dict := fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent %d /Filter /%s",
+		img.Width, img.Height, colorSpace, img.BitsPerComponent, img.Filter)
+	if img.DecodeParms != "" {
+		dict += " /DecodeParms " + img.DecodeParms
+	}
+	p.writeObject(imgID, dict, img.Data)
+
+	var (
+		x, y, w, h   = img.Layout.Place(img.Width, img.Height, img.Resolution)
+		pageW, pageH = A4WidthPt, A4HeightPt
+		clip         string
+	)
+	switch {
+	case img.DPI > 0:
+		w, h = img.SizePt()
+		x, y, pageW, pageH = 0, 0, w, h
+	case img.Layout.Placement == PlaceFill:
+		m := img.Layout.Margin
+		clip = fmt.Sprintf("%.2f %.2f %.2f %.2f re W n ", m, m, pageW-2*m, pageH-2*m)
+	}
+
+	content := []byte(fmt.Sprintf("q %s%.2f 0 0 %.2f %.2f %.2f cm /Im0 Do Q", clip, w, h, x, y))
+	resources := fmt.Sprintf("/XObject <</Im0 %d 0 R>>", imgID)
+
+	if len(img.Text) > 0 {
+		text, states := textContent(img.Text, x, y, w, h)
+		content = append(append(content, '\n'), text...)
+		resources += fmt.Sprintf(" /Font %d 0 R", p.fonts())
+		if states != "" {
+			resources += " /ExtGState <<" + states + ">>"
+		}
+	}
+
+	return p.addPage(content, resources, pageW, pageH, img.Rotate)
+}
+
+// SizePt returns the size of the image on the page in points
+func (i *Image) SizePt() (float64, float64) {
+	if i.DPI > 0 {
+		return float64(i.Width) * 72 / float64(i.DPI), float64(i.Height) * 72 / float64(i.DPI)
+	}
+	_, _, w, h := i.Layout.Place(i.Width, i.Height, i.Resolution)
+	return w, h
+}
+
+// AddBookmark implements Assembler
+func (p *Writer) AddBookmark(title string) {
+	p.bookmarks = append(p.bookmarks, bookmark{title, len(p.pageIDs)})
+}
+
+// AddContentPage adds an A4 page drawn by the given content stream which
+// may use the standard fonts Helvetica (/F1) and Helvetica-Bold (/F2)
+func (p *Writer) AddContentPage(content []byte) error {
+	return p.addPage(content, fmt.Sprintf("/Font %d 0 R", p.fonts()), A4WidthPt, A4HeightPt, 0)
+}
+
+// fonts returns the font resource dictionary, writing it on first use
+func (p *Writer) fonts() int {
+	if p.fontsID == 0 {
+		f1, f2 := p.allocObject(), p.allocObject()
+		p.writeObject(f1, "/Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding", nil)
+		p.writeObject(f2, "/Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding", nil)
+
+		p.fontsID = p.allocObject()
+		p.writeObject(p.fontsID, fmt.Sprintf("/F1 %d 0 R /F2 %d 0 R", f1, f2), nil)
+	}
+	return p.fontsID
+}
+
+func (p *Writer) iccProfile() int {
+	if p.iccID == 0 {
+		p.iccID = p.allocObject()
+		p.writeObject(p.iccID, "/N 3", p.opts.ICCProfile)
+	}
+	return p.iccID
+}
+
+func (p *Writer) addPage(content []byte, resources string, width, height float64, rotate int) error {
+	contentID := p.allocObject()
+	p.writeObject(contentID, "", content)
+
+	dict := fmt.Sprintf(
+		"/Type /Page /Parent %d 0 R /MediaBox [0 0 %.2f %.2f] /Resources <<%s>> /Contents %d 0 R",
+		p.pagesID, width, height, resources, contentID,
+	)
+	if rotate != 0 {
+		dict += fmt.Sprintf(" /Rotate %d", rotate)
+	}
+
+	pageID := p.allocObject()
+	p.writeObject(pageID, dict, nil)
+	p.pageIDs = append(p.pageIDs, pageID)
+
+	return p.err
+}
+
+// Flush writes the buffered objects to the underlying writer, e.g. to
+// send the pages written so far to a client
+func (p *Writer) Flush() error {
+	if p.err != nil {
+		return p.err
+	}
+	return p.w.Flush()
+}
+
+// Close writes the page tree, the catalog and the cross-reference table
+// and flushes the document to the underlying writer
+func (p *Writer) Close() error {
+	if p.existing != nil {
+		return p.closeAppend()
+	}
+
+	kids := new(bytes.Buffer)
+	for _, id := range p.pageIDs {
+		fmt.Fprintf(kids, "%d 0 R ", id)
+	}
+	p.writeObject(p.pagesID, fmt.Sprintf("/Type /Pages /Kids [%s] /Count %d", bytes.TrimSpace(kids.Bytes()), len(p.pageIDs)), nil)
+
+	catalog := fmt.Sprintf("/Type /Catalog /Pages %d 0 R", p.pagesID)
+	if outlines := p.writeOutlines(); outlines != 0 {
+		catalog += fmt.Sprintf(" /Outlines %d 0 R /PageMode /UseOutlines", outlines)
+	}
+	if p.opts.PDFA {
+		catalog += p.writePDFAObjects()
+	}
+	catalogID := p.allocObject()
+	p.writeObject(catalogID, catalog, nil)
+
+	trailer := fmt.Sprintf(" /Root %d 0 R", catalogID)
+	infoID := p.allocObject()
+	p.writeObject(infoID, p.infoDict(infoID), nil)
+	trailer += fmt.Sprintf(" /Info %d 0 R", infoID)
+
+	if p.enc != nil {
+		encID := p.allocObject()
+		p.writeObject(encID, p.enc.Dict(), nil)
+		trailer += fmt.Sprintf(" /Encrypt %d 0 R", encID)
+	}
+
+	trailer = fmt.Sprintf("/Size %d", len(p.offsets)+1) + trailer
+	trailer += fmt.Sprintf(" /ID [<%x> <%x>]", p.fileID, p.fileID)
+
+	xref := p.written
+	p.printf("xref\n0 %d\n0000000000 65535 f \n", len(p.offsets)+1)
+	for _, o := range p.offsets {
+		p.printf("%010d 00000 n \n", o)
+	}
+	p.printf("trailer\n<<%s>>\nstartxref\n%d\n%%%%EOF\n", trailer, xref)
+
+	if p.err != nil {
+		return p.err
+	}
+	return p.w.Flush()
+}
+
+// writeOutlines writes the bookmarks pointing to existing pages and
+// returns the ID of the outline dictionary (0 = no bookmarks)
+func (p *Writer) writeOutlines() int {
+	marks := []bookmark{}
+	for _, b := range p.bookmarks {
+		if b.page < len(p.pageIDs) {
+			marks = append(marks, b)
+		}
+	}
+	if len(marks) == 0 {
+		return 0
+	}
+
+	outlinesID := p.allocObject()
+	ids := make([]int, len(marks))
+	for i := range marks {
+		ids[i] = p.allocObject()
+	}
+
+	for i, b := range marks {
+		dict := fmt.Sprintf("/Title %s /Parent %d 0 R /Dest [%d 0 R /Fit]", p.textString(b.title), outlinesID, p.pageIDs[b.page])
+		if i > 0 {
+			dict += fmt.Sprintf(" /Prev %d 0 R", ids[i-1])
+		}
+		if i < len(marks)-1 {
+			dict += fmt.Sprintf(" /Next %d 0 R", ids[i+1])
+		}
+		p.writeObject(ids[i], dict, nil)
+	}
+
+	p.writeObject(outlinesID, fmt.Sprintf("/Type /Outlines /First %d 0 R /Last %d 0 R /Count %d", ids[0], ids[len(ids)-1], len(ids)), nil)
+	return outlinesID
+}
+
+// infoDict returns the entries of the document information dictionary
+// stored as object id
+func (p *Writer) infoDict(id int) string {
+	i := p.opts.Info
+	entries := []string{}
+
+	for _, e := range []struct{ key, value string }{
+		{"Title", i.Title},
+		{"Author", i.Author},
+		{"Subject", i.Subject},
+		{"Keywords", i.Keywords},
+		{"Creator", i.Creator},
+		{"Producer", i.Producer},
+	} {
+		if e.value != "" {
+			entries = append(entries, fmt.Sprintf("/%s %s", e.key, p.textString(e.value)))
+		}
+	}
+
+	if !i.CreationDate.IsZero() {
+		entries = append(entries,
+			fmt.Sprintf("/CreationDate %s", p.textString(pdfDate(i.CreationDate))),
+			fmt.Sprintf("/ModDate %s", p.textString(pdfDate(i.CreationDate))),
+		)
+	}
+
+	return strings.Join(entries, " ")
+}
+
+// writePDFAObjects writes the XMP metadata and the output intent and
+// returns the catalog entries referencing them
+func (p *Writer) writePDFAObjects() string {
+	var (
+		i    = p.opts.Info
+		date = i.CreationDate.Format(time.RFC3339)
+		xmp  = new(bytes.Buffer)
+		dc   = new(bytes.Buffer)
+	)
+
+	// The XMP metadata must match the document information dictionary
+	if i.Title != "" {
+		fmt.Fprintf(dc, "<dc:title><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:title>\n", xmlEscape(i.Title))
+	}
+	if i.Author != "" {
+		fmt.Fprintf(dc, "<dc:creator><rdf:Seq><rdf:li>%s</rdf:li></rdf:Seq></dc:creator>\n", xmlEscape(i.Author))
+	}
+	if i.Subject != "" {
+		fmt.Fprintf(dc, "<dc:description><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:description>\n", xmlEscape(i.Subject))
+	}
+	if i.Keywords != "" {
+		fmt.Fprintf(dc, "<pdf:Keywords>%s</pdf:Keywords>\n", xmlEscape(i.Keywords))
+	}
+
+	fmt.Fprintf(xmp, `<?xpacket begin="%s" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about=""
+  xmlns:pdfaid="http://www.aiim.org/pdfa/ns/id/"
+  xmlns:dc="http://purl.org/dc/elements/1.1/"
+  xmlns:pdf="http://ns.adobe.com/pdf/1.3/"
+  xmlns:xmp="http://ns.adobe.com/xap/1.0/">
+<pdfaid:part>2</pdfaid:part>
+<pdfaid:conformance>B</pdfaid:conformance>
+<pdf:Producer>%s</pdf:Producer>
+<xmp:CreatorTool>%s</xmp:CreatorTool>
+<xmp:CreateDate>%s</xmp:CreateDate>
+<xmp:ModifyDate>%s</xmp:ModifyDate>
+%s</rdf:Description>
+</rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`, "\ufeff", xmlEscape(i.Producer), xmlEscape(i.Creator), date, date, dc.String())
+
+	// The metadata stream must stay uncompressed to be found by tools
+	metaID := p.allocObject()
+	p.writeObject(metaID, "/Type /Metadata /Subtype /XML", xmp.Bytes())
+
+	iccID := p.allocObject()
+	p.writeObject(iccID, "/N 3", srgbICCProfile())
+
+	intentID := p.allocObject()
+	p.writeObject(intentID, fmt.Sprintf(
+		"/Type /OutputIntent /S /GTS_PDFA1 /OutputConditionIdentifier (sRGB) /Info (sRGB IEC61966-2.1) /DestOutputProfile %d 0 R",
+		iccID,
+	), nil)
+
+	return fmt.Sprintf(" /Metadata %d 0 R /OutputIntents [%d 0 R]", metaID, intentID)
+}
+
+// textString encodes a text string, encrypting it if the document is
+// encrypted
+func (p *Writer) textString(s string) string {
+	if p.enc == nil {
+		return pdfString(s)
+	}
+	return fmt.Sprintf("<%x>", p.enc.Encrypt(pdfTextBytes(s)))
+}
+
+func isASCII(s string) bool {
+	for _, r := range s {
+		if r > 126 {
+			return false
+		}
+	}
+	return true
+}
+
+// pdfTextBytes returns the byte representation of a text string: ASCII
+// is kept as is, everything else is UTF-16BE with byte order mark
+func pdfTextBytes(s string) []byte {
+	if isASCII(s) {
+		return []byte(s)
+	}
+
+	buf := []byte{0xfe, 0xff}
+	for _, c := range utf16.Encode([]rune(s)) {
+		buf = append(buf, byte(c>>8), byte(c))
+	}
+	return buf
+}
+
+// pdfString encodes a text string as PDF string: ASCII is kept readable
+// as literal string, everything else is written as hex string
+func pdfString(s string) string {
+	if isASCII(s) {
+		r := strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`, "\r", `\r`, "\n", `\n`)
+		return "(" + r.Replace(s) + ")"
+	}
+	return fmt.Sprintf("<%x>", pdfTextBytes(s))
+}
+
+// pdfDate formats the time in the PDF date format
+func pdfDate(t time.Time) string {
+	_, offset := t.Zone()
+	sign := '+'
+	if offset < 0 {
+		sign, offset = '-', -offset
+	}
+	return fmt.Sprintf("D:%s%c%02d'%02d'", t.Format("20060102150405"), sign, offset/3600, offset/60%60)
+}
+
+func xmlEscape(s string) string {
+	buf := new(bytes.Buffer)
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
+
+// JPEGImage wraps JPEG encoded data into an image, the color space is
+// taken from the JPEG header
+func JPEGImage(data []byte) (*Image, error) {
+	c, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read JPEG header: %s", err)
+	}
+
+	img := &Image{
+		Width:            c.Width,
+		Height:           c.Height,
+		ColorSpace:       "DeviceRGB",
+		BitsPerComponent: 8,
+		Filter:           "DCTDecode",
+		Data:             data,
+	}
+
+	switch c.ColorModel {
+	case color.GrayModel:
+		img.ColorSpace = "DeviceGray"
+	case color.CMYKModel:
+		img.ColorSpace = "DeviceCMYK"
+	}
+
+	return img, nil
+}
+
+// PNGImage embeds the compressed data of a PNG losslessly: the IDAT
+// chunks are zlib streams using the PNG predictors which FlateDecode
+// reverses. Only non-interlaced gray and RGB images without alpha
+// channel are supported.
+func PNGImage(data []byte) (*Image, error) {
+	if len(data) < 8 || !bytes.Equal(data[:8], []byte("\x89PNG\r\n\x1a\n")) {
+		return nil, fmt.Errorf("Unable to read PNG header: invalid signature")
+	}
+
+	var (
+		img    *Image
+		colors int
+		idat   = new(bytes.Buffer)
+	)
+	for rest := data[8:]; len(rest) >= 12; {
+		length := int(binary.BigEndian.Uint32(rest[:4]))
+		if length > len(rest)-12 {
+			return nil, fmt.Errorf("Unable to read PNG: truncated chunk")
+		}
+		typ, chunk := string(rest[4:8]), rest[8:8+length]
+		rest = rest[12+length:]
+
+		switch typ {
+		case "IHDR":
+			if length != 13 {
+				return nil, fmt.Errorf("Unable to read PNG header: invalid length")
+			}
+			img = &Image{
+				Width:            int(binary.BigEndian.Uint32(chunk[0:4])),
+				Height:           int(binary.BigEndian.Uint32(chunk[4:8])),
+				BitsPerComponent: int(chunk[8]),
+				Filter:           "FlateDecode",
+			}
+			switch chunk[9] {
+			case 0:
+				img.ColorSpace, colors = "DeviceGray", 1
+			case 2:
+				img.ColorSpace, colors = "DeviceRGB", 3
+			default:
+				return nil, fmt.Errorf("Unsupported PNG color type %d", chunk[9])
+			}
+			if img.BitsPerComponent != 8 && img.BitsPerComponent != 16 {
+				return nil, fmt.Errorf("Unsupported PNG bit depth %d", img.BitsPerComponent)
+			}
+			if chunk[12] != 0 {
+				return nil, fmt.Errorf("Interlaced PNG images are not supported")
+			}
+		case "IDAT":
+			idat.Write(chunk)
+		case "IEND":
+			rest = nil
+		}
+	}
+
+	if img == nil || idat.Len() == 0 {
+		return nil, fmt.Errorf("Unable to read PNG: missing image data")
+	}
+	img.DecodeParms = fmt.Sprintf("<</Predictor 15 /Colors %d /BitsPerComponent %d /Columns %d>>", colors, img.BitsPerComponent, img.Width)
+	img.Data = idat.Bytes()
+	return img, nil
+}
+
+// CCITTImage wraps bilevel image data encoded by EncodeCCITTG4
+func CCITTImage(width, height int, data []byte) *Image {
+	return &Image{
+		Width:            width,
+		Height:           height,
+		ColorSpace:       "DeviceGray",
+		BitsPerComponent: 1,
+		Filter:           "CCITTFaxDecode",
+		DecodeParms:      fmt.Sprintf("<</K -1 /Columns %d /Rows %d /BlackIs1 false>>", width, height),
+		Data:             data,
+	}
+}
@@ -0,0 +1,740 @@
+package pdfgen
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// The reader parses existing documents only as far as needed to append
+// pages to them: the cross-reference sections (tables and streams), the
+// catalog and the root of the page tree. Values are kept as their raw
+// bytes to write them back unchanged.
+
+type (
+	pdfName  string
+	pdfRef   struct{ ID, Gen int }
+	pdfArray []interface{}
+	// pdfRaw is a value not interpreted by the reader (strings, booleans)
+	pdfRaw []byte
+
+	pdfDict struct {
+		keys []string
+		vals map[string]interface{}
+		raw  map[string][]byte
+	}
+
+	pdfStream struct {
+		Dict pdfDict
+		Data []byte
+	}
+)
+
+// xrefEntry locates an object at an offset of the file or, if inStream
+// is set, as the index-th object of the object stream. Free objects
+// have a negative offset.
+type xrefEntry struct {
+	offset   int
+	inStream int
+	index    int
+}
+
+type pdfReader struct {
+	data    []byte
+	xref    map[int]xrefEntry
+	streams map[int]*objectStream
+
+	// depth counts the objects currently being read, references between
+	// them (stream lengths, object streams) must not loop
+	depth int
+}
+
+// objectStream is a decoded object stream: the objects start at the
+// offsets relative to first
+type objectStream struct {
+	data    []byte
+	first   int
+	offsets []int
+}
+
+var errUnexpectedEOF = errors.New("unexpected end of document")
+
+const (
+	// maxNesting limits the depth of nested arrays and dictionaries as
+	// well as the chains of objects read to resolve another one
+	maxNesting = 64
+
+	// maxObjects is the largest object number allowed by the
+	// implementation limits of ISO 32000-1, Annex C
+	maxObjects = 8388607
+
+	// maxDecodedSize limits the size of decoded streams to not let
+	// small compressed streams fill the memory
+	maxDecodedSize = 256 << 20
+)
+
+func (d pdfDict) get(key string) interface{} { return d.vals[key] }
+
+func (d pdfDict) name(key string) string {
+	n, _ := d.vals[key].(pdfName)
+	return string(n)
+}
+
+func (d pdfDict) ref(key string) (pdfRef, bool) {
+	r, ok := d.vals[key].(pdfRef)
+	return r, ok
+}
+
+// String returns the entries of the dictionary without the enclosing
+// brackets, leaving out the given keys
+func (d pdfDict) String(skip ...string) string {
+	buf := new(bytes.Buffer)
+outer:
+	for _, k := range d.keys {
+		for _, s := range skip {
+			if k == s {
+				continue outer
+			}
+		}
+		fmt.Fprintf(buf, " /%s %s", k, d.raw[k])
+	}
+	return buf.String()
+}
+
+func asInt(v interface{}) (int, bool) {
+	f, ok := v.(float64)
+	return int(f), ok && f == float64(int(f))
+}
+
+// pdfLexer reads the values of a document starting at pos, which must
+// be within the data
+type pdfLexer struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+func isPDFSpace(c byte) bool {
+	return c == 0 || c == '\t' || c == '\n' || c == '\f' || c == '\r' || c == ' '
+}
+
+func isPDFDelimiter(c byte) bool {
+	return bytes.IndexByte([]byte("()<>[]{}/%"), c) >= 0
+}
+
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		switch c := l.data[l.pos]; {
+		case isPDFSpace(c):
+			l.pos++
+		case c == '%':
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// token returns the regular characters starting at the current position
+func (l *pdfLexer) token() string {
+	start := l.pos
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+	return string(l.data[start:l.pos])
+}
+
+// keyword reads the expected keyword
+func (l *pdfLexer) keyword(kw string) error {
+	l.skipSpace()
+	if t := l.token(); t != kw {
+		return fmt.Errorf("expected %q at offset %d, found %q", kw, l.pos, t)
+	}
+	return nil
+}
+
+func (l *pdfLexer) int() (int, error) {
+	l.skipSpace()
+	t := l.token()
+	n, err := strconv.Atoi(t)
+	if err != nil {
+		return 0, fmt.Errorf("expected integer at offset %d, found %q", l.pos, t)
+	}
+	return n, nil
+}
+
+// value reads the next value: a dictionary, array, name, number,
+// reference or a raw string / keyword
+func (l *pdfLexer) value() (interface{}, error) {
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, errUnexpectedEOF
+	}
+
+	start := l.pos
+	switch c := l.data[l.pos]; {
+	case c == '/':
+		l.pos++
+		return pdfName(l.token()), nil
+
+	case c == '(':
+		depth := 0
+		for ; l.pos < len(l.data); l.pos++ {
+			switch l.data[l.pos] {
+			case '\\':
+				l.pos++
+			case '(':
+				depth++
+			case ')':
+				if depth--; depth == 0 {
+					l.pos++
+					return pdfRaw(l.data[start:l.pos]), nil
+				}
+			}
+		}
+		return nil, errUnexpectedEOF
+
+	case (c == '[' || c == '<' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '<') && l.depth >= maxNesting:
+		return nil, fmt.Errorf("too deeply nested value at offset %d", start)
+
+	case c == '<' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '<':
+		l.depth++
+		defer func() { l.depth-- }()
+		return l.dict()
+
+	case c == '<':
+		end := bytes.IndexByte(l.data[l.pos:], '>')
+		if end < 0 {
+			return nil, errUnexpectedEOF
+		}
+		l.pos += end + 1
+		return pdfRaw(l.data[start:l.pos]), nil
+
+	case c == '[':
+		l.depth++
+		defer func() { l.depth-- }()
+		l.pos++
+		arr := pdfArray{}
+		for {
+			l.skipSpace()
+			if l.pos >= len(l.data) {
+				return nil, errUnexpectedEOF
+			}
+			if l.data[l.pos] == ']' {
+				l.pos++
+				return arr, nil
+			}
+			v, err := l.value()
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+
+	case c == '+' || c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		t := l.token()
+		n, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at offset %d", t, start)
+		}
+
+		// Integers might be the object number of a reference "1 0 R"
+		if id, ok := asInt(n); ok && id >= 0 {
+			end := l.pos
+			if gen, err := l.int(); err == nil {
+				l.skipSpace()
+				if l.token() == "R" {
+					return pdfRef{id, gen}, nil
+				}
+			}
+			l.pos = end
+		}
+		return n, nil
+
+	case isPDFDelimiter(c):
+		return nil, fmt.Errorf("unexpected %q at offset %d", c, start)
+	}
+
+	// true, false, null
+	if t := l.token(); t != "null" {
+		return pdfRaw(t), nil
+	}
+	return nil, nil
+}
+
+func (l *pdfLexer) dict() (interface{}, error) {
+	l.pos += 2
+	d := pdfDict{vals: map[string]interface{}{}, raw: map[string][]byte{}}
+	for {
+		l.skipSpace()
+		if l.pos+1 >= len(l.data) {
+			return nil, errUnexpectedEOF
+		}
+		if l.data[l.pos] == '>' && l.data[l.pos+1] == '>' {
+			l.pos += 2
+			return d, nil
+		}
+
+		key, err := l.value()
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(pdfName)
+		if !ok {
+			return nil, fmt.Errorf("expected dictionary key at offset %d", l.pos)
+		}
+
+		l.skipSpace()
+		start := l.pos
+		v, err := l.value()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, exists := d.vals[string(name)]; !exists {
+			d.keys = append(d.keys, string(name))
+		}
+		d.vals[string(name)] = v
+		d.raw[string(name)] = l.data[start:l.pos]
+	}
+}
+
+// objectAt reads the indirect object starting at the offset
+func (r *pdfReader) objectAt(offset int) (int, interface{}, error) {
+	if offset < 0 || offset >= len(r.data) {
+		return 0, nil, fmt.Errorf("invalid object offset %d", offset)
+	}
+	l := &pdfLexer{data: r.data, pos: offset}
+
+	id, err := l.int()
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err = l.int(); err != nil {
+		return 0, nil, err
+	}
+	if err = l.keyword("obj"); err != nil {
+		return 0, nil, err
+	}
+
+	v, err := l.value()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	dict, ok := v.(pdfDict)
+	if !ok {
+		return id, v, nil
+	}
+	l.skipSpace()
+	if !bytes.HasPrefix(r.data[l.pos:], []byte("stream")) {
+		return id, v, nil
+	}
+
+	// The data starts after the end of the line of the keyword
+	l.pos += len("stream")
+	if bytes.HasPrefix(r.data[l.pos:], []byte("\r\n")) {
+		l.pos += 2
+	} else if l.pos < len(r.data) && r.data[l.pos] == '\n' {
+		l.pos++
+	}
+
+	lv, err := r.resolve(dict.get("Length"))
+	if err != nil {
+		return 0, nil, err
+	}
+	length, ok := asInt(lv)
+	if !ok || length < 0 || l.pos+length > len(r.data) {
+		return 0, nil, fmt.Errorf("invalid length of stream object %d", id)
+	}
+
+	return id, pdfStream{dict, r.data[l.pos : l.pos+length]}, nil
+}
+
+// resolve returns the object referenced by v or v if it is no reference
+func (r *pdfReader) resolve(v interface{}) (interface{}, error) {
+	ref, ok := v.(pdfRef)
+	if !ok {
+		return v, nil
+	}
+	return r.object(ref.ID)
+}
+
+// object returns the object with the number, nil if it does not exist
+func (r *pdfReader) object(id int) (interface{}, error) {
+	e, ok := r.xref[id]
+	if !ok || (e.inStream == 0 && e.offset < 0) {
+		return nil, nil
+	}
+
+	if r.depth >= maxNesting {
+		return nil, fmt.Errorf("loop in references to object %d", id)
+	}
+	r.depth++
+	defer func() { r.depth-- }()
+
+	if e.inStream == 0 {
+		oid, v, err := r.objectAt(e.offset)
+		if err != nil {
+			return nil, err
+		}
+		if oid != id {
+			return nil, fmt.Errorf("cross-reference table points to object %d instead of %d", oid, id)
+		}
+		return v, nil
+	}
+
+	s, err := r.objectStream(e.inStream)
+	if err != nil {
+		return nil, err
+	}
+	if e.index >= len(s.offsets) {
+		return nil, fmt.Errorf("object %d is missing in object stream %d", id, e.inStream)
+	}
+	pos := s.first + s.offsets[e.index]
+	if pos < 0 || pos >= len(s.data) {
+		return nil, fmt.Errorf("invalid offset of object %d in object stream %d", id, e.inStream)
+	}
+	l := &pdfLexer{data: s.data, pos: pos}
+	return l.value()
+}
+
+// objectStream returns the decoded object stream with the number
+func (r *pdfReader) objectStream(id int) (*objectStream, error) {
+	if s, ok := r.streams[id]; ok {
+		return s, nil
+	}
+	if e := r.xref[id]; e.inStream != 0 {
+		return nil, fmt.Errorf("object stream %d is stored in an object stream", id)
+	}
+
+	v, err := r.object(id)
+	if err != nil {
+		return nil, err
+	}
+	stream, ok := v.(pdfStream)
+	if !ok || stream.Dict.name("Type") != "ObjStm" {
+		return nil, fmt.Errorf("object %d is no object stream", id)
+	}
+	data, err := stream.decode()
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode object stream %d: %s", id, err)
+	}
+
+	var (
+		n, _     = asInt(stream.Dict.get("N"))
+		first, _ = asInt(stream.Dict.get("First"))
+		l        = &pdfLexer{data: data}
+		s        = &objectStream{data: data, first: first}
+	)
+	for i := 0; i < n; i++ {
+		if _, err := l.int(); err != nil {
+			return nil, err
+		}
+		off, err := l.int()
+		if err != nil {
+			return nil, err
+		}
+		s.offsets = append(s.offsets, off)
+	}
+
+	r.streams[id] = s
+	return s, nil
+}
+
+// decode returns the data of FlateDecode compressed or uncompressed
+// streams, other filters are not used by the structures read
+func (s pdfStream) decode() ([]byte, error) {
+	var (
+		filter = s.Dict.get("Filter")
+		parms  = s.Dict.get("DecodeParms")
+	)
+	if arr, ok := filter.(pdfArray); ok && len(arr) == 1 {
+		filter = arr[0]
+		if p, ok := parms.(pdfArray); ok && len(p) == 1 {
+			parms = p[0]
+		}
+	}
+
+	switch filter {
+	case nil:
+		return s.Data, nil
+	case pdfName("FlateDecode"):
+	default:
+		return nil, fmt.Errorf("unsupported filter %v", filter)
+	}
+
+	data, err := inflate(s.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	p, _ := parms.(pdfDict)
+	predictor, _ := asInt(p.get("Predictor"))
+	if predictor < 10 {
+		return data, nil
+	}
+	columns, ok := asInt(p.get("Columns"))
+	if !ok {
+		columns = 1
+	}
+	return decodePNGPredictor(data, columns)
+}
+
+// inflate decompresses zlib data up to maxDecodedSize
+func inflate(data []byte) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	out, err := io.ReadAll(io.LimitReader(zr, maxDecodedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxDecodedSize {
+		return nil, fmt.Errorf("decoded stream exceeds %d MiB", maxDecodedSize>>20)
+	}
+	return out, nil
+}
+
+// decodePNGPredictor reverses the PNG filters applied to every row of
+// the data, which is prefixed by the filter type
+func decodePNGPredictor(data []byte, columns int) ([]byte, error) {
+	if columns < 1 || columns > len(data) || len(data)%(columns+1) != 0 {
+		return nil, fmt.Errorf("invalid length of predicted data")
+	}
+
+	var (
+		out  = make([]byte, 0, len(data)/(columns+1)*columns)
+		prev = make([]byte, columns)
+	)
+	for len(data) > 0 {
+		row := data[1 : columns+1]
+		for i := range row {
+			var left, up, upLeft byte = 0, prev[i], 0
+			if i > 0 {
+				left, upLeft = row[i-1], prev[i-1]
+			}
+
+			switch data[0] {
+			case 0:
+			case 1:
+				row[i] += left
+			case 2:
+				row[i] += up
+			case 3:
+				row[i] += byte((int(left) + int(up)) / 2)
+			case 4:
+				row[i] += paeth(left, up, upLeft)
+			default:
+				return nil, fmt.Errorf("unknown PNG filter %d", data[0])
+			}
+		}
+
+		out = append(out, row...)
+		prev = row
+		data = data[columns+1:]
+	}
+
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := absInt(p-int(a)), absInt(p-int(b)), absInt(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// readXRef reads the cross-reference sections starting with the one
+// at the offset and returns the trailer of the newest one. Entries of
+// newer sections take precedence.
+func (r *pdfReader) readXRef(offset int) (pdfDict, error) {
+	var (
+		trailer pdfDict
+		seen    = map[int]bool{}
+	)
+
+	for {
+		if seen[offset] {
+			return trailer, fmt.Errorf("loop in cross-reference sections")
+		}
+		seen[offset] = true
+
+		if offset < 0 || offset >= len(r.data) {
+			return trailer, fmt.Errorf("invalid cross-reference offset %d", offset)
+		}
+
+		var (
+			t   pdfDict
+			err error
+		)
+		if bytes.HasPrefix(r.data[offset:], []byte("xref")) {
+			t, err = r.readXRefTable(offset)
+		} else {
+			t, err = r.readXRefStream(offset)
+		}
+		if err != nil {
+			return trailer, err
+		}
+
+		if stm, ok := asInt(t.get("XRefStm")); ok {
+			// Hybrid files list compressed objects in a separate stream
+			if _, err := r.readXRefStream(stm); err != nil {
+				return trailer, err
+			}
+		}
+
+		if trailer.vals == nil {
+			trailer = t
+		}
+		prev, ok := asInt(t.get("Prev"))
+		if !ok {
+			return trailer, nil
+		}
+		offset = prev
+	}
+}
+
+func (r *pdfReader) addXRef(id int, e xrefEntry) {
+	if _, ok := r.xref[id]; !ok {
+		r.xref[id] = e
+	}
+}
+
+func (r *pdfReader) readXRefTable(offset int) (pdfDict, error) {
+	l := &pdfLexer{data: r.data, pos: offset + len("xref")}
+
+	for {
+		l.skipSpace()
+		if bytes.HasPrefix(r.data[l.pos:], []byte("trailer")) {
+			break
+		}
+
+		start, err := l.int()
+		if err != nil {
+			return pdfDict{}, err
+		}
+		count, err := l.int()
+		if err != nil {
+			return pdfDict{}, err
+		}
+
+		for i := 0; i < count; i++ {
+			off, err := l.int()
+			if err != nil {
+				return pdfDict{}, err
+			}
+			if _, err = l.int(); err != nil {
+				return pdfDict{}, err
+			}
+			l.skipSpace()
+			if l.token() != "n" {
+				off = -1
+			}
+			r.addXRef(start+i, xrefEntry{offset: off})
+		}
+	}
+
+	if err := l.keyword("trailer"); err != nil {
+		return pdfDict{}, err
+	}
+	v, err := l.value()
+	if err != nil {
+		return pdfDict{}, err
+	}
+	trailer, ok := v.(pdfDict)
+	if !ok {
+		return pdfDict{}, fmt.Errorf("invalid trailer")
+	}
+	return trailer, nil
+}
+
+func (r *pdfReader) readXRefStream(offset int) (pdfDict, error) {
+	_, v, err := r.objectAt(offset)
+	if err != nil {
+		return pdfDict{}, err
+	}
+	stream, ok := v.(pdfStream)
+	if !ok || stream.Dict.name("Type") != "XRef" {
+		return pdfDict{}, fmt.Errorf("no cross-reference section at offset %d", offset)
+	}
+	data, err := stream.decode()
+	if err != nil {
+		return pdfDict{}, fmt.Errorf("unable to decode cross-reference stream: %s", err)
+	}
+
+	var w [3]int
+	warr, _ := stream.Dict.get("W").(pdfArray)
+	if len(warr) != 3 {
+		return pdfDict{}, fmt.Errorf("invalid field widths of cross-reference stream")
+	}
+	for i := range w {
+		var ok bool
+		if w[i], ok = asInt(warr[i]); !ok || w[i] < 0 || w[i] > 8 {
+			return pdfDict{}, fmt.Errorf("invalid field widths of cross-reference stream")
+		}
+	}
+	rowLen := w[0] + w[1] + w[2]
+	if rowLen == 0 {
+		return pdfDict{}, fmt.Errorf("invalid field widths of cross-reference stream")
+	}
+
+	index, _ := stream.Dict.get("Index").(pdfArray)
+	if index == nil {
+		size, _ := asInt(stream.Dict.get("Size"))
+		index = pdfArray{float64(0), float64(size)}
+	}
+
+	field := func(b []byte) int {
+		n := 0
+		for _, c := range b {
+			n = n<<8 | int(c)
+		}
+		return n
+	}
+
+	for i := 0; i+1 < len(index); i += 2 {
+		start, _ := asInt(index[i])
+		count, _ := asInt(index[i+1])
+		for j := 0; j < count; j++ {
+			if len(data) < rowLen {
+				return pdfDict{}, fmt.Errorf("cross-reference stream too short")
+			}
+			typ := 1 // default if the type field is omitted
+			if w[0] > 0 {
+				typ = field(data[:w[0]])
+			}
+			a, b := field(data[w[0]:w[0]+w[1]]), field(data[w[0]+w[1]:rowLen])
+			data = data[rowLen:]
+
+			switch typ {
+			case 0:
+				r.addXRef(start+j, xrefEntry{offset: -1})
+			case 1:
+				r.addXRef(start+j, xrefEntry{offset: a})
+			case 2:
+				r.addXRef(start+j, xrefEntry{inStream: a, index: b})
+			}
+		}
+	}
+
+	return stream.Dict, nil
+}
@@ -0,0 +1,162 @@
+package pdfgen
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// testDocument generates a document with the number of image pages
+func testDocument(t testing.TB, pages int) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, Options{Info: Info{Title: "Test"}})
+	for i := 0; i < pages; i++ {
+		w.AddBookmark(fmt.Sprintf("Page %d", i+1))
+		if err := w.AddImagePage(testImage(t, uint8(i*40))); err != nil {
+			t.Fatalf("adding page: %s", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing document: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func testImage(t testing.TB, shade uint8) *Image {
+	t.Helper()
+
+	img := image.NewGray(image.Rect(0, 0, 32, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 32; x++ {
+			img.SetGray(x, y, color.Gray{Y: shade + uint8(x^y)})
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatalf("encoding image: %s", err)
+	}
+	pimg, err := PNGImage(buf.Bytes())
+	if err != nil {
+		t.Fatalf("reading image: %s", err)
+	}
+	return pimg
+}
+
+// withStartXRef replaces the offset of the cross-reference section
+func withStartXRef(data []byte, offset string) []byte {
+	start := bytes.LastIndex(data, []byte("startxref"))
+	return append(append([]byte{}, data[:start]...), []byte("startxref\n"+offset+"\n%%EOF\n")...)
+}
+
+func TestReadDocument(t *testing.T) {
+	doc, err := ReadDocument(testDocument(t, 3))
+	if err != nil {
+		t.Fatalf("reading document: %s", err)
+	}
+	if doc.Pages != 3 {
+		t.Errorf("expected 3 pages, got %d", doc.Pages)
+	}
+	if doc.firstPageID == 0 || doc.firstPage.name("Type") != "Page" {
+		t.Errorf("first page not found")
+	}
+}
+
+// rawDocument builds a document of the objects numbered from 1 with a
+// cross-reference table, the first one is the catalog
+func rawDocument(objects ...string) []byte {
+	buf := bytes.NewBufferString("%PDF-1.4\n")
+	offsets := []int{}
+	for i, obj := range objects {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(buf, "trailer\n<</Size %d /Root 1 0 R>>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+// withObjectOffset replaces the offset of the object in the
+// cross-reference table written by rawDocument
+func withObjectOffset(data []byte, id int, offset string) []byte {
+	start := bytes.Index(data, []byte("65535 f \n")) + len("65535 f \n") + (id-1)*20
+	return append(append(append([]byte{}, data[:start]...), fmt.Sprintf("%10s", offset)...), data[start+10:]...)
+}
+
+func TestReadDocumentMalformed(t *testing.T) {
+	var (
+		data  = testDocument(t, 1)
+		valid = rawDocument("<</Type /Catalog /Pages 2 0 R>>", "<</Type /Pages /Kids [] /Count 0>>")
+	)
+	if _, err := ReadDocument(valid); err != nil {
+		t.Fatalf("reading raw document: %s", err)
+	}
+
+	for name, doc := range map[string][]byte{
+		"no PDF":             []byte("hello world"),
+		"no startxref":       []byte("%PDF-1.4\n"),
+		"xref past EOF":      withStartXRef(data, "99999999"),
+		"negative xref":      withStartXRef(data, "-12"),
+		"xref at EOF":        withStartXRef(data, fmt.Sprint(len(data))),
+		"xref not numeric":   withStartXRef(data, "abc"),
+		"truncated":          data[:len(data)/2],
+		"object past EOF":    withObjectOffset(valid, 2, "9999999999"),
+		"negative object":    withObjectOffset(valid, 2, "-5"),
+		"object at EOF":      withObjectOffset(valid, 2, fmt.Sprint(len(valid))),
+		"pages past size":    rawDocument("<</Type /Catalog /Pages 6 0 R>>", "<</Type /Pages /Kids [] /Count 0>>"),
+		"nested arrays":      rawDocument("<</Type /Catalog /Pages 2 0 R>>", strings.Repeat("[", 100000)),
+		"self-ref length":    rawDocument("<</Type /Catalog /Pages 2 0 R>>", "<</Length 2 0 R>>\nstream\nabc\nendstream"),
+		"nested obj stream":  rawDocument("<</Type /Catalog /Pages 2 0 R>>", "<</Type /ObjStm /N 1 /First 4 /Length 2 0 R>>\nstream\n2 0 null\nendstream"),
+		"huge trailer size":  bytes.Replace(data, []byte("/Size "), []byte("/Size 99999999999"), 1),
+		"zero xref widths":   xrefStreamDocument("/W [0 0 0] /Size 99999999999"),
+		"invalid xref width": xrefStreamDocument("/W [1 -2 1] /Size 1"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ReadDocument(doc); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+// xrefStreamDocument builds a document with an empty cross-reference
+// stream using the dictionary entries
+func xrefStreamDocument(dict string) []byte {
+	doc := "%PDF-1.5\n"
+	xref := len(doc)
+	return []byte(fmt.Sprintf("%s1 0 obj\n<</Type /XRef %s /Length 0>>\nstream\n\nendstream\nendobj\nstartxref\n%d\n%%%%EOF\n", doc, dict, xref))
+}
+
+func TestObjectAtOffsets(t *testing.T) {
+	r := &pdfReader{data: []byte("1 0 obj null endobj"), xref: map[int]xrefEntry{}, streams: map[int]*objectStream{}}
+	for _, offset := range []int{-1, len(r.data), len(r.data) + 100} {
+		if _, _, err := r.objectAt(offset); err == nil {
+			t.Errorf("expected an error for offset %d", offset)
+		}
+	}
+	if _, _, err := r.objectAt(0); err != nil {
+		t.Errorf("reading object: %s", err)
+	}
+}
+
+func FuzzReadDocument(f *testing.F) {
+	f.Add(testDocument(f, 1))
+	f.Add(testDocument(f, 2))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		doc, err := ReadDocument(data)
+		if err != nil {
+			return
+		}
+		NewAppendWriter(new(bytes.Buffer), doc, false).Close()
+	})
+}
@@ -0,0 +1,324 @@
+package pdfgen
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Object identifiers of the CMS structures (RFC 5652, RFC 5035)
+var (
+	oidData                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningCertificateV2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+	oidSHA256               = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256      = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+// byteRangeSize is the space reserved for the offsets of the /ByteRange
+const byteRangeSize = 32
+
+// Signer adds PAdES signatures (baseline B-B, detached CMS) to
+// documents, they prove the document was not modified since it was
+// signed using the key of the certificate
+type Signer struct {
+	Key crypto.Signer
+	// Certificates is the chain of the certificate of the key, starting
+	// with the certificate of the key
+	Certificates []*x509.Certificate
+	// Reason and Location are shown with the signature
+	Reason   string
+	Location string
+}
+
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerial
+	DigestAlgorithm    algorithmIdentifier
+	SignedAttrs        asn1.RawValue
+	SignatureAlgorithm algorithmIdentifier
+	Signature          []byte
+}
+
+// essCertIDv2 identifies the signing certificate by its hash, SHA-256
+// is the default algorithm which is left out
+type essCertIDv2 struct {
+	CertHash []byte
+}
+
+type signingCertificateV2 struct {
+	Certs []essCertIDv2
+}
+
+type encapContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []algorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapContentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      []signerInfo `asn1:"set"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+// Sign copies the document to w and signs it as of signingTime in an
+// incremental update adding an invisible signature field to the first
+// page
+func (s *Signer) Sign(w io.Writer, doc *Document, signingTime time.Time) error {
+	if len(s.Certificates) == 0 || s.Key == nil {
+		return fmt.Errorf("no key or certificate to sign with")
+	}
+	if doc.firstPageID == 0 {
+		return fmt.Errorf("document has no pages")
+	}
+
+	buf := new(bytes.Buffer)
+	p := newUpdateWriter(buf, doc)
+	sigID, fieldID := p.allocObject(), p.allocObject()
+
+	annots, _, err := doc.refsWith(doc.firstPage.get("Annots"), fieldID)
+	if err != nil {
+		return fmt.Errorf("unsupported annotations of the first page: %s", err)
+	}
+
+	// Documents signed before (e.g. pages added to a signed document)
+	// keep their fields
+	form := pdfDict{}
+	v, err := doc.reader.resolve(doc.catalog.get("AcroForm"))
+	if err != nil {
+		return fmt.Errorf("unable to read form of the document: %s", err)
+	}
+	if v != nil {
+		var ok bool
+		if form, ok = v.(pdfDict); !ok {
+			return fmt.Errorf("unsupported form of the document")
+		}
+	}
+	fields, count, err := doc.refsWith(form.get("Fields"), fieldID)
+	if err != nil {
+		return fmt.Errorf("unsupported form of the document: %s", err)
+	}
+
+	// The signature is written into the reserved /Contents once the
+	// ranges of the document around it are known
+	contentsSize := 2 * s.estimateSize()
+	sig := fmt.Sprintf("/Type /Sig /Filter /Adobe.PPKLite /SubFilter /ETSI.CAdES.detached /ByteRange [0 %s] /Contents <%s> /M %s",
+		strings.Repeat(" ", byteRangeSize), strings.Repeat("0", contentsSize), p.textString(pdfDate(signingTime)))
+	if s.Reason != "" {
+		sig += " /Reason " + p.textString(s.Reason)
+	}
+	if s.Location != "" {
+		sig += " /Location " + p.textString(s.Location)
+	}
+	p.writeObject(sigID, sig, nil)
+
+	// Widget of the field without appearance, it is not shown and printed
+	// (Print and Locked flags as required by PDF/A)
+	p.writeObject(fieldID, fmt.Sprintf("/Type /Annot /Subtype /Widget /FT /Sig /T %s /V %d 0 R /F 132 /Rect [0 0 0 0] /P %d 0 R",
+		pdfString(fmt.Sprintf("Signature%d", count)), sigID, doc.firstPageID), nil)
+	p.writeObject(doc.firstPageID, doc.firstPage.String("Annots")+" /Annots "+annots, nil)
+
+	catalogID := p.allocObject()
+	p.writeObject(catalogID, doc.catalog.String("AcroForm")+fmt.Sprintf(" /AcroForm <<%s /Fields %s /SigFlags 3>>", form.String("Fields", "SigFlags"), fields), nil)
+
+	if err := p.closeUpdate(catalogID); err != nil {
+		return err
+	}
+
+	out := buf.Bytes()
+	sigStart := int(p.offsets[sigID-1])
+	rangeStart := sigStart + bytes.Index(out[sigStart:], []byte("/ByteRange [0 ")) + len("/ByteRange [0 ")
+	contentsStart := sigStart + bytes.Index(out[sigStart:], []byte("/Contents <")) + len("/Contents ")
+	contentsEnd := contentsStart + contentsSize + 2
+
+	byteRange := fmt.Sprintf("%d %d %d", contentsStart, contentsEnd, len(out)-contentsEnd)
+	copy(out[rangeStart:], fmt.Sprintf("%-*s", byteRangeSize, byteRange))
+
+	h := sha256.New()
+	h.Write(out[:contentsStart])
+	h.Write(out[contentsEnd:])
+
+	cms, err := s.signedData(h.Sum(nil))
+	if err != nil {
+		return err
+	}
+	if 2*len(cms) > contentsSize {
+		return fmt.Errorf("signature exceeds the reserved space")
+	}
+	hex.Encode(out[contentsStart+1:], cms)
+
+	_, err = w.Write(out)
+	return err
+}
+
+// refsWith returns the array of references v (or the array v refers
+// to) with the object added and the number of references in it
+func (d *Document) refsWith(v interface{}, id int) (string, int, error) {
+	v, err := d.reader.resolve(v)
+	if err != nil {
+		return "", 0, err
+	}
+
+	refs := []string{}
+	if v != nil {
+		arr, ok := v.(pdfArray)
+		if !ok {
+			return "", 0, fmt.Errorf("no array")
+		}
+		for _, a := range arr {
+			r, ok := a.(pdfRef)
+			if !ok {
+				return "", 0, fmt.Errorf("no reference in array")
+			}
+			refs = append(refs, fmt.Sprintf("%d %d R", r.ID, r.Gen))
+		}
+	}
+
+	refs = append(refs, fmt.Sprintf("%d 0 R", id))
+	return "[" + strings.Join(refs, " ") + "]", len(refs), nil
+}
+
+// estimateSize returns the maximum size of the CMS structure
+func (s *Signer) estimateSize() int {
+	size := 1024
+	for _, c := range s.Certificates {
+		size += len(c.Raw)
+	}
+	if k, ok := s.Key.Public().(*rsa.PublicKey); ok {
+		size += k.Size()
+	} else {
+		size += 160
+	}
+	return size
+}
+
+// signedData creates the detached CMS signature of the document digest
+func (s *Signer) signedData(digest []byte) ([]byte, error) {
+	var sigAlg algorithmIdentifier
+	switch s.Key.Public().(type) {
+	case *rsa.PublicKey:
+		sigAlg = algorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	case *ecdsa.PublicKey:
+		sigAlg = algorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, RSA or ECDSA is required", s.Key.Public())
+	}
+
+	cert := s.Certificates[0]
+	certHash := sha256.Sum256(cert.Raw)
+
+	attrs, err := signedAttributes(
+		cmsAttr(oidContentType, oidData),
+		cmsAttr(oidMessageDigest, digest),
+		// Binds the certificate to the signature as required by PAdES
+		cmsAttr(oidSigningCertificateV2, signingCertificateV2{Certs: []essCertIDv2{{CertHash: certHash[:]}}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// The attributes are signed as SET, they are stored implicitly tagged
+	set, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: attrs})
+	if err != nil {
+		return nil, err
+	}
+	attrsDigest := sha256.Sum256(set)
+	signature, err := s.Key.Sign(rand.Reader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign: %s", err)
+	}
+
+	certs := []byte{}
+	for _, c := range s.Certificates {
+		certs = append(certs, c.Raw...)
+	}
+
+	sd, err := asn1.Marshal(signedData{
+		Version:          1,
+		DigestAlgorithms: []algorithmIdentifier{{Algorithm: oidSHA256}},
+		EncapContentInfo: encapContentInfo{ContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                issuerAndSerial{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, Serial: cert.SerialNumber},
+			DigestAlgorithm:    algorithmIdentifier{Algorithm: oidSHA256},
+			SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrs},
+			SignatureAlgorithm: sigAlg,
+			Signature:          signature,
+		}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode signature: %s", err)
+	}
+
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd},
+	})
+}
+
+// cmsAttrValue is an attribute with a single value to be encoded
+type cmsAttrValue struct {
+	oid   asn1.ObjectIdentifier
+	value interface{}
+}
+
+func cmsAttr(oid asn1.ObjectIdentifier, value interface{}) cmsAttrValue {
+	return cmsAttrValue{oid, value}
+}
+
+// signedAttributes encodes the attributes in the order required for a
+// DER SET, without the SET header
+func signedAttributes(values ...cmsAttrValue) ([]byte, error) {
+	encoded := [][]byte{}
+	for _, v := range values {
+		raw, err := asn1.Marshal(v.value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode attribute: %s", err)
+		}
+		attr, err := asn1.Marshal(cmsAttribute{Type: v.oid, Values: []asn1.RawValue{{FullBytes: raw}}})
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode attribute: %s", err)
+		}
+		encoded = append(encoded, attr)
+	}
+
+	sort.Slice(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 })
+	return bytes.Join(encoded, nil), nil
+}
@@ -0,0 +1,237 @@
+package pdfgen
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testSigner creates a signer with a self-signed certificate of the key
+func testSigner(t *testing.T, key crypto.Signer) *Signer {
+	t.Helper()
+
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "scansnap-go test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("creating certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing certificate: %s", err)
+	}
+	return &Signer{Key: key, Certificates: []*x509.Certificate{cert}, Reason: "Scanned", Location: "Office"}
+}
+
+// verifySignature checks the last signature of the document like a
+// reader and returns the signer info
+func verifySignature(t *testing.T, out []byte, cert *x509.Certificate) signerInfo {
+	t.Helper()
+
+	var r [4]int
+	start := bytes.LastIndex(out, []byte("/ByteRange ["))
+	if _, err := fmt.Sscanf(string(out[start:]), "/ByteRange [%d %d %d %d", &r[0], &r[1], &r[2], &r[3]); err != nil {
+		t.Fatalf("reading byte range: %s", err)
+	}
+	if r[0] != 0 || r[2]+r[3] != len(out) || out[r[1]] != '<' || out[r[2]-1] != '>' {
+		t.Fatalf("byte range %v does not cover the document except the signature", r)
+	}
+
+	der, err := hex.DecodeString(string(out[r[1]+1 : r[2]-1]))
+	if err != nil {
+		t.Fatalf("decoding signature: %s", err)
+	}
+
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil || !ci.ContentType.Equal(oidSignedData) {
+		t.Fatalf("expected signed data, got %v (%v)", ci.ContentType, err)
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatalf("parsing signed data: %s", err)
+	}
+	if len(sd.SignerInfos) != 1 || !bytes.Equal(sd.Certificates.Bytes, cert.Raw) {
+		t.Fatalf("expected one signer with its certificate, got %d signers", len(sd.SignerInfos))
+	}
+	si := sd.SignerInfos[0]
+
+	attrs := map[string][]byte{}
+	for rest := si.SignedAttrs.Bytes; len(rest) > 0; {
+		var attr cmsAttribute
+		if rest, err = asn1.Unmarshal(rest, &attr); err != nil || len(attr.Values) != 1 {
+			t.Fatalf("parsing signed attribute: %v", err)
+		}
+		attrs[attr.Type.String()] = attr.Values[0].FullBytes
+	}
+
+	h := sha256.New()
+	h.Write(out[r[0]:r[1]])
+	h.Write(out[r[2] : r[2]+r[3]])
+	var digest []byte
+	if _, err := asn1.Unmarshal(attrs[oidMessageDigest.String()], &digest); err != nil || !bytes.Equal(digest, h.Sum(nil)) {
+		t.Errorf("message digest does not match the signed byte ranges")
+	}
+	certHash := sha256.Sum256(cert.Raw)
+	var signingCert signingCertificateV2
+	if _, err := asn1.Unmarshal(attrs[oidSigningCertificateV2.String()], &signingCert); err != nil ||
+		len(signingCert.Certs) != 1 || !bytes.Equal(signingCert.Certs[0].CertHash, certHash[:]) {
+		t.Errorf("signing certificate attribute does not match the certificate")
+	}
+
+	set, _ := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: si.SignedAttrs.Bytes})
+	attrsDigest := sha256.Sum256(set)
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, attrsDigest[:], si.Signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, attrsDigest[:], si.Signature) {
+			err = fmt.Errorf("invalid ECDSA signature")
+		}
+	}
+	if err != nil {
+		t.Errorf("signature of the attributes is invalid: %s", err)
+	}
+	return si
+}
+
+func TestSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating RSA key: %s", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating ECDSA key: %s", err)
+	}
+
+	for name, tc := range map[string]struct {
+		key crypto.Signer
+		alg asn1.ObjectIdentifier
+	}{
+		"rsa":   {rsaKey, oidRSAEncryption},
+		"ecdsa": {ecKey, oidECDSAWithSHA256},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := testSigner(t, tc.key)
+			orig := testDocument(t, 2)
+			doc, err := ReadDocument(orig)
+			if err != nil {
+				t.Fatalf("reading document: %s", err)
+			}
+
+			buf := new(bytes.Buffer)
+			if err := s.Sign(buf, doc, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)); err != nil {
+				t.Fatalf("signing document: %s", err)
+			}
+			out := buf.Bytes()
+
+			if !bytes.HasPrefix(out, orig) {
+				t.Errorf("signature is not an incremental update of the document")
+			}
+			for _, s := range []string{"/SubFilter /ETSI.CAdES.detached", "/Reason (Scanned)", "/Location (Office)", "/T (Signature1)", "/SigFlags 3"} {
+				if !bytes.Contains(out[len(orig):], []byte(s)) {
+					t.Errorf("update does not contain %q", s)
+				}
+			}
+			if si := verifySignature(t, out, s.Certificates[0]); !si.SignatureAlgorithm.Algorithm.Equal(tc.alg) {
+				t.Errorf("expected signature algorithm %v, got %v", tc.alg, si.SignatureAlgorithm.Algorithm)
+			}
+
+			signed, err := ReadDocument(out)
+			if err != nil {
+				t.Fatalf("reading signed document: %s", err)
+			}
+			if signed.Pages != 2 {
+				t.Errorf("expected 2 pages, got %d", signed.Pages)
+			}
+		})
+	}
+}
+
+func TestSignTwice(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s := testSigner(t, key)
+
+	out := testDocument(t, 1)
+	for i := 1; i <= 2; i++ {
+		doc, err := ReadDocument(out)
+		if err != nil {
+			t.Fatalf("reading document: %s", err)
+		}
+		buf := new(bytes.Buffer)
+		if err := s.Sign(buf, doc, time.Now()); err != nil {
+			t.Fatalf("signing document: %s", err)
+		}
+		out = buf.Bytes()
+	}
+
+	if !bytes.Contains(out, []byte("/T (Signature2)")) {
+		t.Errorf("expected a second signature field")
+	}
+	if fields := bytes.LastIndex(out, []byte("/Fields [")); fields < 0 || bytes.Count(out[fields:bytes.IndexByte(out[fields:], ']')+fields], []byte(" R")) != 2 {
+		t.Errorf("expected the form to keep the first signature field")
+	}
+	verifySignature(t, out, s.Certificates[0])
+}
+
+func TestSignErrors(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	doc, err := ReadDocument(testDocument(t, 1))
+	if err != nil {
+		t.Fatalf("reading document: %s", err)
+	}
+
+	for name, s := range map[string]*Signer{
+		"no certificate":  {Key: edKey},
+		"unsupported key": testSigner(t, edKey),
+		"no key":          {Certificates: testSigner(t, edKey).Certificates},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := s.Sign(new(bytes.Buffer), doc, time.Now()); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestSignedAttributes(t *testing.T) {
+	digest := sha256.Sum256([]byte("document"))
+	attrs, err := signedAttributes(
+		cmsAttr(oidMessageDigest, digest[:]),
+		cmsAttr(oidContentType, oidData),
+	)
+	if err != nil {
+		t.Fatalf("encoding attributes: %s", err)
+	}
+
+	// DER requires the elements of a SET sorted by their encoding, the
+	// shorter content type comes first
+	var first, second cmsAttribute
+	rest, err := asn1.Unmarshal(attrs, &first)
+	if err == nil {
+		rest, err = asn1.Unmarshal(rest, &second)
+	}
+	if err != nil || len(rest) > 0 {
+		t.Fatalf("expected two attributes, got %x (%v)", attrs, err)
+	}
+	if !first.Type.Equal(oidContentType) || !second.Type.Equal(oidMessageDigest) {
+		t.Errorf("expected content type and message digest, got %v and %v", first.Type, second.Type)
+	}
+}
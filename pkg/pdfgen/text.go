@@ -0,0 +1,158 @@
+package pdfgen
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// Text alignments relative to the X position of a Text
+const (
+	AlignLeft   = "left"
+	AlignCenter = "center"
+	AlignRight  = "right"
+)
+
+// Text is drawn using Helvetica over the image of a page. Positions and
+// sizes are fractions of the image size measured from its top left
+// corner to be independent of its resolution.
+type Text struct {
+	Text string
+	// X and Y are the start of the baseline
+	X, Y  float64
+	Align string
+	// Size of the font as fraction of the image height
+	Size float64
+	// Width stretches the text horizontally to the given fraction of
+	// the image width (0 = natural width)
+	Width float64
+	// Invisible text is not rendered but can be searched and selected,
+	// e.g. to add recognized text to a scanned page
+	Invisible bool
+	// Angle rotates the text counter-clockwise around its start (degrees)
+	Angle float64
+	// Color of the text (nil = black)
+	Color color.Color
+	// Opacity between 0 and 1 for translucent text (0 = opaque)
+	Opacity float64
+}
+
+// helveticaWidths are the glyph widths of Helvetica (1/1000 of the
+// font size) for the characters 32 to 126
+var helveticaWidths = [...]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+// TextWidth returns the width of the text set in Helvetica in units of
+// the font size, other characters are estimated
+func TextWidth(s string) float64 {
+	var w int
+	for _, r := range s {
+		if r >= 32 && r <= 126 {
+			w += helveticaWidths[r-32]
+		} else {
+			w += 556
+		}
+	}
+	return float64(w) / 1000
+}
+
+// textContent draws the texts over an image placed with its lower left
+// corner at left, bottom and the given size in points. The graphics
+// states for translucent text are returned for the page resources.
+func textContent(texts []Text, left, bottom, width, height float64) ([]byte, string) {
+	var (
+		buf    = new(bytes.Buffer)
+		states = map[string]string{}
+		gs     = []string{}
+	)
+
+	for _, t := range texts {
+		size := t.Size * height
+		if size <= 0 || strings.TrimSpace(t.Text) == "" {
+			continue
+		}
+
+		var (
+			natural = TextWidth(t.Text) * size
+			scale   = 100.0
+			mode    = 0
+			x       = left + t.X*width
+			y       = bottom + height - t.Y*height
+		)
+
+		if t.Width > 0 && natural > 0 {
+			scale = 100 * t.Width * width / natural
+			natural = t.Width * width
+		}
+		var (
+			sin, cos = math.Sincos(t.Angle * math.Pi / 180)
+			offset   float64
+		)
+		switch t.Align {
+		case AlignCenter:
+			offset = natural / 2
+		case AlignRight:
+			offset = natural
+		}
+		// Move the start back along the rotated baseline
+		x, y = x-offset*cos, y-offset*sin
+		if t.Invisible {
+			mode = 3
+		}
+
+		var state string
+		if t.Color != nil {
+			r, g, b, _ := t.Color.RGBA()
+			state += fmt.Sprintf("%.3f %.3f %.3f rg ", float64(r)/0xffff, float64(g)/0xffff, float64(b)/0xffff)
+		}
+		if t.Opacity > 0 && t.Opacity < 1 {
+			alpha := fmt.Sprintf("%.2f", t.Opacity)
+			name, ok := states[alpha]
+			if !ok {
+				name = fmt.Sprintf("GS%d", len(states))
+				states[alpha] = name
+				gs = append(gs, fmt.Sprintf("/%s <</Type /ExtGState /ca %s /CA %s>>", name, alpha, alpha))
+			}
+			state += "/" + name + " gs "
+		}
+
+		position := fmt.Sprintf("%.2f %.2f Td", x, y)
+		if t.Angle != 0 {
+			position = fmt.Sprintf("%.4f %.4f %.4f %.4f %.2f %.2f Tm", cos, sin, -sin, cos, x, y)
+		}
+
+		text := fmt.Sprintf("BT /F1 %.2f Tf %d Tr %.2f Tz %s %s Tj ET", size, mode, scale, position, WinAnsiString(t.Text))
+		if state != "" {
+			text = "q " + state + text + " Q"
+		}
+		fmt.Fprintln(buf, text)
+	}
+
+	return buf.Bytes(), strings.Join(gs, " ")
+}
+
+// WinAnsiString encodes the text as literal string for the standard
+// fonts, characters not available in their encoding are replaced
+func WinAnsiString(s string) string {
+	buf := []byte{'('}
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			buf = append(buf, '\\', byte(r))
+		case r >= 32 && r < 127, r >= 0xa0 && r <= 0xff:
+			// Latin-1 supplement matches WinAnsiEncoding
+			buf = append(buf, byte(r))
+		default:
+			buf = append(buf, '?')
+		}
+	}
+	return string(append(buf, ')'))
+}
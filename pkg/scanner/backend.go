@@ -0,0 +1,160 @@
+// Package scanner reads pages from scanners (SANE devices or an
+// acquisition command, e.g. using WIA on Windows) and turns them into
+// encoded page images ready to be assembled into documents
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"regexp"
+)
+
+// Scanner feeds all pages of a job and sends them to out as soon as
+// they are read. The channel is closed when the job is finished.
+type Scanner interface {
+	Scan(job Job, out chan<- image.Image) error
+}
+
+// SourceFlatbed is the "source" option requesting the flatbed of the
+// device, it is replaced by the name the backend uses for it
+const SourceFlatbed = "Flatbed"
+
+// Job describes a single scan
+type Job struct {
+	// Options are set on the device before scanning
+	Options map[string]interface{}
+	// Resolution is validated against the constraints of the device to
+	// report unsupported values as UnsupportedError
+	Resolution int
+	// Depth is the bits per sample requested using the "depth" option,
+	// 16 bit scans are reported as UnsupportedError by devices not
+	// offering them (0 = device default)
+	Depth int
+	// Observer is informed about the progress of the job (optional)
+	Observer Observer
+	// Context aborts the job when done, the error of the context is
+	// returned (optional)
+	Context context.Context
+	// MaxPages ends the job after this many pages (0 = all pages in the
+	// feeder)
+	MaxPages int
+	// PageLimit stops the job with PageLimitError if the device delivers
+	// more than this many pages (0 = no limit), protecting against
+	// backends emitting frames endlessly
+	PageLimit int
+	// Device overrides the device to scan with (optional)
+	Device string
+}
+
+// canceled returns the error of the job context if it is done
+func (j Job) canceled() error {
+	if j.Context == nil {
+		return nil
+	}
+	return j.Context.Err()
+}
+
+// Observer is informed about the progress of a job. Errors returned by
+// Starting and PageScanned abort the job.
+type Observer interface {
+	// Starting is called as soon as the scanner is reserved for the job
+	Starting() error
+	// Started is called after the options were set with the values of
+	// all active device options
+	Started(dev Device, values map[string]interface{})
+	// PageScanned is called after page n (1-based) was sent
+	PageScanned(n int) error
+	// Finished is called when the job ends, unless Starting failed
+	Finished(pages int, err error)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) Starting() error                        { return nil }
+func (nopObserver) Started(Device, map[string]interface{}) {}
+func (nopObserver) PageScanned(int) error                  { return nil }
+func (nopObserver) Finished(int, error)                    {}
+
+// UnsupportedError signals the job asked for something the device is
+// not able to do
+type UnsupportedError string
+
+func (u UnsupportedError) Error() string { return string(u) }
+
+// UnavailableError signals the device is not present (unplugged,
+// powered off) or vanished during the job. SANE is initialized again
+// and the devices are discovered anew for the next job.
+type UnavailableError string
+
+func (u UnavailableError) Error() string { return string(u) }
+
+// PageLimitError signals the job was stopped as the device delivered
+// more than Job.PageLimit pages, the pages up to the limit were sent
+type PageLimitError int
+
+func (p PageLimitError) Error() string {
+	return fmt.Sprintf("Scan stopped as the scanner delivered more than %d pages", int(p))
+}
+
+// DeviceMatches reports whether the name, vendor, model or
+// "<vendor> <model>" of the device matches the expression
+func DeviceMatches(dev Device, match *regexp.Regexp) bool {
+	for _, v := range []string{dev.Name, dev.Vendor, dev.Model, dev.Vendor + " " + dev.Model} {
+		if match.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// optionNumber converts the int / float64 values used in SANE option
+// constraints into a float64
+func optionNumber(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+// DeviceCapabilities describes a device with all its options
+type DeviceCapabilities struct {
+	Device  Device         `json:"device"`
+	Error   string         `json:"error,omitempty"`
+	Options []DeviceOption `json:"options,omitempty"`
+}
+
+// DeviceOption is an option with its current value
+type DeviceOption struct {
+	Option
+	Value interface{} `json:"value,omitempty"`
+}
+
+// DeviceDescriber is implemented by scanners able to describe the
+// options of the device they scan with
+type DeviceDescriber interface {
+	DeviceOptions() (DeviceCapabilities, error)
+}
+
+// PaperSensor is implemented by scanners able to report whether paper
+// is loaded into the document feeder
+type PaperSensor interface {
+	PaperLoaded(option string) (bool, error)
+}
+
+// Pinger is implemented by scanners able to keep their device from
+// falling asleep between scans
+type Pinger interface {
+	Ping() error
+}
+
+// PowerController is implemented by scanners able to send their device
+// to sleep and to wake it up again. Wake sets the given options (e.g.
+// the timers of the idle policy) on the device.
+type PowerController interface {
+	Sleep() error
+	Wake(options map[string]interface{}) error
+}
@@ -0,0 +1,119 @@
+package scanner
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// bilevelPalette is used by binarized pages, EncodeCCITTG4 expects
+// black at index 0
+var bilevelPalette = color.Palette{color.Black, color.White}
+
+// isBilevel tells whether the image uses the palette of binarized
+// pages and can be encoded using CCITT without thresholding it again
+func isBilevel(img *image.Paletted) bool {
+	if len(img.Palette) != len(bilevelPalette) {
+		return false
+	}
+	for i, c := range img.Palette {
+		r1, g1, b1, _ := c.RGBA()
+		r2, g2, b2, _ := bilevelPalette[i].RGBA()
+		if r1 != r2 || g1 != g2 || b1 != b2 {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	// Sauvola sensitivity: higher values produce thinner strokes
+	sauvolaK = 0.34
+	// Dynamic range of the standard deviation for 8-bit images
+	sauvolaR = 128.0
+)
+
+// toGray converts the image into an 8-bit grayscale image
+func toGray(in image.Image) *image.Gray {
+	if g, ok := in.(*image.Gray); ok {
+		return g
+	}
+
+	src := imaging.Grayscale(in)
+	b := src.Bounds()
+	out := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			// Grayscale sets R = G = B, so the red channel is the luminance
+			out.Pix[y*out.Stride+x] = src.Pix[y*src.Stride+x*4]
+		}
+	}
+
+	return out
+}
+
+// binarizeSauvola applies adaptive thresholding using the method of
+// Sauvola & Pietikäinen: the threshold of every pixel is derived from
+// the mean and standard deviation of its neighbourhood, which copes well
+// with unevenly lit backgrounds and faint text.
+func binarizeSauvola(in image.Image, dpi int) *image.Paletted {
+	var (
+		g      = toGray(in)
+		w, h   = g.Bounds().Dx(), g.Bounds().Dy()
+		radius = dpi / 12 // ~2mm neighbourhood
+	)
+
+	if radius < 7 {
+		radius = 7
+	}
+
+	// Integral images of the values and squared values
+	sum := make([]float64, (w+1)*(h+1))
+	sqSum := make([]float64, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		var rowSum, rowSq float64
+		for x := 0; x < w; x++ {
+			v := float64(g.Pix[y*g.Stride+x])
+			rowSum += v
+			rowSq += v * v
+			sum[(y+1)*(w+1)+x+1] = sum[y*(w+1)+x+1] + rowSum
+			sqSum[(y+1)*(w+1)+x+1] = sqSum[y*(w+1)+x+1] + rowSq
+		}
+	}
+
+	out := image.NewPaletted(image.Rect(0, 0, w, h), bilevelPalette)
+	for y := 0; y < h; y++ {
+		y0, y1 := clampInt(y-radius, 0, h), clampInt(y+radius+1, 0, h)
+		for x := 0; x < w; x++ {
+			x0, x1 := clampInt(x-radius, 0, w), clampInt(x+radius+1, 0, w)
+
+			var (
+				n    = float64((x1 - x0) * (y1 - y0))
+				s    = sum[y1*(w+1)+x1] - sum[y0*(w+1)+x1] - sum[y1*(w+1)+x0] + sum[y0*(w+1)+x0]
+				sq   = sqSum[y1*(w+1)+x1] - sqSum[y0*(w+1)+x1] - sqSum[y1*(w+1)+x0] + sqSum[y0*(w+1)+x0]
+				mean = s / n
+				std  = math.Sqrt(math.Max(sq/n-mean*mean, 0))
+			)
+
+			threshold := mean * (1 + sauvolaK*(std/sauvolaR-1))
+			if float64(g.Pix[y*g.Stride+x]) > threshold {
+				out.Pix[y*out.Stride+x] = 1
+			}
+		}
+	}
+
+	return out
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
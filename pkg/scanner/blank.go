@@ -0,0 +1,53 @@
+package scanner
+
+import (
+	"image"
+)
+
+const (
+	// blankAnalysisWidth is the size pages are scaled to for detecting
+	// blank pages, large enough for small print
+	blankAnalysisWidth = 800
+	// Pixels darker than the paper by at least blankInk are ink, noise
+	// and shine-through from the other side stay below
+	blankInk = 64
+)
+
+// isBlank tells whether less than threshold percent of the page are
+// covered by ink. A border of 5% is ignored as it contains the shadows
+// of the paper edges and holes.
+func isBlank(ops ImageOps, img image.Image, threshold float64) bool {
+	var (
+		g    = toGray(ops.Thumbnail(img, blankAnalysisWidth))
+		w, h = g.Bounds().Dx(), g.Bounds().Dy()
+		mx   = w / 20
+		my   = h / 20
+	)
+
+	// The paper is the most frequent gray level in the inner area
+	var hist [256]int
+	for y := my; y < h-my; y++ {
+		for _, v := range g.Pix[y*g.Stride+mx : y*g.Stride+w-mx] {
+			hist[v]++
+		}
+	}
+	paper := 0
+	for v, n := range hist {
+		if n > hist[paper] {
+			paper = v
+		}
+	}
+
+	var ink, total int
+	for v, n := range hist {
+		total += n
+		if paper-v >= blankInk {
+			ink += n
+		}
+	}
+	if total == 0 {
+		return false
+	}
+
+	return float64(ink)*100 < threshold*float64(total)
+}
@@ -0,0 +1,326 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// The patch area of an IT8.7/2 target: 12 rows (A-L) of 22 color
+	// patches above the row of 24 gray patches (GS0-GS23)
+	it8ColorRows    = 12
+	it8ColorColumns = 22
+	it8GrayPatches  = 24
+	// it8SampleArea is the fraction of a patch averaged, the borders are
+	// left out to allow for an imprecise scan area
+	it8SampleArea = 0.4
+)
+
+// CalibrationPatch is a patch of a calibration target with its
+// reference color as XYZ relative to D50 (Y = 1 for a perfect white)
+type CalibrationPatch struct {
+	ID  string
+	XYZ [3]float64
+}
+
+// ParseIT8Reference reads the reference values of an IT8.7/2 target
+// from the CGATS file supplied with it, XYZ or Lab values are accepted
+func ParseIT8Reference(data []byte) ([]CalibrationPatch, error) {
+	var (
+		fields  []string
+		patches []CalibrationPatch
+		section string
+	)
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch line {
+		case "BEGIN_DATA_FORMAT", "BEGIN_DATA":
+			section = line
+			continue
+		case "END_DATA_FORMAT", "END_DATA":
+			section = ""
+			continue
+		}
+
+		tokens := strings.Fields(strings.ReplaceAll(line, `"`, ""))
+		switch section {
+		case "BEGIN_DATA_FORMAT":
+			fields = append(fields, tokens...)
+
+		case "BEGIN_DATA":
+			if len(tokens) != len(fields) {
+				return nil, fmt.Errorf("Data line %q does not match the data format", line)
+			}
+			values := map[string]string{}
+			for i, f := range fields {
+				values[f] = tokens[i]
+			}
+			p, err := parseIT8Patch(values)
+			if err != nil {
+				return nil, err
+			}
+			patches = append(patches, p)
+		}
+	}
+
+	if len(patches) == 0 {
+		return nil, fmt.Errorf("No reference data found")
+	}
+	return patches, nil
+}
+
+func parseIT8Patch(values map[string]string) (CalibrationPatch, error) {
+	p := CalibrationPatch{ID: normalizeIT8ID(values["SAMPLE_ID"])}
+	if p.ID == "" {
+		p.ID = normalizeIT8ID(values["SAMPLE_NAME"])
+	}
+
+	number := func(keys ...string) ([3]float64, bool) {
+		var v [3]float64
+		for i, k := range keys {
+			f, err := strconv.ParseFloat(values[k], 64)
+			if err != nil {
+				return v, false
+			}
+			v[i] = f
+		}
+		return v, true
+	}
+
+	if xyz, ok := number("XYZ_X", "XYZ_Y", "XYZ_Z"); ok {
+		p.XYZ = [3]float64{xyz[0] / 100, xyz[1] / 100, xyz[2] / 100}
+	} else if lab, ok := number("LAB_L", "LAB_A", "LAB_B"); ok {
+		p.XYZ = labToXYZ(lab)
+	} else {
+		return p, fmt.Errorf("Patch %q has neither XYZ nor Lab values", p.ID)
+	}
+	return p, nil
+}
+
+// normalizeIT8ID converts the IDs to the letters followed by the patch
+// number without leading zeros, e.g. A01 to A1 and GS00 to GS0
+func normalizeIT8ID(id string) string {
+	id = strings.ToUpper(id)
+	split := strings.IndexAny(id, "0123456789")
+	if split < 1 {
+		return id
+	}
+	n, err := strconv.Atoi(id[split:])
+	if err != nil {
+		return id
+	}
+	return id[:split] + strconv.Itoa(n)
+}
+
+// it8Cell returns the row and column of the patch and the number of
+// columns of its row, ok is false for patches outside the layout
+func it8Cell(id string) (row, col, cols int, ok bool) {
+	if strings.HasPrefix(id, "GS") {
+		n, err := strconv.Atoi(id[2:])
+		if err != nil || n < 0 || n >= it8GrayPatches {
+			return 0, 0, 0, false
+		}
+		return it8ColorRows, n, it8GrayPatches, true
+	}
+
+	if len(id) < 2 || id[0] < 'A' || id[0] >= 'A'+it8ColorRows {
+		return 0, 0, 0, false
+	}
+	n, err := strconv.Atoi(id[1:])
+	if err != nil || n < 1 || n > it8ColorColumns {
+		return 0, 0, 0, false
+	}
+	return int(id[0] - 'A'), n - 1, it8ColorColumns, true
+}
+
+// CalibrateIT8 derives a color profile from the scan of an IT8.7/2
+// target whose image shows exactly the patch area. The tone curves are
+// fitted to the gray patches, the matrix to all patches. The mean color
+// difference (CIE76 ΔE) of the patches remaining with the profile is
+// returned to judge the result.
+func CalibrateIT8(img image.Image, reference []CalibrationPatch) (*ColorProfile, float64, error) {
+	planes := splitPlanes(img)
+	if len(planes.planes) != 3 {
+		return nil, 0, fmt.Errorf("The target must be scanned in color")
+	}
+
+	type sample struct {
+		rgb [3]float64 // 0-1
+		xyz [3]float64
+	}
+	var (
+		samples []sample
+		grays   []sample
+		rowH    = float64(planes.h) / (it8ColorRows + 1)
+	)
+	for _, p := range reference {
+		row, col, cols, ok := it8Cell(p.ID)
+		if !ok {
+			continue
+		}
+		colW := float64(planes.w) / float64(cols)
+		s := sample{rgb: averagePatch(planes, float64(col)*colW, float64(row)*rowH, colW, rowH), xyz: p.XYZ}
+		samples = append(samples, s)
+		if row == it8ColorRows {
+			grays = append(grays, s)
+		}
+	}
+	if len(grays) < it8GrayPatches/2 || len(samples) < it8ColorRows*it8ColorColumns/2 {
+		return nil, 0, fmt.Errorf("Reference lacks the patches of an IT8.7/2 target (%d gray, %d total)", len(grays), len(samples))
+	}
+
+	var curves [3][]float64
+	for ch := range curves {
+		points := make([][2]float64, len(grays))
+		for i, g := range grays {
+			points[i] = [2]float64{g.rgb[ch], g.xyz[1]}
+		}
+		curves[ch] = fitToneCurve(points)
+	}
+
+	// Least squares fit of the matrix mapping the linearized channels to
+	// XYZ: M = (XᵀL)(LᵀL)⁻¹
+	var ltl, xtl [3][3]float64
+	lin := make([][3]float64, len(samples))
+	for n, s := range samples {
+		for ch := range lin[n] {
+			lin[n][ch] = interpolate(curves[ch], s.rgb[ch])
+		}
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				ltl[i][j] += lin[n][i] * lin[n][j]
+				xtl[i][j] += s.xyz[i] * lin[n][j]
+			}
+		}
+	}
+	inv, ok := invertMatrix(ltl)
+	if !ok {
+		return nil, 0, fmt.Errorf("Unable to fit the colors, the patches are too similar (wrong scan area?)")
+	}
+	matrix := mulMatrices(xtl, inv)
+
+	var sum float64
+	for n, s := range samples {
+		sum += deltaE(xyzToLab(mulMatrixVector(matrix, lin[n])), xyzToLab(s.xyz))
+	}
+
+	return NewColorProfile("Scanner (IT8 calibration, scansnap-go)", curves, matrix), sum / float64(len(samples)), nil
+}
+
+// averagePatch returns the mean level of the channels in the center of
+// the cell, 0-1
+func averagePatch(planes *imagePlanes, x, y, w, h float64) [3]float64 {
+	var (
+		margin = (1 - it8SampleArea) / 2
+		x0, x1 = int(x + w*margin), int(x + w*(1-margin))
+		y0, y1 = int(y + h*margin), int(y + h*(1-margin))
+		sum    [3]float64
+		n      int
+	)
+	for py := y0; py < y1 && py < planes.h; py++ {
+		for px := x0; px < x1 && px < planes.w; px++ {
+			for ch := range sum {
+				sum[ch] += float64(planes.planes[ch][py*planes.w+px])
+			}
+			n++
+		}
+	}
+	if n > 0 {
+		for ch := range sum {
+			sum[ch] /= float64(n) * 255
+		}
+	}
+	return sum
+}
+
+// fitToneCurve interpolates the measured levels and their luminance
+// into a monotonic curve, levels beyond the darkest and brightest patch
+// are extrapolated towards black and white
+func fitToneCurve(points [][2]float64) []float64 {
+	sort.Slice(points, func(i, j int) bool { return points[i][0] < points[j][0] })
+	for i := 1; i < len(points); i++ {
+		points[i][1] = math.Max(points[i][1], points[i-1][1])
+	}
+
+	last := points[len(points)-1]
+	points = append([][2]float64{{0, 0}}, points...)
+	if last[0] < 1 {
+		points = append(points, [2]float64{1, math.Max(last[1], 1)})
+	}
+
+	curve := make([]float64, colorProfileCurvePoints)
+	i := 0
+	for n := range curve {
+		x := float64(n) / float64(len(curve)-1)
+		for i < len(points)-2 && points[i+1][0] < x {
+			i++
+		}
+		a, b := points[i], points[i+1]
+		v := a[1]
+		if b[0] > a[0] {
+			v = a[1] + (b[1]-a[1])*(x-a[0])/(b[0]-a[0])
+		}
+		curve[n] = clamp01(v)
+	}
+	return curve
+}
+
+func invertMatrix(m [3][3]float64) ([3][3]float64, bool) {
+	var inv [3][3]float64
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if math.Abs(det) < 1e-12 {
+		return inv, false
+	}
+
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// Cofactor of the transposed position
+			a, b := (j+1)%3, (j+2)%3
+			c, d := (i+1)%3, (i+2)%3
+			inv[i][j] = (m[a][c]*m[b][d] - m[a][d]*m[b][c]) / det
+		}
+	}
+	return inv, true
+}
+
+func labFunc(t float64) float64 {
+	if t > 216.0/24389 {
+		return math.Cbrt(t)
+	}
+	return (24389.0/27*t + 16) / 116
+}
+
+func xyzToLab(xyz [3]float64) [3]float64 {
+	fx, fy, fz := labFunc(xyz[0]/d50[0]), labFunc(xyz[1]/d50[1]), labFunc(xyz[2]/d50[2])
+	return [3]float64{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
+
+func labToXYZ(lab [3]float64) [3]float64 {
+	fy := (lab[0] + 16) / 116
+	f := [3]float64{fy + lab[1]/500, fy, fy - lab[2]/200}
+
+	var xyz [3]float64
+	for i, v := range f {
+		if v*v*v > 216.0/24389 {
+			xyz[i] = v * v * v
+		} else {
+			xyz[i] = (116*v - 16) * 27 / 24389
+		}
+		xyz[i] *= d50[i]
+	}
+	return xyz
+}
+
+func deltaE(a, b [3]float64) float64 {
+	return math.Sqrt((a[0]-b[0])*(a[0]-b[0]) + (a[1]-b[1])*(a[1]-b[1]) + (a[2]-b[2])*(a[2]-b[2]))
+}
@@ -0,0 +1,199 @@
+package scanner
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// mmToPixels converts a length on the page to pixels of the page image
+func mmToPixels(mm float64, dpi int) int {
+	return int(math.Round(mm * float64(dpi) / 25.4))
+}
+
+// cleanEdgesStep removes the dark borders and shadows left around the
+// page by the background of the feeder
+type cleanEdgesStep struct {
+	width     float64 // mm
+	threshold uint8
+}
+
+func newCleanEdgesStep(o StepOptions) (Step, error) {
+	width, err := o.Float("width", 10)
+	if err != nil {
+		return nil, err
+	}
+	threshold, err := o.Int("threshold", 100)
+	if err != nil {
+		return nil, err
+	}
+	if width <= 0 || threshold < 1 || threshold > 255 {
+		return nil, fmt.Errorf("width must be positive and threshold between 1 and 255")
+	}
+	return cleanEdgesStep{width, uint8(threshold)}, nil
+}
+
+func (c cleanEdgesStep) Apply(p *StepPage) error {
+	var (
+		g      = toGray(p.Image)
+		w, h   = g.Bounds().Dx(), g.Bounds().Dy()
+		maxRun = mmToPixels(c.width, p.DPI)
+		edges  = []image.Point{}
+	)
+
+	// Dark runs starting at the border of the page are background, they
+	// follow the border of skewed pages unlike a fixed crop
+	run := func(x, y, dx, dy int) {
+		for i := 0; i < maxRun && x >= 0 && y >= 0 && x < w && y < h && g.Pix[y*g.Stride+x] < c.threshold; i++ {
+			edges = append(edges, image.Pt(x, y))
+			x, y = x+dx, y+dy
+		}
+	}
+	for y := 0; y < h; y++ {
+		run(0, y, 1, 0)
+		run(w-1, y, -1, 0)
+	}
+	for x := 0; x < w; x++ {
+		run(x, 0, 0, 1)
+		run(x, h-1, 0, -1)
+	}
+
+	if len(edges) == 0 {
+		return nil
+	}
+
+	out := editableCopy(p.Image)
+	for _, pt := range edges {
+		out.Set(pt.X, pt.Y, color.White)
+	}
+	p.Image = out
+
+	return nil
+}
+
+// fillHolesStep fills the holes punched into filed pages, which show
+// the dark background of the feeder, with the surrounding paper color
+type fillHolesStep struct {
+	margin    float64 // mm
+	min, max  float64 // mm
+	threshold uint8
+}
+
+func newFillHolesStep(o StepOptions) (Step, error) {
+	var (
+		f   fillHolesStep
+		err error
+	)
+
+	if f.margin, err = o.Float("margin", 25); err != nil {
+		return nil, err
+	}
+	if f.min, err = o.Float("min", 4); err != nil {
+		return nil, err
+	}
+	if f.max, err = o.Float("max", 9); err != nil {
+		return nil, err
+	}
+	threshold, err := o.Int("threshold", 100)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.margin <= 0 || f.min <= 0 || f.max < f.min {
+		return nil, fmt.Errorf("margin and min must be positive and max must not be below min")
+	}
+	if threshold < 1 || threshold > 255 {
+		return nil, fmt.Errorf("threshold must be between 1 and 255")
+	}
+	f.threshold = uint8(threshold)
+
+	return f, nil
+}
+
+func (f fillHolesStep) Apply(p *StepPage) error {
+	var (
+		g      = toGray(p.Image)
+		w, h   = g.Bounds().Dx(), g.Bounds().Dy()
+		margin = mmToPixels(f.margin, p.DPI)
+		minPx  = maxInt(mmToPixels(f.min, p.DPI), 1)
+		maxPx  = mmToPixels(f.max, p.DPI)
+		holes  = []image.Rectangle{}
+	)
+
+	inMargin := func(x, y int) bool {
+		return x < margin || y < margin || x >= w-margin || y >= h-margin
+	}
+
+	findDarkComponents(g, f.threshold, maxPx, inMargin, func(c darkComponent) {
+		b := c.Bounds
+		dx, dy := b.Dx(), b.Dy()
+
+		switch {
+		case c.Pixels == nil, dx < minPx, dy < minPx:
+			// Too large or too small
+		case b.Min.X == 0, b.Min.Y == 0, b.Max.X == w, b.Max.Y == h:
+			// Touching the border of the page: edge shadow
+		case 4*minInt(dx, dy) < 3*maxInt(dx, dy):
+			// Not round
+		default:
+			// A filled circle covers π/4 of its bounding box, text glyphs and
+			// rings cover less
+			if fill := float64(c.Count) / float64(dx*dy); fill >= 0.6 && fill <= 0.9 {
+				holes = append(holes, b)
+			}
+		}
+	})
+
+	if len(holes) == 0 {
+		return nil
+	}
+
+	out := editableCopy(p.Image)
+	for _, b := range holes {
+		var (
+			cx = float64(b.Min.X+b.Max.X) / 2
+			cy = float64(b.Min.Y+b.Max.Y) / 2
+			// Include the blurred rim of the hole
+			r = float64(maxInt(b.Dx(), b.Dy()))/2 + 2
+		)
+
+		// Paper color sampled from a ring around the hole, the hole might
+		// be punched into a colored page
+		var sum [3]uint64
+		var n uint64
+		forCircle(cx, cy, r+5, w, h, func(x, y int, d float64) {
+			if d < r+2 || g.Pix[y*g.Stride+x] < f.threshold {
+				return
+			}
+			cr, cg, cb, _ := p.Image.At(p.Image.Bounds().Min.X+x, p.Image.Bounds().Min.Y+y).RGBA()
+			sum[0], sum[1], sum[2] = sum[0]+uint64(cr>>8), sum[1]+uint64(cg>>8), sum[2]+uint64(cb>>8)
+			n++
+		})
+
+		paper := color.Color(color.White)
+		if n > 0 {
+			paper = color.RGBA{uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n), 0xff}
+		}
+
+		forCircle(cx, cy, r, w, h, func(x, y int, d float64) {
+			out.Set(x, y, paper)
+		})
+	}
+	p.Image = out
+
+	return nil
+}
+
+// forCircle calls fn for the pixels within the image of size w x h
+// having a distance d <= r to the center
+func forCircle(cx, cy, r float64, w, h int, fn func(x, y int, d float64)) {
+	for y := maxInt(int(cy-r), 0); y <= minInt(int(cy+r), h-1); y++ {
+		for x := maxInt(int(cx-r), 0); x <= minInt(int(cx+r), w-1); x++ {
+			// Distance of the pixel center
+			if d := math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-cy); d <= r {
+				fn(x, y, d)
+			}
+		}
+	}
+}
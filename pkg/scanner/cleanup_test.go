@@ -0,0 +1,111 @@
+package scanner
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// fillRect paints the rectangle of the image
+func fillRect(img draw.Image, r image.Rectangle, c color.Color) {
+	draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+// fillCircle paints the circle of the image
+func fillCircle(img draw.Image, cx, cy, r float64, c color.Color) {
+	b := img.Bounds()
+	forCircle(cx, cy, r, b.Dx(), b.Dy(), func(x, y int, d float64) { img.Set(x, y, c) })
+}
+
+func TestFillHoles(t *testing.T) {
+	// 100 dpi: holes of 6 mm diameter, margin of 98 px
+	page := testPage(300, 400)
+	img := page.Image.(*image.Gray)
+	fillCircle(img, 40, 100, 12, color.Black)                // punch hole
+	fillRect(img, image.Rect(28, 240, 52, 264), color.Black) // square mark
+	fillCircle(img, 150, 200, 12, color.Black)               // dot in the content
+	fillRect(img, image.Rect(0, 330, 20, 350), color.Black)  // edge shadow
+	fillCircle(img, 40, 370, 2, color.Black)                 // speck below min
+
+	if err := mustParsePipeline(t, "fill-holes").Apply(page); err != nil {
+		t.Fatalf("applying step: %s", err)
+	}
+
+	out := page.Image.(*image.Gray)
+	for name, tc := range map[string]struct {
+		pt     image.Point
+		filled bool
+	}{
+		"hole":        {image.Pt(40, 100), true},
+		"hole rim":    {image.Pt(51, 100), true},
+		"square":      {image.Pt(40, 252), false},
+		"content dot": {image.Pt(150, 200), false},
+		"edge shadow": {image.Pt(10, 340), false},
+		"speck":       {image.Pt(40, 370), false},
+	} {
+		if filled := out.GrayAt(tc.pt.X, tc.pt.Y).Y == 0xff; filled != tc.filled {
+			t.Errorf("%s: expected filled=%v at %v", name, tc.filled, tc.pt)
+		}
+	}
+}
+
+func TestFillHolesPaperColor(t *testing.T) {
+	paper := color.RGBA{0xf0, 0xe0, 0x80, 0xff}
+	img := image.NewRGBA(image.Rect(0, 0, 300, 400))
+	fillRect(img, img.Bounds(), paper)
+	fillCircle(img, 260, 200, 12, color.Black)
+
+	page := &StepPage{Image: img, DPI: 100, OutputDPI: 100, Ops: imagingOps{}}
+	if err := mustParsePipeline(t, "fill-holes").Apply(page); err != nil {
+		t.Fatalf("applying step: %s", err)
+	}
+
+	r, g, b, _ := page.Image.At(260, 200).RGBA()
+	if got := (color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 0xff}); got != paper {
+		t.Errorf("expected the hole filled with the paper color %v, got %v", paper, got)
+	}
+}
+
+func TestCleanEdges(t *testing.T) {
+	// 100 dpi: edges of up to 39 px are removed
+	page := testPage(200, 200)
+	img := page.Image.(*image.Gray)
+	fillRect(img, image.Rect(0, 0, 60, 200), color.Gray{Y: 20})     // wide shadow on the left
+	fillRect(img, image.Rect(190, 50, 200, 150), color.Gray{Y: 20}) // narrow shadow on the right
+	fillRect(img, image.Rect(90, 90, 110, 110), color.Black)        // content
+
+	if err := mustParsePipeline(t, "clean-edges").Apply(page); err != nil {
+		t.Fatalf("applying step: %s", err)
+	}
+
+	out := page.Image.(*image.Gray)
+	for name, tc := range map[string]struct {
+		pt      image.Point
+		cleaned bool
+	}{
+		"left border":    {image.Pt(0, 100), true},
+		"left run limit": {image.Pt(38, 100), true},
+		"left beyond":    {image.Pt(45, 100), false},
+		"right shadow":   {image.Pt(195, 100), true},
+		"content":        {image.Pt(100, 100), false},
+	} {
+		if cleaned := out.GrayAt(tc.pt.X, tc.pt.Y).Y == 0xff; cleaned != tc.cleaned {
+			t.Errorf("%s: expected cleaned=%v at %v", name, tc.cleaned, tc.pt)
+		}
+	}
+}
+
+func TestCleanupOptions(t *testing.T) {
+	for _, spec := range []string{
+		"clean-edges width=0",
+		"clean-edges threshold=256",
+		"fill-holes min=5 max=4",
+		"fill-holes margin=0",
+		"fill-holes threshold=0",
+	} {
+		if _, err := ParsePipeline(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
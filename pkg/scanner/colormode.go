@@ -0,0 +1,57 @@
+package scanner
+
+import (
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// Pixels of the thumbnail with a difference of the strongest and
+	// weakest channel of at least colorChroma are colored. Yellowed paper
+	// and the color fringes of the sensor at text averaged by scaling
+	// stay below.
+	colorChroma = 64
+	// Pages with at least colorCoverage of colored pixels (a stamp or a
+	// small logo) keep their color
+	colorCoverage = 0.001
+)
+
+// hasSignificantColor checks whether the page needs to be kept in
+// color, it is analyzed at thumbnail size
+func hasSignificantColor(ops ImageOps, img image.Image) bool {
+	switch src := img.(type) {
+	case *image.Gray:
+		return false
+	case *image.Paletted:
+		if isBilevel(src) {
+			return false
+		}
+	}
+
+	var (
+		thumb   = imaging.Clone(ops.Thumbnail(img, thumbnailWidth))
+		w, h    = thumb.Bounds().Dx(), thumb.Bounds().Dy()
+		colored int
+	)
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			px := thumb.Pix[y*thumb.Stride+x*4 : y*thumb.Stride+x*4+3]
+			min, max := px[0], px[0]
+			for _, v := range px[1:] {
+				if v < min {
+					min = v
+				}
+				if v > max {
+					max = v
+				}
+			}
+			if max-min >= colorChroma {
+				colored++
+			}
+		}
+	}
+
+	return float64(colored) >= colorCoverage*float64(w*h)
+}
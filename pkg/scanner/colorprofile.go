@@ -0,0 +1,365 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"math"
+)
+
+// colorProfileCurvePoints is the number of samples of the tone curves
+const colorProfileCurvePoints = 256
+
+var (
+	// d50 is the white point of the ICC profile connection space
+	d50 = [3]float64{0.9642, 1.0, 0.8249}
+	// xyzToLinearSRGB converts XYZ relative to D50 into linear sRGB
+	// (Bradford adapted to D65)
+	xyzToLinearSRGB = [3][3]float64{
+		{3.1338561, -1.6168667, -0.4906146},
+		{-0.9787684, 1.9161415, 0.0334540},
+		{0.0719453, -0.2289914, 1.4052427},
+	}
+)
+
+// ColorProfile is an RGB matrix/TRC ICC profile characterizing the
+// colors delivered by a scanner. It is embedded into the documents or
+// used to convert the pages to sRGB.
+type ColorProfile struct {
+	Description string
+	// Curves linearize the channels, they are sampled at
+	// colorProfileCurvePoints evenly spaced levels and range from 0 to 1
+	Curves [3][]float64
+	// Matrix converts the linearized channels into XYZ relative to D50
+	Matrix [3][3]float64
+
+	data []byte
+}
+
+// ParseColorProfile reads an ICC profile, only RGB input or display
+// profiles described by a matrix and tone curves are supported (not
+// the lookup tables of more precise profiles)
+func ParseColorProfile(data []byte) (*ColorProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, fmt.Errorf("Not an ICC profile")
+	}
+	if cs := string(data[16:20]); cs != "RGB " {
+		return nil, fmt.Errorf("Unsupported color space %q (supported: RGB)", cs)
+	}
+
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < count; i++ {
+		o := 132 + 12*i
+		if o+12 > len(data) {
+			return nil, fmt.Errorf("Truncated tag table")
+		}
+		off, size := binary.BigEndian.Uint32(data[o+4:]), binary.BigEndian.Uint32(data[o+8:])
+		if uint64(off)+uint64(size) > uint64(len(data)) {
+			return nil, fmt.Errorf("Tag %q exceeds the profile", data[o:o+4])
+		}
+		tags[string(data[o:o+4])] = data[off : off+size]
+	}
+
+	c := &ColorProfile{Description: iccDescription(tags["desc"]), data: data}
+	for i, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz, err := iccXYZ(tags[sig])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s tag (profiles using lookup tables are not supported): %s", sig, err)
+		}
+		for j := range xyz {
+			c.Matrix[j][i] = xyz[j]
+		}
+	}
+	for i, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, err := iccCurve(tags[sig])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s tag: %s", sig, err)
+		}
+		c.Curves[i] = curve
+	}
+
+	return c, nil
+}
+
+// NewColorProfile creates the profile from the curves and the matrix,
+// e.g. measured using a calibration target
+func NewColorProfile(description string, curves [3][]float64, matrix [3][3]float64) *ColorProfile {
+	c := &ColorProfile{Description: description, Curves: curves, Matrix: matrix}
+	c.data = c.encode()
+	return c
+}
+
+// Data returns the ICC profile
+func (c *ColorProfile) Data() []byte { return c.data }
+
+// Linearize returns the linearized channels of the color
+func (c *ColorProfile) Linearize(r, g, b uint8) [3]float64 {
+	return [3]float64{c.Curves[0][r], c.Curves[1][g], c.Curves[2][b]}
+}
+
+// ToXYZ converts the color into XYZ relative to D50
+func (c *ColorProfile) ToXYZ(r, g, b uint8) [3]float64 {
+	return mulMatrixVector(c.Matrix, c.Linearize(r, g, b))
+}
+
+// ToSRGB converts the colors of the image into sRGB, grayscale and
+// bilevel images are returned unchanged
+func (c *ColorProfile) ToSRGB(img image.Image) image.Image {
+	planes := splitPlanes(img)
+	if len(planes.planes) != 3 {
+		return img
+	}
+
+	var (
+		m      = mulMatrices(xyzToLinearSRGB, c.Matrix)
+		curves [3][256]float64
+		encode [4096]uint8
+	)
+	for ch := range curves {
+		for v := range curves[ch] {
+			curves[ch][v] = c.Curves[ch][v*(colorProfileCurvePoints-1)/255]
+		}
+	}
+	for i := range encode {
+		encode[i] = uint8(math.Round(255 * linearToSRGB(float64(i)/float64(len(encode)-1))))
+	}
+
+	r, g, b := planes.planes[0], planes.planes[1], planes.planes[2]
+	for i := range r {
+		lin := [3]float64{curves[0][r[i]], curves[1][g[i]], curves[2][b[i]]}
+		out := mulMatrixVector(m, lin)
+		for ch, v := range out {
+			idx := int(math.Round(v * float64(len(encode)-1)))
+			if idx < 0 {
+				idx = 0
+			} else if idx >= len(encode) {
+				idx = len(encode) - 1
+			}
+			planes.planes[ch][i] = encode[idx]
+		}
+	}
+	return planes.image()
+}
+
+// encode builds an ICC v2 input profile of the curves and the matrix
+func (c *ColorProfile) encode() []byte {
+	xyz := func(v [3]float64) []byte {
+		b := new(bytes.Buffer)
+		b.WriteString("XYZ \x00\x00\x00\x00")
+		for _, f := range v {
+			binary.Write(b, binary.BigEndian, int32(math.Round(f*65536)))
+		}
+		return b.Bytes()
+	}
+
+	curve := func(points []float64) []byte {
+		b := new(bytes.Buffer)
+		b.WriteString("curv\x00\x00\x00\x00")
+		binary.Write(b, binary.BigEndian, uint32(len(points)))
+		for _, v := range points {
+			binary.Write(b, binary.BigEndian, uint16(math.Round(clamp01(v)*65535)))
+		}
+		return b.Bytes()
+	}
+
+	desc := new(bytes.Buffer)
+	desc.WriteString("desc\x00\x00\x00\x00")
+	binary.Write(desc, binary.BigEndian, uint32(len(c.Description)+1))
+	desc.WriteString(c.Description + "\x00")
+	// Empty unicode and scriptcode descriptions
+	desc.Write(make([]byte, 4+4+2+1+67))
+
+	column := func(i int) [3]float64 { return [3]float64{c.Matrix[0][i], c.Matrix[1][i], c.Matrix[2][i]} }
+	tags := []struct {
+		sig  string
+		data []byte
+	}{
+		{"desc", desc.Bytes()},
+		{"cprt", []byte("text\x00\x00\x00\x00No copyright, use freely\x00")},
+		{"wtpt", xyz(d50)},
+		{"rXYZ", xyz(column(0))},
+		{"gXYZ", xyz(column(1))},
+		{"bXYZ", xyz(column(2))},
+		{"rTRC", curve(c.Curves[0])},
+		{"gTRC", curve(c.Curves[1])},
+		{"bTRC", curve(c.Curves[2])},
+	}
+
+	var (
+		offset = 128 + 4 + 12*len(tags)
+		table  = new(bytes.Buffer)
+		data   = new(bytes.Buffer)
+	)
+	binary.Write(table, binary.BigEndian, uint32(len(tags)))
+	for _, t := range tags {
+		table.WriteString(t.sig)
+		binary.Write(table, binary.BigEndian, uint32(offset+data.Len()))
+		binary.Write(table, binary.BigEndian, uint32(len(t.data)))
+		data.Write(t.data)
+		data.Write(make([]byte, (len(t.data)+3)&^3-len(t.data)))
+	}
+
+	header := new(bytes.Buffer)
+	binary.Write(header, binary.BigEndian, uint32(offset+data.Len()))
+	header.Write(make([]byte, 4))                                  // preferred CMM
+	header.Write([]byte{2, 0x10, 0, 0})                            // version 2.1
+	header.WriteString("scnrRGB XYZ ")                             // class, color space, PCS
+	header.Write([]byte{0x07, 0xea, 0, 1, 0, 1, 0, 0, 0, 0, 0, 0}) // 2026-01-01
+	header.WriteString("acsp")
+	header.Write(make([]byte, 4+4+4+4+8+4)) // platform, flags, manufacturer, model, attributes, intent
+	header.Write(xyz(d50)[8:])              // PCS illuminant
+	header.Write(make([]byte, 4+44))        // creator, reserved
+
+	return append(append(header.Bytes(), table.Bytes()...), data.Bytes()...)
+}
+
+func iccDescription(tag []byte) string {
+	if len(tag) < 12 || string(tag[:4]) != "desc" {
+		return ""
+	}
+	n := int(binary.BigEndian.Uint32(tag[8:]))
+	if n < 1 || 12+n > len(tag) {
+		return ""
+	}
+	return string(tag[12 : 12+n-1])
+}
+
+func iccXYZ(tag []byte) ([3]float64, error) {
+	var v [3]float64
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return v, fmt.Errorf("missing")
+	}
+	for i := range v {
+		v[i] = float64(int32(binary.BigEndian.Uint32(tag[8+4*i:]))) / 65536
+	}
+	return v, nil
+}
+
+// iccCurve samples a curveType or parametricCurveType tag
+func iccCurve(tag []byte) ([]float64, error) {
+	if len(tag) < 12 {
+		return nil, fmt.Errorf("missing")
+	}
+
+	var f func(x float64) float64
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if len(tag) < 12+2*n {
+			return nil, fmt.Errorf("truncated curve")
+		}
+		switch n {
+		case 0:
+			f = func(x float64) float64 { return x }
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			f = func(x float64) float64 { return math.Pow(x, gamma) }
+		default:
+			table := make([]float64, n)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+			}
+			f = func(x float64) float64 { return interpolate(table, x) }
+		}
+
+	case "para":
+		// Parameters g, a, b, c, d, e, f of the function types 0-4
+		counts := []int{1, 3, 4, 5, 7}
+		fn := int(binary.BigEndian.Uint16(tag[8:]))
+		if fn >= len(counts) || len(tag) < 12+4*counts[fn] {
+			return nil, fmt.Errorf("unsupported parametric curve")
+		}
+		p := make([]float64, 7)
+		for i := 0; i < counts[fn]; i++ {
+			p[i] = float64(int32(binary.BigEndian.Uint32(tag[12+4*i:]))) / 65536
+		}
+		f = func(x float64) float64 { return parametricCurve(fn, p, x) }
+
+	default:
+		return nil, fmt.Errorf("unsupported type %q", tag[:4])
+	}
+
+	curve := make([]float64, colorProfileCurvePoints)
+	for i := range curve {
+		curve[i] = clamp01(f(float64(i) / float64(colorProfileCurvePoints-1)))
+	}
+	return curve, nil
+}
+
+func parametricCurve(fn int, p []float64, x float64) float64 {
+	g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+	pow := func(v float64) float64 {
+		if v <= 0 {
+			return 0
+		}
+		return math.Pow(v, g)
+	}
+
+	switch fn {
+	case 0:
+		return pow(x)
+	case 1:
+		if x >= -b/a {
+			return pow(a*x + b)
+		}
+		return 0
+	case 2:
+		if x >= -b/a {
+			return pow(a*x+b) + c
+		}
+		return c
+	case 3:
+		if x >= d {
+			return pow(a*x + b)
+		}
+		return c * x
+	default:
+		if x >= d {
+			return pow(a*x+b) + e
+		}
+		return c*x + f
+	}
+}
+
+// interpolate reads the evenly spaced table at x (0-1)
+func interpolate(table []float64, x float64) float64 {
+	pos := clamp01(x) * float64(len(table)-1)
+	i := int(pos)
+	if i >= len(table)-1 {
+		return table[len(table)-1]
+	}
+	frac := pos - float64(i)
+	return table[i]*(1-frac) + table[i+1]*frac
+}
+
+func linearToSRGB(v float64) float64 {
+	v = clamp01(v)
+	if v <= 0.0031308 {
+		return 12.92 * v
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+func mulMatrices(a, b [3][3]float64) (m [3][3]float64) {
+	for i := range m {
+		for j := range m[i] {
+			for k := 0; k < 3; k++ {
+				m[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return m
+}
+
+func mulMatrixVector(m [3][3]float64, v [3]float64) (r [3]float64) {
+	for i := range r {
+		r[i] = m[i][0]*v[0] + m[i][1]*v[1] + m[i][2]*v[2]
+	}
+	return r
+}
@@ -0,0 +1,265 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+)
+
+// Exit statuses of acquisition programs, see Command
+const (
+	commandExitEmpty     = 2
+	commandExitNotFound  = 3
+	commandExitJammed    = 4
+	commandExitBusy      = 5
+	commandExitCoverOpen = 6
+)
+
+// Command scans by running an acquisition program, e.g. a bridge to the
+// TWAIN or WIA driver of the scanner on platforms without SANE.
+//
+// The program gets the job in its environment: SCAN_DIR (directory to
+// write the pages to), SCAN_DEVICE, SCAN_RESOLUTION, SCAN_DEPTH,
+// SCAN_MODE and SCAN_SOURCE (values of the "mode" and "source"
+// options), SCAN_MAX_PAGES (0 = all pages) and SCAN_OPTIONS (all
+// options as JSON object). It writes every page as image file (PNG,
+// JPEG, BMP or TIFF) into SCAN_DIR and prints its path on a line of its
+// own once the file is complete. Failures are reported by the exit
+// status: 2 = feeder empty, 3 = scanner not found, 4 = paper jam, 5 =
+// scanner busy, 6 = cover open, others fail the scan with the last
+// line written to stderr.
+type Command struct {
+	// Path and Args start the program
+	Path string
+	Args []string
+	// Device is passed as SCAN_DEVICE unless the job names a device
+	Device string
+	// Model is reported as model of the device (default: the name of
+	// the program)
+	Model string
+
+	lock sync.Mutex
+}
+
+// Scan implements Scanner
+func (c *Command) Scan(job Job, out chan<- image.Image) (err error) {
+	defer close(out)
+
+	obs := job.Observer
+	if obs == nil {
+		obs = nopObserver{}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err = obs.Starting(); err != nil {
+		return err
+	}
+
+	var n int
+	defer func() { obs.Finished(n, err) }()
+
+	dir, err := ioutil.TempDir("", "scansnap-pages-")
+	if err != nil {
+		return fmt.Errorf("Unable to create page directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	env, err := c.env(job, dir)
+	if err != nil {
+		return err
+	}
+
+	ctx := job.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Path, c.Args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("Unable to start scan command: %s", err)
+	}
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("Unable to start scan command: %s", err)
+	}
+
+	waited := false
+	defer func() {
+		if !waited {
+			// Stopped early, the program is not waited for to finish
+			cancel()
+			cmd.Wait()
+		}
+	}()
+
+	applied := []AppliedOption{}
+	for _, k := range sortedOptionNames(job.Options) {
+		applied = append(applied, AppliedOption{Name: k, Requested: job.Options[k], Effective: job.Options[k]})
+	}
+	if r, ok := obs.(OptionReporter); ok {
+		r.OptionsApplied(applied)
+	}
+	obs.Started(c.device(job), job.Options)
+
+	lines := bufio.NewScanner(stdout)
+	for lines.Scan() {
+		file := strings.TrimSpace(lines.Text())
+		if file == "" {
+			continue
+		}
+
+		if job.PageLimit > 0 && n >= job.PageLimit {
+			return PageLimitError(job.PageLimit)
+		}
+
+		page, err := readPageFile(dir, file)
+		if err != nil {
+			return err
+		}
+
+		out <- page
+		n++
+
+		if err = obs.PageScanned(n); err != nil {
+			return err
+		}
+
+		if job.MaxPages > 0 && n >= job.MaxPages {
+			return nil
+		}
+	}
+
+	waited = true
+	err = cmd.Wait()
+	if ctxErr := job.canceled(); ctxErr != nil {
+		return ctxErr
+	}
+	return commandError(err, stderr.String(), n)
+}
+
+// env returns the environment describing the job to the program
+func (c *Command) env(job Job, dir string) ([]string, error) {
+	opts, err := json.Marshal(job.Options)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to encode options: %s", err)
+	}
+
+	depth := job.Depth
+	if depth == 0 {
+		depth = 8
+	}
+
+	return []string{
+		"SCAN_DIR=" + dir,
+		"SCAN_DEVICE=" + c.device(job).Name,
+		"SCAN_RESOLUTION=" + strconv.Itoa(job.Resolution),
+		"SCAN_DEPTH=" + strconv.Itoa(depth),
+		"SCAN_MODE=" + optionString(job.Options, "mode"),
+		"SCAN_SOURCE=" + optionString(job.Options, "source"),
+		"SCAN_MAX_PAGES=" + strconv.Itoa(job.MaxPages),
+		"SCAN_OPTIONS=" + string(opts),
+	}, nil
+}
+
+// device describes the device of the job to observers
+func (c *Command) device(job Job) Device {
+	dev := Device{Name: c.Device, Vendor: "scansnap-go", Model: c.Model, Type: "acquisition command"}
+	if job.Device != "" {
+		dev.Name = job.Device
+	}
+	if dev.Model == "" {
+		dev.Model = filepath.Base(c.Path)
+	}
+	return dev
+}
+
+func optionString(opts map[string]interface{}, name string) string {
+	if v, ok := opts[name]; ok {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// readPageFile decodes and removes a page written by the program, only
+// files in the page directory are accepted
+func readPageFile(dir, file string) (image.Image, error) {
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	if filepath.Dir(filepath.Clean(file)) != filepath.Clean(dir) {
+		return nil, fmt.Errorf("Scan command reported page %q outside of SCAN_DIR", file)
+	}
+	defer os.Remove(file)
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open page: %s", err)
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode page %s: %s", filepath.Base(file), err)
+	}
+	return img, nil
+}
+
+// commandError maps the exit status of the program to the errors of
+// SANE devices, a program ending without pages found the feeder empty
+func commandError(err error, stderr string, pages int) error {
+	var exit *exec.ExitError
+	switch {
+	case err == nil && pages == 0:
+		return ErrEmpty
+	case err == nil:
+		return nil
+	case !errors.As(err, &exit):
+		return fmt.Errorf("Scan command failed: %s", err)
+	}
+
+	msg := err.Error()
+	if lines := strings.Split(strings.TrimSpace(stderr), "\n"); lines[len(lines)-1] != "" {
+		msg = strings.TrimSpace(lines[len(lines)-1])
+	}
+
+	switch exit.ExitCode() {
+	case commandExitEmpty:
+		if pages > 0 {
+			// The feeder ran empty after the last page
+			return nil
+		}
+		return ErrEmpty
+	case commandExitNotFound:
+		return UnavailableError(msg)
+	case commandExitJammed:
+		return ErrJammed
+	case commandExitBusy:
+		return ErrBusy
+	case commandExitCoverOpen:
+		return ErrCoverOpen
+	}
+	return fmt.Errorf("Scan command failed: %s", msg)
+}
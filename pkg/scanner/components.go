@@ -0,0 +1,104 @@
+package scanner
+
+import (
+	"image"
+	"image/draw"
+
+	"github.com/disintegration/imaging"
+)
+
+// darkComponent is an 8-connected area of dark pixels
+type darkComponent struct {
+	Bounds image.Rectangle
+	// Count is the number of pixels of the component
+	Count int
+	// Pixels contains the pixels of components not exceeding the size
+	// limit given to findDarkComponents, nil for larger ones
+	Pixels []image.Point
+}
+
+// findDarkComponents calls fn for every area of pixels darker than
+// threshold within the pixels accepted by inside (nil = all). Only
+// the pixels of components fitting into limit x limit are collected.
+func findDarkComponents(g *image.Gray, threshold uint8, limit int, inside func(x, y int) bool, fn func(c darkComponent)) {
+	var (
+		w, h    = g.Bounds().Dx(), g.Bounds().Dy()
+		visited = make([]bool, w*h)
+		stack   = []image.Point{}
+		pixels  = []image.Point{}
+	)
+
+	dark := func(x, y int) bool {
+		return g.Pix[y*g.Stride+x] < threshold && (inside == nil || inside(x, y))
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if visited[y*w+x] || !dark(x, y) {
+				continue
+			}
+
+			var (
+				c     = darkComponent{Bounds: image.Rect(x, y, x+1, y+1)}
+				small = true
+			)
+			stack, pixels = append(stack[:0], image.Pt(x, y)), pixels[:0]
+			visited[y*w+x] = true
+
+			for len(stack) > 0 {
+				pt := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+
+				c.Count++
+				c.Bounds = c.Bounds.Union(image.Rect(pt.X, pt.Y, pt.X+1, pt.Y+1))
+				if small = small && c.Bounds.Dx() <= limit && c.Bounds.Dy() <= limit; small {
+					// Larger areas are not of interest, stop collecting them
+					pixels = append(pixels, pt)
+				}
+
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						nx, ny := pt.X+dx, pt.Y+dy
+						if nx < 0 || ny < 0 || nx >= w || ny >= h || visited[ny*w+nx] || !dark(nx, ny) {
+							continue
+						}
+						visited[ny*w+nx] = true
+						stack = append(stack, image.Pt(nx, ny))
+					}
+				}
+			}
+
+			if small {
+				c.Pixels = append([]image.Point(nil), pixels...)
+			}
+			fn(c)
+		}
+	}
+}
+
+// editableCopy returns a copy of the image which can be modified,
+// grayscale and bilevel images keep their type
+func editableCopy(img image.Image) draw.Image {
+	b := img.Bounds()
+
+	switch src := img.(type) {
+	case *image.Gray:
+		out := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+		for y := 0; y < b.Dy(); y++ {
+			copy(out.Pix[y*out.Stride:y*out.Stride+b.Dx()], src.Pix[y*src.Stride:y*src.Stride+b.Dx()])
+		}
+		return out
+
+	case *image.Paletted:
+		out := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), src.Palette)
+		for y := 0; y < b.Dy(); y++ {
+			copy(out.Pix[y*out.Stride:y*out.Stride+b.Dx()], src.Pix[y*src.Stride:y*src.Stride+b.Dx()])
+		}
+		return out
+	}
+
+	if IsDeep(img) {
+		return deepCopy(img)
+	}
+	return imaging.Clone(img)
+}
@@ -0,0 +1,130 @@
+package scanner
+
+import (
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// Width the page is reduced to before looking at its corners
+	cornerAnalysisWidth = 600
+	// Folds and staple shadows between the sizes (legs of the triangle,
+	// mm) are reported, larger dark corners are content (photos, bars)
+	cornerMinSizeMM = 3.0
+	cornerMaxSizeMM = 25.0
+	// Pixels darker than the paper by cornerDarkLevel are shadow
+	cornerDarkLevel = 48
+	// The triangle must be covered by shadow to cornerMinFill, the band
+	// next to its edge must be paper up to cornerMaxBandInk
+	cornerMinFill    = 0.85
+	cornerMaxBandInk = 0.15
+)
+
+// pageCorners are checked in this order, right and bottom tell the
+// edges of the corner
+var pageCorners = []struct {
+	name   string
+	right  bool
+	bottom bool
+}{
+	{"top left", false, false},
+	{"top right", true, false},
+	{"bottom left", false, true},
+	{"bottom right", true, true},
+}
+
+// detectFoldedCorner looks for the dark triangle left in a corner by a
+// folded (dog-eared) corner or the shadow of a removed staple: a solid
+// triangle with its legs along the page edges and paper along its
+// hypotenuse. The corner and the length of the legs are returned.
+func detectFoldedCorner(img image.Image, scanDPI int) (string, float64, bool) {
+	b := img.Bounds()
+	if b.Dx() == 0 || scanDPI <= 0 {
+		return "", 0, false
+	}
+
+	width := cornerAnalysisWidth
+	if b.Dx() < width {
+		width = b.Dx()
+	}
+	small := imaging.Grayscale(imaging.Resize(img, width, 0, imaging.Box))
+	var (
+		sb      = small.Bounds()
+		pxPerMM = float64(scanDPI) * float64(width) / float64(b.Dx()) / 25.4
+		minSize = int(cornerMinSizeMM*pxPerMM + 0.5)
+		maxSize = int(cornerMaxSizeMM*pxPerMM + 0.5)
+		paper   = paperLevel(small)
+	)
+	// The band along the hypotenuse is as wide as the smallest triangle
+	band := minSize
+	if minSize < 3 || 2*(maxSize+2*band) > sb.Dx() || 2*(maxSize+2*band) > sb.Dy() {
+		return "", 0, false
+	}
+
+	side := maxSize + 2*band
+	for _, c := range pageCorners {
+		// dark and total count the pixels by their distance to the corner
+		// along the diagonal (x + y in coordinates of the corner)
+		dark := make([]int, 2*side)
+		total := make([]int, 2*side)
+		for y := 0; y < side; y++ {
+			for x := 0; x < side; x++ {
+				px, py := sb.Min.X+x, sb.Min.Y+y
+				if c.right {
+					px = sb.Max.X - 1 - x
+				}
+				if c.bottom {
+					py = sb.Max.Y - 1 - y
+				}
+				total[x+y]++
+				// Grayscale sets R = G = B
+				if int(small.Pix[small.PixOffset(px, py)]) < paper-cornerDarkLevel {
+					dark[x+y]++
+				}
+			}
+		}
+
+		// The largest triangle matching is reported
+		for size := maxSize; size >= minSize; size-- {
+			if fill(dark, total, 0, size) >= cornerMinFill && fill(dark, total, size+band/2, size+band/2+band) <= cornerMaxBandInk {
+				return c.name, float64(size) / pxPerMM, true
+			}
+		}
+	}
+
+	return "", 0, false
+}
+
+// fill returns the fraction of dark pixels at the diagonals from..to
+func fill(dark, total []int, from, to int) float64 {
+	var d, t int
+	for k := from; k < to; k++ {
+		d += dark[k]
+		t += total[k]
+	}
+	if t == 0 {
+		return 0
+	}
+	return float64(d) / float64(t)
+}
+
+// paperLevel returns the brightness of the paper, the median of the
+// page which is mostly paper for documents
+func paperLevel(img *image.NRGBA) int {
+	var hist [256]int
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			hist[img.Pix[img.PixOffset(x, y)]]++
+		}
+	}
+
+	half, n := b.Dx()*b.Dy()/2, 0
+	for v, c := range hist {
+		if n += c; n >= half {
+			return v
+		}
+	}
+	return 255
+}
@@ -0,0 +1,125 @@
+package scanner
+
+import (
+	"fmt"
+	"image"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// cropStep removes the scanner background around the content of the
+// page, keeping margin mm around it. Pixels differing from the color of
+// the image border by more than tolerance are content, which is the
+// paper itself on a dark background.
+type cropStep struct {
+	margin    float64 // mm
+	tolerance int
+}
+
+func newCropStep(o StepOptions) (Step, error) {
+	margin, err := o.Float("margin", 5)
+	if err != nil {
+		return nil, err
+	}
+	tolerance, err := o.Int("tolerance", 40)
+	if err != nil {
+		return nil, err
+	}
+	if margin < 0 || tolerance < 1 || tolerance > 254 {
+		return nil, fmt.Errorf("margin must not be negative and tolerance must be between 1 and 254")
+	}
+	return cropStep{margin, tolerance}, nil
+}
+
+func (c cropStep) Apply(p *StepPage) error {
+	bounds, ok := contentBounds(toGray(p.Image), c.tolerance)
+	if !ok {
+		// Blank pages are kept as they are
+		return nil
+	}
+
+	var (
+		b      = p.Image.Bounds()
+		margin = mmToPixels(c.margin, p.DPI)
+	)
+	bounds = image.Rect(bounds.Min.X-margin, bounds.Min.Y-margin, bounds.Max.X+margin, bounds.Max.Y+margin).
+		Intersect(image.Rect(0, 0, b.Dx(), b.Dy()))
+	if bounds.Dx() == b.Dx() && bounds.Dy() == b.Dy() {
+		return nil
+	}
+
+	bounds = bounds.Add(b.Min)
+	if sub, ok := p.Image.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		p.Image = editableCopy(sub.SubImage(bounds))
+	} else {
+		p.Image = imaging.Crop(p.Image, bounds)
+	}
+	p.ActualSize = true
+
+	return nil
+}
+
+func (cropStep) KeepsDepth() bool { return true }
+
+// contentBounds returns the area of rows and columns containing
+// content, which must cover at least 0.5% of the row / column to ignore
+// dust and noise
+func contentBounds(g *image.Gray, tolerance int) (image.Rectangle, bool) {
+	var (
+		w, h = g.Bounds().Dx(), g.Bounds().Dy()
+		bg   = borderColor(g)
+		rows = make([]int, h)
+		cols = make([]int, w)
+	)
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if d := int(g.Pix[y*g.Stride+x]) - bg; d > tolerance || -d > tolerance {
+				rows[y]++
+				cols[x]++
+			}
+		}
+	}
+
+	span := func(counts []int, min int) (int, int) {
+		first, last := -1, -1
+		for i, n := range counts {
+			if n >= min {
+				if first < 0 {
+					first = i
+				}
+				last = i
+			}
+		}
+		return first, last + 1
+	}
+
+	x0, x1 := span(cols, maxInt(h/200, 2))
+	y0, y1 := span(rows, maxInt(w/200, 2))
+	if x0 < 0 || y0 < 0 {
+		return image.Rectangle{}, false
+	}
+	return image.Rect(x0, y0, x1, y1), true
+}
+
+// borderColor returns the median gray of the outermost pixels which is
+// the scanner background for over-scanned pages
+func borderColor(g *image.Gray) int {
+	var (
+		w, h = g.Bounds().Dx(), g.Bounds().Dy()
+		vals = []int{}
+	)
+
+	for x := 0; x < w; x++ {
+		vals = append(vals, int(g.Pix[x]), int(g.Pix[(h-1)*g.Stride+x]))
+	}
+	for y := 0; y < h; y++ {
+		vals = append(vals, int(g.Pix[y*g.Stride]), int(g.Pix[y*g.Stride+w-1]))
+	}
+
+	sort.Ints(vals)
+	return vals[len(vals)/2]
+}
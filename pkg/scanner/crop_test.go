@@ -0,0 +1,100 @@
+package scanner
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestCrop(t *testing.T) {
+	for name, tc := range map[string]struct {
+		spec    string
+		draw    func(img *image.Gray)
+		exp     image.Rectangle
+		cropped bool
+	}{
+		"paper on dark background": {
+			"crop",
+			func(img *image.Gray) {
+				fillRect(img, img.Bounds(), color.Gray{Y: 30})
+				fillRect(img, image.Rect(30, 40, 170, 260), color.White)
+			},
+			// 5 mm margin at 100 dpi
+			image.Rect(10, 20, 190, 280),
+			true,
+		},
+		"content on white paper": {
+			"crop margin=0",
+			func(img *image.Gray) {
+				fillRect(img, image.Rect(100, 100, 150, 120), color.Black)
+				img.SetGray(10, 10, color.Gray{}) // dust
+			},
+			image.Rect(100, 100, 150, 120),
+			true,
+		},
+		"margin limited by page": {
+			"crop margin=50",
+			func(img *image.Gray) {
+				fillRect(img, image.Rect(5, 100, 150, 120), color.Black)
+			},
+			image.Rect(0, 0, 300, 300),
+			false,
+		},
+		"faint content within tolerance": {
+			"crop tolerance=100",
+			func(img *image.Gray) {
+				fillRect(img, image.Rect(100, 100, 150, 120), color.Gray{Y: 200})
+			},
+			image.Rect(0, 0, 300, 300),
+			false,
+		},
+		"blank page": {
+			"crop",
+			func(img *image.Gray) {},
+			image.Rect(0, 0, 300, 300),
+			false,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			page := testPage(300, 300)
+			tc.draw(page.Image.(*image.Gray))
+			orig := page.Image
+
+			if err := mustParsePipeline(t, tc.spec).Apply(page); err != nil {
+				t.Fatalf("applying step: %s", err)
+			}
+
+			if page.ActualSize != tc.cropped || (!tc.cropped && page.Image != orig) {
+				t.Errorf("expected cropped=%v, got ActualSize=%v", tc.cropped, page.ActualSize)
+			}
+			if size := page.Image.Bounds().Size(); size != tc.exp.Size() {
+				t.Errorf("expected size %v, got %v", tc.exp.Size(), size)
+			}
+			if _, ok := page.Image.(*image.Gray); !ok {
+				t.Errorf("expected a grayscale image, got %T", page.Image)
+			}
+
+			// The cropped image starts at the content
+			if tc.cropped {
+				out := page.Image.(*image.Gray)
+				src := orig.(*image.Gray)
+				b := out.Bounds()
+				if out.Pix[0] != src.GrayAt(tc.exp.Min.X, tc.exp.Min.Y).Y || out.GrayAt(b.Max.X-1, b.Max.Y-1) != src.GrayAt(tc.exp.Max.X-1, tc.exp.Max.Y-1) {
+					t.Errorf("expected the image cropped to %v", tc.exp)
+				}
+			}
+		})
+	}
+}
+
+func TestCropOptions(t *testing.T) {
+	for _, spec := range []string{
+		"crop margin=-1",
+		"crop tolerance=0",
+		"crop tolerance=255",
+	} {
+		if _, err := ParsePipeline(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
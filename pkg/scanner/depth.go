@@ -0,0 +1,151 @@
+package scanner
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/disintegration/imaging"
+)
+
+// DepthKeeper is implemented by steps keeping deep pages (16 bits per
+// sample) at their depth, all other steps process 8 bit pages
+type DepthKeeper interface {
+	KeepsDepth() bool
+}
+
+// ReducingDepth returns the steps of the pipeline which would reduce
+// deep pages to 8 bits per sample
+func (p Pipeline) ReducingDepth() []string {
+	names := []string{}
+	for _, s := range p {
+		if k, ok := s.Step.(DepthKeeper); !ok || !k.KeepsDepth() {
+			names = append(names, s.Name)
+		}
+	}
+	return names
+}
+
+// IsDeep reports whether the image has 16 bits per sample
+func IsDeep(img image.Image) bool {
+	switch img.ColorModel() {
+	case color.Gray16Model, color.RGBA64Model, color.NRGBA64Model:
+		return true
+	}
+	return false
+}
+
+// deepCopy copies a deep image into a Gray16 or RGBA64 image at the
+// origin, reading the frames of the scanner pixel by pixel once
+func deepCopy(img image.Image) draw.Image {
+	b := img.Bounds()
+	var out draw.Image = image.NewRGBA64(image.Rect(0, 0, b.Dx(), b.Dy()))
+	if img.ColorModel() == color.Gray16Model {
+		out = image.NewGray16(out.Bounds())
+	}
+	draw.Draw(out, out.Bounds(), img, b.Min, draw.Src)
+	return out
+}
+
+// deepGray converts a deep page to gray keeping its depth
+func deepGray(img image.Image) *image.Gray16 {
+	if g, ok := img.(*image.Gray16); ok {
+		return g
+	}
+	b := img.Bounds()
+	out := image.NewGray16(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(out, out.Bounds(), img, b.Min, draw.Src)
+	return out
+}
+
+// deepResize scales a deep page down to width x height averaging the
+// samples covered by every target pixel (box filter)
+func deepResize(img image.Image, width, height int) image.Image {
+	var (
+		src  = deepCopy(img)
+		b    = src.Bounds()
+		out  = image.NewRGBA64(image.Rect(0, 0, width, height))
+		gray *image.Gray16
+	)
+	if _, ok := src.(*image.Gray16); ok {
+		gray = image.NewGray16(out.Bounds())
+	}
+
+	for y := 0; y < height; y++ {
+		y0, y1 := y*b.Dy()/height, (y+1)*b.Dy()/height
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*b.Dx()/width, (x+1)*b.Dx()/width
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, bl, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, _ := src.At(sx, sy).RGBA()
+					r, g, bl, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), n+1
+				}
+			}
+
+			if gray != nil {
+				gray.SetGray16(x, y, color.Gray16{uint16(r / n)})
+				continue
+			}
+			out.SetRGBA64(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), 0xffff})
+		}
+	}
+
+	if gray != nil {
+		return gray
+	}
+	return out
+}
+
+// RotatePage rotates the page clockwise by 90, 180 or 270 degrees,
+// deep pages keep their depth
+func RotatePage(ops ImageOps, img image.Image, angle int) image.Image {
+	if !IsDeep(img) {
+		switch angle {
+		case 90:
+			return imaging.Rotate270(img)
+		case 180:
+			return ops.Rotate180(img)
+		case 270:
+			return imaging.Rotate90(img)
+		}
+		return img
+	}
+
+	var (
+		src    = deepCopy(img)
+		w, h   = src.Bounds().Dx(), src.Bounds().Dy()
+		size   = image.Rect(0, 0, h, w)
+		target func(x, y int) (int, int)
+	)
+	switch angle {
+	case 90:
+		target = func(x, y int) (int, int) { return h - 1 - y, x }
+	case 180:
+		size = src.Bounds()
+		target = func(x, y int) (int, int) { return w - 1 - x, h - 1 - y }
+	case 270:
+		target = func(x, y int) (int, int) { return y, w - 1 - x }
+	default:
+		return img
+	}
+
+	var out draw.Image = image.NewRGBA64(size)
+	if _, ok := src.(*image.Gray16); ok {
+		out = image.NewGray16(size)
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			tx, ty := target(x, y)
+			out.Set(tx, ty, src.At(x, y))
+		}
+	}
+	return out
+}
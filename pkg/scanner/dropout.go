@@ -0,0 +1,69 @@
+package scanner
+
+import (
+	"fmt"
+)
+
+// dropoutChannels maps the dropout colors to their plane
+var dropoutChannels = map[string]int{"red": 0, "green": 1, "blue": 2}
+
+// dropoutStep removes the content printed in a color, like the boxes and
+// labels of forms, by replacing pixels of that color with the level of
+// their own channel. This is what the page looks like under light of the
+// color: the print vanishes into the paper while dark handwriting and
+// black print are kept.
+type dropoutStep struct {
+	channel   int
+	tolerance int
+}
+
+func newDropoutStep(o StepOptions) (Step, error) {
+	var (
+		d   dropoutStep
+		ok  bool
+		err error
+	)
+
+	color := o.String("color", "red")
+	if d.channel, ok = dropoutChannels[color]; !ok {
+		return nil, fmt.Errorf("color must be red, green or blue")
+	}
+	if d.tolerance, err = o.Int("tolerance", 40); err != nil {
+		return nil, err
+	}
+	if d.tolerance < 1 || d.tolerance > 254 {
+		return nil, fmt.Errorf("tolerance must be between 1 and 254")
+	}
+
+	return d, nil
+}
+
+func (d dropoutStep) Apply(p *StepPage) error {
+	planes := splitPlanes(p.Image)
+	if len(planes.planes) != 3 {
+		// Gray and bilevel pages have no colors left to drop
+		return nil
+	}
+
+	var (
+		keep   = planes.planes[d.channel]
+		others = [][]uint8{}
+	)
+	for c, plane := range planes.planes {
+		if c != d.channel {
+			others = append(others, plane)
+		}
+	}
+
+	for i, v := range keep {
+		if int(v)-int(others[0][i]) <= d.tolerance || int(v)-int(others[1][i]) <= d.tolerance {
+			continue
+		}
+		for _, plane := range planes.planes {
+			plane[i] = v
+		}
+	}
+
+	p.Image = planes.image()
+	return nil
+}
@@ -0,0 +1,80 @@
+package scanner
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDropout(t *testing.T) {
+	var (
+		paper       = color.RGBA{0xf5, 0xf0, 0xe8, 0xff}
+		redBox      = color.RGBA{0xe0, 0x60, 0x60, 0xff}
+		greenBox    = color.RGBA{0x60, 0xd0, 0x60, 0xff}
+		handwriting = color.RGBA{0x20, 0x20, 0x50, 0xff}
+		orange      = color.RGBA{0xe0, 0xc0, 0x40, 0xff}
+	)
+
+	for spec, tc := range map[string]map[color.RGBA]color.NRGBA{
+		"dropout": {
+			paper:       {0xf5, 0xf0, 0xe8, 0xff},
+			redBox:      {0xe0, 0xe0, 0xe0, 0xff},
+			greenBox:    {0x60, 0xd0, 0x60, 0xff},
+			handwriting: {0x20, 0x20, 0x50, 0xff},
+			// Red only exceeds green by 0x20, below the tolerance
+			orange: {0xe0, 0xc0, 0x40, 0xff},
+		},
+		"dropout color=green": {
+			redBox:   {0xe0, 0x60, 0x60, 0xff},
+			greenBox: {0xd0, 0xd0, 0xd0, 0xff},
+		},
+		"dropout tolerance=20": {
+			orange: {0xe0, 0xe0, 0xe0, 0xff},
+		},
+	} {
+		t.Run(spec, func(t *testing.T) {
+			img := image.NewRGBA(image.Rect(0, 0, 5, 1))
+			for x, c := range []color.RGBA{paper, redBox, greenBox, handwriting, orange} {
+				img.SetRGBA(x, 0, c)
+			}
+
+			page := &StepPage{Image: img, DPI: 100, OutputDPI: 100, Ops: imagingOps{}}
+			if err := mustParsePipeline(t, spec).Apply(page); err != nil {
+				t.Fatalf("applying step: %s", err)
+			}
+
+			out := page.Image.(*image.NRGBA)
+			for x := 0; x < 5; x++ {
+				in := img.RGBAAt(x, 0)
+				if exp, ok := tc[in]; ok {
+					if got := out.NRGBAAt(x, 0); got != exp {
+						t.Errorf("expected %v to become %v, got %v", in, exp, got)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDropoutGray(t *testing.T) {
+	page := testPage(10, 10)
+	orig := page.Image
+	if err := mustParsePipeline(t, "dropout").Apply(page); err != nil {
+		t.Fatalf("applying step: %s", err)
+	}
+	if page.Image != orig {
+		t.Errorf("expected grayscale pages unchanged")
+	}
+}
+
+func TestDropoutOptions(t *testing.T) {
+	for _, spec := range []string{
+		"dropout color=yellow",
+		"dropout tolerance=0",
+		"dropout tolerance=255",
+	} {
+		if _, err := ParsePipeline(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
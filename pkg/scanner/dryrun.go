@@ -0,0 +1,47 @@
+package scanner
+
+import "fmt"
+
+// OptionValidator is implemented by scanners able to apply the options
+// of a job to the device without feeding paper
+type OptionValidator interface {
+	ValidateOptions(job Job) (OptionReport, error)
+}
+
+// OptionReport tells how the device took the options of a job
+type OptionReport struct {
+	Device Device `json:"device"`
+	// Valid is set if all options were accepted by the device
+	Valid   bool            `json:"valid"`
+	Options []AppliedOption `json:"options"`
+	// Values are all active options of the device after applying them
+	Values map[string]interface{} `json:"values"`
+}
+
+// ValidateOptions implements OptionValidator, the fake scanner takes all
+// options like for scans
+func (f *Fake) ValidateOptions(job Job) (OptionReport, error) {
+	if job.Device != "" && job.Device != fakeDevice.Name {
+		return OptionReport{}, UnavailableError(fmt.Sprintf("Scanner %q not found", job.Device))
+	}
+	if job.Resolution > 0 && (job.Resolution < 50 || job.Resolution > 600) {
+		return OptionReport{}, UnsupportedError("Resolution is not supported by the fake scanner (range 50-600)")
+	}
+	if job.Depth != 0 && job.Depth != 8 && job.Depth != 16 {
+		return OptionReport{}, UnsupportedError("Depth is not supported by the fake scanner (supported: 8, 16)")
+	}
+
+	caps, _ := f.DeviceOptions()
+	report := OptionReport{Device: fakeDevice, Valid: true, Values: map[string]interface{}{}}
+	for _, o := range caps.Options {
+		report.Values[o.Name] = o.Value
+	}
+
+	for _, name := range sortedOptionNames(job.Options) {
+		v := job.Options[name]
+		report.Options = append(report.Options, AppliedOption{Name: name, Requested: v, Effective: v})
+		report.Values[name] = v
+	}
+
+	return report, nil
+}
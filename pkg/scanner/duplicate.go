@@ -0,0 +1,108 @@
+package scanner
+
+import (
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// fingerprintSize is the width and height of Fingerprint, the page is
+	// blurred to compare the layout of the lines and not single letters
+	fingerprintSize = 96
+	fingerprintBlur = 1.5
+	// fingerprintShift is the number of pixels the pages may be shifted
+	// against each other, about 9mm of an A4 page
+	fingerprintShift = 4
+
+	// Darkness below fingerprintPaperLevel is the paper and its noise,
+	// differences below fingerprintTolerance are caused by the noise and
+	// the differing position of the sheet
+	fingerprintPaperLevel = 16
+	fingerprintTolerance  = 16
+	// fingerprintMaxDifference is the fraction of the ink allowed to
+	// differ for scans of the same sheet side, differing lines of
+	// otherwise equal pages change about twice as much
+	fingerprintMaxDifference = 0.01
+)
+
+// Fingerprint is a blurred, small version of the page holding the
+// darkness of every pixel to tell whether two pages are scans of the
+// same sheet side
+type Fingerprint struct {
+	ink [fingerprintSize * fingerprintSize]uint8
+}
+
+// Similar tells whether the fingerprints look like scans of the same
+// sheet side: aligned at their best position nearly all of their ink
+// matches
+func (f *Fingerprint) Similar(o *Fingerprint) bool {
+	for dy := -fingerprintShift; dy <= fingerprintShift; dy++ {
+		for dx := -fingerprintShift; dx <= fingerprintShift; dx++ {
+			if f.difference(o, dx, dy) <= fingerprintMaxDifference {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// difference returns the fraction of the ink differing with o shifted
+// by dx, dy
+func (f *Fingerprint) difference(o *Fingerprint, dx, dy int) float64 {
+	var diff, ink int
+	for y := fingerprintShift; y < fingerprintSize-fingerprintShift; y++ {
+		for x := fingerprintShift; x < fingerprintSize-fingerprintShift; x++ {
+			a, b := int(f.ink[y*fingerprintSize+x]), int(o.ink[(y+dy)*fingerprintSize+x+dx])
+			d := a - b
+			if d < 0 {
+				d = -d
+			}
+			if d > fingerprintTolerance {
+				diff += d - fingerprintTolerance
+			}
+			ink += a + b
+		}
+	}
+	if ink == 0 {
+		return 1
+	}
+	return float64(diff) / float64(ink)
+}
+
+// IsDuplicate tells whether the pages look like scans of the same sheet
+// side, pages without content to compare never are
+func (p *Page) IsDuplicate(o *Page) bool {
+	if p.Fingerprint == nil || o.Fingerprint == nil {
+		return false
+	}
+	return p.Fingerprint.Similar(o.Fingerprint)
+}
+
+// pageFingerprint computes the fingerprint of the page (the thumbnail
+// is sufficient), nil for nearly blank pages which would match every
+// other one
+func pageFingerprint(img image.Image) *Fingerprint {
+	var (
+		small = toGray(imaging.Blur(imaging.Resize(img, fingerprintSize, fingerprintSize, imaging.Box), fingerprintBlur))
+		f     = &Fingerprint{}
+		total int
+	)
+
+	for y := 0; y < fingerprintSize; y++ {
+		for x := 0; x < fingerprintSize; x++ {
+			v := 255 - int(small.Pix[y*small.Stride+x]) - fingerprintPaperLevel
+			if v < 0 {
+				v = 0
+			}
+			f.ink[y*fingerprintSize+x] = uint8(v)
+			total += v
+		}
+	}
+
+	// An average darkness below 1 is a few specks at most
+	if total < fingerprintSize*fingerprintSize {
+		return nil
+	}
+	return f
+}
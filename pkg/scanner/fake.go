@@ -0,0 +1,176 @@
+package scanner
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"sync/atomic"
+)
+
+// fakeDevice is reported to observers of jobs executed by Fake
+var fakeDevice = Device{Name: "fake:0", Vendor: "scansnap-go", Model: "Fake scanner", Type: "virtual device"}
+
+// Fake is a Scanner producing generated pages without any hardware or
+// SANE involved to test the processing and document pipeline
+type Fake struct {
+	// Pages is the number of pages fed per job
+	Pages int
+
+	// scanned counts all pages fed, reported as read-only page-counter
+	// option like the counters of real devices
+	scanned int64
+}
+
+// Scan implements Scanner. The "resolution", "mode" ("Gray" or color),
+// "depth" (8 or 16) and "page-width" / "page-height" (mm) options are
+// respected.
+func (f *Fake) Scan(job Job, out chan<- image.Image) (err error) {
+	defer close(out)
+
+	obs := job.Observer
+	if obs == nil {
+		obs = nopObserver{}
+	}
+
+	if err = obs.Starting(); err != nil {
+		return err
+	}
+
+	var n int
+	defer func() { obs.Finished(n, err) }()
+
+	if job.Device != "" && job.Device != fakeDevice.Name {
+		return UnavailableError(fmt.Sprintf("Scanner %q not found", job.Device))
+	}
+
+	if job.Resolution > 0 {
+		if job.Resolution < 50 || job.Resolution > 600 {
+			return UnsupportedError("Resolution is not supported by the fake scanner (range 50-600)")
+		}
+	}
+	if job.Depth != 0 && job.Depth != 8 && job.Depth != 16 {
+		return UnsupportedError("Depth is not supported by the fake scanner (supported: 8, 16)")
+	}
+
+	values := map[string]interface{}{}
+	applied := []AppliedOption{}
+	for _, k := range sortedOptionNames(job.Options) {
+		values[k] = job.Options[k]
+		applied = append(applied, AppliedOption{Name: k, Requested: job.Options[k], Effective: job.Options[k]})
+	}
+	if r, ok := obs.(OptionReporter); ok {
+		r.OptionsApplied(applied)
+	}
+	obs.Started(fakeDevice, values)
+
+	pages := f.Pages
+	if job.MaxPages > 0 && job.MaxPages < pages {
+		pages = job.MaxPages
+	}
+
+	for n < pages {
+		if err = job.canceled(); err != nil {
+			return err
+		}
+		if job.PageLimit > 0 && n >= job.PageLimit {
+			return PageLimitError(job.PageLimit)
+		}
+
+		out <- fakePage(job.Options, n)
+		n++
+		atomic.AddInt64(&f.scanned, 1)
+
+		if err = obs.PageScanned(n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeviceOptions implements DeviceDescriber with the options respected
+// by the fake scanner
+func (f *Fake) DeviceOptions() (DeviceCapabilities, error) {
+	return DeviceCapabilities{
+		Device: fakeDevice,
+		Options: []DeviceOption{
+			{Option: Option{
+				Name: "resolution", Title: "Scan resolution", Type: TypeInt, Unit: UnitDpi,
+				ConstrRange: &Range{Min: 50, Max: 600, Quant: 1}, IsActive: true, IsSettable: true,
+			}, Value: 300},
+			{Option: Option{
+				Name: "mode", Title: "Scan mode", Type: TypeString,
+				ConstrSet: []interface{}{"Color", "Gray"}, IsActive: true, IsSettable: true,
+			}, Value: "Color"},
+			{Option: Option{
+				Name: "depth", Title: "Bit depth", Type: TypeInt, Unit: UnitBit,
+				ConstrSet: []interface{}{8, 16}, IsActive: true, IsSettable: true,
+			}, Value: 8},
+			{Option: Option{
+				Name: "page-width", Title: "Paper width", Type: TypeFloat, Unit: UnitMm,
+				ConstrRange: &Range{Min: 0.0, Max: 221.0, Quant: 0.0}, IsActive: true, IsSettable: true,
+			}, Value: 210.0},
+			{Option: Option{
+				Name: "page-height", Title: "Paper height", Type: TypeFloat, Unit: UnitMm,
+				ConstrRange: &Range{Min: 0.0, Max: 876.0, Quant: 0.0}, IsActive: true, IsSettable: true,
+			}, Value: 297.0},
+			{Option: Option{
+				Name: "page-counter", Group: "Sensors", Title: "Pages fed", Type: TypeInt,
+				IsActive: true, IsDetectable: true,
+			}, Value: int(atomic.LoadInt64(&f.scanned))},
+		},
+	}, nil
+}
+
+// fakePage draws a page with a border and a block of text-like lines,
+// the number of lines depends on the page index
+func fakePage(opts map[string]interface{}, idx int) image.Image {
+	dpi := optionNumber(opts["resolution"])
+	if dpi == 0 {
+		dpi = 300
+	}
+	widthMM, heightMM := optionNumber(opts["page-width"]), optionNumber(opts["page-height"])
+	if widthMM == 0 || heightMM == 0 {
+		widthMM, heightMM = 210, 297
+	}
+
+	var (
+		w, h = int(widthMM / 25.4 * dpi), int(heightMM / 25.4 * dpi)
+		mm   = func(v float64) int { return int(v / 25.4 * dpi) }
+		img  draw.Image
+		ink  = image.NewUniform(color.RGBA{0x20, 0x20, 0x60, 0xff})
+	)
+
+	deep := optionNumber(opts["depth"]) == 16
+	switch {
+	case opts["mode"] == "Gray" && deep:
+		img = image.NewGray16(image.Rect(0, 0, w, h))
+	case opts["mode"] == "Gray":
+		img = image.NewGray(image.Rect(0, 0, w, h))
+	case deep:
+		img = image.NewRGBA64(image.Rect(0, 0, w, h))
+	default:
+		img = image.NewRGBA(image.Rect(0, 0, w, h))
+	}
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+
+	// Border 10mm inside the page edges
+	for _, r := range []image.Rectangle{
+		image.Rect(mm(10), mm(10), w-mm(10), mm(11)),
+		image.Rect(mm(10), h-mm(11), w-mm(10), h-mm(10)),
+		image.Rect(mm(10), mm(10), mm(11), h-mm(10)),
+		image.Rect(w-mm(11), mm(10), w-mm(10), h-mm(10)),
+	} {
+		draw.Draw(img, r, ink, image.Point{}, draw.Src)
+	}
+
+	// Lines of varying length looking like text
+	for i := 0; i < 10+idx%20; i++ {
+		y := mm(25 + float64(i)*8)
+		length := w - mm(40) - mm(float64((i*37+idx*11)%60))
+		draw.Draw(img, image.Rect(mm(20), y, mm(20)+length, y+mm(3)), ink, image.Point{}, draw.Src)
+	}
+
+	return img
+}
@@ -0,0 +1,86 @@
+package scanner
+
+import (
+	"context"
+	"image"
+	"testing"
+)
+
+// scanPages scans a job using the scanner and processes the pages
+func scanPages(t *testing.T, s Scanner, job Job, p Processor) ([]*Page, error) {
+	t.Helper()
+
+	out := make(chan image.Image)
+	errc := make(chan error, 1)
+	go func() { errc <- s.Scan(job, out) }()
+
+	pages, errs, _ := ProcessPages(p, out, 0)
+	if len(errs) > 0 {
+		t.Fatalf("processing pages: %s", errs)
+	}
+	return pages, <-errc
+}
+
+func TestFakeScan(t *testing.T) {
+	opts := map[string]interface{}{"resolution": 75, "mode": "Gray"}
+
+	for _, color := range []string{ColorModeColor, ColorModeGray, ColorModeBW} {
+		t.Run(color, func(t *testing.T) {
+			pages, err := scanPages(t, &Fake{Pages: 3}, Job{Options: opts, Resolution: 75},
+				ImageProcessor{Color: color, ScanDPI: 75, OutputDPI: 75, JPEGQuality: 75})
+			if err != nil {
+				t.Fatalf("scanning: %s", err)
+			}
+			if len(pages) != 3 {
+				t.Fatalf("expected 3 pages, got %d", len(pages))
+			}
+
+			for i, p := range pages {
+				if p.Index != i {
+					t.Errorf("expected page %d at position %d", p.Index, i)
+				}
+				if p.Width == 0 || p.Height <= p.Width || len(p.Data) == 0 {
+					t.Errorf("page %d: invalid image %dx%d with %d bytes", i, p.Width, p.Height, len(p.Data))
+				}
+				if _, err := p.PDFImage(); err != nil {
+					t.Errorf("page %d: %s", i, err)
+				}
+			}
+
+			if exp := map[string]string{ColorModeBW: "ccitt"}[color]; exp != "" && pages[0].ImageType != exp {
+				t.Errorf("expected %s page, got %s", exp, pages[0].ImageType)
+			}
+		})
+	}
+}
+
+func TestFakeScanLimits(t *testing.T) {
+	p := ImageProcessor{Color: ColorModeGray, ScanDPI: 75, OutputDPI: 75}
+	opts := map[string]interface{}{"resolution": 75}
+
+	pages, err := scanPages(t, &Fake{Pages: 5}, Job{Options: opts, MaxPages: 2}, p)
+	if err != nil || len(pages) != 2 {
+		t.Errorf("expected 2 pages using MaxPages, got %d (%v)", len(pages), err)
+	}
+
+	pages, err = scanPages(t, &Fake{Pages: 5}, Job{Options: opts, PageLimit: 2}, p)
+	if _, ok := err.(PageLimitError); !ok || len(pages) != 2 {
+		t.Errorf("expected PageLimitError after 2 pages, got %d (%v)", len(pages), err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = scanPages(t, &Fake{Pages: 5}, Job{Options: opts, Context: ctx}, p); err != context.Canceled {
+		t.Errorf("expected the canceled job to fail, got %v", err)
+	}
+
+	for name, job := range map[string]Job{
+		"resolution": {Resolution: 1200},
+		"depth":      {Depth: 12},
+		"device":     {Device: "test:0"},
+	} {
+		if _, err = scanPages(t, &Fake{Pages: 1}, job, p); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package scanner
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// imagePlanes holds the 8 bit channels of an image for the filters,
+// grayscale and bilevel images have a single plane
+type imagePlanes struct {
+	w, h    int
+	planes  [][]uint8
+	bilevel bool
+}
+
+func splitPlanes(img image.Image) *imagePlanes {
+	b := img.Bounds()
+	p := &imagePlanes{w: b.Dx(), h: b.Dy()}
+
+	switch src := img.(type) {
+	case *image.Gray:
+		p.planes = [][]uint8{make([]uint8, p.w*p.h)}
+		for y := 0; y < p.h; y++ {
+			copy(p.planes[0][y*p.w:(y+1)*p.w], src.Pix[y*src.Stride:y*src.Stride+p.w])
+		}
+		return p
+
+	case *image.Paletted:
+		if isBilevel(src) {
+			p.bilevel = true
+			p.planes = [][]uint8{toGray(src).Pix}
+			return p
+		}
+	}
+
+	src := imaging.Clone(img)
+	p.planes = [][]uint8{make([]uint8, p.w*p.h), make([]uint8, p.w*p.h), make([]uint8, p.w*p.h)}
+	for y := 0; y < p.h; y++ {
+		for x := 0; x < p.w; x++ {
+			o := y*src.Stride + x*4
+			for c := range p.planes {
+				p.planes[c][y*p.w+x] = src.Pix[o+c]
+			}
+		}
+	}
+	return p
+}
+
+// image merges the planes into an image of the type split
+func (p *imagePlanes) image() image.Image {
+	rect := image.Rect(0, 0, p.w, p.h)
+
+	switch {
+	case p.bilevel:
+		out := image.NewPaletted(rect, bilevelPalette)
+		for i, v := range p.planes[0] {
+			if v >= 128 {
+				out.Pix[i/p.w*out.Stride+i%p.w] = 1
+			}
+		}
+		return out
+
+	case len(p.planes) == 1:
+		out := image.NewGray(rect)
+		for y := 0; y < p.h; y++ {
+			copy(out.Pix[y*out.Stride:y*out.Stride+p.w], p.planes[0][y*p.w:(y+1)*p.w])
+		}
+		return out
+	}
+
+	out := image.NewNRGBA(rect)
+	for y := 0; y < p.h; y++ {
+		for x := 0; x < p.w; x++ {
+			o := y*out.Stride + x*4
+			for c := range p.planes {
+				out.Pix[o+c] = p.planes[c][y*p.w+x]
+			}
+			out.Pix[o+3] = 0xff
+		}
+	}
+	return out
+}
+
+// radiusOption reads the radius of a filter window
+func radiusOption(o StepOptions, def int) (int, error) {
+	r, err := o.Int("radius", def)
+	if err != nil {
+		return 0, err
+	}
+	if r < 1 || r > 5 {
+		return 0, fmt.Errorf("radius must be between 1 and 5")
+	}
+	return r, nil
+}
+
+// medianStep replaces every pixel by the median of the surrounding
+// (2*radius+1)² pixels, which removes noise while keeping edges sharp
+type medianStep struct{ radius int }
+
+func newMedianStep(o StepOptions) (Step, error) {
+	r, err := radiusOption(o, 1)
+	if err != nil {
+		return nil, err
+	}
+	return medianStep{r}, nil
+}
+
+func (m medianStep) Apply(p *StepPage) error {
+	planes := splitPlanes(p.Image)
+	for i, plane := range planes.planes {
+		planes.planes[i] = medianFilter(plane, planes.w, planes.h, m.radius)
+	}
+	p.Image = planes.image()
+	return nil
+}
+
+// medianFilter uses a sliding histogram per row (Huang), the image is
+// extended by repeating its border pixels
+func medianFilter(in []uint8, w, h, r int) []uint8 {
+	var (
+		out  = make([]uint8, len(in))
+		half = (2*r + 1) * (2*r + 1) / 2
+	)
+
+	at := func(x, y int) uint8 {
+		return in[clampInt(y, 0, h-1)*w+clampInt(x, 0, w-1)]
+	}
+
+	for y := 0; y < h; y++ {
+		var hist [256]int
+		for dy := -r; dy <= r; dy++ {
+			for dx := -r; dx <= r; dx++ {
+				hist[at(dx, y+dy)]++
+			}
+		}
+
+		// med is the median, lt the number of pixels below it
+		med, lt := 0, 0
+		for lt+hist[med] <= half {
+			lt += hist[med]
+			med++
+		}
+		out[y*w] = uint8(med)
+
+		for x := 1; x < w; x++ {
+			// Move the window by one column
+			for dy := -r; dy <= r; dy++ {
+				removed, added := int(at(x-r-1, y+dy)), int(at(x+r, y+dy))
+				hist[removed]--
+				hist[added]++
+				if removed < med {
+					lt--
+				}
+				if added < med {
+					lt++
+				}
+			}
+
+			for lt > half {
+				med--
+				lt -= hist[med]
+			}
+			for lt+hist[med] <= half {
+				lt += hist[med]
+				med++
+			}
+			out[y*w+x] = uint8(med)
+		}
+	}
+
+	return out
+}
+
+// denoiseStep smooths the paper texture and scanner noise using a
+// bilateral filter: neighbours differing by much more than strength
+// gray levels (text, edges) are not averaged in
+type denoiseStep struct {
+	radius   int
+	strength float64
+}
+
+func newDenoiseStep(o StepOptions) (Step, error) {
+	r, err := radiusOption(o, 2)
+	if err != nil {
+		return nil, err
+	}
+	strength, err := o.Float("strength", 20)
+	if err != nil {
+		return nil, err
+	}
+	if strength <= 0 || strength > 255 {
+		return nil, fmt.Errorf("strength must be positive and at most 255")
+	}
+	return denoiseStep{r, strength}, nil
+}
+
+func (d denoiseStep) Apply(p *StepPage) error {
+	planes := splitPlanes(p.Image)
+	for i, plane := range planes.planes {
+		planes.planes[i] = bilateralFilter(plane, planes.w, planes.h, d.radius, d.strength)
+	}
+	p.Image = planes.image()
+	return nil
+}
+
+func bilateralFilter(in []uint8, w, h, r int, sigma float64) []uint8 {
+	var (
+		out = make([]uint8, len(in))
+		// Fixed point weights by difference and by distance
+		rangeWeight   [256]int64
+		spatialWeight = make([]int64, (2*r+1)*(2*r+1))
+		spatialSigma  = float64(r) / 2
+	)
+
+	for d := range rangeWeight {
+		rangeWeight[d] = int64(1024 * math.Exp(-float64(d*d)/(2*sigma*sigma)))
+	}
+	for dy := -r; dy <= r; dy++ {
+		for dx := -r; dx <= r; dx++ {
+			spatialWeight[(dy+r)*(2*r+1)+dx+r] = int64(1024 * math.Exp(-float64(dx*dx+dy*dy)/(2*spatialSigma*spatialSigma)))
+		}
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var (
+				center     = int(in[y*w+x])
+				sum, total int64
+			)
+
+			for dy := -r; dy <= r; dy++ {
+				row := clampInt(y+dy, 0, h-1) * w
+				for dx := -r; dx <= r; dx++ {
+					v := int(in[row+clampInt(x+dx, 0, w-1)])
+					diff := v - center
+					if diff < 0 {
+						diff = -diff
+					}
+					weight := spatialWeight[(dy+r)*(2*r+1)+dx+r] * rangeWeight[diff]
+					sum += weight * int64(v)
+					total += weight
+				}
+			}
+
+			// The center always has a positive weight
+			out[y*w+x] = uint8((sum + total/2) / total)
+		}
+	}
+
+	return out
+}
+
+// sharpenStep applies an unsharp mask: the difference to the page
+// blurred by radius (sigma in pixels) is amplified by amount, smaller
+// differences than threshold (noise) are kept
+type sharpenStep struct {
+	amount, radius float64
+	threshold      int
+}
+
+func newSharpenStep(o StepOptions) (Step, error) {
+	var (
+		s   sharpenStep
+		err error
+	)
+
+	if s.amount, err = o.Float("amount", 1); err != nil {
+		return nil, err
+	}
+	if s.radius, err = o.Float("radius", 1); err != nil {
+		return nil, err
+	}
+	if s.threshold, err = o.Int("threshold", 0); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case s.amount <= 0 || s.amount > 5:
+		return nil, fmt.Errorf("amount must be positive and at most 5")
+	case s.radius <= 0 || s.radius > 10:
+		return nil, fmt.Errorf("radius must be positive and at most 10")
+	case s.threshold < 0 || s.threshold > 255:
+		return nil, fmt.Errorf("threshold must be between 0 and 255")
+	}
+
+	return s, nil
+}
+
+func (s sharpenStep) Apply(p *StepPage) error {
+	planes := splitPlanes(p.Image)
+	if planes.bilevel {
+		return nil
+	}
+
+	for i, plane := range planes.planes {
+		blurred := imaging.Blur(&image.Gray{Pix: plane, Stride: planes.w, Rect: image.Rect(0, 0, planes.w, planes.h)}, s.radius)
+
+		out := make([]uint8, len(plane))
+		for j, v := range plane {
+			diff := int(v) - int(blurred.Pix[j*4])
+			if diff < s.threshold && -diff < s.threshold {
+				out[j] = v
+				continue
+			}
+			out[j] = uint8(clampInt(int(math.Round(float64(v)+s.amount*float64(diff))), 0, 255))
+		}
+		planes.planes[i] = out
+	}
+
+	p.Image = planes.image()
+	return nil
+}
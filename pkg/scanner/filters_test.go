@@ -0,0 +1,148 @@
+package scanner
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// naiveMedian sorts the window of every pixel, the image is extended by
+// repeating its border pixels
+func naiveMedian(in []uint8, w, h, r int) []uint8 {
+	out := make([]uint8, len(in))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			window := []int{}
+			for dy := -r; dy <= r; dy++ {
+				for dx := -r; dx <= r; dx++ {
+					window = append(window, int(in[clampInt(y+dy, 0, h-1)*w+clampInt(x+dx, 0, w-1)]))
+				}
+			}
+			sort.Ints(window)
+			out[y*w+x] = uint8(window[len(window)/2])
+		}
+	}
+	return out
+}
+
+func TestMedianFilter(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	w, h := 37, 23
+	in := make([]uint8, w*h)
+	for i := range in {
+		in[i] = uint8(rng.Intn(256))
+	}
+
+	for r := 1; r <= 5; r++ {
+		got, exp := medianFilter(in, w, h, r), naiveMedian(in, w, h, r)
+		for i := range exp {
+			if got[i] != exp[i] {
+				t.Errorf("radius %d: expected %d at (%d,%d), got %d", r, exp[i], i%w, i/w, got[i])
+				break
+			}
+		}
+	}
+}
+
+func TestMedianStep(t *testing.T) {
+	page := testPage(40, 40)
+	img := page.Image.(*image.Gray)
+	img.SetGray(10, 10, color.Gray{})                     // salt noise
+	fillRect(img, image.Rect(20, 0, 40, 40), color.Black) // edge
+
+	if err := mustParsePipeline(t, "median").Apply(page); err != nil {
+		t.Fatalf("applying step: %s", err)
+	}
+
+	out, ok := page.Image.(*image.Gray)
+	if !ok {
+		t.Fatalf("expected a grayscale image, got %T", page.Image)
+	}
+	if v := out.GrayAt(10, 10).Y; v != 0xff {
+		t.Errorf("expected the noise removed, got %d", v)
+	}
+	if out.GrayAt(19, 20).Y != 0xff || out.GrayAt(20, 20).Y != 0 {
+		t.Errorf("expected the edge kept sharp, got %d / %d", out.GrayAt(19, 20).Y, out.GrayAt(20, 20).Y)
+	}
+}
+
+func TestDenoiseStep(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	page := testPage(60, 40)
+	img := page.Image.(*image.Gray)
+	for i := range img.Pix {
+		img.Pix[i] = uint8(200 + rng.Intn(21) - 10) // paper texture
+	}
+	fillRect(img, image.Rect(30, 0, 60, 40), color.Gray{Y: 20}) // text
+
+	if err := mustParsePipeline(t, "denoise").Apply(page); err != nil {
+		t.Fatalf("applying step: %s", err)
+	}
+
+	out := page.Image.(*image.Gray)
+	deviation := func(pix *image.Gray, r image.Rectangle) float64 {
+		var sum float64
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				d := float64(pix.GrayAt(x, y).Y) - 200
+				sum += d * d
+			}
+		}
+		return sum / float64(r.Dx()*r.Dy())
+	}
+
+	paper := image.Rect(5, 5, 25, 35)
+	if before, after := deviation(img, paper), deviation(out, paper); after > before/4 {
+		t.Errorf("expected the texture smoothed, variance %.1f before, %.1f after", before, after)
+	}
+	if out.GrayAt(29, 20).Y < 180 || out.GrayAt(30, 20).Y > 40 {
+		t.Errorf("expected the edge kept, got %d / %d", out.GrayAt(29, 20).Y, out.GrayAt(30, 20).Y)
+	}
+}
+
+func TestFilterImageTypes(t *testing.T) {
+	bilevel := image.NewPaletted(image.Rect(0, 0, 8, 8), bilevelPalette)
+	rgba := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	fillRect(rgba, rgba.Bounds(), color.RGBA{0xff, 0x80, 0x00, 0xff})
+
+	for name, tc := range map[string]struct {
+		img image.Image
+		exp image.Image
+	}{
+		"gray":    {image.NewGray(image.Rect(0, 0, 8, 8)), &image.Gray{}},
+		"bilevel": {bilevel, &image.Paletted{}},
+		"color":   {rgba, &image.NRGBA{}},
+	} {
+		for _, spec := range []string{"median", "denoise"} {
+			page := &StepPage{Image: tc.img, DPI: 100, OutputDPI: 100, Ops: imagingOps{}}
+			if err := mustParsePipeline(t, spec).Apply(page); err != nil {
+				t.Fatalf("%s %s: applying step: %s", spec, name, err)
+			}
+			if got, exp := fmt.Sprintf("%T", page.Image), fmt.Sprintf("%T", tc.exp); got != exp {
+				t.Errorf("%s %s: expected %s, got %s", spec, name, exp, got)
+			}
+		}
+	}
+
+	page := &StepPage{Image: rgba, DPI: 100, OutputDPI: 100, Ops: imagingOps{}}
+	mustParsePipeline(t, "median radius=2").Apply(page)
+	if c := page.Image.(*image.NRGBA).NRGBAAt(4, 4); c != (color.NRGBA{0xff, 0x80, 0x00, 0xff}) {
+		t.Errorf("expected the color kept, got %v", c)
+	}
+}
+
+func TestFilterOptions(t *testing.T) {
+	for _, spec := range []string{
+		"median radius=0",
+		"median radius=6",
+		"denoise strength=0",
+		"denoise strength=300",
+	} {
+		if _, err := ParsePipeline(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+//go:build !windows
+// +build !windows
+
+package scanner
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Luzifer/sane"
+)
+
+// flatbedOptions replaces a SourceFlatbed source by the value of the
+// "source" option of the device naming its flatbed ("Flatbed",
+// "FlatBed", "Platen", ...), it fails for devices without one
+func flatbedOptions(c *sane.Conn, opts map[string]interface{}) (map[string]interface{}, error) {
+	if opts["source"] != SourceFlatbed {
+		return opts, nil
+	}
+
+	for _, o := range c.Options() {
+		if o.Name != "source" {
+			continue
+		}
+		for _, v := range o.ConstrSet {
+			s, ok := v.(string)
+			if !ok || !isFlatbedSource(s) {
+				continue
+			}
+
+			out := map[string]interface{}{}
+			for k, v := range opts {
+				out[k] = v
+			}
+			out["source"] = s
+			return out, nil
+		}
+		return nil, UnsupportedError(fmt.Sprintf("The device has no flatbed (sources: %v)", o.ConstrSet))
+	}
+
+	return nil, UnsupportedError("The device has no flatbed, it has no source option")
+}
+
+func isFlatbedSource(s string) bool {
+	s = strings.ToLower(s)
+	return strings.Contains(s, "flatbed") || strings.Contains(s, "platen")
+}
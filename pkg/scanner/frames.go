@@ -0,0 +1,97 @@
+//go:build !windows
+// +build !windows
+
+package scanner
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/Luzifer/sane"
+)
+
+// scannedPage is a page assembled from the frames read from the
+// scanner. It mirrors sane.Image which cannot be constructed outside
+// the sane package but is required to read pages one by one.
+type scannedPage struct {
+	fs [3]*sane.Frame // multiple frames must be in RGB order
+}
+
+// readPage reads all frames belonging to the next page
+func readPage(c *sane.Conn) (*scannedPage, error) {
+	m := &scannedPage{}
+
+	for {
+		f, err := c.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch f.Format {
+		case sane.FrameGray, sane.FrameRgb, sane.FrameRed:
+			m.fs[0] = f
+		case sane.FrameGreen:
+			m.fs[1] = f
+		case sane.FrameBlue:
+			m.fs[2] = f
+		default:
+			return nil, fmt.Errorf("Unknown frame type %d", f.Format)
+		}
+
+		if f.IsLast {
+			return m, nil
+		}
+	}
+}
+
+func (m *scannedPage) Bounds() image.Rectangle {
+	return image.Rect(0, 0, m.fs[0].Width, m.fs[0].Height)
+}
+
+func (m *scannedPage) ColorModel() color.Model {
+	f := m.fs[0]
+	switch {
+	case f.Depth != 16 && f.Format == sane.FrameGray:
+		return color.GrayModel
+	case f.Depth == 16 && f.Format == sane.FrameGray:
+		return color.Gray16Model
+	case f.Depth == 16:
+		return color.RGBA64Model
+	}
+	return color.RGBAModel
+}
+
+func (m *scannedPage) At(x, y int) color.Color {
+	f := m.fs[0]
+	if x < 0 || x >= f.Width || y < 0 || y >= f.Height {
+		return color.RGBA{}
+	}
+
+	if f.Format == sane.FrameGray {
+		switch f.Depth {
+		case 1:
+			return color.Gray{uint8(0xff * f.At(x, y, 0))}
+		case 16:
+			return color.Gray16{f.At(x, y, 0)}
+		}
+		return color.Gray{uint8(f.At(x, y, 0))}
+	}
+
+	var r, g, b uint16
+	if f.Format == sane.FrameRgb {
+		// interleaved
+		r, g, b = f.At(x, y, 0), f.At(x, y, 1), f.At(x, y, 2)
+	} else {
+		// one frame per channel
+		r, g, b = f.At(x, y, 0), m.fs[1].At(x, y, 0), m.fs[2].At(x, y, 0)
+	}
+
+	switch f.Depth {
+	case 1:
+		return color.RGBA{uint8(0xff * r), uint8(0xff * g), uint8(0xff * b), 0xff}
+	case 16:
+		return color.RGBA64{r, g, b, 0xffff}
+	}
+	return color.RGBA{uint8(r), uint8(g), uint8(b), 0xff}
+}
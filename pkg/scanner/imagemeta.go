@@ -0,0 +1,293 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"time"
+)
+
+// ImageMetadata describes the capture of a page, embedded into image
+// files as EXIF and XMP for photo and document management tools
+type ImageMetadata struct {
+	// Time the page was scanned at
+	Time time.Time
+	// DPI is the resolution of the image
+	DPI int
+	// Make and Model describe the scanner
+	Make, Model string
+	// Software names the program and version producing the image
+	Software string
+}
+
+// EmbedMetadata returns the JPEG or PNG image with the metadata
+// embedded, other image types are returned unchanged
+func EmbedMetadata(imageType string, data []byte, m ImageMetadata) ([]byte, error) {
+	switch imageType {
+	case "jpeg":
+		return embedJPEGMetadata(data, m)
+	case "png":
+		return embedPNGMetadata(data, m)
+	}
+	return data, nil
+}
+
+// jpegXMPHeader starts the APP1 segment holding XMP
+const jpegXMPHeader = "http://ns.adobe.com/xap/1.0/\x00"
+
+// embedJPEGMetadata inserts APP1 segments with EXIF and XMP after the
+// start of image and a JFIF header
+func embedJPEGMetadata(data []byte, m ImageMetadata) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, fmt.Errorf("Invalid JPEG data")
+	}
+
+	pos := 2
+	if data[2] == 0xFF && data[3] == 0xE0 && len(data) >= 6 {
+		// Keep the JFIF APP0 segment first
+		pos += 2 + int(binary.BigEndian.Uint16(data[4:6]))
+	}
+	if pos > len(data) {
+		return nil, fmt.Errorf("Invalid JPEG data")
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(data[:pos])
+	for _, seg := range [][]byte{
+		append([]byte("Exif\x00\x00"), exifData(m)...),
+		append([]byte(jpegXMPHeader), xmpPacket(m)...),
+	} {
+		if len(seg)+2 > 0xFFFF {
+			return nil, fmt.Errorf("Metadata too large for JPEG segment")
+		}
+		buf.Write([]byte{0xFF, 0xE1})
+		binary.Write(buf, binary.BigEndian, uint16(len(seg)+2))
+		buf.Write(seg)
+	}
+	buf.Write(data[pos:])
+	return buf.Bytes(), nil
+}
+
+// embedPNGMetadata inserts the physical pixel size, the modification
+// time, EXIF and XMP chunks after the image header
+func embedPNGMetadata(data []byte, m ImageMetadata) ([]byte, error) {
+	const (
+		sigLen  = 8
+		ihdrLen = 8 + 13 + 4
+	)
+	if len(data) < sigLen+ihdrLen || string(data[12:16]) != "IHDR" {
+		return nil, fmt.Errorf("Invalid PNG data")
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(data[:sigLen+ihdrLen])
+
+	if m.DPI > 0 {
+		phys := make([]byte, 9)
+		ppm := uint32(float64(m.DPI)/0.0254 + 0.5)
+		binary.BigEndian.PutUint32(phys[0:], ppm)
+		binary.BigEndian.PutUint32(phys[4:], ppm)
+		phys[8] = 1 // Unit: metre
+		writePNGChunk(buf, "pHYs", phys)
+	}
+
+	if !m.Time.IsZero() {
+		t := m.Time.UTC()
+		tm := make([]byte, 7)
+		binary.BigEndian.PutUint16(tm, uint16(t.Year()))
+		tm[2], tm[3], tm[4], tm[5], tm[6] = byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second())
+		writePNGChunk(buf, "tIME", tm)
+	}
+
+	writePNGChunk(buf, "eXIf", exifData(m))
+	// iTXt: keyword, no compression, empty language tag and translation
+	writePNGChunk(buf, "iTXt", append([]byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"), xmpPacket(m)...))
+
+	buf.Write(data[sigLen+ihdrLen:])
+	return buf.Bytes(), nil
+}
+
+func writePNGChunk(buf *bytes.Buffer, typ string, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+
+	buf.WriteString(typ)
+	buf.Write(data)
+	binary.Write(buf, binary.BigEndian, crc.Sum32())
+}
+
+// TIFF types of the EXIF entries written
+const (
+	exifASCII     = 2
+	exifShort     = 3
+	exifLong      = 4
+	exifRational  = 5
+	exifUndefined = 7
+)
+
+// exifEntry is a tag of an image file directory, value holds the
+// encoded value
+type exifEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+func exifString(tag uint16, s string) exifEntry {
+	return exifEntry{tag: tag, typ: exifASCII, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+}
+
+func exifRationalValue(tag uint16, num, den uint32) exifEntry {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint32(v, num)
+	binary.BigEndian.PutUint32(v[4:], den)
+	return exifEntry{tag: tag, typ: exifRational, count: 1, value: v}
+}
+
+func exifShortValue(tag, value uint16) exifEntry {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint16(v, value)
+	return exifEntry{tag: tag, typ: exifShort, count: 1, value: v}
+}
+
+func exifLongValue(tag uint16, value uint32) exifEntry {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, value)
+	return exifEntry{tag: tag, typ: exifLong, count: 1, value: v}
+}
+
+// exifData encodes the metadata as big endian TIFF structure with the
+// image attributes in IFD0 and the capture time in the EXIF IFD
+func exifData(m ImageMetadata) []byte {
+	var ifd0, exif []exifEntry
+	if m.Make != "" {
+		ifd0 = append(ifd0, exifString(0x010F, m.Make))
+	}
+	if m.Model != "" {
+		ifd0 = append(ifd0, exifString(0x0110, m.Model))
+	}
+	if m.DPI > 0 {
+		ifd0 = append(ifd0,
+			exifRationalValue(0x011A, uint32(m.DPI), 1), // XResolution
+			exifRationalValue(0x011B, uint32(m.DPI), 1), // YResolution
+			exifShortValue(0x0128, 2),                   // ResolutionUnit: inch
+		)
+	}
+	if m.Software != "" {
+		ifd0 = append(ifd0, exifString(0x0131, m.Software))
+	}
+
+	exif = append(exif, exifEntry{tag: 0x9000, typ: exifUndefined, count: 4, value: []byte("0232")}) // ExifVersion
+	if !m.Time.IsZero() {
+		date := m.Time.Format("2006:01:02 15:04:05")
+		ifd0 = append(ifd0, exifString(0x0132, date)) // DateTime
+		exif = append(exif,
+			exifString(0x9003, date),                    // DateTimeOriginal
+			exifString(0x9004, date),                    // DateTimeDigitized
+			exifString(0x9011, m.Time.Format("-07:00")), // OffsetTimeOriginal
+		)
+	}
+
+	const headerLen = 8
+	ifd0 = append(ifd0, exifLongValue(0x8769, 0)) // ExifIFDPointer, set below
+	ifd0Len := ifdLen(ifd0)
+
+	// The EXIF IFD follows IFD0 and its values
+	exifOffset := uint32(headerLen + ifd0Len)
+	binary.BigEndian.PutUint32(ifd0[len(ifd0)-1].value, exifOffset)
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("MM\x00\x2A")
+	binary.Write(buf, binary.BigEndian, uint32(headerLen))
+	writeIFD(buf, ifd0, headerLen, 0)
+	writeIFD(buf, exif, exifOffset, 0)
+	return buf.Bytes()
+}
+
+// ifdLen returns the size of the directory including the values not
+// fitting into the entries
+func ifdLen(entries []exifEntry) int {
+	n := 2 + 12*len(entries) + 4
+	for _, e := range entries {
+		if len(e.value) > 4 {
+			n += len(e.value) + len(e.value)%2
+		}
+	}
+	return n
+}
+
+// writeIFD writes the directory located at offset linking to the one at
+// next (0 for the last), values larger than four bytes are stored after it
+func writeIFD(buf *bytes.Buffer, entries []exifEntry, offset, next uint32) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	values := new(bytes.Buffer)
+	valueOffset := offset + uint32(2+12*len(entries)+4)
+
+	binary.Write(buf, binary.BigEndian, uint16(len(entries)))
+	for _, e := range entries {
+		binary.Write(buf, binary.BigEndian, e.tag)
+		binary.Write(buf, binary.BigEndian, e.typ)
+		binary.Write(buf, binary.BigEndian, e.count)
+
+		if len(e.value) <= 4 {
+			v := make([]byte, 4)
+			copy(v, e.value)
+			buf.Write(v)
+			continue
+		}
+
+		binary.Write(buf, binary.BigEndian, valueOffset+uint32(values.Len()))
+		values.Write(e.value)
+		if len(e.value)%2 == 1 {
+			// Values start on word boundaries
+			values.WriteByte(0)
+		}
+	}
+	binary.Write(buf, binary.BigEndian, next)
+	buf.Write(values.Bytes())
+}
+
+// xmpPacket describes the metadata for tools reading XMP only
+func xmpPacket(m ImageMetadata) []byte {
+	attrs := new(bytes.Buffer)
+	attr := func(name, value string) {
+		if value == "" {
+			return
+		}
+		fmt.Fprintf(attrs, "\n  %s=\"", name)
+		xml.EscapeText(attrs, []byte(value))
+		attrs.WriteString(`"`)
+	}
+
+	if !m.Time.IsZero() {
+		date := m.Time.Format(time.RFC3339)
+		attr("xmp:CreateDate", date)
+		attr("exif:DateTimeOriginal", date)
+	}
+	attr("xmp:CreatorTool", m.Software)
+	attr("tiff:Make", m.Make)
+	attr("tiff:Model", m.Model)
+	if m.DPI > 0 {
+		attr("tiff:XResolution", fmt.Sprintf("%d/1", m.DPI))
+		attr("tiff:YResolution", fmt.Sprintf("%d/1", m.DPI))
+		attr("tiff:ResolutionUnit", "2")
+	}
+
+	return []byte(fmt.Sprintf(`<?xpacket begin="%s" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about=""
+  xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+  xmlns:tiff="http://ns.adobe.com/tiff/1.0/"
+  xmlns:exif="http://ns.adobe.com/exif/1.0/"%s/>
+</rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`, "\ufeff", attrs.String()))
+}
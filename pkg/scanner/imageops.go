@@ -0,0 +1,134 @@
+package scanner
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// ImageOps implements the expensive image operations of the
+// ImageProcessor so they can be provided by different libraries
+type ImageOps interface {
+	Rotate180(img image.Image) image.Image
+	// Fit scales the image to fit into width x height keeping its
+	// aspect ratio using a high quality filter
+	Fit(img image.Image, width, height int) image.Image
+	// Thumbnail scales the image to the given width using a fast filter
+	Thumbnail(img image.Image, width int) image.Image
+	Gray(img image.Image) *image.Gray
+	EncodeJPEG(w io.Writer, img image.Image, quality int) error
+}
+
+var imageOps = map[string]ImageOps{
+	"imaging": imagingOps{},
+}
+
+// RegisterImageOps makes an ImageOps implementation selectable by name
+func RegisterImageOps(name string, ops ImageOps) {
+	imageOps[name] = ops
+}
+
+// GetImageOps returns the implementation registered with the name
+func GetImageOps(name string) (ImageOps, error) {
+	ops, ok := imageOps[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown image backend %q (available: %s)", name, strings.Join(ImageOpsNames(), ", "))
+	}
+	return ops, nil
+}
+
+// ResampleFilterSetter is implemented by ImageOps able to scale with
+// another filter than their default (lanczos)
+type ResampleFilterSetter interface {
+	WithResampleFilter(name string) (ImageOps, error)
+}
+
+var resampleFilters = map[string]imaging.ResampleFilter{
+	"lanczos":    imaging.Lanczos,
+	"catmullrom": imaging.CatmullRom,
+	"linear":     imaging.Linear,
+	"box":        imaging.Box,
+	"nearest":    imaging.NearestNeighbor,
+}
+
+// ResampleFilterNames lists the filters Fit can scale the pages with
+func ResampleFilterNames() []string {
+	names := []string{}
+	for name := range resampleFilters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DefaultResampleFilter returns the filter for the architecture: the
+// slow CPUs of ARM boards take twice as long with Lanczos than with
+// CatmullRom while the difference is hardly visible for the usual 2:1
+// downscaling
+func DefaultResampleFilter() string {
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		return "lanczos"
+	default:
+		return "catmullrom"
+	}
+}
+
+// WithResampleFilter returns the ops scaling with the named filter
+func WithResampleFilter(ops ImageOps, name string) (ImageOps, error) {
+	if _, ok := resampleFilters[name]; !ok {
+		return nil, fmt.Errorf("Unknown resampling filter %q (available: %s)", name, strings.Join(ResampleFilterNames(), ", "))
+	}
+
+	s, ok := ops.(ResampleFilterSetter)
+	if !ok {
+		return nil, fmt.Errorf("The image backend does not support choosing the resampling filter")
+	}
+	return s.WithResampleFilter(name)
+}
+
+// ImageOpsNames lists the names of all registered implementations
+func ImageOpsNames() []string {
+	names := []string{}
+	for name := range imageOps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// imagingOps is the pure Go implementation available in every build,
+// it scales using Lanczos unless another filter is set
+type imagingOps struct {
+	filter string
+}
+
+func (imagingOps) Rotate180(img image.Image) image.Image { return imaging.Rotate180(img) }
+
+func (o imagingOps) Fit(img image.Image, width, height int) image.Image {
+	filter, ok := resampleFilters[o.filter]
+	if !ok {
+		filter = imaging.Lanczos
+	}
+	return imaging.Fit(img, width, height, filter)
+}
+
+func (imagingOps) WithResampleFilter(name string) (ImageOps, error) {
+	return imagingOps{filter: name}, nil
+}
+
+func (imagingOps) Thumbnail(img image.Image, width int) image.Image {
+	return imaging.Resize(img, width, 0, imaging.Box)
+}
+
+func (imagingOps) Gray(img image.Image) *image.Gray { return toGray(img) }
+
+func (imagingOps) EncodeJPEG(w io.Writer, img image.Image, quality int) error {
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+}
@@ -0,0 +1,239 @@
+//go:build vips
+// +build vips
+
+package scanner
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+// The vips operations are variadic which cgo is unable to call
+
+static int scansnap_rot180(VipsImage *in, VipsImage **out) {
+	return vips_rot(in, out, VIPS_ANGLE_D180, NULL);
+}
+
+static int scansnap_resize(VipsImage *in, VipsImage **out, double scale, int kernel) {
+	return vips_resize(in, out, scale, "kernel", (VipsKernel) kernel, NULL);
+}
+
+static int scansnap_gray(VipsImage *in, VipsImage **out) {
+	return vips_colourspace(in, out, VIPS_INTERPRETATION_B_W, NULL);
+}
+
+static int scansnap_jpegsave(VipsImage *in, void **buf, size_t *len, int quality) {
+	return vips_jpegsave_buffer(in, buf, len, "Q", quality, "strip", TRUE, NULL);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"runtime"
+	"unsafe"
+)
+
+// Build with "-tags vips" (requires libvips and its headers) to enable
+// the libvips backend which is considerably faster resizing and
+// encoding large pages
+func init() {
+	if C.vips_init(C.CString("scansnap-go")) != 0 {
+		panic("Unable to initialize libvips: " + vipsError())
+	}
+	// Pages are processed concurrently by the ImageProcessor already
+	C.vips_concurrency_set(1)
+	C.vips_cache_set_max(0)
+
+	RegisterImageOps("vips", vipsOps{})
+}
+
+// vipsOps scales using Lanczos unless another filter is set
+type vipsOps struct {
+	filter string
+}
+
+// vipsKernels are the kernels of the resampling filters: vips shrinks
+// by whole factors using a box filter before applying the kernel to the
+// rest, so box only needs the nearest pixel
+var vipsKernels = map[string]C.int{
+	"lanczos":    C.int(C.VIPS_KERNEL_LANCZOS3),
+	"catmullrom": C.int(C.VIPS_KERNEL_CUBIC),
+	"linear":     C.int(C.VIPS_KERNEL_LINEAR),
+	"box":        C.int(C.VIPS_KERNEL_NEAREST),
+	"nearest":    C.int(C.VIPS_KERNEL_NEAREST),
+}
+
+func (vipsOps) WithResampleFilter(name string) (ImageOps, error) {
+	return vipsOps{filter: name}, nil
+}
+
+func (vipsOps) Rotate180(img image.Image) image.Image {
+	return vipsApply(img, func(in *C.VipsImage, out **C.VipsImage) C.int {
+		return C.scansnap_rot180(in, out)
+	})
+}
+
+func (o vipsOps) Fit(img image.Image, width, height int) image.Image {
+	b := img.Bounds()
+	scale := float64(width) / float64(b.Dx())
+	if s := float64(height) / float64(b.Dy()); s < scale {
+		scale = s
+	}
+
+	kernel, ok := vipsKernels[o.filter]
+	if !ok {
+		kernel = C.int(C.VIPS_KERNEL_LANCZOS3)
+	}
+
+	return vipsApply(img, func(in *C.VipsImage, out **C.VipsImage) C.int {
+		return C.scansnap_resize(in, out, C.double(scale), kernel)
+	})
+}
+
+func (vipsOps) Thumbnail(img image.Image, width int) image.Image {
+	scale := float64(width) / float64(img.Bounds().Dx())
+
+	return vipsApply(img, func(in *C.VipsImage, out **C.VipsImage) C.int {
+		return C.scansnap_resize(in, out, C.double(scale), C.int(C.VIPS_KERNEL_LINEAR))
+	})
+}
+
+func (vipsOps) Gray(img image.Image) *image.Gray {
+	if g, ok := img.(*image.Gray); ok {
+		return g
+	}
+
+	out := vipsApply(img, func(in *C.VipsImage, out **C.VipsImage) C.int {
+		return C.scansnap_gray(in, out)
+	})
+	if g, ok := out.(*image.Gray); ok {
+		return g
+	}
+	// Operation failed and returned the input
+	return toGray(out)
+}
+
+func (vipsOps) EncodeJPEG(w io.Writer, img image.Image, quality int) error {
+	in, err := vipsFromImage(img)
+	if err != nil {
+		return err
+	}
+	defer C.g_object_unref(C.gpointer(in))
+
+	var (
+		buf unsafe.Pointer
+		n   C.size_t
+	)
+	if C.scansnap_jpegsave(in, &buf, &n, C.int(quality)) != 0 {
+		return fmt.Errorf("Unable to encode JPEG: %s", vipsError())
+	}
+	defer C.g_free(C.gpointer(buf))
+
+	_, err = w.Write(C.GoBytes(buf, C.int(n)))
+	return err
+}
+
+// vipsApply executes the operation on the image. As the interface does
+// not allow to report errors the input image is returned unchanged if
+// the operation fails.
+func vipsApply(img image.Image, op func(in *C.VipsImage, out **C.VipsImage) C.int) image.Image {
+	in, err := vipsFromImage(img)
+	if err != nil {
+		return img
+	}
+	defer C.g_object_unref(C.gpointer(in))
+
+	var out *C.VipsImage
+	if op(in, &out) != 0 {
+		C.vips_error_clear()
+		return img
+	}
+	defer C.g_object_unref(C.gpointer(out))
+
+	res, err := vipsToImage(out)
+	if err != nil {
+		return img
+	}
+	return res
+}
+
+// vipsFromImage copies the pixels into a new 8-bit gray or RGB vips
+// image
+func vipsFromImage(img image.Image) (*C.VipsImage, error) {
+	var (
+		b     = img.Bounds()
+		w, h  = b.Dx(), b.Dy()
+		bands int
+		pix   []byte
+	)
+
+	if g, ok := img.(*image.Gray); ok {
+		bands, pix = 1, make([]byte, w*h)
+		for y := 0; y < h; y++ {
+			copy(pix[y*w:(y+1)*w], g.Pix[y*g.Stride:y*g.Stride+w])
+		}
+	} else {
+		rgba, ok := img.(*image.RGBA)
+		if !ok || rgba.Rect.Min != (image.Point{}) {
+			rgba = image.NewRGBA(image.Rect(0, 0, w, h))
+			draw.Draw(rgba, rgba.Rect, img, b.Min, draw.Src)
+		}
+
+		bands, pix = 3, make([]byte, w*h*3)
+		for y := 0; y < h; y++ {
+			row := rgba.Pix[y*rgba.Stride:]
+			for x := 0; x < w; x++ {
+				copy(pix[(y*w+x)*3:], row[x*4:x*4+3])
+			}
+		}
+	}
+
+	vi := C.vips_image_new_from_memory_copy(unsafe.Pointer(&pix[0]), C.size_t(len(pix)),
+		C.int(w), C.int(h), C.int(bands), C.VIPS_FORMAT_UCHAR)
+	runtime.KeepAlive(pix)
+	if vi == nil {
+		return nil, fmt.Errorf("Unable to create vips image: %s", vipsError())
+	}
+	return vi, nil
+}
+
+// vipsToImage copies the pixels of an 8-bit gray or RGB vips image
+func vipsToImage(vi *C.VipsImage) (image.Image, error) {
+	var (
+		w, h  = int(vi.Xsize), int(vi.Ysize)
+		bands = int(vi.Bands)
+		n     C.size_t
+	)
+
+	if vi.BandFmt != C.VIPS_FORMAT_UCHAR || (bands != 1 && bands != 3) {
+		return nil, fmt.Errorf("Unsupported vips image format (%d bands)", bands)
+	}
+
+	mem := C.vips_image_write_to_memory(vi, &n)
+	if mem == nil {
+		return nil, fmt.Errorf("Unable to read vips image: %s", vipsError())
+	}
+	defer C.g_free(C.gpointer(mem))
+	pix := C.GoBytes(mem, C.int(n))
+
+	if bands == 1 {
+		return &image.Gray{Pix: pix, Stride: w, Rect: image.Rect(0, 0, w, h)}, nil
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < w*h; i++ {
+		copy(out.Pix[i*4:], pix[i*3:i*3+3])
+		out.Pix[i*4+3] = 0xff
+	}
+	return out, nil
+}
+
+func vipsError() string {
+	msg := C.GoString(C.vips_error_buffer())
+	C.vips_error_clear()
+	return msg
+}
@@ -0,0 +1,169 @@
+package scanner
+
+import (
+	"fmt"
+	"math"
+)
+
+// whitenStep stretches the levels of every channel so the paper becomes
+// white, which also removes the color cast of colored or aged paper
+type whitenStep struct {
+	// white is the level mapped to white (0 = estimate the paper color
+	// per channel), black the one mapped to black
+	white, black int
+	// gamma > 1 darkens the mid tones (faint text), < 1 brightens them
+	gamma float64
+}
+
+func newWhitenStep(o StepOptions) (Step, error) {
+	var (
+		w   whitenStep
+		err error
+	)
+
+	if w.white, err = o.Int("white", 0); err != nil {
+		return nil, err
+	}
+	if w.black, err = o.Int("black", 0); err != nil {
+		return nil, err
+	}
+	if w.gamma, err = o.Float("gamma", 1); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case w.white < 0 || w.white > 255 || w.black < 0 || w.black > 255:
+		return nil, fmt.Errorf("white and black must be between 0 and 255")
+	case w.white != 0 && w.white <= w.black:
+		return nil, fmt.Errorf("white must be above black")
+	case w.gamma < 0.1 || w.gamma > 10:
+		return nil, fmt.Errorf("gamma must be between 0.1 and 10")
+	}
+
+	return w, nil
+}
+
+func (w whitenStep) Apply(p *StepPage) error {
+	planes := splitPlanes(p.Image)
+	if planes.bilevel {
+		return nil
+	}
+
+	white := make([]int, len(planes.planes))
+	for i := range white {
+		white[i] = w.white
+	}
+	if w.white == 0 {
+		var ok bool
+		if white, ok = estimatePaper(planes); !ok {
+			// Mostly dark pages (photos) have no paper to adjust to
+			return nil
+		}
+	}
+
+	for i, plane := range planes.planes {
+		if white[i] <= w.black {
+			continue
+		}
+
+		var lut [256]uint8
+		for v := range lut {
+			n := math.Max(0, math.Min(1, float64(v-w.black)/float64(white[i]-w.black)))
+			lut[v] = uint8(math.Round(255 * math.Pow(n, w.gamma)))
+		}
+		for j, v := range plane {
+			plane[j] = lut[v]
+		}
+	}
+
+	p.Image = planes.image()
+	return nil
+}
+
+// estimatePaper returns the white point per channel: paper is the
+// brighter half of the page, its darkest quarter is mapped to white so
+// most of its texture and noise disappears
+func estimatePaper(planes *imagePlanes) ([]int, bool) {
+	var (
+		n    = planes.w * planes.h
+		lum  = planes.planes[0]
+		hist [256]int
+	)
+
+	if len(planes.planes) == 3 {
+		lum = make([]uint8, n)
+		for i := range lum {
+			lum[i] = uint8((299*int(planes.planes[0][i]) + 587*int(planes.planes[1][i]) + 114*int(planes.planes[2][i])) / 1000)
+		}
+	}
+
+	for _, v := range lum {
+		hist[v]++
+	}
+	median, count := 0, 0
+	for ; median < 255 && count+hist[median] <= n/2; median++ {
+		count += hist[median]
+	}
+	if median < 128 {
+		return nil, false
+	}
+
+	white := make([]int, len(planes.planes))
+	for c, plane := range planes.planes {
+		var (
+			paper [256]int
+			total int
+		)
+		for i, v := range plane {
+			if int(lum[i]) >= median {
+				paper[v]++
+				total++
+			}
+		}
+
+		level, count := 0, 0
+		for ; level < 255 && count+paper[level] <= total/4; level++ {
+			count += paper[level]
+		}
+		white[c] = level
+	}
+
+	return white, true
+}
+
+// contrastStep changes the contrast by percent (-100 to 100) around the
+// mid gray
+type contrastStep struct{ percent float64 }
+
+func newContrastStep(o StepOptions) (Step, error) {
+	percent, err := o.Float("percent", 0)
+	if err != nil {
+		return nil, err
+	}
+	if percent == 0 || percent < -100 || percent > 100 {
+		return nil, fmt.Errorf("percent must be between -100 and 100 and not 0")
+	}
+	return contrastStep{percent}, nil
+}
+
+func (c contrastStep) Apply(p *StepPage) error {
+	planes := splitPlanes(p.Image)
+	if planes.bilevel {
+		return nil
+	}
+
+	var lut [256]uint8
+	for v := range lut {
+		n := (float64(v)/255-0.5)*(1+c.percent/100) + 0.5
+		lut[v] = uint8(math.Round(255 * math.Max(0, math.Min(1, n))))
+	}
+
+	for _, plane := range planes.planes {
+		for j, v := range plane {
+			plane[j] = lut[v]
+		}
+	}
+
+	p.Image = planes.image()
+	return nil
+}
@@ -0,0 +1,86 @@
+package scanner
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestWhitenPaper(t *testing.T) {
+	// Aged paper with a text block covering less than half of the page
+	img := image.NewRGBA(image.Rect(0, 0, 40, 40))
+	fillRect(img, img.Bounds(), color.RGBA{230, 220, 180, 0xff})
+	fillRect(img, image.Rect(5, 5, 35, 15), color.RGBA{40, 40, 40, 0xff})
+
+	page := &StepPage{Image: img, DPI: 100, OutputDPI: 100, Ops: imagingOps{}}
+	if err := mustParsePipeline(t, "whiten").Apply(page); err != nil {
+		t.Fatalf("applying step: %s", err)
+	}
+
+	out := page.Image.(*image.NRGBA)
+	if c := out.NRGBAAt(20, 30); c != (color.NRGBA{0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("expected the paper white, got %v", c)
+	}
+	// The color cast is removed from the text as well: blue is stretched
+	// more than red
+	if c := out.NRGBAAt(20, 10); c.R > 60 || c.B < c.R {
+		t.Errorf("expected the text dark, got %v", c)
+	}
+}
+
+func TestWhitenLevels(t *testing.T) {
+	for spec, exp := range map[string]map[uint8]uint8{
+		"whiten white=200 black=50":         {0: 0, 50: 0, 125: 128, 200: 255, 230: 255},
+		"whiten white=200 black=50 gamma=2": {50: 0, 125: 64, 200: 255},
+		"whiten white=128":                  {0: 0, 64: 128, 128: 255},
+	} {
+		t.Run(spec, func(t *testing.T) {
+			img := image.NewGray(image.Rect(0, 0, 256, 1))
+			for x := range img.Pix {
+				img.Pix[x] = uint8(x)
+			}
+			page := &StepPage{Image: img, DPI: 100, OutputDPI: 100, Ops: imagingOps{}}
+			if err := mustParsePipeline(t, spec).Apply(page); err != nil {
+				t.Fatalf("applying step: %s", err)
+			}
+
+			out := page.Image.(*image.Gray)
+			for in, v := range exp {
+				if got := out.Pix[in]; got != v {
+					t.Errorf("expected %d mapped to %d, got %d", in, v, got)
+				}
+			}
+		})
+	}
+}
+
+func TestWhitenUnchanged(t *testing.T) {
+	photo := image.NewGray(image.Rect(0, 0, 20, 20))
+	fillRect(photo, photo.Bounds(), color.Gray{Y: 60})
+	fillRect(photo, image.Rect(0, 0, 20, 5), color.Gray{Y: 230})
+	bilevel := image.NewPaletted(image.Rect(0, 0, 20, 20), bilevelPalette)
+
+	for name, img := range map[string]image.Image{"dark page": photo, "bilevel": bilevel} {
+		page := &StepPage{Image: img, DPI: 100, OutputDPI: 100, Ops: imagingOps{}}
+		if err := mustParsePipeline(t, "whiten").Apply(page); err != nil {
+			t.Fatalf("%s: applying step: %s", name, err)
+		}
+		if page.Image != img {
+			t.Errorf("%s: expected the page unchanged", name)
+		}
+	}
+}
+
+func TestWhitenOptions(t *testing.T) {
+	for _, spec := range []string{
+		"whiten white=256",
+		"whiten black=-1",
+		"whiten white=50 black=50",
+		"whiten gamma=0",
+		"whiten gamma=11",
+	} {
+		if _, err := ParsePipeline(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
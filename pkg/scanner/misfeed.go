@@ -0,0 +1,100 @@
+package scanner
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// Width the page is reduced to before estimating its skew
+	skewAnalysisWidth = 400
+	// Pages with less dark pixels than this ratio carry too little
+	// content to estimate the skew from
+	skewMinInkRatio = 0.005
+	// Maximum skew angle (degrees) and step size to try
+	skewMaxAngle  = 6.0
+	skewAngleStep = 0.25
+	// Pages longer than the configured page height by this factor are
+	// likely two sheets overlapping each other
+	overlapLengthFactor = 1.02
+)
+
+// detectMisfeed checks a page for the typical artifacts of sheets fed
+// while stapled or stuck together: a strong skew of the content or a
+// page length exceeding the physical page size and, if corners is set,
+// a folded corner. The image is scanned at scanDPI. An empty string is
+// returned for pages looking fine.
+func detectMisfeed(img image.Image, scanDPI int, skewThreshold, pageHeight float64, corners bool) string {
+	if skewThreshold > 0 {
+		heightMM := float64(img.Bounds().Dy()) * 25.4 / float64(scanDPI)
+		if pageHeight > 0 && heightMM > pageHeight*overlapLengthFactor {
+			return fmt.Sprintf("page length %.0fmm exceeds page height %.0fmm", heightMM, pageHeight)
+		}
+
+		if skew, ok := estimateSkew(img); ok && math.Abs(skew) >= skewThreshold {
+			return fmt.Sprintf("content skewed by %.1f°", skew)
+		}
+	}
+
+	if corners {
+		if corner, size, ok := detectFoldedCorner(img, scanDPI); ok {
+			return fmt.Sprintf("%s corner folded or stapled (%.0fmm)", corner, size)
+		}
+	}
+
+	return ""
+}
+
+// estimateSkew determines the angle (in degrees) at which the rows of
+// dark pixels (text lines) line up best using a projection profile
+func estimateSkew(img image.Image) (float64, bool) {
+	small := imaging.Grayscale(imaging.Resize(img, skewAnalysisWidth, 0, imaging.Box))
+	b := small.Bounds()
+
+	type point struct{ x, y float64 }
+	ink := []point{}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			// Grayscale sets R = G = B
+			if small.Pix[small.PixOffset(x, y)] < 128 {
+				ink = append(ink, point{float64(x), float64(y)})
+			}
+		}
+	}
+
+	if float64(len(ink)) < float64(b.Dx()*b.Dy())*skewMinInkRatio {
+		return 0, false
+	}
+
+	var (
+		bestAngle float64
+		bestScore float64
+		offset    = float64(b.Dx()) * math.Tan(skewMaxAngle*math.Pi/180)
+		bins      = make([]float64, b.Dy()+2*int(offset)+2)
+	)
+
+	for angle := -skewMaxAngle; angle <= skewMaxAngle; angle += skewAngleStep {
+		for i := range bins {
+			bins[i] = 0
+		}
+
+		tan := math.Tan(angle * math.Pi / 180)
+		for _, p := range ink {
+			bins[int(p.y-p.x*tan+offset)]++
+		}
+
+		var score float64
+		for _, v := range bins {
+			score += v * v
+		}
+
+		if score > bestScore {
+			bestScore, bestAngle = score, angle
+		}
+	}
+
+	return bestAngle, true
+}
@@ -0,0 +1,62 @@
+package scanner
+
+import (
+	"fmt"
+	"sort"
+)
+
+// AppliedOption is an option of the job with the value requested and
+// the one the device uses. Inexact is set if the backend adjusted the
+// value, ReloadOptions if setting it changed other options. Adjusted is
+// set if the effective value differs from the requested one.
+type AppliedOption struct {
+	Name          string      `json:"name"`
+	Requested     interface{} `json:"requested"`
+	Effective     interface{} `json:"effective,omitempty"`
+	Inexact       bool        `json:"inexact,omitempty"`
+	ReloadOptions bool        `json:"reload_options,omitempty"`
+	Adjusted      bool        `json:"adjusted,omitempty"`
+	Error         string      `json:"error,omitempty"`
+}
+
+// OptionReporter is implemented by observers interested in how the
+// device took the options of the job, it is called before Started
+type OptionReporter interface {
+	OptionsApplied(opts []AppliedOption)
+}
+
+// sameOptionValue compares option values, numbers (fixed options are
+// requested as int and read as float64) by their value
+func sameOptionValue(a, b interface{}) bool {
+	fa, okA := numericOptionValue(a)
+	fb, okB := numericOptionValue(b)
+	if okA && okB {
+		return fa == fb
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func numericOptionValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// sortedOptionNames returns the names of the options in a stable order
+func sortedOptionNames(opts map[string]interface{}) []string {
+	names := make([]string, 0, len(opts))
+	for name := range opts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,378 @@
+package scanner
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/Luzifer/scansnap-go/pkg/pdfgen"
+)
+
+// DefaultPipeline matches the processing before pipelines were
+// configurable: the pages are only scaled to the output resolution
+const DefaultPipeline = "resize"
+
+var defaultPipeline = Pipeline{{Name: "resize", Step: resizeStep{}}}
+
+// StepPage is the page passed through the steps of a pipeline
+type StepPage struct {
+	// Index is the position of the page in the scanned batch (0-based)
+	Index int
+	// Back is set for the back sides of duplex sheets
+	Back  bool
+	Image image.Image
+	// DPI is the resolution of Image, OutputDPI the one requested for
+	// the document
+	DPI, OutputDPI int
+	Ops            ImageOps
+	// Text is drawn over the page in the PDF
+	Text []pdfgen.Text
+	// Words are recognized on the page by an OCR step
+	Words []Word
+	// ActualSize makes the PDF page the size of the image at DPI instead
+	// of scaling it to the width of an A4 page, set by steps changing the
+	// size of the page like crop
+	ActualSize bool
+	// Layout places the page on an A4 page unless it is shown at its
+	// ActualSize
+	Layout pdfgen.Layout
+}
+
+// Word is a word recognized on the page, Box is given in pixels of the
+// page image and Line numbers the lines of the page in reading order
+type Word struct {
+	Text       string          `json:"text"`
+	Confidence float64         `json:"confidence"`
+	Box        image.Rectangle `json:"box"`
+	Line       int             `json:"line"`
+}
+
+// sizePt returns the size of the page image in the PDF in points
+func (p *StepPage) sizePt() (float64, float64) {
+	b := p.Image.Bounds()
+	if p.ActualSize {
+		return float64(b.Dx()) * 72 / float64(p.DPI), float64(b.Dy()) * 72 / float64(p.DPI)
+	}
+	_, _, w, h := p.Layout.Place(b.Dx(), b.Dy(), p.DPI)
+	return w, h
+}
+
+// Step is a single operation of a pipeline modifying the page
+type Step interface {
+	Apply(p *StepPage) error
+}
+
+// StepFactory creates a step from the options given in the pipeline
+type StepFactory func(opts StepOptions) (Step, error)
+
+var stepFactories = map[string]StepFactory{
+	"binarize":    newBinarizeStep,
+	"clean-edges": newCleanEdgesStep,
+	"contrast":    newContrastStep,
+	"crop":        newCropStep,
+	"denoise":     newDenoiseStep,
+	"deskew":      newDeskewStep,
+	"despeckle":   newDespeckleStep,
+	"dropout":     newDropoutStep,
+	"fill-holes":  newFillHolesStep,
+	"median":      newMedianStep,
+	"resize":      newResizeStep,
+	"rotate":      newRotateStep,
+	"sharpen":     newSharpenStep,
+	"stamp":       newStampStep,
+	"watermark":   newWatermarkStep,
+	"whiten":      newWhitenStep,
+}
+
+// RegisterStep makes a step usable in pipelines by name
+func RegisterStep(name string, factory StepFactory) {
+	stepFactories[name] = factory
+}
+
+// StepNames lists the names of all registered steps
+func StepNames() []string {
+	names := []string{}
+	for name := range stepFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StepOptions are the options of a step in the pipeline, options not
+// read by the factory are reported as unknown
+type StepOptions struct {
+	values map[string]string
+	used   map[string]bool
+}
+
+// String returns the option or def if not given
+func (s StepOptions) String(name, def string) string {
+	s.used[name] = true
+	if v, ok := s.values[name]; ok {
+		return v
+	}
+	return def
+}
+
+// Int returns the option parsed as integer or def if not given
+func (s StepOptions) Int(name string, def int) (int, error) {
+	v := s.String(name, "")
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer %q for option %q", v, name)
+	}
+	return i, nil
+}
+
+// Float returns the option parsed as float or def if not given
+func (s StepOptions) Float(name string, def float64) (float64, error) {
+	v := s.String(name, "")
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q for option %q", v, name)
+	}
+	return f, nil
+}
+
+func (s StepOptions) unused() []string {
+	names := []string{}
+	for name := range s.values {
+		if !s.used[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Pipeline is the ordered list of steps applied to every page
+type Pipeline []PipelineStep
+
+// PipelineStep is a step of the pipeline together with its name for
+// error messages and the options it was created with
+type PipelineStep struct {
+	Name    string
+	Options map[string]string
+	Step
+}
+
+// String returns the step as given in a pipeline description, options
+// sorted by name
+func (p PipelineStep) String() string {
+	names := []string{}
+	for name := range p.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := []string{p.Name}
+	for _, name := range names {
+		fields = append(fields, name+"="+quotePipelineValue(p.Options[name]))
+	}
+	return strings.Join(fields, " ")
+}
+
+func quotePipelineValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, " \t\r\n,\"\\") {
+		return v
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
+
+// String returns the description of the pipeline, parsing it results in
+// the same pipeline
+func (p Pipeline) String() string {
+	steps := []string{}
+	for _, s := range p {
+		steps = append(steps, s.String())
+	}
+	return strings.Join(steps, ", ")
+}
+
+// Contains reports whether the pipeline has a step with the name
+func (p Pipeline) Contains(name string) bool {
+	for _, s := range p {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply runs all steps on the page
+func (p Pipeline) Apply(page *StepPage) error {
+	for _, s := range p {
+		if err := s.Apply(page); err != nil {
+			return fmt.Errorf("Step %s failed: %s", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// ParsePipeline creates the pipeline from its description: the steps
+// are separated by commas and followed by their options, values
+// containing spaces or commas are quoted:
+//
+//	deskew, rotate angle=90 pages=back, resize dpi=200, stamp text="Received {{.Date}}"
+func ParsePipeline(spec string) (Pipeline, error) {
+	tokens, err := splitPipeline(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline := Pipeline{}
+	for _, step := range tokens {
+		if len(step) == 0 {
+			continue
+		}
+
+		s, err := parseStep(step)
+		if err != nil {
+			return nil, err
+		}
+		pipeline = append(pipeline, s)
+	}
+
+	return pipeline, nil
+}
+
+// Override changes single steps of the pipeline: steps prefixed with
+// "-" are removed, other steps replace the step of the same name or are
+// appended if the pipeline does not contain it:
+//
+//	-despeckle, ocr lang=fra, deskew
+func (p Pipeline) Override(spec string) (Pipeline, error) {
+	tokens, err := splitPipeline(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline := append(Pipeline{}, p...)
+	for _, step := range tokens {
+		if len(step) == 0 {
+			continue
+		}
+
+		if name := strings.TrimPrefix(step[0], "-"); name != step[0] {
+			if _, ok := stepFactories[name]; !ok {
+				return nil, fmt.Errorf("Unknown processing step %q (available: %s)", name, strings.Join(StepNames(), ", "))
+			}
+			if len(step) > 1 {
+				return nil, fmt.Errorf("Step %q to remove can not have options", name)
+			}
+
+			kept := Pipeline{}
+			for _, s := range pipeline {
+				if s.Name != name {
+					kept = append(kept, s)
+				}
+			}
+			pipeline = kept
+			continue
+		}
+
+		s, err := parseStep(step)
+		if err != nil {
+			return nil, err
+		}
+
+		replaced := false
+		for i := range pipeline {
+			if pipeline[i].Name == s.Name {
+				pipeline[i], replaced = s, true
+			}
+		}
+		if !replaced {
+			pipeline = append(pipeline, s)
+		}
+	}
+
+	return pipeline, nil
+}
+
+// parseStep creates the step from its name followed by its options
+func parseStep(step []string) (PipelineStep, error) {
+	name := step[0]
+	factory, ok := stepFactories[name]
+	if !ok {
+		return PipelineStep{}, fmt.Errorf("Unknown processing step %q (available: %s)", name, strings.Join(StepNames(), ", "))
+	}
+
+	opts := StepOptions{values: map[string]string{}, used: map[string]bool{}}
+	for _, o := range step[1:] {
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return PipelineStep{}, fmt.Errorf("Invalid option %q for step %q, expected name=value", o, name)
+		}
+		opts.values[kv[0]] = kv[1]
+	}
+
+	s, err := factory(opts)
+	if err != nil {
+		return PipelineStep{}, fmt.Errorf("Invalid step %q: %s", name, err)
+	}
+	if unknown := opts.unused(); len(unknown) > 0 {
+		return PipelineStep{}, fmt.Errorf("Unknown option(s) %s for step %q", strings.Join(unknown, ", "), name)
+	}
+
+	return PipelineStep{Name: name, Options: opts.values, Step: s}, nil
+}
+
+// splitPipeline splits the description into steps and their fields,
+// double quotes protect spaces and commas and are removed
+func splitPipeline(spec string) ([][]string, error) {
+	var (
+		steps   = [][]string{{}}
+		field   strings.Builder
+		inField bool
+		quoted  bool
+		escaped bool
+	)
+
+	endField := func() {
+		if inField {
+			steps[len(steps)-1] = append(steps[len(steps)-1], field.String())
+		}
+		field.Reset()
+		inField = false
+	}
+
+	for _, r := range spec {
+		switch {
+		case escaped:
+			field.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted, inField = !quoted, true
+		case quoted:
+			field.WriteRune(r)
+		case r == ',':
+			endField()
+			steps = append(steps, []string{})
+		case unicode.IsSpace(r):
+			endField()
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+
+	if quoted {
+		return nil, fmt.Errorf("Unterminated quote in pipeline %q", spec)
+	}
+	endField()
+
+	return steps, nil
+}
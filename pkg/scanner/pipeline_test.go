@@ -0,0 +1,157 @@
+package scanner
+
+import (
+	"errors"
+	"image"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testPage returns a page of w x h white pixels scanned at 100 dpi
+func testPage(w, h int) *StepPage {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	return &StepPage{Image: img, DPI: 100, OutputDPI: 100, Ops: imagingOps{}}
+}
+
+// mustParsePipeline parses the pipeline description or fails the test
+func mustParsePipeline(t *testing.T, spec string) Pipeline {
+	t.Helper()
+
+	p, err := ParsePipeline(spec)
+	if err != nil {
+		t.Fatalf("parsing pipeline %q: %s", spec, err)
+	}
+	return p
+}
+
+func TestParsePipeline(t *testing.T) {
+	for spec, tc := range map[string]struct {
+		steps []string
+		err   string
+	}{
+		"":                  {[]string{}, ""},
+		"resize":            {[]string{"resize"}, ""},
+		" deskew ,, resize": {[]string{"deskew", "resize"}, ""},
+		"rotate angle=90 pages=back, resize dpi=200":    {[]string{"rotate angle=90 pages=back", "resize dpi=200"}, ""},
+		`stamp text="Received, {{.Date}}" position=top`: {[]string{`stamp position=top text="Received, {{.Date}}"`}, ""},
+		`stamp text="say \"hi\""`:                       {[]string{`stamp text="say \"hi\""`}, ""},
+
+		"unknown":                  {nil, `Unknown processing step "unknown"`},
+		"resize dpi":               {nil, `Invalid option "dpi" for step "resize"`},
+		"resize =200":              {nil, `Invalid option "=200" for step "resize"`},
+		"resize dpi=high":          {nil, `Invalid step "resize": invalid integer "high"`},
+		"resize dpi=-1":            {nil, `Invalid step "resize": dpi must not be negative`},
+		"resize dpi=200 size=a4":   {nil, `Unknown option(s) size for step "resize"`},
+		"rotate angle=45":          {nil, `Invalid step "rotate": angle must be 90, 180 or 270`},
+		"rotate angle=90 pages=1":  {nil, `Invalid step "rotate": invalid pages "1"`},
+		`stamp text="unterminated`: {nil, "Unterminated quote"},
+	} {
+		t.Run(spec, func(t *testing.T) {
+			p, err := ParsePipeline(spec)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsing pipeline: %s", err)
+			}
+
+			steps := []string{}
+			for _, s := range p {
+				steps = append(steps, s.String())
+			}
+			if !reflect.DeepEqual(steps, tc.steps) {
+				t.Errorf("expected steps %q, got %q", tc.steps, steps)
+			}
+
+			// The description parses to the same pipeline
+			if again := mustParsePipeline(t, p.String()); again.String() != p.String() {
+				t.Errorf("expected %q to round trip, got %q", p.String(), again.String())
+			}
+		})
+	}
+}
+
+func TestPipelineOverride(t *testing.T) {
+	base := mustParsePipeline(t, "deskew, despeckle size=3, resize")
+
+	for spec, tc := range map[string]struct {
+		exp string
+		err string
+	}{
+		"":                  {"deskew, despeckle size=3, resize", ""},
+		"-despeckle":        {"deskew, resize", ""},
+		"despeckle size=1":  {"deskew, despeckle size=1, resize", ""},
+		"binarize, -deskew": {"despeckle size=3, resize, binarize", ""},
+		"-crop":             {"deskew, despeckle size=3, resize", ""},
+		"-unknown":          {"", `Unknown processing step "unknown"`},
+		"-despeckle size=1": {"", `Step "despeckle" to remove can not have options`},
+		"despeckle size=0":  {"", `Invalid step "despeckle"`},
+	} {
+		t.Run(spec, func(t *testing.T) {
+			p, err := base.Override(spec)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("overriding pipeline: %s", err)
+			}
+			if p.String() != tc.exp {
+				t.Errorf("expected %q, got %q", tc.exp, p.String())
+			}
+		})
+	}
+
+	if base.String() != "deskew, despeckle size=3, resize" {
+		t.Errorf("override modified the base pipeline: %q", base.String())
+	}
+}
+
+func TestPipelineApply(t *testing.T) {
+	p := mustParsePipeline(t, "rotate angle=90 pages=back, resize dpi=50")
+
+	for name, back := range map[string]bool{"front": false, "back": true} {
+		t.Run(name, func(t *testing.T) {
+			page := testPage(40, 60)
+			page.Back = back
+			if err := p.Apply(page); err != nil {
+				t.Fatalf("applying pipeline: %s", err)
+			}
+
+			exp := image.Pt(20, 30)
+			if back {
+				exp = image.Pt(30, 20)
+			}
+			if size := page.Image.Bounds().Size(); size != exp || page.DPI != 50 {
+				t.Errorf("expected %v at 50 dpi, got %v at %d dpi", exp, size, page.DPI)
+			}
+		})
+	}
+
+	if !p.Contains("resize") || p.Contains("deskew") {
+		t.Errorf("Contains does not match the steps of %q", p.String())
+	}
+}
+
+func TestPipelineApplyError(t *testing.T) {
+	RegisterStep("test-fail", func(o StepOptions) (Step, error) { return failingStep{}, nil })
+	defer delete(stepFactories, "test-fail")
+
+	err := mustParsePipeline(t, "resize, test-fail").Apply(testPage(10, 10))
+	if err == nil || err.Error() != "Step test-fail failed: broken page" {
+		t.Errorf("expected the error to name the step, got %v", err)
+	}
+}
+
+type failingStep struct{}
+
+func (failingStep) Apply(p *StepPage) error { return errors.New("broken page") }
@@ -0,0 +1,232 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"strings"
+	"sync"
+)
+
+// PoolMember is one of the devices of a Pool
+type PoolMember struct {
+	// Name selects the member using Job.Device, the SANE name of the
+	// device it scans with is accepted too
+	Name    string
+	Scanner *SANE
+	// Options replace the options of the jobs executed on the member,
+	// e.g. options only known to some of the models
+	Options map[string]interface{}
+
+	busy bool
+}
+
+// Pool dispatches jobs to several devices: jobs naming a member are
+// executed on it, all others on the first idle member. Jobs wait for
+// a member to become idle.
+type Pool struct {
+	Members []*PoolMember
+
+	lock sync.Mutex
+	// released is closed and replaced whenever a member becomes idle
+	released chan struct{}
+}
+
+// Scan implements Scanner
+func (p *Pool) Scan(job Job, out chan<- image.Image) error {
+	m, err := p.acquire(job)
+	if err != nil {
+		close(out)
+		return err
+	}
+	defer p.release(m)
+
+	opts := map[string]interface{}{}
+	for k, v := range job.Options {
+		opts[k] = v
+	}
+	for k, v := range m.Options {
+		opts[k] = v
+	}
+	job.Options = opts
+	// The member scans with the device it is configured for
+	job.Device = ""
+
+	return m.Scanner.Scan(job, out)
+}
+
+// DeviceOptions implements DeviceDescriber with the options of the
+// first member
+func (p *Pool) DeviceOptions() (DeviceCapabilities, error) {
+	if len(p.Members) == 0 {
+		return DeviceCapabilities{}, UnavailableError("No scanners configured")
+	}
+	return p.Members[0].Scanner.DeviceOptions()
+}
+
+// ValidateOptions implements OptionValidator with the member named by
+// the job or the first one, the options of the member are applied
+func (p *Pool) ValidateOptions(job Job) (OptionReport, error) {
+	if len(p.Members) == 0 {
+		return OptionReport{}, UnavailableError("No scanners configured")
+	}
+
+	m := p.Members[0]
+	if job.Device != "" {
+		p.lock.Lock()
+		named, err := p.pick(job.Device)
+		p.lock.Unlock()
+		if err != nil {
+			return OptionReport{}, err
+		}
+		if named == nil {
+			return OptionReport{}, ErrBusy
+		}
+		m = named
+	}
+
+	opts := map[string]interface{}{}
+	for k, v := range job.Options {
+		opts[k] = v
+	}
+	for k, v := range m.Options {
+		opts[k] = v
+	}
+	job.Options = opts
+	job.Device = ""
+
+	return m.Scanner.ValidateOptions(job)
+}
+
+// Ping implements Pinger with all idle members
+func (p *Pool) Ping() error {
+	var errs []string
+	for _, m := range p.Members {
+		if err := m.Scanner.Ping(); err != nil && err != ErrBusy {
+			errs = append(errs, fmt.Sprintf("%s: %s", m.Name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Unable to reach scanners: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Sleep implements PowerController with all idle members, members in
+// use stay awake
+func (p *Pool) Sleep() error {
+	return p.power(func(s *SANE) error {
+		if err := s.Sleep(); err != ErrBusy {
+			return err
+		}
+		return nil
+	})
+}
+
+// Wake implements PowerController with all members
+func (p *Pool) Wake(options map[string]interface{}) error {
+	return p.power(func(s *SANE) error { return s.Wake(options) })
+}
+
+func (p *Pool) power(fn func(s *SANE) error) error {
+	var errs []string
+	for _, m := range p.Members {
+		if err := fn(m.Scanner); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", m.Name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Unable to change power state of scanners: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Exclusive executes fn while no member is scanning with all their
+// devices closed. SANE is initialized again with a changed
+// configuration only if nothing else keeps it initialized.
+func (p *Pool) Exclusive(fn func() error) error {
+	return p.ExclusiveContext(context.Background(), fn)
+}
+
+// ExclusiveContext is Exclusive giving up waiting for the devices once
+// ctx is done
+func (p *Pool) ExclusiveContext(ctx context.Context, fn func() error) error {
+	for _, m := range p.Members {
+		if err := m.Scanner.lockContext(ctx); err != nil {
+			return err
+		}
+		defer m.Scanner.lock.Unlock()
+
+		m.Scanner.closeConn()
+	}
+	return fn()
+}
+
+// acquire reserves the member named by the job or the first idle one,
+// it waits until one is idle or the job is canceled
+func (p *Pool) acquire(job Job) (*PoolMember, error) {
+	var done <-chan struct{}
+	if job.Context != nil {
+		done = job.Context.Done()
+	}
+
+	for {
+		p.lock.Lock()
+		m, err := p.pick(job.Device)
+		if err != nil || m != nil {
+			if m != nil {
+				m.busy = true
+			}
+			p.lock.Unlock()
+			return m, err
+		}
+
+		if p.released == nil {
+			p.released = make(chan struct{})
+		}
+		released := p.released
+		p.lock.Unlock()
+
+		select {
+		case <-released:
+		case <-done:
+			return nil, job.Context.Err()
+		}
+	}
+}
+
+// pick must be called with the lock held, it returns nil if the
+// member(s) in question are busy
+func (p *Pool) pick(device string) (*PoolMember, error) {
+	if device == "" {
+		for _, m := range p.Members {
+			if !m.busy {
+				return m, nil
+			}
+		}
+		return nil, nil
+	}
+
+	for _, m := range p.Members {
+		if m.Name == device || (m.Scanner.Device != "" && m.Scanner.Device == device) {
+			if m.busy {
+				return nil, nil
+			}
+			return m, nil
+		}
+	}
+	return nil, UnavailableError(fmt.Sprintf("Scanner %q is not configured", device))
+}
+
+func (p *Pool) release(m *PoolMember) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	m.busy = false
+	if p.released != nil {
+		close(p.released)
+		p.released = nil
+	}
+}
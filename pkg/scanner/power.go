@@ -0,0 +1,82 @@
+//go:build !windows
+// +build !windows
+
+package scanner
+
+import (
+	"fmt"
+
+	"github.com/Luzifer/sane"
+)
+
+// sleepTimerOption is the option of the fujitsu backend setting the
+// minutes of inactivity until the device goes to sleep
+const sleepTimerOption = "sleeptimer"
+
+// Sleep implements PowerController: the sleep timer of the device is
+// set to its shortest value and the device is closed, so it sleeps a
+// minute later unless used again. Devices without a sleep timer fail
+// with UnsupportedError, a device in use with sane.ErrBusy.
+func (s *SANE) Sleep() error {
+	if !s.lock.TryLock() {
+		return sane.ErrBusy
+	}
+	defer s.lock.Unlock()
+
+	c, _, err := s.open("")
+	if err != nil {
+		return err
+	}
+	defer s.closeConn()
+
+	timeout := -1
+	for _, o := range c.Options() {
+		if o.Name != sleepTimerOption || !o.IsActive || !o.IsSettable {
+			continue
+		}
+		timeout = 1
+		if o.ConstrRange != nil {
+			if min, ok := o.ConstrRange.Min.(int); ok && min > timeout {
+				timeout = min
+			}
+		}
+	}
+	if timeout < 0 {
+		return UnsupportedError("The device has no sleep timer")
+	}
+
+	if _, err = s.setOption(c, sleepTimerOption, timeout); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Wake implements PowerController: opening the device wakes it up, the
+// options are set and one is read to make sure it answers
+func (s *SANE) Wake(options map[string]interface{}) error {
+	if !s.lock.TryLock() {
+		// A device in use is awake
+		return nil
+	}
+	defer s.lock.Unlock()
+
+	c, _, err := s.open("")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range sortedOptionNames(options) {
+		if _, err = s.setOption(c, name, options[name]); err != nil {
+			s.closeConn()
+			return err
+		}
+	}
+
+	if _, err = c.GetOption("resolution"); err != nil {
+		s.closeConn()
+		return fmt.Errorf("Unable to read option resolution: %w", err)
+	}
+
+	s.release(nil)
+	return nil
+}
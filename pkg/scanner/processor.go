@@ -0,0 +1,468 @@
+package scanner
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/pdfgen"
+	"github.com/disintegration/imaging"
+)
+
+// Color modes supported by the ImageProcessor
+const (
+	ColorModeColor = "color"
+	ColorModeGray  = "gray"
+	ColorModeBW    = "bw"
+	// ColorModeAuto keeps color only for pages containing significant
+	// color and converts the other pages to grayscale, ColorModeAutoBW
+	// to black and white
+	ColorModeAuto   = "auto"
+	ColorModeAutoBW = "auto-bw"
+)
+
+const thumbnailWidth = 400
+
+// Page is a single processed page ready to be embedded into the PDF
+type Page struct {
+	// Index is the position of the page in the scanned batch (0-based)
+	Index int
+	// Width and Height of the page image in pixels
+	Width, Height int
+	// Image is the decoded page which is only kept if needed for later
+	// processing (OCR) as it takes many times the memory of Data
+	Image image.Image
+	// Data contains the encoded image in the format given by ImageType
+	// ("jpeg", "ccitt" or "png")
+	Data      []byte
+	ImageType string
+	// DPI is the resolution of the page image
+	DPI int
+	// Color is the color mode the page was encoded in, which is chosen
+	// per page by the auto modes
+	Color string
+	// Text is drawn over the page image in the PDF
+	Text []pdfgen.Text
+	// Words contains the text recognized by OCR, see StepPage
+	Words []Word
+	// ActualSize sizes the PDF page to the image at DPI instead of an A4
+	// page
+	ActualSize bool
+	// Thumbnail is a small JPEG preview of the page
+	Thumbnail []byte
+	// Fingerprint compares the page to others to find sheets scanned twice,
+	// nil for pages without content to compare (see IsDuplicate)
+	Fingerprint *Fingerprint
+	// Blank is set for back sides removed by RemoveBlankBacks, they have
+	// no image and are not embedded
+	Blank bool
+	// ProcessingTime is the time the pipeline and encoding took, set by
+	// the caller of the processor
+	ProcessingTime time.Duration
+	// Original is the scanned image before processing encoded
+	// losslessly at the scan resolution, only set if requested using
+	// ImageProcessor.KeepOriginal
+	Original *Page
+	// Misfeed contains the reason the page is suspected to be fed
+	// badly (stapled / overlapping sheets), empty if it looks fine
+	Misfeed string
+	// Section is set by the caller on pages starting a new section of
+	// the document, which is added to the outline of the PDF
+	Section string
+	// Rotate turns the page clockwise in the PDF without re-encoding
+	// it, see RotateBy
+	Rotate int
+
+	// data and image replace Data and Image of pages moved into a Spool
+	data, image *spoolFile
+}
+
+// PDFImage wraps the encoded data of the page for the PDF assembler
+func (p *Page) PDFImage() (*pdfgen.Image, error) {
+	var img *pdfgen.Image
+
+	data, err := p.ImageData()
+	if err != nil {
+		return nil, err
+	}
+
+	switch p.ImageType {
+	case "jpeg":
+		img, err = pdfgen.JPEGImage(data)
+	case "ccitt":
+		img = pdfgen.CCITTImage(p.Width, p.Height, data)
+	case "png":
+		img, err = pdfgen.PNGImage(data)
+	default:
+		return nil, fmt.Errorf("Unsupported image type %q", p.ImageType)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	img.Text = p.Text
+	img.Rotate = p.Rotate
+	img.Resolution = p.DPI
+	if p.ActualSize {
+		img.DPI = p.DPI
+	}
+	return img, nil
+}
+
+// RotateBy turns the page clockwise by a multiple of 90 degrees,
+// negative values turn it counter-clockwise
+func (p *Page) RotateBy(degrees int) error {
+	if degrees%90 != 0 {
+		return fmt.Errorf("Rotation must be a multiple of 90 degrees")
+	}
+	degrees = (degrees%360 + 360) % 360
+
+	if len(p.Thumbnail) > 0 && degrees != 0 {
+		thumb, err := jpeg.Decode(bytes.NewReader(p.Thumbnail))
+		if err != nil {
+			return fmt.Errorf("Unable to decode thumbnail: %s", err)
+		}
+
+		// imaging rotates counter-clockwise
+		switch degrees {
+		case 90:
+			thumb = imaging.Rotate270(thumb)
+		case 180:
+			thumb = imaging.Rotate180(thumb)
+		case 270:
+			thumb = imaging.Rotate90(thumb)
+		}
+
+		buf := new(bytes.Buffer)
+		if err = jpeg.Encode(buf, thumb, &jpeg.Options{Quality: 80}); err != nil {
+			return fmt.Errorf("Unable to encode thumbnail: %s", err)
+		}
+		p.Thumbnail = buf.Bytes()
+	}
+
+	p.Rotate = (p.Rotate + degrees) % 360
+	return nil
+}
+
+// Processor turns a scanned image into an encoded page, idx is the
+// position of the page in the batch
+type Processor interface {
+	Process(idx int, img image.Image) (*Page, error)
+}
+
+// ImageProcessor applies the default transformations to scanned pages
+type ImageProcessor struct {
+	// Color is one of the ColorMode constants
+	Color string
+	// Duplex batches have the back side of every sheet at odd indices
+	// which is rotated by RotateBack (0 or 180) degrees
+	Duplex     bool
+	RotateBack int
+	// ScanDPI is the resolution of the scanned images, OutputDPI the one
+	// of the document pages scaled to by the resize step
+	ScanDPI, OutputDPI int
+	// Pipeline is applied to every page before it is encoded according
+	// to Color (default: DefaultPipeline)
+	Pipeline    Pipeline
+	JPEGQuality int
+	// Lossless encodes gray and color pages as PNG instead of JPEG,
+	// bilevel pages are always lossless
+	Lossless bool
+	// KeepOriginal keeps the scanned image in Page.Original
+	KeepOriginal bool
+	// RemoveBlankBacks marks back sides with less than BlankThreshold
+	// percent covered by ink as Blank, front sides are always kept
+	RemoveBlankBacks bool
+	BlankThreshold   float64
+	// KeepImage keeps the decoded image in the Page, KeepFirstImage
+	// only for the first page of the batch
+	KeepImage      bool
+	KeepFirstImage bool
+	// Ops executes the image operations (default: pure Go imaging)
+	Ops ImageOps
+	// Layout places the pages on the PDF pages, steps drawing text use
+	// it to size the text in points
+	Layout pdfgen.Layout
+	// Pages skewed by at least MisfeedSkewThreshold degrees (0 =
+	// disable) or longer than PageHeightMM are reported as misfed, with
+	// MisfeedCorners also pages with a folded corner
+	MisfeedSkewThreshold float64
+	PageHeightMM         float64
+	MisfeedCorners       bool
+	// Spool keeps the images of the processed pages in files instead of
+	// memory if set
+	Spool *Spool
+	// ColorProfile converts the color pages from the colors of the
+	// scanner to sRGB before processing them if set
+	ColorProfile *ColorProfile
+}
+
+// Process implements Processor
+func (p ImageProcessor) Process(idx int, img image.Image) (*Page, error) {
+	ops := p.Ops
+	if ops == nil {
+		ops = imagingOps{}
+	}
+
+	switch img.(type) {
+	case *image.Gray16, *image.RGBA64:
+	default:
+		if IsDeep(img) {
+			// Frames of 16 bit scans are read once instead of by every step
+			img = deepCopy(img)
+		}
+	}
+
+	// In duplex mode every even page (odd index) is the back side
+	// of the previous sheet
+	back := p.Duplex && idx%2 == 1
+	if back && p.RotateBack == 180 {
+		img = ops.Rotate180(img)
+	}
+
+	if back && p.RemoveBlankBacks && isBlank(ops, img, p.BlankThreshold) {
+		return &Page{Index: idx, Blank: true}, nil
+	}
+
+	var original *Page
+	if p.KeepOriginal {
+		var err error
+		if original, err = encodeOriginal(ops, idx, img, p.ScanDPI); err != nil {
+			return nil, fmt.Errorf("Unable to encode original of page %d: %s", idx, err)
+		}
+	}
+
+	if p.ColorProfile != nil {
+		img = p.ColorProfile.ToSRGB(img)
+	}
+
+	// Checked before the pipeline as deskewing would hide the skew
+	misfeed := detectMisfeed(img, p.ScanDPI, p.MisfeedSkewThreshold, p.PageHeightMM, p.MisfeedCorners)
+
+	pipeline := p.Pipeline
+	if pipeline == nil {
+		pipeline = defaultPipeline
+	}
+	page := &StepPage{Index: idx, Back: back, Image: img, DPI: p.ScanDPI, OutputDPI: p.OutputDPI, Ops: ops, Layout: p.Layout}
+	if err := pipeline.Apply(page); err != nil {
+		return nil, fmt.Errorf("Unable to process page %d: %s", idx, err)
+	}
+	img = page.Image
+
+	var (
+		buf       = new(bytes.Buffer)
+		imageType = "jpeg"
+		err       error
+	)
+
+	mode := p.Color
+	switch mode {
+	case ColorModeAuto, ColorModeAutoBW:
+		if hasSignificantColor(ops, img) {
+			mode = ColorModeColor
+		} else if mode == ColorModeAuto {
+			mode = ColorModeGray
+		} else {
+			mode = ColorModeBW
+		}
+	}
+
+	switch mode {
+	case ColorModeBW:
+		// Bilevel pages compress far better using CCITT G4 than JPEG
+		bw, ok := img.(*image.Paletted)
+		if !ok || !isBilevel(bw) {
+			bw = binarizeSauvola(ops.Gray(img), page.DPI)
+		}
+		img = bw
+		imageType = "ccitt"
+		_, err = buf.Write(pdfgen.EncodeCCITTG4(bw))
+
+	case ColorModeGray:
+		if IsDeep(img) {
+			img = deepGray(img)
+		} else {
+			img = ops.Gray(img)
+		}
+		imageType, err = p.encode(ops, buf, img)
+
+	default:
+		mode = ColorModeColor
+		imageType, err = p.encode(ops, buf, img)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to encode page %d: %s", idx, err)
+	}
+
+	var (
+		thumbImg = ops.Thumbnail(img, thumbnailWidth)
+		thumb    = new(bytes.Buffer)
+	)
+	if err := ops.EncodeJPEG(thumb, thumbImg, 80); err != nil {
+		return nil, fmt.Errorf("Unable to encode thumbnail of page %d: %s", idx, err)
+	}
+
+	pg := &Page{
+		Index:       idx,
+		Width:       img.Bounds().Dx(),
+		Height:      img.Bounds().Dy(),
+		Data:        buf.Bytes(),
+		ImageType:   imageType,
+		DPI:         page.DPI,
+		Color:       mode,
+		Text:        page.Text,
+		Words:       page.Words,
+		ActualSize:  page.ActualSize,
+		Thumbnail:   thumb.Bytes(),
+		Fingerprint: pageFingerprint(thumbImg),
+		Original:    original,
+		Misfeed:     misfeed,
+	}
+
+	if p.KeepImage || (p.KeepFirstImage && idx == 0) {
+		pg.Image = img
+	}
+
+	if p.Spool != nil {
+		if err := pg.SpoolTo(p.Spool); err != nil {
+			pg.Release()
+			return nil, fmt.Errorf("Unable to spool page %d: %w", idx, err)
+		}
+	}
+
+	return pg, nil
+}
+
+// PageErrors reports the pages which failed to process by their index
+type PageErrors map[int]error
+
+func (p PageErrors) Error() string {
+	idx := p.Indices()
+	return fmt.Sprintf("Unable to process %d page(s), first error: %s", len(idx), p[idx[0]])
+}
+
+// Indices returns the indices of the failed pages in ascending order
+func (p PageErrors) Indices() []int {
+	idx := []int{}
+	for i := range p {
+		idx = append(idx, i)
+	}
+	sort.Ints(idx)
+	return idx
+}
+
+// encode writes the gray or color page as JPEG or PNG and returns the
+// image type, deep pages are always PNG as JPEG has 8 bits per sample
+func (p ImageProcessor) encode(ops ImageOps, w io.Writer, img image.Image) (string, error) {
+	if !p.Lossless && !IsDeep(img) {
+		return "jpeg", ops.EncodeJPEG(w, img, p.JPEGQuality)
+	}
+	// Scans are opaque, so the encoder writes gray or RGB without
+	// alpha channel as embedded into the PDF
+	return "png", png.Encode(w, img)
+}
+
+// encodeOriginal keeps the scanned image as PNG shown at its actual
+// size, bilevel images are stored as gray as PDFImage does not support
+// paletted PNGs
+func encodeOriginal(ops ImageOps, idx int, img image.Image, dpi int) (*Page, error) {
+	mode := ColorModeColor
+	switch img.(type) {
+	case *image.Paletted:
+		img, mode = ops.Gray(img), ColorModeGray
+	case *image.Gray, *image.Gray16:
+		mode = ColorModeGray
+	}
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+
+	return &Page{
+		Index:      idx,
+		Width:      img.Bounds().Dx(),
+		Height:     img.Bounds().Dy(),
+		Data:       buf.Bytes(),
+		ImageType:  "png",
+		DPI:        dpi,
+		Color:      mode,
+		ActualSize: true,
+	}, nil
+}
+
+// ProcessPages processes the images received from in on all available
+// CPUs and returns the pages in their original order. Page indices
+// start at firstIndex. Pages failing to process are left out and
+// reported as PageErrors, the remaining pages are returned anyway. The
+// index following the last image received is returned as the next
+// firstIndex.
+func ProcessPages(p Processor, in <-chan image.Image, firstIndex int) ([]*Page, PageErrors, int) {
+	type job struct {
+		idx int
+		img image.Image
+	}
+
+	var (
+		jobs  = make(chan job)
+		pages = []*Page{}
+		errs  = PageErrors{}
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+	)
+
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				pg, err := p.Process(j.idx, j.img)
+
+				mu.Lock()
+				if err != nil {
+					errs[j.idx] = err
+				} else {
+					pages = append(pages, pg)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	idx := firstIndex
+	for img := range in {
+		jobs <- job{idx, img}
+		idx++
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Index < pages[j].Index })
+
+	if len(errs) > 0 {
+		return pages, errs, idx
+	}
+	return pages, nil, idx
+}
+
+func reducePageDPI(ops ImageOps, in image.Image, scanDPI, pdfDPI int) image.Image {
+	if scanDPI == pdfDPI {
+		// Resampling to the same size is expensive and changes nothing
+		return in
+	}
+
+	origW, origH := in.Bounds().Dx(), in.Bounds().Dy()
+
+	if IsDeep(in) {
+		return deepResize(in, origW*pdfDPI/scanDPI, origH*pdfDPI/scanDPI)
+	}
+	return ops.Fit(in, origW*pdfDPI/scanDPI, origH*pdfDPI/scanDPI)
+}
@@ -0,0 +1,215 @@
+package scanner
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/disintegration/imaging"
+)
+
+// replayDevice is reported to observers of jobs executed by Replay
+var replayDevice = Device{Name: "replay:0", Vendor: "scansnap-go", Model: "Fixture replay", Type: "virtual device"}
+
+// replayExtensions are the image files fed by Replay
+var replayExtensions = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".bmp": true, ".tif": true, ".tiff": true}
+
+// Replay is a Scanner feeding image files from a directory instead of
+// scanning them, to develop and demo profiles, pipelines, splitting and
+// OCR on machines without a scanner. Every job feeds the images in the
+// order of their names. A directory containing subdirectories feeds one
+// of them per job in turn, e.g. to replay different batches.
+type Replay struct {
+	// Dir contains the image fixtures (PNG, JPEG, BMP or TIFF)
+	Dir string
+	// DPI is the resolution the fixtures were scanned at, they are
+	// scaled to the resolution of the job (default: 300)
+	DPI int
+
+	lock sync.Mutex
+	// next is the index of the subdirectory fed by the next job
+	next int
+	// scanned counts all pages fed like the counters of real devices
+	scanned int64
+}
+
+// Scan implements Scanner. The "resolution", "mode" ("Gray" or color)
+// and "depth" (8 or 16) options are respected.
+func (r *Replay) Scan(job Job, out chan<- image.Image) (err error) {
+	defer close(out)
+
+	obs := job.Observer
+	if obs == nil {
+		obs = nopObserver{}
+	}
+
+	if err = obs.Starting(); err != nil {
+		return err
+	}
+
+	var n int
+	defer func() { obs.Finished(n, err) }()
+
+	if job.Device != "" && job.Device != replayDevice.Name {
+		return UnavailableError(fmt.Sprintf("Scanner %q not found", job.Device))
+	}
+	if job.Depth != 0 && job.Depth != 8 && job.Depth != 16 {
+		return UnsupportedError("Depth is not supported by the replay scanner (supported: 8, 16)")
+	}
+
+	files, err := r.batch()
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return ErrEmpty
+	}
+
+	values := map[string]interface{}{}
+	applied := []AppliedOption{}
+	for _, k := range sortedOptionNames(job.Options) {
+		values[k] = job.Options[k]
+		applied = append(applied, AppliedOption{Name: k, Requested: job.Options[k], Effective: job.Options[k]})
+	}
+	if rep, ok := obs.(OptionReporter); ok {
+		rep.OptionsApplied(applied)
+	}
+	obs.Started(replayDevice, values)
+
+	for _, file := range files {
+		if job.MaxPages > 0 && n >= job.MaxPages {
+			return nil
+		}
+		if err = job.canceled(); err != nil {
+			return err
+		}
+		if job.PageLimit > 0 && n >= job.PageLimit {
+			return PageLimitError(job.PageLimit)
+		}
+
+		page, err := r.page(file, job.Options)
+		if err != nil {
+			return err
+		}
+
+		out <- page
+		n++
+		atomic.AddInt64(&r.scanned, 1)
+
+		if err = obs.PageScanned(n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// batch returns the files to feed for the next job
+func (r *Replay) batch() ([]string, error) {
+	entries, err := ioutil.ReadDir(r.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read fixture directory: %s", err)
+	}
+
+	var dirs []string
+	for _, e := range entries {
+		if e.IsDir() {
+			dirs = append(dirs, filepath.Join(r.Dir, e.Name()))
+		}
+	}
+
+	dir := r.Dir
+	if len(dirs) > 0 {
+		sort.Strings(dirs)
+
+		r.lock.Lock()
+		dir = dirs[r.next%len(dirs)]
+		r.next++
+		r.lock.Unlock()
+
+		if entries, err = ioutil.ReadDir(dir); err != nil {
+			return nil, fmt.Errorf("Unable to read fixture directory: %s", err)
+		}
+	}
+
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && replayExtensions[strings.ToLower(filepath.Ext(e.Name()))] {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// page reads the fixture and converts it to the resolution and mode of
+// the job
+func (r *Replay) page(file string, opts map[string]interface{}) (image.Image, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open fixture: %s", err)
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode fixture %s: %s", filepath.Base(file), err)
+	}
+
+	src := float64(r.DPI)
+	if src <= 0 {
+		src = 300
+	}
+	if dpi := optionNumber(opts["resolution"]); dpi > 0 && dpi != src {
+		w := int(float64(img.Bounds().Dx()) * dpi / src)
+		img = imaging.Resize(img, w, 0, imaging.CatmullRom)
+	}
+
+	deep := optionNumber(opts["depth"]) == 16
+	var dst draw.Image
+	switch {
+	case opts["mode"] == "Gray" && deep:
+		dst = image.NewGray16(img.Bounds())
+	case opts["mode"] == "Gray":
+		return toGray(img), nil
+	case deep:
+		dst = image.NewRGBA64(img.Bounds())
+	default:
+		dst = image.NewRGBA(img.Bounds())
+	}
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	return dst, nil
+}
+
+// DeviceOptions implements DeviceDescriber with the options respected
+// by the replay scanner
+func (r *Replay) DeviceOptions() (DeviceCapabilities, error) {
+	return DeviceCapabilities{
+		Device: replayDevice,
+		Options: []DeviceOption{
+			{Option: Option{
+				Name: "resolution", Title: "Scan resolution", Type: TypeInt, Unit: UnitDpi,
+				ConstrRange: &Range{Min: 50, Max: 1200, Quant: 1}, IsActive: true, IsSettable: true,
+			}, Value: 300},
+			{Option: Option{
+				Name: "mode", Title: "Scan mode", Type: TypeString,
+				ConstrSet: []interface{}{"Color", "Gray"}, IsActive: true, IsSettable: true,
+			}, Value: "Color"},
+			{Option: Option{
+				Name: "depth", Title: "Bit depth", Type: TypeInt, Unit: UnitBit,
+				ConstrSet: []interface{}{8, 16}, IsActive: true, IsSettable: true,
+			}, Value: 8},
+			{Option: Option{
+				Name: "page-counter", Group: "Sensors", Title: "Pages fed", Type: TypeInt,
+				IsActive: true, IsDetectable: true,
+			}, Value: int(atomic.LoadInt64(&r.scanned))},
+		},
+	}, nil
+}
@@ -0,0 +1,131 @@
+package scanner
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFixture writes a PNG of the given size and shade
+func writeFixture(t *testing.T, file string, w, h int, shade uint8) {
+	t.Helper()
+
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = shade
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		t.Fatalf("creating fixture directory: %s", err)
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatalf("creating fixture: %s", err)
+	}
+	defer f.Close()
+	if err = png.Encode(f, img); err != nil {
+		t.Fatalf("encoding fixture: %s", err)
+	}
+}
+
+// replayImages returns the images fed by a job of the scanner
+func replayImages(r *Replay, job Job) ([]image.Image, error) {
+	out := make(chan image.Image)
+	errc := make(chan error, 1)
+	go func() { errc <- r.Scan(job, out) }()
+
+	var imgs []image.Image
+	for img := range out {
+		imgs = append(imgs, img)
+	}
+	return imgs, <-errc
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, filepath.Join(dir, "b.png"), 40, 60, 200)
+	writeFixture(t, filepath.Join(dir, "a.png"), 40, 60, 100)
+	if err := ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not an image"), 0o644); err != nil {
+		t.Fatalf("writing file: %s", err)
+	}
+
+	r := &Replay{Dir: dir, DPI: 100}
+	imgs, err := replayImages(r, Job{Options: map[string]interface{}{"resolution": 50, "mode": "Gray"}})
+	if err != nil {
+		t.Fatalf("replaying: %s", err)
+	}
+	if len(imgs) != 2 {
+		t.Fatalf("expected 2 pages, got %d", len(imgs))
+	}
+	for i, exp := range []uint8{100, 200} {
+		if b := imgs[i].Bounds(); b.Dx() != 20 || b.Dy() != 30 {
+			t.Errorf("page %d: expected 20x30 pixels, got %dx%d", i, b.Dx(), b.Dy())
+		}
+		if y := color.GrayModel.Convert(imgs[i].At(10, 10)).(color.Gray).Y; y != exp {
+			t.Errorf("page %d: expected shade %d, got %d", i, exp, y)
+		}
+	}
+
+	imgs, err = replayImages(r, Job{Options: map[string]interface{}{"depth": 16}})
+	if err != nil || len(imgs) != 2 {
+		t.Fatalf("expected 2 pages, got %d (%v)", len(imgs), err)
+	}
+	if _, ok := imgs[0].(*image.RGBA64); !ok {
+		t.Errorf("expected a 16 bit color page, got %T", imgs[0])
+	}
+}
+
+func TestReplayBatches(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, filepath.Join(dir, "1", "page.png"), 10, 10, 0)
+	writeFixture(t, filepath.Join(dir, "2", "page1.png"), 10, 10, 0)
+	writeFixture(t, filepath.Join(dir, "2", "page2.png"), 10, 10, 0)
+
+	r := &Replay{Dir: dir}
+	for i, exp := range []int{1, 2, 1} {
+		imgs, err := replayImages(r, Job{})
+		if err != nil {
+			t.Fatalf("job %d: %s", i, err)
+		}
+		if len(imgs) != exp {
+			t.Errorf("job %d: expected %d pages, got %d", i, exp, len(imgs))
+		}
+	}
+}
+
+func TestReplayMalformed(t *testing.T) {
+	empty := t.TempDir()
+
+	corrupt := t.TempDir()
+	writeFixture(t, filepath.Join(corrupt, "a.png"), 10, 10, 0)
+	if err := ioutil.WriteFile(filepath.Join(corrupt, "b.png"), []byte("\x89PNG\r\n\x1a\ngarbage"), 0o644); err != nil {
+		t.Fatalf("writing fixture: %s", err)
+	}
+
+	for name, tc := range map[string]struct {
+		dir   string
+		pages int
+	}{
+		"missing directory": {filepath.Join(empty, "missing"), 0},
+		"empty directory":   {empty, 0},
+		"corrupt image":     {corrupt, 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			imgs, err := replayImages(&Replay{Dir: tc.dir}, Job{})
+			if err == nil {
+				t.Errorf("expected an error")
+			}
+			if len(imgs) != tc.pages {
+				t.Errorf("expected %d pages before the error, got %d", tc.pages, len(imgs))
+			}
+		})
+	}
+
+	if _, err := replayImages(&Replay{Dir: empty}, Job{}); err != ErrEmpty {
+		t.Errorf("expected ErrEmpty for an empty directory, got %v", err)
+	}
+}
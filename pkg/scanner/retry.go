@@ -0,0 +1,48 @@
+package scanner
+
+import "time"
+
+// RetryPolicy retries SANE operations failing with transient errors
+// (device busy, USB hiccups) using exponential backoff. The zero value
+// disables retries.
+type RetryPolicy struct {
+	// Initial is the first wait between two attempts, doubled for every
+	// following attempt
+	Initial time.Duration
+	// Deadline is the total time an operation is retried for
+	Deadline time.Duration
+	// Notify is called before waiting for the next attempt (optional)
+	Notify func(op string, err error, wait time.Duration)
+}
+
+// transientError reports whether the operation may succeed when tried
+// again without side effects
+func transientError(err error) bool {
+	return err == ErrBusy || err == ErrIo
+}
+
+// busyError reports whether the device refused to start the operation
+// which is the only error safe to retry once data is transferred
+func busyError(err error) bool {
+	return err == ErrBusy
+}
+
+func (r RetryPolicy) do(op string, retryable func(error) bool, fn func() error) error {
+	var (
+		deadline = time.Now().Add(r.Deadline)
+		wait     = r.Initial
+	)
+
+	for {
+		err := fn()
+		if err == nil || r.Initial <= 0 || !retryable(err) || time.Now().Add(wait).After(deadline) {
+			return err
+		}
+
+		if r.Notify != nil {
+			r.Notify(op, err, wait)
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
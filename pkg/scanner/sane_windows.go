@@ -0,0 +1,77 @@
+package scanner
+
+import (
+	"context"
+	"image"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// errNoSANE is returned by all operations of SANE on Windows
+var errNoSANE = UnavailableError("SANE is not available on Windows, scan using WIA or an acquisition command instead")
+
+// SANE is not available on Windows, the type keeps the configuration
+// of the other platforms and fails all operations. Scans are executed
+// by a Command, see WIA.
+type SANE struct {
+	Device      string
+	DeviceMatch *regexp.Regexp
+	Retry       RetryPolicy
+	IdleTimeout time.Duration
+
+	lock sync.Mutex
+}
+
+// Devices fails as SANE is not available
+func (s *SANE) Devices() ([]Device, error) { return nil, errNoSANE }
+
+// TryDevices fails as SANE is not available
+func (s *SANE) TryDevices() ([]Device, bool, error) { return nil, false, errNoSANE }
+
+// Exclusive fails as SANE is not available
+func (s *SANE) Exclusive(func(list func() ([]Device, error)) error) error { return errNoSANE }
+
+// Reset fails as SANE is not available
+func (s *SANE) Reset(context.Context) ([]Device, error) { return nil, errNoSANE }
+
+// Scan implements Scanner failing as SANE is not available
+func (s *SANE) Scan(_ Job, out chan<- image.Image) error {
+	close(out)
+	return errNoSANE
+}
+
+// DeviceOptions fails as SANE is not available
+func (s *SANE) DeviceOptions() (DeviceCapabilities, error) { return DeviceCapabilities{}, errNoSANE }
+
+// PaperLoaded fails as SANE is not available
+func (s *SANE) PaperLoaded(string) (bool, error) { return false, errNoSANE }
+
+// Ping fails as SANE is not available
+func (s *SANE) Ping() error { return errNoSANE }
+
+// Capabilities fails as SANE is not available
+func (s *SANE) Capabilities() ([]DeviceCapabilities, error) { return nil, errNoSANE }
+
+// ValidateOptions fails as SANE is not available
+func (s *SANE) ValidateOptions(Job) (OptionReport, error) { return OptionReport{}, errNoSANE }
+
+// Sleep fails as SANE is not available
+func (s *SANE) Sleep() error { return errNoSANE }
+
+// Wake fails as SANE is not available
+func (s *SANE) Wake(map[string]interface{}) error { return errNoSANE }
+
+// lockContext acquires the lock unless ctx is done before
+func (s *SANE) lockContext(ctx context.Context) error {
+	for !s.lock.TryLock() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+func (s *SANE) closeConn() {}
@@ -0,0 +1,51 @@
+//go:build !windows
+// +build !windows
+
+package scanner
+
+import "github.com/Luzifer/sane"
+
+// The devices, their options and the errors of all backends are
+// described using the types of the SANE library, builds without SANE
+// (Windows) declare them in sanetypes_windows.go
+type (
+	Device = sane.Device
+	Option = sane.Option
+	Range  = sane.Range
+	Type   = sane.Type
+	Unit   = sane.Unit
+)
+
+// Option types
+const (
+	TypeBool   = sane.TypeBool
+	TypeInt    = sane.TypeInt
+	TypeFloat  = sane.TypeFloat
+	TypeString = sane.TypeString
+	TypeButton = sane.TypeButton
+)
+
+// Option units
+const (
+	UnitNone    = sane.UnitNone
+	UnitPixel   = sane.UnitPixel
+	UnitBit     = sane.UnitBit
+	UnitMm      = sane.UnitMm
+	UnitDpi     = sane.UnitDpi
+	UnitPercent = sane.UnitPercent
+	UnitUsec    = sane.UnitUsec
+)
+
+// Errors reported by the devices
+var (
+	ErrUnsupported = sane.ErrUnsupported
+	ErrCancelled   = sane.ErrCancelled
+	ErrBusy        = sane.ErrBusy
+	ErrInvalid     = sane.ErrInvalid
+	ErrJammed      = sane.ErrJammed
+	ErrEmpty       = sane.ErrEmpty
+	ErrCoverOpen   = sane.ErrCoverOpen
+	ErrIo          = sane.ErrIo
+	ErrNoMem       = sane.ErrNoMem
+	ErrDenied      = sane.ErrDenied
+)
@@ -0,0 +1,74 @@
+package scanner
+
+import "errors"
+
+// Device describes a scanning device like sane.Device
+type Device struct {
+	Name, Vendor, Model, Type string
+}
+
+// Type is the data type of an option
+type Type int
+
+// Option types, numbered like in SANE
+const (
+	TypeBool Type = iota
+	TypeInt
+	TypeFloat
+	TypeString
+	TypeButton
+)
+
+// Unit is the physical unit of an option
+type Unit int
+
+// Option units, numbered like in SANE
+const (
+	UnitNone Unit = iota
+	UnitPixel
+	UnitBit
+	UnitMm
+	UnitDpi
+	UnitPercent
+	UnitUsec
+)
+
+// Range is the range of the values of a numeric option
+type Range struct {
+	Min   interface{}
+	Max   interface{}
+	Quant interface{}
+}
+
+// Option describes an option of a device like sane.Option
+type Option struct {
+	Name         string
+	Group        string
+	Title        string
+	Desc         string
+	Type         Type
+	Unit         Unit
+	Length       int
+	ConstrSet    []interface{}
+	ConstrRange  *Range
+	IsActive     bool
+	IsSettable   bool
+	IsDetectable bool
+	IsAutomatic  bool
+	IsEmulated   bool
+	IsAdvanced   bool
+}
+
+// Errors reported by the devices, with the messages of the SANE library
+var (
+	ErrUnsupported = errors.New("sane: operation not supported")
+	ErrCancelled   = errors.New("sane: operation cancelled")
+	ErrBusy        = errors.New("sane: device busy")
+	ErrInvalid     = errors.New("sane: invalid argument")
+	ErrJammed      = errors.New("sane: feeder jammed")
+	ErrEmpty       = errors.New("sane: feeder empty")
+	ErrCoverOpen   = errors.New("sane: cover open")
+	ErrIo          = errors.New("sane: input/output error")
+	ErrNoMem       = errors.New("sane: out of memory")
+	ErrDenied      = errors.New("sane: access denied")
+)
@@ -0,0 +1,773 @@
+//go:build !windows
+// +build !windows
+
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/sane"
+)
+
+// SANE scans using a device found by SANE. All access to the SANE
+// layer is serialized: only one scan can be executed at a time and
+// reinitialization must not happen mid-scan.
+//
+// The device is kept open for IdleTimeout after a scan to save the
+// setup time of the next one. Options not set by a job therefore keep
+// the value of the previous job.
+type SANE struct {
+	// Device is the name of the device to use, the first one found if
+	// empty. The SANE "test" backend (device "test:0") is supported.
+	Device string
+	// DeviceMatch selects the first device matching it if Device is
+	// empty, see DeviceMatches
+	DeviceMatch *regexp.Regexp
+	// Retry is applied to opening the device, setting options and
+	// starting to read pages
+	Retry RetryPolicy
+	// IdleTimeout is the time the device is kept open after a scan, 0
+	// closes it after every scan
+	IdleTimeout time.Duration
+
+	lock sync.Mutex
+	// conn is the device kept open between scans, SANE is initialized
+	// while it is set
+	conn    *sane.Conn
+	dev     sane.Device
+	idle    *time.Timer
+	idleGen int
+}
+
+// Devices initializes SANE, lists the available devices and tears SANE
+// down again
+func (s *SANE) Devices() ([]sane.Device, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.listDevices()
+}
+
+// TryDevices lists the devices unless a scan is running, in which case
+// busy is true
+func (s *SANE) TryDevices() (devs []sane.Device, busy bool, err error) {
+	if !s.lock.TryLock() {
+		return nil, true, nil
+	}
+	defer s.lock.Unlock()
+
+	devs, err = s.listDevices()
+	return devs, false, err
+}
+
+// Exclusive executes fn while no scan is running, it may change the
+// SANE configuration and use the passed list function to check it
+func (s *SANE) Exclusive(fn func(list func() ([]sane.Device, error)) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// The configuration change must be picked up by a new SANE instance
+	s.closeConn()
+	return fn(s.listDevices)
+}
+
+// Reset closes the kept device and tears SANE down so the next job
+// starts with a fresh SANE instance, e.g. to recover from a backend no
+// longer answering. It waits for a running scan or session to end until
+// ctx is done and returns the devices found by the new instance.
+func (s *SANE) Reset(ctx context.Context) ([]sane.Device, error) {
+	if err := s.lockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer s.lock.Unlock()
+
+	s.closeConn()
+	return s.listDevices()
+}
+
+// lockContext acquires the lock unless ctx is done before
+func (s *SANE) lockContext(ctx context.Context) error {
+	for !s.lock.TryLock() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+func (s *SANE) listDevices() ([]sane.Device, error) {
+	if s.conn != nil {
+		// SANE is initialized already and must not be torn down
+		devs, err := sane.Devices()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to list devices: %s", err)
+		}
+
+		if _, err = selectDevice(devs, s.dev.Name, nil); err != nil {
+			// The kept device is gone, discover it again on the next job
+			s.closeConn()
+		}
+		return devs, nil
+	}
+
+	if err := saneInit(); err != nil {
+		return nil, fmt.Errorf("Unable to initialize SANE: %s", err)
+	}
+	defer saneExit()
+
+	devs, err := sane.Devices()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list devices: %s", err)
+	}
+
+	return devs, nil
+}
+
+// Scan implements Scanner
+func (s *SANE) Scan(job Job, out chan<- image.Image) (err error) {
+	defer close(out)
+
+	obs := job.Observer
+	if obs == nil {
+		obs = nopObserver{}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err = obs.Starting(); err != nil {
+		return err
+	}
+
+	var n int
+	defer func() { obs.Finished(n, err) }()
+
+	for attempt := 0; ; attempt++ {
+		var (
+			reused, started bool
+			c               *sane.Conn
+		)
+		if c, reused, err = s.open(job.Device); err != nil {
+			return err
+		}
+
+		started, err = s.scan(c, job, obs, out, &n)
+		s.release(err)
+
+		if err == nil || started || !reused || attempt > 0 {
+			return err
+		}
+		if _, ok := err.(UnsupportedError); ok {
+			return err
+		}
+		// The kept device failed before scanning anything, it might have
+		// been reset in the meantime: try once more with a fresh one
+	}
+}
+
+// scan executes the job on the opened device, started reports whether
+// the observer was informed about the start of the job
+func (s *SANE) scan(c *sane.Conn, job Job, obs Observer, out chan<- image.Image, n *int) (started bool, err error) {
+	if err = checkResolutionSupported(c, job.Resolution); err != nil {
+		return false, err
+	}
+	if err = checkDepthSupported(c, job.Depth); err != nil {
+		return false, err
+	}
+
+	opts := job.Options
+	if isTestDevice(s.dev) {
+		opts = testDeviceOptions(c, opts)
+	}
+	if opts, err = flatbedOptions(c, opts); err != nil {
+		return false, err
+	}
+
+	applied := []AppliedOption{}
+	for _, name := range sortedOptionNames(opts) {
+		o, err := s.setOption(c, name, opts[name])
+		if err != nil {
+			return false, err
+		}
+		applied = append(applied, o)
+	}
+
+	values := effectiveOptions(c, applied)
+	if r, ok := obs.(OptionReporter); ok {
+		r.OptionsApplied(applied)
+	}
+	obs.Started(s.dev, values)
+
+	if job.Context != nil {
+		// Aborts the page currently read, sane_cancel may be called
+		// while another call is in progress
+		stop := context.AfterFunc(job.Context, c.Cancel)
+		defer stop()
+	}
+
+	for {
+		if err = job.canceled(); err != nil {
+			return true, err
+		}
+
+		var page *scannedPage
+		err := s.Retry.do("read page", busyError, func() (err error) {
+			page, err = readPage(c)
+			return err
+		})
+		if err != nil {
+			if ctxErr := job.canceled(); ctxErr != nil {
+				return true, ctxErr
+			}
+			if err == sane.ErrEmpty && *n > 0 {
+				// This is expected in multi-page scenarios and signals
+				// there are no more pages to come.
+				return true, nil
+			}
+			if err == sane.ErrIo {
+				return true, UnavailableError(fmt.Sprintf("Lost connection to the scanner: %s", err))
+			}
+			return true, err
+		}
+
+		if job.PageLimit > 0 && *n >= job.PageLimit {
+			// The device is cancelled and closed by release
+			return true, PageLimitError(job.PageLimit)
+		}
+
+		out <- page
+		*n++
+
+		if err = obs.PageScanned(*n); err != nil {
+			return true, err
+		}
+
+		if job.MaxPages > 0 && *n >= job.MaxPages {
+			return true, nil
+		}
+	}
+}
+
+// open returns the device kept open from the previous scan (reused is
+// true) or initializes SANE and opens the device given (configured one
+// if empty)
+func (s *SANE) open(device string) (c *sane.Conn, reused bool, err error) {
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+
+	if device == "" {
+		device = s.Device
+	}
+
+	if s.conn != nil && device != "" && s.dev.Name != device {
+		// Another device is kept open
+		s.closeConn()
+	}
+
+	if s.conn != nil {
+		return s.conn, true, nil
+	}
+
+	if err = saneInit(); err != nil {
+		return nil, false, fmt.Errorf("Unable to initialize SANE: %s", err)
+	}
+
+	devs, err := sane.Devices()
+	if err != nil {
+		saneExit()
+		return nil, false, fmt.Errorf("Unable to list devices: %s", err)
+	}
+
+	dev, err := selectDevice(devs, device, s.DeviceMatch)
+	if err != nil {
+		saneExit()
+		return nil, false, err
+	}
+
+	if err = s.Retry.do("open", transientError, func() (err error) {
+		c, err = sane.Open(dev.Name)
+		return err
+	}); err != nil {
+		saneExit()
+		if err == sane.ErrIo || err == sane.ErrInvalid {
+			return nil, false, UnavailableError(fmt.Sprintf("Unable to open scanner: %s", err))
+		}
+		return nil, false, fmt.Errorf("Unable to open scanner: %w", err)
+	}
+
+	s.conn, s.dev = c, dev
+	return c, false, nil
+}
+
+// release ends the scan on the device and keeps it open for the next
+// one unless it failed in a way leaving the device in an unknown state
+func (s *SANE) release(err error) {
+	s.conn.Cancel()
+
+	keep := err == nil || err == sane.ErrEmpty
+	if _, ok := err.(UnsupportedError); ok {
+		keep = true
+	}
+
+	if !keep || s.IdleTimeout <= 0 {
+		s.closeConn()
+		return
+	}
+
+	s.idleGen++
+	gen := s.idleGen
+	s.idle = time.AfterFunc(s.IdleTimeout, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		// A scan might have taken the device while waiting for the lock
+		if gen == s.idleGen && s.idle != nil {
+			s.idle = nil
+			s.closeConn()
+		}
+	})
+}
+
+// closeConn closes the kept device and tears SANE down
+func (s *SANE) closeConn() {
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+
+	if s.conn == nil {
+		return
+	}
+
+	s.conn.Close()
+	saneExit()
+	s.conn = nil
+}
+
+var (
+	// saneUsers counts the SANE instances needing SANE initialized, the
+	// members of a Pool share the process wide SANE library
+	saneUsers     int
+	saneUsersLock sync.Mutex
+)
+
+// saneInit initializes SANE for the first user
+func saneInit() error {
+	saneUsersLock.Lock()
+	defer saneUsersLock.Unlock()
+
+	if saneUsers == 0 {
+		if err := sane.Init(); err != nil {
+			return err
+		}
+	}
+	saneUsers++
+	return nil
+}
+
+// saneExit tears SANE down once the last user is done, tearing it down
+// earlier would close the devices of the others
+func saneExit() {
+	saneUsersLock.Lock()
+	defer saneUsersLock.Unlock()
+
+	if saneUsers--; saneUsers == 0 {
+		sane.Exit()
+	}
+}
+
+// selectDevice returns the device with the given name or the first one
+// (matching match if set) if name is empty
+func selectDevice(devs []sane.Device, name string, match *regexp.Regexp) (sane.Device, error) {
+	if len(devs) < 1 {
+		return sane.Device{}, UnavailableError("No scanners found")
+	}
+
+	if name == "" && match != nil {
+		for _, d := range devs {
+			if DeviceMatches(d, match) {
+				return d, nil
+			}
+		}
+		return sane.Device{}, UnavailableError(fmt.Sprintf("No scanner matching %q found", match.String()))
+	}
+
+	if name == "" {
+		return devs[0], nil
+	}
+
+	for _, d := range devs {
+		if d.Name == name {
+			return d, nil
+		}
+	}
+	return sane.Device{}, UnavailableError(fmt.Sprintf("Scanner %q not found", name))
+}
+
+// isTestDevice reports whether the device is provided by the SANE
+// "test" backend simulating a scanner without hardware
+func isTestDevice(dev sane.Device) bool {
+	return strings.HasPrefix(dev.Name, "test:")
+}
+
+// testDeviceOptions adapts the options meant for a document scanner to
+// the test backend: the feeder is simulated by its "Automatic Document
+// Feeder" source unless the flatbed is requested and options it does
+// not know are dropped
+func testDeviceOptions(c *sane.Conn, opts map[string]interface{}) map[string]interface{} {
+	known := map[string]bool{}
+	for _, o := range c.Options() {
+		known[o.Name] = true
+	}
+
+	out := map[string]interface{}{}
+	for name, value := range opts {
+		if !known[name] {
+			continue
+		}
+		if name == "source" && value != SourceFlatbed {
+			value = "Automatic Document Feeder"
+		}
+		out[name] = value
+	}
+	return out
+}
+
+// adaptOptionValue converts int values of float options as SANE is
+// strict about the type and configuration formats tend to lose the
+// fraction of values like 297.0
+func adaptOptionValue(c *sane.Conn, name string, value interface{}) interface{} {
+	i, ok := value.(int)
+	if !ok {
+		return value
+	}
+
+	for _, o := range c.Options() {
+		if o.Name == name && o.Type == sane.TypeFloat {
+			return float64(i)
+		}
+	}
+	return value
+}
+
+// optionValues reads the current values of all active options
+func optionValues(c *sane.Conn) map[string]interface{} {
+	values := map[string]interface{}{}
+	for _, o := range c.Options() {
+		if !o.IsActive || o.Type == sane.TypeButton {
+			continue
+		}
+		if v, err := c.GetOption(o.Name); err == nil {
+			values[o.Name] = v
+		}
+	}
+	return values
+}
+
+// checkResolutionSupported validates the requested resolution against
+// the constraints the device reports for its "resolution" option
+func checkResolutionSupported(c *sane.Conn, dpi int) error {
+	if dpi == 0 {
+		return nil
+	}
+
+	for _, o := range c.Options() {
+		if o.Name != "resolution" {
+			continue
+		}
+
+		if o.ConstrRange != nil {
+			min, max := optionNumber(o.ConstrRange.Min), optionNumber(o.ConstrRange.Max)
+			if float64(dpi) < min || float64(dpi) > max {
+				return UnsupportedError(fmt.Sprintf("Resolution %d is not supported by the device (range %.0f-%.0f)", dpi, min, max))
+			}
+			return nil
+		}
+
+		if len(o.ConstrSet) > 0 {
+			for _, v := range o.ConstrSet {
+				if optionNumber(v) == float64(dpi) {
+					return nil
+				}
+			}
+			return UnsupportedError(fmt.Sprintf("Resolution %d is not supported by the device (supported: %v)", dpi, o.ConstrSet))
+		}
+
+		return nil
+	}
+
+	// Device does not expose a resolution option, let SetOption complain
+	return nil
+}
+
+// checkDepthSupported validates depths above 8 bits against the
+// "depth" option of the device, document scanners default to 8 bits
+func checkDepthSupported(c *sane.Conn, depth int) error {
+	if depth <= 8 {
+		return nil
+	}
+
+	for _, o := range c.Options() {
+		if o.Name != "depth" {
+			continue
+		}
+		for _, v := range o.ConstrSet {
+			if optionNumber(v) == float64(depth) {
+				return nil
+			}
+		}
+		return UnsupportedError(fmt.Sprintf("Depth %d is not supported by the device (supported: %v)", depth, o.ConstrSet))
+	}
+
+	return UnsupportedError(fmt.Sprintf("Depth %d is not supported by the device, it has no depth option", depth))
+}
+
+// DeviceOptions describes the options of the device used for scanning
+// and keeps it open for the next scan
+func (s *SANE) DeviceOptions() (DeviceCapabilities, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, _, err := s.open("")
+	if err != nil {
+		return DeviceCapabilities{}, err
+	}
+	defer s.release(nil)
+
+	return DeviceCapabilities{Device: s.dev, Options: describeOptions(c)}, nil
+}
+
+// describeOptions reads all options with their current values
+func describeOptions(c *sane.Conn) []DeviceOption {
+	opts := []DeviceOption{}
+	for _, o := range c.Options() {
+		do := DeviceOption{Option: o}
+		if o.IsActive && o.Type != sane.TypeButton {
+			do.Value, _ = c.GetOption(o.Name)
+		}
+		opts = append(opts, do)
+	}
+	return opts
+}
+
+// PaperLoaded reads the named sensor option (e.g. "page-loaded") of the
+// device, it fails with sane.ErrBusy while the device is in use
+func (s *SANE) PaperLoaded(option string) (bool, error) {
+	if !s.lock.TryLock() {
+		return false, sane.ErrBusy
+	}
+	defer s.lock.Unlock()
+
+	c, _, err := s.open("")
+	if err != nil {
+		return false, err
+	}
+	defer s.release(nil)
+
+	v, err := c.GetOption(option)
+	if err != nil {
+		return false, fmt.Errorf("Unable to read sensor %s: %w", option, err)
+	}
+
+	switch l := v.(type) {
+	case bool:
+		return l, nil
+	case int:
+		return l != 0, nil
+	}
+	return false, UnsupportedError(fmt.Sprintf("Sensor %s is no boolean option", option))
+}
+
+// Ping opens the device and reads its resolution to keep it awake, it
+// fails with sane.ErrBusy while the device is in use. A kept device not
+// answering is closed and opened once more to recover it.
+func (s *SANE) Ping() error {
+	if !s.lock.TryLock() {
+		return sane.ErrBusy
+	}
+	defer s.lock.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		c, reused, err := s.open("")
+		if err != nil {
+			return err
+		}
+
+		if _, err = c.GetOption("resolution"); err == nil {
+			s.release(nil)
+			return nil
+		}
+
+		s.closeConn()
+		if !reused || attempt > 0 {
+			return fmt.Errorf("Unable to read option resolution: %w", err)
+		}
+	}
+}
+
+// Session is a device opened for remote use, e.g. by clients of the
+// SANE network protocol. It has exclusive access to SANE until closed.
+type Session struct {
+	Conn   *sane.Conn
+	Device sane.Device
+
+	s    *SANE
+	once sync.Once
+}
+
+// Close releases the device, it is closed as the remote client might
+// have left it in any state
+func (x *Session) Close() {
+	x.once.Do(func() {
+		x.s.closeConn()
+		x.s.lock.Unlock()
+	})
+}
+
+// OpenSession opens the device given (configured one if empty) for
+// remote use, it fails with sane.ErrBusy while a scan is running
+func (s *SANE) OpenSession(device string) (*Session, error) {
+	if !s.lock.TryLock() {
+		return nil, sane.ErrBusy
+	}
+
+	c, _, err := s.open(device)
+	if err != nil {
+		s.lock.Unlock()
+		return nil, err
+	}
+
+	return &Session{Conn: c, Device: s.dev, s: s}, nil
+}
+
+// Capabilities lists all devices with their options and current values
+func (s *SANE) Capabilities() ([]DeviceCapabilities, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn == nil {
+		if err := saneInit(); err != nil {
+			return nil, fmt.Errorf("Unable to initialize SANE: %s", err)
+		}
+		defer saneExit()
+	}
+
+	devs, err := sane.Devices()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list devices: %s", err)
+	}
+
+	caps := []DeviceCapabilities{}
+	for _, d := range devs {
+		dc := DeviceCapabilities{Device: d}
+
+		// The device kept open is not able to be opened a second time
+		c, kept := s.conn, s.conn != nil && d.Name == s.dev.Name
+		if !kept {
+			if c, err = sane.Open(d.Name); err != nil {
+				dc.Error = fmt.Sprintf("Unable to open device: %s", err)
+				caps = append(caps, dc)
+				continue
+			}
+		}
+
+		dc.Options = describeOptions(c)
+
+		if !kept {
+			c.Close()
+		}
+		caps = append(caps, dc)
+	}
+
+	return caps, nil
+}
+
+// setOption sets the option on the device and records the side effects
+// reported by the backend
+func (s *SANE) setOption(c *sane.Conn, name string, value interface{}) (AppliedOption, error) {
+	var (
+		applied = AppliedOption{Name: name, Requested: value}
+		info    sane.Info
+	)
+	value = adaptOptionValue(c, name, value)
+	if err := s.Retry.do("set option "+name, transientError, func() (err error) {
+		info, err = c.SetOption(name, value)
+		return err
+	}); err != nil {
+		return applied, fmt.Errorf("Unable to set option: %w", err)
+	}
+
+	applied.Inexact, applied.ReloadOptions = info.Inexact, info.ReloadOpts
+	return applied, nil
+}
+
+// effectiveOptions reads the values of all active options and records
+// the effective values of the applied options, options set later might
+// have changed the ones set before
+func effectiveOptions(c *sane.Conn, applied []AppliedOption) map[string]interface{} {
+	values := optionValues(c)
+	for i, o := range applied {
+		if o.Error != "" {
+			continue
+		}
+		applied[i].Effective = values[o.Name]
+		applied[i].Adjusted = applied[i].Inexact || !sameOptionValue(o.Requested, values[o.Name])
+	}
+	return values
+}
+
+// ValidateOptions implements OptionValidator: the options of the job
+// are set on the device like for a scan, the values the backend ended
+// up with are read back and the device is released without starting
+// a scan. It fails with sane.ErrBusy while the device is in use.
+func (s *SANE) ValidateOptions(job Job) (OptionReport, error) {
+	if !s.lock.TryLock() {
+		return OptionReport{}, sane.ErrBusy
+	}
+	defer s.lock.Unlock()
+
+	c, _, err := s.open(job.Device)
+	if err != nil {
+		return OptionReport{}, err
+	}
+	// The options set stay on the kept device like after a scan
+	defer s.release(nil)
+
+	if err = checkResolutionSupported(c, job.Resolution); err != nil {
+		return OptionReport{}, err
+	}
+	if err = checkDepthSupported(c, job.Depth); err != nil {
+		return OptionReport{}, err
+	}
+
+	opts := job.Options
+	if isTestDevice(s.dev) {
+		opts = testDeviceOptions(c, opts)
+	}
+	if opts, err = flatbedOptions(c, opts); err != nil {
+		return OptionReport{}, err
+	}
+
+	report := OptionReport{Device: s.dev, Valid: true}
+	for _, name := range sortedOptionNames(opts) {
+		applied, err := s.setOption(c, name, opts[name])
+		if err != nil {
+			applied.Error = err.Error()
+			report.Valid = false
+		}
+		report.Options = append(report.Options, applied)
+	}
+	report.Values = effectiveOptions(c, report.Options)
+
+	return report, nil
+}
@@ -0,0 +1,57 @@
+package scanner
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math"
+)
+
+// Shrink returns a copy of the page encoded as JPEG with the quality,
+// scaled by scale (at most 1) and converted to gray if requested to
+// reduce the size of the document. The page is re-encoded from its
+// decoded image or else from its data, bilevel pages are returned
+// unchanged as they are small already.
+func (p *Page) Shrink(ops ImageOps, quality int, scale float64, gray bool) (*Page, error) {
+	if p.ImageType == "ccitt" || p.Blank {
+		return p, nil
+	}
+
+	img, err := p.DecodedImage()
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		data, err := p.ImageData()
+		if err != nil {
+			return nil, err
+		}
+		if img, _, err = image.Decode(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("Unable to decode page %d: %s", p.Index+1, err)
+		}
+	}
+
+	if scale < 1 {
+		b := img.Bounds()
+		img = ops.Fit(img, int(math.Round(float64(b.Dx())*scale)), int(math.Round(float64(b.Dy())*scale)))
+	}
+
+	color := p.Color
+	if gray {
+		img = ops.Gray(img)
+		color = ColorModeGray
+	}
+
+	buf := new(bytes.Buffer)
+	if err := ops.EncodeJPEG(buf, img, quality); err != nil {
+		return nil, fmt.Errorf("Unable to encode page %d: %s", p.Index+1, err)
+	}
+
+	s := *p
+	s.Data, s.ImageType, s.Color = buf.Bytes(), "jpeg", color
+	s.Width, s.Height = img.Bounds().Dx(), img.Bounds().Dy()
+	// The page keeps its size in the PDF
+	s.DPI = int(math.Round(float64(p.DPI) * float64(s.Width) / float64(p.Width)))
+	s.Image, s.data, s.image = nil, nil, nil
+	return &s, nil
+}
@@ -0,0 +1,215 @@
+package scanner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// spoolFilePrefix marks the files of a Spool, others in Dir are kept
+const spoolFilePrefix = "scansnap-page-"
+
+// ErrSpoolFull is returned for pages not fitting into the spool anymore
+var ErrSpoolFull = errors.New("Spool size limit reached")
+
+// Spool keeps the encoded and decoded images of the pages in files
+// instead of memory so large batches do not need to fit into it. The
+// files of pages no longer referenced are removed when the pages are
+// garbage collected or using Page.Release.
+type Spool struct {
+	Dir string
+	// MaxSize limits the size of all spooled files in bytes (0 = no
+	// limit)
+	MaxSize int64
+
+	lock sync.Mutex
+	size int64
+}
+
+// NewSpool creates the directory and removes the files left over by a
+// previous run
+func NewSpool(dir string, maxSize int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("Unable to create spool directory: %s", err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list spool directory: %s", err)
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), spoolFilePrefix) {
+			os.Remove(path.Join(dir, f.Name()))
+		}
+	}
+
+	return &Spool{Dir: dir, MaxSize: maxSize}, nil
+}
+
+// Size returns the size of the currently spooled files in bytes
+func (s *Spool) Size() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.size
+}
+
+func (s *Spool) reserve(size int64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.MaxSize > 0 && s.size+size > s.MaxSize {
+		return false
+	}
+	s.size += size
+	return true
+}
+
+func (s *Spool) unreserve(size int64) {
+	s.lock.Lock()
+	s.size -= size
+	s.lock.Unlock()
+}
+
+func (s *Spool) store(data []byte) (*spoolFile, error) {
+	size := int64(len(data))
+	if !s.reserve(size) {
+		// Pages dropped without being released are only removed by
+		// their finalizers
+		runtime.GC()
+		if !s.reserve(size) {
+			return nil, ErrSpoolFull
+		}
+	}
+
+	f, err := ioutil.TempFile(s.Dir, spoolFilePrefix)
+	if err != nil {
+		s.unreserve(size)
+		return nil, fmt.Errorf("Unable to create spool file: %s", err)
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		s.unreserve(size)
+		return nil, fmt.Errorf("Unable to write spool file: %s", err)
+	}
+
+	sf := &spoolFile{spool: s, path: f.Name(), size: size}
+	runtime.SetFinalizer(sf, (*spoolFile).remove)
+	return sf, nil
+}
+
+// spoolFile is a file of the Spool holding the data of a page
+type spoolFile struct {
+	spool *Spool
+	path  string
+	size  int64
+	once  sync.Once
+}
+
+func (f *spoolFile) read() ([]byte, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read spool file: %s", err)
+	}
+	return data, nil
+}
+
+func (f *spoolFile) remove() {
+	f.once.Do(func() {
+		os.Remove(f.path)
+		f.spool.unreserve(f.size)
+	})
+}
+
+// SpoolTo moves Data and Image of the page and its original into files
+// of the spool
+func (p *Page) SpoolTo(s *Spool) error {
+	var err error
+
+	if p.Data != nil {
+		if p.data, err = s.store(p.Data); err != nil {
+			return err
+		}
+		p.Data = nil
+	}
+
+	if p.Image != nil {
+		// Compressed fast as this is only a fraction of the raw pixels
+		buf := new(bytes.Buffer)
+		enc := png.Encoder{CompressionLevel: png.BestSpeed}
+		if err = enc.Encode(buf, p.Image); err != nil {
+			return fmt.Errorf("Unable to encode image for spooling: %s", err)
+		}
+		if p.image, err = s.store(buf.Bytes()); err != nil {
+			return err
+		}
+		p.Image = nil
+	}
+
+	if p.Original != nil {
+		return p.Original.SpoolTo(s)
+	}
+	return nil
+}
+
+// ImageData returns the encoded image, read from the spool if the page
+// was spooled
+func (p *Page) ImageData() ([]byte, error) {
+	if p.data == nil {
+		return p.Data, nil
+	}
+	return p.data.read()
+}
+
+// DecodedImage returns the decoded image if it was kept, read from the
+// spool if the page was spooled
+func (p *Page) DecodedImage() (image.Image, error) {
+	if p.image == nil {
+		return p.Image, nil
+	}
+
+	data, err := p.image.read()
+	if err != nil {
+		return nil, err
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode spooled image: %s", err)
+	}
+	return img, nil
+}
+
+// Size returns the size of the encoded image in bytes
+func (p *Page) Size() int {
+	if p.data == nil {
+		return len(p.Data)
+	}
+	return int(p.data.size)
+}
+
+// Release removes the spooled files of the page, its images are not
+// available afterwards
+func (p *Page) Release() {
+	for _, f := range []*spoolFile{p.data, p.image} {
+		if f != nil {
+			f.remove()
+		}
+	}
+	p.data, p.image = nil, nil
+
+	if p.Original != nil {
+		p.Original.Release()
+	}
+}
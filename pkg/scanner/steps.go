@@ -0,0 +1,329 @@
+package scanner
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/pdfgen"
+	"github.com/disintegration/imaging"
+)
+
+// Values of the pages option selecting the pages a step applies to
+const (
+	stepPagesAll   = "all"
+	stepPagesFront = "front"
+	stepPagesBack  = "back"
+)
+
+func pagesOption(o StepOptions) (string, error) {
+	switch v := o.String("pages", stepPagesAll); v {
+	case stepPagesAll, stepPagesFront, stepPagesBack:
+		return v, nil
+	default:
+		return "", fmt.Errorf("invalid pages %q (supported: all, front, back)", v)
+	}
+}
+
+func matchesPages(pages string, p *StepPage) bool {
+	switch pages {
+	case stepPagesFront:
+		return !p.Back
+	case stepPagesBack:
+		return p.Back
+	}
+	return true
+}
+
+// resizeStep scales the page to dpi (default: the output resolution)
+type resizeStep struct{ dpi int }
+
+func newResizeStep(o StepOptions) (Step, error) {
+	dpi, err := o.Int("dpi", 0)
+	if err != nil {
+		return nil, err
+	}
+	if dpi < 0 {
+		return nil, fmt.Errorf("dpi must not be negative")
+	}
+	return resizeStep{dpi}, nil
+}
+
+func (r resizeStep) Apply(p *StepPage) error {
+	dpi := r.dpi
+	if dpi == 0 {
+		dpi = p.OutputDPI
+	}
+
+	p.Image = reducePageDPI(p.Ops, p.Image, p.DPI, dpi)
+	p.DPI = dpi
+	return nil
+}
+
+func (resizeStep) KeepsDepth() bool { return true }
+
+// rotateStep rotates the pages clockwise by a multiple of 90 degrees
+type rotateStep struct {
+	angle int
+	pages string
+}
+
+func newRotateStep(o StepOptions) (Step, error) {
+	angle, err := o.Int("angle", 0)
+	if err != nil {
+		return nil, err
+	}
+	if angle%90 != 0 || angle <= 0 || angle >= 360 {
+		return nil, fmt.Errorf("angle must be 90, 180 or 270")
+	}
+
+	pages, err := pagesOption(o)
+	if err != nil {
+		return nil, err
+	}
+
+	return rotateStep{angle, pages}, nil
+}
+
+func (r rotateStep) Apply(p *StepPage) error {
+	if matchesPages(r.pages, p) {
+		p.Image = RotatePage(p.Ops, p.Image, r.angle)
+	}
+	return nil
+}
+
+func (rotateStep) KeepsDepth() bool { return true }
+
+// deskewStep straightens pages fed at an angle, the skew is estimated
+// like for the misfeed detection
+type deskewStep struct{}
+
+func newDeskewStep(o StepOptions) (Step, error) { return deskewStep{}, nil }
+
+func (deskewStep) Apply(p *StepPage) error {
+	angle, ok := estimateSkew(p.Image)
+	if !ok || angle == 0 {
+		return nil
+	}
+
+	// The corners rotated into the page are filled with paper white and
+	// the page keeps its size
+	b := p.Image.Bounds()
+	p.Image = imaging.CropCenter(imaging.Rotate(p.Image, angle, color.White), b.Dx(), b.Dy())
+	return nil
+}
+
+// despeckleStep removes dark specks (dust, paper fibres) of at most
+// size x size pixels surrounded by background
+type despeckleStep struct{ size int }
+
+func newDespeckleStep(o StepOptions) (Step, error) {
+	size, err := o.Int("size", 2)
+	if err != nil {
+		return nil, err
+	}
+	if size < 1 {
+		return nil, fmt.Errorf("size must be at least 1")
+	}
+	return despeckleStep{size}, nil
+}
+
+func (d despeckleStep) Apply(p *StepPage) error {
+	specks := []image.Point{}
+	findDarkComponents(toGray(p.Image), 128, d.size, nil, func(c darkComponent) {
+		specks = append(specks, c.Pixels...)
+	})
+
+	if len(specks) == 0 {
+		return nil
+	}
+
+	out := editableCopy(p.Image)
+	for _, pt := range specks {
+		out.Set(pt.X, pt.Y, color.White)
+	}
+	p.Image = out
+
+	return nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// binarizeStep reduces the page to black and white using a fixed
+// threshold or adaptive thresholding (threshold 0)
+type binarizeStep struct{ threshold int }
+
+func newBinarizeStep(o StepOptions) (Step, error) {
+	threshold, err := o.Int("threshold", 0)
+	if err != nil {
+		return nil, err
+	}
+	if threshold < 0 || threshold > 255 {
+		return nil, fmt.Errorf("threshold must be between 0 and 255")
+	}
+	return binarizeStep{threshold}, nil
+}
+
+func (b binarizeStep) Apply(p *StepPage) error {
+	g := p.Ops.Gray(p.Image)
+	if b.threshold == 0 {
+		p.Image = binarizeSauvola(g, p.DPI)
+		return nil
+	}
+
+	w, h := g.Bounds().Dx(), g.Bounds().Dy()
+	out := image.NewPaletted(image.Rect(0, 0, w, h), bilevelPalette)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if int(g.Pix[y*g.Stride+x]) >= b.threshold {
+				out.Pix[y*out.Stride+x] = 1
+			}
+		}
+	}
+	p.Image = out
+	return nil
+}
+
+// Positions of stamps on the page
+var stampPositions = map[string]struct {
+	x     float64 // 0 = left, 0.5 = center, 1 = right
+	top   bool
+	align string
+}{
+	"top-left":     {0, true, pdfgen.AlignLeft},
+	"top":          {0.5, true, pdfgen.AlignCenter},
+	"top-right":    {1, true, pdfgen.AlignRight},
+	"bottom-left":  {0, false, pdfgen.AlignLeft},
+	"bottom":       {0.5, false, pdfgen.AlignCenter},
+	"bottom-right": {1, false, pdfgen.AlignRight},
+}
+
+// StampData is available in the text template of the stamp step
+type StampData struct {
+	Page int // Number of the page in the batch (1-based)
+	// Bates is the Bates number of the page: the prefix followed by the
+	// page number counted from the start number
+	Bates string
+	Date  string
+	Time  string
+	// Now allows other date formats: {{ .Now.Format "02.01.2006" }}
+	Now time.Time
+}
+
+// stampStep prints a text onto the pages
+type stampStep struct {
+	text     *template.Template
+	position string
+	size     float64 // points
+	margin   float64 // mm
+	pages    string
+
+	batesPrefix             string
+	batesStart, batesDigits int
+}
+
+func newStampStep(o StepOptions) (Step, error) {
+	var (
+		s   = stampStep{position: o.String("position", "bottom-right")}
+		err error
+	)
+
+	text := o.String("text", "")
+	if text == "" {
+		return nil, fmt.Errorf("text is required")
+	}
+	if s.text, err = template.New("stamp").Parse(text); err != nil {
+		return nil, fmt.Errorf("invalid text template: %s", err)
+	}
+	if err = s.text.Execute(new(bytes.Buffer), StampData{}); err != nil {
+		return nil, fmt.Errorf("invalid text template: %s", err)
+	}
+
+	if _, ok := stampPositions[s.position]; !ok {
+		names := []string{}
+		for n := range stampPositions {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("invalid position %q (supported: %s)", s.position, strings.Join(names, ", "))
+	}
+
+	if s.size, err = o.Float("size", 8); err != nil {
+		return nil, err
+	}
+	if s.margin, err = o.Float("margin", 5); err != nil {
+		return nil, err
+	}
+	if s.size <= 0 || s.margin < 0 {
+		return nil, fmt.Errorf("size must be positive and margin must not be negative")
+	}
+	if s.pages, err = pagesOption(o); err != nil {
+		return nil, err
+	}
+
+	s.batesPrefix = o.String("bates-prefix", "")
+	if s.batesStart, err = o.Int("bates-start", 1); err != nil {
+		return nil, err
+	}
+	if s.batesDigits, err = o.Int("bates-digits", 6); err != nil {
+		return nil, err
+	}
+	if s.batesStart < 0 || s.batesDigits < 1 || s.batesDigits > 20 {
+		return nil, fmt.Errorf("bates-start must not be negative and bates-digits must be between 1 and 20")
+	}
+
+	return s, nil
+}
+
+func (s stampStep) Apply(p *StepPage) error {
+	if !matchesPages(s.pages, p) {
+		return nil
+	}
+
+	now := time.Now()
+	buf := new(bytes.Buffer)
+	if err := s.text.Execute(buf, StampData{
+		Page:  p.Index + 1,
+		Bates: fmt.Sprintf("%s%0*d", s.batesPrefix, s.batesDigits, s.batesStart+p.Index),
+		Date:  now.Format("2006-01-02"),
+		Time:  now.Format("15:04"),
+		Now:   now,
+	}); err != nil {
+		return fmt.Errorf("Unable to render stamp: %s", err)
+	}
+
+	var (
+		pos               = stampPositions[s.position]
+		widthPt, heightPt = p.sizePt()
+		marginPt          = s.margin * 72 / 25.4
+		t                 = pdfgen.Text{Text: buf.String(), Align: pos.align, Size: s.size / heightPt}
+	)
+
+	t.X = pos.x + marginPt/widthPt*(1-2*pos.x)
+	if pos.top {
+		// Baseline below the margin by the height of capitals
+		t.Y = (marginPt + 0.72*s.size) / heightPt
+	} else {
+		t.Y = 1 - marginPt/heightPt
+	}
+
+	p.Text = append(p.Text, t)
+	return nil
+}
@@ -0,0 +1,218 @@
+package scanner
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+)
+
+// TIFF compression schemes of the pages written by WriteTIFF
+const (
+	tiffCompressionG4      = 4
+	tiffCompressionDeflate = 8
+)
+
+// tiffOrientations maps the clockwise rotation of pages to the TIFF
+// orientation turning them when displayed
+var tiffOrientations = map[int]uint16{0: 1, 90: 6, 180: 3, 270: 8}
+
+// WriteTIFF writes the pages into a multi-page TIFF with one directory
+// per page and the capture metadata. Black and white pages keep their
+// CCITT G4 data, the others are stored losslessly using Deflate. Blank
+// pages are skipped, the text drawn on the pages in the PDF and the OCR
+// text layer are not included.
+func WriteTIFF(w io.Writer, pages []*Page, m ImageMetadata) error {
+	var kept []*Page
+	for _, p := range pages {
+		if !p.Blank {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) == 0 {
+		return fmt.Errorf("No pages to write")
+	}
+
+	const headerLen = 8
+	header := new(bytes.Buffer)
+	header.WriteString("MM\x00\x2A")
+	binary.Write(header, binary.BigEndian, uint32(headerLen))
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+
+	// Pages are written one by one, only the offset of the next
+	// directory has to be known when writing one
+	offset := uint64(headerLen)
+	for i, p := range kept {
+		entries, data, err := tiffPage(p)
+		if err != nil {
+			return fmt.Errorf("Unable to encode page %d: %s", p.Index+1, err)
+		}
+
+		entries = append(entries,
+			exifLongValue(0x00FE, 2), // NewSubfileType: page of a multi-page document
+			exifShortValue(0x0112, tiffOrientations[(p.Rotate%360+360)%360]),
+			exifLongValue(0x0116, uint32(p.Height)),          // RowsPerStrip
+			exifShorts(0x0129, uint16(i), uint16(len(kept))), // PageNumber
+			exifLongValue(0x0111, 0),                         // StripOffsets, set below
+			exifLongValue(0x0117, uint32(len(data))),         // StripByteCounts
+			exifRationalValue(0x011A, uint32(p.DPI), 1),      // XResolution
+			exifRationalValue(0x011B, uint32(p.DPI), 1),      // YResolution
+			exifShortValue(0x0128, 2),                        // ResolutionUnit: inch
+		)
+		if m.Software != "" {
+			entries = append(entries, exifString(0x0131, m.Software))
+		}
+		if !m.Time.IsZero() {
+			entries = append(entries, exifString(0x0132, m.Time.Format("2006:01:02 15:04:05"))) // DateTime
+		}
+		if m.Make != "" {
+			entries = append(entries, exifString(0x010F, m.Make))
+		}
+		if m.Model != "" {
+			entries = append(entries, exifString(0x0110, m.Model))
+		}
+
+		// The strip follows the directory and its values
+		stripOffset := offset + uint64(ifdLen(entries))
+		end := stripOffset + uint64(len(data)+len(data)%2)
+		if end > math.MaxUint32 {
+			return fmt.Errorf("Document exceeds the 4 GiB supported by TIFF")
+		}
+		for j := range entries {
+			if entries[j].tag == 0x0111 {
+				binary.BigEndian.PutUint32(entries[j].value, uint32(stripOffset))
+			}
+		}
+
+		var next uint32
+		if i < len(kept)-1 {
+			next = uint32(end)
+		}
+
+		buf := new(bytes.Buffer)
+		writeIFD(buf, entries, uint32(offset), next)
+		buf.Write(data)
+		if len(data)%2 == 1 {
+			// Directories start on word boundaries
+			buf.WriteByte(0)
+		}
+		if _, err = w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		offset = end
+	}
+
+	return nil
+}
+
+// tiffPage returns the tags describing the image of the page and the
+// strip containing it
+func tiffPage(p *Page) ([]exifEntry, []byte, error) {
+	data, err := p.ImageData()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	size := []exifEntry{
+		exifLongValue(0x0100, uint32(p.Width)),  // ImageWidth
+		exifLongValue(0x0101, uint32(p.Height)), // ImageLength
+	}
+
+	var img image.Image
+	switch p.ImageType {
+	case "ccitt":
+		return append(size,
+			exifShortValue(0x0102, 1), // BitsPerSample
+			exifShortValue(0x0103, tiffCompressionG4),
+			exifShortValue(0x0106, 0), // PhotometricInterpretation: WhiteIsZero
+			exifShortValue(0x0115, 1), // SamplesPerPixel
+		), data, nil
+
+	case "jpeg":
+		img, err = jpeg.Decode(bytes.NewReader(data))
+	case "png":
+		img, err = png.Decode(bytes.NewReader(data))
+	default:
+		return nil, nil, fmt.Errorf("Unsupported image type %q", p.ImageType)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to decode image: %s", err)
+	}
+
+	var (
+		pix         []byte
+		stride      int
+		bits        uint16
+		samples     = 3
+		photometric = uint16(2) // RGB
+		b           = img.Bounds()
+	)
+
+	switch src := img.(type) {
+	case *image.Gray:
+		pix, stride, bits, samples, photometric = src.Pix, src.Stride, 8, 1, 1 // BlackIsZero
+	case *image.Gray16:
+		pix, stride, bits, samples, photometric = src.Pix, src.Stride, 16, 1, 1
+	case *image.RGBA64, *image.NRGBA64:
+		dst := image.NewNRGBA64(b)
+		draw.Draw(dst, b, src, b.Min, draw.Src)
+		pix, stride, bits = rgbSamples(dst.Pix, dst.Stride, b.Dx(), b.Dy(), 2), 6*b.Dx(), 16
+	default:
+		dst := image.NewNRGBA(b)
+		draw.Draw(dst, b, src, b.Min, draw.Src)
+		pix, stride, bits = rgbSamples(dst.Pix, dst.Stride, b.Dx(), b.Dy(), 1), 3*b.Dx(), 8
+	}
+
+	rowLen := b.Dx() * samples * int(bits) / 8
+	compressed := new(bytes.Buffer)
+	zw := zlib.NewWriter(compressed)
+	for y := 0; y < b.Dy(); y++ {
+		if _, err = zw.Write(pix[y*stride : y*stride+rowLen]); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err = zw.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	bitsPerSample := make([]uint16, samples)
+	for i := range bitsPerSample {
+		bitsPerSample[i] = bits
+	}
+
+	return append(size,
+		exifShorts(0x0102, bitsPerSample...), // BitsPerSample
+		exifShortValue(0x0103, tiffCompressionDeflate),
+		exifShortValue(0x0106, photometric), // PhotometricInterpretation
+		exifShortValue(0x0115, uint16(samples)),
+	), compressed.Bytes(), nil
+}
+
+// rgbSamples drops the alpha channel of the rows of NRGBA pixels having
+// the given bytes per sample
+func rgbSamples(pix []byte, stride, w, h, sampleLen int) []byte {
+	out := make([]byte, 0, 3*sampleLen*w*h)
+	for y := 0; y < h; y++ {
+		row := pix[y*stride:]
+		for x := 0; x < w; x++ {
+			out = append(out, row[4*sampleLen*x:4*sampleLen*x+3*sampleLen]...)
+		}
+	}
+	return out
+}
+
+func exifShorts(tag uint16, values ...uint16) exifEntry {
+	v := make([]byte, 2*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint16(v[2*i:], value)
+	}
+	return exifEntry{tag: tag, typ: exifShort, count: uint32(len(values)), value: v}
+}
@@ -0,0 +1,135 @@
+package scanner
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"io/ioutil"
+	"testing"
+)
+
+// tiffDirectories returns the inline values of the short and long tags
+// of all directories of a big endian TIFF
+func tiffDirectories(t *testing.T, data []byte) []map[uint16]uint32 {
+	t.Helper()
+
+	if len(data) < 8 || string(data[:4]) != "MM\x00\x2A" {
+		t.Fatalf("invalid TIFF header %q", data[:4])
+	}
+
+	var dirs []map[uint16]uint32
+	for off := int(binary.BigEndian.Uint32(data[4:])); off != 0; {
+		if off%2 != 0 || off+2 > len(data) {
+			t.Fatalf("invalid directory offset %d", off)
+		}
+		n := int(binary.BigEndian.Uint16(data[off:]))
+		if off+2+12*n+4 > len(data) {
+			t.Fatalf("directory at %d exceeds the file", off)
+		}
+
+		tags := map[uint16]uint32{}
+		for i := 0; i < n; i++ {
+			e := data[off+2+12*i:]
+			switch binary.BigEndian.Uint16(e[2:]) {
+			case exifShort:
+				tags[binary.BigEndian.Uint16(e)] = uint32(binary.BigEndian.Uint16(e[8:]))
+			case exifLong:
+				tags[binary.BigEndian.Uint16(e)] = binary.BigEndian.Uint32(e[8:])
+			}
+		}
+		dirs = append(dirs, tags)
+
+		off = int(binary.BigEndian.Uint32(data[off+2+12*n:]))
+	}
+	return dirs
+}
+
+func TestWriteTIFF(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 30, 40))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i)
+	}
+	bw := image.NewGray(image.Rect(0, 0, 64, 20))
+	for i := range bw.Pix {
+		bw.Pix[i] = uint8(i%3) * 255
+	}
+
+	p := ImageProcessor{ScanDPI: 150, OutputDPI: 150, Lossless: true, Pipeline: Pipeline{}}
+	p.Color = ColorModeGray
+	grayPage, err := p.Process(0, gray)
+	if err != nil {
+		t.Fatalf("processing page: %s", err)
+	}
+	p.Color = ColorModeBW
+	bwPage, err := p.Process(2, bw)
+	if err != nil {
+		t.Fatalf("processing page: %s", err)
+	}
+	bwPage.Rotate = 90
+
+	buf := new(bytes.Buffer)
+	if err = WriteTIFF(buf, []*Page{grayPage, {Index: 1, Blank: true}, bwPage}, ImageMetadata{Software: "test"}); err != nil {
+		t.Fatalf("writing TIFF: %s", err)
+	}
+	data := buf.Bytes()
+
+	dirs := tiffDirectories(t, data)
+	if len(dirs) != 2 {
+		t.Fatalf("expected 2 directories without the blank page, got %d", len(dirs))
+	}
+
+	for i, tc := range []struct {
+		page        *Page
+		compression uint32
+		orientation uint32
+	}{
+		{grayPage, tiffCompressionDeflate, 1},
+		{bwPage, tiffCompressionG4, 6},
+	} {
+		tags := dirs[i]
+		if tags[0x0100] != uint32(tc.page.Width) || tags[0x0101] != uint32(tc.page.Height) {
+			t.Errorf("page %d: expected %dx%d pixels, got %dx%d", i, tc.page.Width, tc.page.Height, tags[0x0100], tags[0x0101])
+		}
+		if tags[0x0103] != tc.compression {
+			t.Errorf("page %d: expected compression %d, got %d", i, tc.compression, tags[0x0103])
+		}
+		if tags[0x0112] != tc.orientation {
+			t.Errorf("page %d: expected orientation %d, got %d", i, tc.orientation, tags[0x0112])
+		}
+		if tags[0x0129] != uint32(i) {
+			t.Errorf("page %d: expected page number %d, got %d", i, i, tags[0x0129])
+		}
+
+		start, end := int(tags[0x0111]), int(tags[0x0111]+tags[0x0117])
+		if end > len(data) {
+			t.Fatalf("page %d: strip exceeds the file", i)
+		}
+		strip := data[start:end]
+
+		if tc.compression == tiffCompressionG4 {
+			if !bytes.Equal(strip, tc.page.Data) {
+				t.Errorf("page %d: CCITT data was not kept", i)
+			}
+			continue
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(strip))
+		if err != nil {
+			t.Fatalf("page %d: reading strip: %s", i, err)
+		}
+		pix, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("page %d: inflating strip: %s", i, err)
+		}
+		if !bytes.Equal(pix, gray.Pix) {
+			t.Errorf("page %d: pixels differ", i)
+		}
+	}
+
+	if err = WriteTIFF(new(bytes.Buffer), []*Page{{Blank: true}}, ImageMetadata{}); err == nil {
+		t.Errorf("expected an error without pages")
+	}
+	if err = WriteTIFF(new(bytes.Buffer), []*Page{{Data: []byte("x"), ImageType: "gif"}}, ImageMetadata{}); err == nil {
+		t.Errorf("expected an error for an unsupported image type")
+	}
+}
@@ -0,0 +1,185 @@
+package scanner
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg" // Watermark images
+	_ "image/png"  // Watermark images
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Luzifer/scansnap-go/pkg/pdfgen"
+	"github.com/disintegration/imaging"
+)
+
+// watermarkStep overlays a translucent text (added to the PDF like the
+// stamps) or image (blended into the page) onto the pages
+type watermarkStep struct {
+	text     string
+	image    image.Image
+	opacity  float64
+	angle    float64 // degrees, text only
+	size     float64 // points, text only (0 = fit the page)
+	color    color.Color
+	scale    float64 // fraction of the page width, image only
+	position string
+	margin   float64 // mm
+	pages    string
+}
+
+func newWatermarkStep(o StepOptions) (Step, error) {
+	var (
+		w = watermarkStep{
+			text:     o.String("text", ""),
+			position: o.String("position", "center"),
+		}
+		err error
+	)
+
+	file := o.String("image", "")
+	switch {
+	case (w.text == "") == (file == ""):
+		return nil, fmt.Errorf("either text or image is required")
+
+	case file != "":
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open image: %s", err)
+		}
+		defer f.Close()
+
+		if w.image, _, err = image.Decode(f); err != nil {
+			return nil, fmt.Errorf("unable to decode image: %s", err)
+		}
+	}
+
+	if _, ok := stampPositions[w.position]; !ok && w.position != "center" {
+		return nil, fmt.Errorf("invalid position %q (supported: center or the positions of stamp)", w.position)
+	}
+
+	if w.opacity, err = o.Float("opacity", 0.25); err != nil {
+		return nil, err
+	}
+	if w.angle, err = o.Float("angle", 45); err != nil {
+		return nil, err
+	}
+	if w.size, err = o.Float("size", 0); err != nil {
+		return nil, err
+	}
+	if w.scale, err = o.Float("scale", 0.3); err != nil {
+		return nil, err
+	}
+	if w.margin, err = o.Float("margin", 10); err != nil {
+		return nil, err
+	}
+	if w.pages, err = pagesOption(o); err != nil {
+		return nil, err
+	}
+	if w.color, err = parseHexColor(o.String("color", "808080")); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case w.opacity <= 0 || w.opacity > 1:
+		return nil, fmt.Errorf("opacity must be positive and at most 1")
+	case w.size < 0 || w.margin < 0:
+		return nil, fmt.Errorf("size and margin must not be negative")
+	case w.scale <= 0 || w.scale > 1:
+		return nil, fmt.Errorf("scale must be positive and at most 1")
+	}
+
+	return w, nil
+}
+
+// parseHexColor reads colors given as RRGGBB
+func parseHexColor(v string) (color.Color, error) {
+	n, err := strconv.ParseUint(strings.TrimPrefix(v, "#"), 16, 32)
+	if err != nil || len(strings.TrimPrefix(v, "#")) != 6 {
+		return nil, fmt.Errorf("invalid color %q, expected RRGGBB", v)
+	}
+	return color.RGBA{uint8(n >> 16), uint8(n >> 8), uint8(n), 0xff}, nil
+}
+
+func (w watermarkStep) Apply(p *StepPage) error {
+	if !matchesPages(w.pages, p) {
+		return nil
+	}
+
+	if w.image != nil {
+		w.applyImage(p)
+		return nil
+	}
+
+	var (
+		widthPt, heightPt = p.sizePt()
+		marginPt          = w.margin * 72 / 25.4
+		angle             = w.angle
+		size              = w.size
+	)
+
+	t := pdfgen.Text{Text: w.text, Color: w.color, Opacity: w.opacity}
+
+	if w.position == "center" {
+		sin, cos := math.Sincos(angle * math.Pi / 180)
+		if size == 0 {
+			// Fill 70% of the line through the center of the page
+			length := math.Min(widthPt/math.Max(math.Abs(cos), 1e-6), heightPt/math.Max(math.Abs(sin), 1e-6))
+			size = 0.7 * length / pdfgen.TextWidth(w.text)
+		}
+
+		// Center the capitals (0.72 of the font size high) on the page
+		t.Align, t.Angle = pdfgen.AlignCenter, angle
+		t.X = 0.5 + 0.36*size*sin/widthPt
+		t.Y = 0.5 + 0.36*size*cos/heightPt
+	} else {
+		pos := stampPositions[w.position]
+		if size == 0 {
+			size = 24
+		}
+
+		t.Align = pos.align
+		t.X = pos.x + marginPt/widthPt*(1-2*pos.x)
+		if pos.top {
+			t.Y = (marginPt + 0.72*size) / heightPt
+		} else {
+			t.Y = 1 - marginPt/heightPt
+		}
+	}
+	t.Size = size / heightPt
+
+	p.Text = append(p.Text, t)
+	return nil
+}
+
+// applyImage blends the image scaled to the page into the page image
+func (w watermarkStep) applyImage(p *StepPage) {
+	var (
+		b      = p.Image.Bounds()
+		mark   = imaging.Resize(w.image, int(w.scale*float64(b.Dx())), 0, imaging.Lanczos)
+		margin = mmToPixels(w.margin, p.DPI)
+		at     image.Point
+	)
+
+	if w.position == "center" {
+		at = image.Pt((b.Dx()-mark.Bounds().Dx())/2, (b.Dy()-mark.Bounds().Dy())/2)
+	} else {
+		pos := stampPositions[w.position]
+		at.X = int(pos.x*float64(b.Dx()-mark.Bounds().Dx())) + int(float64(margin)*(1-2*pos.x))
+		if pos.top {
+			at.Y = margin
+		} else {
+			at.Y = b.Dy() - mark.Bounds().Dy() - margin
+		}
+	}
+
+	out := imaging.Overlay(p.Image, mark, at.Add(b.Min), w.opacity)
+	if _, ok := p.Image.(*image.Gray); ok {
+		// Grayscale pages stay grayscale for the following steps
+		p.Image = toGray(out)
+		return
+	}
+	p.Image = out
+}
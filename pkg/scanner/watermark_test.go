@@ -0,0 +1,133 @@
+package scanner
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/Luzifer/scansnap-go/pkg/pdfgen"
+)
+
+func TestWatermarkText(t *testing.T) {
+	// 200 x 200 pt page
+	diagonal := 0.7 * 200 * math.Sqrt2 / pdfgen.TextWidth("DRAFT")
+
+	for spec, tc := range map[string]struct {
+		exp  pdfgen.Text
+		back bool
+	}{
+		"watermark text=DRAFT": {
+			exp: pdfgen.Text{
+				Text: "DRAFT", Align: pdfgen.AlignCenter, Angle: 45, Size: diagonal / 200, Opacity: 0.25, Color: color.RGBA{0x80, 0x80, 0x80, 0xff},
+				X: 0.5 + 0.36*diagonal*math.Sqrt2/2/200, Y: 0.5 + 0.36*diagonal*math.Sqrt2/2/200,
+			},
+		},
+		"watermark text=COPY position=top-left size=10 margin=25.4 color=ff0000 opacity=1": {
+			exp: pdfgen.Text{
+				Text: "COPY", Align: pdfgen.AlignLeft, Size: 10.0 / 200, Opacity: 1, Color: color.RGBA{0xff, 0, 0, 0xff},
+				X: 72.0 / 200, Y: (72 + 7.2) / 200,
+			},
+		},
+		"watermark text=COPY position=bottom-right margin=0": {
+			exp: pdfgen.Text{
+				Text: "COPY", Align: pdfgen.AlignRight, Size: 24.0 / 200, Opacity: 0.25, Color: color.RGBA{0x80, 0x80, 0x80, 0xff},
+				X: 1, Y: 1,
+			},
+		},
+		"watermark text=DRAFT pages=back": {back: true},
+	} {
+		t.Run(spec, func(t *testing.T) {
+			page := testPage(200, 200)
+			page.DPI, page.ActualSize = 72, true
+			if err := mustParsePipeline(t, spec).Apply(page); err != nil {
+				t.Fatalf("applying step: %s", err)
+			}
+
+			if tc.back {
+				if len(page.Text) != 0 {
+					t.Errorf("expected no watermark on front pages, got %+v", page.Text)
+				}
+				return
+			}
+			if len(page.Text) != 1 {
+				t.Fatalf("expected one text, got %d", len(page.Text))
+			}
+
+			got, exp := page.Text[0], tc.exp
+			near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+			if got.Text != exp.Text || got.Align != exp.Align || got.Angle != exp.Angle || got.Opacity != exp.Opacity || got.Color != exp.Color ||
+				!near(got.Size, exp.Size) || !near(got.X, exp.X) || !near(got.Y, exp.Y) {
+				t.Errorf("expected %+v, got %+v", exp, got)
+			}
+		})
+	}
+}
+
+func TestWatermarkImage(t *testing.T) {
+	mark := image.NewGray(image.Rect(0, 0, 10, 10))
+	file := path.Join(t.TempDir(), "mark.png")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatalf("creating image: %s", err)
+	}
+	if err := png.Encode(f, mark); err != nil {
+		t.Fatalf("encoding image: %s", err)
+	}
+	f.Close()
+
+	for name, tc := range map[string]struct {
+		options       string
+		marked, clear image.Point
+	}{
+		"center":       {"scale=0.5 opacity=0.5", image.Pt(50, 50), image.Pt(10, 10)},
+		"bottom-right": {"scale=0.2 opacity=0.5 position=bottom-right margin=0", image.Pt(90, 90), image.Pt(50, 50)},
+		"top-left":     {"scale=0.2 opacity=0.5 position=top-left margin=2.54", image.Pt(15, 15), image.Pt(5, 5)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			page := testPage(100, 100)
+			if err := mustParsePipeline(t, "watermark image="+quotePipelineValue(file)+" "+tc.options).Apply(page); err != nil {
+				t.Fatalf("applying step: %s", err)
+			}
+
+			out, ok := page.Image.(*image.Gray)
+			if !ok {
+				t.Fatalf("expected a grayscale image, got %T", page.Image)
+			}
+			if v := out.GrayAt(tc.marked.X, tc.marked.Y).Y; v < 120 || v > 136 {
+				t.Errorf("expected the image blended at %v, got %d", tc.marked, v)
+			}
+			if v := out.GrayAt(tc.clear.X, tc.clear.Y).Y; v != 0xff {
+				t.Errorf("expected no watermark at %v, got %d", tc.clear, v)
+			}
+			if len(page.Text) != 0 {
+				t.Errorf("expected no text, got %+v", page.Text)
+			}
+		})
+	}
+}
+
+func TestWatermarkOptions(t *testing.T) {
+	for _, spec := range []string{
+		"watermark",
+		"watermark text=DRAFT image=mark.png",
+		"watermark image=/nonexistent/mark.png",
+		"watermark text=DRAFT position=middle",
+		"watermark text=DRAFT opacity=0",
+		"watermark text=DRAFT scale=2",
+		"watermark text=DRAFT size=-1",
+		"watermark text=DRAFT color=red",
+		"watermark text=DRAFT color=fff",
+	} {
+		if _, err := ParsePipeline(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+
+	if c, err := parseHexColor("#1a2B3c"); err != nil || c != (color.RGBA{0x1a, 0x2b, 0x3c, 0xff}) {
+		t.Errorf("expected #1a2B3c to be parsed, got %v (%v)", c, err)
+	}
+}
@@ -0,0 +1,30 @@
+package scanner
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"encoding/binary"
+	"unicode/utf16"
+)
+
+//go:embed wia.ps1
+var wiaScript string
+
+// WIA returns a Command scanning with the Windows Image Acquisition
+// driver of the scanner using PowerShell, it replaces SANE on Windows.
+// The device is the name or WIA device ID of the scanner, the first one
+// if empty.
+func WIA(device string) *Command {
+	// -EncodedCommand takes the script as base64 of its UTF-16LE text
+	var script []byte
+	for _, r := range utf16.Encode([]rune(wiaScript)) {
+		script = binary.LittleEndian.AppendUint16(script, r)
+	}
+
+	return &Command{
+		Path:   "powershell.exe",
+		Args:   []string{"-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-EncodedCommand", base64.StdEncoding.EncodeToString(script)},
+		Device: device,
+		Model:  "Windows Image Acquisition",
+	}
+}
@@ -0,0 +1,99 @@
+# Scans with the WIA driver of the scanner, executed by the Command
+# returned by WIA (see command.go for the environment and exit codes)
+$ErrorActionPreference = 'Stop'
+
+# WIA errors reported by the exit status
+$exitCodes = @{
+  '80210002' = 4 # WIA_ERROR_PAPER_JAM
+  '80210003' = 2 # WIA_ERROR_PAPER_EMPTY
+  '80210005' = 3 # WIA_ERROR_OFFLINE
+  '80210006' = 5 # WIA_ERROR_BUSY
+  '80210015' = 3 # WIA_S_NO_DEVICE_AVAILABLE
+  '80210016' = 6 # WIA_ERROR_COVER_OPEN
+}
+
+function Get-ExitCode($err) {
+  $e = $err.Exception
+  while ($e.InnerException) { $e = $e.InnerException }
+  $code = '{0:X8}' -f $e.HResult
+  if ($exitCodes.ContainsKey($code)) { return $exitCodes[$code] }
+  return 1
+}
+
+function Set-Property($properties, $id, $value) {
+  foreach ($p in $properties) {
+    if ($p.PropertyID -eq $id) {
+      $p.Value = $value
+      return
+    }
+  }
+}
+
+try {
+  $manager = New-Object -ComObject WIA.DeviceManager
+  $info = $null
+  foreach ($d in $manager.DeviceInfos) {
+    if ($d.Type -ne 1) { continue } # ScannerDeviceType
+    $name = $d.Properties.Item('Name').Value
+    if (-not $env:SCAN_DEVICE -or $env:SCAN_DEVICE -eq $d.DeviceID -or $env:SCAN_DEVICE -eq $name) {
+      $info = $d
+      break
+    }
+  }
+  if (-not $info) {
+    [Console]::Error.WriteLine('No scanners found')
+    exit 3
+  }
+  $device = $info.Connect()
+  $item = $device.Items.Item(1)
+
+  $flatbed = $env:SCAN_SOURCE -eq 'Flatbed'
+  $handling = 1 # FEEDER
+  if ($flatbed) {
+    $handling = 2 # FLATBED
+  } elseif ($env:SCAN_SOURCE -eq 'ADF Duplex') {
+    $handling = 5 # FEEDER | DUPLEX
+  }
+  Set-Property $device.Properties 3088 $handling # WIA_DPS_DOCUMENT_HANDLING_SELECT
+  if (-not $flatbed) {
+    Set-Property $device.Properties 3096 ([int]$env:SCAN_MAX_PAGES) # WIA_DPS_PAGES, 0 = all
+  }
+
+  $intent, $bits = 1, 24 # WIA_INTENT_IMAGE_TYPE_COLOR
+  if ($env:SCAN_MODE -eq 'Gray') {
+    $intent, $bits = 2, 8 # WIA_INTENT_IMAGE_TYPE_GRAYSCALE
+  }
+  if ($env:SCAN_DEPTH -eq '16') { $bits *= 2 }
+  Set-Property $item.Properties 6146 $intent # WIA_IPS_CUR_INTENT
+  Set-Property $item.Properties 4104 $bits # WIA_IPA_DEPTH
+
+  $dpi = [int]$env:SCAN_RESOLUTION
+  if ($dpi -gt 0) {
+    Set-Property $item.Properties 6147 $dpi # WIA_IPS_XRES
+    Set-Property $item.Properties 6148 $dpi # WIA_IPS_YRES
+  }
+} catch {
+  [Console]::Error.WriteLine($_.Exception.Message)
+  exit (Get-ExitCode $_)
+}
+
+$pages = 0
+while ($true) {
+  try {
+    $img = $item.Transfer('{B96B3CAF-0728-11D3-9D7B-0000F81EF32E}') # PNG
+  } catch {
+    $code = Get-ExitCode $_
+    if ($code -eq 2 -and $pages -gt 0) { break } # Feeder ran empty
+    [Console]::Error.WriteLine($_.Exception.Message)
+    exit $code
+  }
+
+  $pages++
+  $file = Join-Path $env:SCAN_DIR ('page-{0:D4}.{1}' -f $pages, $img.FileExtension)
+  $img.SaveFile($file)
+  [Console]::Out.WriteLine($file)
+  [Console]::Out.Flush()
+
+  if ($flatbed -or ($env:SCAN_MAX_PAGES -ne '0' -and $pages -ge [int]$env:SCAN_MAX_PAGES)) { break }
+}
+exit 0
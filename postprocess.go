@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// postProcess runs the --post-process command on the rendered document
+// which is modified in place by the command
+func postProcess(file string, doc *deliveryDocument) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.PostProcessTimeout)
+	defer cancel()
+
+	output := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, cfg.PostProcess, file)
+	cmd.Env = append(os.Environ(),
+		"SCANSNAP_FILE="+file,
+		"SCANSNAP_FILENAME="+doc.Filename,
+		"SCANSNAP_CONTENT_TYPE="+doc.ContentType,
+		"SCANSNAP_CREATED="+doc.Created.Format(time.RFC3339),
+		"SCANSNAP_JOB_ID="+doc.JobID,
+		"SCANSNAP_PAGES="+strconv.Itoa(doc.Pages),
+		"SCANSNAP_PROFILE="+doc.Profile,
+		"SCANSNAP_TITLE="+doc.Title,
+		"SCANSNAP_USER="+doc.User,
+	)
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	start := time.Now()
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("Post-processing did not finish within %s", cfg.PostProcessTimeout)
+	}
+
+	logger := log.WithFields(log.Fields{
+		"job_id":   doc.JobID,
+		"duration": time.Since(start).Seconds(),
+		"output":   strings.TrimSpace(output.String()),
+	})
+	if err != nil {
+		logger.WithError(err).Error("Post-processing failed")
+		return fmt.Errorf("Unable to post-process document: %s", err)
+	}
+
+	if stat, err := os.Stat(file); err != nil || stat.Size() == 0 {
+		logger.Error("Post-processing left no document")
+		return fmt.Errorf("Post-processing left no document")
+	}
+
+	logger.Debug("Document post-processed")
+	return nil
+}
+
+// postProcessedRender renders the document to a temporary file and
+// post-processes a copy of it. The returned file contains the processed
+// document, or the unprocessed one if post-processing failed, and must
+// be removed by the caller. The render function copies the file.
+func postProcessedRender(render func(io.Writer) error, doc *deliveryDocument) (string, func(io.Writer) error, error) {
+	original, err := renderTempFile(render)
+	if err != nil {
+		return "", nil, err
+	}
+
+	copyFile := func(file string) func(io.Writer) error {
+		return func(w io.Writer) error {
+			f, err := os.Open(file)
+			if err != nil {
+				return fmt.Errorf("Unable to open document: %s", err)
+			}
+			defer f.Close()
+
+			_, err = io.Copy(w, f)
+			return err
+		}
+	}
+
+	// The command might leave a broken document behind when failing
+	processed, err := renderTempFile(copyFile(original))
+	if err == nil {
+		if err = postProcess(processed, doc); err != nil {
+			os.Remove(processed)
+		}
+	}
+	if err != nil {
+		return original, copyFile(original), err
+	}
+
+	os.Remove(original)
+	return processed, copyFile(processed), nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	powerSleep = "sleep"
+	powerWake  = "wake"
+)
+
+// powerOptions are the scanner options of the idle policy, set again
+// when the scanner is woken up
+var powerOptions = []string{"offtimer", "sleeptimer"}
+
+// powerStatus tells whether the scanner was sent to sleep
+type powerStatus struct {
+	Asleep bool       `json:"asleep"`
+	Since  *time.Time `json:"since,omitempty"`
+	// OffTimer and SleepTimer are the minutes of the idle policy
+	// (--off-timer, --sleep-timer), nil if the device setting is kept
+	OffTimer   interface{} `json:"off_timer,omitempty"`
+	SleepTimer interface{} `json:"sleep_timer,omitempty"`
+}
+
+// powerState keeps whether the scanner was sent to sleep, the keep-alive
+// is paused until it is woken up or used again
+type powerState struct {
+	lock   sync.Mutex
+	asleep bool
+	since  time.Time
+}
+
+var scannerPower = &powerState{}
+
+// Asleep tells whether the scanner was sent to sleep
+func (p *powerState) Asleep() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.asleep
+}
+
+// set records the power state, it is not changed if already set
+func (p *powerState) set(asleep bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.asleep != asleep {
+		p.asleep, p.since = asleep, time.Now()
+	}
+}
+
+// Status describes the power state and the idle policy
+func (p *powerState) Status() powerStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	opts := defaultScannerOptions()
+	s := powerStatus{Asleep: p.asleep, OffTimer: opts["offtimer"], SleepTimer: opts["sleeptimer"]}
+	if !p.since.IsZero() {
+		since := p.since
+		s.Since = &since
+	}
+	return s
+}
+
+// idlePolicyOptions returns the options of the idle policy configured
+func idlePolicyOptions() map[string]interface{} {
+	defaults := defaultScannerOptions()
+
+	opts := map[string]interface{}{}
+	for _, name := range powerOptions {
+		if v, ok := defaults[name]; ok {
+			opts[name] = v
+		}
+	}
+	return opts
+}
+
+// handlePowerState sends the scanner to sleep or wakes it up
+func handlePowerState(res http.ResponseWriter, r *http.Request) {
+	state := r.PathValue("state")
+	if state != powerSleep && state != powerWake {
+		writeError(res, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("Unknown power state %q (supported: sleep, wake)", state))
+		return
+	}
+
+	ctl, ok := scanBackend.(scanner.PowerController)
+	if !ok {
+		writeError(res, http.StatusNotFound, errCodeDisabled, "The scanner backend does not support power control")
+		return
+	}
+
+	var err error
+	if state == powerSleep {
+		err = ctl.Sleep()
+	} else {
+		err = ctl.Wake(idlePolicyOptions())
+	}
+
+	logger := log.WithFields(log.Fields{"state": state, "user": requestUser(r)})
+	var unsupported scanner.UnsupportedError
+	switch {
+	case errors.As(err, &unsupported):
+		writeError(res, http.StatusNotFound, errCodeDisabled, err.Error())
+		return
+
+	case err != nil:
+		logger.WithError(err).Error("Unable to change power state of the scanner")
+		writeScanError(res, "", err)
+		return
+	}
+
+	scannerPower.set(state == powerSleep)
+	logger.Info("Changed power state of the scanner")
+	writeJSON(res, http.StatusOK, scannerPower.Status())
+}
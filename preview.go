@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// handlePreviewRequest scans the front side of the first sheet at the
+// preview resolution to check alignment and settings before scanning a
+// large batch. The scan parameters of /scan.pdf apply, resolutions and
+// duplex are overridden.
+func handlePreviewRequest(res http.ResponseWriter, r *http.Request) {
+	params, err := parseScanParams(r)
+	if err != nil {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	params.JobID = newID()
+	params.User = requestUser(r)
+	params.Duplex = false
+	params.ScanDPI, params.PDFDPI = cfg.PreviewDPI, cfg.PreviewDPI
+	params.MaxPages = 1
+	switch params.Color {
+	case scanner.ColorModeBW:
+		// Bilevel pages are encoded using CCITT which is no JPEG
+		params.Color = scanner.ColorModeGray
+	case scanner.ColorModeAutoBW:
+		params.Color = scanner.ColorModeAuto
+	}
+	params.Lossless, params.Archive, params.Depth = false, false, 8
+	res.Header().Set("X-Job-ID", params.JobID)
+
+	pages, skipped, err := scanAndProcessPages(params, 0)
+	if err != nil {
+		log.WithError(err).Error("Unable to scan preview")
+		writeScanError(res, params.JobID, err)
+		return
+	}
+
+	if len(pages) == 0 {
+		msg := "Unable to process preview"
+		if len(skipped) > 0 {
+			msg = skipped.Error()
+		}
+		writeError(res, http.StatusInternalServerError, errCodeInternal, msg)
+		return
+	}
+
+	data, err := pages[0].ImageData()
+	if err != nil {
+		log.WithError(err).Error("Unable to read preview")
+		writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to read preview")
+		return
+	}
+
+	res.Header().Set("Content-Type", "image/jpeg")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Write(data)
+}
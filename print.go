@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// Upload targets forwarding the documents to a printer using IPP or to
+// the HTTP API of a fax gateway, combined with the hardware button the
+// daemon becomes a copy or fax station
+
+// IPP attribute tags and operations used for Print-Job (RFC 8010,
+// RFC 8011)
+const (
+	ippTagOperation   = 0x01
+	ippTagJob         = 0x02
+	ippTagEnd         = 0x03
+	ippTagInteger     = 0x21
+	ippTagTextNoLang  = 0x41
+	ippTagNameNoLang  = 0x42
+	ippTagKeyword     = 0x44
+	ippTagURI         = 0x45
+	ippTagCharset     = 0x47
+	ippTagNaturalLang = 0x48
+	ippTagMimeType    = 0x49
+
+	ippOpPrintJob = 0x0002
+)
+
+var ippRequestID uint32
+
+// ippTarget prints the documents using the Print-Job operation of the
+// printer at the IPP URI (e.g. ipp://printer.local/ipp/print)
+type ippTarget struct {
+	URL string `yaml:"url"`
+	// User is sent as requesting-user-name (default: the user of the scan)
+	User      string `yaml:"user"`
+	Copies    int    `yaml:"copies"`
+	Sides     string `yaml:"sides"`
+	Media     string `yaml:"media"`
+	ColorMode string `yaml:"color_mode"`
+	// Format overrides the document-format, e.g. application/octet-stream
+	// for printers detecting the format themselves
+	Format string `yaml:"format"`
+
+	endpoint string
+}
+
+func newIPPTarget(decode func(interface{}) error) (uploadTarget, error) {
+	t := &ippTarget{Copies: 1}
+	if err := decode(t); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %s", err)
+	}
+	switch u.Scheme {
+	case "ipp", "http":
+		u.Scheme = "http"
+		if u.Port() == "" {
+			u.Host += ":631"
+		}
+	case "ipps", "https":
+		u.Scheme = "https"
+		if u.Port() == "" {
+			u.Host += ":631"
+		}
+	default:
+		return nil, fmt.Errorf("url must be an ipp:// or ipps:// URI")
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("url has no host")
+	}
+	t.endpoint = u.String()
+
+	if t.Copies < 1 {
+		return nil, fmt.Errorf("copies must be at least 1")
+	}
+	switch t.Sides {
+	case "", "one-sided", "two-sided-long-edge", "two-sided-short-edge":
+	default:
+		return nil, fmt.Errorf("sides must be one-sided, two-sided-long-edge or two-sided-short-edge")
+	}
+	switch t.ColorMode {
+	case "", "auto", "color", "monochrome":
+	default:
+		return nil, fmt.Errorf("color_mode must be auto, color or monochrome")
+	}
+
+	return t, nil
+}
+
+// Address implements addressedTarget
+func (p ippTarget) Address() string { return urlAddress(p.endpoint) }
+
+// Upload implements uploadTarget
+func (p ippTarget) Upload(ctx context.Context, doc *deliveryDocument) error {
+	format := p.Format
+	if format == "" {
+		if doc.ContentType != "application/pdf" {
+			return fmt.Errorf("Unable to print %s documents, only PDF is supported", doc.ContentType)
+		}
+		format = doc.ContentType
+	}
+
+	f, size, err := doc.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	user := p.User
+	if user == "" {
+		user = doc.User
+	}
+	if user == "" {
+		user = "scansnap-go"
+	}
+
+	msg := newIPPMessage(ippOpPrintJob)
+	msg.group(ippTagOperation)
+	msg.attr(ippTagCharset, "attributes-charset", "utf-8")
+	msg.attr(ippTagNaturalLang, "attributes-natural-language", "en")
+	msg.attr(ippTagURI, "printer-uri", p.URL)
+	msg.attr(ippTagNameNoLang, "requesting-user-name", user)
+	msg.attr(ippTagNameNoLang, "job-name", doc.Filename)
+	msg.attr(ippTagMimeType, "document-format", format)
+
+	msg.group(ippTagJob)
+	msg.intAttr("copies", p.Copies)
+	if p.Sides != "" {
+		msg.attr(ippTagKeyword, "sides", p.Sides)
+	}
+	if p.Media != "" {
+		msg.attr(ippTagKeyword, "media", p.Media)
+	}
+	if p.ColorMode != "" {
+		msg.attr(ippTagKeyword, "print-color-mode", p.ColorMode)
+	}
+	msg.buf.WriteByte(ippTagEnd)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint, io.MultiReader(bytes.NewReader(msg.buf.Bytes()), f))
+	if err != nil {
+		return fmt.Errorf("Unable to create request: %s", err)
+	}
+	req.ContentLength = int64(msg.buf.Len()) + size
+	req.Header.Set("Content-Type", "application/ipp")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to execute request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return fmt.Errorf("Unable to read response: %s", err)
+	}
+
+	return ippStatus(body)
+}
+
+// ippMessage encodes an IPP request
+type ippMessage struct {
+	buf bytes.Buffer
+}
+
+func newIPPMessage(op uint16) *ippMessage {
+	m := &ippMessage{}
+	// Version 2.0, the operation and the request ID
+	m.buf.Write([]byte{2, 0})
+	binary.Write(&m.buf, binary.BigEndian, op)
+	binary.Write(&m.buf, binary.BigEndian, atomic.AddUint32(&ippRequestID, 1))
+	return m
+}
+
+func (m *ippMessage) group(tag byte) { m.buf.WriteByte(tag) }
+
+func (m *ippMessage) attr(tag byte, name, value string) {
+	m.value(tag, name, []byte(value))
+}
+
+func (m *ippMessage) intAttr(name string, value int) {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(value))
+	m.value(ippTagInteger, name, v)
+}
+
+func (m *ippMessage) value(tag byte, name string, value []byte) {
+	m.buf.WriteByte(tag)
+	binary.Write(&m.buf, binary.BigEndian, uint16(len(name)))
+	m.buf.WriteString(name)
+	binary.Write(&m.buf, binary.BigEndian, uint16(len(value)))
+	m.buf.Write(value)
+}
+
+// ippStatus converts unsuccessful IPP responses into errors including
+// the status-message of the printer
+func ippStatus(resp []byte) error {
+	if len(resp) < 8 {
+		return fmt.Errorf("Invalid IPP response")
+	}
+	status := binary.BigEndian.Uint16(resp[2:4])
+	if status < 0x0100 {
+		// successful-ok and its variants (ignored or substituted attributes)
+		return nil
+	}
+
+	message := ""
+	for data := resp[8:]; len(data) > 0 && data[0] != ippTagEnd; {
+		if data[0] < 0x10 {
+			// Begin of an attribute group
+			data = data[1:]
+			continue
+		}
+		if len(data) < 3 {
+			break
+		}
+		tag, nameLen := data[0], int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 5+nameLen {
+			break
+		}
+		name := string(data[3 : 3+nameLen])
+		valueLen := int(binary.BigEndian.Uint16(data[3+nameLen : 5+nameLen]))
+		if len(data) < 5+nameLen+valueLen {
+			break
+		}
+		if name == "status-message" && tag == ippTagTextNoLang {
+			message = string(data[5+nameLen : 5+nameLen+valueLen])
+			break
+		}
+		data = data[5+nameLen+valueLen:]
+	}
+
+	if message == "" {
+		return fmt.Errorf("Printer rejected the job (status 0x%04x)", status)
+	}
+	return fmt.Errorf("Printer rejected the job (status 0x%04x): %s", status, message)
+}
+
+// faxTarget posts the documents as multipart form to the HTTP API of a
+// fax gateway sending them to the number To
+type faxTarget struct {
+	URL      string `yaml:"url"`
+	To       string `yaml:"to"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	// NumberField and Field name the form fields of the number and the
+	// document expected by the gateway
+	NumberField string            `yaml:"number_field"`
+	Field       string            `yaml:"field"`
+	Fields      map[string]string `yaml:"fields"`
+	Headers     map[string]string `yaml:"headers"`
+}
+
+func newFaxTarget(decode func(interface{}) error) (uploadTarget, error) {
+	t := &faxTarget{NumberField: "to", Field: "file"}
+	if err := decode(t); err != nil {
+		return nil, err
+	}
+
+	if _, err := url.ParseRequestURI(t.URL); err != nil {
+		return nil, fmt.Errorf("invalid url: %s", err)
+	}
+	if strings.Trim(t.To, "+0123456789 -/()") != "" || t.To == "" {
+		return nil, fmt.Errorf("to must be a fax number")
+	}
+
+	return t, nil
+}
+
+// Address implements addressedTarget
+func (x faxTarget) Address() string { return urlAddress(x.URL) }
+
+// Upload implements uploadTarget
+func (x faxTarget) Upload(ctx context.Context, doc *deliveryDocument) error {
+	if doc.ContentType != "application/pdf" {
+		return fmt.Errorf("Unable to fax %s documents, only PDF is supported", doc.ContentType)
+	}
+
+	f, _, err := doc.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+
+	go func() {
+		err := form.WriteField(x.NumberField, x.To)
+		for k, v := range x.Fields {
+			if err == nil {
+				err = form.WriteField(k, v)
+			}
+		}
+
+		var part io.Writer
+		if err == nil {
+			part, err = form.CreateFormFile(x.Field, doc.Filename)
+		}
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, x.URL, pr)
+	if err != nil {
+		pr.Close()
+		return fmt.Errorf("Unable to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	for k, v := range x.Headers {
+		req.Header.Set(k, v)
+	}
+	if x.User != "" {
+		req.SetBasicAuth(x.User, x.Password)
+	}
+
+	return doTargetRequest(req)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// scanAndProcessPages reads the pages from the scanner and processes
+// them on all available CPUs while the scanner is still feeding the
+// following pages. Page indices start at firstIndex. If the scan fails
+// the pages captured so far are returned together with the error.
+// Pages failing to process are skipped and reported in skipped.
+func scanAndProcessPages(params *scanParams, firstIndex int) (pages []*scanner.Page, skipped scanner.PageErrors, err error) {
+	var (
+		raw     = make(chan image.Image)
+		scanErr = make(chan error, 1)
+		start   = time.Now()
+	)
+
+	ctx := context.Background()
+	if cfg.ScanTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, cfg.ScanTimeout)
+		defer cancelTimeout()
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	defer runningJobs.Add(params, cancel)()
+
+	go func() { scanErr <- fetchPages(ctx, params, raw) }()
+
+	if params.Meta == nil {
+		params.Meta = newJobMeta(params)
+	}
+
+	pages, skipped, params.Fed = scanner.ProcessPages(thumbnailRecorder{params.processor(), params.JobID, params.OnPage, params.OnProcessed, cancel}, raw, firstIndex)
+	pages = removeBlankPages(params, pages)
+	pages = findDuplicatePages(params, pages)
+	for _, p := range pages {
+		if p.Misfeed != "" {
+			params.logger().WithFields(log.Fields{"page": p.Index + 1, "reason": p.Misfeed}).Info("Page looks misfed")
+		}
+	}
+	for _, idx := range skipped.Indices() {
+		params.logger().WithError(skipped[idx]).WithField("page", idx+1).Error("Unable to process page, skipping it")
+	}
+
+	err = <-scanErr
+	if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		// Cancelled using the job API or timed out
+		err = context.Cause(ctx)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("Scan did not finish within %s: %w", cfg.ScanTimeout, err)
+	}
+
+	logger := params.logger().WithFields(log.Fields{
+		"pages":    len(pages),
+		"duration": time.Since(start).Seconds(),
+	})
+	if dev := runningJobs.Device(params.JobID); dev != "" {
+		logger = logger.WithField("device", dev)
+		params.Meta.Device = dev
+	}
+	if opts := runningJobs.Options(params.JobID); opts != nil {
+		params.Meta.setOptions(opts)
+	}
+	params.Meta.ScanSeconds += time.Since(start).Seconds()
+	if err != nil {
+		logger.WithError(err).Warn("Scan finished with error")
+	} else {
+		logger.Info("Scan finished")
+	}
+
+	return pages, skipped, err
+}
+
+// thumbnailRecorder keeps the thumbnails of the processed pages with
+// the running job to preview them before the scan is finished and
+// passes the pages to onPage and onProcessed if set. The scan is
+// cancelled if the spool is full as all following pages would fail too.
+type thumbnailRecorder struct {
+	scanner.Processor
+	jobID       string
+	onPage      func(*scanner.Page)
+	onProcessed func(int, *scanner.Page)
+	cancel      context.CancelCauseFunc
+}
+
+func (t thumbnailRecorder) Process(idx int, img image.Image) (*scanner.Page, error) {
+	start := time.Now()
+	p, err := t.Processor.Process(idx, img)
+	if errors.Is(err, scanner.ErrSpoolFull) {
+		t.cancel(err)
+	}
+	if err == nil {
+		p.ProcessingTime = time.Since(start)
+	}
+	if err == nil && p.Thumbnail != nil {
+		runningJobs.AddThumbnail(t.jobID, idx, p.Thumbnail)
+	}
+	if err == nil && t.onPage != nil && !p.Blank {
+		t.onPage(p)
+	}
+	if t.onProcessed != nil {
+		if err == nil && !p.Blank {
+			t.onProcessed(idx, p)
+		} else {
+			t.onProcessed(idx, nil)
+		}
+	}
+	return p, err
+}
+
+// removeBlankPages drops the pages the processor found to be blank
+func removeBlankPages(params *scanParams, pages []*scanner.Page) []*scanner.Page {
+	out := []*scanner.Page{}
+	for _, p := range pages {
+		if p.Blank {
+			params.logger().WithField("page", p.Index+1).Info("Removing blank back side")
+			params.Meta.BlankPages = append(params.Meta.BlankPages, p.Index+1)
+			continue
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// findDuplicatePages compares every page to the same side of the
+// previous sheet to find sheets fed twice. They are recorded in the
+// metadata and removed for duplicate-pages=drop, the first scan of the
+// sheet is kept.
+func findDuplicatePages(params *scanParams, pages []*scanner.Page) []*scanner.Page {
+	if params.DuplicatePages == duplicatePagesIgnore {
+		return pages
+	}
+
+	sheet := 1
+	if params.Duplex {
+		sheet = 2
+	}
+	byIndex := map[int]*scanner.Page{}
+	for _, p := range pages {
+		byIndex[p.Index] = p
+	}
+
+	out := []*scanner.Page{}
+	for _, p := range pages {
+		prev, ok := byIndex[p.Index-sheet]
+		if !ok || !p.IsDuplicate(prev) {
+			out = append(out, p)
+			continue
+		}
+
+		params.logger().WithFields(log.Fields{"page": p.Index + 1, "previous": prev.Index + 1}).Warn("Page looks like the previous sheet scanned again")
+		params.Meta.DuplicatePages = append(params.Meta.DuplicatePages, p.Index+1)
+		if params.DuplicatePages == duplicatePagesFlag {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// skipUnembeddablePages removes the pages unable to be embedded into a
+// PDF before the document is started and adds them to skipped
+func skipUnembeddablePages(params *scanParams, pages []*scanner.Page, skipped scanner.PageErrors) ([]*scanner.Page, scanner.PageErrors) {
+	out := []*scanner.Page{}
+	for _, p := range pages {
+		if _, err := p.PDFImage(); err != nil {
+			params.logger().WithError(err).WithField("page", p.Index+1).Error("Unable to embed page, skipping it")
+			if skipped == nil {
+				skipped = scanner.PageErrors{}
+			}
+			skipped[p.Index] = err
+			continue
+		}
+		out = append(out, p)
+	}
+	return out, skipped
+}
+
+// scannedPageCount returns the number of pages fed including skipped
+// ones as the page indices are continuous
+func scannedPageCount(pages []*scanner.Page) int {
+	if len(pages) == 0 {
+		return 0
+	}
+	return pages[len(pages)-1].Index + 1
+}
+
+// skippedPages returns the comma separated 1-based indices of the
+// skipped pages
+func skippedPages(skipped scanner.PageErrors) string {
+	idx := []string{}
+	for _, i := range skipped.Indices() {
+		idx = append(idx, strconv.Itoa(i+1))
+	}
+	return strings.Join(idx, ",")
+}
+
+// selectPages picks the pages by their number in the batch, skipped
+// pages are not renumbered. Without selection the pages are kept in
+// their order.
+func selectPages(pages []*scanner.Page, sel pageSelection) []*scanner.Page {
+	if len(sel) == 0 {
+		return pages
+	}
+
+	byIndex := map[int]*scanner.Page{}
+	for _, p := range pages {
+		byIndex[p.Index] = p
+	}
+
+	out := []*scanner.Page{}
+	for _, i := range sel.indices(scannedPageCount(pages)) {
+		if p, ok := byIndex[i]; ok {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// misfedPages returns the comma separated 1-based indices of all pages
+// in the batch suspected to be misfed
+func misfedPages(pages []*scanner.Page) string {
+	idx := []string{}
+	for _, p := range pages {
+		if p.Misfeed != "" {
+			idx = append(idx, strconv.Itoa(p.Index+1))
+		}
+	}
+	return strings.Join(idx, ",")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// profile is a named set of defaults for the query parameters of a scan
+// request, e.g. "invoice" scanning in black & white at 300dpi
+type profile map[string]string
+
+var (
+	profiles = map[string]profile{}
+	// userProfiles maps the authenticated users to the profile used for
+	// their scans not naming a profile (--user-profile)
+	userProfiles = map[string]string{}
+	// profilesLock guards both as they are replaced when the
+	// configuration is reloaded
+	profilesLock sync.RWMutex
+)
+
+// loadProfiles reads the profiles from a YAML file mapping the profile
+// names to their parameters:
+//
+//	invoice:
+//	  color: bw
+//	  pdf-dpi: "300"
+func loadProfiles(file string) error {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("Unable to read profiles: %s", err)
+	}
+
+	p := map[string]profile{}
+	if err := yaml.Unmarshal(raw, &p); err != nil {
+		return fmt.Errorf("Unable to parse profiles: %s", err)
+	}
+
+	for name, prof := range p {
+		if _, ok := prof["profile"]; ok {
+			return fmt.Errorf("Profile %q must not reference another profile", name)
+		}
+	}
+
+	profilesLock.Lock()
+	defer profilesLock.Unlock()
+
+	profiles = p
+	return nil
+}
+
+// loadUserProfiles reads the "user:profile" entries of --user-profile
+func loadUserProfiles(entries []string) error {
+	profilesLock.Lock()
+	defer profilesLock.Unlock()
+
+	up := map[string]string{}
+	for _, e := range nonEmpty(entries) {
+		user, name, ok := strings.Cut(e, ":")
+		if !ok || user == "" || name == "" {
+			return fmt.Errorf("Invalid user profile %q, expected format 'user:profile'", e)
+		}
+		if _, ok := profiles[name]; !ok {
+			return fmt.Errorf("User profile of %q references unknown profile %q", user, name)
+		}
+		up[user] = name
+	}
+
+	userProfiles = up
+	return nil
+}
+
+// userProfile returns the profile of the user given in --user-profile
+func userProfile(user string) string {
+	profilesLock.RLock()
+	defer profilesLock.RUnlock()
+
+	return userProfiles[user]
+}
+
+// profileExists tells whether the profile is defined in --profiles
+func profileExists(name string) bool {
+	profilesLock.RLock()
+	defer profilesLock.RUnlock()
+
+	_, ok := profiles[name]
+	return ok
+}
+
+// applyProfile fills the parameters not given in the query from the
+// named profile
+func applyProfile(q url.Values, name string) error {
+	profilesLock.RLock()
+	defer profilesLock.RUnlock()
+
+	prof, ok := profiles[name]
+	if !ok {
+		names := []string{}
+		for n := range profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("Unknown profile %q (available: %s)", name, strings.Join(names, ", "))
+	}
+
+	for k, v := range prof {
+		if q.Get(k) == "" {
+			q.Set(k, v)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,464 @@
+package main
+
+import "fmt"
+
+// Minimal QR code (model 2) encoder for the cover sheets: byte mode,
+// error correction level M, versions 1-10 (up to 213 bytes of data)
+
+const qrMaxVersion = 10
+
+var (
+	// Error correction codewords per block and number of blocks for
+	// level M indexed by version
+	qrECCPerBlock = [qrMaxVersion + 1]int{0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26}
+	qrNumBlocks   = [qrMaxVersion + 1]int{0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5}
+)
+
+type qrCode struct {
+	size     int
+	modules  [][]bool // [y][x], true is dark
+	function [][]bool // modules belonging to function patterns
+}
+
+// encodeQR returns the modules of the smallest QR code holding data,
+// true meaning dark, without the quiet zone
+func encodeQR(data []byte) ([][]bool, error) {
+	version := 0
+	for v := 1; v <= qrMaxVersion; v++ {
+		// Mode indicator, character count and the data itself
+		if 4+qrCountBits(v)+8*len(data) <= 8*qrDataCodewords(v) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("Data too long for QR code (%d bytes)", len(data))
+	}
+
+	q := newQRCode(version)
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(qrAddECC(qrEncodeData(data, version), version))
+
+	best, bestPenalty := -1, 0
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if p := q.penalty(); best < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask) // XOR again to undo
+	}
+
+	q.applyMask(best)
+	q.drawFormatBits(best)
+
+	return q.modules, nil
+}
+
+func newQRCode(version int) *qrCode {
+	size := 17 + 4*version
+	q := &qrCode{size: size}
+	for i := 0; i < size; i++ {
+		q.modules = append(q.modules, make([]bool, size))
+		q.function = append(q.function, make([]bool, size))
+	}
+	return q
+}
+
+func qrCountBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+// qrRawModules returns the number of modules available for data and
+// error correction codewords
+func qrRawModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		align := version/7 + 2
+		n -= (25*align-10)*align - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+func qrDataCodewords(version int) int {
+	return qrRawModules(version)/8 - qrECCPerBlock[version]*qrNumBlocks[version]
+}
+
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *qrCode) drawFunctionPatterns(version int) {
+	// Timing patterns
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns including their separators
+	for _, c := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || x >= q.size || y < 0 || y >= q.size {
+					continue
+				}
+				d := maxInt(absInt(dx), absInt(dy))
+				q.set(x, y, d != 2 && d != 4)
+			}
+		}
+	}
+
+	// Alignment patterns, skipping the ones overlapping finder patterns
+	pos := qrAlignmentPositions(version)
+	for i, y := range pos {
+		for j, x := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == len(pos)-1) || (i == len(pos)-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(x+dx, y+dy, maxInt(absInt(dx), absInt(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format areas, they are drawn after masking
+	q.drawFormatBits(0)
+
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>uint(i))&1 == 1
+			a, b := q.size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+func qrAlignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+
+	num := version/7 + 2
+	step := (version*8 + num*3 + 5) / (num*4 - 4) * 2
+	pos := make([]int, num)
+	pos[0] = 6
+	for i, p := num-1, 17+4*version-7; i > 0; i, p = i-1, p-step {
+		pos[i] = p
+	}
+	return pos
+}
+
+// drawFormatBits draws both copies of the format information for
+// error correction level M and the given mask
+func (q *qrCode) drawFormatBits(mask int) {
+	data := 0<<3 | mask // level M is encoded as 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>uint(i))&1 == 1 }
+
+	for i := 0; i < 6; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true) // Always dark module
+}
+
+// qrEncodeData creates the data codewords in byte mode including the
+// terminator and padding
+func qrEncodeData(data []byte, version int) []byte {
+	var (
+		bits       []bool
+		appendBits = func(v, n int) {
+			for i := n - 1; i >= 0; i-- {
+				bits = append(bits, (v>>uint(i))&1 == 1)
+			}
+		}
+		capacity = qrDataCodewords(version) * 8
+	)
+
+	appendBits(0x4, 4)
+	appendBits(len(data), qrCountBits(version))
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+
+	appendBits(0, minInt(4, capacity-len(bits)))
+	appendBits(0, (8-len(bits)%8)%8)
+	for pad := 0xec; len(bits) < capacity; pad ^= 0xec ^ 0x11 {
+		appendBits(pad, 8)
+	}
+
+	out := make([]byte, len(bits)/8)
+	for i, b := range bits {
+		if b {
+			out[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return out
+}
+
+// qrAddECC splits the data into blocks, computes their Reed-Solomon
+// error correction codewords and interleaves everything
+func qrAddECC(data []byte, version int) []byte {
+	var (
+		numBlocks  = qrNumBlocks[version]
+		eccLen     = qrECCPerBlock[version]
+		raw        = qrRawModules(version) / 8
+		numShort   = numBlocks - raw%numBlocks
+		shortLen   = raw/numBlocks - eccLen
+		divisor    = rsDivisor(eccLen)
+		dataBlocks [][]byte
+		eccBlocks  [][]byte
+	)
+
+	for i, k := 0, 0; i < numBlocks; i++ {
+		n := shortLen
+		if i >= numShort {
+			n++
+		}
+		block := data[k : k+n]
+		k += n
+		dataBlocks = append(dataBlocks, block)
+		eccBlocks = append(eccBlocks, rsRemainder(block, divisor))
+	}
+
+	out := []byte{}
+	for i := 0; i <= shortLen; i++ {
+		for _, b := range dataBlocks {
+			if i < len(b) {
+				out = append(out, b[i])
+			}
+		}
+	}
+	for i := 0; i < eccLen; i++ {
+		for _, b := range eccBlocks {
+			out = append(out, b[i])
+		}
+	}
+	return out
+}
+
+func gfMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11d)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, c := range divisor {
+			result[i] ^= gfMultiply(c, factor)
+		}
+	}
+	return result
+}
+
+// drawCodewords places the codewords in the zig-zag pattern
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// Skip the vertical timing pattern
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if q.function[y][x] || i >= len(data)*8 {
+					continue
+				}
+				q.modules[y][x] = (data[i/8]>>uint(7-i%8))&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol by the rules of the specification, the
+// mask with the lowest score is the easiest to read
+func (q *qrCode) penalty() int {
+	var (
+		score int
+		dark  int
+		at    = func(x, y int, transpose bool) bool {
+			if transpose {
+				return q.modules[x][y]
+			}
+			return q.modules[y][x]
+		}
+	)
+
+	// Runs of the same color and finder-like patterns in rows and columns
+	finder := []bool{true, false, true, true, true, false, true}
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < q.size; y++ {
+			run := 1
+			for x := 1; x <= q.size; x++ {
+				if x < q.size && at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += 3 + run - 5
+				}
+				run = 1
+			}
+
+			for x := 0; x+7 <= q.size; x++ {
+				match := true
+				for i, f := range finder {
+					if at(x+i, y, transpose) != f {
+						match = false
+						break
+					}
+				}
+				if !match {
+					continue
+				}
+
+				light := func(from, to int) bool {
+					for i := from; i < to; i++ {
+						if i >= 0 && i < q.size && at(i, y, transpose) {
+							return false
+						}
+					}
+					return true
+				}
+				if light(x-4, x) || light(x+7, x+11) {
+					score += 40
+				}
+			}
+		}
+	}
+
+	// 2x2 blocks of the same color
+	for y := 0; y < q.size-1; y++ {
+		for x := 0; x < q.size-1; x++ {
+			c := q.modules[y][x]
+			if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+				score += 3
+			}
+		}
+	}
+
+	// Balance of dark and light modules
+	for _, row := range q.modules {
+		for _, m := range row {
+			if m {
+				dark++
+			}
+		}
+	}
+	total := q.size * q.size
+	k := (absInt(dark*20-total*10)+total-1)/total - 1
+	return score + k*10
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// Priorities of the scans waiting for the scanner, scans of a higher
+// priority start first, scans of the same priority in the order they
+// were requested. urgent is reserved to admins.
+const (
+	priorityLow    = "low"
+	priorityNormal = "normal"
+	priorityHigh   = "high"
+	priorityUrgent = "urgent"
+)
+
+var scanPriorities = map[string]int{
+	priorityLow:    -1,
+	priorityNormal: 0,
+	priorityHigh:   1,
+	priorityUrgent: 2,
+}
+
+// queuedScan is a scan waiting for the scanner, ready is closed when it
+// is its turn
+type queuedScan struct {
+	jobID    string
+	priority string
+	seq      uint64
+	ready    chan struct{}
+}
+
+// scanQueue passes the scans to the scanner(s) by their priority, as
+// many at a time as there are scanners, and counts the scans running or
+// waiting to enforce --max-queued-scans
+type scanQueue struct {
+	pending int
+	running int
+	waiting []*queuedScan
+	seq     uint64
+	lock    sync.Mutex
+}
+
+var pendingScans = &scanQueue{}
+
+// Enter registers a scan and waits for its turn, it fails with a
+// queueFullError if more than --max-queued-scans scans are waiting for
+// the running one or with the error of ctx if it is done while waiting
+func (q *scanQueue) Enter(ctx context.Context, jobID, priority string) error {
+	q.lock.Lock()
+	if cfg.MaxQueuedScans > 0 && q.pending > cfg.MaxQueuedScans {
+		q.lock.Unlock()
+		return queueFullError{q.pending - 1}
+	}
+	q.pending++
+
+	if q.running < scanSlots() && len(q.waiting) == 0 {
+		q.running++
+		q.lock.Unlock()
+		return nil
+	}
+
+	q.seq++
+	scan := &queuedScan{jobID: jobID, priority: priority, seq: q.seq, ready: make(chan struct{})}
+	q.waiting = append(q.waiting, scan)
+	q.lock.Unlock()
+
+	select {
+	case <-scan.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i, w := range q.waiting {
+		if w == scan {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			q.pending--
+			return context.Cause(ctx)
+		}
+	}
+	// It became the scan's turn meanwhile, the scanner fails it
+	return nil
+}
+
+// Leave removes the scan registered by Enter and starts the next one
+func (q *scanQueue) Leave() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.pending--
+	q.running--
+	if len(q.waiting) == 0 || q.running >= scanSlots() {
+		return
+	}
+
+	next := 0
+	for i, w := range q.waiting {
+		if q.before(w, q.waiting[next]) {
+			next = i
+		}
+	}
+	scan := q.waiting[next]
+	q.waiting = append(q.waiting[:next], q.waiting[next+1:]...)
+	q.running++
+	close(scan.ready)
+}
+
+// scanSlots returns the number of scans running at the same time, one
+// per member of --scanners
+func scanSlots() int {
+	if p, ok := scanBackend.(*scanner.Pool); ok && len(p.Members) > 1 {
+		return len(p.Members)
+	}
+	return 1
+}
+
+// before orders the waiting scans by priority and request
+func (q *scanQueue) before(a, b *queuedScan) bool {
+	if pa, pb := scanPriorities[a.priority], scanPriorities[b.priority]; pa != pb {
+		return pa > pb
+	}
+	return a.seq < b.seq
+}
+
+// Positions returns the position (1 = next) of the waiting scans by job
+// ID
+func (q *scanQueue) Positions() map[string]int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	positions := map[string]int{}
+	for _, a := range q.waiting {
+		pos := 1
+		for _, b := range q.waiting {
+			if b != a && q.before(b, a) {
+				pos++
+			}
+		}
+		positions[a.jobID] = pos
+	}
+	return positions
+}
+
+// SetPriority changes the priority of a waiting scan, false if no scan
+// with the job ID is waiting
+func (q *scanQueue) SetPriority(jobID, priority string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, w := range q.waiting {
+		if w.jobID == jobID {
+			w.priority = priority
+			return true
+		}
+	}
+	return false
+}
+
+// validatePriority checks the priority exists and may be requested by
+// the user, urgent scans require admin access unless the priority is
+// set by a profile
+func validatePriority(r *http.Request, priority string) error {
+	if _, ok := scanPriorities[priority]; !ok {
+		return fmt.Errorf("Invalid priority %q (supported: low, normal, high, urgent)", priority)
+	}
+	if priority == priorityUrgent && r.URL.Query().Get("priority") == priorityUrgent && !isAdmin(r) {
+		return fmt.Errorf("Priority urgent requires admin access")
+	}
+	return nil
+}
+
+// handleAdminSetPriority changes the priority of a scan waiting for the
+// scanner, e.g. to let an urgent scan jump ahead of a queued archive
+func handleAdminSetPriority(res http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Priority string `json:"priority"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, "Invalid JSON body")
+		return
+	}
+	if _, ok := scanPriorities[req.Priority]; !ok {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("Invalid priority %q (supported: low, normal, high, urgent)", req.Priority))
+		return
+	}
+
+	id := r.PathValue("id")
+	if !pendingScans.SetPriority(id, req.Priority) {
+		writeError(res, http.StatusNotFound, errCodeNotFound, "No scan with this job ID is waiting for the scanner")
+		return
+	}
+	runningJobs.SetPriority(id, req.Priority)
+
+	log.WithFields(log.Fields{
+		"job_id":   id,
+		"priority": req.Priority,
+		"user":     requestUser(r),
+	}).Info("Priority of queued scan changed")
+
+	writeJSON(res, http.StatusOK, map[string]interface{}{"job_id": id, "priority": req.Priority, "queue_position": pendingScans.Positions()[id]})
+}
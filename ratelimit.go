@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRateLimitClients triggers removing the clients having their
+	// bucket refilled from the rate limiter
+	maxRateLimitClients = 1024
+	// queueFullRetryAfter is suggested to clients rejected because too
+	// many scans are waiting for the scanner
+	queueFullRetryAfter = 30 * time.Second
+)
+
+// queueFullError signals too many scans are waiting for the scanner,
+// see --max-queued-scans
+type queueFullError struct {
+	Queued int
+}
+
+func (q queueFullError) Error() string {
+	return fmt.Sprintf("%d scan(s) are already waiting for the scanner, retry later", q.Queued)
+}
+
+// rateLimiter grants every client IP --rate-limit requests per second
+// with bursts of --rate-limit-burst requests (token bucket)
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	clients map[string]*rateBucket
+	lock    sync.Mutex
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), clients: map[string]*rateBucket{}}
+}
+
+// Allow takes a token from the bucket of the client, if it is empty the
+// time until the next token is available is returned
+func (l *rateLimiter) Allow(client string) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	if len(l.clients) >= maxRateLimitClients {
+		l.expire(now)
+	}
+
+	b, ok := l.clients[client]
+	if !ok {
+		b = &rateBucket{tokens: l.burst, updated: now}
+		l.clients[client] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// expire removes the clients whose buckets are full again, the caller
+// must hold the lock
+func (l *rateLimiter) expire(now time.Time) {
+	for client, b := range l.clients {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// limitRequests rejects requests of clients exceeding --rate-limit
+func limitRequests(next http.Handler) http.Handler {
+	if cfg.RateLimit <= 0 {
+		return next
+	}
+
+	limiter := newRateLimiter(cfg.RateLimit, cfg.RateLimitBurst)
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+
+		if ok, wait := limiter.Allow(client); !ok {
+			res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(res, http.StatusTooManyRequests, errCodeRateLimited, "Too many requests, slow down")
+			return
+		}
+		next.ServeHTTP(res, r)
+	})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// Raw frames are debug downloads and kept only for a limited time
+const rawFramesTTL = time.Hour
+
+// rawFrames are the images of a scan as received from the scanner
+// before the pipeline, kept to tune the scan and pipeline settings
+type rawFrames struct {
+	ID      string
+	JobID   string
+	Pages   []*scanner.Page
+	Created time.Time
+}
+
+type rawFrameStore struct {
+	frames map[string]*rawFrames
+	lock   sync.Mutex
+}
+
+var rawFrameScans = &rawFrameStore{frames: map[string]*rawFrames{}}
+
+// Add keeps the originals of the pages, pages without original are
+// left out
+func (s *rawFrameStore) Add(jobID string, pages []*scanner.Page) *rawFrames {
+	f := &rawFrames{ID: newID(), JobID: jobID, Created: time.Now()}
+	for _, p := range pages {
+		if p.Original != nil {
+			f.Pages = append(f.Pages, p.Original)
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for id, e := range s.frames {
+		if time.Since(e.Created) > rawFramesTTL {
+			delete(s.frames, id)
+		}
+	}
+
+	s.frames[f.ID] = f
+	return f
+}
+
+func (s *rawFrameStore) Get(id string) *rawFrames {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f := s.frames[id]
+	if f == nil || time.Since(f.Created) > rawFramesTTL {
+		return nil
+	}
+	return f
+}
+
+// page returns the frame by its page number in the batch
+func (f rawFrames) page(n int) *scanner.Page {
+	for _, p := range f.Pages {
+		if p.Index+1 == n {
+			return p
+		}
+	}
+	return nil
+}
+
+func handleRawFramesSummary(res http.ResponseWriter, r *http.Request) {
+	f := rawFrameScans.Get(r.PathValue("id"))
+	if f == nil {
+		writeError(res, http.StatusNotFound, errCodeNotFound, "Raw frames not found or expired")
+		return
+	}
+
+	type frameSummary struct {
+		Page   int    `json:"page"`
+		Width  int    `json:"width"`
+		Height int    `json:"height"`
+		DPI    int    `json:"dpi"`
+		Color  string `json:"color"`
+		PNG    string `json:"png"`
+		PNM    string `json:"pnm"`
+	}
+
+	summary := []frameSummary{}
+	for _, p := range f.Pages {
+		summary = append(summary, frameSummary{
+			Page:   p.Index + 1,
+			Width:  p.Width,
+			Height: p.Height,
+			DPI:    p.DPI,
+			Color:  p.Color,
+			PNG:    fmt.Sprintf("/raw-frames/%s/%d.png", f.ID, p.Index+1),
+			PNM:    fmt.Sprintf("/raw-frames/%s/%d.pnm", f.ID, p.Index+1),
+		})
+	}
+
+	writeJSON(res, http.StatusOK, map[string]interface{}{
+		"id":     f.ID,
+		"job_id": f.JobID,
+		"pages":  summary,
+	})
+}
+
+// handleRawFrame serves /raw-frames/{id}/{page}.png and .pnm
+func handleRawFrame(res http.ResponseWriter, r *http.Request) {
+	f := rawFrameScans.Get(r.PathValue("id"))
+	if f == nil {
+		writeError(res, http.StatusNotFound, errCodeNotFound, "Raw frames not found or expired")
+		return
+	}
+
+	var (
+		file = r.PathValue("file")
+		ext  = path.Ext(file)
+		p    *scanner.Page
+	)
+	if n, err := strconv.Atoi(strings.TrimSuffix(file, ext)); err == nil {
+		p = f.page(n)
+	}
+	if p == nil || (ext != ".png" && ext != ".pnm") {
+		writeError(res, http.StatusNotFound, errCodeNotFound, "Page not found")
+		return
+	}
+
+	data, err := p.ImageData()
+	if err != nil {
+		log.WithError(err).Error("Unable to read raw frame")
+		writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to read raw frame")
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-cache")
+	if ext == ".png" {
+		res.Header().Set("Content-Type", "image/png")
+		res.Write(data)
+		return
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		log.WithError(err).Error("Unable to decode raw frame")
+		writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to decode raw frame")
+		return
+	}
+
+	res.Header().Set("Content-Type", "image/x-portable-anymap")
+	w := bufio.NewWriter(res)
+	writePNM(w, img)
+	w.Flush()
+}
+
+// writePNM writes the image as binary PGM (gray) or PPM (color) with
+// 8 bit per sample
+func writePNM(w *bufio.Writer, img image.Image) {
+	b := img.Bounds()
+
+	if g, ok := img.(*image.Gray); ok {
+		fmt.Fprintf(w, "P5\n%d %d\n255\n", b.Dx(), b.Dy())
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			off := g.PixOffset(b.Min.X, y)
+			w.Write(g.Pix[off : off+b.Dx()])
+		}
+		return
+	}
+
+	fmt.Fprintf(w, "P6\n%d %d\n255\n", b.Dx(), b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			w.Write([]byte{byte(r >> 8), byte(g >> 8), byte(bl >> 8)})
+		}
+	}
+}
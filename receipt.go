@@ -0,0 +1,188 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+)
+
+// receiptDefaults are the parameters of receipt scans not given by the
+// request or its profile: the faint thermal print is cropped, enhanced
+// and recognized
+var receiptDefaults = map[string]string{
+	"blank-pages": blankPagesBacks,
+	"color":       scanner.ColorModeGray,
+	"contrast":    "30",
+	"duplex":      "false",
+	"pipeline":    "crop margin=3, ocr",
+}
+
+var (
+	receiptAmountPattern  = regexp.MustCompile(`\b(\d{1,3}(?:[.,']\d{3})*|\d+)[.,](\d{2})\b`)
+	receiptTotalPattern   = regexp.MustCompile(`(?i)\b(?:summe|gesamt\w*|total|zu zahlen|betrag|amount due|balance due|grand total)\b`)
+	receiptExcludePattern = regexp.MustCompile(`(?i)\b(?:zwischensumme|subtotal|sub-total|netto|net|mwst|ust|vat|tax|gegeben|rückgeld|change|cash)\b`)
+	receiptDatePatterns   = []struct {
+		pattern *regexp.Regexp
+		layout  string
+	}{
+		{regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}\b`), "2006-01-02"},
+		{regexp.MustCompile(`\b\d{1,2}\.\d{1,2}\.\d{4}\b`), "2.1.2006"},
+		{regexp.MustCompile(`\b\d{1,2}\.\d{1,2}\.\d{2}\b`), "2.1.06"},
+		{regexp.MustCompile(`\b\d{1,2}/\d{1,2}/\d{4}\b`), "2/1/2006"},
+	}
+	receiptCurrencies = []struct{ symbol, code string }{
+		{"€", "EUR"}, {"EUR", "EUR"}, {"CHF", "CHF"}, {"£", "GBP"}, {"GBP", "GBP"}, {"$", "USD"}, {"USD", "USD"},
+	}
+)
+
+// receiptSummary contains the expense data guessed from a receipt,
+// fields not found are left empty
+type receiptSummary struct {
+	File     string `json:"file"`
+	Pages    int    `json:"pages"`
+	Vendor   string `json:"vendor"`
+	Date     string `json:"date"`
+	Total    string `json:"total"`
+	Currency string `json:"currency"`
+}
+
+// writeReceiptZIP writes every receipt (sheet) as PDF into a ZIP archive
+// followed by the summary of all receipts as CSV and JSON
+func writeReceiptZIP(w io.Writer, params *scanParams, pages []*scanner.Page, base string) error {
+	var (
+		zw        = zip.NewWriter(w)
+		summaries = []receiptSummary{}
+	)
+
+	add := func(name string) (io.Writer, error) {
+		return zw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+	}
+
+	for i, sheet := range splitSheets(pages, params.Duplex) {
+		s := summarizeReceipt(sheet)
+		s.File = fmt.Sprintf("%s_%03d.pdf", base, i+1)
+		summaries = append(summaries, s)
+
+		fw, err := add(s.File)
+		if err != nil {
+			return fmt.Errorf("Unable to add receipt %d to archive: %s", i+1, err)
+		}
+		if err := writePDF(fw, params, sheet); err != nil {
+			return fmt.Errorf("Unable to generate receipt %d: %s", i+1, err)
+		}
+	}
+
+	fw, err := add(base + ".csv")
+	if err != nil {
+		return fmt.Errorf("Unable to add summary to archive: %s", err)
+	}
+	cw := csv.NewWriter(fw)
+	cw.Write([]string{"file", "pages", "vendor", "date", "total", "currency"})
+	for _, s := range summaries {
+		cw.Write([]string{s.File, strconv.Itoa(s.Pages), s.Vendor, s.Date, s.Total, s.Currency})
+	}
+	cw.Flush()
+	if err = cw.Error(); err != nil {
+		return fmt.Errorf("Unable to write summary: %s", err)
+	}
+
+	if fw, err = add(base + ".json"); err != nil {
+		return fmt.Errorf("Unable to add summary to archive: %s", err)
+	}
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(summaries); err != nil {
+		return fmt.Errorf("Unable to write summary: %s", err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("Unable to finalize archive: %s", err)
+	}
+
+	return nil
+}
+
+// summarizeReceipt guesses the expense data from the recognized lines:
+// the vendor is the first line with letters, the total the amount of
+// the last line labeled as total or else the largest amount
+func summarizeReceipt(pages []*scanner.Page) receiptSummary {
+	s := receiptSummary{Pages: len(pages)}
+
+	lines := []string{}
+	for _, p := range pages {
+		lines = append(lines, pageLines(p)...)
+	}
+
+	var largest float64
+	for _, l := range lines {
+		date := receiptDate(l)
+		if s.Vendor == "" && strings.IndexFunc(l, unicode.IsLetter) >= 0 && date == "" && !receiptAmountPattern.MatchString(l) {
+			s.Vendor = l
+		}
+
+		if date != "" {
+			// The parts of the date would be taken as amounts
+			if s.Date == "" {
+				s.Date = date
+			}
+			continue
+		}
+
+		if s.Currency == "" {
+			for _, c := range receiptCurrencies {
+				if strings.Contains(l, c.symbol) {
+					s.Currency = c.code
+					break
+				}
+			}
+		}
+
+		for _, m := range receiptAmountPattern.FindAllStringSubmatch(l, -1) {
+			amount := strings.NewReplacer(".", "", ",", "", "'", "").Replace(m[1]) + "." + m[2]
+			v, err := strconv.ParseFloat(amount, 64)
+			if err != nil {
+				continue
+			}
+			if receiptTotalPattern.MatchString(l) && !receiptExcludePattern.MatchString(l) {
+				s.Total = strconv.FormatFloat(v, 'f', 2, 64)
+			}
+			if v > largest {
+				largest = v
+			}
+		}
+	}
+
+	if s.Total == "" && largest > 0 {
+		s.Total = strconv.FormatFloat(largest, 'f', 2, 64)
+	}
+
+	return s
+}
+
+// receiptDate returns the first date of the line as 2006-01-02, empty
+// if the line has none
+func receiptDate(line string) string {
+	for _, d := range receiptDatePatterns {
+		m := d.pattern.FindString(line)
+		if m == "" {
+			continue
+		}
+		if t, err := time.Parse(d.layout, m); err == nil {
+			return t.Format("2006-01-02")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadLock keeps reloads triggered by signal and admin API from
+// interleaving
+var reloadLock sync.Mutex
+
+// reloadConfig reads the profiles, scanner options, upload targets,
+// schedules and authentication again. A file failing to load keeps its previous
+// configuration, the errors of all files are returned. Running scans
+// keep the parameters they were started with.
+func reloadConfig() []string {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	var errs []string
+	fail := func(err error) { errs = append(errs, err.Error()) }
+
+	if cfg.Profiles != "" {
+		if err := loadProfiles(cfg.Profiles); err != nil {
+			fail(err)
+		}
+	}
+
+	if err := loadUserProfiles(cfg.UserProfile); err != nil {
+		fail(err)
+	}
+
+	if cfg.ScannerOptions != "" {
+		if err := loadScannerOptions(cfg.ScannerOptions); err != nil {
+			fail(err)
+		}
+	}
+
+	if cfg.Targets != "" {
+		if err := loadTargets(cfg.Targets); err != nil {
+			fail(err)
+		}
+	}
+
+	if cfg.Schedules != "" {
+		if err := loadSchedules(cfg.Schedules); err != nil {
+			fail(err)
+		}
+	}
+
+	if chain, err := buildAuthChain(); err != nil {
+		fail(err)
+	} else {
+		auth.Set(chain)
+	}
+
+	if len(errs) > 0 {
+		log.WithField("errors", errs).Error("Configuration reloaded with errors")
+	} else {
+		log.Info("Configuration reloaded")
+	}
+	return errs
+}
+
+// reloadOnSIGHUP reloads the configuration whenever the daemon receives
+// SIGHUP
+func reloadOnSIGHUP() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	go func() {
+		for range sig {
+			reloadConfig()
+		}
+	}()
+}
+
+func handleAdminReload(res http.ResponseWriter, r *http.Request) {
+	if errs := reloadConfig(); len(errs) > 0 {
+		writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to reload configuration: "+strings.Join(errs, "; "))
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
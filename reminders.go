@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Maintenance tasks done by the user whose reminders are based on the
+// pages scanned since they were done last
+const (
+	taskCleaning    = "cleaning"
+	taskCalibration = "calibration"
+)
+
+// reminderMessages are the titles and messages of the notifications
+// sent for due tasks, translated into the language of the target
+var reminderMessages = map[string][2]string{
+	taskCleaning:    {"Scanner cleaning due", "Scanner cleaning is due: %d pages were scanned since (reminder at %d pages)"},
+	taskCalibration: {"Scanner calibration due", "Scanner calibration is due: %d pages were scanned since (reminder at %d pages)"},
+}
+
+var maintenanceTasks = []string{taskCleaning, taskCalibration}
+
+// maintenanceRecord is the lifetime page count at which the task was
+// done last, kept with the scan totals
+type maintenanceRecord struct {
+	Pages int       `json:"pages"`
+	Time  time.Time `json:"time"`
+	// Reminded is set once the reminder was sent until the task is done
+	Reminded bool `json:"reminded,omitempty"`
+}
+
+// maintenanceReminder tells how many pages were scanned since the task
+// was done and whether it is due
+type maintenanceReminder struct {
+	Task      string     `json:"task"`
+	Pages     int        `json:"pages"`
+	Threshold int        `json:"threshold,omitempty"`
+	LastDone  *time.Time `json:"last_done,omitempty"`
+	Due       bool       `json:"due"`
+}
+
+// reminderThreshold returns the pages after which the task is due, 0 if
+// no reminder is configured
+func reminderThreshold(task string) int {
+	switch task {
+	case taskCleaning:
+		return cfg.CleaningReminder
+	case taskCalibration:
+		return cfg.CalibrationReminder
+	}
+	return 0
+}
+
+// reminder must be called with the lock held
+func (d *dutyCycleStats) reminder(task string) maintenanceReminder {
+	r := maintenanceReminder{Task: task, Pages: d.totals.Pages, Threshold: reminderThreshold(task)}
+	if rec := d.totals.Maintenance[task]; rec != nil {
+		r.Pages -= rec.Pages
+		if !rec.Time.IsZero() {
+			done := rec.Time
+			r.LastDone = &done
+		}
+	}
+	r.Due = r.Threshold > 0 && r.Pages >= r.Threshold
+	return r
+}
+
+// Reminders returns the state of all maintenance tasks
+func (d *dutyCycleStats) Reminders() []maintenanceReminder {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	out := []maintenanceReminder{}
+	for _, task := range maintenanceTasks {
+		out = append(out, d.reminder(task))
+	}
+	return out
+}
+
+// maintenanceDone resets the pages of the task to the current count
+func (d *dutyCycleStats) maintenanceDone(task string) maintenanceReminder {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.totals.Maintenance == nil {
+		d.totals.Maintenance = map[string]*maintenanceRecord{}
+	}
+	d.totals.Maintenance[task] = &maintenanceRecord{Pages: d.totals.Pages, Time: time.Now()}
+	d.saveTotals()
+	return d.reminder(task)
+}
+
+// dueReminders returns the tasks which became due since the last call
+// and marks them as reminded
+func (d *dutyCycleStats) dueReminders() []maintenanceReminder {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	due := []maintenanceReminder{}
+	for _, task := range maintenanceTasks {
+		r := d.reminder(task)
+		rec := d.totals.Maintenance[task]
+		if !r.Due || (rec != nil && rec.Reminded) {
+			continue
+		}
+
+		if d.totals.Maintenance == nil {
+			d.totals.Maintenance = map[string]*maintenanceRecord{}
+		}
+		if rec == nil {
+			// Never done, the count starts with the first scanned page
+			rec = &maintenanceRecord{}
+			d.totals.Maintenance[task] = rec
+		}
+		rec.Reminded = true
+		due = append(due, r)
+	}
+
+	if len(due) > 0 {
+		d.saveTotals()
+	}
+	return due
+}
+
+// checkReminders logs, publishes and notifies the tasks which became due
+// with the last scan, once until they are done
+func checkReminders() {
+	for _, r := range dutyCycle.dueReminders() {
+		log.WithFields(log.Fields{
+			"task":      r.Task,
+			"pages":     r.Pages,
+			"threshold": r.Threshold,
+		}).Warn("Maintenance is due, reset the reminder using POST /maintenance/" + r.Task + " once it is done")
+
+		publishEvent(scanEvent{Event: "maintenance_due", Task: r.Task, Pages: r.Pages})
+		texts := reminderMessages[r.Task]
+		notifyMessage(nonEmpty(cfg.MaintenanceNotify), texts[0], texts[1], r.Pages, r.Threshold)
+	}
+}
+
+// notifyMessage sends the message formatted using the args to the named
+// notification targets
+func notifyMessage(names []string, title, msg string, args ...interface{}) {
+	targetsLock.RLock()
+	notifiers := map[string]messageNotifier{}
+	for _, name := range names {
+		n, ok := uploadTargets[name].(messageNotifier)
+		if !ok {
+			log.WithField("target", name).Error("Target does not exist or is unable to send messages")
+			continue
+		}
+		notifiers[name] = n
+	}
+	targetsLock.RUnlock()
+
+	if len(notifiers) == 0 {
+		return
+	}
+
+	go func() {
+		for name, n := range notifiers {
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			if err := n.NotifyMessage(ctx, title, msg, args...); err != nil {
+				log.WithError(err).WithField("target", name).Error("Unable to send notification")
+			}
+			cancel()
+		}
+	}()
+}
+
+// handleMaintenanceDone records the task as done, the pages for its
+// reminder count from now on
+func handleMaintenanceDone(res http.ResponseWriter, r *http.Request) {
+	task := r.PathValue("task")
+	if task != taskCleaning && task != taskCalibration {
+		writeError(res, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("Unknown maintenance task %q (supported: cleaning, calibration)", task))
+		return
+	}
+
+	reminder := dutyCycle.maintenanceDone(task)
+	log.WithFields(log.Fields{"task": task, "user": requestUser(r)}).Info("Maintenance done, reminder reset")
+	writeJSON(res, http.StatusOK, reminder)
+}
+
+// writeReminderMetrics appends the pages since the maintenance tasks
+// were done to the metrics
+func writeReminderMetrics(w io.Writer) {
+	reminders := dutyCycle.Reminders()
+
+	fmt.Fprint(w, "# HELP scansnap_maintenance_pages_since Pages scanned since the maintenance task was done\n# TYPE scansnap_maintenance_pages_since gauge\n")
+	for _, r := range reminders {
+		fmt.Fprintf(w, "scansnap_maintenance_pages_since{task=%q} %d\n", r.Task, r.Pages)
+	}
+
+	fmt.Fprint(w, "# HELP scansnap_maintenance_due Whether the maintenance task is due\n# TYPE scansnap_maintenance_due gauge\n")
+	for _, r := range reminders {
+		if r.Threshold == 0 {
+			continue
+		}
+		due := 0
+		if r.Due {
+			due = 1
+		}
+		fmt.Fprintf(w, "scansnap_maintenance_due{task=%q} %d\n", r.Task, due)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Request IDs set by a proxy in front of the daemon are kept if they look
+// like an ID, otherwise a new one is generated
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// statusRecorder keeps the status of the response for the request log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+// Flush keeps streamed responses working through the recorder
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the connection
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// logRequests assigns every request an ID returned as X-Request-ID and
+// logs the request once it is answered
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = newID()
+		}
+		res.Header().Set("X-Request-ID", id)
+
+		rec := &statusRecorder{ResponseWriter: res}
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeyRequestID, id))
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		fields := log.Fields{
+			"request_id": id,
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"status":     rec.status,
+			"duration":   time.Since(start).Seconds(),
+			"remote":     r.RemoteAddr,
+		}
+		if jobID := res.Header().Get("X-Job-ID"); jobID != "" {
+			fields["job_id"] = jobID
+		}
+		log.WithFields(fields).Info("HTTP request")
+	})
+}
+
+// requestID returns the ID assigned to the request by logRequests
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(ctxKeyRequestID).(string)
+	return id
+}
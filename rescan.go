@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// Partial scans are kept this long for the user to feed the remaining
+// sheets again
+const partialScanTTL = time.Hour
+
+// partialScan holds the pages captured before a scan failed (e.g. due
+// to a paper jam) so a re-scan of the remaining sheets can be merged
+type partialScan struct {
+	ID     string
+	Params *scanParams
+	Pages  []*scanner.Page
+	// Fed is the number of pages fed including the ones removed as blank
+	// or unable to be processed, the resumed scan continues with it
+	Fed   int
+	Error string
+	// Status, ErrorCode and SANEStatus describe the cause of the
+	// failure
+	Status     int
+	ErrorCode  string
+	SANEStatus string
+	Created    time.Time
+}
+
+// SheetsDone returns the number of physical sheets captured completely
+func (p partialScan) SheetsDone() int {
+	if p.Params.Duplex {
+		return p.Fed / 2
+	}
+	return p.Fed
+}
+
+type partialScanStore struct {
+	scans map[string]*partialScan
+	lock  sync.Mutex
+}
+
+var partialScans = &partialScanStore{scans: map[string]*partialScan{}}
+
+// Add stores the captured pages of a failed scan, see completeSheets
+func (p *partialScanStore) Add(params *scanParams, pages []*scanner.Page, scanErr error) *partialScan {
+	pages, fed := completeSheets(params, pages, params.Fed)
+
+	status, code := partialScanError(scanErr)
+	ps := &partialScan{
+		ID:         newID(),
+		Params:     params,
+		Pages:      pages,
+		Fed:        fed,
+		Error:      scanErr.Error(),
+		Status:     status,
+		ErrorCode:  code,
+		SANEStatus: saneStatusName(scanErr),
+		Created:    time.Now(),
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.expire()
+	p.scans[ps.ID] = ps
+	return ps
+}
+
+func (p *partialScanStore) Get(id string) *partialScan {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.expire()
+	return p.scans[id]
+}
+
+func (p *partialScanStore) Remove(id string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.scans, id)
+}
+
+// expire removes old partial scans, the caller must hold the lock
+func (p *partialScanStore) expire() {
+	for id, ps := range p.scans {
+		if time.Since(ps.Created) > partialScanTTL {
+			delete(p.scans, id)
+		}
+	}
+}
+
+// completeSheets drops the pages of a sheet not captured completely
+// (duplex scan stopped between front and back) from the pages of a
+// failed scan as that sheet needs to be scanned again. The number of
+// pages fed is reduced to the complete sheets.
+func completeSheets(params *scanParams, pages []*scanner.Page, fed int) ([]*scanner.Page, int) {
+	if params.Duplex && fed%2 == 1 {
+		// Front side of a sheet without its back side
+		fed--
+		for len(pages) > 0 && pages[len(pages)-1].Index >= fed {
+			pages = pages[:len(pages)-1]
+		}
+	}
+	return pages, fed
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// rescanTemplate is cloned for every request to translate its texts
+// using T into the language of the client
+var rescanTemplate = template.Must(template.New("rescan").Funcs(template.FuncMap{"T": fmt.Sprintf}).Parse(`<!DOCTYPE html>
+<html lang="{{ .Lang }}">
+<head><meta charset="utf-8"><title>{{ T "Continue scan" }}</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 2em auto;">
+<h1>{{ T "Scan interrupted" }}</h1>
+<p>{{ T "The scan stopped with an error:" }} <code>{{ .Error }}</code></p>
+{{ if .Paper }}
+<p>{{ T "Paper size: %s" .Paper }}</p>
+{{ end }}
+{{ if .SheetsDone }}
+<p>{{ T "%d sheet(s) were captured successfully. The last good page looks like this:" .SheetsDone }}</p>
+<p><img src="/rescan/{{ .ID }}/last-page.jpg" alt="{{ T "Last captured page" }}" style="max-width: 100%; border: 1px solid #ccc;"></p>
+{{ end }}
+<p>{{ T "Place the sheets starting with" }} <strong>{{ T "sheet %d" .NextSheet }}</strong> {{ T "back into the feeder and continue the scan. The new pages are appended to the %d page(s) already captured." (len .Pages) }}</p>
+<p><a href="/scan.pdf?resume={{ .ID }}">{{ T "Continue scan" }}</a></p>
+</body>
+</html>`))
+
+func handleRescanAssistant(res http.ResponseWriter, r *http.Request) {
+	ps := partialScans.Get(r.PathValue("id"))
+	if ps == nil {
+		writeError(res, http.StatusNotFound, errCodeNotFound, "Partial scan not found or expired")
+		return
+	}
+
+	lang := responseLanguage(res)
+	tpl := template.Must(rescanTemplate.Clone()).Funcs(template.FuncMap{
+		"T": func(msg string, args ...interface{}) string { return localize(lang, msg, args...) },
+	})
+
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Content-Language", lang)
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Add("Vary", "Accept-Language")
+	if err := tpl.Execute(res, struct {
+		*partialScan
+		SheetsDone, NextSheet int
+		Lang, Paper           string
+	}{ps, ps.SheetsDone(), ps.SheetsDone() + 1, lang, responsePaperSize(res, ps.Params)}); err != nil {
+		log.WithError(err).Error("Unable to render rescan assistant")
+	}
+}
+
+func handleRescanLastPage(res http.ResponseWriter, r *http.Request) {
+	ps := partialScans.Get(r.PathValue("id"))
+	if ps == nil || len(ps.Pages) == 0 {
+		writeError(res, http.StatusNotFound, errCodeNotFound, "Partial scan not found or expired")
+		return
+	}
+
+	res.Header().Set("Content-Type", "image/jpeg")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Write(ps.Pages[len(ps.Pages)-1].Thumbnail)
+}
+
+// respondPartialScan tells the client where to continue a failed scan
+func respondPartialScan(res http.ResponseWriter, ps *partialScan) {
+	assistant := fmt.Sprintf("/rescan/%s", ps.ID)
+
+	res.Header().Set("X-Rescan-ID", ps.ID)
+	res.Header().Set("Location", assistant)
+	writeAPIError(res, ps.Status, apiError{
+		Code: ps.ErrorCode,
+		Message: fmt.Sprintf(
+			"Scan failed after %d sheet(s): %s\nPlace the sheets starting with sheet %d back into the feeder and continue at %s",
+			ps.SheetsDone(), ps.Error, ps.SheetsDone()+1, assistant,
+		),
+		SANEStatus:    ps.SANEStatus,
+		JobID:         ps.Params.JobID,
+		PagesCaptured: len(ps.Pages),
+		RescanID:      ps.ID,
+	})
+}
+
+// partialScanError returns the status and code for the cause of the
+// failure, scan_interrupted unless it has a more specific one
+func partialScanError(err error) (int, string) {
+	if status, code := scanErrorStatus(err); code != errCodeScanFailed {
+		return status, code
+	}
+	return http.StatusInternalServerError, errCodeScanInterrupted
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// scanResult is a document kept for --result-ttl without scan storage
+// to download it again if the transfer of the response failed
+type scanResult struct {
+	ID          string    `json:"id"`
+	JobID       string    `json:"job_id"`
+	File        string    `json:"file"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	SHA256      string    `json:"sha256"`
+	Created     time.Time `json:"created"`
+}
+
+type scanResultStore struct {
+	results map[string]*scanResult
+	lock    sync.Mutex
+}
+
+var scanResults = &scanResultStore{results: map[string]*scanResult{}}
+
+// Add keeps the document file, a link to it is created so the file can
+// be removed after the delivery to the targets. The ID is random, not
+// the job ID, to serve as download token. With --state-dir the result
+// is kept there to survive restarts.
+func (s *scanResultStore) Add(doc *deliveryDocument, checksum string) (*scanResult, error) {
+	res := &scanResult{
+		ID:          newID(),
+		JobID:       doc.JobID,
+		File:        doc.File + ".result",
+		Filename:    doc.Filename,
+		ContentType: doc.ContentType,
+		SHA256:      checksum,
+		Created:     time.Now(),
+	}
+
+	if jobState == nil {
+		if err := os.Link(doc.File, res.File); err != nil {
+			return nil, err
+		}
+	} else {
+		res.File = jobState.DataFile("results", res.ID)
+		if err := linkOrCopy(doc.File, res.File); err != nil {
+			return nil, err
+		}
+		if err := jobState.Save("results", res.ID, res); err != nil {
+			os.Remove(res.File)
+			return nil, err
+		}
+	}
+
+	s.lock.Lock()
+	s.results[res.ID] = res
+	s.lock.Unlock()
+
+	time.AfterFunc(cfg.ResultTTL, func() { s.remove(res) })
+	return res, nil
+}
+
+func (s *scanResultStore) Get(id string) *scanResult {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.results[id]
+}
+
+// Restore loads the results kept by the previous run from the state
+// directory, they expire --result-ttl after they were created
+func (s *scanResultStore) Restore() {
+	jobState.Load("results", func(raw []byte) error {
+		res := &scanResult{}
+		if err := json.Unmarshal(raw, res); err != nil {
+			return err
+		}
+		if _, err := os.Stat(res.File); err != nil {
+			return err
+		}
+
+		s.lock.Lock()
+		s.results[res.ID] = res
+		s.lock.Unlock()
+
+		time.AfterFunc(cfg.ResultTTL-time.Since(res.Created), func() { s.remove(res) })
+		return nil
+	})
+}
+
+func (s *scanResultStore) remove(res *scanResult) {
+	s.lock.Lock()
+	delete(s.results, res.ID)
+	s.lock.Unlock()
+
+	// Downloads still running keep the open file readable
+	if err := os.Remove(res.File); err != nil {
+		log.WithError(err).WithField("job_id", res.JobID).Error("Unable to remove expired scan result")
+	}
+	if jobState != nil {
+		jobState.Remove("results", res.ID)
+	}
+}
+
+// serveScanResult answers GET /scans/{id}.pdf from the kept results,
+// false if there is no result with the ID
+func serveScanResult(res http.ResponseWriter, r *http.Request) bool {
+	file := r.PathValue("file")
+	ext := path.Ext(file)
+
+	result := scanResults.Get(strings.TrimSuffix(file, ext))
+	if result == nil {
+		return false
+	}
+	if ext != "" && ext != contentTypeExtension(result.ContentType) {
+		return false
+	}
+
+	if serveSelectedPages(res, r, result.File, result.ContentType, result.Filename) {
+		return true
+	}
+
+	// ServeFile answers range requests to continue broken downloads
+	res.Header().Set("X-Content-SHA256", result.SHA256)
+	res.Header().Set("ETag", `"`+result.SHA256+`"`)
+	res.Header().Set("Content-Type", result.ContentType)
+	res.Header().Set("Content-Disposition", contentDisposition(result.Filename))
+	http.ServeFile(res, r, result.File)
+	return true
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// retentionInterval is the time between cleanups besides the ones
+	// after every stored scan
+	retentionInterval = time.Hour
+	// retentionGracePeriod protects recent scans from the count and size
+	// limits while they are downloaded and delivered
+	retentionGracePeriod = time.Hour
+	// staleTempFileAge is the age of documents rendered for deliveries
+	// left behind by a crash, deliveries finish much faster
+	staleTempFileAge = 24 * time.Hour
+)
+
+// retentionState serializes the cleanups and keeps the size of the
+// storage found by the last one for the metrics
+type retentionState struct {
+	lock    sync.Mutex
+	trigger chan struct{}
+
+	scans int
+	bytes int64
+}
+
+var retention = &retentionState{trigger: make(chan struct{}, 1)}
+
+// Trigger requests a cleanup, e.g. after a scan was stored
+func (r *retentionState) Trigger() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+		// A cleanup is pending already
+	}
+}
+
+// Run cleans up at start, every retentionInterval and when triggered
+func (r *retentionState) Run() {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for {
+		r.cleanup()
+
+		select {
+		case <-ticker.C:
+		case <-r.trigger:
+		}
+	}
+}
+
+func (r *retentionState) cleanup() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var (
+		removed   int
+		reclaimed int64
+	)
+
+	if storage != nil {
+		removed, reclaimed = r.cleanupStorage()
+	}
+	reclaimed += cleanupStaleTempFiles()
+
+	if removed > 0 || reclaimed > 0 {
+		dutyCycle.recordRetention(removed, reclaimed)
+	}
+}
+
+// cleanupStorage removes the stored scans exceeding --retention-max-age,
+// --retention-max-count or --retention-max-size, oldest first
+func (r *retentionState) cleanupStorage() (removed int, reclaimed int64) {
+	recs, err := storage.List()
+	if err != nil {
+		log.WithError(err).Error("Unable to list stored scans for retention")
+		return 0, 0
+	}
+
+	var (
+		maxSize = int64(cfg.RetentionMaxSize) << 20
+		kept    int
+		size    int64
+	)
+
+	// Newest first, the scans are kept until a limit is reached
+	for _, rec := range recs {
+		age := time.Since(rec.Created)
+		expired := cfg.RetentionMaxAge > 0 && age > cfg.RetentionMaxAge
+		exceeds := (cfg.RetentionMaxCount > 0 && kept >= cfg.RetentionMaxCount) ||
+			(maxSize > 0 && size+int64(rec.Size) > maxSize)
+
+		if (expired || exceeds) && age > retentionGracePeriod {
+			n, err := storage.Remove(rec)
+			if err != nil {
+				log.WithError(err).WithField("scan_id", rec.ID).Error("Unable to remove stored scan")
+			} else {
+				log.WithFields(log.Fields{
+					"scan_id": rec.ID,
+					"created": rec.Created.Format(time.RFC3339),
+					"size":    n,
+				}).Info("Removed stored scan by retention policy")
+				removed++
+				reclaimed += n
+				continue
+			}
+		}
+
+		kept++
+		size += int64(rec.Size)
+	}
+
+	r.scans, r.bytes = kept, size
+	return removed, reclaimed
+}
+
+// cleanupStaleTempFiles removes the documents rendered for deliveries
+// by previous runs, the spooled pages are removed at start already
+func cleanupStaleTempFiles() (reclaimed int64) {
+	dir := cfg.SpoolDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+
+	maxAge := staleTempFileAge
+	if cfg.ResultTTL > maxAge {
+		// Kept results are links of these files
+		maxAge = cfg.ResultTTL
+	}
+
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), "scansnap-delivery-") || f.IsDir() || time.Since(f.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.Remove(path.Join(dir, f.Name())); err == nil {
+			log.WithField("file", f.Name()).Info("Removed stale delivery file")
+			reclaimed += f.Size()
+		}
+	}
+	return reclaimed
+}
+
+// writeRetentionMetrics appends the size of the storage to the metrics
+func writeRetentionMetrics(w io.Writer) {
+	if storage == nil {
+		return
+	}
+
+	retention.lock.Lock()
+	scans, bytes := retention.scans, retention.bytes
+	retention.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP scansnap_storage_scans Number of stored scans at the last cleanup\n# TYPE scansnap_storage_scans gauge\nscansnap_storage_scans %d\n", scans)
+	fmt.Fprintf(w, "# HELP scansnap_storage_bytes Size of the stored scans at the last cleanup\n# TYPE scansnap_storage_bytes gauge\nscansnap_storage_bytes %d\n", bytes)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/pdfgen"
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// routingSheetKey wraps the settings in the QR code to tell routing
+	// sheets apart from other codes containing JSON
+	routingSheetKey = "scansnap_routing"
+	// routingSheetQRSize is larger than on cover sheets to be read
+	// reliably from scans at low resolutions
+	routingSheetQRSize = 256.0
+)
+
+// routingSheet holds the settings encoded as JSON into the QR code of
+// a routing sheet placed on top of the stack
+type routingSheet struct {
+	Profile  string   `json:"profile,omitempty"`
+	Targets  []string `json:"targets,omitempty"`
+	Title    string   `json:"title,omitempty"`
+	Subject  string   `json:"subject,omitempty"`
+	Keywords string   `json:"keywords,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+func (s routingSheet) validate() error {
+	if s.Profile != "" && !profileExists(s.Profile) {
+		return fmt.Errorf("Unknown profile %q", s.Profile)
+	}
+
+	targetsLock.RLock()
+	defer targetsLock.RUnlock()
+
+	for _, t := range s.Targets {
+		if _, ok := uploadTargets[t]; !ok {
+			return fmt.Errorf("Unknown target %q", t)
+		}
+	}
+	return nil
+}
+
+// parseRoutingSheet returns the sheet encoded in one of the barcodes,
+// nil if none of them is a routing sheet
+func parseRoutingSheet(codes []string) *routingSheet {
+	for _, code := range codes {
+		var wrapped map[string]*routingSheet
+		if json.Unmarshal([]byte(code), &wrapped) != nil {
+			continue
+		}
+		if s := wrapped[routingSheetKey]; s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// applyRoutingSheet detects a routing sheet on the first page of the
+// batch, applies its settings and removes it. The scan was already done
+// when it is read: the profile only selects the route and the filename,
+// its scan and processing parameters do not apply.
+func applyRoutingSheet(params *scanParams, pages []*scanner.Page) []*scanner.Page {
+	if !cfg.RoutingSheets || len(pages) < 2 || pages[0].Index != 0 {
+		return pages
+	}
+
+	sheet := parseRoutingSheet(readBarcodes(pages))
+	if sheet == nil {
+		return pages
+	}
+
+	logger := params.logger().WithFields(log.Fields{"profile": sheet.Profile, "targets": sheet.Targets, "tags": sheet.Tags})
+	if err := sheet.validate(); err != nil {
+		// The targets file might have changed since printing the sheet,
+		// it is kept in the document for the user to notice
+		logger.WithError(err).Warn("Ignoring invalid routing sheet")
+		return pages
+	}
+	logger.Info("Applying routing sheet")
+
+	if sheet.Profile != "" {
+		params.Profile = sheet.Profile
+		params.Meta.Profile = sheet.Profile
+	}
+	for _, v := range []struct {
+		value string
+		field *string
+	}{
+		{sheet.Title, &params.Info.Title},
+		{sheet.Subject, &params.Info.Subject},
+		{sheet.Keywords, &params.Info.Keywords},
+	} {
+		if v.value != "" {
+			*v.field = v.value
+		}
+	}
+	params.RoutingSheet = sheet
+
+	pages[0].Release()
+	return pages[1:]
+}
+
+// handleRoutingSheet renders a printable routing sheet applying the
+// settings given by the query parameters to the scans it is put on
+func handleRoutingSheet(res http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sheet := routingSheet{
+		Profile:  q.Get("profile"),
+		Targets:  nonEmpty(q["target"]),
+		Title:    q.Get("title"),
+		Subject:  q.Get("subject"),
+		Keywords: q.Get("keywords"),
+		Tags:     nonEmpty(q["tag"]),
+	}
+	if err := sheet.validate(); err != nil {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	code, err := json.Marshal(map[string]routingSheet{routingSheetKey: sheet})
+	if err != nil {
+		writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to encode routing sheet")
+		return
+	}
+
+	lines := []string{"Place this sheet on top of the documents to scan."}
+	for _, f := range [][2]string{
+		{"Targets", strings.Join(sheet.Targets, ", ")},
+		{"Subject", sheet.Subject},
+		{"Keywords", sheet.Keywords},
+		{"Tags", strings.Join(sheet.Tags, ", ")},
+	} {
+		if f[1] != "" {
+			lines = append(lines, f[0]+": "+f[1])
+		}
+	}
+
+	title := "Routing sheet"
+	if sheet.Title != "" {
+		title += ": " + sheet.Title
+	}
+
+	content, err := coverSheet{
+		Title:   title,
+		Created: time.Now(),
+		Profile: sheet.Profile,
+		Text:    strings.Join(lines, "\n"),
+		QR:      string(code),
+		QRSize:  routingSheetQRSize,
+	}.Render()
+	if err != nil {
+		// The QR code holds about 200 bytes
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/pdf")
+	res.Header().Set("Content-Disposition", contentDisposition("routing-sheet.pdf"))
+
+	pdf := pdfgen.NewWriter(res, pdfgen.Options{Info: pdfgen.Info{
+		Title:        "Routing sheet",
+		Creator:      "scansnap-go " + version,
+		Producer:     "scansnap-go " + version,
+		CreationDate: time.Now(),
+	}})
+	if err = pdf.AddContentPage(content); err == nil {
+		err = pdf.Close()
+	}
+	if err != nil {
+		log.WithError(err).Error("Unable to render routing sheet")
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Upload target for S3 compatible object storages (AWS, MinIO, ...),
+// requests are signed using AWS Signature Version 4
+
+const (
+	s3DefaultPartSize = 16 // MiB
+	// S3 rejects parts smaller than 5 MiB except for the last one
+	s3MinPartSize = 5
+	s3MaxParts    = 10000
+)
+
+type s3Target struct {
+	Endpoint     string `yaml:"endpoint"`
+	Region       string `yaml:"region"`
+	Bucket       string `yaml:"bucket"`
+	Prefix       string `yaml:"prefix"`
+	AccessKey    string `yaml:"access_key"`
+	SecretKey    string `yaml:"secret_key"`
+	SessionToken string `yaml:"session_token"`
+	// SSE is the server side encryption ("AES256" or "aws:kms" using the
+	// optional SSEKMSKeyID)
+	SSE         string `yaml:"sse"`
+	SSEKMSKeyID string `yaml:"sse_kms_key_id"`
+	// VirtualHosted addresses the bucket as subdomain of the endpoint
+	// instead of the path (required by some providers)
+	VirtualHosted bool `yaml:"virtual_hosted"`
+	// PartSize in MiB, larger documents are uploaded in parts
+	PartSize int `yaml:"part_size"`
+
+	endpoint *url.URL
+	prefix   *template.Template
+
+	// Multipart uploads by document file kept to be continued by the
+	// next attempt of the delivery
+	uploadsLock sync.Mutex
+	uploads     map[string]*s3Upload
+}
+
+// s3Upload is a multipart upload with the parts uploaded so far
+type s3Upload struct {
+	Key      string
+	ID       string
+	PartSize int64
+	Parts    []s3Part
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// s3Error is an error response of the storage
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e s3Error) Error() string {
+	return fmt.Sprintf("Unexpected status %d: %s %s", e.Status, e.Code, e.Message)
+}
+
+func newS3Target(decode func(interface{}) error) (uploadTarget, error) {
+	t := &s3Target{
+		Region:    "us-east-1",
+		PartSize:  s3DefaultPartSize,
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		uploads:   map[string]*s3Upload{},
+	}
+	if err := decode(t); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if t.endpoint, err = url.ParseRequestURI(t.Endpoint); err != nil || t.endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", t.Endpoint)
+	}
+	if t.Bucket == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	if t.AccessKey == "" || t.SecretKey == "" {
+		return nil, fmt.Errorf("access_key and secret_key are required")
+	}
+	if t.PartSize < s3MinPartSize {
+		return nil, fmt.Errorf("part_size must be at least %d MiB", s3MinPartSize)
+	}
+
+	switch t.SSE {
+	case "", "AES256", "aws:kms":
+	default:
+		return nil, fmt.Errorf("unsupported sse %q (supported: AES256, aws:kms)", t.SSE)
+	}
+	if t.SSEKMSKeyID != "" && t.SSE != "aws:kms" {
+		return nil, fmt.Errorf("sse_kms_key_id requires sse aws:kms")
+	}
+
+	if t.prefix, err = template.New("prefix").Parse(t.Prefix); err != nil {
+		return nil, fmt.Errorf("invalid prefix template: %s", err)
+	}
+
+	return t, nil
+}
+
+// Address implements addressedTarget
+func (s *s3Target) Address() string { return urlAddress(s.Endpoint) }
+
+// Upload implements uploadTarget
+func (s *s3Target) Upload(ctx context.Context, doc *deliveryDocument) error {
+	prefix := new(bytes.Buffer)
+	if err := s.prefix.Execute(prefix, doc); err != nil {
+		return fmt.Errorf("Unable to render prefix: %s", err)
+	}
+	key := strings.TrimPrefix(prefix.String()+doc.Filename, "/")
+
+	f, size, err := doc.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	partSize := int64(s.PartSize) << 20
+	for size > partSize*s3MaxParts {
+		partSize *= 2
+	}
+
+	if size <= partSize {
+		body, err := ioutil.ReadAll(f)
+		if err != nil {
+			return fmt.Errorf("Unable to read document: %s", err)
+		}
+
+		resp, err := s.do(ctx, http.MethodPut, key, nil, s.objectHeaders(doc), body)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	return s.multipartUpload(ctx, key, doc, f, size, partSize)
+}
+
+// Discard implements resumableTarget by aborting the multipart upload
+// of the document
+func (s *s3Target) Discard(doc *deliveryDocument) {
+	s.uploadsLock.Lock()
+	upload := s.uploads[doc.File]
+	delete(s.uploads, doc.File)
+	s.uploadsLock.Unlock()
+
+	if upload != nil {
+		s.abort(upload)
+	}
+}
+
+// abort deletes the multipart upload and its parts
+func (s *s3Target) abort(upload *s3Upload) {
+	if resp, err := s.do(context.Background(), http.MethodDelete, upload.Key, url.Values{"uploadId": {upload.ID}}, nil, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// pendingUpload returns the multipart upload of the document started by
+// a previous attempt or starts a new one
+func (s *s3Target) pendingUpload(ctx context.Context, key string, doc *deliveryDocument, partSize int64) (*s3Upload, error) {
+	s.uploadsLock.Lock()
+	upload := s.uploads[doc.File]
+	s.uploadsLock.Unlock()
+
+	if upload != nil && upload.Key == key && upload.PartSize == partSize {
+		return upload, nil
+	}
+	if upload != nil {
+		s.Discard(doc)
+	}
+
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, s.objectHeaders(doc), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to start multipart upload: %s", err)
+	}
+
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil || initiated.UploadID == "" {
+		return nil, fmt.Errorf("Invalid response starting multipart upload: %v", err)
+	}
+
+	upload = &s3Upload{Key: key, ID: initiated.UploadID, PartSize: partSize}
+	s.uploadsLock.Lock()
+	s.uploads[doc.File] = upload
+	s.uploadsLock.Unlock()
+
+	return upload, nil
+}
+
+// multipartUpload uploads the document in parts of partSize. The parts
+// of a failed upload are kept and the next attempt continues after them
+// until the delivery is given up and the upload discarded.
+func (s *s3Target) multipartUpload(ctx context.Context, key string, doc *deliveryDocument, f io.ReadSeeker, size, partSize int64) error {
+	upload, err := s.pendingUpload(ctx, key, doc, partSize)
+	if err != nil {
+		return err
+	}
+
+	sent := int64(len(upload.Parts)) * partSize
+	if _, err = f.Seek(sent, io.SeekStart); err != nil {
+		return fmt.Errorf("Unable to seek document: %s", err)
+	}
+	if sent > 0 {
+		doc.reportProgress(sent, size)
+	}
+
+	buf := make([]byte, partSize)
+	for n := len(upload.Parts) + 1; sent < size; n++ {
+		l, err := io.ReadFull(f, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("Unable to read document: %s", err)
+		}
+
+		q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {upload.ID}}
+		resp, err := s.do(ctx, http.MethodPut, key, q, nil, buf[:l])
+		if err != nil {
+			if e, ok := err.(s3Error); ok && e.Code == "NoSuchUpload" {
+				// Expired or aborted by the storage, start over next time
+				s.forget(doc)
+			}
+			return fmt.Errorf("Unable to upload part %d: %s", n, err)
+		}
+		resp.Body.Close()
+
+		upload.Parts = append(upload.Parts, s3Part{n, resp.Header.Get("ETag")})
+		sent += int64(l)
+		doc.reportProgress(sent, size)
+	}
+
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: upload.Parts}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return fmt.Errorf("Unable to encode parts: %s", err)
+	}
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {upload.ID}}, http.Header{"Content-Type": {"application/xml"}}, body)
+	if err != nil {
+		return fmt.Errorf("Unable to complete multipart upload: %s", err)
+	}
+
+	// Failures are reported with status 200 once the parts are being
+	// combined, the parts are not used again then
+	var result struct {
+		XMLName xml.Name
+		Message string `xml:"Message"`
+	}
+	xml.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if result.XMLName.Local == "Error" {
+		s.Discard(doc)
+		return fmt.Errorf("Unable to complete multipart upload: %s", result.Message)
+	}
+
+	s.forget(doc)
+	return nil
+}
+
+// forget drops the multipart upload of the document without aborting it
+func (s *s3Target) forget(doc *deliveryDocument) {
+	s.uploadsLock.Lock()
+	delete(s.uploads, doc.File)
+	s.uploadsLock.Unlock()
+}
+
+func (s *s3Target) objectHeaders(doc *deliveryDocument) http.Header {
+	h := http.Header{"Content-Type": {doc.ContentType}}
+	if s.SSE != "" {
+		h.Set("X-Amz-Server-Side-Encryption", s.SSE)
+	}
+	if s.SSEKMSKeyID != "" {
+		h.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", s.SSEKMSKeyID)
+	}
+	return h
+}
+
+// do executes a signed request for the object and converts error
+// responses into errors
+func (s *s3Target) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	path := "/" + key
+	if s.VirtualHosted {
+		u.Host = s.Bucket + "." + u.Host
+	} else {
+		path = "/" + s.Bucket + path
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = s3Escape(strings.TrimSuffix(s.endpoint.Path, "/")+path, false)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create request: %s", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	sum := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(sum[:]), time.Now())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to execute request: %s", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+
+		var s3Err struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		xml.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&s3Err)
+		return nil, s3Error{resp.StatusCode, s3Err.Code, s3Err.Message}
+	}
+
+	return resp, nil
+}
+
+// sign adds the AWS Signature Version 4 authorization to the request,
+// host and all x-amz-* headers are signed
+func (s *s3Target) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	var (
+		amzDate = now.Format("20060102T150405Z")
+		scope   = strings.Join([]string{now.Format("20060102"), s.Region, "s3", "aws4_request"}, "/")
+	)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	values := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-amz-") {
+			values[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+
+	names := make([]string, 0, len(values))
+	for k := range values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var headers strings.Builder
+	for _, k := range names {
+		headers.WriteString(k + ":" + values[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.AccessKey, scope, signed, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3CanonicalQuery encodes the query sorted by key as required for
+// signing, it is used as the query of the request as well
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything except the unreserved characters
+// of RFC 3986, slashes are kept unless encodeSlash is set
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,925 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/sane"
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// Server side of the SANE network protocol (protocol version 3 as
+// spoken by saned and the SANE "net" backend) giving SANE frontends on
+// other hosts access to the scanner. While a client has the device
+// opened it is not available for other scans.
+
+// Procedures of the protocol
+const (
+	sanedProcInit = iota
+	sanedProcGetDevices
+	sanedProcOpen
+	sanedProcClose
+	sanedProcGetOptionDescriptors
+	sanedProcControlOption
+	sanedProcGetParameters
+	sanedProcStart
+	sanedProcCancel
+	sanedProcAuthorize
+	sanedProcExit
+)
+
+const (
+	// SANE_VERSION_CODE(1, 0, 3)
+	sanedVersion = 1<<24 | 3
+
+	sanedStatusGood        = 0
+	sanedStatusUnsupported = 1
+	sanedStatusCancelled   = 2
+	sanedStatusBusy        = 3
+	sanedStatusInvalid     = 4
+	sanedStatusEOF         = 5
+	sanedStatusJammed      = 6
+	sanedStatusNoDocs      = 7
+	sanedStatusCoverOpen   = 8
+	sanedStatusIOError     = 9
+	sanedStatusNoMem       = 10
+	sanedStatusDenied      = 11
+
+	sanedTypeBool   = 0
+	sanedTypeInt    = 1
+	sanedTypeFixed  = 2
+	sanedTypeString = 3
+	sanedTypeButton = 4
+	sanedTypeGroup  = 5
+
+	sanedActionGet  = 0
+	sanedActionSet  = 1
+	sanedActionAuto = 2
+
+	// sanedIdleTimeout closes connections not sending any request, this
+	// also releases a device opened by a vanished client
+	sanedIdleTimeout = 5 * time.Minute
+	// sanedStringSize is the buffer size announced for string options
+	// without string list
+	sanedStringSize = 256
+)
+
+var sanedStatusCodes = map[error]int{
+	sane.ErrUnsupported: sanedStatusUnsupported,
+	sane.ErrCancelled:   sanedStatusCancelled,
+	sane.ErrBusy:        sanedStatusBusy,
+	sane.ErrInvalid:     sanedStatusInvalid,
+	sane.ErrJammed:      sanedStatusJammed,
+	sane.ErrEmpty:       sanedStatusNoDocs,
+	sane.ErrCoverOpen:   sanedStatusCoverOpen,
+	sane.ErrIo:          sanedStatusIOError,
+	sane.ErrNoMem:       sanedStatusNoMem,
+	sane.ErrDenied:      sanedStatusDenied,
+}
+
+func sanedStatus(err error) int {
+	if err == nil {
+		return sanedStatusGood
+	}
+	for e, code := range sanedStatusCodes {
+		if errors.Is(err, e) {
+			return code
+		}
+	}
+	var unavailable scanner.UnavailableError
+	if errors.As(err, &unavailable) {
+		return sanedStatusIOError
+	}
+	return sanedStatusInvalid
+}
+
+func listenAndServeSANED() error {
+	allowed, err := parseNetworks("saned-allow", cfg.SANEDAllow)
+	if err != nil {
+		return err
+	}
+	if auth.Enabled() && len(allowed) == 0 {
+		// SANE clients are not able to use any of the configured
+		// authentication methods
+		return fmt.Errorf("--saned-allow is required when authentication is configured")
+	}
+
+	l, err := net.Listen("tcp", cfg.SANEDListen)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for SANE network clients: %s", err)
+	}
+
+	log.WithField("listen", cfg.SANEDListen).Info("Serving the scanner using the SANE network protocol")
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return fmt.Errorf("Unable to accept SANE network client: %s", err)
+		}
+
+		if !sanedAllowed(allowed, conn.RemoteAddr()) || !sanedAllowed(allowedNetworks, conn.RemoteAddr()) {
+			log.WithField("remote", conn.RemoteAddr()).Warn("SANE network client not allowed by --saned-allow or --allow-cidr")
+			conn.Close()
+			continue
+		}
+
+		go (&sanedConn{conn: conn, wire: newSANEDWire(conn)}).serve()
+	}
+}
+
+func sanedAllowed(allowed []*net.IPNet, addr net.Addr) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	tcp, ok := addr.(*net.TCPAddr)
+	return ok && networkAllowed(allowed, tcp.IP)
+}
+
+// sanedWire encodes and decodes the values of the protocol, errors are
+// kept and reported by flush
+type sanedWire struct {
+	r   *bufio.Reader
+	w   *bufio.Writer
+	err error
+}
+
+func newSANEDWire(rw io.ReadWriter) *sanedWire {
+	return &sanedWire{r: bufio.NewReader(rw), w: bufio.NewWriter(rw)}
+}
+
+func (s *sanedWire) word() int {
+	b := make([]byte, 4)
+	if s.err == nil {
+		_, s.err = io.ReadFull(s.r, b)
+	}
+	return int(int32(binary.BigEndian.Uint32(b)))
+}
+
+// bytes reads an array of characters, strings include their NUL
+// terminator
+func (s *sanedWire) bytes() []byte {
+	n := s.word()
+	if s.err != nil || n <= 0 {
+		return nil
+	}
+	if n > 1<<16 {
+		s.err = fmt.Errorf("Array of %d bytes too large", n)
+		return nil
+	}
+
+	b := make([]byte, n)
+	_, s.err = io.ReadFull(s.r, b)
+	return b
+}
+
+func (s *sanedWire) string() string {
+	b := s.bytes()
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func (s *sanedWire) putWord(v int) {
+	if s.err == nil {
+		s.err = binary.Write(s.w, binary.BigEndian, int32(v))
+	}
+}
+
+func (s *sanedWire) putBytes(b []byte) {
+	s.putWord(len(b))
+	if s.err == nil {
+		_, s.err = s.w.Write(b)
+	}
+}
+
+// putString writes a string, empty strings are sent as NULL
+func (s *sanedWire) putString(v string) {
+	if v == "" {
+		s.putWord(0)
+		return
+	}
+	s.putBytes(append([]byte(v), 0))
+}
+
+func (s *sanedWire) flush() error {
+	if s.err == nil {
+		s.err = s.w.Flush()
+	}
+	return s.err
+}
+
+// sanedOption is an entry of the option list sent to the client,
+// option 0 (number of options) and groups have no Option
+type sanedOption struct {
+	Group  string
+	Option *sane.Option
+}
+
+type sanedConn struct {
+	conn    net.Conn
+	wire    *sanedWire
+	user    string
+	session *scanner.Session
+	options []sanedOption
+	// reading is closed when the transfer of the current frame ended
+	reading chan struct{}
+}
+
+func (s *sanedConn) logger() *log.Entry {
+	return log.WithFields(log.Fields{"remote": s.conn.RemoteAddr(), "user": s.user})
+}
+
+func (s *sanedConn) serve() {
+	defer s.close()
+
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(sanedIdleTimeout))
+
+		proc := s.wire.word()
+		if s.wire.err != nil {
+			if s.wire.err != io.EOF {
+				s.logger().WithError(s.wire.err).Debug("SANE network connection closed")
+			}
+			return
+		}
+
+		if !s.handle(proc) {
+			return
+		}
+		if err := s.wire.flush(); err != nil {
+			s.logger().WithError(err).Debug("SANE network connection failed")
+			return
+		}
+	}
+}
+
+// handle executes the procedure, false ends the connection
+func (s *sanedConn) handle(proc int) bool {
+	w := s.wire
+
+	switch proc {
+	case sanedProcInit:
+		w.word()
+		s.user = w.string()
+		w.putWord(sanedStatusGood)
+		w.putWord(sanedVersion)
+		s.logger().Info("SANE network client connected")
+
+	case sanedProcGetDevices:
+		s.getDevices()
+
+	case sanedProcOpen:
+		s.open(w.string())
+
+	case sanedProcClose:
+		w.word()
+		s.closeSession()
+		w.putWord(0)
+
+	case sanedProcGetOptionDescriptors:
+		w.word()
+		s.getOptionDescriptors()
+
+	case sanedProcControlOption:
+		s.controlOption()
+
+	case sanedProcGetParameters:
+		w.word()
+		s.getParameters()
+
+	case sanedProcStart:
+		w.word()
+		s.start()
+
+	case sanedProcCancel:
+		w.word()
+		if s.session != nil {
+			s.session.Conn.Cancel()
+		}
+		w.putWord(0)
+
+	case sanedProcAuthorize:
+		// Authorization is never requested by this server
+		w.string()
+		w.string()
+		w.string()
+		w.putWord(0)
+
+	case sanedProcExit:
+		return false
+
+	default:
+		s.logger().WithField("procedure", proc).Warn("Unknown SANE network procedure")
+		return false
+	}
+
+	return w.err == nil
+}
+
+func (s *sanedConn) close() {
+	s.closeSession()
+	s.conn.Close()
+}
+
+func (s *sanedConn) closeSession() {
+	if s.session == nil {
+		return
+	}
+
+	s.session.Conn.Cancel()
+	if s.reading != nil {
+		<-s.reading
+	}
+	s.session.Close()
+	s.session, s.options, s.reading = nil, nil, nil
+	s.logger().Info("SANE network client released the scanner")
+}
+
+func (s *sanedConn) getDevices() {
+	devs, busy, err := saneScanner.TryDevices()
+	switch {
+	case busy && s.session != nil:
+		devs, err = []sane.Device{s.session.Device}, nil
+	case busy:
+		err = sane.ErrBusy
+	}
+
+	s.wire.putWord(sanedStatus(err))
+	s.wire.putWord(len(devs) + 1)
+	for _, d := range devs {
+		s.wire.putWord(0)
+		s.wire.putString(d.Name)
+		s.wire.putString(d.Vendor)
+		s.wire.putString(d.Model)
+		s.wire.putString(d.Type)
+	}
+	// List is NULL terminated
+	s.wire.putWord(1)
+}
+
+func (s *sanedConn) open(device string) {
+	var err error
+
+	if s.session == nil {
+		s.session, err = saneScanner.OpenSession(device)
+	} else if device != "" && device != s.session.Device.Name {
+		// Only a single device is opened by a client at a time
+		err = sane.ErrBusy
+	}
+
+	if err != nil {
+		s.logger().WithError(err).WithField("device", device).Warn("SANE network client unable to open device")
+	} else {
+		s.logger().WithField("device", s.session.Device.Name).Info("SANE network client opened the scanner")
+	}
+
+	s.wire.putWord(sanedStatus(err))
+	s.wire.putWord(0)
+	s.wire.putString("")
+}
+
+// optionList builds the option list from the current options of the
+// device, the option numbers refer to it
+func (s *sanedConn) optionList() []sanedOption {
+	list := []sanedOption{{}}
+	group := ""
+
+	opts := s.session.Conn.Options()
+	for i := range opts {
+		if opts[i].Group != group {
+			group = opts[i].Group
+			list = append(list, sanedOption{Group: group})
+		}
+		list = append(list, sanedOption{Option: &opts[i]})
+	}
+	return list
+}
+
+func (s *sanedConn) getOptionDescriptors() {
+	w := s.wire
+	if s.session == nil {
+		w.putWord(0)
+		return
+	}
+
+	s.options = s.optionList()
+	w.putWord(len(s.options))
+
+	for i, o := range s.options {
+		w.putWord(0)
+
+		switch {
+		case i == 0:
+			w.putString("")
+			w.putString("Number of options")
+			w.putString("Read-only option that specifies how many options a specific device supports.")
+			w.putWord(sanedTypeInt)
+			w.putWord(int(sane.UnitNone))
+			w.putWord(4)
+			// SANE_CAP_SOFT_DETECT
+			w.putWord(4)
+			w.putWord(0)
+
+		case o.Option == nil:
+			w.putString("")
+			w.putString(o.Group)
+			w.putString("")
+			w.putWord(sanedTypeGroup)
+			w.putWord(int(sane.UnitNone))
+			w.putWord(0)
+			w.putWord(0)
+			w.putWord(0)
+
+		default:
+			s.putOptionDescriptor(*o.Option)
+		}
+	}
+}
+
+func (s *sanedConn) putOptionDescriptor(o sane.Option) {
+	w := s.wire
+
+	w.putString(o.Name)
+	w.putString(o.Title)
+	w.putString(o.Desc)
+	w.putWord(sanedOptionType(o))
+	w.putWord(int(o.Unit))
+	w.putWord(sanedOptionSize(o))
+
+	var capabilities int
+	for bit, set := range map[int]bool{
+		1:  o.IsSettable,
+		4:  o.IsDetectable,
+		8:  o.IsEmulated,
+		16: o.IsAutomatic,
+		32: !o.IsActive,
+		64: o.IsAdvanced,
+	} {
+		if set {
+			capabilities |= bit
+		}
+	}
+	w.putWord(capabilities)
+
+	switch {
+	case o.ConstrRange != nil:
+		w.putWord(1)
+		w.putWord(0)
+		for _, v := range []interface{}{o.ConstrRange.Min, o.ConstrRange.Max, o.ConstrRange.Quant} {
+			w.putWord(sanedNumber(o, v))
+		}
+
+	case len(o.ConstrSet) > 0 && o.Type == sane.TypeString:
+		w.putWord(3)
+		w.putWord(len(o.ConstrSet) + 1)
+		for _, v := range o.ConstrSet {
+			w.putString(fmt.Sprint(v))
+		}
+		w.putWord(0)
+
+	case len(o.ConstrSet) > 0:
+		// Word lists start with their length
+		w.putWord(2)
+		w.putWord(len(o.ConstrSet) + 1)
+		w.putWord(len(o.ConstrSet))
+		for _, v := range o.ConstrSet {
+			w.putWord(sanedNumber(o, v))
+		}
+
+	default:
+		w.putWord(0)
+	}
+}
+
+func sanedOptionType(o sane.Option) int {
+	switch o.Type {
+	case sane.TypeBool:
+		return sanedTypeBool
+	case sane.TypeInt:
+		return sanedTypeInt
+	case sane.TypeFloat:
+		return sanedTypeFixed
+	case sane.TypeString:
+		return sanedTypeString
+	}
+	return sanedTypeButton
+}
+
+// sanedOptionSize returns the value size in bytes, the size of string
+// options is not exposed by the SANE binding and estimated
+func sanedOptionSize(o sane.Option) int {
+	switch o.Type {
+	case sane.TypeButton:
+		return 0
+	case sane.TypeString:
+		size := sanedStringSize
+		for _, v := range o.ConstrSet {
+			if l := len(fmt.Sprint(v)) + 1; l > size {
+				size = l
+			}
+		}
+		return size
+	}
+	return o.Length * 4
+}
+
+// sanedNumber encodes a value of a numeric option as word, fixed point
+// values have 16 fractional bits
+func sanedNumber(o sane.Option, v interface{}) int {
+	switch n := v.(type) {
+	case bool:
+		if n {
+			return 1
+		}
+		return 0
+	case int:
+		if o.Type == sane.TypeFloat {
+			return n << 16
+		}
+		return n
+	case float64:
+		if o.Type == sane.TypeFloat {
+			return int(math.Round(n * (1 << 16)))
+		}
+		return int(n)
+	}
+	return 0
+}
+
+func (s *sanedConn) controlOption() {
+	w := s.wire
+
+	w.word()
+	number := w.word()
+	action := w.word()
+
+	var value []byte
+	if action != sanedActionAuto {
+		w.word()
+		w.word()
+		value = w.optionValue(s.valueType(number))
+	}
+	if w.err != nil {
+		return
+	}
+
+	status, info, o := s.applyOption(number, action, value)
+
+	w.putWord(status)
+	w.putWord(info)
+	if o == nil {
+		// Invalid option, no value is sent back
+		w.putWord(sanedTypeInt)
+		w.putWord(0)
+		w.putWord(0)
+	} else {
+		s.putOptionValue(*o, number)
+	}
+	w.putString("")
+}
+
+func (s *sanedConn) option(number int) *sane.Option {
+	if number <= 0 || number >= len(s.options) {
+		return nil
+	}
+	return s.options[number].Option
+}
+
+func (s *sanedConn) valueType(number int) int {
+	if number == 0 {
+		return sanedTypeInt
+	}
+	if o := s.option(number); o != nil {
+		return sanedOptionType(*o)
+	}
+	return sanedTypeGroup
+}
+
+// optionValue reads the value of a control option request as raw
+// array, words are kept big endian
+func (s *sanedWire) optionValue(valueType int) []byte {
+	n := s.word()
+	if s.err != nil || n <= 0 {
+		return nil
+	}
+
+	size := n
+	switch valueType {
+	case sanedTypeBool, sanedTypeInt, sanedTypeFixed:
+		size = 4 * n
+	case sanedTypeButton, sanedTypeGroup:
+		return nil
+	}
+	if size > 1<<16 {
+		s.err = fmt.Errorf("Option value of %d bytes too large", size)
+		return nil
+	}
+
+	b := make([]byte, size)
+	_, s.err = io.ReadFull(s.r, b)
+	return b
+}
+
+// applyOption executes the action on the option and returns the SANE
+// status, the info bits and the option to send the value of
+func (s *sanedConn) applyOption(number, action int, value []byte) (int, int, *sane.Option) {
+	if s.session == nil || s.options == nil {
+		return sanedStatusInvalid, 0, nil
+	}
+	if number == 0 {
+		if action != sanedActionGet {
+			return sanedStatusInvalid, 0, nil
+		}
+		return sanedStatusGood, 0, &sane.Option{Type: sane.TypeInt, Length: 1}
+	}
+
+	o := s.option(number)
+	if o == nil {
+		return sanedStatusInvalid, 0, nil
+	}
+
+	var (
+		info sane.Info
+		err  error
+	)
+
+	switch action {
+	case sanedActionGet:
+		return sanedStatusGood, 0, o
+
+	case sanedActionAuto:
+		info, err = s.session.Conn.SetOption(o.Name, sane.Auto)
+
+	case sanedActionSet:
+		if o.Type == sane.TypeButton {
+			// Pressing buttons is not supported by the SANE binding
+			return sanedStatusUnsupported, 0, o
+		}
+		info, err = s.session.Conn.SetOption(o.Name, sanedDecodeValue(*o, value))
+
+	default:
+		return sanedStatusInvalid, 0, nil
+	}
+
+	if err != nil {
+		s.logger().WithError(err).WithField("option", o.Name).Debug("SANE network client unable to set option")
+		return sanedStatus(err), 0, o
+	}
+
+	var bits int
+	if info.Inexact {
+		bits |= 1
+	}
+	if info.ReloadOpts {
+		bits |= 2
+	}
+	if info.ReloadParams {
+		bits |= 4
+	}
+	return sanedStatusGood, bits, o
+}
+
+// sanedDecodeValue converts a received value into the type the SANE
+// binding expects for the option
+func sanedDecodeValue(o sane.Option, value []byte) interface{} {
+	if o.Type == sane.TypeString {
+		if i := strings.IndexByte(string(value), 0); i >= 0 {
+			value = value[:i]
+		}
+		return string(value)
+	}
+
+	var words []int
+	for i := 0; i+4 <= len(value) && len(words) < o.Length; i += 4 {
+		words = append(words, int(int32(binary.BigEndian.Uint32(value[i:]))))
+	}
+	for len(words) < o.Length {
+		words = append(words, 0)
+	}
+
+	switch o.Type {
+	case sane.TypeBool:
+		v := make([]bool, len(words))
+		for i, w := range words {
+			v[i] = w != 0
+		}
+		if o.Length == 1 {
+			return v[0]
+		}
+		return v
+
+	case sane.TypeInt:
+		if o.Length == 1 {
+			return words[0]
+		}
+		return words
+	}
+
+	v := make([]float64, len(words))
+	for i, w := range words {
+		v[i] = float64(w) / (1 << 16)
+	}
+	if o.Length == 1 {
+		return v[0]
+	}
+	return v
+}
+
+// putOptionValue writes value type, size and the current value of the
+// option
+func (s *sanedConn) putOptionValue(o sane.Option, number int) {
+	w := s.wire
+
+	var value interface{}
+	if number == 0 {
+		value = len(s.options)
+	} else if o.Type != sane.TypeButton && o.IsActive {
+		value, _ = s.session.Conn.GetOption(o.Name)
+	}
+
+	w.putWord(sanedOptionType(o))
+	w.putWord(sanedOptionSize(o))
+
+	switch o.Type {
+	case sane.TypeString:
+		b := make([]byte, sanedOptionSize(o))
+		v, _ := value.(string)
+		copy(b[:len(b)-1], v)
+		w.putBytes(b)
+
+	case sane.TypeButton:
+		w.putWord(0)
+
+	default:
+		var words []interface{}
+		switch v := value.(type) {
+		case []bool:
+			for _, e := range v {
+				words = append(words, e)
+			}
+		case []int:
+			for _, e := range v {
+				words = append(words, e)
+			}
+		case []float64:
+			for _, e := range v {
+				words = append(words, e)
+			}
+		default:
+			words = []interface{}{v}
+		}
+		for len(words) < o.Length {
+			words = append(words, nil)
+		}
+
+		w.putWord(o.Length)
+		for _, v := range words[:o.Length] {
+			w.putWord(sanedNumber(o, v))
+		}
+	}
+}
+
+func (s *sanedConn) getParameters() {
+	var (
+		p   sane.Params
+		err = sane.ErrInvalid
+	)
+	if s.session != nil {
+		p, err = s.session.Conn.Params()
+	}
+
+	s.wire.putWord(sanedStatus(err))
+	s.wire.putWord(int(p.Format))
+	if p.IsLast {
+		s.wire.putWord(1)
+	} else {
+		s.wire.putWord(0)
+	}
+	s.wire.putWord(p.BytesPerLine)
+	s.wire.putWord(p.PixelsPerLine)
+	s.wire.putWord(p.Lines)
+	s.wire.putWord(p.Depth)
+}
+
+// start starts the next frame and transfers it using a data connection
+// the client opens to the returned port
+func (s *sanedConn) start() {
+	w := s.wire
+	reply := func(status, port int) {
+		w.putWord(status)
+		w.putWord(port)
+		// Byte order of 16 bit samples, the frames are sent as read
+		if binary.NativeEndian.Uint16([]byte{0x12, 0x34}) == 0x3412 {
+			w.putWord(0x1234)
+		} else {
+			w.putWord(0x4321)
+		}
+		w.putString("")
+	}
+
+	if s.session == nil {
+		reply(sanedStatusInvalid, 0)
+		return
+	}
+	if s.reading != nil {
+		<-s.reading
+	}
+
+	host, _, _ := net.SplitHostPort(s.conn.LocalAddr().String())
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		s.logger().WithError(err).Error("Unable to listen for SANE data connection")
+		reply(sanedStatusIOError, 0)
+		return
+	}
+
+	if err = s.session.Conn.Start(); err != nil {
+		l.Close()
+		reply(sanedStatus(err), 0)
+		return
+	}
+
+	s.reading = make(chan struct{})
+	go s.transfer(l, s.session.Conn, s.reading)
+
+	reply(sanedStatusGood, l.Addr().(*net.TCPAddr).Port)
+}
+
+// acceptData waits for the client to open the data connection, others
+// connecting to the port would be sent the scanned frame otherwise
+func (s *sanedConn) acceptData(l net.Listener) (net.Conn, error) {
+	for {
+		data, err := l.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if sameHost(data.RemoteAddr(), s.conn.RemoteAddr()) {
+			return data, nil
+		}
+
+		s.logger().WithField("data_remote", data.RemoteAddr()).Warn("Rejected SANE data connection from another host")
+		data.Close()
+	}
+}
+
+// sameHost tells whether the addresses share the IP
+func sameHost(a, b net.Addr) bool {
+	ta, ok1 := a.(*net.TCPAddr)
+	tb, ok2 := b.(*net.TCPAddr)
+	return ok1 && ok2 && ta.IP.Equal(tb.IP)
+}
+
+// transfer sends the frame as records prefixed with their length, the
+// end is marked by the length 0xffffffff followed by the status
+func (s *sanedConn) transfer(l net.Listener, c *sane.Conn, done chan struct{}) {
+	defer close(done)
+
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(time.Minute))
+	data, err := s.acceptData(l)
+	l.Close()
+	if err != nil {
+		s.logger().WithError(err).Warn("SANE network client did not open the data connection")
+		c.Cancel()
+		return
+	}
+	defer data.Close()
+
+	var (
+		buf    = make([]byte, 32*1024)
+		header = make([]byte, 4)
+		status = sanedStatusEOF
+	)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			if err != io.EOF {
+				status = sanedStatus(err)
+			}
+			break
+		}
+		if n == 0 {
+			continue
+		}
+
+		binary.BigEndian.PutUint32(header, uint32(n))
+		if _, err = data.Write(append(header, buf[:n]...)); err != nil {
+			s.logger().WithError(err).Debug("SANE data connection failed")
+			c.Cancel()
+			return
+		}
+	}
+
+	data.Write([]byte{0xff, 0xff, 0xff, 0xff, byte(status)})
+}
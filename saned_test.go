@@ -0,0 +1,203 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Luzifer/sane"
+)
+
+func TestSANEDWireRoundTrip(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := newSANEDWire(buf)
+	w.putWord(42)
+	w.putWord(-1)
+	w.putString("test:0")
+	w.putString("")
+	w.putBytes([]byte{1, 2, 3})
+	if err := w.flush(); err != nil {
+		t.Fatalf("writing: %s", err)
+	}
+
+	if exp := []byte{0, 0, 0, 42, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 7}; !bytes.HasPrefix(buf.Bytes(), exp) {
+		t.Errorf("expected big endian words and the string length including NUL, got % x", buf.Bytes()[:12])
+	}
+
+	r := newSANEDWire(buf)
+	if v := r.word(); v != 42 {
+		t.Errorf("expected 42, got %d", v)
+	}
+	if v := r.word(); v != -1 {
+		t.Errorf("expected -1, got %d", v)
+	}
+	if v := r.string(); v != "test:0" {
+		t.Errorf("expected test:0, got %q", v)
+	}
+	if v := r.string(); v != "" {
+		t.Errorf("expected an empty string, got %q", v)
+	}
+	if v := r.bytes(); !bytes.Equal(v, []byte{1, 2, 3}) {
+		t.Errorf("expected 01 02 03, got % x", v)
+	}
+	if r.err != nil {
+		t.Errorf("reading: %s", r.err)
+	}
+}
+
+// sanedWords encodes the words as sent by the client
+func sanedWords(words ...int) []byte {
+	buf := new(bytes.Buffer)
+	for _, w := range words {
+		binary.Write(buf, binary.BigEndian, int32(w))
+	}
+	return buf.Bytes()
+}
+
+func TestSANEDWireMalformed(t *testing.T) {
+	for name, tc := range map[string]struct {
+		data []byte
+		read func(w *sanedWire)
+	}{
+		"truncated word":   {[]byte{0, 0}, func(w *sanedWire) { w.word() }},
+		"truncated string": {append(sanedWords(10), "abc"...), func(w *sanedWire) { w.string() }},
+		"huge array":       {sanedWords(1 << 30), func(w *sanedWire) { w.bytes() }},
+		"huge option":      {sanedWords(1 << 15), func(w *sanedWire) { w.optionValue(sanedTypeInt) }},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := newSANEDWire(bytes.NewBuffer(tc.data))
+			tc.read(w)
+			if w.err == nil {
+				t.Errorf("expected an error")
+			}
+			// Errors are kept, nothing is read after them
+			if v := w.word(); v != 0 || w.err == nil {
+				t.Errorf("expected reading to stop after the error")
+			}
+		})
+	}
+
+	w := newSANEDWire(bytes.NewBuffer(sanedWords(-5)))
+	if b := w.bytes(); b != nil || w.err != nil {
+		t.Errorf("expected a negative length to be read as NULL array")
+	}
+}
+
+func TestSANEDOptionValue(t *testing.T) {
+	w := newSANEDWire(bytes.NewBuffer(append(sanedWords(2, 300, -1), append(sanedWords(4), "Gray"...)...)))
+	if v := w.optionValue(sanedTypeInt); !bytes.Equal(v, sanedWords(300, -1)) {
+		t.Errorf("unexpected int value % x", v)
+	}
+	if v := w.optionValue(sanedTypeString); string(v) != "Gray" {
+		t.Errorf("unexpected string value %q", v)
+	}
+	if w.err != nil {
+		t.Errorf("reading: %s", w.err)
+	}
+
+	for name, tc := range map[string]struct {
+		opt   sane.Option
+		value []byte
+		exp   interface{}
+	}{
+		"string":       {sane.Option{Type: sane.TypeString, Length: 16}, []byte("Color\x00garbage"), "Color"},
+		"bool":         {sane.Option{Type: sane.TypeBool, Length: 1}, sanedWords(1), true},
+		"int":          {sane.Option{Type: sane.TypeInt, Length: 1}, sanedWords(-300), -300},
+		"int list":     {sane.Option{Type: sane.TypeInt, Length: 3}, sanedWords(1, 2), []int{1, 2, 0}},
+		"fixed":        {sane.Option{Type: sane.TypeFloat, Length: 1}, sanedWords(210 << 16), 210.0},
+		"fixed list":   {sane.Option{Type: sane.TypeFloat, Length: 2}, sanedWords(1<<15, -1<<16), []float64{0.5, -1}},
+		"short value":  {sane.Option{Type: sane.TypeInt, Length: 1}, []byte{1, 2}, 0},
+		"excess words": {sane.Option{Type: sane.TypeBool, Length: 1}, sanedWords(0, 1, 1), false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if v := sanedDecodeValue(tc.opt, tc.value); !reflect.DeepEqual(v, tc.exp) {
+				t.Errorf("expected %#v, got %#v", tc.exp, v)
+			}
+		})
+	}
+}
+
+func TestSANEDStatus(t *testing.T) {
+	for err, exp := range map[error]int{
+		nil:           sanedStatusGood,
+		sane.ErrEmpty: sanedStatusNoDocs,
+		fmt.Errorf("scanning: %w", sane.ErrJammed): sanedStatusJammed,
+		errors.New("something else"):               sanedStatusInvalid,
+	} {
+		if got := sanedStatus(err); got != exp {
+			t.Errorf("%v: expected status %d, got %d", err, exp, got)
+		}
+	}
+}
+
+func TestSANEDConnInit(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		(&sanedConn{conn: server, wire: newSANEDWire(server)}).serve()
+	}()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	w := newSANEDWire(client)
+	w.putWord(sanedProcInit)
+	w.putWord(sanedVersion)
+	w.putString("jdoe")
+	if err := w.flush(); err != nil {
+		t.Fatalf("sending init: %s", err)
+	}
+	if status, version := w.word(), w.word(); w.err != nil || status != sanedStatusGood || version != sanedVersion {
+		t.Errorf("unexpected init response %d / %x (%v)", status, version, w.err)
+	}
+
+	// Unknown procedures end the connection
+	w.putWord(99)
+	w.flush()
+	if w.word(); w.err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", w.err)
+	}
+	<-done
+}
+
+func TestSameHost(t *testing.T) {
+	a := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 40000}
+	for addr, exp := range map[net.Addr]bool{
+		&net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 50000}: true,
+		&net.TCPAddr{IP: net.ParseIP("::ffff:192.168.1.10")}:       true,
+		&net.TCPAddr{IP: net.ParseIP("192.168.1.11"), Port: 40000}: false,
+		&net.UDPAddr{IP: net.ParseIP("192.168.1.10")}:              false,
+	} {
+		if got := sameHost(a, addr); got != exp {
+			t.Errorf("%s: expected %v, got %v", addr, exp, got)
+		}
+	}
+}
+
+func TestListenAndServeSANEDAuth(t *testing.T) {
+	chain, allow, listen := auth.current(), cfg.SANEDAllow, cfg.SANEDListen
+	t.Cleanup(func() { auth.Set(chain); cfg.SANEDAllow, cfg.SANEDListen = allow, listen })
+
+	// An invalid address fails listening instead of serving
+	auth.Set(authChain{tokenAuthenticator{"ci": "secret"}})
+	cfg.SANEDAllow, cfg.SANEDListen = nil, "invalid"
+	if err := listenAndServeSANED(); err == nil || !strings.Contains(err.Error(), "--saned-allow is required") {
+		t.Errorf("expected --saned-allow to be required, got %v", err)
+	}
+
+	cfg.SANEDAllow = []string{"192.168.1.0/24"}
+	if err := listenAndServeSANED(); err == nil || !strings.Contains(err.Error(), "Unable to listen") {
+		t.Errorf("expected the server to start listening, got %v", err)
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+import "errors"
+
+// listenAndServeSANED fails as the SANE network protocol serves the
+// device using SANE, which is not available on Windows
+func listenAndServeSANED() error {
+	return errors.New("The SANE network protocol is not available on Windows")
+}
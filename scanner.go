@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"image"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// invalidParamError signals the request asked for something the
+// scanner is not able to do
+type invalidParamError struct {
+	msg string
+}
+
+func (i invalidParamError) Error() string { return i.msg }
+
+var (
+	// saneScanner provides all access to SANE
+	saneScanner = &scanner.SANE{}
+	// scanBackend executes the scans, replaced by a fake scanner for
+	// testing without hardware
+	scanBackend scanner.Scanner = saneScanner
+)
+
+// usesSANE tells whether the scans are executed by SANE, not by the
+// fake scanner, replayed fixtures or an acquisition command
+// (--scan-command, WIA)
+func usesSANE() bool {
+	_, command := scanBackend.(*scanner.Command)
+	return cfg.FakeScanner == 0 && cfg.ReplayDir == "" && !command
+}
+
+// fetchPages scans all pages available in the feeder and sends them
+// to out as soon as they are read. The channel is closed when the
+// scan is finished.
+func fetchPages(ctx context.Context, params *scanParams, out chan<- image.Image) error {
+	if err := scannerClaims.Check(params); err != nil {
+		close(out)
+		return err
+	}
+	if err := pendingScans.Enter(ctx, params.JobID, params.Priority); err != nil {
+		close(out)
+		return err
+	}
+	defer pendingScans.Leave()
+
+	err := scanBackend.Scan(scanner.Job{
+		Options:    params.scannerOptions(),
+		Resolution: params.ScanDPI,
+		Depth:      params.Depth,
+		Observer:   &jobObserver{params: params},
+		Context:    ctx,
+		MaxPages:   params.MaxPages,
+		PageLimit:  params.PageLimit,
+		Device:     params.Device,
+	}, out)
+
+	if e, ok := err.(scanner.UnsupportedError); ok {
+		return invalidParamError{e.Error()}
+	}
+	return err
+}
+
+// jobObserver ties a scan job to the duty cycle, option snapshots,
+// events and failure injection
+type jobObserver struct {
+	params *scanParams
+	start  time.Time
+}
+
+func (j *jobObserver) Starting() error {
+	if err := dutyCycle.checkCooldown(); err != nil {
+		return err
+	}
+	// The scanner might have been claimed while waiting for it
+	if err := scannerClaims.Check(j.params); err != nil {
+		return err
+	}
+	j.start = dutyCycle.start()
+	// Scanning wakes the scanner up
+	scannerPower.set(false)
+	return nil
+}
+
+// OptionsApplied logs how the device took the options and keeps them
+// for the metadata of the job
+func (j *jobObserver) OptionsApplied(opts []scanner.AppliedOption) {
+	for _, o := range opts {
+		logger := j.params.logger().WithFields(log.Fields{
+			"option":    o.Name,
+			"requested": o.Requested,
+			"effective": o.Effective,
+		})
+		if o.Adjusted {
+			logger.WithField("inexact", o.Inexact).Info("Option adjusted by the backend")
+			continue
+		}
+		logger.Debug("Option set")
+	}
+	runningJobs.SetOptions(j.params.JobID, opts)
+}
+
+func (j *jobObserver) Started(dev scanner.Device, values map[string]interface{}) {
+	// Makes changed backend defaults or firmware traceable
+	optionSnapshots.Add(&optionSnapshot{
+		JobID:   j.params.JobID,
+		Created: time.Now(),
+		Device:  dev,
+		Values:  values,
+	})
+
+	runningJobs.SetDevice(j.params.JobID, dev.Name)
+	j.params.logger().WithField("device", dev.Name).Info("Scan started")
+
+	publishEvent(scanEvent{Event: "started", JobID: j.params.JobID, Profile: j.params.Profile, User: j.params.User})
+}
+
+func (j *jobObserver) PageScanned(n int) error {
+	publishEvent(scanEvent{Event: "page", JobID: j.params.JobID, Page: n})
+
+	if failInject.JamAfterPage > 0 && n == failInject.JamAfterPage {
+		return scanner.ErrJammed
+	}
+	return nil
+}
+
+func (j *jobObserver) Finished(pages int, err error) {
+	dutyCycle.record(j.start, pages, err)
+	if pages > 0 {
+		checkMaintenance()
+		checkReminders()
+	}
+}
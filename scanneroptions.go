@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	// scannerOptOverrides replace the built-in scannerOpts, they are
+	// changed using PUT /admin/options and persisted to the file given
+	// in --scanner-options
+	scannerOptOverrides     = map[string]interface{}{}
+	scannerOptOverridesLock sync.RWMutex
+
+	// requestScannerOpts are set from the scan parameters of every
+	// request, overriding their defaults has no effect
+	requestScannerOpts = map[string]string{
+		"depth":      "depth",
+		"mode":       "color",
+		"resolution": "scan-dpi",
+		"source":     "duplex",
+	}
+)
+
+// defaultScannerOptions returns the built-in options with the
+// overrides applied
+func defaultScannerOptions() map[string]interface{} {
+	scannerOptOverridesLock.RLock()
+	defer scannerOptOverridesLock.RUnlock()
+
+	opts := map[string]interface{}{}
+	for k, v := range scannerOpts {
+		opts[k] = v
+	}
+	for k, v := range scannerOptOverrides {
+		opts[k] = v
+	}
+	return opts
+}
+
+// loadScannerOptions reads the persisted overrides, a missing file is
+// created on the first change
+func loadScannerOptions(file string) error {
+	raw, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read scanner options: %s", err)
+	}
+
+	opts := map[string]interface{}{}
+	if err := yaml.Unmarshal(raw, &opts); err != nil {
+		return fmt.Errorf("Unable to parse scanner options: %s", err)
+	}
+
+	for name, value := range opts {
+		if param, ok := requestScannerOpts[name]; ok {
+			return fmt.Errorf("Option %q is set per request using %q and must not be configured", name, param)
+		}
+
+		opts[name] = yamlScannerOption(name, value)
+	}
+
+	scannerOptOverridesLock.Lock()
+	defer scannerOptOverridesLock.Unlock()
+
+	scannerOptOverrides = opts
+	return nil
+}
+
+// yamlScannerOption restores the type of options read from YAML which
+// does not keep the fraction of floats like 297.0
+func yamlScannerOption(name string, value interface{}) interface{} {
+	if i, ok := value.(int); ok {
+		if _, isFloat := scannerOpts[name].(float64); isFloat {
+			return float64(i)
+		}
+	}
+	return value
+}
+
+// saveScannerOptions replaces the file atomically with the current
+// overrides
+func saveScannerOptions(file string) error {
+	scannerOptOverridesLock.RLock()
+	raw, err := yaml.Marshal(scannerOptOverrides)
+	scannerOptOverridesLock.RUnlock()
+	if err != nil {
+		return fmt.Errorf("Unable to marshal scanner options: %s", err)
+	}
+
+	tmp, err := ioutil.TempFile(path.Dir(file), ".scanner-options-")
+	if err != nil {
+		return fmt.Errorf("Unable to create temporary file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Unable to write scanner options: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Unable to write scanner options: %s", err)
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+// parseScannerOptionValue converts a JSON value into the type expected
+// by SANE: numbers without fraction become int, others float64
+func parseScannerOptionValue(name string, v interface{}) (interface{}, error) {
+	switch n := v.(type) {
+	case bool, string:
+		return n, nil
+	case json.Number:
+		if i, err := strconv.Atoi(n.String()); err == nil {
+			return i, nil
+		}
+		return n.Float64()
+	}
+	return nil, fmt.Errorf("Invalid value for option %q: %v (expected bool, number or string)", name, v)
+}
+
+// checkScannerOption validates the option value against the option
+// descriptor of the device and adapts int values for float options
+func checkScannerOption(dev scanner.DeviceCapabilities, name string, value interface{}) (interface{}, error) {
+	for _, o := range dev.Options {
+		if o.Name != name {
+			continue
+		}
+
+		if !o.IsSettable {
+			return nil, fmt.Errorf("Option %q is not settable", name)
+		}
+
+		switch o.Type {
+		case scanner.TypeBool:
+			if _, ok := value.(bool); ok {
+				return value, nil
+			}
+		case scanner.TypeInt:
+			if _, ok := value.(int); ok {
+				return value, nil
+			}
+		case scanner.TypeFloat:
+			switch v := value.(type) {
+			case float64:
+				return v, nil
+			case int:
+				return float64(v), nil
+			}
+		case scanner.TypeString:
+			if _, ok := value.(string); ok {
+				return value, nil
+			}
+		}
+		return nil, fmt.Errorf("Invalid value for option %q: %v (expected %s)", name, value, saneTypeNames[o.Type])
+	}
+
+	return nil, fmt.Errorf("Unknown option %q", name)
+}
+
+type adminOptionsStatus struct {
+	Options   map[string]interface{} `json:"options"`
+	Overrides map[string]interface{} `json:"overrides"`
+	File      string                 `json:"file,omitempty"`
+}
+
+func currentAdminOptionsStatus() adminOptionsStatus {
+	s := adminOptionsStatus{Options: defaultScannerOptions(), Overrides: map[string]interface{}{}, File: cfg.ScannerOptions}
+
+	scannerOptOverridesLock.RLock()
+	defer scannerOptOverridesLock.RUnlock()
+	for k, v := range scannerOptOverrides {
+		s.Overrides[k] = v
+	}
+	return s
+}
+
+func handleAdminGetOptions(res http.ResponseWriter, r *http.Request) {
+	writeJSON(res, http.StatusOK, currentAdminOptionsStatus())
+}
+
+// handleAdminPutOptions changes the default scanner options: the body
+// is a JSON object of option values, null restores the built-in value
+func handleAdminPutOptions(res http.ResponseWriter, r *http.Request) {
+	var body map[string]interface{}
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, "Invalid JSON body")
+		return
+	}
+
+	persist, _ := strconv.ParseBool(r.URL.Query().Get("persist"))
+	if persist && cfg.ScannerOptions == "" {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, "Persisting options requires --scanner-options to be set")
+		return
+	}
+
+	var dev *scanner.DeviceCapabilities
+	if describer, ok := scanBackend.(scanner.DeviceDescriber); ok {
+		if caps, err := describer.DeviceOptions(); err != nil {
+			// Allow changes while the scanner is switched off
+			log.WithError(err).Warn("Unable to read device options, changed options are not validated")
+		} else {
+			dev = &caps
+		}
+	}
+
+	changes := map[string]interface{}{}
+	for name, raw := range body {
+		if param, ok := requestScannerOpts[name]; ok {
+			writeError(res, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("Option %q is set per request using %q", name, param))
+			return
+		}
+
+		if raw == nil {
+			changes[name] = nil
+			continue
+		}
+
+		value, err := parseScannerOptionValue(name, raw)
+		if err == nil && dev != nil {
+			value, err = checkScannerOption(*dev, name, value)
+		}
+		if err != nil {
+			writeError(res, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+			return
+		}
+		changes[name] = value
+	}
+
+	scannerOptOverridesLock.Lock()
+	for name, value := range changes {
+		if value == nil {
+			delete(scannerOptOverrides, name)
+			continue
+		}
+		scannerOptOverrides[name] = value
+	}
+	scannerOptOverridesLock.Unlock()
+
+	log.WithFields(log.Fields{
+		"options": changes,
+		"persist": persist,
+		"user":    requestUser(r),
+	}).Info("Default scanner options changed")
+
+	if persist {
+		if err := saveScannerOptions(cfg.ScannerOptions); err != nil {
+			log.WithError(err).Error("Unable to persist scanner options")
+			writeError(res, http.StatusInternalServerError, errCodeInternal, "Options were changed but could not be persisted")
+			return
+		}
+	}
+
+	writeJSON(res, http.StatusOK, currentAdminOptionsStatus())
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// scannerConfig is one device of the pool configured in --scanners
+type scannerConfig struct {
+	Name    string                 `yaml:"name"`
+	Device  string                 `yaml:"device"`
+	Match   string                 `yaml:"match"`
+	Options map[string]interface{} `yaml:"options"`
+}
+
+// scanPool dispatches the scans to the devices given in --scanners, nil
+// if a single device is used
+var scanPool *scanner.Pool
+
+// loadScannerPool reads the devices of the pool from a YAML file:
+//
+//	---
+//	- name: reception
+//	  match: iX500
+//	- name: office
+//	  device: fujitsu:ScanSnap iX1600:1234
+//	  options:
+//	    page-height: 420.0
+func loadScannerPool(file string) (*scanner.Pool, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read scanners: %s", err)
+	}
+
+	var configs []scannerConfig
+	if err := yaml.Unmarshal(raw, &configs); err != nil {
+		return nil, fmt.Errorf("Unable to parse scanners: %s", err)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("No scanners configured in %s", file)
+	}
+
+	pool := &scanner.Pool{}
+	names := map[string]bool{}
+	for i, c := range configs {
+		if c.Name == "" {
+			return nil, fmt.Errorf("Scanner %d has no name", i+1)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("Scanner %q is configured twice", c.Name)
+		}
+		names[c.Name] = true
+
+		if (c.Device == "") == (c.Match == "") {
+			return nil, fmt.Errorf("Scanner %q needs either a device or a match", c.Name)
+		}
+
+		s := &scanner.SANE{
+			Device:      c.Device,
+			Retry:       saneScanner.Retry,
+			IdleTimeout: saneScanner.IdleTimeout,
+		}
+		if c.Match != "" {
+			if s.DeviceMatch, err = regexp.Compile(c.Match); err != nil {
+				return nil, fmt.Errorf("Invalid match of scanner %q: %s", c.Name, err)
+			}
+		}
+
+		opts := map[string]interface{}{}
+		for name, value := range c.Options {
+			if param, ok := requestScannerOpts[name]; ok {
+				return nil, fmt.Errorf("Option %q of scanner %q is set per request using %q and must not be configured", name, c.Name, param)
+			}
+			opts[name] = yamlScannerOption(name, value)
+		}
+
+		pool.Members = append(pool.Members, &scanner.PoolMember{Name: c.Name, Scanner: s, Options: opts})
+		log.WithFields(log.Fields{"scanner": c.Name, "device": c.Device, "match": c.Match}).Debug("Scanner added to pool")
+	}
+
+	return pool, nil
+}
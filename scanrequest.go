@@ -0,0 +1,245 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// scanRequestSchema describes scanRequest, keep both in sync
+//
+//go:embed scanrequest.schema.json
+var scanRequestSchema []byte
+
+// scanRequest is the JSON body of POST /scan, a structured alternative
+// to the query parameters of /scan.pdf
+type scanRequest struct {
+	Profile string                 `json:"profile"`
+	Device  string                 `json:"device"`
+	Resume  string                 `json:"resume"`
+	Session string                 `json:"session"`
+	Section string                 `json:"section"`
+	Options map[string]interface{} `json:"options"`
+
+	Scan struct {
+		Color      *string `json:"color"`
+		Depth      *int    `json:"depth"`
+		Duplex     *bool   `json:"duplex"`
+		Source     *string `json:"source"`
+		ScanDPI    *int    `json:"scan_dpi"`
+		RotateBack *int    `json:"rotate_back"`
+		MaxPages   *int    `json:"max_pages"`
+		Priority   *string `json:"priority"`
+	} `json:"scan"`
+
+	Processing struct {
+		Pages       *string `json:"pages"`
+		SplitEvery  *int    `json:"split_every"`
+		DuplexSplit *bool   `json:"duplex_split"`
+		Cover       *bool   `json:"cover"`
+		CoverText   *string `json:"cover_text"`
+		Pipeline    *string `json:"pipeline"`
+		Steps       *string `json:"steps"`
+		Sharpen     *int    `json:"sharpen"`
+		Contrast    *int    `json:"contrast"`
+		OCRLang     *string `json:"ocr_lang"`
+		OCROSD      *bool   `json:"ocr_osd"`
+		OCROverlay  *bool   `json:"ocr_overlay"`
+		RawFrames   *bool   `json:"raw_frames"`
+		Partial     *bool   `json:"partial"`
+
+		BlankPages     *string  `json:"blank_pages"`
+		BlankThreshold *float64 `json:"blank_threshold"`
+		DuplicatePages *string  `json:"duplicate_pages"`
+
+		ExpectPages       *int    `json:"expect_pages"`
+		ExpectSheets      *int    `json:"expect_sheets"`
+		PageCountMismatch *string `json:"page_count_mismatch"`
+	} `json:"processing"`
+
+	Output struct {
+		PDFDPI       *int     `json:"pdf_dpi"`
+		PDFMargin    *float64 `json:"pdf_margin"`
+		PDFPlacement *string  `json:"pdf_placement"`
+		Quality      *int     `json:"quality"`
+		Lossless     *bool    `json:"lossless"`
+		MaxSize      *string  `json:"max_size"`
+		Archive      *bool    `json:"archive"`
+		PDFA         *bool    `json:"pdfa"`
+		Photo        *bool    `json:"photo"`
+		Card         *bool    `json:"card"`
+		Receipt      *bool    `json:"receipt"`
+		Stream       *bool    `json:"stream"`
+		PageNumbers  *bool    `json:"page_numbers"`
+		Optimize     *bool    `json:"optimize"`
+		Password     *string  `json:"password"`
+		Title        *string  `json:"title"`
+		Author       *string  `json:"author"`
+		Subject      *string  `json:"subject"`
+		Keywords     *string  `json:"keywords"`
+		CreationDate *string  `json:"creation_date"`
+	} `json:"output"`
+}
+
+// query translates the request into the query parameters of /scan.pdf
+// to share their parsing, profile handling and validation
+func (s scanRequest) query() url.Values {
+	q := url.Values{}
+
+	for param, v := range map[string]*string{
+		"color":               s.Scan.Color,
+		"priority":            s.Scan.Priority,
+		"source":              s.Scan.Source,
+		"pages":               s.Processing.Pages,
+		"cover-text":          s.Processing.CoverText,
+		"pipeline":            s.Processing.Pipeline,
+		"steps":               s.Processing.Steps,
+		"page-count-mismatch": s.Processing.PageCountMismatch,
+		"ocr-lang":            s.Processing.OCRLang,
+		"blank-pages":         s.Processing.BlankPages,
+		"duplicate-pages":     s.Processing.DuplicatePages,
+		"password":            s.Output.Password,
+		"title":               s.Output.Title,
+		"author":              s.Output.Author,
+		"subject":             s.Output.Subject,
+		"keywords":            s.Output.Keywords,
+		"creation-date":       s.Output.CreationDate,
+		"max-size":            s.Output.MaxSize,
+		"pdf-placement":       s.Output.PDFPlacement,
+	} {
+		if v != nil {
+			q.Set(param, *v)
+		}
+	}
+
+	for param, v := range map[string]*bool{
+		"duplex":       s.Scan.Duplex,
+		"cover":        s.Processing.Cover,
+		"ocr-osd":      s.Processing.OCROSD,
+		"ocr-overlay":  s.Processing.OCROverlay,
+		"raw-frames":   s.Processing.RawFrames,
+		"partial":      s.Processing.Partial,
+		"duplex-split": s.Processing.DuplexSplit,
+		"lossless":     s.Output.Lossless,
+		"archive":      s.Output.Archive,
+		"pdfa":         s.Output.PDFA,
+		"photo":        s.Output.Photo,
+		"card":         s.Output.Card,
+		"receipt":      s.Output.Receipt,
+		"stream":       s.Output.Stream,
+		"page-numbers": s.Output.PageNumbers,
+		"optimize":     s.Output.Optimize,
+	} {
+		if v != nil {
+			q.Set(param, strconv.FormatBool(*v))
+		}
+	}
+
+	for param, v := range map[string]*int{
+		"scan-dpi":      s.Scan.ScanDPI,
+		"depth":         s.Scan.Depth,
+		"rotate-back":   s.Scan.RotateBack,
+		"max-pages":     s.Scan.MaxPages,
+		"split-every":   s.Processing.SplitEvery,
+		"sharpen":       s.Processing.Sharpen,
+		"contrast":      s.Processing.Contrast,
+		"expect-pages":  s.Processing.ExpectPages,
+		"expect-sheets": s.Processing.ExpectSheets,
+		"pdf-dpi":       s.Output.PDFDPI,
+		"quality":       s.Output.Quality,
+	} {
+		if v != nil {
+			q.Set(param, strconv.Itoa(*v))
+		}
+	}
+
+	if v := s.Processing.BlankThreshold; v != nil {
+		q.Set("blank-threshold", strconv.FormatFloat(*v, 'f', -1, 64))
+	}
+	if v := s.Output.PDFMargin; v != nil {
+		q.Set("pdf-margin", strconv.FormatFloat(*v, 'f', -1, 64))
+	}
+
+	for param, v := range map[string]string{
+		"profile": s.Profile,
+		"resume":  s.Resume,
+		"session": s.Session,
+		"section": s.Section,
+	} {
+		if v != "" {
+			q.Set(param, v)
+		}
+	}
+
+	return q
+}
+
+// scannerOptions validates and converts the SANE option overrides
+func (s scanRequest) scannerOptions() (map[string]interface{}, error) {
+	opts := map[string]interface{}{}
+	for name, raw := range s.Options {
+		if param, ok := requestScannerOpts[name]; ok {
+			return nil, fmt.Errorf("Option %q is set using %q", name, param)
+		}
+
+		v, err := parseScannerOptionValue(name, raw)
+		if err != nil {
+			return nil, err
+		}
+		opts[name] = v
+	}
+	return opts, nil
+}
+
+func handleScanJSONRequest(res http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	params, sr, err := parseScanJSONRequest(r)
+	if err != nil {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	serveNegotiatedScan(res, sr, params, start)
+}
+
+// parseScanJSONRequest decodes the JSON scan request of the body into
+// scan parameters, the returned request carries them as query
+func parseScanJSONRequest(r *http.Request) (*scanParams, *http.Request, error) {
+	var body scanRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		return nil, nil, fmt.Errorf("Invalid scan request (see /scan/schema.json): %s", err)
+	}
+
+	opts, err := body.scannerOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The body is consumed, parse the translated parameters as if they
+	// were given to /scan.pdf
+	sr := r.Clone(r.Context())
+	sr.Method = http.MethodGet
+	sr.URL.RawQuery = body.query().Encode()
+
+	params, err := parseScanParams(sr)
+	if err != nil {
+		return nil, nil, err
+	}
+	params.Device = body.Device
+	params.Options = opts
+
+	return params, sr, nil
+}
+
+func handleScanRequestSchema(res http.ResponseWriter, r *http.Request) {
+	res.Header().Set("Content-Type", "application/schema+json")
+	res.Write(scanRequestSchema)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// scheduleUser is the user scans started by the scheduler are
+// attributed to
+const scheduleUser = "scheduler"
+
+// scheduledScan starts a scan with the profile whenever the time
+// matches the cron expression
+type scheduledScan struct {
+	Name    string `yaml:"name"`
+	Cron    string `yaml:"cron"`
+	Profile string `yaml:"profile"`
+	// IfPaperLoaded skips the scan if the document feeder is empty
+	IfPaperLoaded bool `yaml:"if_paper_loaded"`
+
+	spec cronSpec
+}
+
+var (
+	schedules     []*scheduledScan
+	schedulesLock sync.RWMutex
+)
+
+// loadSchedules reads the scheduled scans from a YAML file:
+//
+//	---
+//	- name: outbox
+//	  cron: "0 18 * * 1-5"
+//	  profile: outbox
+//	  if_paper_loaded: true
+func loadSchedules(file string) error {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("Unable to read schedules: %s", err)
+	}
+
+	var s []*scheduledScan
+	if err := yaml.Unmarshal(raw, &s); err != nil {
+		return fmt.Errorf("Unable to parse schedules: %s", err)
+	}
+
+	for i, sc := range s {
+		if sc.Name == "" {
+			sc.Name = strconv.Itoa(i + 1)
+		}
+		if sc.spec, err = parseCron(sc.Cron); err != nil {
+			return fmt.Errorf("Invalid cron expression of schedule %s: %s", sc.Name, err)
+		}
+		if sc.Profile != "" && !profileExists(sc.Profile) {
+			return fmt.Errorf("Schedule %s references unknown profile %q", sc.Name, sc.Profile)
+		}
+	}
+
+	schedulesLock.Lock()
+	defer schedulesLock.Unlock()
+
+	schedules = s
+	return nil
+}
+
+// startScheduler checks the schedules at the start of every minute
+func startScheduler() error {
+	if storage == nil && !haveUploadTargets() {
+		return fmt.Errorf("Scheduled scans require --storage-dir or --targets")
+	}
+
+	schedulesLock.RLock()
+	log.WithField("schedules", len(schedules)).Info("Scheduling scans")
+	schedulesLock.RUnlock()
+
+	go func() {
+		for {
+			now := time.Now()
+			next := now.Truncate(time.Minute).Add(time.Minute)
+			time.Sleep(next.Sub(now))
+
+			schedulesLock.RLock()
+			for _, s := range schedules {
+				if s.spec.Matches(next) {
+					go s.run()
+				}
+			}
+			schedulesLock.RUnlock()
+		}
+	}()
+	return nil
+}
+
+func (s *scheduledScan) run() {
+	logger := log.WithFields(log.Fields{"schedule": s.Name, "profile": s.Profile})
+
+	if s.IfPaperLoaded {
+		sensor, ok := scanBackend.(scanner.PaperSensor)
+		if !ok {
+			logger.Error("Schedule requires a paper sensor, the scanner backend has none")
+			return
+		}
+
+		loaded, err := sensor.PaperLoaded(cfg.WatchSensor)
+		switch {
+		case errors.Is(err, scanner.ErrBusy):
+			logger.Info("Scanner is busy, skipping scheduled scan")
+			return
+		case err != nil:
+			logger.WithError(err).Error("Unable to read the paper sensor, skipping scheduled scan")
+			return
+		case !loaded:
+			logger.Debug("No paper loaded, skipping scheduled scan")
+			return
+		}
+	}
+
+	logger.Info("Starting scheduled scan")
+	if status := runHeadlessScan(scheduleUser, s.Profile); status >= http.StatusBadRequest {
+		logger.WithField("status", status).Error("Scheduled scan failed")
+	}
+}
+
+// cronSpec contains the allowed values of the five fields of a cron
+// expression (minute, hour, day of month, month, day of week)
+type cronSpec struct {
+	minute, hour, dom, month, dow map[int]bool
+	// domAny and dowAny are set for "*", if both days are restricted
+	// either of them has to match
+	domAny, dowAny bool
+}
+
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// parseCron reads a five field cron expression, fields support "*",
+// lists ("1,15"), ranges ("1-5") and steps ("*/15")
+func parseCron(expr string) (cronSpec, error) {
+	if m, ok := cronMacros[expr]; ok {
+		expr = m
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSpec{}, fmt.Errorf("Expected 5 fields, got %d", len(fields))
+	}
+
+	var (
+		spec cronSpec
+		err  error
+	)
+	for i, f := range []struct {
+		set      *map[int]bool
+		min, max int
+	}{
+		{&spec.minute, 0, 59},
+		{&spec.hour, 0, 23},
+		{&spec.dom, 1, 31},
+		{&spec.month, 1, 12},
+		{&spec.dow, 0, 7},
+	} {
+		if *f.set, err = parseCronField(fields[i], f.min, f.max); err != nil {
+			return cronSpec{}, fmt.Errorf("Field %q: %s", fields[i], err)
+		}
+	}
+
+	// Sunday is 0 or 7
+	if spec.dow[7] {
+		spec.dow[0] = true
+	}
+	spec.domAny, spec.dowAny = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+	return spec, nil
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := map[int]bool{}
+
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if r, s, ok := strings.Cut(part, "/"); ok {
+			var err error
+			if step, err = strconv.Atoi(s); err != nil || step < 1 {
+				return nil, fmt.Errorf("Invalid step %q", s)
+			}
+			rng = r
+		}
+
+		from, to := min, max
+		if rng != "*" {
+			f, t, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = strconv.Atoi(f); err != nil {
+				return nil, fmt.Errorf("Invalid value %q", f)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(t); err != nil {
+					return nil, fmt.Errorf("Invalid value %q", t)
+				}
+			} else if step > 1 {
+				// "5/10" starts at 5 and continues to the maximum
+				to = max
+			}
+		}
+
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("Value out of range %d-%d", min, max)
+		}
+		for v := from; v <= to; v += step {
+			values[v] = true
+		}
+	}
+
+	return values, nil
+}
+
+// Matches reports whether the expression matches the minute of t
+func (c cronSpec) Matches(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	// maxSearchSnippets is the number of matching lines returned per scan
+	maxSearchSnippets = 3
+	// maxSnippetLength cuts long lines around the first match
+	maxSnippetLength = 200
+)
+
+// searchIndex is an inverted index of the words recognized in stored
+// scans mapping the terms to the scans containing them and the number
+// of occurrences
+type searchIndex struct {
+	terms map[string]map[string]int
+	lock  sync.RWMutex
+}
+
+type searchResult struct {
+	Scan     *scanRecord     `json:"scan"`
+	Score    int             `json:"score"`
+	Snippets []searchSnippet `json:"snippets"`
+}
+
+type searchSnippet struct {
+	Page int    `json:"page"`
+	Text string `json:"text"`
+}
+
+var scanIndex = &searchIndex{terms: map[string]map[string]int{}}
+
+// searchTerms splits the text into lower-case words
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// parseSearchQuery returns the terms of the query, words ending in *
+// keep it to be matched as prefix
+func parseSearchQuery(q string) []string {
+	terms := []string{}
+	for _, f := range strings.Fields(q) {
+		words := searchTerms(f)
+		if len(words) > 0 && strings.HasSuffix(f, "*") {
+			words[len(words)-1] += "*"
+		}
+		terms = append(terms, words...)
+	}
+	return terms
+}
+
+// Add indexes the recognized text of the scan replacing a previous
+// text of the scan (resumed jobs)
+func (s *searchIndex) Add(t *jobText) {
+	s.Remove(t.JobID)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, p := range t.Pages {
+		for _, w := range p.Words {
+			for _, term := range searchTerms(w.Text) {
+				if s.terms[term] == nil {
+					s.terms[term] = map[string]int{}
+				}
+				s.terms[term][t.JobID]++
+			}
+		}
+	}
+}
+
+// Remove drops the text of the scan from the index
+func (s *searchIndex) Remove(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for term, scans := range s.terms {
+		delete(scans, id)
+		if len(scans) == 0 {
+			delete(s.terms, term)
+		}
+	}
+}
+
+// Load indexes the recognized text persisted in the storage directory
+func (s *searchIndex) Load() {
+	files, err := filepath.Glob(path.Join(storage.dir, "*.text.json"))
+	if err != nil {
+		log.WithError(err).Error("Unable to list recognized texts")
+		return
+	}
+
+	for _, f := range files {
+		raw, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+
+		t := &jobText{}
+		if err := json.Unmarshal(raw, t); err != nil {
+			log.WithError(err).WithField("file", f).Warn("Unable to index recognized text")
+			continue
+		}
+		s.Add(t)
+	}
+
+	log.WithField("scans", len(files)).Debug("Search index loaded")
+}
+
+// Search returns the scans containing all terms of the query with the
+// number of occurrences as score, terms ending in * match all words
+// starting with them
+func (s *searchIndex) Search(terms []string) map[string]int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var scores map[string]int
+	for _, term := range terms {
+		matches := map[string]int{}
+		if prefix := strings.TrimSuffix(term, "*"); prefix != term {
+			for t, scans := range s.terms {
+				if strings.HasPrefix(t, prefix) {
+					for id, n := range scans {
+						matches[id] += n
+					}
+				}
+			}
+		} else {
+			for id, n := range s.terms[term] {
+				matches[id] += n
+			}
+		}
+
+		if scores == nil {
+			scores = matches
+			continue
+		}
+		for id := range scores {
+			if n, ok := matches[id]; ok {
+				scores[id] += n
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	return scores
+}
+
+// matchesTerm reports whether the word is matched by a search term
+func matchesTerm(word string, terms []string) bool {
+	for _, term := range terms {
+		if prefix := strings.TrimSuffix(term, "*"); prefix != term {
+			if strings.HasPrefix(word, prefix) {
+				return true
+			}
+		} else if word == term {
+			return true
+		}
+	}
+	return false
+}
+
+// searchSnippets returns the recognized lines containing the terms
+func searchSnippets(t *jobText, terms []string) []searchSnippet {
+	snippets := []searchSnippet{}
+	for _, p := range t.Pages {
+		for _, l := range p.lines() {
+			var (
+				words []string
+				match = -1 // position of the first match in runes
+				pos   int
+			)
+			for _, w := range l.Words {
+				for _, word := range searchTerms(w.Text) {
+					if match < 0 && matchesTerm(word, terms) {
+						match = pos
+					}
+				}
+				words = append(words, w.Text)
+				pos += utf8.RuneCountInString(w.Text) + 1
+			}
+			if match < 0 {
+				continue
+			}
+
+			text := []rune(strings.Join(words, " "))
+			if len(text) > maxSnippetLength {
+				// Keep the match in the middle of the snippet
+				start := match - maxSnippetLength/2
+				if start+maxSnippetLength > len(text) {
+					start = len(text) - maxSnippetLength
+				}
+				if start < 0 {
+					start = 0
+				}
+				text = text[start : start+maxSnippetLength]
+			}
+
+			snippets = append(snippets, searchSnippet{Page: p.Page, Text: string(text)})
+			if len(snippets) == maxSearchSnippets {
+				return snippets
+			}
+		}
+	}
+	return snippets
+}
+
+func handleSearch(res http.ResponseWriter, r *http.Request) {
+	if storage == nil {
+		writeError(res, http.StatusNotFound, errCodeDisabled, "Scan history is not enabled")
+		return
+	}
+
+	terms := parseSearchQuery(r.URL.Query().Get("q"))
+	if len(terms) == 0 {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, "Query q must contain at least one word")
+		return
+	}
+
+	limit := defaultSearchLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxSearchLimit {
+			writeError(res, http.StatusBadRequest, errCodeInvalidParameter, "Invalid value for limit (1-100)")
+			return
+		}
+	}
+
+	results := []searchResult{}
+	for id, score := range scanIndex.Search(terms) {
+		rec, err := storage.Get(id)
+		if err != nil {
+			// Scans failing to be stored have their text indexed anyway
+			continue
+		}
+		results = append(results, searchResult{Scan: rec, Score: score})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Scan.Created.After(results[j].Scan.Created)
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	for i := range results {
+		if t, err := jobTexts.Get(results[i].Scan.ID); err == nil {
+			results[i].Snippets = searchSnippets(t, terms)
+		}
+	}
+
+	writeJSON(res, http.StatusOK, results)
+}
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	checkPass checkStatus = iota
+	checkWarn
+	checkFail
+)
+
+type checkStatus int
+
+func (c checkStatus) String() string {
+	return map[checkStatus]string{
+		checkPass: "pass",
+		checkWarn: "warn",
+		checkFail: "fail",
+	}[c]
+}
+
+type checkResult struct {
+	Status  checkStatus
+	Message string
+	Hint    string
+	// Fatal results prevent the daemon from serving requests
+	Fatal bool
+}
+
+type selfCheck struct {
+	Name string
+	Run  func() checkResult
+}
+
+type selfCheckReport struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+	Fatal   bool   `json:"fatal,omitempty"`
+	// Duration of the check in seconds
+	Duration float64 `json:"duration"`
+}
+
+// selfTestReport is the result of running all checks
+type selfTestReport struct {
+	Started time.Time `json:"started"`
+	// OK is cleared if a check reported a fatal problem
+	OK bool `json:"ok"`
+	// Status is the worst status of the checks
+	Status string            `json:"status"`
+	Checks []selfCheckReport `json:"checks"`
+}
+
+// fujitsuUSBVendor is the USB vendor ID of Fujitsu (PFU) scanners
+const fujitsuUSBVendor = "04c5"
+
+// selfCheckTimeout limits the checks using the device
+const selfCheckTimeout = time.Minute
+
+// selfCheckDialTimeout limits connecting to an upload target
+const selfCheckDialTimeout = 5 * time.Second
+
+var selfChecks = []selfCheck{
+	{Name: "sane", Run: checkSANE},
+	{Name: "usb-permissions", Run: checkUSBPermissions},
+	{Name: "options", Run: checkOptions},
+	{Name: "test-frame", Run: checkTestFrame},
+	{Name: "directories", Run: checkDirectories},
+	{Name: "tools", Run: checkTools},
+	{Name: "targets", Run: checkTargets},
+}
+
+var (
+	// lastSelfTest is the report of the checks run on startup or by
+	// POST /selftest
+	lastSelfTest     *selfTestReport
+	lastSelfTestLock sync.Mutex
+)
+
+// selfTest executes all registered checks in order
+func selfTest() selfTestReport {
+	report := selfTestReport{Started: time.Now(), OK: true, Checks: []selfCheckReport{}}
+
+	worst := checkPass
+	for _, c := range selfChecks {
+		start := time.Now()
+		r := c.Run()
+
+		report.Checks = append(report.Checks, selfCheckReport{
+			Name:     c.Name,
+			Status:   r.Status.String(),
+			Message:  r.Message,
+			Hint:     r.Hint,
+			Fatal:    r.Status == checkFail && r.Fatal,
+			Duration: time.Since(start).Seconds(),
+		})
+		if r.Status > worst {
+			worst = r.Status
+		}
+		if r.Status == checkFail && r.Fatal {
+			report.OK = false
+		}
+	}
+	report.Status = worst.String()
+
+	return report
+}
+
+// runSelfChecks executes all registered checks, logs a report and keeps
+// it for GET /selftest
+func runSelfChecks() selfTestReport {
+	report := selfTest()
+
+	for _, c := range report.Checks {
+		logger := log.WithFields(log.Fields{
+			"check":    c.Name,
+			"status":   c.Status,
+			"duration": c.Duration,
+		})
+		if c.Hint != "" {
+			logger = logger.WithField("hint", c.Hint)
+		}
+
+		switch c.Status {
+		case checkPass.String():
+			logger.Info(c.Message)
+		case checkWarn.String():
+			logger.Warn(c.Message)
+		case checkFail.String():
+			logger.Error(c.Message)
+		}
+	}
+
+	lastSelfTestLock.Lock()
+	lastSelfTest = &report
+	lastSelfTestLock.Unlock()
+
+	return report
+}
+
+// handleSelfTest responds with the report of the last self-test, POST
+// runs the checks again. Reports with fatal problems are sent as 503.
+func handleSelfTest(res http.ResponseWriter, r *http.Request) {
+	var report selfTestReport
+	if r.Method == http.MethodPost {
+		report = runSelfChecks()
+		log.WithFields(log.Fields{"status": report.Status, "user": requestUser(r)}).Info("Self-test executed")
+	} else {
+		lastSelfTestLock.Lock()
+		if lastSelfTest == nil {
+			lastSelfTestLock.Unlock()
+			writeError(res, http.StatusNotFound, errCodeNotFound, "No self-test executed yet")
+			return
+		}
+		report = *lastSelfTest
+		lastSelfTestLock.Unlock()
+	}
+
+	status := http.StatusOK
+	if !report.OK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(res, status, report)
+}
+
+func checkSANE() checkResult {
+	if cfg.FakeScanner > 0 {
+		return checkResult{
+			Status:  checkWarn,
+			Message: "Using the fake scanner, SANE is not checked",
+		}
+	}
+	if cfg.ReplayDir != "" {
+		return checkResult{
+			Status:  checkWarn,
+			Message: "Replaying fixtures from " + cfg.ReplayDir + ", SANE is not checked",
+		}
+	}
+	if !usesSANE() {
+		return checkResult{
+			Status:  checkPass,
+			Message: "Scanning with an acquisition command, SANE is not used",
+		}
+	}
+
+	// Use the scanner to not tear down SANE while it keeps the device open
+	devs, err := saneScanner.Devices()
+	if err != nil {
+		return checkResult{
+			Status:  checkFail,
+			Message: err.Error(),
+			Hint:    "Check libsane is installed, its dll.conf enables your backend and 'scanimage -L' works for the same user",
+			Fatal:   true,
+		}
+	}
+
+	if len(devs) == 0 && saneScanner.DeviceMatch != nil && cfg.Device == "" {
+		return checkResult{
+			Status:  checkFail,
+			Message: fmt.Sprintf("No scanners found to match %q against", cfg.DeviceMatch),
+			Hint:    "Check the scanner is powered on and connected",
+			Fatal:   true,
+		}
+	}
+
+	if len(devs) == 0 {
+		return checkResult{
+			Status:  checkWarn,
+			Message: "No scanners found",
+			Hint:    "Check the scanner is powered on and connected, scans will fail until it is",
+		}
+	}
+
+	var (
+		names = []string{}
+		using = devs[0].Name
+	)
+	for _, d := range devs {
+		names = append(names, fmt.Sprintf("%s (%s %s)", d.Name, d.Vendor, d.Model))
+	}
+
+	if cfg.Device != "" {
+		using = ""
+		for _, d := range devs {
+			if d.Name == cfg.Device {
+				using = d.Name
+			}
+		}
+		if using == "" {
+			return checkResult{
+				Status:  checkWarn,
+				Message: fmt.Sprintf("Scanner %q not found (found: %s)", cfg.Device, strings.Join(names, ", ")),
+				Hint:    "Check the name given in --device against the output of 'scanimage -L'",
+			}
+		}
+	}
+
+	if cfg.Device == "" && saneScanner.DeviceMatch != nil {
+		using = ""
+		for _, d := range devs {
+			if scanner.DeviceMatches(d, saneScanner.DeviceMatch) {
+				using = d.Name
+				break
+			}
+		}
+		if using == "" {
+			return checkResult{
+				Status:  checkFail,
+				Message: fmt.Sprintf("No scanner matches %q (found: %s)", cfg.DeviceMatch, strings.Join(names, ", ")),
+				Hint:    "Check the expression given in --device-match against the output of 'scanimage -L'",
+				Fatal:   true,
+			}
+		}
+	}
+
+	if scanPool != nil {
+		var missing []string
+		for _, m := range scanPool.Members {
+			found := false
+			for _, d := range devs {
+				if d.Name == m.Scanner.Device || (m.Scanner.DeviceMatch != nil && scanner.DeviceMatches(d, m.Scanner.DeviceMatch)) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				missing = append(missing, m.Name)
+			}
+		}
+
+		if len(missing) > 0 {
+			return checkResult{
+				Status:  checkWarn,
+				Message: fmt.Sprintf("Scanners %s of the pool not found (found: %s)", strings.Join(missing, ", "), strings.Join(names, ", ")),
+				Hint:    "Check the devices given in --scanners against the output of 'scanimage -L', scans dispatched to them fail until they are connected",
+			}
+		}
+		using = fmt.Sprintf("a pool of %d scanners", len(scanPool.Members))
+	}
+
+	return checkResult{
+		Status:  checkPass,
+		Message: fmt.Sprintf("Found %d scanner(s): %s, using %s", len(devs), strings.Join(names, ", "), using),
+	}
+}
+
+// checkOptions applies the default scanner options to the device
+// without feeding paper, catching options it does not take before the
+// first scan fails on them
+func checkOptions() checkResult {
+	validator, ok := scanBackend.(scanner.OptionValidator)
+	if !ok || !usesSANE() {
+		return checkResult{
+			Status:  checkPass,
+			Message: "Not scanning with SANE, options are not applied",
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), selfCheckTimeout)
+	defer cancel()
+
+	report, err := validator.ValidateOptions(scanner.Job{Options: defaultScannerOptions(), Context: ctx})
+	if err != nil {
+		return checkResult{
+			Status:  checkWarn,
+			Message: fmt.Sprintf("Unable to apply the scanner options: %s", err),
+			Hint:    "Check the scanner is powered on and connected, scans will fail until it is",
+		}
+	}
+
+	var rejected []string
+	for _, o := range report.Options {
+		if o.Error != "" {
+			rejected = append(rejected, fmt.Sprintf("%s (%s)", o.Name, o.Error))
+		}
+	}
+	if len(rejected) > 0 {
+		return checkResult{
+			Status:  checkFail,
+			Message: fmt.Sprintf("Scanner %s rejected the options %s", report.Device.Name, strings.Join(rejected, ", ")),
+			Hint:    "Check the default scanner options (--scanner-options) against GET /options",
+		}
+	}
+
+	return checkResult{
+		Status:  checkPass,
+		Message: fmt.Sprintf("Scanner %s took %d option(s)", report.Device.Name, len(report.Options)),
+	}
+}
+
+// checkTestFrame scans a frame from the SANE test backend to check the
+// acquisition works without feeding paper (--self-test-frame)
+func checkTestFrame() checkResult {
+	if !cfg.SelfTestFrame {
+		return checkResult{
+			Status:  checkPass,
+			Message: "No test frame requested (--self-test-frame), skipping",
+		}
+	}
+	if !featureSANE {
+		return checkResult{
+			Status:  checkWarn,
+			Message: "SANE is not available, no test frame scanned",
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), selfCheckTimeout)
+	defer cancel()
+
+	var (
+		frame image.Image
+		done  = make(chan struct{})
+		out   = make(chan image.Image, 1)
+		test  = &scanner.SANE{Device: "test:0"}
+	)
+	go func() {
+		defer close(done)
+		for img := range out {
+			frame = img
+		}
+	}()
+
+	// SANE is not thread-safe: the scanner is reserved while the test
+	// backend is used
+	scan := func() error {
+		return saneScanner.Exclusive(func(func() ([]scanner.Device, error)) error {
+			return test.Scan(scanner.Job{Options: map[string]interface{}{"resolution": 75}, MaxPages: 1, Context: ctx}, out)
+		})
+	}
+
+	var err error
+	if scanPool != nil {
+		// The devices of the pool share the same SANE instance
+		err = scanPool.Exclusive(scan)
+	} else {
+		err = scan()
+	}
+	<-done
+
+	switch {
+	case err != nil:
+		return checkResult{
+			Status:  checkFail,
+			Message: fmt.Sprintf("Unable to scan a test frame: %s", err),
+			Hint:    "Enable the 'test' backend in the dll.conf of SANE (see --sane-config-dir)",
+		}
+
+	case frame == nil:
+		return checkResult{
+			Status:  checkFail,
+			Message: "The test backend delivered no frame",
+		}
+	}
+
+	return checkResult{
+		Status:  checkPass,
+		Message: fmt.Sprintf("Scanned a %dx%d test frame", frame.Bounds().Dx(), frame.Bounds().Dy()),
+	}
+}
+
+// checkDirectories writes a file into the directories given by
+// --spool-dir, --storage-dir and --state-dir
+func checkDirectories() checkResult {
+	var checked, failed []string
+	for _, d := range []struct{ flag, dir string }{
+		{"--spool-dir", cfg.SpoolDir},
+		{"--storage-dir", cfg.StorageDir},
+		{"--state-dir", cfg.StateDir},
+	} {
+		if d.dir == "" {
+			continue
+		}
+		checked = append(checked, d.dir)
+		if err := checkWritable(d.dir); err != nil {
+			failed = append(failed, fmt.Sprintf("%s %s (%s)", d.flag, d.dir, err))
+		}
+	}
+
+	switch {
+	case len(checked) == 0:
+		return checkResult{
+			Status:  checkPass,
+			Message: "No directories configured, skipping",
+		}
+
+	case len(failed) > 0:
+		return checkResult{
+			Status:  checkFail,
+			Message: fmt.Sprintf("Unable to write into %s", strings.Join(failed, ", ")),
+			Hint:    "Check the directories exist and are writable for the user running the daemon",
+		}
+	}
+
+	return checkResult{
+		Status:  checkPass,
+		Message: fmt.Sprintf("Directories %s are writable", strings.Join(checked, ", ")),
+	}
+}
+
+// checkWritable creates and removes a file in the directory
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".selftest-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write([]byte("selftest")); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// checkTools looks for the tesseract binary and the zbarimg binary if
+// routes or routing sheets read barcodes
+func checkTools() checkResult {
+	var (
+		found   []string
+		missing []string
+	)
+
+	if featureOCR {
+		if c := toolCapability(featureOCR, "with -tags noocr", cfg.Tesseract); c.Available {
+			found = append(found, cfg.Tesseract)
+		} else {
+			missing = append(missing, fmt.Sprintf("--tesseract: %s", c.Reason))
+		}
+	}
+
+	if featureBarcode && usesBarcodes() {
+		if c := toolCapability(featureBarcode, "with -tags nobarcode", cfg.Zbarimg); c.Available {
+			found = append(found, cfg.Zbarimg)
+		} else {
+			missing = append(missing, fmt.Sprintf("--zbarimg: %s", c.Reason))
+		}
+	}
+
+	switch {
+	case len(missing) > 0:
+		return checkResult{
+			Status:  checkWarn,
+			Message: fmt.Sprintf("Tools not available: %s", strings.Join(missing, ", ")),
+			Hint:    "Install the tools or give their path, scans requesting OCR or reading barcodes fail until they are",
+		}
+
+	case len(found) == 0:
+		return checkResult{
+			Status:  checkPass,
+			Message: "No external tools used, skipping",
+		}
+	}
+
+	return checkResult{
+		Status:  checkPass,
+		Message: fmt.Sprintf("Found %s", strings.Join(found, ", ")),
+	}
+}
+
+// usesBarcodes tells whether routing sheets or any route read barcodes
+func usesBarcodes() bool {
+	if cfg.RoutingSheets {
+		return true
+	}
+
+	targetsLock.RLock()
+	defer targetsLock.RUnlock()
+
+	for _, route := range deliveryRoutes {
+		if route.Barcode != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTargets checks the directories of the upload targets are
+// writable and the servers of the others accept connections
+func checkTargets() checkResult {
+	targetsLock.RLock()
+	var names []string
+	targets := map[string]uploadTarget{}
+	for name, t := range uploadTargets {
+		names = append(names, name)
+		targets[name] = t
+	}
+	targetsLock.RUnlock()
+
+	if len(names) == 0 {
+		return checkResult{
+			Status:  checkPass,
+			Message: "No upload targets configured (--targets), skipping",
+		}
+	}
+	sort.Strings(names)
+
+	var failed []string
+	for _, name := range names {
+		switch t := targets[name].(type) {
+		case *directoryTarget:
+			if err := checkWritable(t.Path); err != nil {
+				failed = append(failed, fmt.Sprintf("%s (%s)", name, err))
+			}
+
+		case addressedTarget:
+			conn, err := net.DialTimeout("tcp", t.Address(), selfCheckDialTimeout)
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("%s (%s)", name, err))
+				continue
+			}
+			conn.Close()
+		}
+	}
+
+	if len(failed) > 0 {
+		return checkResult{
+			Status:  checkWarn,
+			Message: fmt.Sprintf("Upload targets not reachable: %s", strings.Join(failed, ", ")),
+			Hint:    "Check the paths and servers in --targets, deliveries to them are retried and fail until they are reachable",
+		}
+	}
+
+	return checkResult{
+		Status:  checkPass,
+		Message: fmt.Sprintf("Upload targets %s are reachable", strings.Join(names, ", ")),
+	}
+}
+
+// checkUSBPermissions looks for attached Fujitsu USB devices and checks
+// whether the current user is allowed to access their device nodes
+func checkUSBPermissions() checkResult {
+	devices, err := filepath.Glob("/sys/bus/usb/devices/*/idVendor")
+	if err != nil || len(devices) == 0 {
+		return checkResult{
+			Status:  checkPass,
+			Message: "No USB device information available, skipping",
+		}
+	}
+
+	var found, denied []string
+	for _, vendorFile := range devices {
+		vendor, err := ioutil.ReadFile(vendorFile)
+		if err != nil || strings.TrimSpace(string(vendor)) != fujitsuUSBVendor {
+			continue
+		}
+
+		devDir := path.Dir(vendorFile)
+		busNum, err1 := readSysfsInt(path.Join(devDir, "busnum"))
+		devNum, err2 := readSysfsInt(path.Join(devDir, "devnum"))
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		node := fmt.Sprintf("/dev/bus/usb/%03d/%03d", busNum, devNum)
+		found = append(found, node)
+
+		f, err := os.OpenFile(node, os.O_RDWR, 0)
+		if err != nil {
+			denied = append(denied, node)
+			continue
+		}
+		f.Close()
+	}
+
+	switch {
+	case len(found) == 0:
+		return checkResult{
+			Status:  checkPass,
+			Message: "No Fujitsu USB devices attached, skipping",
+		}
+
+	case len(denied) > 0:
+		return checkResult{
+			Status:  checkWarn,
+			Message: fmt.Sprintf("No read/write access to USB device(s) %s", strings.Join(denied, ", ")),
+			Hint:    "Add the user to the 'scanner' group or install the udev rules shipped with libsane",
+		}
+
+	default:
+		return checkResult{
+			Status:  checkPass,
+			Message: fmt.Sprintf("USB device(s) %s accessible", strings.Join(found, ", ")),
+		}
+	}
+}
+
+func readSysfsInt(file string) (int, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(raw)))
+}
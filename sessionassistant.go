@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sessionAssistantTemplate guides through scanning a session page by
+// page (flatbed) or batch by batch, it is cloned for every request to
+// translate its texts using T
+var sessionAssistantTemplate = template.Must(template.New("session").Funcs(template.FuncMap{"T": fmt.Sprintf}).Parse(`<!DOCTYPE html>
+<html lang="{{ .Lang }}">
+<head><meta charset="utf-8"><title>{{ T "Scan session" }}</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 2em auto;">
+<h1>{{ T "Scan session" }}</h1>
+{{ if .Error }}
+<p>{{ T "The last scan failed:" }} <code>{{ .Error }}</code></p>
+{{ end }}
+<p>{{ T "%d page(s) were scanned into the document so far." .Pages }}</p>
+{{ if .Paper }}
+<p>{{ T "Paper size: %s" .Paper }}</p>
+{{ end }}
+{{ if .Pages }}
+<p><img src="/sessions/{{ .ID }}/pages/{{ .Pages }}/thumb.jpg" alt="{{ T "Last scanned page" }}" style="max-width: 100%; border: 1px solid #ccc;"></p>
+{{ end }}
+{{ if .Flatbed }}
+<p>{{ T "Place the next page on the glass and scan it, or finish the document if all pages are scanned." }}</p>
+{{ else }}
+<p>{{ T "Place the next sheets into the feeder and scan them, or finish the document if all pages are scanned." }}</p>
+{{ end }}
+<form method="post" action="/sessions/{{ .ID }}/assistant" style="display: inline;"><button type="submit">{{ if .Flatbed }}{{ T "Scan next page" }}{{ else }}{{ T "Scan next sheets" }}{{ end }}</button></form>
+{{ if .Pages }}
+<form method="post" action="/sessions/{{ .ID }}/finish" style="display: inline;"><button type="submit">{{ T "Finish document" }}</button></form>
+{{ end }}
+</body>
+</html>`))
+
+func handleSessionAssistant(res http.ResponseWriter, r *http.Request) {
+	renderSessionAssistant(res, r.PathValue("id"), "")
+}
+
+// handleSessionAssistantScan scans the next page or batch into the
+// session and shows the assistant again, with the error if it failed
+func handleSessionAssistantScan(res http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	buf := &bufferResponseWriter{header: http.Header{}}
+	serveSessionScan(&languageWriter{buf, responseLanguage(res), responseUnits(res)}, r, id)
+	if buf.status < http.StatusBadRequest {
+		// Reloading the assistant must not scan again
+		http.Redirect(res, r, "/sessions/"+id+"/assistant", http.StatusSeeOther)
+		return
+	}
+
+	var failed struct {
+		Error apiError `json:"error"`
+	}
+	if err := json.Unmarshal(buf.body.Bytes(), &failed); err != nil || failed.Error.Message == "" {
+		failed.Error.Message = http.StatusText(buf.status)
+	}
+	renderSessionAssistant(res, id, failed.Error.Message)
+}
+
+func renderSessionAssistant(res http.ResponseWriter, id, scanErr string) {
+	var (
+		pages   int
+		flatbed bool
+		paper   string
+	)
+	if err := assemblySessions.Use(id, func(s *assemblySession) error {
+		pages, flatbed = len(s.Pages), s.Params.Source == sourceFlatbed
+		paper = responsePaperSize(res, s.Params)
+		return nil
+	}); err != nil {
+		writeSessionError(res, err)
+		return
+	}
+
+	lang := responseLanguage(res)
+	tpl := template.Must(sessionAssistantTemplate.Clone()).Funcs(template.FuncMap{
+		"T": func(msg string, args ...interface{}) string { return localize(lang, msg, args...) },
+	})
+
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Content-Language", lang)
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Add("Vary", "Accept-Language")
+	if err := tpl.Execute(res, struct {
+		ID, Error, Lang, Paper string
+		Pages                  int
+		Flatbed                bool
+	}{id, scanErr, lang, paper, pages, flatbed}); err != nil {
+		log.WithError(err).Error("Unable to render session assistant")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// sessionPage describes a page of an assembly session to review the
+// pages before the document is finished
+type sessionPage struct {
+	// Page is the position in the session used to edit the page,
+	// Scanned its number in the scanned batches
+	Page      int    `json:"page"`
+	Scanned   int    `json:"scanned"`
+	Section   string `json:"section,omitempty"`
+	Color     string `json:"color"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Rotate    int    `json:"rotate"`
+	Misfeed   string `json:"misfeed,omitempty"`
+	Thumbnail string `json:"thumbnail"`
+}
+
+var errInvalidPageOrder = errors.New("Order must list every page of the session exactly once")
+
+// sessionPages lists the pages of the session, the caller must hold the
+// lock of the store
+func sessionPages(s *assemblySession) []sessionPage {
+	pages := []sessionPage{}
+	for i, p := range s.Pages {
+		pages = append(pages, sessionPage{
+			Page:      i + 1,
+			Scanned:   p.Index + 1,
+			Section:   p.Section,
+			Color:     p.Color,
+			Width:     p.Width,
+			Height:    p.Height,
+			Rotate:    p.Rotate,
+			Misfeed:   p.Misfeed,
+			Thumbnail: fmt.Sprintf("/sessions/%s/pages/%d/thumb.jpg", s.ID, i+1),
+		})
+	}
+	return pages
+}
+
+// sessionPageIndex returns the 0-based position of the page given in
+// the path
+func sessionPageIndex(r *http.Request, s *assemblySession) (int, error) {
+	n, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil || n < 1 || n > len(s.Pages) {
+		return 0, errPageNotFound
+	}
+	return n - 1, nil
+}
+
+// editSessionPages applies the change to the session and responds with
+// the resulting list of pages
+func editSessionPages(res http.ResponseWriter, r *http.Request, edit func(s *assemblySession) error) {
+	var pages []sessionPage
+	if err := assemblySessions.Use(r.PathValue("id"), func(s *assemblySession) error {
+		if err := edit(s); err != nil {
+			return err
+		}
+		pages = sessionPages(s)
+		return nil
+	}); err != nil {
+		writeSessionError(res, err)
+		return
+	}
+
+	writeJSON(res, http.StatusOK, pages)
+}
+
+func handleListSessionPages(res http.ResponseWriter, r *http.Request) {
+	editSessionPages(res, r, func(*assemblySession) error { return nil })
+}
+
+func handleSessionPageThumbnail(res http.ResponseWriter, r *http.Request) {
+	var thumb []byte
+	if err := assemblySessions.Use(r.PathValue("id"), func(s *assemblySession) error {
+		i, err := sessionPageIndex(r, s)
+		if err != nil {
+			return err
+		}
+		thumb = s.Pages[i].Thumbnail
+		return nil
+	}); err != nil {
+		writeSessionError(res, err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "image/jpeg")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Write(thumb)
+}
+
+func handleDeleteSessionPage(res http.ResponseWriter, r *http.Request) {
+	editSessionPages(res, r, func(s *assemblySession) error {
+		i, err := sessionPageIndex(r, s)
+		if err != nil {
+			return err
+		}
+
+		if section := s.Pages[i].Section; section != "" && i+1 < len(s.Pages) && s.Pages[i+1].Section == "" {
+			// The section starts with the following page now
+			s.Pages[i+1].Section = section
+		}
+		s.Pages = append(s.Pages[:i:i], s.Pages[i+1:]...)
+		return nil
+	})
+}
+
+func handleRotateSessionPage(res http.ResponseWriter, r *http.Request) {
+	degrees := 90
+	if v := r.URL.Query().Get("degrees"); v != "" {
+		var err error
+		if degrees, err = strconv.Atoi(v); err != nil {
+			writeError(res, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("Invalid value for degrees: %q", v))
+			return
+		}
+	}
+
+	editSessionPages(res, r, func(s *assemblySession) error {
+		i, err := sessionPageIndex(r, s)
+		if err != nil {
+			return err
+		}
+		return s.Pages[i].RotateBy(degrees)
+	})
+}
+
+// handleReorderSessionPages takes the page numbers of the session in
+// their new order as JSON array
+func handleReorderSessionPages(res http.ResponseWriter, r *http.Request) {
+	var order []int
+	if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("Invalid JSON body: %s", err))
+		return
+	}
+
+	editSessionPages(res, r, func(s *assemblySession) error {
+		if len(order) != len(s.Pages) {
+			return errInvalidPageOrder
+		}
+
+		var (
+			pages = s.Pages[:0:0]
+			seen  = map[int]bool{}
+		)
+		for _, n := range order {
+			if n < 1 || n > len(s.Pages) || seen[n] {
+				return errInvalidPageOrder
+			}
+			seen[n] = true
+			pages = append(pages, s.Pages[n-1])
+		}
+		s.Pages = pages
+		return nil
+	})
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// Assembly sessions are kept this long after their last batch
+const assemblySessionTTL = time.Hour
+
+// assemblySession collects the pages of several batches scanned into
+// one document, e.g. for documents exceeding the feeder capacity. All
+// batches are scanned with the parameters the session was created with.
+type assemblySession struct {
+	ID      string
+	Params  *scanParams
+	Pages   []*scanner.Page
+	Batches int
+	Created time.Time
+	Updated time.Time
+
+	// next is the index of the first page of the next batch, scanning
+	// is set while a batch is being scanned into the session
+	next     int
+	scanning bool
+}
+
+// assemblySessionStatus is the JSON representation of a session
+type assemblySessionStatus struct {
+	ID      string    `json:"id"`
+	Batches int       `json:"batches"`
+	Pages   int       `json:"pages"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	// Assistant is the page guiding through scanning the session
+	Assistant string `json:"assistant"`
+}
+
+type assemblySessionStore struct {
+	sessions map[string]*assemblySession
+	lock     sync.Mutex
+}
+
+var (
+	assemblySessions = &assemblySessionStore{sessions: map[string]*assemblySession{}}
+
+	errPageNotFound    = errors.New("Page not found in the session")
+	errSessionBusy     = errors.New("A batch is currently being scanned into the session")
+	errSessionNotFound = errors.New("Session not found or expired")
+)
+
+func (a *assemblySessionStore) Add(params *scanParams) assemblySessionStatus {
+	s := &assemblySession{
+		ID:      newID(),
+		Params:  params,
+		Created: time.Now(),
+		Updated: time.Now(),
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.expire()
+	a.sessions[s.ID] = s
+	return s.status()
+}
+
+func (a *assemblySessionStore) Status(id string) (assemblySessionStatus, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.expire()
+	s, ok := a.sessions[id]
+	if !ok {
+		return assemblySessionStatus{}, false
+	}
+	return s.status(), true
+}
+
+// BeginBatch reserves the session for scanning a batch and returns the
+// parameters to scan with and the index of the first page
+func (a *assemblySessionStore) BeginBatch(id string) (scanParams, int, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.expire()
+	s, ok := a.sessions[id]
+	switch {
+	case !ok:
+		return scanParams{}, 0, errSessionNotFound
+	case s.scanning:
+		return scanParams{}, 0, errSessionBusy
+	}
+
+	s.scanning = true
+	return *s.Params, s.next, nil
+}
+
+// EndBatch appends the pages of the batch started by BeginBatch, its
+// first page starts a section of the document named by the title
+// ("Batch N" if empty). The next batch continues with the page index
+// fed.
+func (a *assemblySessionStore) EndBatch(id string, pages []*scanner.Page, fed int, title string) assemblySessionStatus {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	s := a.sessions[id]
+	s.scanning = false
+	s.Updated = time.Now()
+
+	if fed > s.next {
+		s.next = fed
+	}
+	if s.Params.Duplex && s.next%2 == 1 {
+		// Back sides are expected at odd indices
+		s.next++
+	}
+
+	if len(pages) > 0 {
+		s.Batches++
+		if title == "" {
+			title = fmt.Sprintf("Batch %d", s.Batches)
+		}
+		pages[0].Section = title
+		s.Pages = append(s.Pages, pages...)
+	}
+
+	return s.status()
+}
+
+// Remove takes the session out of the store for finishing or
+// discarding it
+func (a *assemblySessionStore) Remove(id string) (*assemblySession, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.expire()
+	s, ok := a.sessions[id]
+	switch {
+	case !ok:
+		return nil, errSessionNotFound
+	case s.scanning:
+		return nil, errSessionBusy
+	}
+
+	delete(a.sessions, id)
+	return s, nil
+}
+
+// expire removes sessions not used for a while, the caller must hold
+// the lock
+func (a *assemblySessionStore) expire() {
+	for id, s := range a.sessions {
+		if !s.scanning && time.Since(s.Updated) > assemblySessionTTL {
+			delete(a.sessions, id)
+		}
+	}
+}
+
+// status returns the JSON representation, the caller must hold the
+// lock of the store
+func (s *assemblySession) status() assemblySessionStatus {
+	return assemblySessionStatus{
+		ID:      s.ID,
+		Batches: s.Batches,
+		Pages:   len(s.Pages),
+		Created: s.Created,
+		Expires: s.Updated.Add(assemblySessionTTL),
+
+		Assistant: "/sessions/" + s.ID + "/assistant",
+	}
+}
+
+// Use calls fn with the session while holding the lock of the store to
+// read or modify its pages, which also keeps the session from expiring
+func (a *assemblySessionStore) Use(id string, fn func(s *assemblySession) error) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.expire()
+	s, ok := a.sessions[id]
+	if !ok {
+		return errSessionNotFound
+	}
+
+	s.Updated = time.Now()
+	return fn(s)
+}
+
+// writeSessionError responds with the error of a session lookup or
+// modification
+func writeSessionError(res http.ResponseWriter, err error) {
+	switch err {
+	case errSessionBusy:
+		writeError(res, http.StatusConflict, errCodeScannerBusy, err.Error())
+	case errSessionNotFound, errPageNotFound:
+		writeError(res, http.StatusNotFound, errCodeNotFound, err.Error())
+	default:
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+	}
+}
+
+func handleCreateSession(res http.ResponseWriter, r *http.Request) {
+	params, err := parseScanParams(r)
+	if err != nil {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+	params.User = requestUser(r)
+
+	status := assemblySessions.Add(params)
+	log.WithFields(log.Fields{
+		"session": status.ID,
+		"user":    params.User,
+	}).Info("Assembly session created")
+
+	res.Header().Set("Location", "/sessions/"+status.ID)
+	writeJSON(res, http.StatusCreated, status)
+}
+
+func handleGetSession(res http.ResponseWriter, r *http.Request) {
+	status, ok := assemblySessions.Status(r.PathValue("id"))
+	if !ok {
+		writeSessionError(res, errSessionNotFound)
+		return
+	}
+	writeJSON(res, http.StatusOK, status)
+}
+
+func handleDeleteSession(res http.ResponseWriter, r *http.Request) {
+	if _, err := assemblySessions.Remove(r.PathValue("id")); err != nil {
+		writeSessionError(res, err)
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// handleFinishSession responds with the document assembled from all
+// batches of the session, delivering it like a single scan
+func handleFinishSession(res http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	s, err := assemblySessions.Remove(r.PathValue("id"))
+	if err != nil {
+		writeSessionError(res, err)
+		return
+	}
+
+	var (
+		params = s.Params
+		pages  = s.Pages
+	)
+	params.JobID = newID()
+	params.RequestID = requestID(r)
+	res.Header().Set("X-Job-ID", params.JobID)
+
+	if len(params.Pages) > 0 {
+		// The pages might have been reordered, they are selected by their
+		// position in the session instead of the scanned page number
+		selected := []*scanner.Page{}
+		for _, i := range params.Pages.indices(len(pages)) {
+			if i < len(pages) {
+				selected = append(selected, pages[i])
+			}
+		}
+		pages, params.Pages = selected, nil
+	}
+
+	params.logger().WithFields(log.Fields{
+		"session": s.ID,
+		"batches": s.Batches,
+		"pages":   len(s.Pages),
+	}).Info("Assembly session finished")
+
+	serveDocument(res, r, params, pages, nil, start)
+}
+
+// serveSessionScan scans a batch into the session and responds with
+// the state of the session. Pages captured before a failure are kept,
+// the remaining sheets are scanned as the next batch.
+func serveSessionScan(res http.ResponseWriter, r *http.Request, id string) {
+	params, firstIndex, err := assemblySessions.BeginBatch(id)
+	if err != nil {
+		writeSessionError(res, err)
+		return
+	}
+
+	params.JobID = newID()
+	params.User = requestUser(r)
+	params.RequestID = requestID(r)
+	params.ClaimToken = claimToken(r)
+	if jobID, ok := r.Context().Value(ctxKeyJobID).(string); ok {
+		params.JobID = jobID
+	}
+	res.Header().Set("X-Job-ID", params.JobID)
+
+	pages, skipped, scanErr := scanAndProcessPages(&params, firstIndex)
+	fed := params.Fed
+	if scanErr != nil {
+		pages, fed = completeSheets(&params, pages, fed)
+	}
+	status := assemblySessions.EndBatch(id, pages, fed, r.URL.Query().Get("section"))
+
+	if len(skipped) > 0 {
+		res.Header().Set("X-Skipped-Pages", skippedPages(skipped))
+		res.Header().Add("X-Scan-Warning", "Some pages were unable to be processed and are missing in the document")
+	}
+	if misfed := misfedPages(pages); misfed != "" {
+		res.Header().Set("X-Misfeed-Pages", misfed)
+		res.Header().Add("X-Scan-Warning", "Possible misfeed (stapled or overlapping sheets) detected, please rescan")
+	}
+
+	if scanErr == nil {
+		writeJSON(res, http.StatusOK, status)
+		return
+	}
+
+	params.logger().WithError(scanErr).WithFields(log.Fields{
+		"session": id,
+		"pages":   len(pages),
+	}).Error("Unable to scan batch into session")
+	if len(pages) == 0 {
+		writeScanError(res, params.JobID, scanErr)
+		return
+	}
+
+	httpStatus, code := partialScanError(scanErr)
+	writeAPIError(res, httpStatus, apiError{
+		Code:          code,
+		Message:       fmt.Sprintf("Scan failed after %d page(s): %s\nThe pages were added to the session, scan the remaining sheets into it", len(pages), scanErr),
+		SANEStatus:    saneStatusName(scanErr),
+		JobID:         params.JobID,
+		PagesCaptured: len(pages),
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/pdfgen"
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+)
+
+// pdfSigner signs every generated PDF, nil disables signing
+var pdfSigner *pdfgen.Signer
+
+func loadPDFSigner(certFile, keyFile string) (*pdfgen.Signer, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("Signing requires --sign-cert and --sign-key")
+	}
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load certificate: %s", err)
+	}
+
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Key is unable to sign")
+	}
+
+	signer := &pdfgen.Signer{Key: key, Reason: cfg.SignReason, Location: cfg.SignLocation}
+	for _, der := range pair.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse certificate: %s", err)
+		}
+		signer.Certificates = append(signer.Certificates, cert)
+	}
+
+	if leaf := signer.Certificates[0]; time.Now().After(leaf.NotAfter) {
+		return nil, fmt.Errorf("Certificate expired at %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	return signer, nil
+}
+
+// writeSignedPDF renders the document into memory to sign it as a
+// whole once it is complete
+func writeSignedPDF(w io.Writer, params *scanParams, pages []*scanner.Page) error {
+	buf := new(bytes.Buffer)
+	if err := assemblePDF(buf, params, pages); err != nil {
+		return err
+	}
+	return signPDF(w, buf.Bytes())
+}
+
+// signPDF writes the document with the signature added as incremental
+// update
+func signPDF(w io.Writer, data []byte) error {
+	doc, err := pdfgen.ReadDocument(data)
+	if err != nil {
+		return fmt.Errorf("Unable to read PDF to sign: %s", err)
+	}
+	if err = pdfSigner.Sign(w, doc, time.Now()); err != nil {
+		return fmt.Errorf("Unable to sign PDF: %s", err)
+	}
+	return nil
+}
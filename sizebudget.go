@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+)
+
+// sizeBudgetSteps are tried in order until the document fits max-size:
+// the JPEG quality is lowered first, then the resolution and at last
+// the color is dropped
+var sizeBudgetSteps = []struct {
+	quality int
+	scale   float64
+	gray    bool
+}{
+	{75, 1, false},
+	{60, 1, false},
+	{60, 0.75, false},
+	{50, 0.75, true},
+	{40, 0.5, true},
+	{30, 0.5, true},
+	{25, 0.35, true},
+}
+
+// parseByteSize reads sizes like 5MB, 500k or 1048576, the units are
+// binary (1MB = 1024 KB) to stay below the limits either way
+func parseByteSize(v string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(v))
+	unit := int64(1)
+	for _, u := range []struct {
+		suffix string
+		factor int64
+	}{
+		{"GIB", 1 << 30}, {"GB", 1 << 30}, {"G", 1 << 30},
+		{"MIB", 1 << 20}, {"MB", 1 << 20}, {"M", 1 << 20},
+		{"KIB", 1 << 10}, {"KB", 1 << 10}, {"K", 1 << 10},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.factor
+			break
+		}
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("Invalid size %q (e.g. 5MB or 500KB)", v)
+	}
+	return int64(f * float64(unit)), nil
+}
+
+// documentSize renders the documents of the pages to measure them
+func documentSize(params *scanParams, pages []*scanner.Page) (int64, error) {
+	var size int64
+	for _, doc := range scanDocuments(params, pages) {
+		c := &countingWriter{w: ioutil.Discard}
+		if err := writePDF(c, params, doc); err != nil {
+			return 0, err
+		}
+		size += c.n
+	}
+	return size, nil
+}
+
+// fitSizeBudget re-encodes the pages with the first of sizeBudgetSteps
+// getting the documents below max-size. The description of the step
+// used is returned, empty if the pages fit already. If no step is
+// sufficient the smallest pages are returned with fits set to false.
+func fitSizeBudget(params *scanParams, pages []*scanner.Page) (out []*scanner.Page, step string, fits bool, err error) {
+	size, err := documentSize(params, pages)
+	if err != nil || size <= params.MaxSize {
+		return pages, "", true, err
+	}
+
+	for _, s := range sizeBudgetSteps {
+		out = make([]*scanner.Page, len(pages))
+		for i, p := range pages {
+			if out[i], err = p.Shrink(imageOps, s.quality, s.scale, s.gray); err != nil {
+				return pages, "", false, err
+			}
+		}
+
+		step = fmt.Sprintf("quality=%d", s.quality)
+		if s.scale < 1 {
+			step += fmt.Sprintf(", dpi=%d", int(float64(params.PDFDPI)*s.scale))
+		}
+		if s.gray {
+			step += ", gray"
+		}
+
+		if size, err = documentSize(params, out); err != nil {
+			return pages, "", false, err
+		}
+		params.logger().WithField("size", size).WithField("step", step).Debug("Reduced document for max-size")
+		if size <= params.MaxSize {
+			return out, step, true, nil
+		}
+	}
+
+	return out, step, false, nil
+}
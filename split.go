@@ -0,0 +1,152 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+)
+
+// splitDocuments chops the pages into documents of n pages each, the
+// last document containing the remaining pages. With n < 1 all pages
+// are kept in a single document.
+func splitDocuments(pages []*scanner.Page, n int) [][]*scanner.Page {
+	if n < 1 || len(pages) <= n {
+		return [][]*scanner.Page{pages}
+	}
+
+	docs := [][]*scanner.Page{}
+	for len(pages) > 0 {
+		if len(pages) < n {
+			n = len(pages)
+		}
+		docs = append(docs, pages[:n])
+		pages = pages[n:]
+	}
+
+	return docs
+}
+
+// splitSheets groups the pages by the sheet they were scanned from,
+// sheets with their back side removed by blank-pages keep the front only
+func splitSheets(pages []*scanner.Page, duplex bool) [][]*scanner.Page {
+	sheets := [][]*scanner.Page{}
+	for _, p := range pages {
+		if n := len(sheets); duplex && isBackSide(p) && n > 0 && len(sheets[n-1]) == 1 && sheets[n-1][0].Index == p.Index-1 {
+			sheets[n-1] = append(sheets[n-1], p)
+			continue
+		}
+		sheets = append(sheets, []*scanner.Page{p})
+	}
+	return sheets
+}
+
+// splitDuplex separates the front and back sides of a duplex batch into
+// two documents, a side without pages is left out
+func splitDuplex(pages []*scanner.Page) [][]*scanner.Page {
+	var fronts, backs []*scanner.Page
+	for _, p := range pages {
+		if isBackSide(p) {
+			backs = append(backs, p)
+		} else {
+			fronts = append(fronts, p)
+		}
+	}
+
+	docs := [][]*scanner.Page{}
+	for _, doc := range [][]*scanner.Page{fronts, backs} {
+		if len(doc) > 0 {
+			docs = append(docs, doc)
+		}
+	}
+	return docs
+}
+
+// isBackSide tells whether the page is the back side of a sheet in a
+// duplex batch, which are at the odd indices
+func isBackSide(p *scanner.Page) bool { return p.Index%2 == 1 }
+
+// scanDocuments splits the pages into the documents requested by
+// split-every or duplex-split
+func scanDocuments(params *scanParams, pages []*scanner.Page) [][]*scanner.Page {
+	if params.DuplexSplit {
+		return splitDuplex(pages)
+	}
+	return splitDocuments(pages, params.SplitEvery)
+}
+
+// documentName names the document in a ZIP archive by the base name and
+// its position in the batch or by the duplex side
+func documentName(params *scanParams, base string, i int, doc []*scanner.Page) string {
+	switch {
+	case params.DuplexSplit && isBackSide(doc[0]):
+		return base + "_back.pdf"
+	case params.DuplexSplit:
+		return base + "_front.pdf"
+	}
+	return fmt.Sprintf("%s_%03d.pdf", base, i+1)
+}
+
+// writeZIPFromDocuments renders each document into its own PDF and
+// writes them into a ZIP archive named by documentName
+func writeZIPFromDocuments(w io.Writer, params *scanParams, docs [][]*scanner.Page, base string) error {
+	zw := zip.NewWriter(w)
+
+	for i, doc := range docs {
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     documentName(params, base, i, doc),
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to add document %d to archive: %s", i+1, err)
+		}
+
+		if err := writePDF(fw, params, doc); err != nil {
+			return fmt.Errorf("Unable to generate document %d: %s", i+1, err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("Unable to finalize archive: %s", err)
+	}
+
+	return nil
+}
+
+// deliverDuplexSplit delivers the front sides to the targets of the route
+// and the back sides to its back targets, each as its own PDF
+func deliverDuplexSplit(res http.ResponseWriter, params *scanParams, docs [][]*scanner.Page, route deliveryRoute, doc *deliveryDocument) {
+	base := strings.TrimSuffix(doc.Filename, filepath.Ext(doc.Filename))
+
+	for i, pages := range docs {
+		targets := route.Targets
+		if isBackSide(pages[0]) {
+			targets = route.BackTargets
+		}
+		if len(targets) == 0 {
+			continue
+		}
+
+		file, err := renderTempFile(func(w io.Writer) error { return writePDF(w, params, pages) })
+		if err != nil {
+			params.logger().WithError(err).Error("Unable to generate document for delivery")
+			res.Header().Add("X-Scan-Warning", "Unable to generate the documents for delivery")
+			return
+		}
+
+		side := *doc
+		side.File = file
+		side.Filename = documentName(params, base, i, pages)
+		side.ContentType = "application/pdf"
+		side.Pages = len(pages)
+		deliverScan(targets, &side, true)
+	}
+
+	res.Header().Set("X-Back-Targets", strings.Join(route.BackTargets, ", "))
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cooldownError signals the scanner is resting after a large batch
+type cooldownError struct {
+	Remaining time.Duration
+}
+
+func (c cooldownError) Error() string {
+	return fmt.Sprintf("Scanner is cooling down after a large batch, retry in %s", c.Remaining.Round(time.Second))
+}
+
+// dutyCycleStats tracks how much the scanner is used to give an idea of
+// its energy consumption and wear
+type dutyCycleStats struct {
+	lock sync.Mutex
+
+	started      time.Time
+	active       time.Duration
+	jobs         int
+	failedJobs   int
+	pages        int
+	recentJobs   []time.Time // start of the jobs within the last hour
+	lastEnd      time.Time
+	lastPages    int
+	runningSince time.Time // start of the current scan, zero if idle
+
+	totals     scanTotals
+	totalsFile string // empty if the totals are not persisted
+}
+
+// scanTotals are the cumulative statistics kept across restarts
+type scanTotals struct {
+	Scans    int       `json:"scans"`
+	Pages    int       `json:"pages"`
+	Failures int       `json:"failures"`
+	LastScan time.Time `json:"last_scan"`
+	// RemovedScans and ReclaimedBytes count the cleanups of the
+	// retention policy
+	RemovedScans   int   `json:"removed_scans"`
+	ReclaimedBytes int64 `json:"reclaimed_bytes"`
+	// Maintenance are the maintenance tasks done by the user, see
+	// maintenanceReminder
+	Maintenance map[string]*maintenanceRecord `json:"maintenance,omitempty"`
+}
+
+var dutyCycle = &dutyCycleStats{started: time.Now()}
+
+type dutyCycleSnapshot struct {
+	Uptime            float64 `json:"uptime_seconds"`
+	ActiveTime        float64 `json:"active_seconds"`
+	IdleTime          float64 `json:"idle_seconds"`
+	DutyCycle         float64 `json:"duty_cycle"`
+	Jobs              int     `json:"jobs"`
+	FailedJobs        int     `json:"failed_jobs"`
+	Pages             int     `json:"pages"`
+	JobsLastHour      int     `json:"jobs_last_hour"`
+	CooldownRemaining float64 `json:"cooldown_remaining_seconds"`
+
+	TotalScans          int        `json:"total_scans"`
+	TotalPages          int        `json:"total_pages"`
+	AveragePagesPerScan float64    `json:"average_pages_per_scan"`
+	TotalFailures       int        `json:"total_failures"`
+	LastScan            *time.Time `json:"last_scan,omitempty"`
+	RemovedScans        int        `json:"removed_scans"`
+	ReclaimedBytes      int64      `json:"reclaimed_bytes"`
+}
+
+// loadTotals reads the cumulative statistics from the file and keeps
+// persisting them to it after every scan
+func (d *dutyCycleStats) loadTotals(file string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.totalsFile = file
+	raw, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read stats file: %s", err)
+	}
+
+	if err = json.Unmarshal(raw, &d.totals); err != nil {
+		return fmt.Errorf("Unable to parse stats file: %s", err)
+	}
+	return nil
+}
+
+// saveTotals must be called with the lock held
+func (d *dutyCycleStats) saveTotals() {
+	if d.totalsFile == "" {
+		return
+	}
+
+	raw, err := json.MarshalIndent(d.totals, "", "  ")
+	if err == nil {
+		// Write to a temporary file first to not lose the totals when
+		// the daemon is killed while writing
+		tmp := d.totalsFile + ".tmp"
+		if err = ioutil.WriteFile(tmp, raw, 0600); err == nil {
+			err = os.Rename(tmp, d.totalsFile)
+		}
+	}
+	if err != nil {
+		log.WithError(err).Error("Unable to persist scan statistics")
+	}
+}
+
+// statsFile returns the file to persist the totals to, next to the
+// scans if --stats-file is not set
+func statsFile() string {
+	if cfg.StatsFile != "" {
+		return cfg.StatsFile
+	}
+	if cfg.StorageDir != "" {
+		return path.Join(cfg.StorageDir, "stats.json")
+	}
+	return ""
+}
+
+// checkCooldown returns a cooldownError if the previous batch was large
+// enough to require a rest which is not yet over
+func (d *dutyCycleStats) checkCooldown() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if r := d.cooldownRemaining(); r > 0 {
+		return cooldownError{r}
+	}
+	return nil
+}
+
+// cooldownRemaining must be called with the lock held
+func (d *dutyCycleStats) cooldownRemaining() time.Duration {
+	if cfg.CooldownPages < 1 || d.lastPages < cfg.CooldownPages {
+		return 0
+	}
+	if r := cfg.CooldownDuration - time.Since(d.lastEnd); r > 0 {
+		return r
+	}
+	return 0
+}
+
+// start marks the scanner as busy and returns the start time to be
+// passed to record when the scan is finished
+func (d *dutyCycleStats) start() time.Time {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.runningSince = time.Now()
+	return d.runningSince
+}
+
+// record adds a finished scanner run of the given number of pages
+func (d *dutyCycleStats) record(start time.Time, pages int, err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.runningSince = time.Time{}
+	d.active += time.Since(start)
+	d.jobs++
+	d.pages += pages
+	if err != nil {
+		d.failedJobs++
+	}
+
+	d.recentJobs = append(d.recentJobs, start)
+	d.lastEnd = time.Now()
+	d.lastPages = pages
+
+	d.totals.Scans++
+	d.totals.Pages += pages
+	if err != nil {
+		d.totals.Failures++
+	}
+	d.totals.LastScan = d.lastEnd
+	d.saveTotals()
+}
+
+// recordRetention adds the scans and bytes removed by a cleanup
+func (d *dutyCycleStats) recordRetention(scans int, bytes int64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.totals.RemovedScans += scans
+	d.totals.ReclaimedBytes += bytes
+	d.saveTotals()
+}
+
+func (d *dutyCycleStats) Snapshot() dutyCycleSnapshot {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for len(d.recentJobs) > 0 && time.Since(d.recentJobs[0]) > time.Hour {
+		d.recentJobs = d.recentJobs[1:]
+	}
+
+	var (
+		uptime = time.Since(d.started)
+		active = d.active
+	)
+	if !d.runningSince.IsZero() {
+		active += time.Since(d.runningSince)
+	}
+
+	snap := dutyCycleSnapshot{
+		Uptime:            uptime.Seconds(),
+		ActiveTime:        active.Seconds(),
+		IdleTime:          (uptime - active).Seconds(),
+		DutyCycle:         active.Seconds() / uptime.Seconds(),
+		Jobs:              d.jobs,
+		FailedJobs:        d.failedJobs,
+		Pages:             d.pages,
+		JobsLastHour:      len(d.recentJobs),
+		CooldownRemaining: d.cooldownRemaining().Seconds(),
+
+		TotalScans:     d.totals.Scans,
+		TotalPages:     d.totals.Pages,
+		TotalFailures:  d.totals.Failures,
+		RemovedScans:   d.totals.RemovedScans,
+		ReclaimedBytes: d.totals.ReclaimedBytes,
+	}
+	if d.totals.Scans > 0 {
+		snap.AveragePagesPerScan = float64(d.totals.Pages) / float64(d.totals.Scans)
+	}
+	if !d.totals.LastScan.IsZero() {
+		last := d.totals.LastScan
+		snap.LastScan = &last
+	}
+	return snap
+}
+
+func handleStats(res http.ResponseWriter, r *http.Request) {
+	writeJSON(res, http.StatusOK, dutyCycle.Snapshot())
+}
+
+// handleMetrics exposes the stats in the Prometheus text format
+func handleMetrics(res http.ResponseWriter, r *http.Request) {
+	s := dutyCycle.Snapshot()
+
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range []struct {
+		name, typ, help string
+		value           interface{}
+	}{
+		{"scansnap_uptime_seconds", "gauge", "Time since the daemon was started", s.Uptime},
+		{"scansnap_scanner_active_seconds_total", "counter", "Time the scanner was busy scanning", s.ActiveTime},
+		{"scansnap_scanner_idle_seconds_total", "counter", "Time the scanner was idle", s.IdleTime},
+		{"scansnap_jobs_total", "counter", "Number of scan jobs executed", s.Jobs},
+		{"scansnap_jobs_failed_total", "counter", "Number of scan jobs which failed", s.FailedJobs},
+		{"scansnap_pages_total", "counter", "Number of pages scanned", s.Pages},
+		{"scansnap_jobs_last_hour", "gauge", "Number of scan jobs started within the last hour", s.JobsLastHour},
+		{"scansnap_cooldown_remaining_seconds", "gauge", "Time until the scanner accepts jobs again after a large batch", s.CooldownRemaining},
+		{"scansnap_scans_lifetime_total", "counter", "Number of scans executed, kept across restarts", s.TotalScans},
+		{"scansnap_pages_lifetime_total", "counter", "Number of pages scanned, kept across restarts", s.TotalPages},
+		{"scansnap_retention_removed_scans_total", "counter", "Number of stored scans removed by the retention policy, kept across restarts", s.RemovedScans},
+		{"scansnap_retention_reclaimed_bytes_total", "counter", "Space freed by removing stored scans and stale delivery files, kept across restarts", s.ReclaimedBytes},
+	} {
+		fmt.Fprintf(res, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", m.name, m.help, m.name, m.typ, m.name, m.value)
+	}
+	writeMaintenanceMetrics(res)
+	writeReminderMetrics(res)
+	writeRetentionMetrics(res)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var scanIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// scanRecord describes a scan persisted in the storage directory
+type scanRecord struct {
+	ID          string    `json:"id"`
+	Created     time.Time `json:"created"`
+	Pages       int       `json:"pages"`
+	Documents   int       `json:"documents"`
+	Size        int       `json:"size"`
+	SHA256      string    `json:"sha256,omitempty"`
+	ContentType string    `json:"content_type"`
+	Filename    string    `json:"filename"`
+	Title       string    `json:"title,omitempty"`
+	User        string    `json:"user,omitempty"`
+	Pipeline    string    `json:"pipeline,omitempty"`
+}
+
+func (s scanRecord) Extension() string {
+	return contentTypeExtension(s.ContentType)
+}
+
+// contentTypeExtension returns the file extension of the documents
+// having the content type
+func contentTypeExtension(contentType string) string {
+	switch contentType {
+	case "application/zip":
+		return ".zip"
+	case "image/tiff":
+		return ".tif"
+	}
+	return ".pdf"
+}
+
+// scanStorage keeps every scan as file next to a JSON file containing
+// its metadata
+type scanStorage struct {
+	dir string
+}
+
+// storage is nil when no storage directory is configured
+var storage *scanStorage
+
+func newScanStorage(dir string) (*scanStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create storage directory: %s", err)
+	}
+	return &scanStorage{dir: dir}, nil
+}
+
+// Write persists the scan result rendered by render under the Filename
+// of the record and fills its Size (and ID if not set)
+func (s *scanStorage) Write(rec *scanRecord, render func(io.Writer) error) error {
+	if rec.ID == "" {
+		rec.ID = newID()
+	}
+
+	if _, err := os.Stat(path.Join(s.dir, rec.Filename)); err == nil {
+		// Never overwrite previous scans having the same name
+		ext := path.Ext(rec.Filename)
+		rec.Filename = strings.TrimSuffix(rec.Filename, ext) + "_" + rec.ID + rec.Extension()
+	}
+
+	f, err := os.OpenFile(s.File(rec), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to create scan file: %s", err)
+	}
+
+	h := sha256.New()
+	cw := &countingWriter{w: io.MultiWriter(f, h)}
+	err = render(cw)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(s.File(rec))
+		return fmt.Errorf("Unable to write scan: %s", err)
+	}
+	rec.Size = int(cw.n)
+	rec.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	meta, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to marshal metadata: %s", err)
+	}
+
+	// Metadata is written last so incomplete scans are not listed
+	if err := ioutil.WriteFile(path.Join(s.dir, rec.ID+".json"), meta, 0600); err != nil {
+		return fmt.Errorf("Unable to write metadata: %s", err)
+	}
+
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (s *scanStorage) Get(id string) (*scanRecord, error) {
+	if !scanIDPattern.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+
+	raw, err := ioutil.ReadFile(path.Join(s.dir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &scanRecord{}
+	if err := json.Unmarshal(raw, rec); err != nil {
+		return nil, fmt.Errorf("Unable to read metadata of scan %s: %s", id, err)
+	}
+	if rec.Filename == "" {
+		// Scans stored before filename templating were named by their ID
+		rec.Filename = rec.ID + rec.Extension()
+	}
+	return rec, nil
+}
+
+// Checksum returns the SHA-256 of the stored scan, scans stored before
+// checksums were recorded are hashed on demand
+func (s *scanStorage) Checksum(rec *scanRecord) (string, error) {
+	if rec.SHA256 != "" {
+		return rec.SHA256, nil
+	}
+
+	f, err := os.Open(s.File(rec))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// List returns all stored scans, newest first
+func (s *scanStorage) List() ([]*scanRecord, error) {
+	files, err := filepath.Glob(path.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	recs := []*scanRecord{}
+	for _, f := range files {
+		rec, err := s.Get(strings.TrimSuffix(path.Base(f), ".json"))
+		if err != nil {
+			continue
+		}
+		recs = append(recs, rec)
+	}
+
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Created.After(recs[j].Created) })
+	return recs, nil
+}
+
+func (s *scanStorage) File(rec *scanRecord) string {
+	return path.Join(s.dir, rec.Filename)
+}
+
+// Remove deletes the scan with its metadata, recognized text and option
+// snapshot and returns the number of bytes freed
+func (s *scanStorage) Remove(rec *scanRecord) (int64, error) {
+	var freed int64
+
+	// Metadata is removed first so the scan is no longer listed
+	for _, f := range []string{path.Join(s.dir, rec.ID+".json"), s.File(rec), jobTextFile(rec.ID), optionSnapshotFile(rec.ID)} {
+		stat, err := os.Stat(f)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			err = os.Remove(f)
+		}
+		if err != nil {
+			return freed, fmt.Errorf("Unable to remove %s: %s", path.Base(f), err)
+		}
+		freed += stat.Size()
+	}
+
+	scanIndex.Remove(rec.ID)
+	return freed, nil
+}
+
+func handleListScans(res http.ResponseWriter, r *http.Request) {
+	if storage == nil {
+		writeError(res, http.StatusNotFound, errCodeDisabled, "Scan history is not enabled")
+		return
+	}
+
+	recs, err := storage.List()
+	if err != nil {
+		writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to list scans")
+		return
+	}
+
+	writeJSON(res, http.StatusOK, recs)
+}
+
+// handleGetScan serves /scans/{id}.pdf (or .zip for split batches),
+// the extension may be omitted. The pages parameter selects pages of
+// PDFs.
+func handleGetScan(res http.ResponseWriter, r *http.Request) {
+	if serveScanResult(res, r) {
+		return
+	}
+
+	if storage == nil {
+		writeError(res, http.StatusNotFound, errCodeDisabled, "Scan history is not enabled")
+		return
+	}
+
+	file := r.PathValue("file")
+	ext := path.Ext(file)
+
+	rec, err := storage.Get(strings.TrimSuffix(file, ext))
+	if err != nil {
+		// The ID might contain something looking like an extension
+		rec, err = storage.Get(file)
+		ext = ""
+	}
+	if err != nil || (ext != "" && rec.Extension() != ext) {
+		writeError(res, http.StatusNotFound, errCodeNotFound, "Scan not found")
+		return
+	}
+
+	if serveSelectedPages(res, r, storage.File(rec), rec.ContentType, rec.Filename) {
+		return
+	}
+
+	// ServeFile answers If-None-Match using the ETag
+	if sum, err := storage.Checksum(rec); err == nil {
+		res.Header().Set("X-Content-SHA256", sum)
+		res.Header().Set("ETag", `"`+sum+`"`)
+	}
+
+	res.Header().Set("Content-Type", rec.ContentType)
+	res.Header().Set("Content-Disposition", contentDisposition(rec.Filename))
+	http.ServeFile(res, r, storage.File(rec))
+}
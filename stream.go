@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/pdfgen"
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+)
+
+// pdfStream writes the processed pages into the PDF sent to the client
+// while the scan continues. Pages finish out of order, every page is
+// written once all pages before it were written or turned out to have
+// no page (blank or unable to be processed).
+type pdfStream struct {
+	res      http.ResponseWriter
+	params   *scanParams
+	filename string
+
+	lock    sync.Mutex
+	pdf     *pdfgen.Writer
+	hash    hash.Hash
+	next    int
+	pending map[int]*scanner.Page
+	pages   int
+	err     error
+}
+
+// Processed queues the page of the index and writes all pages which are
+// next in order
+func (s *pdfStream) Processed(idx int, page *scanner.Page) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pending[idx] = page
+	written := false
+	for {
+		p, ok := s.pending[s.next]
+		if !ok {
+			break
+		}
+		delete(s.pending, s.next)
+		s.next++
+		if p != nil && s.err == nil {
+			s.err = s.write(p)
+			written = true
+		}
+	}
+
+	if written && s.err == nil {
+		s.err = s.pdf.Flush()
+		if f, ok := s.res.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// write adds the page to the document, the response is started with the
+// first page so errors before can still be reported as status
+func (s *pdfStream) write(page *scanner.Page) error {
+	if s.pdf == nil {
+		s.res.Header().Set("Content-Type", "application/pdf")
+		s.res.Header().Set("Content-Disposition", contentDisposition(s.filename))
+		s.res.Header().Set("Cache-Control", "no-cache")
+		s.res.Header().Set("Trailer", "X-Error-Code, X-Scan-Warning, X-Skipped-Pages, X-Scan-Pages, X-Content-SHA256, X-Generation-Time")
+		s.res.WriteHeader(http.StatusOK)
+
+		s.hash = sha256.New()
+		s.pdf = pdfgen.NewWriter(io.MultiWriter(s.res, s.hash), s.params.pdfOptions())
+	}
+
+	img, err := page.PDFImage()
+	if err != nil {
+		return fmt.Errorf("Unable to embed page %d: %s", page.Index+1, err)
+	}
+	img.Layout = s.params.layout()
+	if page.Section != "" {
+		s.pdf.AddBookmark(page.Section)
+	}
+	if err := s.pdf.AddImagePage(img); err != nil {
+		return fmt.Errorf("Unable to write page %d: %s", page.Index+1, err)
+	}
+
+	s.pages++
+	return nil
+}
+
+// serveStreamedScan sends the PDF while the pages are scanned. Like the
+// multipart responses the scan is not stored or delivered to the upload
+// targets as the document is not available as a whole.
+func serveStreamedScan(res http.ResponseWriter, r *http.Request, params *scanParams, start time.Time) {
+	q := r.URL.Query()
+	if params.Cover || params.PageNumbers || params.Optimize || params.SplitEvery > 0 || params.DuplexSplit || params.Existing != nil || len(params.Pages) > 0 || params.Archive || params.RawFrames || params.ExpectPages > 0 || params.ExpectSheets > 0 || params.Photo || params.Card || params.Receipt || q.Get("resume") != "" || q.Get("session") != "" {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, "Streamed documents can not be combined with cover, page-numbers, optimize, split-every, duplex-split, merge, pages, archive, raw-frames, expect-pages, expect-sheets, photo, card, receipt, resume or session")
+		return
+	}
+	if cfg.PostProcess != "" {
+		writeError(res, http.StatusBadRequest, errCodeInvalidParameter, "Streamed documents can not be post-processed (--post-process)")
+		return
+	}
+
+	if params.DuplicatePages == duplicatePagesDrop {
+		// The pages are sent before the next sheet can be compared
+		params.DuplicatePages = duplicatePagesFlag
+	}
+
+	params.JobID = newID()
+	params.User = requestUser(r)
+	params.RequestID = requestID(r)
+	if id, ok := r.Context().Value(ctxKeyJobID).(string); ok {
+		params.JobID = id
+	}
+	res.Header().Set("X-Job-ID", params.JobID)
+	res.Header().Set("X-Pipeline", params.pipeline().String())
+
+	// The number of pages is not known yet
+	filename, err := scanFilename(params, requestUser(r), 0, start, ".pdf")
+	if err != nil {
+		params.logger().WithError(err).Error("Unable to generate filename")
+		writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to generate filename")
+		return
+	}
+
+	stream := &pdfStream{res: res, params: params, filename: filename, pending: map[int]*scanner.Page{}}
+	params.OnProcessed = stream.Processed
+
+	pages, skipped, err := scanAndProcessPages(params, 0)
+	if err != nil {
+		_, code := scanErrorStatus(err)
+		params.logger().WithError(err).WithField("pages", len(pages)).Error("Unable to fetch pages")
+		if len(pages) > 0 {
+			recordFailedJob(r, params, len(pages), err)
+		}
+		publishEvent(scanEvent{Event: "failed", JobID: params.JobID, Pages: len(pages), Profile: params.Profile, User: params.User, Error: err.Error(), ErrorCode: code})
+	}
+
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	if stream.pdf == nil {
+		// Nothing was sent yet
+		switch {
+		case err != nil:
+			writeScanError(res, params.JobID, err)
+		case len(skipped) > 0:
+			writeError(res, http.StatusInternalServerError, errCodeInternal, skipped.Error())
+		default:
+			writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to render the pages")
+		}
+		return
+	}
+
+	if stream.err == nil {
+		stream.err = stream.pdf.Close()
+	}
+	if stream.err != nil {
+		// Parts of the document were already sent, abort the connection
+		// to signal the document is incomplete
+		params.logger().WithError(stream.err).Error("Unable to generate document")
+		publishEvent(scanEvent{Event: "failed", JobID: params.JobID, Pages: len(pages), Profile: params.Profile, User: params.User, Error: stream.err.Error(), ErrorCode: errCodeInternal})
+		panic(http.ErrAbortHandler)
+	}
+
+	if idx := skipped.Indices(); len(idx) > 0 {
+		failed := []string{}
+		for _, i := range idx {
+			failed = append(failed, strconv.Itoa(i+1))
+		}
+		res.Header().Set("X-Skipped-Pages", strings.Join(failed, ","))
+		res.Header().Add("X-Scan-Warning", "Some pages were unable to be processed and are missing")
+	}
+	if params.Meta != nil && len(params.Meta.DuplicatePages) > 0 {
+		res.Header().Add("X-Scan-Warning", "Some pages look like sheets scanned twice, please check the pages")
+	}
+	if err != nil {
+		_, code := partialScanError(err)
+		res.Header().Set("X-Error-Code", code)
+		res.Header().Add("X-Scan-Warning", fmt.Sprintf("Scan failed after %d page(s): %s", len(pages), err))
+	}
+
+	checksum := hex.EncodeToString(stream.hash.Sum(nil))
+	res.Header().Set("X-Scan-Pages", strconv.Itoa(stream.pages))
+	res.Header().Set("X-Content-SHA256", checksum)
+	res.Header().Set("X-Generation-Time", time.Since(start).String())
+
+	if err == nil {
+		publishEvent(scanEvent{
+			Event:     "completed",
+			JobID:     params.JobID,
+			Pages:     stream.pages,
+			Documents: 1,
+			Filename:  filename,
+			Profile:   params.Profile,
+			User:      params.User,
+			SHA256:    checksum,
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const recentLogLines = 1000
+
+// logBuffer is a logrus hook keeping the most recent log lines in
+// memory to be included into support bundles
+type logBuffer struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+var recentLogs = &logBuffer{}
+
+func (l *logBuffer) Levels() []log.Level { return log.AllLevels }
+
+func (l *logBuffer) Fire(e *log.Entry) error {
+	line, err := e.String()
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.lines = append(l.lines, line)
+	if len(l.lines) > recentLogLines {
+		l.lines = l.lines[len(l.lines)-recentLogLines:]
+	}
+	return nil
+}
+
+func (l *logBuffer) String() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return strings.Join(l.lines, "")
+}
+
+// failedJob describes the last scan which failed
+type failedJob struct {
+	Time   time.Time   `json:"time"`
+	User   string      `json:"user,omitempty"`
+	Error  string      `json:"error"`
+	Pages  int         `json:"pages_captured"`
+	Params *scanParams `json:"params"`
+}
+
+var (
+	lastFailure     *failedJob
+	lastFailureLock sync.Mutex
+)
+
+func recordFailedJob(r *http.Request, params *scanParams, pages int, err error) {
+	p := *params
+	p.Password = ""
+
+	lastFailureLock.Lock()
+	defer lastFailureLock.Unlock()
+
+	lastFailure = &failedJob{
+		Time:   time.Now(),
+		User:   requestUser(r),
+		Error:  err.Error(),
+		Pages:  pages,
+		Params: &p,
+	}
+}
+
+// sanitizedConfig returns the configuration with all secrets removed
+func sanitizedConfig() interface{} {
+	c := cfg
+
+	redact := func(entries []string) []string {
+		out := []string{}
+		for _, e := range nonEmpty(entries) {
+			out = append(out, strings.SplitN(e, ":", 2)[0]+":***")
+		}
+		return out
+	}
+
+	c.AdminUser = nonEmpty(c.AdminUser)
+	c.AuthBasic = redact(c.AuthBasic)
+	c.AuthToken = redact(c.AuthToken)
+	if c.MQTTPassword != "" {
+		c.MQTTPassword = "***"
+	}
+
+	return c
+}
+
+// writeSupportBundle collects everything useful for a bug report into a
+// ZIP archive
+func writeSupportBundle(w io.Writer) error {
+	zw := zip.NewWriter(w)
+
+	files := []struct {
+		name    string
+		content func() (interface{}, error)
+	}{
+		{"version.json", func() (interface{}, error) {
+			return map[string]string{
+				"version": version,
+				"go":      runtime.Version(),
+				"os":      runtime.GOOS,
+				"arch":    runtime.GOARCH,
+			}, nil
+		}},
+		{"config.json", func() (interface{}, error) { return sanitizedConfig(), nil }},
+		{"selfcheck.json", func() (interface{}, error) { return selfTest(), nil }},
+		{"devices.json", func() (interface{}, error) { return saneScanner.Capabilities() }},
+		{"stats.json", func() (interface{}, error) { return dutyCycle.Snapshot(), nil }},
+		{"last-failed-job.json", func() (interface{}, error) {
+			lastFailureLock.Lock()
+			defer lastFailureLock.Unlock()
+			return lastFailure, nil
+		}},
+		{"logs.txt", func() (interface{}, error) { return recentLogs.String(), nil }},
+	}
+
+	for _, f := range files {
+		content, err := f.content()
+		if err != nil {
+			// An incomplete bundle is still better than none
+			content = map[string]string{"error": err.Error()}
+		}
+
+		var data []byte
+		if s, ok := content.(string); ok {
+			data = []byte(s)
+		} else if data, err = json.MarshalIndent(content, "", "  "); err != nil {
+			return fmt.Errorf("Unable to marshal %s: %s", f.name, err)
+		}
+
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			return fmt.Errorf("Unable to add %s to archive: %s", f.name, err)
+		}
+		if _, err := fw.Write(data); err != nil {
+			return fmt.Errorf("Unable to write %s to archive: %s", f.name, err)
+		}
+	}
+
+	return zw.Close()
+}
+
+func supportBundleFilename() string {
+	return fmt.Sprintf("scansnap-go-support-%s.zip", time.Now().Format("20060102-150405"))
+}
+
+func handleAdminSupportBundle(res http.ResponseWriter, r *http.Request) {
+	buf := new(bytes.Buffer)
+	if err := writeSupportBundle(buf); err != nil {
+		log.WithError(err).Error("Unable to generate support bundle")
+		writeError(res, http.StatusInternalServerError, errCodeInternal, "Unable to generate support bundle")
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/zip")
+	res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", supportBundleFilename()))
+	res.Header().Set("Cache-Control", "no-cache")
+	io.Copy(res, buf)
+}
+
+// runSupportBundle implements the support-bundle command writing the
+// bundle to the given file (default: timestamped file in the current
+// directory, "-" for stdout)
+func runSupportBundle(args []string) {
+	target := supportBundleFilename()
+	if len(args) > 0 {
+		target = args[0]
+	}
+
+	var w io.Writer = os.Stdout
+	if target != "-" {
+		f, err := os.Create(target)
+		if err != nil {
+			log.WithError(err).Fatal("Unable to create support bundle")
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := writeSupportBundle(w); err != nil {
+		log.WithError(err).Fatal("Unable to generate support bundle")
+	}
+
+	if target != "-" {
+		log.WithField("file", target).Info("Support bundle written, please attach it to your bug report")
+	}
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// directoryTarget copies the documents into a directory, e.g. the
+// consume directory of paperless-ngx
+type directoryTarget struct {
+	Path string `yaml:"path"`
+	// Filename replaces the --filename-template for this target, it is
+	// a template over the document fields
+	Filename string `yaml:"filename"`
+
+	filename *template.Template
+}
+
+func newDirectoryTarget(decode func(interface{}) error) (uploadTarget, error) {
+	t := &directoryTarget{}
+	if err := decode(t); err != nil {
+		return nil, err
+	}
+
+	if t.Path == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+	if stat, err := os.Stat(t.Path); err != nil || !stat.IsDir() {
+		return nil, fmt.Errorf("path %q is no directory", t.Path)
+	}
+
+	if t.Filename != "" {
+		var err error
+		if t.filename, err = template.New("filename").Parse(t.Filename); err != nil {
+			return nil, fmt.Errorf("invalid filename template: %s", err)
+		}
+	}
+
+	return t, nil
+}
+
+// Upload implements uploadTarget
+func (d directoryTarget) Upload(ctx context.Context, doc *deliveryDocument) error {
+	ext := filepath.Ext(doc.Filename)
+	base := strings.TrimSuffix(doc.Filename, ext)
+	if d.filename != nil {
+		buf := new(bytes.Buffer)
+		if err := d.filename.Execute(buf, doc); err != nil {
+			return fmt.Errorf("Unable to render filename: %s", err)
+		}
+		if base = sanitizeFilename(buf.String()); base == "" {
+			return fmt.Errorf("Filename template rendered an empty name")
+		}
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+
+	in, _, err := doc.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Consumers watching the directory must not pick up partial files,
+	// the temporary file is hidden and has no extension to be ignored
+	// by them until it is renamed
+	out, err := ioutil.TempFile(d.Path, ".scansnap-")
+	if err != nil {
+		return fmt.Errorf("Unable to create file: %s", err)
+	}
+	defer os.Remove(out.Name())
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		// Temporary files are private, consumers might run as other user
+		err = out.Chmod(0o644)
+	}
+	if err == nil {
+		// The content must be on disk before the name is visible
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write file: %s", err)
+	}
+
+	name := filepath.Join(d.Path, base+ext)
+	for i := 2; ; i++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			break
+		}
+		name = filepath.Join(d.Path, fmt.Sprintf("%s_%d%s", base, i, ext))
+	}
+
+	if err := os.Rename(out.Name(), name); err != nil {
+		return fmt.Errorf("Unable to move file into place: %s", err)
+	}
+
+	if dir, err := os.Open(d.Path); err == nil {
+		// Persist the rename, not supported by every file system
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// webDAVTarget uploads the documents into a WebDAV collection, e.g. a
+// Nextcloud folder
+type webDAVTarget struct {
+	URL      string `yaml:"url"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+}
+
+func newWebDAVTarget(decode func(interface{}) error) (uploadTarget, error) {
+	t := &webDAVTarget{}
+	if err := decode(t); err != nil {
+		return nil, err
+	}
+
+	if _, err := url.ParseRequestURI(t.URL); err != nil {
+		return nil, fmt.Errorf("invalid url: %s", err)
+	}
+	if !strings.HasSuffix(t.URL, "/") {
+		t.URL += "/"
+	}
+
+	return t, nil
+}
+
+// Address implements addressedTarget
+func (w webDAVTarget) Address() string { return urlAddress(w.URL) }
+
+// Upload implements uploadTarget
+func (w webDAVTarget) Upload(ctx context.Context, doc *deliveryDocument) error {
+	f, size, err := doc.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, w.URL+url.PathEscape(doc.Filename), f)
+	if err != nil {
+		return fmt.Errorf("Unable to create request: %s", err)
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", doc.ContentType)
+	if w.User != "" {
+		req.SetBasicAuth(w.User, w.Password)
+	}
+
+	return doTargetRequest(req)
+}
+
+// webhookTarget posts the documents as multipart form to a URL, the
+// defaults match the document upload of the paperless-ngx API
+type webhookTarget struct {
+	URL     string            `yaml:"url"`
+	Field   string            `yaml:"field"`
+	Headers map[string]string `yaml:"headers"`
+	// TagIDs translates the tags of the classification rules into the
+	// IDs paperless expects, tags not listed are not sent then
+	TagIDs map[string]int `yaml:"tag_ids"`
+}
+
+func newWebhookTarget(decode func(interface{}) error) (uploadTarget, error) {
+	t := &webhookTarget{Field: "document"}
+	if err := decode(t); err != nil {
+		return nil, err
+	}
+
+	if _, err := url.ParseRequestURI(t.URL); err != nil {
+		return nil, fmt.Errorf("invalid url: %s", err)
+	}
+
+	return t, nil
+}
+
+// Address implements addressedTarget
+func (w webhookTarget) Address() string { return urlAddress(w.URL) }
+
+// Upload implements uploadTarget
+func (w webhookTarget) Upload(ctx context.Context, doc *deliveryDocument) error {
+	f, _, err := doc.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The form is streamed to not keep large documents in memory
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+
+	go func() {
+		fields := [][2]string{
+			{"title", doc.Title},
+			{"job_id", doc.JobID},
+			{"pages", strconv.Itoa(doc.Pages)},
+			{"profile", doc.Profile},
+			{"user", doc.User},
+			{"created", doc.Created.Format(time.RFC3339)},
+		}
+		for _, tag := range doc.Tags {
+			if w.TagIDs == nil {
+				fields = append(fields, [2]string{"tags", tag})
+			} else if id, ok := w.TagIDs[tag]; ok {
+				fields = append(fields, [2]string{"tags", strconv.Itoa(id)})
+			}
+		}
+		for _, field := range fields {
+			if field[1] == "" {
+				continue
+			}
+			if err := form.WriteField(field[0], field[1]); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+
+		part, err := form.CreateFormFile(w.Field, doc.Filename)
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, pr)
+	if err != nil {
+		pr.Close()
+		return fmt.Errorf("Unable to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+
+	return doTargetRequest(req)
+}
+
+// doTargetRequest executes the upload request and converts unsuccessful
+// responses into errors
+func doTargetRequest(req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to execute request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// emailTarget sends the documents as attachment, STARTTLS is used if
+// offered by the server
+type emailTarget struct {
+	SMTP     string   `yaml:"smtp"`
+	User     string   `yaml:"user"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+	Subject  string   `yaml:"subject"`
+
+	localeOptions `yaml:",inline"`
+
+	subject *template.Template
+}
+
+func newEmailTarget(decode func(interface{}) error) (uploadTarget, error) {
+	t := &emailTarget{Subject: "Scan {{ .Filename }}"}
+	if err := decode(t); err != nil {
+		return nil, err
+	}
+
+	if _, _, err := net.SplitHostPort(t.SMTP); err != nil {
+		return nil, fmt.Errorf("smtp must be given as host:port: %s", err)
+	}
+	if t.From == "" || len(t.To) == 0 {
+		return nil, fmt.Errorf("from and to are required")
+	}
+	if err := t.localeOptions.validate(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if t.subject, err = template.New("subject").Parse(t.Subject); err != nil {
+		return nil, fmt.Errorf("invalid subject template: %s", err)
+	}
+
+	return t, nil
+}
+
+// Address implements addressedTarget
+func (e emailTarget) Address() string { return e.SMTP }
+
+// Upload implements uploadTarget
+func (e emailTarget) Upload(ctx context.Context, doc *deliveryDocument) error {
+	subject := new(bytes.Buffer)
+	if err := e.subject.Execute(subject, doc); err != nil {
+		return fmt.Errorf("Unable to render subject: %s", err)
+	}
+
+	f, _, err := doc.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", e.SMTP)
+	if err != nil {
+		return fmt.Errorf("Unable to connect to SMTP server: %s", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	host, _, _ := net.SplitHostPort(e.SMTP)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("Unable to start SMTP session: %s", err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("Unable to start TLS: %s", err)
+		}
+	}
+	if e.User != "" {
+		if err = c.Auth(smtp.PlainAuth("", e.User, e.Password, host)); err != nil {
+			return fmt.Errorf("Unable to authenticate: %s", err)
+		}
+	}
+
+	if err = c.Mail(e.From); err != nil {
+		return fmt.Errorf("Sender rejected: %s", err)
+	}
+	for _, to := range e.To {
+		if err = c.Rcpt(to); err != nil {
+			return fmt.Errorf("Recipient %q rejected: %s", to, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("Unable to start message: %s", err)
+	}
+	if err = e.writeMessage(w, subject.String(), doc, f); err != nil {
+		return fmt.Errorf("Unable to write message: %s", err)
+	}
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("Message rejected: %s", err)
+	}
+
+	return c.Quit()
+}
+
+func (e emailTarget) writeMessage(w io.Writer, subject string, doc *deliveryDocument, attachment io.Reader) error {
+	msg := multipart.NewWriter(w)
+
+	headers := []string{
+		"From: " + e.From,
+		"To: " + strings.Join(e.To, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/mixed; boundary=" + msg.Boundary(),
+	}
+	if _, err := io.WriteString(w, strings.Join(headers, "\r\n")+"\r\n\r\n"); err != nil {
+		return err
+	}
+
+	text, err := msg.CreatePart(map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(text, "%s\r\n", e.localize("Scanned %d page(s) on %s.", doc.Pages, formatDateTime(e.lang(), doc.Created)))
+	if paper := e.paperSize(doc); paper != "" {
+		fmt.Fprintf(text, "%s\r\n", e.localize("Paper size: %s", paper))
+	}
+
+	part, err := msg.CreatePart(map[string][]string{
+		"Content-Type":              {mime.FormatMediaType(doc.ContentType, map[string]string{"name": doc.Filename})},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": doc.Filename})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return err
+	}
+
+	enc := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: part, width: 76})
+	if _, err = io.Copy(enc, attachment); err != nil {
+		return err
+	}
+	if err = enc.Close(); err != nil {
+		return err
+	}
+
+	return msg.Close()
+}
+
+// lineWrapper breaks the written data into lines of the given width as
+// required for base64 encoded mail content
+type lineWrapper struct {
+	w     io.Writer
+	width int
+	col   int
+}
+
+func (l *lineWrapper) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > l.width-l.col {
+			chunk = chunk[:l.width-l.col]
+		}
+
+		w, err := l.w.Write(chunk)
+		n += w
+		if err != nil {
+			return n, err
+		}
+
+		l.col += w
+		p = p[w:]
+		if l.col == l.width {
+			if _, err := l.w.Write([]byte("\r\n")); err != nil {
+				return n, err
+			}
+			l.col = 0
+		}
+	}
+	return n, nil
+}
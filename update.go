@@ -0,0 +1,397 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// updateReleaseURL is the GitHub API endpoint of the latest release
+var updateReleaseURL = "https://api.github.com/repos/Luzifer/scansnap-go/releases/latest"
+
+// updatePublicKey is the base64 encoded Ed25519 key the SHA256SUMS of
+// the releases are signed with, pinned when building a release using
+// -ldflags "-X main.updatePublicKey=<key>" (see ci/release.sh)
+var updatePublicKey = ""
+
+// release is the part of a GitHub release used for the update check
+type release struct {
+	Tag    string `json:"tag_name"`
+	URL    string `json:"html_url"`
+	Assets []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// updateStatus is the result of the last update check
+type updateStatus struct {
+	Current   string    `json:"current"`
+	Latest    string    `json:"latest,omitempty"`
+	URL       string    `json:"url,omitempty"`
+	Available bool      `json:"update_available"`
+	CheckedAt time.Time `json:"checked_at,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// updateChecker periodically compares the running version against the
+// latest release
+type updateChecker struct {
+	lock   sync.Mutex
+	status *updateStatus
+	warned string
+}
+
+var updates = &updateChecker{}
+
+// Run checks for updates every --update-check
+func (u *updateChecker) Run() {
+	for {
+		u.check()
+		time.Sleep(cfg.UpdateCheck)
+	}
+}
+
+// Status returns the result of the last check, nil if the check is
+// disabled or did not run yet
+func (u *updateChecker) Status() *updateStatus {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.status == nil {
+		return nil
+	}
+	s := *u.status
+	return &s
+}
+
+func (u *updateChecker) check() {
+	status := &updateStatus{Current: version, CheckedAt: time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	rel, err := latestRelease(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Unable to check for updates")
+		status.Error = err.Error()
+	} else {
+		status.Latest, status.URL = rel.Tag, rel.URL
+		status.Available = newerVersion(rel.Tag, version)
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.status = status
+	if status.Available && u.warned != status.Latest {
+		// Logged once per release, not on every check
+		log.WithFields(log.Fields{"current": version, "latest": status.Latest, "url": status.URL}).Warn("A newer version is available, update using 'scansnap-go selfupdate'")
+		u.warned = status.Latest
+	}
+}
+
+// latestRelease fetches the latest release from GitHub
+func latestRelease(ctx context.Context) (release, error) {
+	var rel release
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, updateReleaseURL, nil)
+	if err != nil {
+		return rel, fmt.Errorf("Unable to create request: %s", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", "scansnap-go/"+version)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return rel, fmt.Errorf("Unable to fetch latest release: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return rel, fmt.Errorf("Unable to fetch latest release: status %d", resp.StatusCode)
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&rel); err != nil {
+		return rel, fmt.Errorf("Unable to decode latest release: %s", err)
+	}
+	if rel.Tag == "" {
+		return rel, fmt.Errorf("Latest release has no tag")
+	}
+	return rel, nil
+}
+
+// parseVersion reads the numbers of "v1.2.3" (the "v" is optional),
+// false for development builds
+func parseVersion(v string) ([]int, bool) {
+	v, _, _ = strings.Cut(strings.TrimPrefix(v, "v"), "-")
+
+	var out []int
+	for _, p := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, false
+		}
+		out = append(out, n)
+	}
+	return out, true
+}
+
+// newerVersion tells whether latest is newer than current, it is never
+// for development builds
+func newerVersion(latest, current string) bool {
+	l, ok := parseVersion(latest)
+	if !ok {
+		return false
+	}
+	c, ok := parseVersion(current)
+	if !ok {
+		return false
+	}
+
+	for i := 0; i < len(l) || i < len(c); i++ {
+		var a, b int
+		if i < len(l) {
+			a = l[i]
+		}
+		if i < len(c) {
+			b = c[i]
+		}
+		if a != b {
+			return a > b
+		}
+	}
+	return false
+}
+
+// runSelfUpdate replaces the running binary by the one of the latest
+// release for this platform. With "check" as argument it only reports
+// whether there is an update.
+func runSelfUpdate(args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	rel, err := latestRelease(ctx)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to check for updates")
+	}
+
+	logger := log.WithFields(log.Fields{"current": version, "latest": rel.Tag})
+	if _, ok := parseVersion(version); !ok {
+		logger.Fatal("Development builds can not be updated, install a release")
+	}
+	if updatePublicKey == "" {
+		logger.Fatal("Binary was built without the key to verify releases, install the update manually")
+	}
+	if !newerVersion(rel.Tag, version) {
+		logger.Info("Already running the latest version")
+		return
+	}
+	if len(args) > 0 && args[0] == "check" {
+		logger.WithField("url", rel.URL).Info("A newer version is available")
+		return
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.WithError(err).Fatal("Unable to locate the running binary")
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		log.WithError(err).Fatal("Unable to locate the running binary")
+	}
+
+	bin, err := downloadRelease(ctx, rel)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to download update")
+	}
+
+	if err = replaceBinary(exe, bin); err != nil {
+		log.WithError(err).Fatal("Unable to install update")
+	}
+
+	logger.WithField("binary", exe).Info("Updated, restart the daemon to use the new version")
+}
+
+// downloadRelease fetches the archive of the release for this platform,
+// verifies it against the SHA256SUMS of the release, which have to be
+// signed by the updatePublicKey, and returns the binary contained
+func downloadRelease(ctx context.Context, rel release) ([]byte, error) {
+	var archive, name, sums, sig string
+	platform := "_" + runtime.GOOS + "_" + runtime.GOARCH
+	for _, a := range rel.Assets {
+		switch {
+		case a.Name == "SHA256SUMS":
+			sums = a.URL
+		case a.Name == "SHA256SUMS.sig":
+			sig = a.URL
+		case strings.HasSuffix(a.Name, platform+".tar.gz"), strings.HasSuffix(a.Name, platform+".zip"):
+			archive, name = a.URL, a.Name
+		}
+	}
+	if archive == "" {
+		return nil, fmt.Errorf("Release %s has no binary for %s/%s", rel.Tag, runtime.GOOS, runtime.GOARCH)
+	}
+	if sums == "" || sig == "" {
+		return nil, fmt.Errorf("Release %s has no signed SHA256SUMS to verify the download", rel.Tag)
+	}
+
+	data, err := download(ctx, archive)
+	if err != nil {
+		return nil, err
+	}
+	sumData, err := download(ctx, sums)
+	if err != nil {
+		return nil, err
+	}
+	sigData, err := download(ctx, sig)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifyChecksums(sumData, sigData, updatePublicKey); err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	if !checksumListed(sumData, name, hex.EncodeToString(sum[:])) {
+		return nil, fmt.Errorf("Checksum of %s does not match SHA256SUMS", name)
+	}
+
+	if strings.HasSuffix(name, ".zip") {
+		return binaryFromZip(data)
+	}
+	return binaryFromTarGz(data)
+}
+
+// verifyChecksums checks the raw Ed25519 signature of the SHA256SUMS
+// against the base64 encoded public key
+func verifyChecksums(sums, sig []byte, publicKey string) error {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("Invalid key to verify releases")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), sums, sig) {
+		return fmt.Errorf("Signature of SHA256SUMS is invalid")
+	}
+	return nil
+}
+
+func download(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create request: %s", err)
+	}
+	req.Header.Set("User-Agent", "scansnap-go/"+version)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to download %s: %s", u, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unable to download %s: status %d", u, resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// checksumListed tells whether the "<sha256>  <file>" lines contain sum
+// for the file
+func checksumListed(sums []byte, name, sum string) bool {
+	s := bufio.NewScanner(bytes.NewReader(sums))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name && strings.EqualFold(fields[0], sum) {
+			return true
+		}
+	}
+	return false
+}
+
+// isReleaseBinary tells whether a file of the archive is the binary
+func isReleaseBinary(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), "scansnap-go")
+}
+
+func binaryFromTarGz(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read archive: %s", err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("Archive does not contain the binary")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read archive: %s", err)
+		}
+		if h.Typeflag == tar.TypeReg && isReleaseBinary(h.Name) {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+func binaryFromZip(data []byte) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read archive: %s", err)
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || !isReleaseBinary(f.Name) {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read archive: %s", err)
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	return nil, fmt.Errorf("Archive does not contain the binary")
+}
+
+// replaceBinary writes the new binary next to the running one and moves
+// it into place, the old binary is kept as "<name>.old" until the next
+// update as Windows can not replace a running binary
+func replaceBinary(exe string, bin []byte) error {
+	tmp := exe + ".new"
+	if err := ioutil.WriteFile(tmp, bin, 0o755); err != nil {
+		return fmt.Errorf("Unable to write binary: %s", err)
+	}
+
+	old := exe + ".old"
+	os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Unable to move running binary: %s", err)
+	}
+	if err := os.Rename(tmp, exe); err != nil {
+		// Restore the running binary
+		os.Rename(old, exe)
+		os.Remove(tmp)
+		return fmt.Errorf("Unable to move binary into place: %s", err)
+	}
+	return nil
+}
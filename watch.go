@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// watchUser is recorded as the user of scans started by inserting
+// paper into the document feeder
+const watchUser = "adf-watch"
+
+// startADFWatch polls the paper sensor in the background and scans
+// into the storage and upload targets when paper is inserted
+func startADFWatch() error {
+	if storage == nil && !haveUploadTargets() {
+		return fmt.Errorf("Watching the document feeder requires --storage-dir or --targets")
+	}
+
+	sensor, ok := scanBackend.(scanner.PaperSensor)
+	if !ok {
+		return fmt.Errorf("The scanner backend has no paper sensor")
+	}
+
+	log.WithField("sensor", cfg.WatchSensor).Info("Watching the document feeder for paper")
+	go watchADF(sensor)
+	return nil
+}
+
+func watchADF(sensor scanner.PaperSensor) {
+	var (
+		loadedSince time.Time
+		// After a scan the paper has to be removed before the next one
+		// is started, otherwise a jammed sheet would be scanned again
+		armed   = true
+		failing bool
+	)
+
+	for range time.Tick(cfg.WatchInterval) {
+		loaded, err := sensor.PaperLoaded(cfg.WatchSensor)
+		switch {
+		case errors.Is(err, scanner.ErrBusy):
+			// Another scan is running and takes the paper
+			loadedSince = time.Time{}
+			continue
+
+		case err != nil:
+			if !failing {
+				log.WithError(err).Warn("Unable to read the paper sensor")
+			}
+			failing = true
+			continue
+		}
+		failing = false
+
+		switch {
+		case !loaded:
+			loadedSince, armed = time.Time{}, true
+			continue
+
+		case !armed:
+			continue
+
+		case loadedSince.IsZero():
+			// Wait for the user to finish inserting the stack
+			log.Debug("Paper inserted into the document feeder")
+			loadedSince = time.Now()
+			continue
+
+		case time.Since(loadedSince) < cfg.WatchDelay:
+			continue
+		}
+
+		armed = false
+		log.Info("Starting scan of the paper inserted into the document feeder")
+		if status := runHeadlessScan(watchUser, cfg.WatchProfile); status >= http.StatusBadRequest {
+			log.WithField("status", status).Error("Scan of the inserted paper failed")
+		}
+	}
+}
@@ -0,0 +1,853 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/big"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/Luzifer/scansnap-go/pkg/scanner"
+	log "github.com/sirupsen/logrus"
+)
+
+// Minimal WSD (Web Services on Devices) scanner used by the Windows
+// "Add a device" dialog and the Windows scan dialogs: WS-Discovery
+// announces the device, the device metadata is fetched using
+// WS-Transfer and scans are done using the WS-Scan service. Like with
+// eSCL the clients select format (JPEG pages or a PDF/A), color mode,
+// resolution and duplex, all other settings use the configured defaults.
+
+const (
+	wsdNSAddressing = "http://schemas.xmlsoap.org/ws/2004/08/addressing"
+	wsdNSDiscovery  = "http://schemas.xmlsoap.org/ws/2005/04/discovery"
+	wsdNSScan       = "http://schemas.microsoft.com/windows/2006/08/wdp/scan"
+
+	wsdAnonymous      = wsdNSAddressing + "/role/anonymous"
+	wsdDiscoveryTo    = "urn:schemas-xmlsoap-org:ws:2005:04:discovery"
+	wsdActionFault    = wsdNSAddressing + "/fault"
+	wsdActionGet      = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Get"
+	wsdActionEventing = "http://schemas.xmlsoap.org/ws/2004/08/eventing/"
+
+	// wsdMaxProbeDelay is the maximum random delay of responses to
+	// multicast probes (APP_MAX_DELAY)
+	wsdMaxProbeDelay = 500 * time.Millisecond
+)
+
+var (
+	wsdDiscoveryGroup = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 3702}
+
+	wsdJobs = newNetworkJobStore()
+
+	// wsdFormats maps the WS-Scan formats offered to the job formats
+	wsdFormats = map[string]string{
+		"jfif":  "image/jpeg",
+		"pdf-a": "application/pdf",
+	}
+
+	wsdColorModes = map[string]string{
+		"BlackAndWhite1": scanner.ColorModeBW,
+		"Grayscale8":     scanner.ColorModeGray,
+		"RGB24":          scanner.ColorModeColor,
+	}
+)
+
+var wsdTemplates = template.Must(template.New("wsd").Funcs(template.FuncMap{
+	"xml": xmlText,
+	// Sizes are given in 1/1000 inch
+	"thousandths": func(v int) int { return v * 10 / 3 },
+}).Parse(`
+{{- define "envelope" -}}
+<?xml version="1.0" encoding="UTF-8"?>
+<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:wsd="http://schemas.xmlsoap.org/ws/2005/04/discovery" xmlns:wsdp="http://schemas.xmlsoap.org/ws/2006/02/devprof" xmlns:wsx="http://schemas.xmlsoap.org/ws/2004/09/mex" xmlns:wse="http://schemas.xmlsoap.org/ws/2004/08/eventing" xmlns:wscn="http://schemas.microsoft.com/windows/2006/08/wdp/scan" xmlns:xop="http://www.w3.org/2004/08/xop/include">
+<soap:Header>
+<wsa:To>{{ xml .To }}</wsa:To>
+<wsa:Action>{{ xml .Action }}</wsa:Action>
+<wsa:MessageID>urn:uuid:{{ .MessageID }}</wsa:MessageID>
+{{- if .RelatesTo }}
+<wsa:RelatesTo>{{ xml .RelatesTo }}</wsa:RelatesTo>
+{{- end }}
+{{- if .MessageNumber }}
+<wsd:AppSequence InstanceId="{{ .InstanceID }}" MessageNumber="{{ .MessageNumber }}"/>
+{{- end }}
+</soap:Header>
+<soap:Body>{{ .Body }}</soap:Body>
+</soap:Envelope>
+{{ end -}}
+
+{{- define "endpoint" -}}
+<wsa:EndpointReference><wsa:Address>urn:uuid:{{ .UUID }}</wsa:Address></wsa:EndpointReference>
+<wsd:Types>wsdp:Device wscn:ScanDeviceType</wsd:Types>
+<wsd:XAddrs>{{ xml .XAddrs }}</wsd:XAddrs>
+<wsd:MetadataVersion>1</wsd:MetadataVersion>
+{{- end -}}
+
+{{- define "Hello" -}}
+<wsd:Hello>{{ template "endpoint" . }}</wsd:Hello>
+{{- end -}}
+
+{{- define "ProbeMatches" -}}
+<wsd:ProbeMatches><wsd:ProbeMatch>{{ template "endpoint" . }}</wsd:ProbeMatch></wsd:ProbeMatches>
+{{- end -}}
+
+{{- define "ResolveMatches" -}}
+<wsd:ResolveMatches><wsd:ResolveMatch>{{ template "endpoint" . }}</wsd:ResolveMatch></wsd:ResolveMatches>
+{{- end -}}
+
+{{- define "GetResponse" -}}
+<wsx:Metadata>
+<wsx:MetadataSection Dialect="http://schemas.xmlsoap.org/ws/2006/02/devprof/ThisModel">
+<wsdp:ThisModel>
+<wsdp:Manufacturer>{{ xml .Info.Vendor }}</wsdp:Manufacturer>
+<wsdp:ModelName>{{ xml .Info.Model }}</wsdp:ModelName>
+<wsdp:PresentationUrl>{{ xml .BaseURL }}/</wsdp:PresentationUrl>
+</wsdp:ThisModel>
+</wsx:MetadataSection>
+<wsx:MetadataSection Dialect="http://schemas.xmlsoap.org/ws/2006/02/devprof/ThisDevice">
+<wsdp:ThisDevice>
+<wsdp:FriendlyName>{{ xml .Name }}</wsdp:FriendlyName>
+<wsdp:FirmwareVersion>{{ xml .Version }}</wsdp:FirmwareVersion>
+<wsdp:SerialNumber>{{ .Info.UUID }}</wsdp:SerialNumber>
+</wsdp:ThisDevice>
+</wsx:MetadataSection>
+<wsx:MetadataSection Dialect="http://schemas.xmlsoap.org/ws/2006/02/devprof/Relationship">
+<wsdp:Relationship Type="http://schemas.xmlsoap.org/ws/2006/02/devprof/host">
+<wsdp:Host>
+<wsa:EndpointReference><wsa:Address>urn:uuid:{{ .Info.UUID }}</wsa:Address></wsa:EndpointReference>
+<wsdp:Types>wsdp:Device wscn:ScanDeviceType</wsdp:Types>
+<wsdp:ServiceId>urn:uuid:{{ .Info.UUID }}</wsdp:ServiceId>
+</wsdp:Host>
+<wsdp:Hosted>
+<wsa:EndpointReference><wsa:Address>{{ xml .BaseURL }}/wsd/scan</wsa:Address></wsa:EndpointReference>
+<wsdp:Types>wscn:ScannerServiceType</wsdp:Types>
+<wsdp:ServiceId>uri:scansnap-go/scanner</wsdp:ServiceId>
+</wsdp:Hosted>
+</wsdp:Relationship>
+</wsx:MetadataSection>
+</wsx:Metadata>
+{{- end -}}
+
+{{- define "mediaside" }}
+<wscn:ScannerOpticalResolution><wscn:Width>{{ .MaxResolution }}</wscn:Width><wscn:Height>{{ .MaxResolution }}</wscn:Height></wscn:ScannerOpticalResolution>
+<wscn:ScannerMinimumSize><wscn:Width>{{ thousandths .MinWidth }}</wscn:Width><wscn:Height>{{ thousandths .MinHeight }}</wscn:Height></wscn:ScannerMinimumSize>
+<wscn:ScannerMaximumSize><wscn:Width>{{ thousandths .MaxWidth }}</wscn:Width><wscn:Height>{{ thousandths .MaxHeight }}</wscn:Height></wscn:ScannerMaximumSize>
+<wscn:ResolutionsSupported>
+<wscn:Widths>{{ range .Resolutions }}<wscn:Width>{{ . }}</wscn:Width>{{ end }}</wscn:Widths>
+<wscn:Heights>{{ range .Resolutions }}<wscn:Height>{{ . }}</wscn:Height>{{ end }}</wscn:Heights>
+</wscn:ResolutionsSupported>
+<wscn:ColorSupported><wscn:ColorEntry>BlackAndWhite1</wscn:ColorEntry><wscn:ColorEntry>Grayscale8</wscn:ColorEntry><wscn:ColorEntry>RGB24</wscn:ColorEntry></wscn:ColorSupported>
+{{ end -}}
+
+{{- define "GetScannerElementsResponse" -}}
+<wscn:GetScannerElementsResponse><wscn:ScannerElements>
+<wscn:ElementData Name="wscn:ScannerDescription" Valid="true"><wscn:ScannerDescription>
+<wscn:ScannerName>{{ xml .Name }}</wscn:ScannerName>
+<wscn:ScannerInfo>{{ xml .Info.MakeAndModel }}</wscn:ScannerInfo>
+</wscn:ScannerDescription></wscn:ElementData>
+<wscn:ElementData Name="wscn:ScannerConfiguration" Valid="true"><wscn:ScannerConfiguration>
+<wscn:DeviceSettings>
+<wscn:FormatsSupported><wscn:FormatValue>jfif</wscn:FormatValue><wscn:FormatValue>pdf-a</wscn:FormatValue></wscn:FormatsSupported>
+<wscn:CompressionQualityFactorSupported><wscn:MinValue>100</wscn:MinValue><wscn:MaxValue>100</wscn:MaxValue></wscn:CompressionQualityFactorSupported>
+<wscn:ContentTypesSupported><wscn:ContentTypeValue>Auto</wscn:ContentTypeValue><wscn:ContentTypeValue>Text</wscn:ContentTypeValue><wscn:ContentTypeValue>Photo</wscn:ContentTypeValue><wscn:ContentTypeValue>Mixed</wscn:ContentTypeValue></wscn:ContentTypesSupported>
+<wscn:DocumentSizeAutoDetectSupported>false</wscn:DocumentSizeAutoDetectSupported>
+<wscn:AutoExposureSupported>false</wscn:AutoExposureSupported>
+<wscn:BrightnessSupported>false</wscn:BrightnessSupported>
+<wscn:ContrastSupported>false</wscn:ContrastSupported>
+<wscn:ScalingRangeSupported><wscn:ScalingWidth><wscn:MinValue>100</wscn:MinValue><wscn:MaxValue>100</wscn:MaxValue></wscn:ScalingWidth><wscn:ScalingHeight><wscn:MinValue>100</wscn:MinValue><wscn:MaxValue>100</wscn:MaxValue></wscn:ScalingHeight></wscn:ScalingRangeSupported>
+<wscn:RotationsSupported><wscn:RotationValue>0</wscn:RotationValue></wscn:RotationsSupported>
+</wscn:DeviceSettings>
+<wscn:ADF>
+<wscn:ADFSupportsDuplex>true</wscn:ADFSupportsDuplex>
+<wscn:ADFFront>{{ template "mediaside" .Info }}</wscn:ADFFront>
+<wscn:ADFBack>{{ template "mediaside" .Info }}</wscn:ADFBack>
+</wscn:ADF>
+</wscn:ScannerConfiguration></wscn:ElementData>
+<wscn:ElementData Name="wscn:ScannerStatus" Valid="true"><wscn:ScannerStatus>
+<wscn:ScannerCurrentTime>{{ .Now }}</wscn:ScannerCurrentTime>
+<wscn:ScannerState>{{ .State }}</wscn:ScannerState>
+<wscn:ActiveConditions/>
+</wscn:ScannerStatus></wscn:ElementData>
+<wscn:ElementData Name="wscn:DefaultScanTicket" Valid="true"><wscn:DefaultScanTicket>
+<wscn:JobDescription><wscn:JobName>Scan</wscn:JobName><wscn:JobOriginatingUserName>scansnap-go</wscn:JobOriginatingUserName></wscn:JobDescription>
+{{ template "documentparameters" .Ticket }}
+</wscn:DefaultScanTicket></wscn:ElementData>
+</wscn:ScannerElements></wscn:GetScannerElementsResponse>
+{{- end -}}
+
+{{- define "documentparameters" -}}
+<wscn:DocumentParameters>
+<wscn:Format>{{ .Format }}</wscn:Format>
+<wscn:ImagesToTransfer>0</wscn:ImagesToTransfer>
+<wscn:InputSource>{{ .InputSource }}</wscn:InputSource>
+<wscn:InputSize><wscn:InputMediaSize><wscn:Width>{{ .Width }}</wscn:Width><wscn:Height>{{ .Height }}</wscn:Height></wscn:InputMediaSize></wscn:InputSize>
+<wscn:MediaSides>
+<wscn:MediaFront><wscn:ColorProcessing>{{ .ColorProcessing }}</wscn:ColorProcessing><wscn:Resolution><wscn:Width>{{ .Resolution }}</wscn:Width><wscn:Height>{{ .Resolution }}</wscn:Height></wscn:Resolution></wscn:MediaFront>
+{{- if eq .InputSource "ADFDuplex" }}
+<wscn:MediaBack><wscn:ColorProcessing>{{ .ColorProcessing }}</wscn:ColorProcessing><wscn:Resolution><wscn:Width>{{ .Resolution }}</wscn:Width><wscn:Height>{{ .Resolution }}</wscn:Height></wscn:Resolution></wscn:MediaBack>
+{{- end }}
+</wscn:MediaSides>
+</wscn:DocumentParameters>
+{{- end -}}
+
+{{- define "CreateScanJobResponse" -}}
+<wscn:CreateScanJobResponse>
+<wscn:JobId>{{ .Job.Number }}</wscn:JobId>
+<wscn:JobToken>{{ .Job.ID }}</wscn:JobToken>
+<wscn:ImageInformation><wscn:MediaFrontImageInfo>
+<wscn:PixelsPerLine>{{ .PixelsPerLine }}</wscn:PixelsPerLine>
+<wscn:NumberOfLines>{{ .NumberOfLines }}</wscn:NumberOfLines>
+<wscn:BytesPerLine>{{ .BytesPerLine }}</wscn:BytesPerLine>
+</wscn:MediaFrontImageInfo></wscn:ImageInformation>
+<wscn:DocumentFinalParameters>{{ template "documentparameters" .Ticket }}</wscn:DocumentFinalParameters>
+</wscn:CreateScanJobResponse>
+{{- end -}}
+
+{{- define "RetrieveImageResponse" -}}
+<wscn:RetrieveImageResponse><wscn:ScanData><xop:Include href="cid:{{ . }}"/></wscn:ScanData></wscn:RetrieveImageResponse>
+{{- end -}}
+
+{{- define "jobstatus" -}}
+<wscn:JobId>{{ .Number }}</wscn:JobId>
+<wscn:JobState>{{ .State }}</wscn:JobState>
+<wscn:JobStateReasons><wscn:JobStateReason>{{ .Reason }}</wscn:JobStateReason></wscn:JobStateReasons>
+<wscn:ScansCompleted>{{ .ScansCompleted }}</wscn:ScansCompleted>
+{{- end -}}
+
+{{- define "GetJobElementsResponse" -}}
+<wscn:GetJobElementsResponse><wscn:JobElements>
+<wscn:ElementData Name="wscn:JobStatus" Valid="true"><wscn:JobStatus>{{ template "jobstatus" . }}
+<wscn:JobCreatedTime>{{ .Created }}</wscn:JobCreatedTime>
+</wscn:JobStatus></wscn:ElementData>
+</wscn:JobElements></wscn:GetJobElementsResponse>
+{{- end -}}
+
+{{- define "jobsummaries" -}}
+{{- range . }}
+<wscn:JobSummary><wscn:JobName>Scan</wscn:JobName><wscn:JobOriginatingUserName>scansnap-go</wscn:JobOriginatingUserName>{{ template "jobstatus" . }}</wscn:JobSummary>
+{{- end }}
+{{- end -}}
+
+{{- define "GetActiveJobsResponse" -}}
+<wscn:GetActiveJobsResponse><wscn:ActiveJobs>{{ template "jobsummaries" . }}</wscn:ActiveJobs></wscn:GetActiveJobsResponse>
+{{- end -}}
+
+{{- define "GetJobHistoryResponse" -}}
+<wscn:GetJobHistoryResponse><wscn:JobHistory>{{ template "jobsummaries" . }}</wscn:JobHistory></wscn:GetJobHistoryResponse>
+{{- end -}}
+
+{{- define "CancelJobResponse" -}}
+<wscn:CancelJobResponse/>
+{{- end -}}
+
+{{- define "SubscribeResponse" -}}
+<wse:SubscribeResponse>
+<wse:SubscriptionManager><wsa:Address>{{ xml .Manager }}</wsa:Address><wsa:ReferenceParameters><wse:Identifier>urn:uuid:{{ .ID }}</wse:Identifier></wsa:ReferenceParameters></wse:SubscriptionManager>
+<wse:Expires>{{ xml .Expires }}</wse:Expires>
+</wse:SubscribeResponse>
+{{- end -}}
+
+{{- define "RenewResponse" -}}
+<wse:RenewResponse><wse:Expires>{{ xml .Expires }}</wse:Expires></wse:RenewResponse>
+{{- end -}}
+
+{{- define "UnsubscribeResponse" -}}
+{{- end -}}
+
+{{- define "Fault" -}}
+<soap:Fault>
+<soap:Code><soap:Value>soap:{{ .Code }}</soap:Value>{{ if .Subcode }}<soap:Subcode><soap:Value>{{ .Subcode }}</soap:Value></soap:Subcode>{{ end }}</soap:Code>
+<soap:Reason><soap:Text xml:lang="en">{{ xml .Reason }}</soap:Text></soap:Reason>
+</soap:Fault>
+{{- end -}}
+`))
+
+// wsdEnvelope is a received SOAP message, the namespace prefixes are
+// ignored and the body elements of the supported requests decoded
+type wsdEnvelope struct {
+	XMLName xml.Name `xml:"Envelope"`
+	Header  struct {
+		Action    string `xml:"Action"`
+		MessageID string `xml:"MessageID"`
+	} `xml:"Header"`
+	Body struct {
+		Probe *struct {
+			Types string `xml:"Types"`
+		} `xml:"Probe"`
+		Resolve *struct {
+			Address string `xml:"EndpointReference>Address"`
+		} `xml:"Resolve"`
+		CreateScanJob *struct {
+			Ticket wsdScanTicket `xml:"ScanTicket>DocumentParameters"`
+		} `xml:"CreateScanJobRequest"`
+		Job *struct {
+			JobID    int    `xml:"JobId"`
+			JobToken string `xml:"JobToken"`
+		} `xml:",any"`
+		Subscribe *struct {
+			Expires string `xml:"Expires"`
+		} `xml:"Subscribe"`
+		Renew *struct {
+			Expires string `xml:"Expires"`
+		} `xml:"Renew"`
+	} `xml:"Body"`
+}
+
+// wsdScanTicket holds the document parameters of a scan ticket
+type wsdScanTicket struct {
+	Format          string `xml:"Format"`
+	InputSource     string `xml:"InputSource"`
+	ColorProcessing string `xml:"MediaSides>MediaFront>ColorProcessing"`
+	Resolution      int    `xml:"MediaSides>MediaFront>Resolution>Width"`
+	// Sizes in 1/1000 inch
+	Width  int `xml:"InputSize>InputMediaSize>Width"`
+	Height int `xml:"InputSize>InputMediaSize>Height"`
+}
+
+// wsdFault is answered as SOAP fault, Subcode is the WS-Scan (or
+// WS-Addressing) error name
+type wsdFault struct {
+	Status  int
+	Code    string
+	Subcode string
+	Reason  string
+}
+
+func (w wsdFault) Error() string { return w.Reason }
+
+func wsdSenderFault(subcode, reason string) wsdFault {
+	return wsdFault{Status: http.StatusBadRequest, Code: "Sender", Subcode: subcode, Reason: reason}
+}
+
+// wsdMessage renders a SOAP message having the named body template
+func wsdMessage(header map[string]interface{}, body string, data interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := wsdTemplates.ExecuteTemplate(&b, body, data); err != nil {
+		return nil, fmt.Errorf("Unable to render %s: %s", body, err)
+	}
+
+	envelope := map[string]interface{}{"To": wsdAnonymous, "MessageID": randomUUID(), "Body": b.String()}
+	for k, v := range header {
+		envelope[k] = v
+	}
+
+	b.Reset()
+	if err := wsdTemplates.ExecuteTemplate(&b, "envelope", envelope); err != nil {
+		return nil, fmt.Errorf("Unable to render envelope: %s", err)
+	}
+	return b.Bytes(), nil
+}
+
+func randomUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	// Version 4, RFC 4122 variant
+	b[6], b[8] = b[6]&0x0f|0x40, b[8]&0x3f|0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// wsdXAddrs returns the device addresses on all local interfaces
+func wsdXAddrs(port int) string {
+	scheme := "http"
+	if cfg.TLSCert != "" {
+		scheme = "https"
+	}
+
+	var addrs []string
+	for _, ip := range localIPv4Addrs() {
+		addrs = append(addrs, fmt.Sprintf("%s://%s/wsd", scheme, net.JoinHostPort(ip.String(), strconv.Itoa(port))))
+	}
+	return strings.Join(addrs, " ")
+}
+
+// startWSDiscovery announces the device using WS-Discovery and answers
+// probes in the background
+func startWSDiscovery() error {
+	port, err := listenPort(cfg.Listen)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, wsdDiscoveryGroup)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for WS-Discovery probes: %s", err)
+	}
+
+	d := &wsdDiscovery{conn: conn, port: port, uuid: deviceUUID(), instanceID: time.Now().Unix()}
+	log.WithField("uuid", d.uuid).Info("Announcing WSD scanner using WS-Discovery")
+	go d.Run()
+	return nil
+}
+
+type wsdDiscovery struct {
+	conn       *net.UDPConn
+	port       int
+	uuid       string
+	instanceID int64
+	sequence   atomic.Int64
+}
+
+// Run sends the hello message and answers probes until the connection
+// fails
+func (w *wsdDiscovery) Run() {
+	w.send(wsdDiscoveryGroup, wsdNSDiscovery+"/Hello", "", "Hello", wsdDiscoveryTo)
+
+	buf := make([]byte, 65536)
+	for {
+		n, src, err := w.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.WithError(err).Error("WS-Discovery responder stopped")
+			return
+		}
+		if !networkAllowed(allowedNetworks, src.IP) {
+			continue
+		}
+
+		var msg wsdEnvelope
+		if err := xml.Unmarshal(buf[:n], &msg); err != nil {
+			log.WithError(err).WithField("remote", src).Debug("Ignoring invalid WS-Discovery message")
+			continue
+		}
+
+		switch {
+		case msg.Header.Action == wsdNSDiscovery+"/Probe" && msg.Body.Probe != nil && wsdProbeMatches(msg.Body.Probe.Types):
+			go func() {
+				delay, _ := rand.Int(rand.Reader, big.NewInt(int64(wsdMaxProbeDelay)))
+				time.Sleep(time.Duration(delay.Int64()))
+				w.send(src, wsdNSDiscovery+"/ProbeMatches", msg.Header.MessageID, "ProbeMatches", wsdAnonymous)
+			}()
+
+		case msg.Header.Action == wsdNSDiscovery+"/Resolve" && msg.Body.Resolve != nil && strings.TrimSpace(msg.Body.Resolve.Address) == "urn:uuid:"+w.uuid:
+			w.send(src, wsdNSDiscovery+"/ResolveMatches", msg.Header.MessageID, "ResolveMatches", wsdAnonymous)
+		}
+	}
+}
+
+func (w *wsdDiscovery) send(to *net.UDPAddr, action, relatesTo, body, recipient string) {
+	msg, err := wsdMessage(map[string]interface{}{
+		"To":            recipient,
+		"Action":        action,
+		"RelatesTo":     relatesTo,
+		"InstanceID":    w.instanceID,
+		"MessageNumber": w.sequence.Add(1),
+	}, body, map[string]string{"UUID": w.uuid, "XAddrs": wsdXAddrs(w.port)})
+	if err != nil {
+		log.WithError(err).Error("Unable to render WS-Discovery message")
+		return
+	}
+
+	if _, err := w.conn.WriteToUDP(msg, to); err != nil {
+		log.WithError(err).WithField("remote", to).Debug("Unable to send WS-Discovery message")
+	}
+}
+
+// wsdProbeMatches checks whether the device is of the probed types, the
+// namespace prefixes are not resolved
+func wsdProbeMatches(types string) bool {
+	for _, t := range strings.Fields(types) {
+		if i := strings.LastIndex(t, ":"); i >= 0 {
+			t = t[i+1:]
+		}
+		if t != "Device" && t != "ScanDeviceType" {
+			return false
+		}
+	}
+	return true
+}
+
+// handleWSD serves the SOAP requests of the device (/wsd) and its
+// scanner service (/wsd/scan)
+func handleWSD(res http.ResponseWriter, r *http.Request) {
+	var msg wsdEnvelope
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&msg); err != nil {
+		writeWSDFault(res, "", wsdSenderFault("", fmt.Sprintf("Invalid SOAP message: %s", err)))
+		return
+	}
+
+	action := msg.Header.Action
+	header := map[string]interface{}{"Action": action + "Response", "RelatesTo": msg.Header.MessageID}
+
+	var (
+		body string
+		data interface{}
+		err  error
+	)
+
+	switch {
+	case action == wsdActionGet:
+		body, data = "GetResponse", wsdTemplateData(r)
+	case action == wsdNSScan+"/GetScannerElements":
+		body, data = "GetScannerElementsResponse", wsdTemplateData(r)
+	case action == wsdNSScan+"/CreateScanJob":
+		body, data, err = wsdCreateScanJob(r, msg)
+	case action == wsdNSScan+"/RetrieveImage":
+		wsdRetrieveImage(res, r, msg)
+		return
+	case action == wsdNSScan+"/CancelJob":
+		body, err = "CancelJobResponse", wsdCancelJob(msg)
+	case action == wsdNSScan+"/GetJobElements":
+		body, data, err = wsdGetJobElements(msg)
+	case action == wsdNSScan+"/GetActiveJobs":
+		body, data = "GetActiveJobsResponse", wsdJobSummaries(false)
+	case action == wsdNSScan+"/GetJobHistory":
+		body, data = "GetJobHistoryResponse", wsdJobSummaries(true)
+	case strings.HasPrefix(action, wsdActionEventing):
+		body, data, err = wsdEventing(r, msg)
+	default:
+		err = wsdSenderFault("wsa:ActionNotSupported", fmt.Sprintf("Unsupported action %q", action))
+	}
+
+	if err != nil {
+		writeWSDFault(res, msg.Header.MessageID, err)
+		return
+	}
+
+	out, err := wsdMessage(header, body, data)
+	if err != nil {
+		writeWSDFault(res, msg.Header.MessageID, err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+	res.Write(out)
+}
+
+func writeWSDFault(res http.ResponseWriter, relatesTo string, err error) {
+	fault, ok := err.(wsdFault)
+	if !ok {
+		log.WithError(err).Error("WSD request failed")
+		fault = wsdFault{Status: http.StatusInternalServerError, Code: "Receiver", Subcode: "wscn:ServerErrorInternalError", Reason: err.Error()}
+	}
+
+	out, err := wsdMessage(map[string]interface{}{"Action": wsdActionFault, "RelatesTo": relatesTo}, "Fault", fault)
+	if err != nil {
+		log.WithError(err).Error("Unable to render WSD fault")
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+	res.WriteHeader(fault.Status)
+	res.Write(out)
+}
+
+// wsdBaseURL returns the address the client reached the device at
+func wsdBaseURL(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+// wsdTemplateData describes the device and the scanner service
+func wsdTemplateData(r *http.Request) map[string]interface{} {
+	info := currentDeviceInfo()
+	if info.Model == "" {
+		info.Model = info.MakeAndModel
+	}
+
+	state := "Idle"
+	if len(runningJobs.List()) > 0 {
+		state = "Processing"
+	}
+
+	resolution := 300
+	if info.MaxResolution < resolution {
+		resolution = info.MaxResolution
+	}
+
+	return map[string]interface{}{
+		"BaseURL": wsdBaseURL(r),
+		"Info":    info,
+		"Name":    serviceInstanceName(),
+		"Now":     time.Now().UTC().Format(time.RFC3339),
+		"Version": version,
+		"State":   state,
+		"Ticket": wsdScanTicket{
+			Format:          "jfif",
+			InputSource:     "ADF",
+			ColorProcessing: "RGB24",
+			Resolution:      resolution,
+			Width:           info.MaxWidth * 10 / 3,
+			Height:          info.MaxHeight * 10 / 3,
+		},
+	}
+}
+
+// wsdCreateScanJob starts the scan described by the ticket, the
+// parameters the scan is actually done with are returned to the client
+func wsdCreateScanJob(r *http.Request, msg wsdEnvelope) (string, interface{}, error) {
+	if msg.Body.CreateScanJob == nil {
+		return "", nil, wsdSenderFault("wscn:ClientErrorInvalidArgs", "Missing scan ticket")
+	}
+	ticket := msg.Body.CreateScanJob.Ticket
+
+	if ticket.Format == "" {
+		ticket.Format = "jfif"
+	}
+	format, ok := wsdFormats[ticket.Format]
+	if !ok {
+		return "", nil, wsdSenderFault("wscn:ClientErrorFormatNotSupported", fmt.Sprintf("Unsupported format %q", ticket.Format))
+	}
+
+	switch ticket.InputSource {
+	case "", "ADF":
+		ticket.InputSource = "ADF"
+	case "ADFDuplex":
+	default:
+		return "", nil, wsdSenderFault("wscn:ClientErrorInputSourceNotSupported", "Only the document feeder is available")
+	}
+
+	q := url.Values{}
+	q.Set("duplex", strconv.FormatBool(ticket.InputSource == "ADFDuplex"))
+	if color, ok := wsdColorModes[ticket.ColorProcessing]; ok {
+		q.Set("color", color)
+	} else {
+		ticket.ColorProcessing = "RGB24"
+	}
+	if ticket.Resolution > 0 {
+		// Clients expect the requested resolution in the document
+		q.Set("scan-dpi", strconv.Itoa(ticket.Resolution))
+		q.Set("pdf-dpi", strconv.Itoa(ticket.Resolution))
+	}
+	if ticket.Format == "pdf-a" {
+		q.Set("pdfa", "true")
+	}
+
+	job, err := startNetworkJob(r, wsdJobs, format, q)
+	if err != nil {
+		return "", nil, wsdSenderFault("wscn:ClientErrorInvalidArgs", err.Error())
+	}
+
+	log.WithFields(log.Fields{
+		"job_id": job.ID,
+		"format": format,
+		"user":   requestUser(r),
+	}).Info("Starting scan requested using WSD")
+
+	info := wsdTemplateData(r)["Ticket"].(wsdScanTicket)
+	if ticket.Resolution == 0 {
+		ticket.Resolution = info.Resolution
+	}
+	if ticket.Width == 0 || ticket.Height == 0 {
+		ticket.Width, ticket.Height = info.Width, info.Height
+	}
+
+	pixels := ticket.Width * ticket.Resolution / 1000
+	bytesPerLine := pixels * 3
+	switch ticket.ColorProcessing {
+	case "Grayscale8":
+		bytesPerLine = pixels
+	case "BlackAndWhite1":
+		bytesPerLine = (pixels + 7) / 8
+	}
+
+	return "CreateScanJobResponse", map[string]interface{}{
+		"Job":           job,
+		"Ticket":        ticket,
+		"PixelsPerLine": pixels,
+		"NumberOfLines": ticket.Height * ticket.Resolution / 1000,
+		"BytesPerLine":  bytesPerLine,
+	}, nil
+}
+
+// wsdRequestedJob returns the job named in the request, the job token
+// is checked if the request contains one
+func wsdRequestedJob(msg wsdEnvelope) (*networkJob, error) {
+	if msg.Body.Job == nil {
+		return nil, wsdSenderFault("wscn:ClientErrorInvalidArgs", "Missing job ID")
+	}
+
+	job := wsdJobs.GetNumber(msg.Body.Job.JobID)
+	if job == nil {
+		return nil, wsdSenderFault("wscn:ClientErrorJobIdNotFound", "No scan job with this ID")
+	}
+	if token := msg.Body.Job.JobToken; token != "" && token != job.ID {
+		return nil, wsdSenderFault("wscn:ClientErrorJobTokenNotFound", "Invalid job token")
+	}
+	return job, nil
+}
+
+// wsdRetrieveImage waits for the scan to finish and returns the next
+// document as MTOM attachment
+func wsdRetrieveImage(res http.ResponseWriter, r *http.Request, msg wsdEnvelope) {
+	job, err := wsdRequestedJob(msg)
+	if err != nil {
+		writeWSDFault(res, msg.Header.MessageID, err)
+		return
+	}
+
+	select {
+	case <-job.done:
+	case <-r.Context().Done():
+		return
+	}
+
+	job.lock.Lock()
+	if job.next >= len(job.docs) {
+		failed := job.next == 0 && job.status >= http.StatusBadRequest && job.errCode != errCodeADFEmpty
+		code := job.errCode
+		job.lock.Unlock()
+
+		if failed {
+			writeWSDFault(res, msg.Header.MessageID, wsdFault{
+				Status:  http.StatusInternalServerError,
+				Code:    "Receiver",
+				Subcode: "wscn:ServerErrorInternalError",
+				Reason:  fmt.Sprintf("Scan failed: %s", code),
+			})
+			return
+		}
+		writeWSDFault(res, msg.Header.MessageID, wsdSenderFault("wscn:ClientErrorNoImagesAvailable", "No more documents"))
+		return
+	}
+
+	doc := job.docs[job.next]
+	job.docs[job.next] = nil
+	job.next++
+	job.lock.Unlock()
+
+	const envelopeID, imageID = "envelope@scansnap-go", "image@scansnap-go"
+
+	envelope, err := wsdMessage(map[string]interface{}{
+		"Action":    wsdNSScan + "/RetrieveImageResponse",
+		"RelatesTo": msg.Header.MessageID,
+	}, "RetrieveImageResponse", imageID)
+	if err != nil {
+		writeWSDFault(res, msg.Header.MessageID, err)
+		return
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	parts := []struct {
+		header textproto.MIMEHeader
+		data   []byte
+	}{
+		{textproto.MIMEHeader{
+			"Content-Type":              {`application/xop+xml; charset=utf-8; type="application/soap+xml"`},
+			"Content-Id":                {"<" + envelopeID + ">"},
+			"Content-Transfer-Encoding": {"binary"},
+		}, envelope},
+		{textproto.MIMEHeader{
+			"Content-Type":              {"application/binary"},
+			"Content-Id":                {"<" + imageID + ">"},
+			"Content-Transfer-Encoding": {"binary"},
+		}, doc},
+	}
+	for _, p := range parts {
+		w, err := mw.CreatePart(p.header)
+		if err != nil {
+			writeWSDFault(res, msg.Header.MessageID, fmt.Errorf("Unable to create MTOM part: %s", err))
+			return
+		}
+		w.Write(p.data)
+	}
+	mw.Close()
+
+	res.Header().Set("Content-Type", fmt.Sprintf(
+		`multipart/related; type="application/xop+xml"; boundary=%q; start="<%s>"; start-info="application/soap+xml"`,
+		mw.Boundary(), envelopeID,
+	))
+	res.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	res.Write(body.Bytes())
+}
+
+func wsdCancelJob(msg wsdEnvelope) error {
+	job, err := wsdRequestedJob(msg)
+	if err != nil {
+		return err
+	}
+
+	// Finished jobs are simply not fetched any further
+	runningJobs.Cancel(job.ID)
+	return nil
+}
+
+// wsdJobStatus returns the job status in WS-Scan terms, the caller must
+// hold the job lock
+func wsdJobStatus(job *networkJob) map[string]interface{} {
+	state, reason := "Processing", "JobScanning"
+	switch {
+	case job.finished.IsZero():
+	case job.errCode == errCodeScanCancelled:
+		state, reason = "Canceled", "JobCanceledByUser"
+	case job.status >= http.StatusBadRequest && len(job.docs) == 0:
+		state, reason = "Aborted", "JobAbortedBySystem"
+	default:
+		state, reason = "Completed", "JobCompletedSuccessfully"
+	}
+
+	return map[string]interface{}{
+		"Number":         job.Number,
+		"State":          state,
+		"Reason":         reason,
+		"ScansCompleted": len(job.docs),
+		"Created":        job.Created.UTC().Format(time.RFC3339),
+	}
+}
+
+func wsdGetJobElements(msg wsdEnvelope) (string, interface{}, error) {
+	job, err := wsdRequestedJob(msg)
+	if err != nil {
+		return "", nil, err
+	}
+
+	job.lock.Lock()
+	defer job.lock.Unlock()
+
+	return "GetJobElementsResponse", wsdJobStatus(job), nil
+}
+
+// wsdJobSummaries lists the running or the finished jobs
+func wsdJobSummaries(finished bool) []map[string]interface{} {
+	var jobs []map[string]interface{}
+	for _, job := range wsdJobs.List() {
+		job.lock.Lock()
+		if job.finished.IsZero() != finished {
+			jobs = append(jobs, wsdJobStatus(job))
+		}
+		job.lock.Unlock()
+	}
+	return jobs
+}
+
+// wsdEventing accepts event subscriptions of the clients, scan events
+// (scanning from the device) are not supported so no events are sent
+func wsdEventing(r *http.Request, msg wsdEnvelope) (string, interface{}, error) {
+	switch msg.Header.Action {
+	case wsdActionEventing + "Subscribe":
+		expires := "PT1H"
+		if msg.Body.Subscribe != nil && msg.Body.Subscribe.Expires != "" {
+			expires = msg.Body.Subscribe.Expires
+		}
+		return "SubscribeResponse", map[string]string{
+			"Manager": wsdBaseURL(r) + "/wsd/scan",
+			"ID":      randomUUID(),
+			"Expires": expires,
+		}, nil
+
+	case wsdActionEventing + "Renew":
+		expires := "PT1H"
+		if msg.Body.Renew != nil && msg.Body.Renew.Expires != "" {
+			expires = msg.Body.Renew.Expires
+		}
+		return "RenewResponse", map[string]string{"Expires": expires}, nil
+
+	case wsdActionEventing + "Unsubscribe":
+		return "UnsubscribeResponse", nil, nil
+	}
+
+	return "", nil, wsdSenderFault("wsa:ActionNotSupported", fmt.Sprintf("Unsupported action %q", msg.Header.Action))
+}
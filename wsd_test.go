@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// wsdRequest wraps the body into a SOAP envelope with the action
+func wsdRequest(action, body string) string {
+	return `<?xml version="1.0" encoding="utf-8"?>
+<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:sca="http://schemas.microsoft.com/windows/2006/08/wdp/scan">
+<soap:Header>
+<wsa:To>urn:uuid:00000000-0000-0000-0000-000000000000</wsa:To>
+<wsa:Action>` + action + `</wsa:Action>
+<wsa:MessageID>urn:uuid:11111111-2222-3333-4444-555555555555</wsa:MessageID>
+</soap:Header>
+<soap:Body>` + body + `</soap:Body>
+</soap:Envelope>`
+}
+
+// wsdResponse is the part of a response checked by the tests
+type wsdResponse struct {
+	Header struct {
+		Action    string `xml:"Action"`
+		RelatesTo string `xml:"RelatesTo"`
+	} `xml:"Header"`
+	Fault *struct {
+		Subcode string `xml:"Code>Subcode>Value"`
+		Reason  string `xml:"Reason>Text"`
+	} `xml:"Body>Fault"`
+}
+
+func TestWSDEnvelope(t *testing.T) {
+	var msg wsdEnvelope
+	err := xml.Unmarshal([]byte(wsdRequest(wsdNSScan+"/CreateScanJob", `<sca:CreateScanJobRequest><sca:ScanTicket>
+<sca:JobDescription><sca:JobName>Scan</sca:JobName></sca:JobDescription>
+<sca:DocumentParameters>
+<sca:Format>pdf-a</sca:Format>
+<sca:InputSource>ADFDuplex</sca:InputSource>
+<sca:InputSize><sca:InputMediaSize><sca:Width>8500</sca:Width><sca:Height>11000</sca:Height></sca:InputMediaSize></sca:InputSize>
+<sca:MediaSides><sca:MediaFront><sca:ColorProcessing>Grayscale8</sca:ColorProcessing>
+<sca:Resolution><sca:Width>300</sca:Width><sca:Height>300</sca:Height></sca:Resolution></sca:MediaFront></sca:MediaSides>
+</sca:DocumentParameters>
+</sca:ScanTicket></sca:CreateScanJobRequest>`)), &msg)
+	if err != nil {
+		t.Fatalf("decoding message: %s", err)
+	}
+
+	if msg.Header.Action != wsdNSScan+"/CreateScanJob" || msg.Header.MessageID != "urn:uuid:11111111-2222-3333-4444-555555555555" {
+		t.Errorf("unexpected header %+v", msg.Header)
+	}
+	if msg.Body.CreateScanJob == nil {
+		t.Fatalf("scan ticket not decoded")
+	}
+	exp := wsdScanTicket{Format: "pdf-a", InputSource: "ADFDuplex", ColorProcessing: "Grayscale8", Resolution: 300, Width: 8500, Height: 11000}
+	if got := msg.Body.CreateScanJob.Ticket; got != exp {
+		t.Errorf("expected ticket %+v, got %+v", exp, got)
+	}
+}
+
+func TestWSDMessage(t *testing.T) {
+	out, err := wsdMessage(map[string]interface{}{"Action": wsdActionFault, "RelatesTo": "urn:uuid:<&>"}, "Fault",
+		wsdSenderFault("wscn:ClientErrorInvalidArgs", `Invalid "ticket" <value> & more`))
+	if err != nil {
+		t.Fatalf("rendering message: %s", err)
+	}
+
+	var res wsdResponse
+	if err = xml.Unmarshal(out, &res); err != nil {
+		t.Fatalf("parsing message: %s\n%s", err, out)
+	}
+	if res.Header.Action != wsdActionFault || res.Header.RelatesTo != "urn:uuid:<&>" {
+		t.Errorf("unexpected header %+v", res.Header)
+	}
+	if res.Fault == nil || res.Fault.Subcode != "wscn:ClientErrorInvalidArgs" || res.Fault.Reason != `Invalid "ticket" <value> & more` {
+		t.Errorf("unexpected fault %+v", res.Fault)
+	}
+}
+
+func TestHandleWSDMalformed(t *testing.T) {
+	for name, tc := range map[string]struct {
+		body    string
+		subcode string
+	}{
+		"no XML":             {"hello world", ""},
+		"truncated":          {wsdRequest(wsdNSScan+"/CreateScanJob", "")[:200], ""},
+		"unsupported action": {wsdRequest("urn:unknown", ""), "wsa:ActionNotSupported"},
+		"missing ticket":     {wsdRequest(wsdNSScan+"/CreateScanJob", ""), "wscn:ClientErrorInvalidArgs"},
+		"unsupported format": {
+			wsdRequest(wsdNSScan+"/CreateScanJob", `<sca:CreateScanJobRequest><sca:ScanTicket><sca:DocumentParameters><sca:Format>tiff-single-g4</sca:Format></sca:DocumentParameters></sca:ScanTicket></sca:CreateScanJobRequest>`),
+			"wscn:ClientErrorFormatNotSupported",
+		},
+		"flatbed": {
+			wsdRequest(wsdNSScan+"/CreateScanJob", `<sca:CreateScanJobRequest><sca:ScanTicket><sca:DocumentParameters><sca:InputSource>Platen</sca:InputSource></sca:DocumentParameters></sca:ScanTicket></sca:CreateScanJobRequest>`),
+			"wscn:ClientErrorInputSourceNotSupported",
+		},
+		"unknown job": {
+			wsdRequest(wsdNSScan+"/GetJobElements", `<sca:GetJobElementsRequest><sca:JobId>999999</sca:JobId></sca:GetJobElementsRequest>`),
+			"wscn:ClientErrorJobIdNotFound",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			res := httptest.NewRecorder()
+			handleWSD(res, httptest.NewRequest(http.MethodPost, "/wsd/scan", strings.NewReader(tc.body)))
+
+			if res.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", res.Code)
+			}
+
+			var msg wsdResponse
+			if err := xml.Unmarshal(res.Body.Bytes(), &msg); err != nil {
+				t.Fatalf("parsing fault: %s", err)
+			}
+			if msg.Fault == nil || msg.Fault.Subcode != tc.subcode {
+				t.Errorf("expected fault %q, got %+v", tc.subcode, msg.Fault)
+			}
+			if tc.subcode != "" && msg.Header.RelatesTo != "urn:uuid:11111111-2222-3333-4444-555555555555" {
+				t.Errorf("fault does not relate to the request: %q", msg.Header.RelatesTo)
+			}
+		})
+	}
+}
+
+func TestWSDProbeMatches(t *testing.T) {
+	for types, exp := range map[string]bool{
+		"":                                 true,
+		"wsdp:Device":                      true,
+		"wsdp:Device wscn:ScanDeviceType":  true,
+		"wsdp:Device wprt:PrintDeviceType": false,
+	} {
+		if got := wsdProbeMatches(types); got != exp {
+			t.Errorf("%q: expected %v, got %v", types, exp, got)
+		}
+	}
+}